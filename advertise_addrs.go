@@ -0,0 +1,172 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// maxAdvertisedPortRange caps how many addresses a single lighthouse.advertise_addrs port range can expand to
+const maxAdvertisedPortRange = MaxRemotes
+
+// advertiseAddr is a single address we report to lighthouses, along with how peers should rank it
+type advertiseAddr struct {
+	addr     netip.AddrPort
+	priority uint32
+	tag      AddrTag
+}
+
+// parseAddrTag converts the config form of a tag to an AddrTag
+func parseAddrTag(raw string) (AddrTag, error) {
+	switch strings.ToLower(raw) {
+	case "":
+		return AddrTag_Untagged, nil
+	case "public":
+		return AddrTag_Public, nil
+	case "private":
+		return AddrTag_Private, nil
+	case "relay-only", "relay_only":
+		return AddrTag_RelayOnly, nil
+	default:
+		return AddrTag_Untagged, fmt.Errorf("unknown tag %q, expected public, private, or relay-only", raw)
+	}
+}
+
+// parsePortRange parses a port, or an inclusive range of ports like 4242-4250
+func parsePortRange(raw string) (uint16, uint16, error) {
+	lo, hi, isRange := strings.Cut(raw, "-")
+	start, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !isRange {
+		return uint16(start), uint16(start), nil
+	}
+
+	end, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid port range %q", raw)
+	}
+
+	if end-start+1 > maxAdvertisedPortRange {
+		return 0, 0, fmt.Errorf("port range %q is larger than %d ports", raw, maxAdvertisedPortRange)
+	}
+
+	return uint16(start), uint16(end), nil
+}
+
+// newAdvertiseAddrsFromConfig reads lighthouse.advertise_addrs. Entries are either a plain `host:port` string or a map
+// with an `addr`, and optionally a `priority` and `tag`. The port may be a range, which advertises every port in it.
+// The result is sorted with the highest priority first.
+func newAdvertiseAddrsFromConfig(c *config.C, nebulaPort uint32, skip func(netip.Addr) bool, warn func(rawAddr string, entry int)) ([]advertiseAddr, error) {
+	raw := c.Get("lighthouse.advertise_addrs")
+	if raw == nil {
+		return []advertiseAddr{}, nil
+	}
+
+	rawList, ok := raw.([]any)
+	if !ok {
+		return nil, util.NewContextualError("lighthouse.advertise_addrs must be a list", m{"type": fmt.Sprintf("%T", raw)}, nil)
+	}
+
+	advAddrs := make([]advertiseAddr, 0, len(rawList))
+	for i, rawEntry := range rawList {
+		var rawAddr string
+		var priority uint32
+		var tag AddrTag
+
+		switch v := rawEntry.(type) {
+		case string:
+			rawAddr = v
+
+		case map[string]any:
+			rawAddr = fmt.Sprintf("%v", v["addr"])
+			if v["addr"] == nil {
+				return nil, util.NewContextualError("lighthouse.advertise_addrs entry is missing addr", m{"entry": i + 1}, nil)
+			}
+
+			if p, ok := v["priority"]; ok {
+				pi, err := strconv.ParseUint(fmt.Sprintf("%v", p), 10, 32)
+				if err != nil {
+					return nil, util.NewContextualError("Unable to parse priority in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+				}
+				priority = uint32(pi)
+			}
+
+			if t, ok := v["tag"]; ok {
+				var err error
+				tag, err = parseAddrTag(fmt.Sprintf("%v", t))
+				if err != nil {
+					return nil, util.NewContextualError("Unable to parse tag in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+				}
+			}
+
+		default:
+			return nil, util.NewContextualError("lighthouse.advertise_addrs entry must be a string or a map", m{"entry": i + 1}, nil)
+		}
+
+		host, sport, err := net.SplitHostPort(rawAddr)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+		if len(addrs) == 0 {
+			return nil, util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, nil)
+		}
+
+		start, end, err := parsePortRange(sport)
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse port in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
+		}
+
+		if start == 0 {
+			start = uint16(nebulaPort)
+			end = start
+		}
+
+		//TODO: we could technically insert all returned addrs instead of just the first one if a dns lookup was used
+		addr := addrs[0].Unmap()
+		if skip(addr) {
+			warn(rawAddr, i+1)
+			continue
+		}
+
+		for port := uint32(start); port <= uint32(end); port++ {
+			advAddrs = append(advAddrs, advertiseAddr{
+				addr:     netip.AddrPortFrom(addr, uint16(port)),
+				priority: priority,
+				tag:      tag,
+			})
+		}
+	}
+
+	// Keep config order within the same priority
+	slices.SortStableFunc(advAddrs, func(a, b advertiseAddr) int {
+		switch {
+		case a.priority > b.priority:
+			return -1
+		case a.priority < b.priority:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return advAddrs, nil
+}
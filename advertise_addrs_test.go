@@ -0,0 +1,74 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAdvertiseAddrsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	skip := func(addr netip.Addr) bool { return addr == netip.MustParseAddr("10.128.0.1") }
+	var warned []int
+	warn := func(_ string, entry int) { warned = append(warned, entry) }
+
+	advAddrs, err := newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.NoError(t, err)
+	assert.Empty(t, advAddrs)
+
+	c.Settings["lighthouse"] = map[string]any{"advertise_addrs": []any{
+		"1.1.1.1:0",
+		"10.128.0.1:4242",
+		map[string]any{"addr": "2.2.2.2:5000-5002", "priority": 10, "tag": "relay-only"},
+		map[string]any{"addr": "[1::1]:4242", "priority": 20, "tag": "private"},
+	}}
+	advAddrs, err = newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, warned)
+	assert.Equal(t, []advertiseAddr{
+		{addr: netip.MustParseAddrPort("[1::1]:4242"), priority: 20, tag: AddrTag_Private},
+		{addr: netip.MustParseAddrPort("2.2.2.2:5000"), priority: 10, tag: AddrTag_RelayOnly},
+		{addr: netip.MustParseAddrPort("2.2.2.2:5001"), priority: 10, tag: AddrTag_RelayOnly},
+		{addr: netip.MustParseAddrPort("2.2.2.2:5002"), priority: 10, tag: AddrTag_RelayOnly},
+		{addr: netip.MustParseAddrPort("1.1.1.1:4242")},
+	}, advAddrs)
+
+	c.Settings["lighthouse"] = map[string]any{"advertise_addrs": []any{map[string]any{"addr": "1.1.1.1:4242", "tag": "nope"}}}
+	_, err = newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.ErrorContains(t, err, "Unable to parse tag in lighthouse.advertise_addrs entry")
+
+	c.Settings["lighthouse"] = map[string]any{"advertise_addrs": []any{map[string]any{"priority": 1}}}
+	_, err = newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.ErrorContains(t, err, "lighthouse.advertise_addrs entry is missing addr")
+
+	c.Settings["lighthouse"] = map[string]any{"advertise_addrs": []any{"1.1.1.1:5000-4000"}}
+	_, err = newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.ErrorContains(t, err, "Unable to parse port in lighthouse.advertise_addrs entry")
+
+	c.Settings["lighthouse"] = map[string]any{"advertise_addrs": []any{"1.1.1.1:1000-2000"}}
+	_, err = newAdvertiseAddrsFromConfig(c, 4242, skip, warn)
+	require.ErrorContains(t, err, "Unable to parse port in lighthouse.advertise_addrs entry")
+}
+
+func TestParsePortRange(t *testing.T) {
+	start, end, err := parsePortRange("4242")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(4242), start)
+	assert.Equal(t, uint16(4242), end)
+
+	start, end, err = parsePortRange("4242-4245")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(4242), start)
+	assert.Equal(t, uint16(4245), end)
+
+	_, _, err = parsePortRange("0-10")
+	require.Error(t, err)
+
+	_, _, err = parsePortRange("nope")
+	require.Error(t, err)
+}
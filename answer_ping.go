@@ -0,0 +1,53 @@
+package nebula
+
+import (
+	"net/netip"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// With tun.answer_ping nebula replies to pings for this host's vpn addresses itself rather than handing them to the
+// tun device, so reachability checks work no matter what the host firewall does with icmp. The nebula firewall still
+// has to let the ping in.
+
+func (f *Interface) reloadAnswerPing(c *config.C) {
+	initial := c.InitialLoad()
+	if !initial && !c.HasChanged("tun.answer_ping") {
+		return
+	}
+
+	f.answerPing.Store(c.GetBool("tun.answer_ping", false))
+	if !initial {
+		f.l.Infof("tun.answer_ping changed to %v", f.answerPing.Load())
+	}
+}
+
+// answerPingOutside replies to an echo request that hostinfo sent to one of our vpn addresses. packet is the decrypted
+// request, out is a buffer we can build the reply in, and packet is reused to encrypt the reply. It reports whether
+// the ping was answered, if so the request must not go on to the tun device.
+func (f *Interface) answerPingOutside(hostinfo *HostInfo, fwPacket *firewall.Packet, packet, out, nb []byte, q int) bool {
+	if !f.answerPing.Load() || !f.myVpnAddrsTable.Contains(fwPacket.LocalAddr) {
+		return false
+	}
+
+	var reply []byte
+	switch fwPacket.Protocol {
+	case firewall.ProtoICMP:
+		if cap(out) < len(packet) {
+			return false
+		}
+		reply = iputil.CreateICMPEchoResponse(packet, out)
+	case firewall.ProtoICMPv6:
+		reply = iputil.CreateICMPv6EchoResponse(packet, out)
+	}
+
+	if reply == nil {
+		return false
+	}
+
+	f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, reply, nb, packet, q)
+	return true
+}
@@ -0,0 +1,235 @@
+// Package beacon announces this node on the local network and listens for other nodes doing the same, so peers on
+// the same LAN can reach each other directly even when the lighthouses are unreachable or only know public addresses.
+package beacon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+
+	// maxAnnouncementSize keeps announcements within a single unfragmented datagram
+	maxAnnouncementSize = 1200
+)
+
+// DefaultGroup is an administratively scoped multicast group, it does not leave the local site
+var DefaultGroup = netip.MustParseAddrPort("239.255.77.77:4244")
+
+// magic prefixes every announcement so stray traffic on the group is ignored cheaply
+var magic = []byte("nebula-beacon\x01")
+
+var ErrNotAnnouncement = errors.New("not a beacon announcement")
+
+// Announcement is what a node multicasts about itself. It is not authenticated, the receiver only uses it to try an
+// underlay address and the handshake proves who is actually there.
+type Announcement struct {
+	VpnAddrs    []netip.Addr `json:"vpnAddrs"`
+	Fingerprint string       `json:"fingerprint"`
+	Port        uint16       `json:"port"`
+}
+
+func (a Announcement) Marshal() ([]byte, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append(bytes.Clone(magic), b...)
+	if len(out) > maxAnnouncementSize {
+		return nil, fmt.Errorf("announcement is %d bytes, more than the %d allowed", len(out), maxAnnouncementSize)
+	}
+	return out, nil
+}
+
+func Unmarshal(b []byte) (Announcement, error) {
+	var a Announcement
+	if !bytes.HasPrefix(b, magic) {
+		return a, ErrNotAnnouncement
+	}
+
+	if err := json.Unmarshal(b[len(magic):], &a); err != nil {
+		return a, fmt.Errorf("%w: %w", ErrNotAnnouncement, err)
+	}
+
+	if len(a.VpnAddrs) == 0 || a.Port == 0 {
+		return a, fmt.Errorf("%w: missing vpn addresses or port", ErrNotAnnouncement)
+	}
+
+	return a, nil
+}
+
+// Config is the parsed form of the lan_discovery config stanza
+type Config struct {
+	Group      netip.AddrPort
+	Interval   time.Duration
+	Interfaces []string
+}
+
+// NewConfigFromConfig parses the beacon stanza at k. A nil Config is returned if it is not enabled.
+func NewConfigFromConfig(c *config.C, k string) (*Config, error) {
+	if !c.GetBool(k+".enabled", false) {
+		return nil, nil
+	}
+
+	bc := &Config{
+		Group:      DefaultGroup,
+		Interval:   c.GetDuration(k+".interval", DefaultInterval),
+		Interfaces: c.GetStringSlice(k+".interfaces", nil),
+	}
+
+	if bc.Interval <= 0 {
+		return nil, fmt.Errorf("config `%s.interval` must be greater than 0", k)
+	}
+
+	if rg := c.GetString(k+".group", ""); rg != "" {
+		g, err := netip.ParseAddrPort(rg)
+		if err != nil {
+			return nil, fmt.Errorf("config `%s.group` is invalid: %w", k, err)
+		}
+
+		if !g.Addr().IsMulticast() {
+			return nil, fmt.Errorf("config `%s.group` is not a multicast address: %v", k, g)
+		}
+		bc.Group = g
+	}
+
+	return bc, nil
+}
+
+// Run announces every Interval and calls onPeer with announcements heard from the group, along with the address they
+// came from. announce is called before every announcement, nothing is sent while it returns false. Run returns once
+// the listeners are up, they stop when ctx is done.
+func Run(ctx context.Context, l *logrus.Logger, bc *Config, announce func() (Announcement, bool), onPeer func(Announcement, netip.Addr)) error {
+	var ifaces []*net.Interface
+	if len(bc.Interfaces) == 0 {
+		ifaces = []*net.Interface{nil}
+	}
+
+	for _, name := range bc.Interfaces {
+		ifi, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %w", name, err)
+		}
+		ifaces = append(ifaces, ifi)
+	}
+
+	network := "udp4"
+	if bc.Group.Addr().Is6() {
+		network = "udp6"
+	}
+	group := net.UDPAddrFromAddrPort(bc.Group)
+
+	var conns []*net.UDPConn
+	for _, ifi := range ifaces {
+		conn, err := net.ListenMulticastUDP(network, ifi, group)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("failed to join %v: %w", bc.Group, err)
+		}
+
+		if ifi != nil {
+			if bc.Group.Addr().Is4() {
+				err = ipv4.NewPacketConn(conn).SetMulticastInterface(ifi)
+			} else {
+				err = ipv6.NewPacketConn(conn).SetMulticastInterface(ifi)
+			}
+			if err != nil {
+				conn.Close()
+				for _, c := range conns {
+					c.Close()
+				}
+				return fmt.Errorf("failed to send on %s: %w", ifi.Name, err)
+			}
+		}
+
+		conns = append(conns, conn)
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listen(l, conn, onPeer)
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(bc.Interval)
+		defer ticker.Stop()
+
+		for {
+			send(l, conns, group, announce)
+
+			select {
+			case <-ctx.Done():
+				for _, conn := range conns {
+					conn.Close()
+				}
+				wg.Wait()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func send(l *logrus.Logger, conns []*net.UDPConn, group *net.UDPAddr, announce func() (Announcement, bool)) {
+	a, ok := announce()
+	if !ok {
+		return
+	}
+
+	b, err := a.Marshal()
+	if err != nil {
+		l.WithError(err).Error("Failed to marshal lan discovery announcement")
+		return
+	}
+
+	for _, conn := range conns {
+		if _, err := conn.WriteToUDP(b, group); err != nil {
+			l.WithError(err).WithField("group", group).Debug("Failed to send lan discovery announcement")
+		}
+	}
+}
+
+func listen(l *logrus.Logger, conn *net.UDPConn, onPeer func(Announcement, netip.Addr)) {
+	b := make([]byte, maxAnnouncementSize)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				l.WithError(err).Error("Failed to read lan discovery announcement")
+			}
+			return
+		}
+
+		a, err := Unmarshal(b[:n])
+		if err != nil {
+			if l.Level >= logrus.DebugLevel {
+				l.WithError(err).WithField("from", from).Debug("Ignoring lan discovery packet")
+			}
+			continue
+		}
+
+		onPeer(a, from.Addr().Unmap())
+	}
+}
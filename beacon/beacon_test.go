@@ -0,0 +1,100 @@
+package beacon
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncement(t *testing.T) {
+	a := Announcement{
+		VpnAddrs:    []netip.Addr{netip.MustParseAddr("10.128.0.1"), netip.MustParseAddr("fd00::1")},
+		Fingerprint: "abcd",
+		Port:        4242,
+	}
+
+	b, err := a.Marshal()
+	require.NoError(t, err)
+
+	a2, err := Unmarshal(b)
+	require.NoError(t, err)
+	assert.Equal(t, a, a2)
+
+	_, err = Unmarshal([]byte("hello"))
+	require.ErrorIs(t, err, ErrNotAnnouncement)
+
+	_, err = Unmarshal(append(bytes.Clone(magic), []byte("{")...))
+	require.ErrorIs(t, err, ErrNotAnnouncement)
+
+	_, err = Unmarshal(append(bytes.Clone(magic), []byte(`{"port": 4242}`)...))
+	require.ErrorIs(t, err, ErrNotAnnouncement)
+
+	a.VpnAddrs = make([]netip.Addr, 200)
+	for i := range a.VpnAddrs {
+		a.VpnAddrs[i] = netip.MustParseAddr("fd00::1")
+	}
+	_, err = a.Marshal()
+	require.Error(t, err)
+}
+
+func TestNewConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	bc, err := NewConfigFromConfig(c, "lan_discovery")
+	require.NoError(t, err)
+	assert.Nil(t, bc)
+
+	c.Settings["lan_discovery"] = map[string]any{"enabled": true}
+	bc, err = NewConfigFromConfig(c, "lan_discovery")
+	require.NoError(t, err)
+	assert.Equal(t, &Config{Group: DefaultGroup, Interval: DefaultInterval}, bc)
+
+	c.Settings["lan_discovery"] = map[string]any{"enabled": true, "group": "[ff02::114]:5000", "interval": "1s", "interfaces": []any{"eth0"}}
+	bc, err = NewConfigFromConfig(c, "lan_discovery")
+	require.NoError(t, err)
+	assert.Equal(t, &Config{Group: netip.MustParseAddrPort("[ff02::114]:5000"), Interval: time.Second, Interfaces: []string{"eth0"}}, bc)
+
+	c.Settings["lan_discovery"] = map[string]any{"enabled": true, "group": "10.0.0.1:4244"}
+	_, err = NewConfigFromConfig(c, "lan_discovery")
+	require.EqualError(t, err, "config `lan_discovery.group` is not a multicast address: 10.0.0.1:4244")
+
+	c.Settings["lan_discovery"] = map[string]any{"enabled": true, "interval": "-1s"}
+	_, err = NewConfigFromConfig(c, "lan_discovery")
+	require.EqualError(t, err, "config `lan_discovery.interval` must be greater than 0")
+}
+
+func TestRun(t *testing.T) {
+	l := test.NewLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bc := &Config{Group: netip.MustParseAddrPort("239.255.77.77:24244"), Interval: 50 * time.Millisecond}
+	a := Announcement{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.128.0.1")}, Fingerprint: "abcd", Port: 4242}
+
+	heard := make(chan Announcement, 10)
+	err := Run(ctx, l, bc, func() (Announcement, bool) { return a, true }, func(a Announcement, _ netip.Addr) {
+		select {
+		case heard <- a:
+		default:
+		}
+	})
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+
+	// Multicast loopback hands us our own announcements, if the host routes multicast at all
+	select {
+	case got := <-heard:
+		assert.Equal(t, a, got)
+	case <-time.After(time.Second):
+		t.Skip("multicast is not routed on this host")
+	}
+}
@@ -0,0 +1,155 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+// Broadcast and multicast packets from the inside have no single host to go to. With broadcast.groups set, hosts in
+// those groups form a broadcast domain: we copy these packets to every host in the groups we have a tunnel with and
+// accept them from those hosts, which lets mDNS, SSDP, and LAN game discovery work over the overlay. Copies are never
+// a reason to start a handshake, tunnels.preconnect can keep tunnels to the domain up.
+
+var errBroadcastNotAllowed = errors.New("peer is not in the broadcast domain")
+
+// limitedBroadcast is the ipv4 all hosts broadcast address
+var limitedBroadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+type broadcastDomain struct {
+	groups []string
+
+	// out limits the copies we send and in the broadcasts we accept, in packets
+	out, in *tokenBucket
+
+	sent, dropped metrics.Counter
+}
+
+func newBroadcastDomainFromConfig(c *config.C) (*broadcastDomain, error) {
+	b := &broadcastDomain{
+		groups:  c.GetStringSlice("broadcast.groups", []string{}),
+		sent:    metrics.GetOrRegisterCounter("broadcast.sent", nil),
+		dropped: metrics.GetOrRegisterCounter("broadcast.dropped", nil),
+	}
+
+	rate := c.GetInt("broadcast.rate", 100)
+	burst := c.GetInt("broadcast.burst", rate)
+	if rate < 1 {
+		return nil, fmt.Errorf("broadcast.rate must be at least 1 packet per second")
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("broadcast.burst must be at least 1 packet")
+	}
+
+	b.out = newTokenBucket(uint64(rate), uint64(burst))
+	b.in = newTokenBucket(uint64(rate), uint64(burst))
+	return b, nil
+}
+
+func (b *broadcastDomain) enabled() bool {
+	return b != nil && len(b.groups) > 0
+}
+
+// member reports whether hostinfo is in any of the domain's groups
+func (b *broadcastDomain) member(hostinfo *HostInfo) bool {
+	if hostinfo.ConnectionState == nil || hostinfo.ConnectionState.peerCert == nil {
+		return false
+	}
+
+	for _, g := range b.groups {
+		if _, ok := hostinfo.ConnectionState.peerCert.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Interface) reloadBroadcast(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("broadcast") {
+		return
+	}
+
+	b, err := newBroadcastDomainFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load broadcast config, keeping the previous one")
+		return
+	}
+
+	f.broadcast.Store(b)
+	if b.enabled() {
+		f.l.WithFields(logrus.Fields{"groups": b.groups, "rate": b.out.rate, "burst": b.out.burst}).
+			Info("Broadcast and multicast packets will be sent to hosts in the broadcast groups")
+	}
+}
+
+// overlayBroadcast reports whether addr is a broadcast or multicast address handled by the broadcast domain
+func (f *Interface) overlayBroadcast(addr netip.Addr) bool {
+	if !f.broadcast.Load().enabled() {
+		return false
+	}
+
+	return addr.IsMulticast() || addr == limitedBroadcast || f.myBroadcastAddrsTable.Contains(addr)
+}
+
+// sendBroadcast copies an inside broadcast or multicast packet to every member of the domain we have a tunnel with
+func (f *Interface) sendBroadcast(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	b := f.broadcast.Load()
+
+	members := map[*HostInfo]struct{}{}
+	f.hostMap.ForEachVpnAddr(func(hostinfo *HostInfo) {
+		if b.member(hostinfo) && hasAddrFamily(hostinfo.vpnAddrs, fwPacket.RemoteAddr.Is4()) {
+			members[hostinfo] = struct{}{}
+		}
+	})
+
+	now := time.Now()
+	for hostinfo := range members {
+		if !b.out.allow(now, 1) {
+			b.dropped.Inc(1)
+			continue
+		}
+
+		if err := f.firewall.DropBroadcast(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache); err != nil {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("fwPacket", fwPacket).WithField("reason", err).
+					Debugln("dropping outbound broadcast")
+			}
+			continue
+		}
+
+		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q)
+		b.sent.Inc(1)
+	}
+}
+
+func hasAddrFamily(addrs []netip.Addr, is4 bool) bool {
+	for _, addr := range addrs {
+		if addr.Is4() == is4 {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptBroadcast is the firewall check for a broadcast or multicast packet from hostinfo
+func (f *Interface) acceptBroadcast(hostinfo *HostInfo, fwPacket *firewall.Packet, localCache firewall.ConntrackCache) error {
+	b := f.broadcast.Load()
+	if !b.enabled() || !b.member(hostinfo) {
+		return errBroadcastNotAllowed
+	}
+
+	if !b.in.allow(time.Now(), 1) {
+		b.dropped.Inc(1)
+		return errBroadcastNotAllowed
+	}
+
+	return f.firewall.DropBroadcast(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+}
@@ -0,0 +1,107 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBroadcastDomainFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	b, err := newBroadcastDomainFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, b.enabled())
+	assert.False(t, (*broadcastDomain)(nil).enabled())
+
+	c.Settings["broadcast"] = map[string]any{"groups": []any{"lan"}, "rate": 2}
+	b, err = newBroadcastDomainFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, b.enabled())
+
+	// Burst defaults to a second of rate
+	now := time.Now()
+	assert.True(t, b.out.allow(now, 1))
+	assert.True(t, b.out.allow(now, 1))
+	assert.False(t, b.out.allow(now, 1))
+	// Sending and accepting are limited apart
+	assert.True(t, b.in.allow(now, 1))
+
+	member := &HostInfo{ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{InvertedGroups: map[string]struct{}{"lan": {}}}}}
+	other := &HostInfo{ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{InvertedGroups: map[string]struct{}{"web": {}}}}}
+	assert.True(t, b.member(member))
+	assert.False(t, b.member(other))
+	assert.False(t, b.member(&HostInfo{ConnectionState: &ConnectionState{}}))
+
+	c.Settings["broadcast"] = map[string]any{"groups": []any{"lan"}, "rate": 0}
+	_, err = newBroadcastDomainFromConfig(c)
+	require.Error(t, err)
+
+	c.Settings["broadcast"] = map[string]any{"groups": []any{"lan"}, "burst": -1}
+	_, err = newBroadcastDomainFromConfig(c)
+	require.Error(t, err)
+}
+
+func TestFirewall_DropBroadcast(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(netip.MustParsePrefix("10.0.0.0/24"))
+
+	me := dummyCert{name: "me", networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}}
+	them := dummyCert{name: "them", networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")}, groups: []string{"lan"}}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{Certificate: &them, InvertedGroups: map[string]struct{}{"lan": {}}},
+		},
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+	}
+	h.buildNetworks(myVpnNetworksTable, &them)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &me)
+	require.NoError(t, fw.AddRule(true, firewall.ProtoUDP, 5353, 5353, []string{"lan"}, "", "", "", "", ""))
+	require.NoError(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, []string{"any"}, "", "", "", "", ""))
+	cp := cert.NewCAPool()
+
+	// An mDNS query from them
+	in := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("224.0.0.251"),
+		RemoteAddr: netip.MustParseAddr("10.0.0.2"),
+		LocalPort:  5353,
+		RemotePort: 5353,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.Equal(t, ErrInvalidLocalIP, fw.Drop(in, true, &h, cp, nil))
+	require.NoError(t, fw.DropBroadcast(in, true, &h, cp, nil))
+
+	// The rules still apply
+	in.LocalPort = 1900
+	in.RemotePort = 1900
+	assert.Equal(t, ErrNoMatchingRule, fw.DropBroadcast(in, true, &h, cp, nil))
+
+	// And the sender has to be who they say
+	in.LocalPort = 5353
+	in.RemoteAddr = netip.MustParseAddr("10.0.0.3")
+	assert.Equal(t, ErrInvalidRemoteIP, fw.DropBroadcast(in, true, &h, cp, nil))
+
+	// Our own mDNS query to them
+	out := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("10.0.0.1"),
+		RemoteAddr: netip.MustParseAddr("224.0.0.251"),
+		LocalPort:  5353,
+		RemotePort: 5353,
+		Protocol:   firewall.ProtoUDP,
+	}
+	assert.Equal(t, ErrInvalidRemoteIP, fw.Drop(out, false, &h, cp, nil))
+	require.NoError(t, fw.DropBroadcast(out, false, &h, cp, nil))
+
+	out.LocalAddr = netip.MustParseAddr("192.168.0.1")
+	assert.Equal(t, ErrInvalidLocalIP, fw.DropBroadcast(out, false, &h, cp, nil))
+}
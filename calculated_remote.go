@@ -53,7 +53,7 @@ func (c *calculatedRemote) ApplyV4(addr netip.Addr) *V4AddrPort {
 	b = addr.As4()
 	intAddr := binary.BigEndian.Uint32(b[:])
 
-	return &V4AddrPort{(maskAddr & mask) | (intAddr & ^mask), c.port}
+	return &V4AddrPort{Addr: (maskAddr & mask) | (intAddr & ^mask), Port: c.port}
 }
 
 func (c *calculatedRemote) ApplyV6(addr netip.Addr) *V6AddrPort {
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"path"
 	"slices"
 	"strings"
 	"time"
@@ -12,13 +13,20 @@ import (
 type CAPool struct {
 	CAs           map[string]*CachedCertificate
 	certBlocklist map[string]struct{}
+	// nameBlocklist holds path.Match patterns for certificate names, exact names are patterns without wildcards
+	nameBlocklist  []string
+	groupBlocklist map[string]struct{}
+	issuanceLog    *IssuanceLog
+	skewTolerance  time.Duration
+	expiredGrace   time.Duration
 }
 
 // NewCAPool creates an empty CAPool
 func NewCAPool() *CAPool {
 	ca := CAPool{
-		CAs:           make(map[string]*CachedCertificate),
-		certBlocklist: make(map[string]struct{}),
+		CAs:            make(map[string]*CachedCertificate),
+		certBlocklist:  make(map[string]struct{}),
+		groupBlocklist: make(map[string]struct{}),
 	}
 
 	return &ca
@@ -109,9 +117,26 @@ func (ncp *CAPool) BlocklistFingerprint(f string) {
 	ncp.certBlocklist[f] = struct{}{}
 }
 
-// ResetCertBlocklist removes all previously blocklisted cert fingerprints
+// BlocklistName blocks every cert with a name matching pattern, which may use the wildcards of path.Match
+func (ncp *CAPool) BlocklistName(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+	}
+
+	ncp.nameBlocklist = append(ncp.nameBlocklist, pattern)
+	return nil
+}
+
+// BlocklistGroup blocks every cert in group
+func (ncp *CAPool) BlocklistGroup(group string) {
+	ncp.groupBlocklist[group] = struct{}{}
+}
+
+// ResetCertBlocklist removes all previously blocklisted cert fingerprints, names, and groups
 func (ncp *CAPool) ResetCertBlocklist() {
 	ncp.certBlocklist = make(map[string]struct{})
+	ncp.nameBlocklist = nil
+	ncp.groupBlocklist = make(map[string]struct{})
 }
 
 // IsBlocklisted tests the provided fingerprint against the pools blocklist.
@@ -124,80 +149,166 @@ func (ncp *CAPool) IsBlocklisted(fingerprint string) bool {
 	return false
 }
 
+// IsCertificateBlocklisted tests the provided cert against the pools fingerprint, name, and group blocklists.
+// Returns true if the cert is blocked.
+func (ncp *CAPool) IsCertificateBlocklisted(c Certificate, fingerprint string) bool {
+	if ncp.IsBlocklisted(fingerprint) {
+		return true
+	}
+
+	if len(ncp.nameBlocklist) > 0 {
+		name := c.Name()
+		for _, pattern := range ncp.nameBlocklist {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	if len(ncp.groupBlocklist) > 0 {
+		for _, g := range c.Groups() {
+			if _, ok := ncp.groupBlocklist[g]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RequireIssuanceLog makes verification fail for any certificate that is not in l, a nil l removes the requirement
+func (ncp *CAPool) RequireIssuanceLog(l *IssuanceLog) {
+	ncp.issuanceLog = l
+}
+
+// SetClockSkewTolerance lets certificates verify for up to d past either end of their validity period, so hosts with
+// clocks that far apart still agree on which certificates are valid
+func (ncp *CAPool) SetClockSkewTolerance(d time.Duration) {
+	ncp.skewTolerance = d
+}
+
+// SetExpiredGrace lets a certificate that expired up to d ago, after the clock skew tolerance, still verify with
+// VerifyCertificateWithGrace and VerifyCachedCertificateWithGrace, so the caller can admit it and ask for a renewal.
+// VerifyCertificate and VerifyCachedCertificate are not affected. The root gets no grace.
+func (ncp *CAPool) SetExpiredGrace(d time.Duration) {
+	ncp.expiredGrace = d
+}
+
+// inExpiredGrace is true when c expired no more than the grace period ago
+func (ncp *CAPool) inExpiredGrace(c Certificate, now time.Time) bool {
+	return ncp.expiredGrace > 0 && !c.NotBefore().After(now.Add(ncp.skewTolerance)) &&
+		!c.NotAfter().Before(now.Add(-ncp.skewTolerance-ncp.expiredGrace))
+}
+
+// expired is Certificate.Expired with the clock skew tolerance applied
+func (ncp *CAPool) expired(c Certificate, now time.Time) bool {
+	return c.NotBefore().After(now.Add(ncp.skewTolerance)) || c.NotAfter().Before(now.Add(-ncp.skewTolerance))
+}
+
 // VerifyCertificate verifies the certificate is valid and is signed by a trusted CA in the pool.
 // If the certificate is valid then the returned CachedCertificate can be used in subsequent verification attempts
 // to increase performance.
 func (ncp *CAPool) VerifyCertificate(now time.Time, c Certificate) (*CachedCertificate, error) {
+	cc, _, err := ncp.verifyCertificate(now, c, false)
+	return cc, err
+}
+
+// VerifyCertificateWithGrace is the same as VerifyCertificate other than it also accepts a certificate that expired
+// within the expired grace period, inGrace is true when that is the only reason it was accepted.
+func (ncp *CAPool) VerifyCertificateWithGrace(now time.Time, c Certificate) (cc *CachedCertificate, inGrace bool, err error) {
+	return ncp.verifyCertificate(now, c, true)
+}
+
+func (ncp *CAPool) verifyCertificate(now time.Time, c Certificate, grace bool) (*CachedCertificate, bool, error) {
 	if c == nil {
-		return nil, fmt.Errorf("no certificate")
+		return nil, false, fmt.Errorf("no certificate")
 	}
 	fp, err := c.Fingerprint()
 	if err != nil {
-		return nil, fmt.Errorf("could not calculate fingerprint to verify: %w", err)
+		return nil, false, fmt.Errorf("could not calculate fingerprint to verify: %w", err)
 	}
 
-	signer, err := ncp.verify(c, now, fp, "")
+	signer, inGrace, err := ncp.verify(c, now, fp, "", grace)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	gs := invertedGroups(c.Groups())
 	cc := CachedCertificate{
 		Certificate:       c,
-		InvertedGroups:    make(map[string]struct{}),
+		InvertedGroups:    gs.m,
 		Fingerprint:       fp,
 		signerFingerprint: signer.Fingerprint,
+		groups:            gs,
 	}
 
-	for _, g := range c.Groups() {
-		cc.InvertedGroups[g] = struct{}{}
+	if inGrace {
+		// Only certificates that fully verify are shared
+		return &cc, true, nil
 	}
 
-	return &cc, nil
+	// The fingerprint covers the whole certificate, signature included, so an earlier copy is the same certificate
+	return verifiedCertificates.get(fp, &cc), false, nil
 }
 
 // VerifyCachedCertificate is the same as VerifyCertificate other than it operates on a pre-verified structure and
 // is a cheaper operation to perform as a result.
 func (ncp *CAPool) VerifyCachedCertificate(now time.Time, c *CachedCertificate) error {
-	_, err := ncp.verify(c.Certificate, now, c.Fingerprint, c.signerFingerprint)
+	_, _, err := ncp.verify(c.Certificate, now, c.Fingerprint, c.signerFingerprint, false)
 	return err
 }
 
-func (ncp *CAPool) verify(c Certificate, now time.Time, certFp string, signerFp string) (*CachedCertificate, error) {
-	if ncp.IsBlocklisted(certFp) {
-		return nil, ErrBlockListed
+// VerifyCachedCertificateWithGrace is the same as VerifyCertificateWithGrace other than it operates on a pre-verified
+// structure and is a cheaper operation to perform as a result.
+func (ncp *CAPool) VerifyCachedCertificateWithGrace(now time.Time, c *CachedCertificate) (inGrace bool, err error) {
+	_, inGrace, err = ncp.verify(c.Certificate, now, c.Fingerprint, c.signerFingerprint, true)
+	return inGrace, err
+}
+
+func (ncp *CAPool) verify(c Certificate, now time.Time, certFp string, signerFp string, grace bool) (*CachedCertificate, bool, error) {
+	if ncp.IsCertificateBlocklisted(c, certFp) {
+		return nil, false, ErrBlockListed
+	}
+
+	if ncp.issuanceLog != nil && !ncp.issuanceLog.Contains(certFp) {
+		return nil, false, ErrNotInIssuanceLog
 	}
 
 	signer, err := ncp.GetCAForCert(c)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	if signer.Certificate.Expired(now) {
-		return nil, ErrRootExpired
+	if ncp.expired(signer.Certificate, now) {
+		return nil, false, ErrRootExpired
 	}
 
-	if c.Expired(now) {
-		return nil, ErrExpired
+	inGrace := false
+	if ncp.expired(c, now) {
+		if !grace || !ncp.inExpiredGrace(c, now) {
+			return nil, false, ErrExpired
+		}
+		inGrace = true
 	}
 
 	// If we are checking a cached certificate then we can bail early here
 	// Either the root is no longer trusted or everything is fine
 	if len(signerFp) > 0 {
 		if signerFp != signer.Fingerprint {
-			return nil, ErrFingerprintMismatch
+			return nil, false, ErrFingerprintMismatch
 		}
-		return signer, nil
+		return signer, inGrace, nil
 	}
 	if !c.CheckSignature(signer.Certificate.PublicKey()) {
-		return nil, ErrSignatureMismatch
+		return nil, false, ErrSignatureMismatch
 	}
 
 	err = CheckCAConstraints(signer.Certificate, c)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return signer, nil
+	return signer, inGrace, nil
 }
 
 // GetCAForCert attempts to return the signing certificate for the provided certificate.
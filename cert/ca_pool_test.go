@@ -558,3 +558,128 @@ func TestCertificateV2_Verify_Subnets(t *testing.T) {
 	_, err = caPool.VerifyCertificate(time.Now(), c)
 	require.NoError(t, err)
 }
+
+func TestCAPool_ClockSkewTolerance(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	c, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "test cert", now, now.Add(10*time.Minute), nil, nil, nil)
+
+	caPool := NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	_, err := caPool.VerifyCertificate(now.Add(-time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+	_, err = caPool.VerifyCertificate(now.Add(11*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+
+	caPool.SetClockSkewTolerance(2 * time.Minute)
+	_, err = caPool.VerifyCertificate(now.Add(-time.Minute), c)
+	require.NoError(t, err)
+	_, err = caPool.VerifyCertificate(now.Add(11*time.Minute), c)
+	require.NoError(t, err)
+
+	_, err = caPool.VerifyCertificate(now.Add(-3*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+	_, err = caPool.VerifyCertificate(now.Add(13*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+
+	// The root gets the same allowance
+	_, err = caPool.VerifyCertificate(now.Add(63*time.Minute), c)
+	require.ErrorIs(t, err, ErrRootExpired)
+	caPool.SetClockSkewTolerance(2 * time.Hour)
+	_, err = caPool.VerifyCertificate(now.Add(63*time.Minute), c)
+	require.NoError(t, err)
+}
+
+func TestCAPool_ExpiredGrace(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	c, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "test cert", now, now.Add(10*time.Minute), nil, nil, nil)
+
+	caPool := NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	cc, err := caPool.VerifyCertificate(now.Add(15*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+	assert.Nil(t, cc)
+
+	caPool.SetExpiredGrace(10 * time.Minute)
+
+	// VerifyCertificate does not apply the grace
+	cc, err = caPool.VerifyCertificate(now.Add(15*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+	assert.Nil(t, cc)
+
+	cc, inGrace, err := caPool.VerifyCertificateWithGrace(now.Add(15*time.Minute), c)
+	require.NoError(t, err)
+	assert.True(t, inGrace)
+	require.NotNil(t, cc)
+	require.ErrorIs(t, caPool.VerifyCachedCertificate(now.Add(15*time.Minute), cc), ErrExpired)
+	inGrace, err = caPool.VerifyCachedCertificateWithGrace(now.Add(15*time.Minute), cc)
+	require.NoError(t, err)
+	assert.True(t, inGrace)
+
+	// Certificates only admitted for the grace are not interned
+	valid, err := caPool.VerifyCertificate(now.Add(5*time.Minute), c)
+	require.NoError(t, err)
+	assert.NotSame(t, cc, valid)
+
+	// Still valid certs are not flagged and the grace ends
+	inGrace, err = caPool.VerifyCachedCertificateWithGrace(now.Add(5*time.Minute), cc)
+	require.NoError(t, err)
+	assert.False(t, inGrace)
+	_, err = caPool.VerifyCachedCertificateWithGrace(now.Add(21*time.Minute), cc)
+	require.ErrorIs(t, err, ErrExpired)
+
+	// The clock skew tolerance comes first
+	caPool.SetClockSkewTolerance(2 * time.Minute)
+	inGrace, err = caPool.VerifyCachedCertificateWithGrace(now.Add(21*time.Minute), cc)
+	require.NoError(t, err)
+	assert.True(t, inGrace)
+
+	// Not valid yet certs and an expired root get no grace
+	_, _, err = caPool.VerifyCertificateWithGrace(now.Add(-5*time.Minute), c)
+	require.ErrorIs(t, err, ErrExpired)
+	_, err = caPool.VerifyCachedCertificateWithGrace(now.Add(63*time.Minute), cc)
+	require.ErrorIs(t, err, ErrRootExpired)
+}
+
+func TestCAPool_BlocklistNameAndGroup(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	laptop, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "laptop-jdoe", now, now.Add(10*time.Minute), nil, nil, []string{"eng"})
+	server, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "web-1", now, now.Add(10*time.Minute), nil, nil, []string{"servers", "web"})
+
+	caPool := NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	cachedLaptop, err := caPool.VerifyCertificate(now, laptop)
+	require.NoError(t, err)
+	cachedServer, err := caPool.VerifyCertificate(now, server)
+	require.NoError(t, err)
+
+	// Exact names and globs
+	require.NoError(t, caPool.BlocklistName("laptop-*"))
+	_, err = caPool.VerifyCertificate(now, laptop)
+	require.ErrorIs(t, err, ErrBlockListed)
+	require.ErrorIs(t, caPool.VerifyCachedCertificate(now, cachedLaptop), ErrBlockListed)
+	require.NoError(t, caPool.VerifyCachedCertificate(now, cachedServer))
+
+	caPool.ResetCertBlocklist()
+	require.NoError(t, caPool.BlocklistName("web-1"))
+	require.NoError(t, caPool.VerifyCachedCertificate(now, cachedLaptop))
+	require.ErrorIs(t, caPool.VerifyCachedCertificate(now, cachedServer), ErrBlockListed)
+
+	// Any one of the groups is enough
+	caPool.ResetCertBlocklist()
+	caPool.BlocklistGroup("web")
+	require.NoError(t, caPool.VerifyCachedCertificate(now, cachedLaptop))
+	require.ErrorIs(t, caPool.VerifyCachedCertificate(now, cachedServer), ErrBlockListed)
+	assert.True(t, caPool.IsCertificateBlocklisted(server, cachedServer.Fingerprint))
+	assert.False(t, caPool.IsBlocklisted(cachedServer.Fingerprint))
+
+	caPool.ResetCertBlocklist()
+	require.NoError(t, caPool.VerifyCachedCertificate(now, cachedServer))
+
+	require.ErrorContains(t, caPool.BlocklistName("laptop-["), "invalid name pattern")
+}
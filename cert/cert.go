@@ -110,6 +110,9 @@ type CachedCertificate struct {
 	InvertedGroups    map[string]struct{}
 	Fingerprint       string
 	signerFingerprint string
+
+	// groups keeps InvertedGroups, which is shared with other certificates, in the intern table
+	groups *groupSet
 }
 
 func (cc *CachedCertificate) String() string {
@@ -0,0 +1,73 @@
+package cert
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// FuzzUnmarshalNebulaCertificate feeds the certificate parsers the bytes a peer can send us during a handshake
+func FuzzUnmarshalNebulaCertificate(f *testing.F) {
+	// Known bad inputs from the unmarshal tests
+	f.Add([]byte("\x98\x00\x00"))
+	f.Add([]byte{})
+
+	for _, v := range []Version{Version1, Version2} {
+		for _, curve := range []Curve{Curve_CURVE25519, Curve_P256} {
+			ca, _, caKey, caPem := NewTestCaCert(v, curve, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+			c, _, _, _ := NewTestCert(v, curve, ca, caKey, "fuzz", time.Now(), time.Now().Add(time.Hour),
+				[]netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")}, []string{"a", "b"})
+
+			for _, cert := range []Certificate{ca, c} {
+				b, err := cert.Marshal()
+				if err != nil {
+					f.Fatal(err)
+				}
+				f.Add(b)
+
+				b, err = cert.MarshalForHandshakes()
+				if err != nil {
+					f.Fatal(err)
+				}
+				f.Add(b)
+			}
+			f.Add(caPem)
+		}
+	}
+
+	publicKey := make([]byte, 32)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Whatever we are handed must be rejected or be safe to use
+		use := func(c Certificate) {
+			_ = c.String()
+			_, _ = c.MarshalJSON()
+			_, _ = c.Marshal()
+			_, _ = c.MarshalForHandshakes()
+			_, _ = c.Fingerprint()
+			_ = c.Networks()
+			_ = c.UnsafeNetworks()
+			_ = c.Groups()
+		}
+
+		if c, err := unmarshalCertificateV1(b, nil); err == nil {
+			use(c)
+		}
+
+		for _, curve := range []Curve{Curve_CURVE25519, Curve_P256} {
+			if c, err := unmarshalCertificateV2(b, nil, curve); err == nil {
+				use(c)
+			}
+		}
+
+		// The handshake path, the public key comes from the noise handshake and the certificate bytes from the peer
+		for _, v := range []Version{Version1, Version2} {
+			if c, err := Recombine(v, b, publicKey, Curve_CURVE25519); err == nil {
+				use(c)
+			}
+		}
+
+		if c, _, err := UnmarshalCertificateFromPEM(b); err == nil {
+			use(c)
+		}
+	})
+}
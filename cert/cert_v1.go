@@ -434,8 +434,10 @@ func unmarshalCertificateV1(b []byte, publicKey []byte) (*certificateV1, error)
 	}
 
 	copy(nc.signature, rc.Signature)
-	copy(nc.details.groups, rc.Details.Groups)
-	nc.details.issuer = hex.EncodeToString(rc.Details.Issuer)
+	for i, g := range rc.Details.Groups {
+		nc.details.groups[i] = internString(g)
+	}
+	nc.details.issuer = internString(hex.EncodeToString(rc.Details.Issuer))
 
 	// If a public key is passed in as an argument, the certificate pubkey must be empty
 	// and the passed-in pubkey copied into the cert.
@@ -702,7 +702,7 @@ func unmarshalDetails(b cryptobyte.String) (detailsV2, error) {
 			if !subString.ReadASN1(&val, asn1.UTF8String) || val.Empty() {
 				return detailsV2{}, ErrBadFormat
 			}
-			groups = append(groups, string(val))
+			groups = append(groups, internString(string(val)))
 		}
 	}
 
@@ -737,6 +737,6 @@ func unmarshalDetails(b cryptobyte.String) (detailsV2, error) {
 		isCA:           isCa,
 		notBefore:      time.Unix(notBefore, 0),
 		notAfter:       time.Unix(notAfter, 0),
-		issuer:         hex.EncodeToString(issuer),
+		issuer:         internString(hex.EncodeToString(issuer)),
 	}, nil
 }
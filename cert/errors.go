@@ -22,13 +22,17 @@ var (
 	ErrCaNotFound                 = errors.New("could not find ca for the certificate")
 	ErrUnknownVersion             = errors.New("certificate version unrecognized")
 	ErrCertPubkeyPresent          = errors.New("certificate has unexpected pubkey present")
-
-	ErrInvalidPEMBlock                   = errors.New("input did not contain a valid PEM encoded block")
-	ErrInvalidPEMCertificateBanner       = errors.New("bytes did not contain a proper certificate banner")
-	ErrInvalidPEMX25519PublicKeyBanner   = errors.New("bytes did not contain a proper X25519 public key banner")
-	ErrInvalidPEMX25519PrivateKeyBanner  = errors.New("bytes did not contain a proper X25519 private key banner")
-	ErrInvalidPEMEd25519PublicKeyBanner  = errors.New("bytes did not contain a proper Ed25519 public key banner")
-	ErrInvalidPEMEd25519PrivateKeyBanner = errors.New("bytes did not contain a proper Ed25519 private key banner")
+	ErrNotInIssuanceLog           = errors.New("certificate is not in the issuance log")
+	ErrIssuanceLogBroken          = errors.New("issuance log chain is broken")
+	ErrRequestProofMismatch       = errors.New("certificate request proof did not match")
+
+	ErrInvalidPEMBlock                    = errors.New("input did not contain a valid PEM encoded block")
+	ErrInvalidPEMCertificateBanner        = errors.New("bytes did not contain a proper certificate banner")
+	ErrInvalidPEMCertificateRequestBanner = errors.New("bytes did not contain a proper certificate request banner")
+	ErrInvalidPEMX25519PublicKeyBanner    = errors.New("bytes did not contain a proper X25519 public key banner")
+	ErrInvalidPEMX25519PrivateKeyBanner   = errors.New("bytes did not contain a proper X25519 private key banner")
+	ErrInvalidPEMEd25519PublicKeyBanner   = errors.New("bytes did not contain a proper Ed25519 public key banner")
+	ErrInvalidPEMEd25519PrivateKeyBanner  = errors.New("bytes did not contain a proper Ed25519 private key banner")
 
 	ErrNoPeerStaticKey = errors.New("no peer static key was present")
 	ErrNoPayload       = errors.New("provided payload was empty")
@@ -0,0 +1,88 @@
+package cert
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"unique"
+	"weak"
+)
+
+// verifiedCertificates hands out one CachedCertificate per fingerprint, so every tunnel to a peer, and every peer that
+// is handshaked again, shares the same copy. Entries go away once no tunnel holds on to them.
+var verifiedCertificates = interner[CachedCertificate]{}
+
+// groupSets hands out one CachedCertificate.InvertedGroups per set of groups, most peers share theirs with many others
+var groupSets = interner[groupSet]{}
+
+type groupSet struct {
+	m map[string]struct{}
+}
+
+// invertedGroups returns the shared set for groups, the caller must keep the *groupSet alive for as long as it uses
+// the map
+func invertedGroups(groups []string) *groupSet {
+	sorted := slices.Clone(groups)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	var key []byte
+	for _, g := range sorted {
+		key = strconv.AppendInt(key, int64(len(g)), 10)
+		key = append(key, ':')
+		key = append(key, g...)
+	}
+
+	gs := &groupSet{m: make(map[string]struct{}, len(sorted))}
+	for _, g := range sorted {
+		gs.m[g] = struct{}{}
+	}
+	return groupSets.get(string(key), gs)
+}
+
+// interner keeps a weak reference to a shared, immutable value per key
+type interner[T any] struct {
+	sync.Mutex
+	m map[string]weak.Pointer[T]
+}
+
+// get returns the live value for key or stores and returns v if there is none
+func (i *interner[T]) get(key string, v *T) *T {
+	i.Lock()
+	defer i.Unlock()
+
+	if wp, ok := i.m[key]; ok {
+		if shared := wp.Value(); shared != nil {
+			return shared
+		}
+	}
+
+	if i.m == nil {
+		i.m = map[string]weak.Pointer[T]{}
+	}
+
+	wp := weak.Make(v)
+	i.m[key] = wp
+	runtime.AddCleanup(v, i.remove, cleanupKey[T]{key: key, wp: wp})
+	return v
+}
+
+type cleanupKey[T any] struct {
+	key string
+	wp  weak.Pointer[T]
+}
+
+// remove drops the entry for a collected value unless it has already been replaced
+func (i *interner[T]) remove(k cleanupKey[T]) {
+	i.Lock()
+	defer i.Unlock()
+	if i.m[k.key] == k.wp {
+		delete(i.m, k.key)
+	}
+}
+
+// internString returns a canonical copy of s. Groups and issuers repeat across most certificates a node sees.
+func internString(s string) string {
+	return unique.Make(s).Value()
+}
@@ -0,0 +1,93 @@
+package cert
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAPool_VerifyCertificate_Interned(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil, nil)
+	c, pub, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "test", time.Time{}, time.Time{}, nil, nil, []string{"servers", "linux"})
+	other, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "other", time.Time{}, time.Time{}, nil, nil, []string{"linux", "servers"})
+
+	caPool := NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	raw, err := c.MarshalForHandshakes()
+	require.NoError(t, err)
+
+	// The same certificate arriving in two handshakes is only held once
+	c1, err := Recombine(Version2, raw, pub, Curve_CURVE25519)
+	require.NoError(t, err)
+	cc1, err := caPool.VerifyCertificate(time.Now(), c1)
+	require.NoError(t, err)
+
+	c2, err := Recombine(Version2, raw, pub, Curve_CURVE25519)
+	require.NoError(t, err)
+	cc2, err := caPool.VerifyCertificate(time.Now(), c2)
+	require.NoError(t, err)
+	assert.Same(t, cc1, cc2)
+
+	// A different certificate is not, but it shares the strings it has in common
+	cc3, err := caPool.VerifyCertificate(time.Now(), other)
+	require.NoError(t, err)
+	assert.NotSame(t, cc1, cc3)
+	assert.Equal(t, cc1.InvertedGroups, cc3.InvertedGroups)
+	assert.Equal(t, cc1.Certificate.Issuer(), cc3.Certificate.Issuer())
+
+	// Failing verification never hands out the shared copy
+	caPool.BlocklistFingerprint(cc1.Fingerprint)
+	_, err = caPool.VerifyCertificate(time.Now(), c1)
+	require.ErrorIs(t, err, ErrBlockListed)
+}
+
+// BenchmarkCAPool_VerifyCertificate_Hub holds the verified certificates of 10k peers with two tunnels each, as a hub
+// does while tunnels are rehandshaked, and reports the heap they use per peer
+func BenchmarkCAPool_VerifyCertificate_Hub(b *testing.B) {
+	const peers = 10000
+
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), nil, nil, nil)
+	caPool := NewCAPool()
+	require.NoError(b, caPool.AddCA(ca))
+
+	raw := make([][]byte, peers)
+	pubs := make([][]byte, peers)
+	for i := range peers {
+		network := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 8)
+		c, pub, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, fmt.Sprintf("host-%d", i), time.Time{}, time.Time{}, []netip.Prefix{network}, nil, []string{"servers", "linux", "prod"})
+
+		var err error
+		raw[i], err = c.MarshalForHandshakes()
+		require.NoError(b, err)
+		pubs[i] = pub
+	}
+
+	for b.Loop() {
+		held := make([]*CachedCertificate, 0, peers*2)
+
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		for i := range raw {
+			for range 2 {
+				c, err := Recombine(Version2, raw[i], pubs[i], Curve_CURVE25519)
+				require.NoError(b, err)
+				cc, err := caPool.VerifyCertificate(time.Now(), c)
+				require.NoError(b, err)
+				held = append(held, cc)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/peers, "heap-B/peer")
+		runtime.KeepAlive(held)
+	}
+}
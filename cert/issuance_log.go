@@ -0,0 +1,166 @@
+package cert
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// IssuanceLogEntry records one signed certificate. Hash covers every other field, including the Hash of the entry
+// before it, so altering, reordering, or dropping an entry breaks the chain for every entry after it.
+type IssuanceLogEntry struct {
+	Index       uint64    `json:"index"`
+	Fingerprint string    `json:"fingerprint"`
+	Issuer      string    `json:"issuer"`
+	Name        string    `json:"name"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Prev        string    `json:"prev"`
+	Hash        string    `json:"hash"`
+}
+
+func (e IssuanceLogEntry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// IssuanceLog is an append-only, hash-chained list of every certificate a CA has signed. nebula-cert sign appends to
+// it and nodes that require it reject any certificate missing from it, which makes issuance with a stolen CA key
+// visible instead of silent.
+type IssuanceLog struct {
+	entries       []IssuanceLogEntry
+	byFingerprint map[string]int
+	byHash        map[string]int
+}
+
+// NewIssuanceLog returns an empty log
+func NewIssuanceLog() *IssuanceLog {
+	return &IssuanceLog{
+		byFingerprint: map[string]int{},
+		byHash:        map[string]int{},
+	}
+}
+
+// UnmarshalIssuanceLog parses a log written one json entry per line and verifies the whole chain
+func UnmarshalIssuanceLog(b []byte) (*IssuanceLog, error) {
+	l := NewIssuanceLog()
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(make([]byte, 0, 4096), 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		raw := bytes.TrimSpace(s.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		var e IssuanceLogEntry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, fmt.Errorf("issuance log line %d: %w", line, err)
+		}
+
+		if err := l.add(e); err != nil {
+			return nil, fmt.Errorf("issuance log line %d: %w", line, err)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// add verifies e extends the chain and adds it
+func (l *IssuanceLog) add(e IssuanceLogEntry) error {
+	if e.Index != uint64(len(l.entries)) {
+		return fmt.Errorf("%w: expected index %d, got %d", ErrIssuanceLogBroken, len(l.entries), e.Index)
+	}
+
+	if e.Prev != l.Head() {
+		return fmt.Errorf("%w: entry %d does not follow %q", ErrIssuanceLogBroken, e.Index, l.Head())
+	}
+
+	h, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	if h != e.Hash {
+		return fmt.Errorf("%w: entry %d hash mismatch", ErrIssuanceLogBroken, e.Index)
+	}
+
+	if _, ok := l.byFingerprint[e.Fingerprint]; ok {
+		return fmt.Errorf("%w: certificate %s is logged more than once", ErrIssuanceLogBroken, e.Fingerprint)
+	}
+
+	l.entries = append(l.entries, e)
+	l.byFingerprint[e.Fingerprint] = len(l.entries) - 1
+	l.byHash[e.Hash] = len(l.entries) - 1
+	return nil
+}
+
+// Append adds c to the end of the log and returns the new entry, which the caller should write out as a line of json
+func (l *IssuanceLog) Append(c Certificate) (IssuanceLogEntry, error) {
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return IssuanceLogEntry{}, err
+	}
+
+	e := IssuanceLogEntry{
+		Index:       uint64(len(l.entries)),
+		Fingerprint: fp,
+		Issuer:      c.Issuer(),
+		Name:        c.Name(),
+		NotBefore:   c.NotBefore().UTC(),
+		NotAfter:    c.NotAfter().UTC(),
+		Prev:        l.Head(),
+	}
+
+	e.Hash, err = e.computeHash()
+	if err != nil {
+		return IssuanceLogEntry{}, err
+	}
+
+	if err := l.add(e); err != nil {
+		return IssuanceLogEntry{}, err
+	}
+
+	return e, nil
+}
+
+// Head is the hash of the last entry, publishing it lets anyone holding a copy of the log check it is the same log
+func (l *IssuanceLog) Head() string {
+	if len(l.entries) == 0 {
+		return ""
+	}
+	return l.entries[len(l.entries)-1].Hash
+}
+
+// Len returns the number of entries in the log
+func (l *IssuanceLog) Len() int {
+	return len(l.entries)
+}
+
+// Contains reports whether the certificate with the given fingerprint was logged. The chain was verified when the log
+// was loaded, so a match is proof of inclusion up to Head.
+func (l *IssuanceLog) Contains(fingerprint string) bool {
+	_, ok := l.byFingerprint[fingerprint]
+	return ok
+}
+
+// HasHead reports whether the log includes the entry with hash h, that is whether it is the log h was published from
+// or a later version of it
+func (l *IssuanceLog) HasHead(h string) bool {
+	_, ok := l.byHash[h]
+	return ok
+}
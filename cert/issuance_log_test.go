@@ -0,0 +1,91 @@
+package cert
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuanceLog(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, nil)
+	var crts []Certificate
+	for _, name := range []string{"a", "b", "c"} {
+		c, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, nil, nil)
+		crts = append(crts, c)
+	}
+
+	l := NewIssuanceLog()
+	assert.Empty(t, l.Head())
+
+	var raw bytes.Buffer
+	var heads []string
+	for _, c := range crts[:2] {
+		e, err := l.Append(c)
+		require.NoError(t, err)
+		assert.Equal(t, c.Name(), e.Name)
+		assert.Equal(t, c.Issuer(), e.Issuer)
+
+		b, err := json.Marshal(e)
+		require.NoError(t, err)
+		raw.Write(append(b, '\n'))
+		heads = append(heads, l.Head())
+	}
+
+	_, err := l.Append(crts[0])
+	require.ErrorIs(t, err, ErrIssuanceLogBroken)
+
+	// A round trip keeps the chain
+	l2, err := UnmarshalIssuanceLog(raw.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, 2, l2.Len())
+	assert.Equal(t, l.Head(), l2.Head())
+	assert.True(t, l2.HasHead(heads[0]))
+	assert.False(t, l2.HasHead("nope"))
+
+	fp0, _ := crts[0].Fingerprint()
+	fp2, _ := crts[2].Fingerprint()
+	assert.True(t, l2.Contains(fp0))
+	assert.False(t, l2.Contains(fp2))
+
+	// Any change to a logged entry breaks the chain
+	tampered := bytes.Replace(raw.Bytes(), []byte(`"name":"a"`), []byte(`"name":"z"`), 1)
+	_, err = UnmarshalIssuanceLog(tampered)
+	require.ErrorIs(t, err, ErrIssuanceLogBroken)
+	require.ErrorContains(t, err, "issuance log line 1: issuance log chain is broken: entry 0 hash mismatch")
+
+	// As does dropping one
+	lines := bytes.SplitAfter(raw.Bytes(), []byte("\n"))
+	_, err = UnmarshalIssuanceLog(lines[1])
+	require.ErrorIs(t, err, ErrIssuanceLogBroken)
+}
+
+func TestCAPool_RequireIssuanceLog(t *testing.T) {
+	ca, _, caKey, _ := NewTestCaCert(Version2, Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, nil)
+	logged, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "logged", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, nil, nil)
+	rogue, _, _, _ := NewTestCert(Version2, Curve_CURVE25519, ca, caKey, "rogue", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.1.0.2/16")}, nil, nil)
+
+	pool := NewCAPool()
+	require.NoError(t, pool.AddCA(ca))
+
+	rogueCached, err := pool.VerifyCertificate(time.Now(), rogue)
+	require.NoError(t, err)
+
+	l := NewIssuanceLog()
+	_, err = l.Append(logged)
+	require.NoError(t, err)
+	pool.RequireIssuanceLog(l)
+
+	_, err = pool.VerifyCertificate(time.Now(), logged)
+	require.NoError(t, err)
+
+	_, err = pool.VerifyCertificate(time.Now(), rogue)
+	require.ErrorIs(t, err, ErrNotInIssuanceLog)
+
+	// Certificates verified before the log was required are caught on their next check
+	require.ErrorIs(t, pool.VerifyCachedCertificate(time.Now(), rogueCached), ErrNotInIssuanceLog)
+}
@@ -10,6 +10,8 @@ import (
 const ( //cert banners
 	CertificateBanner   = "NEBULA CERTIFICATE"
 	CertificateV2Banner = "NEBULA CERTIFICATE V2"
+
+	CertificateRequestBanner = "NEBULA CERTIFICATE REQUEST"
 )
 
 const ( //key-agreement-key banners
@@ -0,0 +1,247 @@
+package cert
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/netip"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// CertificateRequest asks a CA to sign a certificate for PublicKey without the private key ever leaving the host.
+// Proof is a MAC keyed with the Diffie-Hellman secret between the requester's private key and the CA key, so only the
+// holder of the private key could have made the request and only the CA it names can check it. Host keys are X25519 or
+// P256 ECDH keys that can not sign, a proof of possession needs a static key on the other side and the CA key is the
+// only one the requester is sure to have. See SigningKeyDH for why using the CA key this way is safe.
+//
+// Nothing in a request is trusted, the CA operator decides which name, networks, and groups are signed.
+type CertificateRequest struct {
+	Name           string         `json:"name"`
+	Networks       []netip.Prefix `json:"networks"`
+	UnsafeNetworks []netip.Prefix `json:"unsafeNetworks"`
+	Groups         []string       `json:"groups"`
+	Curve          Curve          `json:"curve"`
+	PublicKey      []byte         `json:"publicKey"`
+	// Issuer is the fingerprint of the CA the request was made for
+	Issuer string `json:"issuer"`
+	Proof  []byte `json:"proof"`
+}
+
+// DHFunc performs Diffie-Hellman with peerPublicKey and returns the shared secret. It lets keys held in a PKCS#11
+// module take part, see pkclient.PKClient.DeriveNoise.
+type DHFunc func(peerPublicKey []byte) ([]byte, error)
+
+// Seal sets Issuer and Proof for the CA ca, dh must use the private key for r.PublicKey
+func (r *CertificateRequest) Seal(ca Certificate, dh DHFunc) error {
+	fp, err := ca.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	caPub, err := keyAgreementPublicKey(ca)
+	if err != nil {
+		return err
+	}
+
+	secret, err := dh(caPub)
+	if err != nil {
+		return fmt.Errorf("failed to derive a shared secret with the ca: %w", err)
+	}
+
+	r.Issuer = fp
+	r.Proof, err = r.mac(secret)
+	return err
+}
+
+// Verify checks the request was made for ca by the holder of the private key for r.PublicKey. dh must use the
+// signing key of ca, SigningKeyDH returns one for keys on disk.
+func (r *CertificateRequest) Verify(ca Certificate, dh DHFunc) error {
+	fp, err := ca.Fingerprint()
+	if err != nil {
+		return err
+	}
+	if r.Issuer != fp {
+		return fmt.Errorf("request was made for ca %s, not %s", r.Issuer, fp)
+	}
+
+	if r.Curve != ca.Curve() {
+		return fmt.Errorf("request curve %s does not match ca curve %s", r.Curve, ca.Curve())
+	}
+
+	secret, err := dh(r.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive a shared secret with the request: %w", err)
+	}
+
+	expected, err := r.mac(secret)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, r.Proof) {
+		return ErrRequestProofMismatch
+	}
+
+	return nil
+}
+
+// mac covers every field but Proof itself
+func (r *CertificateRequest) mac(secret []byte) ([]byte, error) {
+	c := *r
+	c.Proof = nil
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("nebula certificate request\x00"))
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// MarshalPEM encodes the request for transport to the CA
+func (r *CertificateRequest) MarshalPEM() ([]byte, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: CertificateRequestBanner, Bytes: b}), nil
+}
+
+// UnmarshalCertificateRequestFromPEM decodes the first pem block in b, returning any remaining bytes. The request must
+// still be checked with Verify.
+func UnmarshalCertificateRequestFromPEM(b []byte) (*CertificateRequest, []byte, error) {
+	p, rest := pem.Decode(b)
+	if p == nil {
+		return nil, rest, ErrInvalidPEMBlock
+	}
+	if p.Type != CertificateRequestBanner {
+		return nil, rest, ErrInvalidPEMCertificateRequestBanner
+	}
+
+	var r CertificateRequest
+	if err := json.Unmarshal(p.Bytes, &r); err != nil {
+		return nil, rest, fmt.Errorf("%w: %w", ErrBadFormat, err)
+	}
+
+	return &r, rest, nil
+}
+
+// PrivateKeyDH returns a DHFunc for a host private key, as written by nebula-cert keygen
+func PrivateKeyDH(curve Curve, key []byte) (DHFunc, error) {
+	var c ecdh.Curve
+	switch curve {
+	case Curve_CURVE25519:
+		c = ecdh.X25519()
+	case Curve_P256:
+		c = ecdh.P256()
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+
+	pk, err := c.NewPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPrivateKey, err)
+	}
+
+	return ecdhFunc(c, pk), nil
+}
+
+// SigningKeyDH returns a DHFunc for a CA signing private key. Ed25519 keys are used as their X25519 equivalent.
+//
+// This reuses the CA signing key for key agreement with a public key the requester chose, which is safe here because:
+//   - The shared secret never leaves Verify, it only keys an HMAC compared in constant time. A requester learns one bit,
+//     whether its proof matched, and it can compute that bit itself for any public key it knows the private key of.
+//     Learning anything more about the CA key from it means solving computational Diffie-Hellman.
+//   - Peer public keys are validated, crypto/ecdh rejects P256 points off the curve and X25519 results of all zeros, so
+//     invalid curve and small subgroup points can not be used to probe the key.
+//   - Joint use of one key for signatures and Diffie-Hellman is proven secure for Ed25519 with X25519 (Thormarker,
+//     "On using the same key pair for Ed25519 and an X25519 based KEM", 2021) and for ECDSA with ECDH style key
+//     agreement (Degabriele et al., "On the Joint Security of Encryption and Signature in EMV", 2012).
+//   - The CA never signs or encrypts anything derived from the request in this step, the certificate it may sign later
+//     is built from fields the operator confirmed.
+func SigningKeyDH(curve Curve, key []byte) (DHFunc, error) {
+	switch curve {
+	case Curve_CURVE25519:
+		if len(key) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidPrivateKey
+		}
+		// The X25519 scalar is the same one Ed25519 signs with, clamping happens in NewPrivateKey
+		h := sha512.Sum512(key[:ed25519.SeedSize])
+		return PrivateKeyDH(curve, h[:32])
+	case Curve_P256:
+		return PrivateKeyDH(curve, key)
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", curve)
+	}
+}
+
+func ecdhFunc(c ecdh.Curve, pk *ecdh.PrivateKey) DHFunc {
+	return func(peer []byte) ([]byte, error) {
+		pub, err := c.NewPublicKey(peer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPublicKey, err)
+		}
+		return pk.ECDH(pub)
+	}
+}
+
+// keyAgreementPublicKey returns the public key of ca in the form a host key can do Diffie-Hellman with
+func keyAgreementPublicKey(ca Certificate) ([]byte, error) {
+	switch ca.Curve() {
+	case Curve_CURVE25519:
+		return ed25519PublicKeyToX25519(ca.PublicKey())
+	case Curve_P256:
+		// An uncompressed ECDSA point is also a valid ECDH public key
+		return ca.PublicKey(), nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %s", ca.Curve())
+	}
+}
+
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// ed25519PublicKeyToX25519 maps an Edwards point to its Montgomery u coordinate, u = (1 + y) / (1 - y)
+func ed25519PublicKeyToX25519(pub []byte) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+
+	// Little endian y with the sign of x in the top bit
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrInvalidPublicKey
+	}
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, ErrInvalidPublicKey
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+package cert
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateRequest(t *testing.T) {
+	for _, curve := range []Curve{Curve_CURVE25519, Curve_P256} {
+		t.Run(curve.String(), func(t *testing.T) {
+			ca, _, caKey, _ := NewTestCaCert(Version2, curve, time.Now(), time.Now().Add(10*time.Minute), nil, nil, nil)
+			otherCa, _, otherCaKey, _ := NewTestCaCert(Version2, curve, time.Now(), time.Now().Add(10*time.Minute), nil, nil, nil)
+
+			var pub, priv []byte
+			if curve == Curve_CURVE25519 {
+				pub, priv = X25519Keypair()
+			} else {
+				pub, priv = P256Keypair()
+			}
+
+			r := &CertificateRequest{
+				Name:      "host",
+				Networks:  []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")},
+				Groups:    []string{"a", "b"},
+				Curve:     curve,
+				PublicKey: pub,
+			}
+
+			hostDH, err := PrivateKeyDH(curve, priv)
+			require.NoError(t, err)
+			require.NoError(t, r.Seal(ca, hostDH))
+
+			b, err := r.MarshalPEM()
+			require.NoError(t, err)
+			r2, rest, err := UnmarshalCertificateRequestFromPEM(append(b, "rest"...))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("rest"), rest)
+			assert.Equal(t, r, r2)
+
+			caDH, err := SigningKeyDH(curve, caKey)
+			require.NoError(t, err)
+			require.NoError(t, r2.Verify(ca, caDH))
+
+			// Any change to the request breaks the proof
+			r2.Groups = append(r2.Groups, "c")
+			require.ErrorIs(t, r2.Verify(ca, caDH), ErrRequestProofMismatch)
+
+			// A different key can not claim the request
+			r3 := *r
+			r3.PublicKey, _ = X25519Keypair()
+			if curve == Curve_P256 {
+				r3.PublicKey, _ = P256Keypair()
+			}
+			require.ErrorIs(t, r3.Verify(ca, caDH), ErrRequestProofMismatch)
+
+			// Only the named ca can verify
+			otherDH, err := SigningKeyDH(curve, otherCaKey)
+			require.NoError(t, err)
+			require.Error(t, r.Verify(otherCa, otherDH))
+
+			r4 := *r
+			r4.Issuer, err = otherCa.Fingerprint()
+			require.NoError(t, err)
+			require.ErrorIs(t, r4.Verify(otherCa, otherDH), ErrRequestProofMismatch)
+		})
+	}
+}
+
+func TestUnmarshalCertificateRequestFromPEM(t *testing.T) {
+	_, _, err := UnmarshalCertificateRequestFromPEM([]byte("nope"))
+	require.ErrorIs(t, err, ErrInvalidPEMBlock)
+
+	_, _, err = UnmarshalCertificateRequestFromPEM(MarshalPublicKeyToPEM(Curve_CURVE25519, make([]byte, 32)))
+	require.ErrorIs(t, err, ErrInvalidPEMCertificateRequestBanner)
+}
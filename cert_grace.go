@@ -0,0 +1,58 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/header"
+)
+
+// A peer whose certificate just expired, maybe because its renewal job is late, would lose every tunnel at once. With
+// pki.expired_grace we admit its certificate for that long past its expiry. The tunnel is flagged, we send an
+// InterfacePeerCertInGrace event, and the peer is told with a ControlRenewCert message that it needs a new certificate.
+// The connection manager keeps reminding it until the grace period is over and pki.disconnect_invalid applies.
+
+// certRenewRequestInterval is the least time between two renewal requests over the same tunnel
+const certRenewRequestInterval = 5 * time.Minute
+
+// peerCertInGrace flags a tunnel whose peer certificate was admitted within the grace period and asks the peer to renew
+func (f *Interface) peerCertInGrace(hostinfo *HostInfo, now time.Time) {
+	if hostinfo.certInGrace.CompareAndSwap(false, true) {
+		metrics.GetOrRegisterCounter("pki.expired_grace.admitted", nil).Inc(1)
+
+		li := hostinfo.logger(f.l)
+		if remoteCert := hostinfo.GetCert(); remoteCert != nil {
+			li = li.WithField("fingerprint", remoteCert.Fingerprint).
+				WithField("notAfter", remoteCert.Certificate.NotAfter())
+		}
+		li.Warn("Remote certificate is expired, keeping the tunnel for pki.expired_grace and asking the peer to renew")
+
+		f.emitEvent(InterfacePeerCertInGrace)
+	}
+
+	last := hostinfo.certRenewRequested.Load()
+	if last != 0 && now.Sub(time.Unix(0, last)) < certRenewRequestInterval {
+		return
+	}
+	if !hostinfo.certRenewRequested.CompareAndSwap(last, now.UnixNano()) || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	f.send(header.Control, header.ControlRenewCert, hostinfo.ConnectionState, hostinfo, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
+}
+
+// handleCertRenewRequest is called when a peer says our certificate is expired. Nothing is renewed here, whatever
+// issues our certificates should listen for InterfaceCertRenewRequested, renew, and reload the config.
+func (f *Interface) handleCertRenewRequest(hostinfo *HostInfo) {
+	metrics.GetOrRegisterCounter("pki.expired_grace.renew_requested", nil).Inc(1)
+
+	li := hostinfo.logger(f.l)
+	if cs := f.pki.getCertState(); cs != nil {
+		if c := cs.getCertificate(cs.initiatingVersion); c != nil {
+			li = li.WithField("notAfter", c.NotAfter())
+		}
+	}
+	li.Warn("Peer says our certificate is expired and only admitted for a grace period, it needs renewing")
+
+	f.emitEvent(InterfaceCertRenewRequested)
+}
@@ -0,0 +1,21 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterface_handleCertRenewRequest(t *testing.T) {
+	f := &Interface{l: test.NewLogger(), pki: &PKI{}}
+	f.pki.cs.Store(&CertState{v1Cert: &dummyCert{notAfter: time.Now()}, initiatingVersion: 1})
+
+	var events []InterfaceEvent
+	f.events.subscribe(func(e InterfaceEvent) { events = append(events, e) })
+
+	f.handleCertRenewRequest(&HostInfo{})
+	f.handleCertRenewRequest(&HostInfo{})
+	assert.Equal(t, []InterfaceEvent{InterfaceCertRenewRequested, InterfaceCertRenewRequested}, events)
+}
@@ -0,0 +1,215 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	defaultClockSkewWarning = 30 * time.Second
+
+	// clockSkewWarnEvery limits how often a skewed clock is logged, the metrics are updated every time
+	clockSkewWarnEvery = time.Minute
+
+	// clockSkewRejectWindow is how close to its validity period a rejected certificate must be for us to blame the clock
+	clockSkewRejectWindow = 24 * time.Hour
+)
+
+// clockProbeMagic prefixes the payload of test packets sent to read a peer's clock. Peers answer with the payload
+// followed by their time, older peers only echo it.
+var clockProbeMagic = []byte("nclk")
+
+type clockSample struct {
+	sent     time.Time
+	received time.Time
+	remote   time.Time
+}
+
+// skew is how far the remote clock is ahead of ours, assuming the reply took half of the round trip
+func (s clockSample) skew() time.Duration {
+	return s.remote.Sub(s.sent.Add(s.received.Sub(s.sent) / 2))
+}
+
+// clockProbes reads our peers' clocks from test replies. The doctor waits on specific probes, the connection manager's
+// test packets are probes too so a skewed clock is noticed without anyone asking.
+type clockProbes struct {
+	sync.Mutex
+	seq     uint64
+	pending map[uint64]chan clockSample
+
+	// warning is the skew in nanoseconds beyond which we warn, 0 disables the warning
+	warning     atomic.Int64
+	lastWarning atomic.Int64
+}
+
+// request returns the payload for a clock probe, a seq of 0 is not waited on
+func (p *clockProbes) request(seq uint64, now time.Time) []byte {
+	payload := binary.BigEndian.AppendUint64(bytes.Clone(clockProbeMagic), seq)
+	return binary.BigEndian.AppendUint64(payload, uint64(now.UnixNano()))
+}
+
+func (p *clockProbes) probe(ctx context.Context, f *Interface, hostinfo *HostInfo) (clockSample, error) {
+	ch := make(chan clockSample, 1)
+
+	p.Lock()
+	if p.pending == nil {
+		p.pending = map[uint64]chan clockSample{}
+	}
+	p.seq++
+	seq := p.seq
+	p.pending[seq] = ch
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		delete(p.pending, seq)
+		p.Unlock()
+	}()
+
+	f.send(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, p.request(seq, time.Now()), make([]byte, 12, 12), make([]byte, mtu))
+
+	t := time.NewTimer(doctorClockProbeTimeout)
+	defer t.Stop()
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-t.C:
+		return clockSample{}, fmt.Errorf("no reply to a clock probe within %s", doctorClockProbeTimeout)
+	case <-ctx.Done():
+		return clockSample{}, ctx.Err()
+	}
+}
+
+// reply records the answer to a clock probe and hands it to whoever is waiting for it, anything else in d is ignored
+func (p *clockProbes) reply(l *logrus.Logger, hostinfo *HostInfo, d []byte, now time.Time) {
+	n := len(clockProbeMagic)
+	if (len(d) != n+16 && len(d) != n+24) || !bytes.HasPrefix(d, clockProbeMagic) {
+		return
+	}
+
+	s := clockSample{
+		sent:     time.Unix(0, int64(binary.BigEndian.Uint64(d[n+8:]))),
+		received: now,
+	}
+	if len(d) == n+24 {
+		s.remote = time.Unix(0, int64(binary.BigEndian.Uint64(d[n+16:])))
+		p.observe(l, hostinfo, s.skew(), now)
+	}
+
+	seq := binary.BigEndian.Uint64(d[n:])
+	if seq == 0 {
+		return
+	}
+
+	p.Lock()
+	ch, ok := p.pending[seq]
+	p.Unlock()
+	if !ok {
+		// A late reply to a probe we gave up on
+		return
+	}
+
+	select {
+	case ch <- s:
+	default:
+	}
+}
+
+// observe records the skew on the hostinfo and in the skew histogram, and warns if our clock is too far from the peer's
+func (p *clockProbes) observe(l *logrus.Logger, hostinfo *HostInfo, skew time.Duration, now time.Time) {
+	hostinfo.clockSkew.Store(&skew)
+	metrics.GetOrRegisterHistogram("clock.skew_ms", nil, metrics.NewExpDecaySample(1028, 0.015)).Update(skew.Milliseconds())
+
+	warning := p.warningThreshold()
+	if warning <= 0 || skew.Abs() <= warning {
+		return
+	}
+
+	p.warn(l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("skew", skew.Round(time.Millisecond)), now,
+		"Our clock is too far from a peer's, certificates may be refused or accepted when they should not be. Sync the clock with ntp")
+}
+
+// rejected warns if a peer certificate was refused for being outside of its validity period by so little that a skewed
+// clock is the likely reason
+func (p *clockProbes) rejected(l *logrus.Logger, err error, c cert.Certificate, now time.Time) {
+	if p.warningThreshold() <= 0 || !errors.Is(err, cert.ErrExpired) {
+		return
+	}
+
+	var off time.Duration
+	if now.Before(c.NotBefore()) {
+		off = c.NotBefore().Sub(now)
+	} else {
+		off = now.Sub(c.NotAfter())
+	}
+
+	if off > clockSkewRejectWindow {
+		return
+	}
+
+	p.warn(l.WithField("certName", c.Name()).WithField("notBefore", c.NotBefore()).WithField("notAfter", c.NotAfter()), now,
+		"Refused a certificate just outside of its validity period, check the clocks on both hosts or raise pki.clock_skew_tolerance")
+}
+
+func (p *clockProbes) warn(e *logrus.Entry, now time.Time, msg string) {
+	metrics.GetOrRegisterCounter("clock.skew_warnings", nil).Inc(1)
+
+	last := p.lastWarning.Load()
+	if now.UnixNano()-last < int64(clockSkewWarnEvery) || !p.lastWarning.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	e.Warn(msg)
+}
+
+// emitStats reports the largest skew, either way, of any host we have a tunnel with
+func (p *clockProbes) emitStats(hm *HostMap) {
+	var worst time.Duration
+	hm.RLock()
+	for _, hostinfo := range hm.Indexes {
+		if skew := hostinfo.clockSkew.Load(); skew != nil && skew.Abs() > worst {
+			worst = skew.Abs()
+		}
+	}
+	hm.RUnlock()
+
+	metrics.GetOrRegisterGauge("clock.skew_max_ms", nil).Update(worst.Milliseconds())
+}
+
+func (p *clockProbes) warningThreshold() time.Duration {
+	return time.Duration(p.warning.Load())
+}
+
+// clockProbeReply returns the payload to answer the test request d with, our time is added to clock probes
+func clockProbeReply(d []byte, now time.Time) []byte {
+	if len(d) != len(clockProbeMagic)+16 || !bytes.HasPrefix(d, clockProbeMagic) {
+		return d
+	}
+
+	return binary.BigEndian.AppendUint64(bytes.Clone(d), uint64(now.UnixNano()))
+}
+
+func (f *Interface) reloadClockSkew(c *config.C) {
+	initial := c.InitialLoad()
+	if initial || c.HasChanged("pki.clock_skew_warning") {
+		warning := c.GetDuration("pki.clock_skew_warning", defaultClockSkewWarning)
+		if warning < 0 {
+			warning = 0
+		}
+		f.clockProbes.warning.Store(int64(warning))
+		if !initial {
+			f.l.Infof("pki.clock_skew_warning changed to %v", warning)
+		}
+	}
+}
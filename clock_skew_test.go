@@ -0,0 +1,111 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockProbes(t *testing.T) {
+	l := test.NewLogger()
+	hostinfo := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.2")}}
+	p := &clockProbes{pending: map[uint64]chan clockSample{}}
+	ch := make(chan clockSample, 1)
+	p.pending[7] = ch
+
+	sent := time.Unix(1000, 0)
+	req := p.request(7, sent)
+	assert.Equal(t, uint64(7), binary.BigEndian.Uint64(req[len(clockProbeMagic):]))
+
+	// anything else is left alone
+	assert.Equal(t, []byte("hello"), clockProbeReply([]byte("hello"), sent))
+	p.reply(l, hostinfo, []byte("hello"), sent)
+	assert.Empty(t, ch)
+
+	// the remote is 10 seconds ahead and the round trip took 2 seconds
+	reply := clockProbeReply(req, sent.Add(11*time.Second))
+	assert.Len(t, reply, len(req)+8)
+	p.reply(l, hostinfo, reply, sent.Add(2*time.Second))
+
+	s := <-ch
+	assert.Equal(t, 10*time.Second, s.skew())
+	assert.Equal(t, 10*time.Second, *hostinfo.clockSkew.Load())
+
+	// an older peer only echoes the probe
+	p.reply(l, hostinfo, req, sent.Add(2*time.Second))
+	s = <-ch
+	assert.True(t, s.remote.IsZero())
+
+	// unsolicited probes still update the hostinfo
+	p.reply(l, hostinfo, clockProbeReply(p.request(0, sent), sent.Add(-5*time.Second)), sent)
+	assert.Empty(t, ch)
+	assert.Equal(t, -5*time.Second, *hostinfo.clockSkew.Load())
+}
+
+func TestClockProbes_emitStats(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	p := &clockProbes{}
+	gauge := metrics.GetOrRegisterGauge("clock.skew_max_ms", nil)
+	histogram := metrics.GetOrRegisterHistogram("clock.skew_ms", nil, metrics.NewExpDecaySample(1028, 0.015))
+	before := histogram.Count()
+
+	for i, skew := range []time.Duration{2 * time.Second, -7 * time.Second, 3 * time.Second} {
+		hostinfo := &HostInfo{vpnAddrs: []netip.Addr{netip.AddrFrom4([4]byte{10, 1, 0, byte(i + 2)})}, localIndexId: uint32(i + 1)}
+		hm.Indexes[hostinfo.localIndexId] = hostinfo
+		p.observe(l, hostinfo, skew, time.Now())
+	}
+	// A host we never heard from does not count
+	hm.Indexes[10] = &HostInfo{localIndexId: 10}
+
+	// Every peer is in the histogram and the gauge holds the worst of them, not whichever answered last
+	p.emitStats(hm)
+	assert.Equal(t, before+3, histogram.Count())
+	assert.Equal(t, int64(7000), gauge.Value())
+
+	delete(hm.Indexes, 2)
+	p.emitStats(hm)
+	assert.Equal(t, int64(3000), gauge.Value())
+}
+
+func TestClockProbes_warn(t *testing.T) {
+	l := test.NewLogger()
+	hostinfo := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.2")}}
+	f := &Interface{l: l}
+	p := &f.clockProbes
+	warnings := metrics.GetOrRegisterCounter("clock.skew_warnings", nil)
+
+	c := config.NewC(l)
+	f.reloadClockSkew(c)
+	assert.Equal(t, defaultClockSkewWarning, p.warningThreshold())
+
+	now := time.Now()
+	before := warnings.Count()
+	p.observe(l, hostinfo, 10*time.Second, now)
+	assert.Equal(t, before, warnings.Count())
+	p.observe(l, hostinfo, -time.Minute, now)
+	assert.Equal(t, before+1, warnings.Count())
+
+	crt := &dummyCert{notBefore: now.Add(time.Hour), notAfter: now.Add(2 * time.Hour)}
+	p.rejected(l, cert.ErrExpired, crt, now)
+	assert.Equal(t, before+2, warnings.Count())
+
+	// far outside of the validity period is not a clock problem
+	p.rejected(l, cert.ErrExpired, crt, now.Add(-48*time.Hour))
+	p.rejected(l, fmt.Errorf("other"), crt, now)
+	assert.Equal(t, before+2, warnings.Count())
+
+	// 0 disables it
+	c.Settings["pki"] = map[string]any{"clock_skew_warning": "0"}
+	f.reloadClockSkew(c)
+	p.observe(l, hostinfo, time.Hour, now)
+	assert.Equal(t, before+2, warnings.Count())
+}
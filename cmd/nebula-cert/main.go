@@ -83,8 +83,14 @@ func main() {
 		err = ca(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
 	case "keygen":
 		err = keygen(args[1:], os.Stdout, os.Stderr)
+	case "request":
+		err = request(args[1:], os.Stdout, os.Stderr)
 	case "sign":
 		err = signCert(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
+	case "sso-login":
+		err = ssoLogin(args[1:], os.Stdout, os.Stderr)
+	case "sso-sign":
+		err = ssoSign(args[1:], os.Stdout, os.Stderr, StdinPasswordReader{})
 	case "print":
 		err = printCert(args[1:], os.Stdout, os.Stderr)
 	case "verify":
@@ -116,8 +122,14 @@ func handleError(mode string, e error, out io.Writer) int {
 			caHelp(out)
 		case "keygen":
 			keygenHelp(out)
+		case "request":
+			requestHelp(out)
 		case "sign":
 			signHelp(out)
+		case "sso-login":
+			ssoLoginHelp(out)
+		case "sso-sign":
+			ssoSignHelp(out)
 		case "print":
 			printHelp(out)
 		case "verify":
@@ -142,7 +154,10 @@ func help(err string, out io.Writer) {
 	fmt.Fprintln(out, "  Modes:")
 	fmt.Fprintln(out, "    "+caSummary())
 	fmt.Fprintln(out, "    "+keygenSummary())
+	fmt.Fprintln(out, "    "+requestSummary())
 	fmt.Fprintln(out, "    "+signSummary())
+	fmt.Fprintln(out, "    "+ssoLoginSummary())
+	fmt.Fprintln(out, "    "+ssoSignSummary())
 	fmt.Fprintln(out, "    "+printSummary())
 	fmt.Fprintln(out, "    "+verifySummary())
 	fmt.Fprintln(out, "")
@@ -20,7 +20,10 @@ func Test_help(t *testing.T) {
 		"  Modes:\n" +
 		"    " + caSummary() + "\n" +
 		"    " + keygenSummary() + "\n" +
+		"    " + requestSummary() + "\n" +
 		"    " + signSummary() + "\n" +
+		"    " + ssoLoginSummary() + "\n" +
+		"    " + ssoSignSummary() + "\n" +
 		"    " + printSummary() + "\n" +
 		"    " + verifySummary() + "\n" +
 		"\n" +
@@ -6,25 +6,36 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/skip2/go-qrcode"
 	"github.com/slackhq/nebula/cert"
 )
 
 type printFlags struct {
-	set       *flag.FlagSet
-	json      *bool
-	outQRPath *string
-	path      *string
+	set            *flag.FlagSet
+	json           *bool
+	table          *bool
+	outQRPath      *string
+	path           *string
+	expiringWithin *time.Duration
+	expired        *bool
+	ca             *bool
 }
 
 func newPrintFlags() *printFlags {
 	pf := printFlags{set: flag.NewFlagSet("print", flag.ContinueOnError)}
 	pf.set.Usage = func() {}
 	pf.json = pf.set.Bool("json", false, "Optional: outputs certificates in json format")
+	pf.table = pf.set.Bool("table", false, "Optional: outputs a one line summary of each certificate")
 	pf.outQRPath = pf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
-	pf.path = pf.set.String("path", "", "Required: path to the certificate")
+	pf.path = pf.set.String("path", "", "Required: path to the certificate, may be a glob. Further paths or globs can be given as arguments")
+	pf.expiringWithin = pf.set.Duration("expiring-within", 0, "Optional: only print certificates that expire within this duration, including those already expired")
+	pf.expired = pf.set.Bool("expired", false, "Optional: only print expired certificates")
+	pf.ca = pf.set.Bool("ca", false, "Optional: only print CA certificates")
 
 	return &pf
 }
@@ -40,46 +51,74 @@ func printCert(args []string, out io.Writer, errOut io.Writer) error {
 		return err
 	}
 
-	rawCert, err := os.ReadFile(*pf.path)
+	if *pf.json && *pf.table {
+		return newHelpErrorf("cannot set both -json and -table")
+	}
+
+	paths, err := expandPaths(append([]string{*pf.path}, pf.set.Args()...))
 	if err != nil {
-		return fmt.Errorf("unable to read cert; %s", err)
+		return err
 	}
 
-	var c cert.Certificate
+	now := time.Now()
 	var qrBytes []byte
-	part := 0
-
 	var jsonCerts []cert.Certificate
 
-	for {
-		c, rawCert, err = cert.UnmarshalCertificateFromPEM(rawCert)
-		if err != nil {
-			return fmt.Errorf("error while unmarshaling cert: %s", err)
-		}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if *pf.table {
+		_, _ = fmt.Fprintln(tw, "PATH\tNAME\tCA\tNETWORKS\tGROUPS\tNOT AFTER\tFINGERPRINT")
+	}
 
-		if *pf.json {
-			jsonCerts = append(jsonCerts, c)
-		} else {
-			_, _ = out.Write([]byte(c.String()))
-			_, _ = out.Write([]byte("\n"))
+	for _, path := range paths {
+		rawCert, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read cert; %s", err)
 		}
 
-		if *pf.outQRPath != "" {
-			b, err := c.MarshalPEM()
+		var c cert.Certificate
+		for {
+			c, rawCert, err = cert.UnmarshalCertificateFromPEM(rawCert)
 			if err != nil {
-				return fmt.Errorf("error while marshalling cert to PEM: %s", err)
+				return fmt.Errorf("error while unmarshaling cert: %s", err)
+			}
+
+			if pf.matches(c, now) {
+				switch {
+				case *pf.json:
+					jsonCerts = append(jsonCerts, c)
+				case *pf.table:
+					fp, _ := c.Fingerprint()
+					_, _ = fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%s\t%s\n",
+						path, c.Name(), c.IsCA(), joinPrefixes(c.Networks()), strings.Join(c.Groups(), ","),
+						c.NotAfter().Format(time.RFC3339), fp)
+				default:
+					_, _ = out.Write([]byte(c.String()))
+					_, _ = out.Write([]byte("\n"))
+				}
+
+				if *pf.outQRPath != "" {
+					b, err := c.MarshalPEM()
+					if err != nil {
+						return fmt.Errorf("error while marshalling cert to PEM: %s", err)
+					}
+					qrBytes = append(qrBytes, b...)
+				}
 			}
-			qrBytes = append(qrBytes, b...)
-		}
 
-		if rawCert == nil || len(rawCert) == 0 || strings.TrimSpace(string(rawCert)) == "" {
-			break
+			if rawCert == nil || len(rawCert) == 0 || strings.TrimSpace(string(rawCert)) == "" {
+				break
+			}
 		}
+	}
 
-		part++
+	if *pf.table {
+		_ = tw.Flush()
 	}
 
 	if *pf.json {
+		if jsonCerts == nil {
+			jsonCerts = []cert.Certificate{}
+		}
 		b, _ := json.Marshal(jsonCerts)
 		_, _ = out.Write(b)
 		_, _ = out.Write([]byte("\n"))
@@ -100,6 +139,37 @@ func printCert(args []string, out io.Writer, errOut io.Writer) error {
 	return nil
 }
 
+// matches reports whether c passes the -expiring-within, -expired and -ca filters
+func (pf *printFlags) matches(c cert.Certificate, now time.Time) bool {
+	if *pf.ca && !c.IsCA() {
+		return false
+	}
+	if *pf.expired && !c.Expired(now) {
+		return false
+	}
+	if *pf.expiringWithin > 0 && c.NotAfter().After(now.Add(*pf.expiringWithin)) {
+		return false
+	}
+	return true
+}
+
+// expandPaths resolves any globs in paths, a path that matches nothing is kept so reading it reports the error
+func expandPaths(paths []string) ([]string, error) {
+	var out []string
+	for _, p := range paths {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, newHelpErrorf("invalid -path %s: %s", p, err)
+		}
+		if len(matches) == 0 {
+			out = append(out, p)
+			continue
+		}
+		out = append(out, matches...)
+	}
+	return out, nil
+}
+
 func printSummary() string {
 	return "print <flags>: prints details about a certificate"
 }
@@ -5,8 +5,11 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,12 +28,20 @@ func Test_printHelp(t *testing.T) {
 	assert.Equal(
 		t,
 		"Usage of "+os.Args[0]+" print <flags>: prints details about a certificate\n"+
+			"  -ca\n"+
+			"    \tOptional: only print CA certificates\n"+
+			"  -expired\n"+
+			"    \tOptional: only print expired certificates\n"+
+			"  -expiring-within duration\n"+
+			"    \tOptional: only print certificates that expire within this duration, including those already expired\n"+
 			"  -json\n"+
 			"    \tOptional: outputs certificates in json format\n"+
 			"  -out-qr string\n"+
 			"    \tOptional: output a qr code image (png) of the certificate\n"+
 			"  -path string\n"+
-			"    \tRequired: path to the certificate\n",
+			"    \tRequired: path to the certificate, may be a glob. Further paths or globs can be given as arguments\n"+
+			"  -table\n"+
+			"    \tOptional: outputs a one line summary of each certificate\n",
 		ob.String(),
 	)
 }
@@ -180,6 +191,74 @@ func Test_printCert(t *testing.T) {
 	assert.Empty(t, eb.String())
 }
 
+func Test_printCertFilters(t *testing.T) {
+	time.Local = time.UTC
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	dir := t.TempDir()
+
+	now := time.Now()
+	ca, caKey := NewTestCaCert("test ca", nil, nil, now.Add(-time.Hour*3), now.Add(time.Hour*24*365), nil, nil, nil)
+	soon, _ := NewTestCert(ca, caKey, "soon", now.Add(-time.Hour), now.Add(time.Hour), []netip.Prefix{netip.MustParsePrefix("10.0.0.1/8")}, nil, []string{"a", "b"})
+	later, _ := NewTestCert(ca, caKey, "later", now.Add(-time.Hour), now.Add(time.Hour*24*30), []netip.Prefix{netip.MustParsePrefix("10.0.0.2/8")}, nil, nil)
+	expired, _ := NewTestCert(ca, caKey, "expired", now.Add(-time.Hour*2), now.Add(-time.Hour), []netip.Prefix{netip.MustParsePrefix("10.0.0.3/8")}, nil, nil)
+
+	write := func(name string, crts ...cert.Certificate) string {
+		var b []byte
+		for _, c := range crts {
+			p, err := c.MarshalPEM()
+			require.NoError(t, err)
+			b = append(b, p...)
+		}
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, b, 0600))
+		return path
+	}
+	caPath := write("ca.crt", ca)
+	write("soon.crt", soon)
+	write("hosts.crt", later, expired)
+
+	names := func(args ...string) []string {
+		ob.Reset()
+		eb.Reset()
+		require.NoError(t, printCert(append([]string{"-json"}, args...), ob, eb))
+		assert.Empty(t, eb.String())
+
+		var out []struct {
+			Details struct {
+				Name string `json:"name"`
+			} `json:"details"`
+		}
+		require.NoError(t, json.Unmarshal(ob.Bytes(), &out))
+		var n []string
+		for _, c := range out {
+			n = append(n, c.Details.Name)
+		}
+		return n
+	}
+
+	all := filepath.Join(dir, "*.crt")
+	assert.Equal(t, []string{"test ca", "later", "expired", "soon"}, names("-path", all))
+	assert.Equal(t, []string{"test ca", "soon"}, names("-path", caPath, filepath.Join(dir, "s*.crt")))
+	assert.Equal(t, []string{"test ca"}, names("-path", all, "-ca"))
+	assert.Equal(t, []string{"expired"}, names("-path", all, "-expired"))
+	assert.Equal(t, []string{"expired", "soon"}, names("-path", all, "-expiring-within", "24h"))
+	assert.Nil(t, names("-path", all, "-ca", "-expired"))
+
+	assertHelpError(t, printCert([]string{"-path", all, "-json", "-table"}, ob, eb), "cannot set both -json and -table")
+
+	// table
+	ob.Reset()
+	eb.Reset()
+	require.NoError(t, printCert([]string{"-table", "-path", all, "-expiring-within", "24h"}, ob, eb))
+	assert.Empty(t, eb.String())
+	lines := strings.Split(strings.TrimSpace(ob.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"PATH", "NAME", "CA", "NETWORKS", "GROUPS", "NOT", "AFTER", "FINGERPRINT"}, strings.Fields(lines[0]))
+	fp, _ := soon.Fingerprint()
+	assert.Equal(t, []string{filepath.Join(dir, "soon.crt"), "soon", "false", "10.0.0.1/8", "a,b", soon.NotAfter().Format(time.RFC3339), fp}, strings.Fields(lines[2]))
+}
+
 // NewTestCaCert will generate a CA cert
 func NewTestCaCert(name string, pubKey, privKey []byte, before, after time.Time, networks, unsafeNetworks []netip.Prefix, groups []string) (cert.Certificate, []byte) {
 	var err error
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/pkclient"
+)
+
+type requestFlags struct {
+	set            *flag.FlagSet
+	caCertPath     *string
+	name           *string
+	networks       *string
+	unsafeNetworks *string
+	groups         *string
+	outKeyPath     *string
+	outReqPath     *string
+	p11url         *string
+}
+
+func newRequestFlags() *requestFlags {
+	rf := requestFlags{set: flag.NewFlagSet("request", flag.ContinueOnError)}
+	rf.set.Usage = func() {}
+	rf.caCertPath = rf.set.String("ca-crt", "ca.crt", "Optional: path to the CA cert that will sign the request")
+	rf.name = rf.set.String("name", "", "Required: name of the cert, usually a hostname")
+	rf.networks = rf.set.String("networks", "", "Required: comma separated list of ip address and network in CIDR notation to assign to this cert")
+	rf.unsafeNetworks = rf.set.String("unsafe-networks", "", "Optional: comma separated list of ip address and network in CIDR notation. Unsafe networks this cert can route for")
+	rf.groups = rf.set.String("groups", "", "Optional: comma separated list of groups")
+	rf.outKeyPath = rf.set.String("out-key", "", "Optional: path to write the private key to, the default is <name>.key")
+	rf.outReqPath = rf.set.String("out-req", "", "Optional: path to write the request to, the default is <name>.req")
+	rf.p11url = p11Flag(rf.set)
+	return &rf
+}
+
+func request(args []string, out io.Writer, errOut io.Writer) error {
+	rf := newRequestFlags()
+	err := rf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	isP11 := len(*rf.p11url) > 0
+
+	if err := mustFlagString("ca-crt", rf.caCertPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("name", rf.name); err != nil {
+		return err
+	}
+	if err := mustFlagString("networks", rf.networks); err != nil {
+		return err
+	}
+
+	networks, err := parseNetworks(*rf.networks)
+	if err != nil {
+		return newHelpErrorf("invalid -networks definition: %s", err)
+	}
+
+	unsafeNetworks, err := parseNetworks(*rf.unsafeNetworks)
+	if err != nil {
+		return newHelpErrorf("invalid -unsafe-networks definition: %s", err)
+	}
+
+	rawCACert, err := os.ReadFile(*rf.caCertPath)
+	if err != nil {
+		return fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	caCert, _, err := cert.UnmarshalCertificateFromPEM(rawCACert)
+	if err != nil {
+		return fmt.Errorf("error while parsing ca-crt: %s", err)
+	}
+
+	if *rf.outKeyPath == "" {
+		*rf.outKeyPath = *rf.name + ".key"
+	}
+	if *rf.outReqPath == "" {
+		*rf.outReqPath = *rf.name + ".req"
+	}
+
+	if _, err := os.Stat(*rf.outReqPath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing request: %s", *rf.outReqPath)
+	}
+
+	// The key must be on the curve the CA signs with
+	curve := caCert.Curve()
+	var pub, rawPriv []byte
+	var dh cert.DHFunc
+
+	if isP11 {
+		if curve != cert.Curve_P256 {
+			return fmt.Errorf("PKCS#11 keys can only be used with a P256 ca")
+		}
+
+		p11Client, err := pkclient.FromUrl(*rf.p11url)
+		if err != nil {
+			return fmt.Errorf("error while creating PKCS#11 client: %w", err)
+		}
+		defer func(client *pkclient.PKClient) {
+			_ = client.Close()
+		}(p11Client)
+
+		pub, err = p11Client.GetPubKey()
+		if err != nil {
+			return fmt.Errorf("error while getting public key with PKCS#11: %w", err)
+		}
+		dh = p11Client.DeriveNoise
+
+	} else {
+		if _, err := os.Stat(*rf.outKeyPath); err == nil {
+			return fmt.Errorf("refusing to overwrite existing key: %s", *rf.outKeyPath)
+		}
+
+		pub, rawPriv = newKeypair(curve)
+		dh, err = cert.PrivateKeyDH(curve, rawPriv)
+		if err != nil {
+			return fmt.Errorf("error while preparing key: %w", err)
+		}
+	}
+
+	req := &cert.CertificateRequest{
+		Name:           *rf.name,
+		Networks:       networks,
+		UnsafeNetworks: unsafeNetworks,
+		Groups:         parseGroups(*rf.groups),
+		Curve:          curve,
+		PublicKey:      pub,
+	}
+
+	if err := req.Seal(caCert, dh); err != nil {
+		return fmt.Errorf("error while sealing request: %w", err)
+	}
+
+	b, err := req.MarshalPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling request: %w", err)
+	}
+
+	if !isP11 {
+		err = os.WriteFile(*rf.outKeyPath, cert.MarshalPrivateKeyToPEM(curve, rawPriv), 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-key: %s", err)
+		}
+	}
+
+	err = os.WriteFile(*rf.outReqPath, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-req: %s", err)
+	}
+
+	return nil
+}
+
+// parseNetworks splits a comma separated list of prefixes, skipping empty entries
+func parseNetworks(s string) ([]netip.Prefix, error) {
+	var networks []netip.Prefix
+	for _, rs := range strings.Split(s, ",") {
+		rs := strings.TrimSpace(rs)
+		if rs == "" {
+			continue
+		}
+
+		n, err := netip.ParsePrefix(rs)
+		if err != nil {
+			return nil, fmt.Errorf("%s", rs)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// parseGroups splits a comma separated list of groups, skipping empty entries
+func parseGroups(s string) []string {
+	var groups []string
+	for _, rg := range strings.Split(s, ",") {
+		g := strings.TrimSpace(rg)
+		if g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func requestSummary() string {
+	return "request <flags>: create a key pair and a signing request for it. the request can be passed to `nebula-cert sign -in-req`, the private key stays here"
+}
+
+func requestHelp(out io.Writer) {
+	rf := newRequestFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + requestSummary() + "\n"))
+	rf.set.SetOutput(out)
+	rf.set.PrintDefaults()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_requestSummary(t *testing.T) {
+	assert.Equal(t, "request <flags>: create a key pair and a signing request for it. the request can be passed to `nebula-cert sign -in-req`, the private key stays here", requestSummary())
+}
+
+func Test_requestHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	requestHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" request <flags>: create a key pair and a signing request for it. the request can be passed to `nebula-cert sign -in-req`, the private key stays here\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the CA cert that will sign the request (default \"ca.crt\")\n"+
+			"  -groups string\n"+
+			"    \tOptional: comma separated list of groups\n"+
+			"  -name string\n"+
+			"    \tRequired: name of the cert, usually a hostname\n"+
+			"  -networks string\n"+
+			"    \tRequired: comma separated list of ip address and network in CIDR notation to assign to this cert\n"+
+			"  -out-key string\n"+
+			"    \tOptional: path to write the private key to, the default is <name>.key\n"+
+			"  -out-req string\n"+
+			"    \tOptional: path to write the request to, the default is <name>.req\n"+
+			optionalPkcs11String("  -pkcs11 string\n    \tOptional: PKCS#11 URI to an existing private key\n")+
+			"  -unsafe-networks string\n"+
+			"    \tOptional: comma separated list of ip address and network in CIDR notation. Unsafe networks this cert can route for\n",
+		ob.String(),
+	)
+}
+
+func Test_request(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+	dir := t.TempDir()
+
+	// required args
+	assertHelpError(t, request([]string{"-networks", "10.1.0.1/16"}, ob, eb), "-name is required")
+	assertHelpError(t, request([]string{"-name", "test"}, ob, eb), "-networks is required")
+	assertHelpError(t, request([]string{"-name", "test", "-networks", "a"}, ob, eb), "invalid -networks definition: a")
+	require.EqualError(t, request([]string{"-name", "test", "-networks", "10.1.0.1/16", "-ca-crt", "./nope"}, ob, eb), "error while reading ca-crt: open ./nope: "+NoSuchFileError)
+
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := NewTestCaCert("ca", caPub, caPriv, time.Now(), time.Now().Add(time.Minute*200), nil, nil, nil)
+	b, _ := ca.MarshalPEM()
+	caCrt := filepath.Join(dir, "ca.crt")
+	caKey := filepath.Join(dir, "ca.key")
+	require.NoError(t, os.WriteFile(caCrt, b, 0600))
+	require.NoError(t, os.WriteFile(caKey, cert.MarshalSigningPrivateKeyToPEM(cert.Curve_CURVE25519, caPriv), 0600))
+
+	// the host makes a key and a request
+	outKey := filepath.Join(dir, "host.key")
+	outReq := filepath.Join(dir, "host.req")
+	args := []string{"-ca-crt", caCrt, "-name", "host", "-networks", "10.1.0.1/16", "-groups", "a, b", "-out-key", outKey, "-out-req", outReq}
+	require.NoError(t, request(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	require.EqualError(t, request(args, ob, eb), "refusing to overwrite existing request: "+outReq)
+
+	rb, _ := os.ReadFile(outKey)
+	hostKey, _, curve, err := cert.UnmarshalPrivateKeyFromPEM(rb)
+	require.NoError(t, err)
+	assert.Equal(t, cert.Curve_CURVE25519, curve)
+
+	// the requested fields are only signed once the ca operator confirms them
+	outCrt := filepath.Join(dir, "host.crt")
+	assertHelpError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-out-crt", outCrt}, ob, eb, nopw), "-in-req needs -name and -networks, or -accept-req to sign the requested fields as printed")
+	assert.Equal(t, "Certificate request:\n  name: host\n  networks: 10.1.0.1/16\n  unsafe-networks: \n  groups: a,b\n", ob.String())
+	assertHelpError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-accept-req", "-out-crt", outCrt}, ob, eb, nopw), "cannot set -accept-req without -in-req")
+	_, err = os.Stat(outCrt)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the ca signs it without seeing the key
+	ob.Reset()
+	require.NoError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-accept-req", "-out-crt", outCrt}, ob, eb, nopw))
+
+	rb, _ = os.ReadFile(outCrt)
+	c, _, err := cert.UnmarshalCertificateFromPEM(rb)
+	require.NoError(t, err)
+	assert.Equal(t, "host", c.Name())
+	assert.Equal(t, "10.1.0.1/16", c.Networks()[0].String())
+	assert.Equal(t, []string{"a", "b"}, c.Groups())
+	require.NoError(t, c.VerifyPrivateKey(cert.Curve_CURVE25519, hostKey))
+
+	// the command line wins over the request
+	require.NoError(t, os.Remove(outCrt))
+	require.NoError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-accept-req", "-out-crt", outCrt, "-groups", "c"}, ob, eb, nopw))
+	rb, _ = os.ReadFile(outCrt)
+	c, _, err = cert.UnmarshalCertificateFromPEM(rb)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, c.Groups())
+
+	// without -accept-req nothing the requester asked for is signed
+	require.NoError(t, os.Remove(outCrt))
+	require.NoError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-out-crt", outCrt, "-name", "other", "-networks", "10.1.0.2/16"}, ob, eb, nopw))
+	rb, _ = os.ReadFile(outCrt)
+	c, _, err = cert.UnmarshalCertificateFromPEM(rb)
+	require.NoError(t, err)
+	assert.Equal(t, "other", c.Name())
+	assert.Equal(t, "10.1.0.2/16", c.Networks()[0].String())
+	assert.Empty(t, c.Groups())
+	require.NoError(t, c.VerifyPrivateKey(cert.Curve_CURVE25519, hostKey))
+
+	assertHelpError(t, signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-out-key", "nope"}, ob, eb, nopw), "cannot set -in-req with -in-pub or -out-key")
+
+	// a request for another ca is refused
+	otherPub, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := NewTestCaCert("other", otherPub, otherPriv, time.Now(), time.Now().Add(time.Minute*200), nil, nil, nil)
+	b, _ = other.MarshalPEM()
+	otherCrt := filepath.Join(dir, "other.crt")
+	otherKey := filepath.Join(dir, "other.key")
+	require.NoError(t, os.WriteFile(otherCrt, b, 0600))
+	require.NoError(t, os.WriteFile(otherKey, cert.MarshalSigningPrivateKeyToPEM(cert.Curve_CURVE25519, otherPriv), 0600))
+
+	err = signCert([]string{"-ca-crt", otherCrt, "-ca-key", otherKey, "-in-req", outReq, "-accept-req", "-out-crt", filepath.Join(dir, "other-host.crt")}, ob, eb, nopw)
+	require.ErrorContains(t, err, "refusing to sign in-req: request was made for ca")
+
+	// a tampered request is refused
+	rb, _ = os.ReadFile(outReq)
+	req, _, err := cert.UnmarshalCertificateRequestFromPEM(rb)
+	require.NoError(t, err)
+	req.Name = "admin"
+	b, err = req.MarshalPEM()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(outReq, b, 0600))
+
+	err = signCert([]string{"-ca-crt", caCrt, "-ca-key", caKey, "-in-req", outReq, "-accept-req", "-out-crt", filepath.Join(dir, "admin.crt")}, ob, eb, nopw)
+	require.ErrorIs(t, err, cert.ErrRequestProofMismatch)
+}
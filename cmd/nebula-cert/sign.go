@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/ecdh"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -28,10 +29,13 @@ type signFlags struct {
 	unsafeNetworks *string
 	duration       *time.Duration
 	inPubPath      *string
+	inReqPath      *string
+	acceptReq      *bool
 	outKeyPath     *string
 	outCertPath    *string
 	outQRPath      *string
 	groups         *string
+	issuanceLog    *string
 
 	p11url *string
 
@@ -51,10 +55,13 @@ func newSignFlags() *signFlags {
 	sf.unsafeNetworks = sf.set.String("unsafe-networks", "", "Optional: comma separated list of ip address and network in CIDR notation. Unsafe networks this cert can route for")
 	sf.duration = sf.set.Duration("duration", 0, "Optional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	sf.inPubPath = sf.set.String("in-pub", "", "Optional (if out-key not set): path to read a previously generated public key")
+	sf.inReqPath = sf.set.String("in-req", "", "Optional: path to read a request made with nebula-cert request. The requested fields are printed, -name and -networks are still required unless -accept-req is set")
+	sf.acceptReq = sf.set.Bool("accept-req", false, "Optional: with -in-req, sign the name, networks, unsafe-networks and groups the request asks for where they are not given here")
 	sf.outKeyPath = sf.set.String("out-key", "", "Optional (if in-pub not set): path to write the private key to")
 	sf.outCertPath = sf.set.String("out-crt", "", "Optional: path to write the certificate to")
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
+	sf.issuanceLog = sf.set.String("issuance-log", "", "Optional: path to an issuance log to record the certificate in, it is created if it does not exist")
 	sf.p11url = p11Flag(sf.set)
 
 	sf.ip = sf.set.String("ip", "", "Deprecated, see -networks")
@@ -79,6 +86,50 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	if err := mustFlagString("ca-crt", sf.caCertPath); err != nil {
 		return err
 	}
+
+	var req *cert.CertificateRequest
+	if *sf.inReqPath != "" {
+		if *sf.inPubPath != "" || *sf.outKeyPath != "" {
+			return newHelpErrorf("cannot set -in-req with -in-pub or -out-key")
+		}
+
+		rawReq, err := os.ReadFile(*sf.inReqPath)
+		if err != nil {
+			return fmt.Errorf("error while reading in-req: %s", err)
+		}
+
+		req, _, err = cert.UnmarshalCertificateRequestFromPEM(rawReq)
+		if err != nil {
+			return fmt.Errorf("error while parsing in-req: %s", err)
+		}
+
+		// The requester picks these fields, show them so the operator knows what they would be signing
+		fmt.Fprintf(out, "Certificate request:\n  name: %s\n  networks: %s\n  unsafe-networks: %s\n  groups: %s\n",
+			req.Name, joinPrefixes(req.Networks), joinPrefixes(req.UnsafeNetworks), strings.Join(req.Groups, ","))
+
+		if *sf.acceptReq {
+			// Anything given on the command line wins over what was asked for
+			if *sf.name == "" {
+				*sf.name = req.Name
+			}
+			if *sf.networks == "" && *sf.ip == "" {
+				*sf.networks = joinPrefixes(req.Networks)
+			}
+			if *sf.unsafeNetworks == "" && *sf.subnets == "" {
+				*sf.unsafeNetworks = joinPrefixes(req.UnsafeNetworks)
+			}
+			if *sf.groups == "" {
+				*sf.groups = strings.Join(req.Groups, ",")
+			}
+
+		} else if *sf.name == "" || (*sf.networks == "" && *sf.ip == "") {
+			return newHelpErrorf("-in-req needs -name and -networks, or -accept-req to sign the requested fields as printed")
+		}
+
+	} else if *sf.acceptReq {
+		return newHelpErrorf("cannot set -accept-req without -in-req")
+	}
+
 	if err := mustFlagString("name", sf.name); err != nil {
 		return err
 	}
@@ -243,7 +294,22 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		}(p11Client)
 	}
 
-	if *sf.inPubPath != "" {
+	if req != nil {
+		var dh cert.DHFunc
+		if isP11 {
+			dh = p11Client.DeriveNoise
+		} else {
+			dh, err = cert.SigningKeyDH(curve, caKey)
+			if err != nil {
+				return fmt.Errorf("error while preparing ca-key: %s", err)
+			}
+		}
+
+		if err := req.Verify(caCert, dh); err != nil {
+			return fmt.Errorf("refusing to sign in-req: %w", err)
+		}
+		pub = req.PublicKey
+	} else if *sf.inPubPath != "" {
 		var pubCurve cert.Curve
 		rawPub, err := os.ReadFile(*sf.inPubPath)
 		if err != nil {
@@ -359,7 +425,13 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 		return fmt.Errorf("invalid version: %d", version)
 	}
 
-	if !isP11 && *sf.inPubPath == "" {
+	if *sf.issuanceLog != "" {
+		if err := appendIssuanceLog(*sf.issuanceLog, crts); err != nil {
+			return err
+		}
+	}
+
+	if !isP11 && *sf.inPubPath == "" && req == nil {
 		if _, err := os.Stat(*sf.outKeyPath); err == nil {
 			return fmt.Errorf("refusing to overwrite existing key: %s", *sf.outKeyPath)
 		}
@@ -399,6 +471,57 @@ func signCert(args []string, out io.Writer, errOut io.Writer, pr PasswordReader)
 	return nil
 }
 
+// appendIssuanceLog records crts at the end of the issuance log at path. The existing log must verify before anything is
+// added to it.
+func appendIssuanceLog(path string, crts []cert.Certificate) error {
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error while reading issuance-log: %w", err)
+	}
+
+	il, err := cert.UnmarshalIssuanceLog(raw)
+	if err != nil {
+		return fmt.Errorf("error while parsing issuance-log: %w", err)
+	}
+
+	var b []byte
+	for _, c := range crts {
+		e, err := il.Append(c)
+		if err != nil {
+			return fmt.Errorf("error while adding to issuance-log: %w", err)
+		}
+
+		line, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("error while marshalling issuance-log entry: %w", err)
+		}
+		b = append(append(b, line...), '\n')
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error while opening issuance-log: %w", err)
+	}
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error while writing issuance-log: %w", err)
+	}
+
+	return nil
+}
+
+func joinPrefixes(p []netip.Prefix) string {
+	s := make([]string, len(p))
+	for i := range p {
+		s[i] = p[i].String()
+	}
+	return strings.Join(s, ",")
+}
+
 func newKeypair(curve cert.Curve) ([]byte, []byte) {
 	switch curve {
 	case cert.Curve_CURVE25519:
@@ -27,6 +27,8 @@ func Test_signHelp(t *testing.T) {
 	assert.Equal(
 		t,
 		"Usage of "+os.Args[0]+" sign <flags>: create and sign a certificate\n"+
+			"  -accept-req\n"+
+			"    \tOptional: with -in-req, sign the name, networks, unsafe-networks and groups the request asks for where they are not given here\n"+
 			"  -ca-crt string\n"+
 			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
 			"  -ca-key string\n"+
@@ -37,8 +39,12 @@ func Test_signHelp(t *testing.T) {
 			"    \tOptional: comma separated list of groups\n"+
 			"  -in-pub string\n"+
 			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
+			"  -in-req string\n"+
+			"    \tOptional: path to read a request made with nebula-cert request. The requested fields are printed, -name and -networks are still required unless -accept-req is set\n"+
 			"  -ip string\n"+
 			"    \tDeprecated, see -networks\n"+
+			"  -issuance-log string\n"+
+			"    \tOptional: path to an issuance log to record the certificate in, it is created if it does not exist\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the cert, usually a hostname\n"+
 			"  -networks string\n"+
@@ -307,6 +313,32 @@ func Test_signCert(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, lCrt.PublicKey(), inPub)
 
+	// test signed certs are recorded in the issuance log
+	logPath := t.TempDir() + "/issuance.log"
+	for _, name := range []string{"first", "second"} {
+		os.Remove(crtF.Name())
+		args = []string{"-version", "1", "-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", name, "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-in-pub", inPubF.Name(), "-duration", "100m", "-issuance-log", logPath}
+		require.NoError(t, signCert(args, ob, eb, nopw))
+	}
+
+	rb, _ = os.ReadFile(logPath)
+	il, err := cert.UnmarshalIssuanceLog(rb)
+	require.NoError(t, err)
+	assert.Equal(t, 2, il.Len())
+	rb, _ = os.ReadFile(crtF.Name())
+	lCrt, _, err = cert.UnmarshalCertificateFromPEM(rb)
+	require.NoError(t, err)
+	fp, _ := lCrt.Fingerprint()
+	assert.True(t, il.Contains(fp))
+
+	// test a broken issuance log is not extended and nothing is written
+	os.Remove(crtF.Name())
+	require.NoError(t, os.WriteFile(logPath, []byte("{}\n"), 0644))
+	args = []string{"-version", "1", "-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "third", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-in-pub", inPubF.Name(), "-duration", "100m", "-issuance-log", logPath}
+	require.ErrorIs(t, signCert(args, ob, eb, nopw), cert.ErrIssuanceLogBroken)
+	_, err = os.Stat(crtF.Name())
+	require.ErrorIs(t, err, os.ErrNotExist)
+
 	// test refuse to sign cert with duration beyond root
 	ob.Reset()
 	eb.Reset()
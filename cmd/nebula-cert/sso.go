@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/enroll"
+)
+
+// Issuing a cert to a person signed in with OpenID Connect takes two steps. The person makes a key and request with
+// nebula-cert request and signs in with sso-login, which writes their id token. They send both to the CA operator, who
+// runs sso-sign. sso-sign verifies the id token against the identity provider and only then signs the request, with
+// the name and groups from the token rather than from the request. The check is only as strong as the place it runs,
+// so it belongs with the CA key. Whoever holds the CA key can still sign anything with plain sign.
+
+type ssoLoginFlags struct {
+	set          *flag.FlagSet
+	issuer       *string
+	clientID     *string
+	clientSecret *string
+	scopes       *string
+	outTokenPath *string
+}
+
+func newSsoLoginFlags() *ssoLoginFlags {
+	sf := ssoLoginFlags{set: flag.NewFlagSet("sso-login", flag.ContinueOnError)}
+	sf.set.Usage = func() {}
+	sf.issuer = sf.set.String("issuer", "", "Required: the OpenID Connect issuer url of the identity provider")
+	sf.clientID = sf.set.String("client-id", "", "Required: the client id registered with the identity provider, it must allow the device flow")
+	sf.clientSecret = sf.set.String("client-secret", "", "Optional: the client secret, if the identity provider requires one. NEBULA_SSO_CLIENT_SECRET is used when not set")
+	sf.scopes = sf.set.String("scopes", "profile,email,groups", "Optional: comma separated list of scopes to ask for along with openid")
+	sf.outTokenPath = sf.set.String("out-token", "sso.token", "Optional: path to write the id token to")
+	return &sf
+}
+
+func ssoLogin(args []string, out io.Writer, errOut io.Writer) error {
+	sf := newSsoLoginFlags()
+	err := sf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("issuer", sf.issuer); err != nil {
+		return err
+	}
+	if err := mustFlagString("client-id", sf.clientID); err != nil {
+		return err
+	}
+	if err := mustFlagString("out-token", sf.outTokenPath); err != nil {
+		return err
+	}
+
+	secret := *sf.clientSecret
+	if secret == "" {
+		secret = os.Getenv("NEBULA_SSO_CLIENT_SECRET")
+	}
+
+	p := &enroll.Provider{
+		Issuer:       *sf.issuer,
+		ClientID:     *sf.clientID,
+		ClientSecret: secret,
+		Scopes:       splitList(*sf.scopes),
+	}
+
+	ctx := context.Background()
+	if err := p.Discover(ctx); err != nil {
+		return err
+	}
+
+	da, err := p.StartDeviceFlow(ctx)
+	if err != nil {
+		return err
+	}
+
+	if da.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "To sign in, visit %s and check that the code is %s\n", da.VerificationURIComplete, da.UserCode)
+	} else {
+		fmt.Fprintf(out, "To sign in, visit %s and enter the code %s\n", da.VerificationURI, da.UserCode)
+	}
+
+	rawToken, err := p.PollToken(ctx, da)
+	if err != nil {
+		return err
+	}
+
+	// The token stands in for the person until it expires
+	err = os.WriteFile(*sf.outTokenPath, []byte(rawToken+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-token: %s", err)
+	}
+
+	fmt.Fprintf(out, "Wrote the id token to %s, send it to the CA operator along with your certificate request\n", *sf.outTokenPath)
+	return nil
+}
+
+type ssoSignFlags struct {
+	set           *flag.FlagSet
+	issuer        *string
+	clientID      *string
+	inTokenPath   *string
+	maxTokenAge   *time.Duration
+	nameClaim     *string
+	groupsClaim   *string
+	groupPrefix   *string
+	allowedGroups *string
+	duration      *time.Duration
+}
+
+// ssoOwnedSignFlags are the sign flags the identity provider decides, they can not be passed through
+var ssoOwnedSignFlags = []string{"name", "groups", "duration", "accept-req", "in-pub", "out-key"}
+
+func newSsoSignFlags() *ssoSignFlags {
+	sf := ssoSignFlags{set: flag.NewFlagSet("sso-sign", flag.ContinueOnError)}
+	sf.set.Usage = func() {}
+	sf.issuer = sf.set.String("issuer", "", "Required: the OpenID Connect issuer url of the identity provider")
+	sf.clientID = sf.set.String("client-id", "", "Required: the client id the id token must be issued to")
+	sf.inTokenPath = sf.set.String("in-token", "", "Required: path to the id token written by nebula-cert sso-login")
+	sf.maxTokenAge = sf.set.Duration("max-token-age", 15*time.Minute, "Optional: refuse id tokens issued longer ago than this")
+	sf.nameClaim = sf.set.String("name-claim", "email", "Optional: the id token claim holding the name of the cert")
+	sf.groupsClaim = sf.set.String("groups-claim", "groups", "Optional: the id token claim holding the groups of the cert")
+	sf.groupPrefix = sf.set.String("group-prefix", "", "Optional: prefix for every group from the identity provider, to keep them apart from host groups")
+	sf.allowedGroups = sf.set.String("allowed-groups", "", "Optional: comma separated list of the only identity provider groups to put in the cert, anyone in none of them is refused")
+	sf.duration = sf.set.Duration("duration", 8*time.Hour, "Optional: how long the cert should be valid for")
+	return &sf
+}
+
+func ssoSign(args []string, out io.Writer, errOut io.Writer, pr PasswordReader) error {
+	sf := newSsoSignFlags()
+	err := sf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("issuer", sf.issuer); err != nil {
+		return err
+	}
+	if err := mustFlagString("client-id", sf.clientID); err != nil {
+		return err
+	}
+	if err := mustFlagString("in-token", sf.inTokenPath); err != nil {
+		return err
+	}
+	if *sf.maxTokenAge <= 0 {
+		return newHelpErrorf("-max-token-age must be positive")
+	}
+	if *sf.duration <= 0 {
+		return newHelpErrorf("-duration must be positive")
+	}
+
+	signArgs := sf.set.Args()
+	if f := findFlag(signArgs, ssoOwnedSignFlags...); f != "" {
+		return newHelpErrorf("-%s can not be passed to sign, it comes from the identity provider or the request", f)
+	}
+	if findFlag(signArgs, "in-req") == "" {
+		return newHelpErrorf("-in-req must be passed to sign, the key has to come from a request made by the person")
+	}
+
+	rawToken, err := os.ReadFile(*sf.inTokenPath)
+	if err != nil {
+		return fmt.Errorf("error while reading in-token: %s", err)
+	}
+
+	p := &enroll.Provider{
+		Issuer:   *sf.issuer,
+		ClientID: *sf.clientID,
+	}
+	mapping := enroll.ClaimMapping{
+		NameClaim:     *sf.nameClaim,
+		GroupsClaim:   *sf.groupsClaim,
+		GroupPrefix:   *sf.groupPrefix,
+		AllowedGroups: splitList(*sf.allowedGroups),
+	}
+
+	ctx := context.Background()
+	if err := p.Discover(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	claims, err := p.VerifyIDToken(ctx, strings.TrimSpace(string(rawToken)), now)
+	if err != nil {
+		return err
+	}
+
+	if err := checkTokenAge(claims, now, *sf.maxTokenAge); err != nil {
+		return err
+	}
+
+	id, err := mapping.Identity(claims)
+	if err != nil {
+		return err
+	}
+
+	signArgs, err = ssoSignArgs(id, *sf.duration, signArgs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Signing a certificate for %s with groups %v, valid for %s\n", id.Name, id.Groups, *sf.duration)
+	return signCert(signArgs, out, errOut, pr)
+}
+
+// checkTokenAge refuses id tokens issued more than maxAge before now, a token is only a fresh sign in for so long
+func checkTokenAge(claims enroll.Claims, now time.Time, maxAge time.Duration) error {
+	iat, ok := claims.IssuedAt()
+	if !ok {
+		return fmt.Errorf("the id token has no issued at time")
+	}
+	if age := now.Sub(iat); age > maxAge {
+		return fmt.Errorf("the id token was issued %s ago, sign in again", age.Round(time.Second))
+	}
+	return nil
+}
+
+// ssoSignArgs returns the arguments for sign that issue a certificate to id
+func ssoSignArgs(id enroll.Identity, duration time.Duration, signArgs []string) ([]string, error) {
+	for _, g := range id.Groups {
+		if strings.Contains(g, ",") {
+			return nil, fmt.Errorf("the group %q from the identity provider can not contain a comma", g)
+		}
+	}
+
+	args := []string{"-name", id.Name, "-duration", duration.String()}
+	if len(id.Groups) > 0 {
+		args = append(args, "-groups", strings.Join(id.Groups, ","))
+	}
+	return append(args, signArgs...), nil
+}
+
+// findFlag returns the first of names that is set in args, in any of the forms the flag package accepts
+func findFlag(args []string, names ...string) string {
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		a = strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		a, _, _ = strings.Cut(a, "=")
+		for _, n := range names {
+			if a == n {
+				return n
+			}
+		}
+	}
+	return ""
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+func ssoLoginSummary() string {
+	return "sso-login <flags>: sign in with an OpenID Connect identity provider and write the id token, to send to the CA operator along with a request made by nebula-cert request"
+}
+
+func ssoLoginHelp(out io.Writer) {
+	sf := newSsoLoginFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + ssoLoginSummary() + "\n"))
+	sf.set.SetOutput(out)
+	sf.set.PrintDefaults()
+}
+
+func ssoSignSummary() string {
+	return "sso-sign <flags> -- <sign flags>: verify the id token from nebula-cert sso-login and sign the person's request as a short lived cert named after them, with their groups from the provider. everything after -- is passed to sign and must include -in-req"
+}
+
+func ssoSignHelp(out io.Writer) {
+	sf := newSsoSignFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + ssoSignSummary() + "\n"))
+	sf.set.SetOutput(out)
+	sf.set.PrintDefaults()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/enroll"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ssoLoginSummary(t *testing.T) {
+	assert.Equal(t, "sso-login <flags>: sign in with an OpenID Connect identity provider and write the id token, to send to the CA operator along with a request made by nebula-cert request", ssoLoginSummary())
+}
+
+func Test_ssoSignSummary(t *testing.T) {
+	assert.Equal(t, "sso-sign <flags> -- <sign flags>: verify the id token from nebula-cert sso-login and sign the person's request as a short lived cert named after them, with their groups from the provider. everything after -- is passed to sign and must include -in-req", ssoSignSummary())
+}
+
+func Test_ssoLogin(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, ssoLogin([]string{"-client-id", "nebula"}, ob, eb), "-issuer is required")
+	assertHelpError(t, ssoLogin([]string{"-issuer", "https://idp.example.com"}, ob, eb), "-client-id is required")
+	assertHelpError(t, ssoLogin([]string{"-issuer", "https://idp.example.com", "-client-id", "nebula", "-out-token", ""}, ob, eb), "-out-token is required")
+	assert.Empty(t, ob.String())
+}
+
+func Test_ssoSign(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+	nopw := &StubPasswordReader{}
+
+	// required args
+	assertHelpError(t, ssoSign([]string{"-client-id", "nebula", "-in-token", "sso.token"}, ob, eb, nopw), "-issuer is required")
+	assertHelpError(t, ssoSign([]string{"-issuer", "https://idp.example.com", "-in-token", "sso.token"}, ob, eb, nopw), "-client-id is required")
+	assertHelpError(t, ssoSign([]string{"-issuer", "https://idp.example.com", "-client-id", "nebula"}, ob, eb, nopw), "-in-token is required")
+
+	base := []string{"-issuer", "https://idp.example.com", "-client-id", "nebula", "-in-token", "sso.token"}
+	assertHelpError(t, ssoSign(append(base, "-duration", "0s"), ob, eb, nopw), "-duration must be positive")
+	assertHelpError(t, ssoSign(append(base, "-max-token-age", "0s"), ob, eb, nopw), "-max-token-age must be positive")
+
+	// The identity provider decides who the cert is for and the person's request decides the key
+	base = append(base, "--", "-networks", "10.1.0.9/16")
+	assertHelpError(t, ssoSign(base, ob, eb, nopw), "-in-req must be passed to sign, the key has to come from a request made by the person")
+	base = append(base, "-in-req", "ada.req")
+	assertHelpError(t, ssoSign(append(base, "-name", "root"), ob, eb, nopw), "-name can not be passed to sign, it comes from the identity provider or the request")
+	assertHelpError(t, ssoSign(append(base, "--groups=admins"), ob, eb, nopw), "-groups can not be passed to sign, it comes from the identity provider or the request")
+	assertHelpError(t, ssoSign(append(base, "-accept-req"), ob, eb, nopw), "-accept-req can not be passed to sign, it comes from the identity provider or the request")
+	assertHelpError(t, ssoSign(append(base, "-in-pub", "x.pub"), ob, eb, nopw), "-in-pub can not be passed to sign, it comes from the identity provider or the request")
+
+	// The token is read before the provider is asked anything
+	require.ErrorContains(t, ssoSign(append([]string{"-issuer", "https://idp.example.com", "-client-id", "nebula", "-in-token", "/does/not/exist"}, base[6:]...), ob, eb, nopw), "error while reading in-token")
+	assert.Empty(t, ob.String())
+}
+
+func Test_checkTokenAge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, checkTokenAge(enroll.Claims{"iat": float64(now.Add(-time.Minute).Unix())}, now, 15*time.Minute))
+	require.EqualError(t, checkTokenAge(enroll.Claims{"iat": float64(now.Add(-time.Hour).Unix())}, now, 15*time.Minute), "the id token was issued 1h0m0s ago, sign in again")
+	require.EqualError(t, checkTokenAge(enroll.Claims{}, now, 15*time.Minute), "the id token has no issued at time")
+}
+
+func Test_ssoSignArgs(t *testing.T) {
+	args, err := ssoSignArgs(enroll.Identity{Name: "ada@example.com", Groups: []string{"sso:eng", "sso:ops"}}, 8*time.Hour, []string{"-networks", "10.1.0.9/16", "-in-req", "ada.req"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-name", "ada@example.com", "-duration", "8h0m0s", "-groups", "sso:eng,sso:ops", "-networks", "10.1.0.9/16", "-in-req", "ada.req"}, args)
+
+	args, err = ssoSignArgs(enroll.Identity{Name: "ada"}, time.Hour, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-name", "ada", "-duration", "1h0m0s"}, args)
+
+	_, err = ssoSignArgs(enroll.Identity{Name: "ada", Groups: []string{"a,b"}}, time.Hour, nil)
+	require.EqualError(t, err, `the group "a,b" from the identity provider can not contain a comma`)
+}
@@ -13,9 +13,11 @@ import (
 )
 
 type verifyFlags struct {
-	set      *flag.FlagSet
-	caPath   *string
-	certPath *string
+	set             *flag.FlagSet
+	caPath          *string
+	certPath        *string
+	issuanceLogPath *string
+	issuanceHead    *string
 }
 
 func newVerifyFlags() *verifyFlags {
@@ -23,6 +25,8 @@ func newVerifyFlags() *verifyFlags {
 	vf.set.Usage = func() {}
 	vf.caPath = vf.set.String("ca", "", "Required: path to a file containing one or more ca certificates")
 	vf.certPath = vf.set.String("crt", "", "Required: path to a file containing a single certificate")
+	vf.issuanceLogPath = vf.set.String("issuance-log", "", "Optional: path to an issuance log the certificate must be recorded in")
+	vf.issuanceHead = vf.set.String("issuance-head", "", "Optional: published head hash the issuance log must contain, requires -issuance-log")
 	return &vf
 }
 
@@ -57,6 +61,26 @@ func verify(args []string, out io.Writer, errOut io.Writer) error {
 		}
 	}
 
+	if *vf.issuanceLogPath != "" {
+		rawLog, err := os.ReadFile(*vf.issuanceLogPath)
+		if err != nil {
+			return fmt.Errorf("error while reading issuance-log: %w", err)
+		}
+
+		il, err := cert.UnmarshalIssuanceLog(rawLog)
+		if err != nil {
+			return fmt.Errorf("error while parsing issuance-log: %w", err)
+		}
+
+		if *vf.issuanceHead != "" && !il.HasHead(*vf.issuanceHead) {
+			return fmt.Errorf("issuance-log does not contain issuance-head %s", *vf.issuanceHead)
+		}
+
+		caPool.RequireIssuanceLog(il)
+	} else if *vf.issuanceHead != "" {
+		return newHelpErrorf("-issuance-head requires -issuance-log")
+	}
+
 	rawCert, err := os.ReadFile(*vf.certPath)
 	if err != nil {
 		return fmt.Errorf("unable to read crt: %w", err)
@@ -26,7 +26,11 @@ func Test_verifyHelp(t *testing.T) {
 			"  -ca string\n"+
 			"    \tRequired: path to a file containing one or more ca certificates\n"+
 			"  -crt string\n"+
-			"    \tRequired: path to a file containing a single certificate\n",
+			"    \tRequired: path to a file containing a single certificate\n"+
+			"  -issuance-head string\n"+
+			"    \tOptional: published head hash the issuance log must contain, requires -issuance-log\n"+
+			"  -issuance-log string\n"+
+			"    \tOptional: path to an issuance log the certificate must be recorded in\n",
 		ob.String(),
 	)
 }
@@ -121,4 +125,28 @@ func Test_verify(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 	require.NoError(t, err)
+
+	// cert missing from the issuance log
+	logPath := t.TempDir() + "/issuance.log"
+	other, _ := NewTestCert(ca, caPriv, "other-cert", time.Now().Add(time.Hour*-1), time.Now().Add(time.Hour), nil, nil, nil)
+	require.NoError(t, appendIssuanceLog(logPath, []cert.Certificate{other}))
+	err = verify([]string{"-ca", caFile.Name(), "-crt", certFile.Name(), "-issuance-log", logPath}, ob, eb)
+	require.ErrorIs(t, err, cert.ErrNotInIssuanceLog)
+
+	// cert in the issuance log
+	require.NoError(t, appendIssuanceLog(logPath, []cert.Certificate{crt}))
+	err = verify([]string{"-ca", caFile.Name(), "-crt", certFile.Name(), "-issuance-log", logPath}, ob, eb)
+	require.NoError(t, err)
+
+	rawLog, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	il, err := cert.UnmarshalIssuanceLog(rawLog)
+	require.NoError(t, err)
+	err = verify([]string{"-ca", caFile.Name(), "-crt", certFile.Name(), "-issuance-log", logPath, "-issuance-head", il.Head()}, ob, eb)
+	require.NoError(t, err)
+
+	err = verify([]string{"-ca", caFile.Name(), "-crt", certFile.Name(), "-issuance-log", logPath, "-issuance-head", "nope"}, ob, eb)
+	require.EqualError(t, err, "issuance-log does not contain issuance-head nope")
+
+	assertHelpError(t, verify([]string{"-ca", caFile.Name(), "-crt", certFile.Name(), "-issuance-head", "nope"}, ob, eb), "-issuance-head requires -issuance-log")
 }
@@ -33,7 +33,8 @@ func init() {
 
 func main() {
 	serviceFlag := flag.String("service", "", "Control the system service.")
-	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
+	configPath := flag.String("config", "", "Path to either a file or directory to load yaml, json, or toml configuration from")
+	configDir := flag.String("config-dir", "", "Path to a directory of config fragments, like /etc/nebula/conf.d, merged over -config in lexical order")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
@@ -51,12 +52,12 @@ func main() {
 	}
 
 	if *serviceFlag != "" {
-		doService(configPath, configTest, Build, serviceFlag)
+		doService(configPath, configDir, configTest, Build, serviceFlag)
 		os.Exit(1)
 	}
 
-	if *configPath == "" {
-		fmt.Println("-config flag must be set")
+	if *configPath == "" && *configDir == "" {
+		fmt.Println("-config or -config-dir flag must be set")
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -65,13 +66,28 @@ func main() {
 	l.Out = os.Stdout
 
 	c := config.NewC(l)
-	err := c.Load(*configPath)
+	err := c.LoadWithDir(*configPath, *configDir)
 	if err != nil {
 		fmt.Printf("failed to load config: %s", err)
 		os.Exit(1)
 	}
 
 	sigChan := make(chan os.Signal, 1)
+	if nebula.HasInstances(c) {
+		instances, err := nebula.MainInstances(c, *configTest, Build, l, sigChan)
+		if err != nil {
+			util.LogWithContextIfNeeded("Failed to start", err, l)
+			os.Exit(1)
+		}
+
+		if !*configTest {
+			instances.Start()
+			instances.ShutdownBlock(sigChan)
+		}
+
+		os.Exit(0)
+	}
+
 	ctrl, err := nebula.Main(c, *configTest, Build, l, nil, sigChan)
 	if err != nil {
 		util.LogWithContextIfNeeded("Failed to start", err, l)
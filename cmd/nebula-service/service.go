@@ -16,9 +16,11 @@ var logger service.Logger
 
 type program struct {
 	configPath *string
+	configDir  *string
 	configTest *bool
 	build      string
 	control    *nebula.Control
+	instances  *nebula.Instances
 }
 
 func (p *program) Start(s service.Service) error {
@@ -29,11 +31,21 @@ func (p *program) Start(s service.Service) error {
 	HookLogger(l)
 
 	c := config.NewC(l)
-	err := c.Load(*p.configPath)
+	err := c.LoadWithDir(*p.configPath, *p.configDir)
 	if err != nil {
 		return fmt.Errorf("failed to load config: %s", err)
 	}
 
+	if nebula.HasInstances(c) {
+		p.instances, err = nebula.MainInstances(c, *p.configTest, Build, l, nil)
+		if err != nil {
+			return err
+		}
+
+		p.instances.Start()
+		return nil
+	}
+
 	p.control, err = nebula.Main(c, *p.configTest, Build, l, nil, nil)
 	if err != nil {
 		return err
@@ -45,6 +57,10 @@ func (p *program) Start(s service.Service) error {
 
 func (p *program) Stop(s service.Service) error {
 	logger.Info("Nebula service stopping.")
+	if p.instances != nil {
+		p.instances.Stop()
+		return nil
+	}
 	p.control.Stop()
 	return nil
 }
@@ -57,8 +73,8 @@ func fileExists(filename string) bool {
 	return true
 }
 
-func doService(configPath *string, configTest *bool, build string, serviceFlag *string) {
-	if *configPath == "" {
+func doService(configPath, configDir *string, configTest *bool, build string, serviceFlag *string) {
+	if *configPath == "" && *configDir == "" {
 		ex, err := os.Executable()
 		if err != nil {
 			panic(err)
@@ -75,9 +91,13 @@ func doService(configPath *string, configTest *bool, build string, serviceFlag *
 		Description: "Nebula network connectivity daemon for encrypted communications",
 		Arguments:   []string{"-service", "run", "-config", *configPath},
 	}
+	if *configDir != "" {
+		svcConfig.Arguments = append(svcConfig.Arguments, "-config-dir", *configDir)
+	}
 
 	prg := &program{
 		configPath: configPath,
+		configDir:  configDir,
 		configTest: configTest,
 		build:      build,
 	}
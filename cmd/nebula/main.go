@@ -32,8 +32,11 @@ func init() {
 }
 
 func main() {
-	configPath := flag.String("config", "", "Path to either a file or directory to load configuration from")
+	configPath := flag.String("config", "", "Path to either a file or directory to load yaml, json, or toml configuration from")
+	configDir := flag.String("config-dir", "", "Path to a directory of config fragments, like /etc/nebula/conf.d, merged over -config in lexical order")
 	configTest := flag.Bool("test", false, "Test the config and print the end result. Non zero exit indicates a faulty config")
+	doctor := flag.Bool("doctor", false, "Start nebula, check for common problems, print what was found and exit. Non zero exit indicates a problem that needs fixing")
+	doctorWait := flag.Duration("doctor-wait", nebula.DefaultDoctorWait, "How long -doctor waits for lighthouses to answer a handshake")
 	printVersion := flag.Bool("version", false, "Print version")
 	printUsage := flag.Bool("help", false, "Print command line usage")
 
@@ -49,29 +52,66 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *configPath == "" {
-		fmt.Println("-config flag must be set")
+	if *configPath == "" && *configDir == "" {
+		fmt.Println("-config or -config-dir flag must be set")
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	l := logrus.New()
 	l.Out = os.Stdout
+	if *doctor {
+		// Keep stdout for the report
+		l.Out = os.Stderr
+	}
 
 	c := config.NewC(l)
-	err := c.Load(*configPath)
+	err := c.LoadWithDir(*configPath, *configDir)
 	if err != nil {
 		fmt.Printf("failed to load config: %s", err)
 		os.Exit(1)
 	}
 
 	sigChan := make(chan os.Signal, 1)
+	if nebula.HasInstances(c) {
+		if *doctor {
+			fmt.Println("-doctor can not be used with a config that has instances")
+			os.Exit(1)
+		}
+
+		instances, err := nebula.MainInstances(c, *configTest, Build, l, sigChan)
+		if err != nil {
+			util.LogWithContextIfNeeded("Failed to start", err, l)
+			os.Exit(1)
+		}
+
+		if !*configTest {
+			instances.Start()
+			notifyReady(l)
+			instances.ShutdownBlock(sigChan)
+		}
+
+		os.Exit(0)
+	}
+
 	ctrl, err := nebula.Main(c, *configTest, Build, l, nil, sigChan)
 	if err != nil {
 		util.LogWithContextIfNeeded("Failed to start", err, l)
 		os.Exit(1)
 	}
 
+	if *doctor && !*configTest {
+		ctrl.Start()
+		report := ctrl.Doctor(*doctorWait)
+		ctrl.Stop()
+
+		fmt.Print(report.String())
+		if report.Failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if !*configTest {
 		ctrl.Start()
 		notifyReady(l)
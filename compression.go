@@ -0,0 +1,251 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Compression is for tunnels over slow links with long round trips, like satellite or LTE, where spending cpu to send
+// fewer bytes pays off. Each host decides on its own whether to compress what it sends to a peer, from
+// compression.hosts and compression.groups, and both say in the handshake which algorithms they can decompress. A host
+// only compresses with an algorithm its peer offered, so older peers are never sent compressed packets.
+//
+// Packets are compressed before they are encrypted and marked with the MessageLZ4 or MessageZstd subtype, which is
+// authenticated along with the rest of the header. Packets that do not get smaller are sent as they are. The size of a
+// compressed packet says something about what is in it, only compress tunnels where that is acceptable.
+
+// compressionAlgorithm is a bit in NebulaHandshakeDetails.Compression
+type compressionAlgorithm uint32
+
+const (
+	compressionNone compressionAlgorithm = 0
+	compressionLZ4  compressionAlgorithm = 1 << 0
+	compressionZstd compressionAlgorithm = 1 << 1
+
+	// supportedCompression is every algorithm we can decompress, we offer all of them in every handshake
+	supportedCompression = compressionLZ4 | compressionZstd
+
+	// defaultCompressionMinSize skips packets like tcp acks that are too small to shrink
+	defaultCompressionMinSize = 64
+)
+
+var compressionNames = map[string]compressionAlgorithm{
+	"none": compressionNone,
+	"lz4":  compressionLZ4,
+	"zstd": compressionZstd,
+}
+
+func parseCompressionAlgorithm(v any) (compressionAlgorithm, error) {
+	s := strings.ToLower(fmt.Sprintf("%v", v))
+	if a, ok := compressionNames[s]; ok {
+		return a, nil
+	}
+	return compressionNone, fmt.Errorf("%q is not one of none, lz4, zstd", s)
+}
+
+func (a compressionAlgorithm) String() string {
+	switch a {
+	case compressionLZ4:
+		return "lz4"
+	case compressionZstd:
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// subtype marks a data message compressed with a
+func (a compressionAlgorithm) subtype() header.MessageSubType {
+	switch a {
+	case compressionLZ4:
+		return header.MessageLZ4
+	case compressionZstd:
+		return header.MessageZstd
+	default:
+		return header.MessageNone
+	}
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		// The tunnel authenticates every packet so the zstd checksum would only cost us bytes
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderCRC(false),
+			zstd.WithLowerEncoderMem(true))
+		return e
+	})
+
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		// Never inflate past the largest packet a tun device can take
+		d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(udp.MTU))
+		return d
+	})
+
+	// compressionBufs holds the packets between compression and encryption, or decryption and decompression
+	compressionBufs = sync.Pool{New: func() any {
+		b := make([]byte, udp.MTU)
+		return &b
+	}}
+)
+
+// compress writes p compressed with a to dst, ok is false if it did not get smaller
+func (a compressionAlgorithm) compress(dst, p []byte) ([]byte, bool) {
+	switch a {
+	case compressionLZ4:
+		n, err := lz4.CompressBlock(p, dst[:cap(dst)], nil)
+		if err != nil || n == 0 || n >= len(p) {
+			return nil, false
+		}
+		return dst[:n], true
+
+	case compressionZstd:
+		out := zstdEncoder().EncodeAll(p, dst[:0])
+		if len(out) >= len(p) {
+			return nil, false
+		}
+		return out, true
+	}
+
+	return nil, false
+}
+
+// decompress writes the payload of a data message with subtype st to dst
+func decompress(st header.MessageSubType, dst, p []byte) ([]byte, error) {
+	switch st {
+	case header.MessageLZ4:
+		n, err := lz4.UncompressBlock(p, dst[:cap(dst)])
+		if err != nil {
+			return nil, err
+		}
+		return dst[:n], nil
+
+	case header.MessageZstd:
+		return zstdDecoder().DecodeAll(p, dst[:0])
+	}
+
+	return nil, fmt.Errorf("subtype %d is not compressed", st)
+}
+
+// isDataSubtype reports whether a message with subtype st carries a packet for the tun device
+func isDataSubtype(st header.MessageSubType) bool {
+	return st == header.MessageNone || st == header.MessageLZ4 || st == header.MessageZstd
+}
+
+// compressionConfig decides which peers we compress packets to
+type compressionConfig struct {
+	// hosts is the algorithm for a peer by vpn address, it wins over groups
+	hosts map[netip.Addr]compressionAlgorithm
+	// groups is the algorithm for peers in a certificate group
+	groups map[string]compressionAlgorithm
+	// minSize is the smallest packet worth compressing
+	minSize int
+
+	txBytes, txCompressedBytes metrics.Counter
+	rxBytes, rxCompressedBytes metrics.Counter
+}
+
+func newCompressionConfigFromConfig(c *config.C) (*compressionConfig, error) {
+	cc := &compressionConfig{
+		hosts:             map[netip.Addr]compressionAlgorithm{},
+		groups:            map[string]compressionAlgorithm{},
+		minSize:           c.GetInt("compression.min_size", defaultCompressionMinSize),
+		txBytes:           metrics.GetOrRegisterCounter("compression.tx.bytes", nil),
+		txCompressedBytes: metrics.GetOrRegisterCounter("compression.tx.compressed_bytes", nil),
+		rxBytes:           metrics.GetOrRegisterCounter("compression.rx.bytes", nil),
+		rxCompressedBytes: metrics.GetOrRegisterCounter("compression.rx.compressed_bytes", nil),
+	}
+
+	if cc.minSize < 0 {
+		return nil, fmt.Errorf("compression.min_size can not be negative")
+	}
+
+	for k, v := range c.GetMap("compression.hosts", map[string]any{}) {
+		addr, err := netip.ParseAddr(fmt.Sprintf("%v", k))
+		if err != nil {
+			return nil, fmt.Errorf("compression.hosts.%v is not a vpn address: %w", k, err)
+		}
+
+		a, err := parseCompressionAlgorithm(v)
+		if err != nil {
+			return nil, fmt.Errorf("compression.hosts.%v is invalid: %w", k, err)
+		}
+		cc.hosts[addr.Unmap()] = a
+	}
+
+	for k, v := range c.GetMap("compression.groups", map[string]any{}) {
+		a, err := parseCompressionAlgorithm(v)
+		if err != nil {
+			return nil, fmt.Errorf("compression.groups.%v is invalid: %w", k, err)
+		}
+		cc.groups[fmt.Sprintf("%v", k)] = a
+	}
+
+	return cc, nil
+}
+
+func (cc *compressionConfig) enabled() bool {
+	return cc != nil && (len(cc.hosts) > 0 || len(cc.groups) > 0)
+}
+
+// algorithm returns what we compress packets to peer with, offered is what they can decompress
+func (cc *compressionConfig) algorithm(peer *cert.CachedCertificate, offered uint32) compressionAlgorithm {
+	if !cc.enabled() || peer == nil {
+		return compressionNone
+	}
+
+	a, found := compressionNone, false
+	for _, n := range peer.Certificate.Networks() {
+		if a, found = cc.hosts[n.Addr()]; found {
+			break
+		}
+	}
+
+	if !found {
+		// A host in several groups gets the strongest algorithm of them
+		for g, ga := range cc.groups {
+			if _, ok := peer.InvertedGroups[g]; ok && ga > a {
+				a = ga
+			}
+		}
+	}
+
+	if uint32(a)&offered == 0 {
+		return compressionNone
+	}
+	return a
+}
+
+// reloadCompression picks up the compression config, the algorithm of a tunnel is decided when it is handshaked so
+// changes only apply to new tunnels
+func (f *Interface) reloadCompression(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("compression") {
+		return
+	}
+
+	cc, err := newCompressionConfigFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load compression config, keeping the previous one")
+		return
+	}
+
+	f.compression.Store(cc)
+	if cc.enabled() || !c.InitialLoad() {
+		f.l.WithFields(logrus.Fields{"hosts": cc.hosts, "groups": cc.groups, "minSize": cc.minSize}).
+			Info("Loaded compression config")
+	}
+}
+
+// compressionFor is what we compress packets to peer with, see compressionConfig.algorithm
+func (f *Interface) compressionFor(peer *cert.CachedCertificate, offered uint32) compressionAlgorithm {
+	return f.compression.Load().algorithm(peer, offered)
+}
@@ -0,0 +1,126 @@
+package nebula
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCompressionConfigFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	cc, err := newCompressionConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, cc.enabled())
+	assert.Equal(t, defaultCompressionMinSize, cc.minSize)
+
+	c.Settings["compression"] = map[string]any{
+		"hosts":    map[string]any{"10.0.0.5": "LZ4", "10.0.0.6": "none"},
+		"groups":   map[string]any{"satellite": "zstd"},
+		"min_size": 200,
+	}
+	cc, err = newCompressionConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, cc.enabled())
+	assert.Equal(t, map[netip.Addr]compressionAlgorithm{
+		netip.MustParseAddr("10.0.0.5"): compressionLZ4,
+		netip.MustParseAddr("10.0.0.6"): compressionNone,
+	}, cc.hosts)
+	assert.Equal(t, map[string]compressionAlgorithm{"satellite": compressionZstd}, cc.groups)
+	assert.Equal(t, 200, cc.minSize)
+
+	c.Settings["compression"] = map[string]any{"groups": map[string]any{"satellite": "gzip"}}
+	_, err = newCompressionConfigFromConfig(c)
+	require.EqualError(t, err, `compression.groups.satellite is invalid: "gzip" is not one of none, lz4, zstd`)
+
+	c.Settings["compression"] = map[string]any{"hosts": map[string]any{"satellite": "lz4"}}
+	_, err = newCompressionConfigFromConfig(c)
+	require.ErrorContains(t, err, "compression.hosts.satellite is not a vpn address")
+}
+
+func TestCompressionConfig_algorithm(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+	newPeer := func(addr string, groups ...string) *cert.CachedCertificate {
+		c, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, addr, time.Now(), time.Now().Add(time.Hour), []netip.Prefix{netip.MustParsePrefix(addr + "/24")}, nil, groups)
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		return &cert.CachedCertificate{Certificate: c, InvertedGroups: inverted}
+	}
+
+	cc := &compressionConfig{
+		hosts: map[netip.Addr]compressionAlgorithm{
+			netip.MustParseAddr("10.0.0.5"): compressionLZ4,
+			netip.MustParseAddr("10.0.0.6"): compressionNone,
+		},
+		groups: map[string]compressionAlgorithm{"lte": compressionLZ4, "satellite": compressionZstd},
+	}
+	all := uint32(supportedCompression)
+
+	assert.Equal(t, compressionNone, cc.algorithm(newPeer("10.0.0.2"), all))
+	assert.Equal(t, compressionLZ4, cc.algorithm(newPeer("10.0.0.2", "lte"), all))
+	// The strongest algorithm of all the groups
+	assert.Equal(t, compressionZstd, cc.algorithm(newPeer("10.0.0.2", "lte", "satellite"), all))
+	// Hosts win over groups, even to turn it off
+	assert.Equal(t, compressionLZ4, cc.algorithm(newPeer("10.0.0.5", "satellite"), all))
+	assert.Equal(t, compressionNone, cc.algorithm(newPeer("10.0.0.6", "satellite"), all))
+	// Never with an algorithm the peer can not decompress, like older hosts that offer nothing
+	assert.Equal(t, compressionNone, cc.algorithm(newPeer("10.0.0.2", "satellite"), uint32(compressionLZ4)))
+	assert.Equal(t, compressionNone, cc.algorithm(newPeer("10.0.0.2", "satellite"), 0))
+
+	var nilConfig *compressionConfig
+	assert.Equal(t, compressionNone, nilConfig.algorithm(newPeer("10.0.0.2", "satellite"), all))
+}
+
+func TestCompressionAlgorithm_compress(t *testing.T) {
+	payload := bytes.Repeat([]byte("satellite links are slow "), 40)
+	random := make([]byte, 1000)
+	for i := range random {
+		random[i] = byte(i * 7919 >> 3)
+	}
+
+	for _, a := range []compressionAlgorithm{compressionLZ4, compressionZstd} {
+		t.Run(a.String(), func(t *testing.T) {
+			buf := make([]byte, udp.MTU)
+			compressed, ok := a.compress(buf, payload)
+			require.True(t, ok)
+			assert.Less(t, len(compressed), len(payload)/5)
+
+			out, err := decompress(a.subtype(), make([]byte, udp.MTU), compressed)
+			require.NoError(t, err)
+			assert.Equal(t, payload, out)
+
+			_, ok = a.compress(buf, []byte("tiny"))
+			assert.False(t, ok)
+
+			_, err = decompress(a.subtype(), make([]byte, udp.MTU), random)
+			require.Error(t, err)
+		})
+	}
+
+	_, ok := compressionNone.compress(make([]byte, udp.MTU), payload)
+	assert.False(t, ok)
+
+	_, err := decompress(header.MessageNone, make([]byte, udp.MTU), payload)
+	require.Error(t, err)
+
+	// Nothing inflates past the largest packet we could have sent
+	bomb := make([]byte, udp.MTU+1)
+	for _, a := range []compressionAlgorithm{compressionLZ4, compressionZstd} {
+		compressed, ok := a.compress(make([]byte, udp.MTU), bomb)
+		require.True(t, ok)
+		_, err = decompress(a.subtype(), make([]byte, udp.MTU), compressed)
+		require.Error(t, err, a.String())
+	}
+}
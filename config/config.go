@@ -2,12 +2,15 @@ package config
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,7 +25,9 @@ import (
 
 type C struct {
 	path        string
+	dir         string
 	files       []string
+	fileSums    map[string][sha256.Size]byte
 	Settings    map[string]any
 	oldSettings map[string]any
 	callbacks   []func(*C)
@@ -37,23 +42,60 @@ func NewC(l *logrus.Logger) *C {
 	}
 }
 
-// Load will find all yaml files within path and load them in lexical order
+// Load will find all yaml, json, and toml files within path and load them in lexical order
 func (c *C) Load(path string) error {
+	return c.LoadWithDir(path, "")
+}
+
+// LoadWithDir loads path like Load and then every yaml, json, and toml file found within dir, like /etc/nebula/conf.d.
+// Either may be empty but not both. Files are merged in order, the files from path in lexical order followed by the
+// files from dir in lexical order, and a value in a later file wins over the same key in an earlier file. Lists are
+// appended together instead, so firewall rules may be spread over several files.
+func (c *C) LoadWithDir(path, dir string) error {
 	c.path = path
+	c.dir = dir
 	c.files = make([]string, 0)
 
-	err := c.resolve(path, true)
-	if err != nil {
-		return err
+	if path != "" {
+		err := c.resolve(path, true)
+		if err != nil {
+			return err
+		}
+
+		if len(c.files) == 0 {
+			return fmt.Errorf("no config files found at %s", path)
+		}
+
+		sort.Strings(c.files)
 	}
 
-	if len(c.files) == 0 {
-		return fmt.Errorf("no config files found at %s", path)
+	if dir != "" {
+		i, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("unable to read config dir: %w", err)
+		}
+		if !i.IsDir() {
+			return fmt.Errorf("config dir %s is not a directory", dir)
+		}
+
+		pathFiles := c.files
+		c.files = make([]string, 0)
+		err = c.resolve(dir, false)
+		if err != nil {
+			return err
+		}
+
+		// A dir within path would have its files loaded twice, they keep their place among the files from path
+		dirFiles := slices.DeleteFunc(c.files, func(f string) bool { return slices.Contains(pathFiles, f) })
+		sort.Strings(dirFiles)
+		c.files = append(pathFiles, dirFiles...)
 	}
 
-	sort.Strings(c.files)
+	if len(c.files) == 0 {
+		return fmt.Errorf("no config files found at %s", strings.Join(c.sources(), " or "))
+	}
 
-	err = c.parse()
+	err := c.parse()
 	if err != nil {
 		return err
 	}
@@ -61,6 +103,23 @@ func (c *C) Load(path string) error {
 	return nil
 }
 
+// Files returns the files the config was loaded from, in the order they were merged
+func (c *C) Files() []string {
+	return c.files
+}
+
+// sources returns the config path and dir that were given to load from
+func (c *C) sources() []string {
+	var s []string
+	if c.path != "" {
+		s = append(s, c.path)
+	}
+	if c.dir != "" {
+		s = append(s, c.dir)
+	}
+	return s
+}
+
 func (c *C) LoadString(raw string) error {
 	if raw == "" {
 		return errors.New("Empty configuration")
@@ -118,10 +177,22 @@ func (c *C) HasChanged(k string) bool {
 	return string(newVals) != string(oldVals)
 }
 
+// Hash returns a hex encoded sha256 of the current settings. It can be used to tell whether two nodes, or the same node
+// at two points in time, are running the same config without exposing any of it.
+func (c *C) Hash() string {
+	b, err := yaml.Marshal(c.Settings)
+	if err != nil {
+		c.l.WithError(err).Error("Error while marshaling config")
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 // CatchHUP will listen for the HUP signal in a go routine and reload all configs found in the
-// original path provided to Load. The old settings are shallow copied for change detection after the reload.
+// original path and dir provided to Load. The old settings are shallow copied for change detection after the reload.
 func (c *C) CatchHUP(ctx context.Context) {
-	if c.path == "" {
+	if c.path == "" && c.dir == "" {
 		return
 	}
 
@@ -152,12 +223,15 @@ func (c *C) ReloadConfig() {
 		c.oldSettings[k] = v
 	}
 
-	err := c.Load(c.path)
+	oldSums := c.fileSums
+	err := c.LoadWithDir(c.path, c.dir)
 	if err != nil {
-		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
+		c.l.WithField("config_path", c.sources()).WithError(err).Error("Error occurred while reloading config")
 		return
 	}
 
+	c.logChangedFiles(oldSums)
+
 	for _, v := range c.callbacks {
 		v(c)
 	}
@@ -249,6 +323,17 @@ func (c *C) GetUint32(k string, d uint32) uint32 {
 	return uint32(r)
 }
 
+// GetFloat will get the float64 for k or return the default d if not found or invalid
+func (c *C) GetFloat(k string, d float64) float64 {
+	r := c.GetString(k, strconv.FormatFloat(d, 'g', -1, 64))
+	v, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		return d
+	}
+
+	return v
+}
+
 // GetBool will get the bool for k or return the default d if not found or invalid
 func (c *C) GetBool(k string, d bool) bool {
 	r := strings.ToLower(c.GetString(k, fmt.Sprintf("%v", d)))
@@ -346,9 +431,7 @@ func (c *C) resolve(path string, direct bool) error {
 }
 
 func (c *C) addFile(path string, direct bool) error {
-	ext := filepath.Ext(path)
-
-	if !direct && ext != ".yaml" && ext != ".yml" {
+	if _, ok := formatFromExt(path); !direct && !ok {
 		return nil
 	}
 
@@ -362,9 +445,7 @@ func (c *C) addFile(path string, direct bool) error {
 }
 
 func (c *C) parseRaw(b []byte) error {
-	var m map[string]any
-
-	err := yaml.Unmarshal(b, &m)
+	m, err := unmarshal(detectFormat(b), b)
 	if err != nil {
 		return err
 	}
@@ -375,15 +456,21 @@ func (c *C) parseRaw(b []byte) error {
 
 func (c *C) parse() error {
 	var m map[string]any
+	sums := make(map[string][sha256.Size]byte, len(c.files))
 
 	for _, path := range c.files {
 		b, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
+		sums[path] = sha256.Sum256(b)
+
+		f, ok := formatFromExt(path)
+		if !ok {
+			f = detectFormat(b)
+		}
 
-		var nm map[string]any
-		err = yaml.Unmarshal(b, &nm)
+		nm, err := unmarshal(f, b)
 		if err != nil {
 			return err
 		}
@@ -398,9 +485,33 @@ func (c *C) parse() error {
 	}
 
 	c.Settings = m
+	c.fileSums = sums
 	return nil
 }
 
+// logChangedFiles logs each config file that was added, changed, or removed since the files had oldSums
+func (c *C) logChangedFiles(oldSums map[string][sha256.Size]byte) {
+	for _, path := range c.files {
+		old, ok := oldSums[path]
+		if !ok {
+			c.l.WithField("file", path).Info("Config file added")
+		} else if old != c.fileSums[path] {
+			c.l.WithField("file", path).Info("Config file changed")
+		}
+	}
+
+	removed := make([]string, 0)
+	for path := range oldSums {
+		if _, ok := c.fileSums[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		c.l.WithField("file", path).Info("Config file removed")
+	}
+}
+
 func readDirNames(path string) ([]string, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -91,6 +91,24 @@ func TestConfig_GetBool(t *testing.T) {
 	assert.False(t, c.GetBool("bool", true))
 }
 
+func TestConfig_GetFloat(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	assert.InDelta(t, 1.5, c.GetFloat("float", 1.5), 0)
+
+	c.Settings["float"] = 2.25
+	assert.InDelta(t, 2.25, c.GetFloat("float", 1.5), 0)
+
+	c.Settings["float"] = 3
+	assert.InDelta(t, 3.0, c.GetFloat("float", 1.5), 0)
+
+	c.Settings["float"] = "0.5"
+	assert.InDelta(t, 0.5, c.GetFloat("float", 1.5), 0)
+
+	c.Settings["float"] = "nope"
+	assert.InDelta(t, 1.5, c.GetFloat("float", 1.5), 0)
+}
+
 func TestConfig_HasChanged(t *testing.T) {
 	l := test.NewLogger()
 	// No reload has occurred, return false
@@ -113,6 +131,23 @@ func TestConfig_HasChanged(t *testing.T) {
 	assert.False(t, c.HasChanged(""))
 }
 
+func TestConfig_Hash(t *testing.T) {
+	l := test.NewLogger()
+	c := NewC(l)
+	require.NoError(t, c.LoadString("pki:\n  key: secret\nlisten:\n  port: 4242\n"))
+	h := c.Hash()
+	assert.Len(t, h, 64)
+	assert.NotContains(t, h, "secret")
+
+	// Key order does not matter
+	c2 := NewC(l)
+	require.NoError(t, c2.LoadString("listen:\n  port: 4242\npki:\n  key: secret\n"))
+	assert.Equal(t, h, c2.Hash())
+
+	c2.Settings["listen"] = map[string]any{"port": 4243}
+	assert.NotEqual(t, h, c2.Hash())
+}
+
 func TestConfig_ReloadConfig(t *testing.T) {
 	l := test.NewLogger()
 	done := make(chan bool, 1)
@@ -147,6 +182,49 @@ func TestConfig_ReloadConfig(t *testing.T) {
 
 }
 
+func TestConfig_LoadWithDir(t *testing.T) {
+	l := test.NewLogger()
+	base := t.TempDir()
+	confd := filepath.Join(base, "conf.d")
+	require.NoError(t, os.Mkdir(confd, 0755))
+	mainPath := filepath.Join(base, "config.yml")
+
+	require.NoError(t, os.WriteFile(mainPath, []byte("outer:\n  inner: main\n  keep: main\nlist: [main]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(confd, "20-b.yml"), []byte("outer:\n  inner: b"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(confd, "10-a.json"), []byte(`{"outer": {"inner": "a"}, "list": ["a"]}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(confd, "README"), []byte("not config"), 0644))
+
+	// Fragments are merged over the mainPath config in lexical order, the last one wins
+	c := NewC(l)
+	require.NoError(t, c.LoadWithDir(mainPath, confd))
+	assert.Equal(t, []string{mainPath, filepath.Join(confd, "10-a.json"), filepath.Join(confd, "20-b.yml")}, c.Files())
+	assert.Equal(t, "b", c.GetString("outer.inner", ""))
+	assert.Equal(t, "main", c.GetString("outer.keep", ""))
+	assert.ElementsMatch(t, []string{"main", "a"}, c.GetStringSlice("list", nil))
+
+	// A reload picks up edits to any fragment along with added and removed ones
+	require.NoError(t, os.WriteFile(filepath.Join(confd, "10-a.json"), []byte(`{"outer": {"keep": "a"}}`), 0644))
+	require.NoError(t, os.Remove(filepath.Join(confd, "20-b.yml")))
+	require.NoError(t, os.WriteFile(filepath.Join(confd, "30-c.toml"), []byte("[outer]\ninner = \"c\""), 0644))
+	c.ReloadConfig()
+	assert.True(t, c.HasChanged("outer"))
+	assert.Equal(t, "c", c.GetString("outer.inner", ""))
+	assert.Equal(t, "a", c.GetString("outer.keep", ""))
+	assert.Equal(t, []string{mainPath, filepath.Join(confd, "10-a.json"), filepath.Join(confd, "30-c.toml")}, c.Files())
+
+	// A dir alone is enough, one that is within the config path is not loaded twice
+	c = NewC(l)
+	require.NoError(t, c.LoadWithDir("", confd))
+	assert.Equal(t, "c", c.GetString("outer.inner", ""))
+	c = NewC(l)
+	require.NoError(t, c.LoadWithDir(base, confd))
+	assert.Len(t, c.Files(), 3)
+
+	require.Error(t, NewC(l).LoadWithDir(mainPath, filepath.Join(base, "missing")))
+	require.Error(t, NewC(l).LoadWithDir(mainPath, mainPath))
+	require.Error(t, NewC(l).LoadWithDir("", t.TempDir()))
+}
+
 // Ensure mergo merges are done the way we expect.
 // This is needed to test for potential regressions, like:
 // - https://github.com/imdario/mergo/issues/187
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.yaml.in/yaml/v3"
+)
+
+// Config may be written in yaml, json, or toml. Files are told apart by their extension, anything else, like a config
+// given as a string or a file named config.conf, by its content. Whatever the format, values are turned into what yaml
+// would have given us so keys are read, merged, and compared for reloads the same way.
+
+type format int
+
+const (
+	formatYAML format = iota
+	formatJSON
+	formatTOML
+)
+
+func (f format) String() string {
+	switch f {
+	case formatJSON:
+		return "json"
+	case formatTOML:
+		return "toml"
+	default:
+		return "yaml"
+	}
+}
+
+// tomlLine matches a toml table header or top level key = value line
+var tomlLine = regexp.MustCompile(`^(\[\[?[A-Za-z0-9_.\-" ]+\]\]?|[A-Za-z0-9_.\-"]+\s*=)`)
+
+// formatFromExt returns the format of a file with a known config extension
+func formatFromExt(path string) (format, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML, true
+	case ".json":
+		return formatJSON, true
+	case ".toml":
+		return formatTOML, true
+	default:
+		return formatYAML, false
+	}
+}
+
+// detectFormat guesses the format of b from its first line that is not blank or a comment
+func detectFormat(b []byte) format {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "{") {
+			return formatJSON
+		}
+		if tomlLine.MatchString(line) {
+			return formatTOML
+		}
+		return formatYAML
+	}
+	return formatYAML
+}
+
+// unmarshal parses b in format f
+func unmarshal(f format, b []byte) (map[string]any, error) {
+	var m map[string]any
+
+	switch f {
+	case formatJSON:
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&m); err != nil {
+			return nil, fmt.Errorf("json: %w", err)
+		}
+		if d.More() {
+			return nil, fmt.Errorf("json: unexpected data after the top level object")
+		}
+
+	case formatTOML:
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("toml: %w", err)
+		}
+
+	default:
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	if m == nil {
+		return nil, nil
+	}
+	return normalize(m).(map[string]any), nil
+}
+
+// normalize turns the values json and toml give us into the ones yaml would, whole numbers become int
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, iv := range v {
+			v[k] = normalize(iv)
+		}
+		return v
+
+	case []any:
+		for i, iv := range v {
+			v[i] = normalize(iv)
+		}
+		return v
+
+	case []map[string]any:
+		out := make([]any, len(v))
+		for i, iv := range v {
+			out[i] = normalize(iv)
+		}
+		return out
+
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+
+	case int64:
+		return int(v)
+
+	case toml.LocalDate, toml.LocalTime, toml.LocalDateTime:
+		return fmt.Sprint(v)
+
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	return v
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_LoadFormats(t *testing.T) {
+	l := test.NewLogger()
+	raw := map[format]string{
+		formatYAML: `
+# a comment
+listen:
+  port: 4242
+  read_buffer: 10485760
+timers:
+  interval: 10s
+  ratio: 0.5
+tun:
+  disabled: true
+firewall:
+  outbound:
+    - port: any
+      proto: any
+      host: any
+`,
+		formatJSON: `{
+  "listen": {"port": 4242, "read_buffer": 10485760},
+  "timers": {"interval": "10s", "ratio": 0.5},
+  "tun": {"disabled": true},
+  "firewall": {"outbound": [{"port": "any", "proto": "any", "host": "any"}]}
+}`,
+		formatTOML: `
+# a comment
+[listen]
+port = 4242
+read_buffer = 10485760
+
+[timers]
+interval = "10s"
+ratio = 0.5
+
+[tun]
+disabled = true
+
+[[firewall.outbound]]
+port = "any"
+proto = "any"
+host = "any"
+`,
+	}
+
+	expected := NewC(l)
+	require.NoError(t, expected.LoadString(raw[formatYAML]))
+
+	for f, s := range raw {
+		assert.Equal(t, f, detectFormat([]byte(s)), f.String())
+
+		c := NewC(l)
+		require.NoError(t, c.LoadString(s), f.String())
+		assert.Equal(t, expected.Settings, c.Settings, f.String())
+		assert.Equal(t, 4242, c.GetInt("listen.port", 0), f.String())
+		assert.Equal(t, uint32(10485760), c.GetUint32("listen.read_buffer", 0), f.String())
+		assert.Equal(t, 10*time.Second, c.GetDuration("timers.interval", 0), f.String())
+		assert.InEpsilon(t, 0.5, c.GetFloat("timers.ratio", 0), 0, f.String())
+		assert.True(t, c.GetBool("tun.disabled", false), f.String())
+		assert.Equal(t, expected.Hash(), c.Hash(), f.String())
+	}
+
+	_, err := unmarshal(formatJSON, []byte(`{"a": 1} {"b": 2}`))
+	require.Error(t, err)
+	_, err = unmarshal(formatTOML, []byte("a = "))
+	require.Error(t, err)
+}
+
+func TestConfig_LoadMixedFormats(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.yaml"), []byte("outer:\n  inner: hi\nlist: [a]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.json"), []byte(`{"outer": {"inner": "override"}, "list": ["b"]}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "03.toml"), []byte("new = 1\nlist = [\"c\"]"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "04.txt"), []byte("ignored: true"), 0644))
+
+	c := NewC(l)
+	require.NoError(t, c.Load(dir))
+	assert.Equal(t, map[string]any{
+		"outer": map[string]any{"inner": "override"},
+		"list":  []any{"c", "b", "a"},
+		"new":   1,
+	}, c.Settings)
+
+	// A file named directly is loaded whatever its extension, the format comes from its content
+	conf := filepath.Join(dir, "04.txt")
+	require.NoError(t, os.WriteFile(conf, []byte("[outer]\ninner = \"hi\"\n"), 0644))
+	c = NewC(l)
+	require.NoError(t, c.Load(conf))
+	assert.Equal(t, "hi", c.GetString("outer.inner", ""))
+
+	// Reloads tell changes apart the same way
+	require.NoError(t, os.WriteFile(conf, []byte("[outer]\ninner = \"ho\"\n"), 0644))
+	c.ReloadConfig()
+	assert.True(t, c.HasChanged("outer.inner"))
+	c.ReloadConfig()
+	assert.False(t, c.HasChanged("outer.inner"))
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Secret references let a config value name where a secret lives instead of holding it, so config files can be kept in
+// config management without the secrets in them. A value that is not a reference is used as is.
+//
+//	env://NAME            the environment variable NAME
+//	file:///path/to/file  the contents of the file, without a trailing newline
+//	vault://path#field    field of the HashiCorp Vault secret at path, kv version 1 or 2
+//
+// Vault is reached with VAULT_ADDR, VAULT_TOKEN, and VAULT_NAMESPACE when it is set, like the vault cli does.
+
+// GetSecret will get the string for k, resolving it if it is a secret reference, or return the default d if not found
+func (c *C) GetSecret(k, d string) (string, error) {
+	v, err := ResolveSecret(c.GetString(k, d))
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve %s: %w", k, err)
+	}
+	return v, nil
+}
+
+// ResolveSecret returns the secret ref points to, or ref itself if it is not a secret reference
+func ResolveSecret(ref string) (string, error) {
+	scheme, rest, ok := strings.Cut(ref, "://")
+	if !ok {
+		return ref, nil
+	}
+
+	switch scheme {
+	case "env":
+		v, ok := os.LookupEnv(rest)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", rest)
+		}
+		return v, nil
+
+	case "file":
+		b, err := os.ReadFile(rest)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+
+	case "vault":
+		path, field, _ := strings.Cut(rest, "#")
+		path = strings.Trim(path, "/")
+		if path == "" || field == "" {
+			return "", errors.New("vault references must look like vault://path#field")
+		}
+		return readVaultField(path, field)
+	}
+
+	return ref, nil
+}
+
+func readVaultField(path, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR must be set to read a vault secret")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to read vault secret %s: %w", path, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to read vault secret %s: %s", path, res.Status)
+	}
+
+	// kv version 2 nests the secret one level further down than version 1
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("unable to parse vault secret %s: %w", path, err)
+	}
+	data := secret.Data
+	if nested, ok := data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", fmt.Errorf("unable to parse vault secret %s: %w", path, err)
+		}
+	}
+
+	var v string
+	if raw, ok := data[field]; !ok || json.Unmarshal(raw, &v) != nil {
+		return "", fmt.Errorf("vault secret %s has no %s field", path, field)
+	}
+	return v, nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_GetSecret(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pass"), []byte("from-file\n"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/nebula":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": map[string]any{"password": "from-vault"}}})
+		case "/v1/kv/nebula":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"password": "from-vault-v1"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "s.token")
+	t.Setenv("NEBULA_TEST_SECRET", "from-env")
+
+	c := NewC(l)
+	require.NoError(t, c.LoadString(`
+plain: not a secret
+env: env://NEBULA_TEST_SECRET
+file: file://`+filepath.Join(dir, "pass")+`
+vault: vault://secret/data/nebula#password
+vault1: vault://kv/nebula#password
+missing_env: env://NEBULA_TEST_SECRET_MISSING
+missing_field: vault://kv/nebula#user
+no_field: vault://kv/nebula
+`))
+
+	for k, expected := range map[string]string{
+		"plain":  "not a secret",
+		"env":    "from-env",
+		"file":   "from-file",
+		"vault":  "from-vault",
+		"vault1": "from-vault-v1",
+		"unset":  "default",
+	} {
+		v, err := c.GetSecret(k, "default")
+		require.NoError(t, err, k)
+		assert.Equal(t, expected, v, k)
+	}
+
+	_, err := c.GetSecret("missing_env", "")
+	require.EqualError(t, err, "unable to resolve missing_env: environment variable NEBULA_TEST_SECRET_MISSING is not set")
+	_, err = c.GetSecret("missing_field", "")
+	require.ErrorContains(t, err, "vault secret kv/nebula has no user field")
+	_, err = c.GetSecret("no_field", "")
+	require.ErrorContains(t, err, "vault://path#field")
+
+	t.Setenv("VAULT_TOKEN", "wrong")
+	_, err = c.GetSecret("vault", "")
+	require.ErrorContains(t, err, "403")
+}
@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// ConnectStatus is the state of a tunnel after Control.Connect
+type ConnectStatus struct {
+	VpnAddr     netip.Addr `json:"vpnAddr"`
+	Established bool       `json:"established"`
+	// Remote is the underlay address of the tunnel, it is not valid when the tunnel goes through a relay
+	Remote netip.AddrPort `json:"remote"`
+	Relays []netip.Addr   `json:"relays,omitempty"`
+	// Attempts is how many rounds of handshakes we sent, 0 if the tunnel was already up
+	Attempts int64 `json:"attempts"`
+	// Tried are the addresses our last handshake went to when the tunnel did not come up
+	Tried    []netip.AddrPort `json:"tried,omitempty"`
+	Duration time.Duration    `json:"duration"`
+	Error    string           `json:"error,omitempty"`
+}
+
+var (
+	errConnectNotInNetwork = errors.New("vpn address is not in any of our networks")
+	errConnectDenied       = errors.New("vpn address is denied by peer_filter")
+	errConnectTimedOut     = errors.New("handshake timed out")
+)
+
+// connect starts a handshake with vpnAddr right away, the lighthouses are queried and asked to have the peer punch
+// towards us as part of it, and waits until the tunnel is up, the handshake gives up, or ctx is done
+func (f *Interface) connect(ctx context.Context, vpnAddr netip.Addr) ConnectStatus {
+	start := time.Now()
+	s := ConnectStatus{VpnAddr: vpnAddr}
+
+	if !f.myVpnNetworksTable.Contains(vpnAddr) {
+		s.Error = errConnectNotInNetwork.Error()
+		return s
+	}
+
+	if !f.peerFilter.Load().allowsAddr(vpnAddr) {
+		s.Error = errConnectDenied.Error()
+		return s
+	}
+
+	hostinfo, ready := f.handshakeManager.GetOrHandshake(vpnAddr, nil)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+	for !ready {
+		if hh := f.handshakeManager.queryVpnIp(vpnAddr); hh != nil {
+			hh.Lock()
+			s.Attempts = hh.counter
+			s.Tried = slices.Clone(hh.lastRemotes)
+			hh.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			s.Duration = time.Since(start)
+			s.Error = ctx.Err().Error()
+			return s
+		case <-tick.C:
+		}
+
+		if hostinfo = f.hostMap.QueryVpnAddr(vpnAddr); hostinfo != nil {
+			break
+		}
+
+		// The handshake may have completed since we looked at the hostmap
+		if f.handshakeManager.queryVpnIp(vpnAddr) == nil && f.hostMap.QueryVpnAddr(vpnAddr) == nil {
+			s.Duration = time.Since(start)
+			s.Error = errConnectTimedOut.Error()
+			return s
+		}
+	}
+
+	s.Established = true
+	s.Remote = hostinfo.remote
+	s.Relays = hostinfo.relayState.CopyRelayIps()
+	s.Tried = nil
+	s.Duration = time.Since(start)
+	return s
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net/netip"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,8 +29,21 @@ const (
 	migrateRelays  trafficDecision = 4
 	tryRehandshake trafficDecision = 5
 	sendTestPacket trafficDecision = 6
+	dropInactive   trafficDecision = 7 // close the tunnel for inactivity, keeping lighthouse state if configured to
+	// rehandshakeInvalid handshakes with a peer whose certificate is no longer valid in case it has a new one
+	rehandshakeInvalid trafficDecision = 8
 )
 
+// groupTimers overrides the connection manager timers for tunnels to hosts in group, a zero value keeps the global setting
+type groupTimers struct {
+	group                   string
+	checkInterval           time.Duration
+	pendingDeletionInterval time.Duration
+	inactivityTimeout       time.Duration
+	// dropInactive overrides tunnels.drop_inactive when it is not nil
+	dropInactive *bool
+}
+
 type connectionManager struct {
 	// relayUsed holds which relay localIndexs are in use
 	relayUsed     map[uint32]struct{}
@@ -44,20 +59,27 @@ type connectionManager struct {
 	pendingDeletionInterval time.Duration
 	inactivityTimeout       atomic.Int64
 	dropInactive            atomic.Bool
+	keepInactiveRemotes     atomic.Bool
+	groupTimers             atomic.Pointer[[]groupTimers]
+	staticFailover          atomic.Bool
+	staticPunch             atomic.Bool
 
 	metricsTxPunchy metrics.Counter
+	// metricsAuditedInvalid counts the tunnels pki.disconnect_invalid audit kept open despite an invalid certificate
+	metricsAuditedInvalid metrics.Counter
 
 	l *logrus.Logger
 }
 
 func newConnectionManagerFromConfig(l *logrus.Logger, c *config.C, hm *HostMap, p *Punchy) *connectionManager {
 	cm := &connectionManager{
-		hostMap:         hm,
-		l:               l,
-		punchy:          p,
-		relayUsed:       make(map[uint32]struct{}),
-		relayUsedLock:   &sync.RWMutex{},
-		metricsTxPunchy: metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
+		hostMap:               hm,
+		l:                     l,
+		punchy:                p,
+		relayUsed:             make(map[uint32]struct{}),
+		relayUsedLock:         &sync.RWMutex{},
+		metricsTxPunchy:       metrics.GetOrRegisterCounter("messages.tx.punchy", nil),
+		metricsAuditedInvalid: metrics.GetOrRegisterCounter("connection_manager.disconnect_invalid.audited", nil),
 	}
 
 	cm.reload(c, true)
@@ -78,7 +100,40 @@ func (cm *connectionManager) reload(c *config.C, initial bool) {
 		// The inactivity duration is checked each time a hostinfo ticks through so we don't need the wheel to contain it.
 		minDuration := min(time.Millisecond*500, cm.checkInterval, cm.pendingDeletionInterval)
 		maxDuration := max(cm.checkInterval, cm.pendingDeletionInterval)
+
+		// Size the wheel for the group timers we start with, later reloads are capped to what the wheel can hold
+		gt, err := groupTimersFromConfig(c)
+		if err != nil {
+			cm.l.WithError(err).Error("Failed to load timers.groups, ignoring it")
+			gt = nil
+		}
+		for _, g := range gt {
+			for _, d := range []time.Duration{g.checkInterval, g.pendingDeletionInterval} {
+				if d > 0 {
+					minDuration = min(minDuration, d)
+					maxDuration = max(maxDuration, d)
+				}
+			}
+		}
+
 		cm.trafficTimer = NewLockingTimerWheel[uint32](minDuration, maxDuration)
+		cm.groupTimers.Store(&gt)
+
+	} else if c.HasChanged("timers.groups") {
+		gt, err := groupTimersFromConfig(c)
+		if err != nil {
+			cm.l.WithError(err).Error("Failed to reload timers.groups, keeping the previous groups")
+		} else {
+			for _, g := range gt {
+				if g.checkInterval > cm.trafficTimer.t.wheelDuration || g.pendingDeletionInterval > cm.trafficTimer.t.wheelDuration {
+					cm.l.WithField("group", g.group).
+						WithField("maxDuration", cm.trafficTimer.t.wheelDuration).
+						Warn("Group timers are longer than nebula started with and will be capped until a restart")
+				}
+			}
+			cm.groupTimers.Store(&gt)
+			cm.l.WithField("groups", len(gt)).Info("timers.groups has changed")
+		}
 	}
 
 	if initial || c.HasChanged("tunnels.inactivity_timeout") {
@@ -91,6 +146,26 @@ func (cm *connectionManager) reload(c *config.C, initial bool) {
 		}
 	}
 
+	if initial || c.HasChanged("static_map.failover") {
+		old := cm.staticFailover.Load()
+		cm.staticFailover.Store(c.GetBool("static_map.failover", false))
+		if !initial {
+			cm.l.WithField("oldBool", old).
+				WithField("newBool", cm.staticFailover.Load()).
+				Info("static_map.failover has changed")
+		}
+	}
+
+	if initial || c.HasChanged("static_map.punch") {
+		old := cm.staticPunch.Load()
+		cm.staticPunch.Store(c.GetBool("static_map.punch", false))
+		if !initial {
+			cm.l.WithField("oldBool", old).
+				WithField("newBool", cm.staticPunch.Load()).
+				Info("static_map.punch has changed")
+		}
+	}
+
 	if initial || c.HasChanged("tunnels.drop_inactive") {
 		old := cm.dropInactive.Load()
 		cm.dropInactive.Store(c.GetBool("tunnels.drop_inactive", false))
@@ -100,12 +175,167 @@ func (cm *connectionManager) reload(c *config.C, initial bool) {
 				Info("Drop inactive setting has changed")
 		}
 	}
+
+	if initial || c.HasChanged("tunnels.keep_inactive_remotes") {
+		old := cm.keepInactiveRemotes.Load()
+		cm.keepInactiveRemotes.Store(c.GetBool("tunnels.keep_inactive_remotes", false))
+		if !initial {
+			cm.l.WithField("oldBool", old).
+				WithField("newBool", cm.keepInactiveRemotes.Load()).
+				Info("tunnels.keep_inactive_remotes has changed")
+		}
+	}
 }
 
 func (cm *connectionManager) getInactivityTimeout() time.Duration {
 	return (time.Duration)(cm.inactivityTimeout.Load())
 }
 
+// groupTimersFromConfig reads timers.groups, a map of group name to any of connection_alive_interval,
+// pending_deletion_interval, inactivity_timeout, and drop_inactive
+func groupTimersFromConfig(c *config.C) ([]groupTimers, error) {
+	var gt []groupTimers
+	for k, v := range c.GetMap("timers.groups", map[string]any{}) {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("timers.groups.%v is not a map", k)
+		}
+
+		g := groupTimers{group: fmt.Sprintf("%v", k)}
+		if rv, ok := m["drop_inactive"]; ok {
+			b, err := strconv.ParseBool(fmt.Sprintf("%v", rv))
+			if err != nil {
+				return nil, fmt.Errorf("timers.groups.%v.drop_inactive is invalid: %w", k, err)
+			}
+			g.dropInactive = &b
+		}
+
+		for name, d := range map[string]*time.Duration{
+			"connection_alive_interval": &g.checkInterval,
+			"pending_deletion_interval": &g.pendingDeletionInterval,
+			"inactivity_timeout":        &g.inactivityTimeout,
+		} {
+			rv, ok := m[name]
+			if !ok {
+				continue
+			}
+
+			var err error
+			*d, err = parseTimerDuration(rv)
+			if err != nil {
+				return nil, fmt.Errorf("timers.groups.%v.%s is invalid: %w", k, name, err)
+			}
+		}
+
+		gt = append(gt, g)
+	}
+
+	sort.Slice(gt, func(i, j int) bool { return gt[i].group < gt[j].group })
+	return gt, nil
+}
+
+// parseTimerDuration accepts a duration string or, like the global timers, a plain number of seconds
+func parseTimerDuration(v any) (time.Duration, error) {
+	s := fmt.Sprintf("%v", v)
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		if n == 0 {
+			return 0, fmt.Errorf("%q must be greater than 0", s)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q must be greater than 0", s)
+	}
+	return d, nil
+}
+
+// timersFor returns the check interval, pending deletion interval, and inactivity timeout for a tunnel.
+// Groups in the peer certificate override the global settings, if a host is in several groups the shortest value wins.
+func (cm *connectionManager) timersFor(h *HostInfo) (time.Duration, time.Duration, time.Duration) {
+	check, pending, inactivity := cm.checkInterval, cm.pendingDeletionInterval, cm.getInactivityTimeout()
+
+	gt := cm.groupTimers.Load()
+	if gt == nil || len(*gt) == 0 {
+		return check, pending, inactivity
+	}
+
+	crt := h.GetCert()
+	if crt == nil {
+		return check, pending, inactivity
+	}
+
+	var gCheck, gPending, gInactivity time.Duration
+	for _, g := range *gt {
+		if _, ok := crt.InvertedGroups[g.group]; !ok {
+			continue
+		}
+
+		gCheck = shortestTimer(gCheck, g.checkInterval)
+		gPending = shortestTimer(gPending, g.pendingDeletionInterval)
+		gInactivity = shortestTimer(gInactivity, g.inactivityTimeout)
+	}
+
+	if gCheck > 0 {
+		check = gCheck
+	}
+	if gPending > 0 {
+		pending = gPending
+	}
+	if gInactivity > 0 {
+		inactivity = gInactivity
+	}
+
+	return check, pending, inactivity
+}
+
+// dropInactiveFor reports whether an idle tunnel to h should be dropped. A group in the peer certificate overrides
+// tunnels.drop_inactive, if a host is in several groups that disagree the tunnel is kept.
+func (cm *connectionManager) dropInactiveFor(h *HostInfo) bool {
+	drop := cm.dropInactive.Load()
+
+	gt := cm.groupTimers.Load()
+	if gt == nil || len(*gt) == 0 {
+		return drop
+	}
+
+	crt := h.GetCert()
+	if crt == nil {
+		return drop
+	}
+
+	var gDrop *bool
+	for _, g := range *gt {
+		if g.dropInactive == nil {
+			continue
+		}
+		if _, ok := crt.InvertedGroups[g.group]; !ok {
+			continue
+		}
+
+		if gDrop == nil || !*g.dropInactive {
+			gDrop = g.dropInactive
+		}
+	}
+
+	if gDrop != nil {
+		return *gDrop
+	}
+	return drop
+}
+
+// shortestTimer returns the smaller of two durations where 0 means unset
+func shortestTimer(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 func (cm *connectionManager) In(h *HostInfo) {
 	h.in.Store(true)
 }
@@ -134,6 +364,7 @@ func (cm *connectionManager) getAndResetTrafficCheck(h *HostInfo, now time.Time)
 	out := h.out.Swap(false)
 	if in || out {
 		h.lastUsed = now
+		h.lastUsedNano.Store(now.UnixNano())
 	}
 	return in, out
 }
@@ -142,7 +373,8 @@ func (cm *connectionManager) getAndResetTrafficCheck(h *HostInfo, now time.Time)
 // We will continue to monitor the HostInfo until the tunnel is dropped.
 func (cm *connectionManager) AddTrafficWatch(h *HostInfo) {
 	if h.out.Swap(true) == false {
-		cm.trafficTimer.Add(h.localIndexId, cm.checkInterval)
+		checkInterval, _, _ := cm.timersFor(h)
+		cm.trafficTimer.Add(h.localIndexId, checkInterval)
 	}
 }
 
@@ -187,6 +419,15 @@ func (cm *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte
 		cm.intf.sendCloseTunnel(hostinfo)
 		cm.intf.closeTunnel(hostinfo)
 
+	case dropInactive:
+		cm.intf.sendCloseTunnel(hostinfo)
+		if cm.keepInactiveRemotes.Load() {
+			// Keep what the lighthouse told us so the tunnel can come back without asking again
+			cm.hostMap.DeleteHostInfo(hostinfo)
+		} else {
+			cm.intf.closeTunnel(hostinfo)
+		}
+
 	case swapPrimary:
 		cm.swapPrimary(hostinfo, primary)
 
@@ -196,8 +437,15 @@ func (cm *connectionManager) doTrafficCheck(localIndex uint32, p, nb, out []byte
 	case tryRehandshake:
 		cm.tryRehandshake(hostinfo)
 
+	case rehandshakeInvalid:
+		cm.intf.handshakeManager.StartHandshake(hostinfo.vpnAddrs[0], nil)
+
 	case sendTestPacket:
-		cm.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, p, nb, out)
+		// The reply tells us the peer's time as well, see clockProbes
+		cm.intf.SendMessageToHostInfo(header.Test, header.TestRequest, hostinfo, cm.intf.clockProbes.request(0, now), nb, out)
+		if cm.staticFailover.Load() {
+			cm.sendStaticFailoverTests(hostinfo, p, nb, out)
+		}
 	}
 
 	cm.resetRelayTrafficCheck(hostinfo)
@@ -329,9 +577,7 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 		return doNothing, nil, nil
 	}
 
-	if cm.isInvalidCertificate(now, hostinfo) {
-		return closeTunnel, hostinfo, nil
-	}
+	checkInterval, pendingDeletionInterval, inactivityTimeout := cm.timersFor(hostinfo)
 
 	primary := cm.hostMap.Hosts[hostinfo.vpnAddrs[0]]
 	mainHostInfo := true
@@ -339,6 +585,15 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 		mainHostInfo = false
 	}
 
+	switch cm.checkCertificate(now, hostinfo, mainHostInfo) {
+	case closeTunnel:
+		return closeTunnel, hostinfo, nil
+	case rehandshakeInvalid:
+		// Check again once the handshake has had a chance to replace this tunnel
+		cm.trafficTimer.Add(hostinfo.localIndexId, checkInterval)
+		return rehandshakeInvalid, hostinfo, nil
+	}
+
 	// Check for traffic on this hostinfo
 	inTraffic, outTraffic := cm.getAndResetTrafficCheck(hostinfo, now)
 
@@ -363,7 +618,7 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 			}
 		}
 
-		cm.trafficTimer.Add(hostinfo.localIndexId, cm.checkInterval)
+		cm.trafficTimer.Add(hostinfo.localIndexId, checkInterval)
 
 		if !outTraffic {
 			// Send a punch packet to keep the NAT state alive
@@ -382,10 +637,15 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 		return deleteTunnel, hostinfo, nil
 	}
 
+	// Tunnels we keep up on purpose are tested while idle so we notice when they die
+	if !outTraffic && cm.intf.preconnect.wants(hostinfo) {
+		outTraffic = true
+	}
+
 	decision := doNothing
 	if hostinfo != nil && hostinfo.ConnectionState != nil && mainHostInfo {
 		if !outTraffic {
-			inactiveFor, isInactive := cm.isInactive(hostinfo, now)
+			inactiveFor, isInactive := cm.isInactive(hostinfo, now, inactivityTimeout)
 			if isInactive {
 				// Tunnel is inactive, tear it down
 				hostinfo.logger(cm.l).
@@ -393,13 +653,13 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 					WithField("primary", mainHostInfo).
 					Info("Dropping tunnel due to inactivity")
 
-				return closeTunnel, hostinfo, primary
+				return dropInactive, hostinfo, primary
 			}
 
 			// If we aren't sending or receiving traffic then its an unused tunnel and we don't to test the tunnel.
 			// Just maintain NAT state if configured to do so.
 			cm.sendPunch(hostinfo)
-			cm.trafficTimer.Add(hostinfo.localIndexId, cm.checkInterval)
+			cm.trafficTimer.Add(hostinfo.localIndexId, checkInterval)
 			return doNothing, nil, nil
 		}
 
@@ -426,18 +686,18 @@ func (cm *connectionManager) makeTrafficDecision(localIndex uint32, now time.Tim
 	}
 
 	hostinfo.pendingDeletion.Store(true)
-	cm.trafficTimer.Add(hostinfo.localIndexId, cm.pendingDeletionInterval)
+	cm.trafficTimer.Add(hostinfo.localIndexId, pendingDeletionInterval)
 	return decision, hostinfo, nil
 }
 
-func (cm *connectionManager) isInactive(hostinfo *HostInfo, now time.Time) (time.Duration, bool) {
-	if cm.dropInactive.Load() == false {
+func (cm *connectionManager) isInactive(hostinfo *HostInfo, now time.Time, inactivityTimeout time.Duration) (time.Duration, bool) {
+	if !cm.dropInactiveFor(hostinfo) {
 		// We aren't configured to drop inactive tunnels
 		return 0, false
 	}
 
 	inactiveDuration := now.Sub(hostinfo.lastUsed)
-	if inactiveDuration < cm.getInactivityTimeout() {
+	if inactiveDuration < inactivityTimeout {
 		// It's not considered inactive
 		return inactiveDuration, false
 	}
@@ -478,33 +738,61 @@ func (cm *connectionManager) swapPrimary(current, primary *HostInfo) {
 	cm.hostMap.Unlock()
 }
 
-// isInvalidCertificate decides if we should destroy a tunnel.
-// returns true if pki.disconnect_invalid is true and the certificate is no longer valid.
-// Blocklisted certificates will skip the pki.disconnect_invalid check and return true.
-func (cm *connectionManager) isInvalidCertificate(now time.Time, hostinfo *HostInfo) bool {
+// checkCertificate verifies the peer certificate against the current CA pool and blocklist and decides what to do
+// with a tunnel whose certificate is no longer valid.
+// returns closeTunnel if pki.disconnect_invalid is true, or audit and the audit is over, and the certificate is no
+// longer valid. The primary tunnel to a peer first gets rehandshakeInvalid, the peer may have been given a new
+// certificate and the handshake gets it. If the tunnel is still here on the next check it is closed.
+// Blocklisted certificates will skip the pki.disconnect_invalid check and return closeTunnel.
+func (cm *connectionManager) checkCertificate(now time.Time, hostinfo *HostInfo, primary bool) trafficDecision {
 	remoteCert := hostinfo.GetCert()
 	if remoteCert == nil {
-		return false //don't tear down tunnels for handshakes in progress
+		return doNothing //don't tear down tunnels for handshakes in progress
 	}
 
 	caPool := cm.intf.pki.GetCAPool()
-	err := caPool.VerifyCachedCertificate(now, remoteCert)
+	inGrace, err := caPool.VerifyCachedCertificateWithGrace(now, remoteCert)
 	if err == nil {
-		return false //cert is still valid! yay!
+		if inGrace {
+			// Admitted for pki.expired_grace, keep reminding the peer to renew
+			cm.intf.peerCertInGrace(hostinfo, now)
+		}
+		return doNothing //cert is still valid! yay!
 	} else if err == cert.ErrBlockListed { //avoiding errors.Is for speed
 		// Block listed certificates should always be disconnected
 		hostinfo.logger(cm.l).WithError(err).
 			WithField("fingerprint", remoteCert.Fingerprint).
 			Info("Remote certificate is blocked, tearing down the tunnel")
-		return true
+		return closeTunnel
 	} else if cm.intf.disconnectInvalid.Load() {
+		if until := cm.intf.disconnectInvalidAudit.Load(); until != nil && (until.IsZero() || now.Before(*until)) {
+			// Only log and count each tunnel once, it is checked again every interval
+			if !hostinfo.auditedInvalidCert {
+				hostinfo.auditedInvalidCert = true
+				cm.metricsAuditedInvalid.Inc(1)
+				hostinfo.logger(cm.l).WithError(err).
+					WithField("fingerprint", remoteCert.Fingerprint).
+					WithField("auditUntil", until).
+					Warn("Remote certificate is no longer valid, keeping the tunnel while pki.disconnect_invalid is in audit mode")
+			}
+			return doNothing
+		}
+
+		if primary && !hostinfo.rehandshakedInvalidCert {
+			hostinfo.rehandshakedInvalidCert = true
+			hostinfo.logger(cm.l).WithError(err).
+				WithField("fingerprint", remoteCert.Fingerprint).
+				Info("Remote certificate is no longer valid, re-handshaking in case it was replaced")
+			return rehandshakeInvalid
+		}
+
 		hostinfo.logger(cm.l).WithError(err).
 			WithField("fingerprint", remoteCert.Fingerprint).
 			Info("Remote certificate is no longer valid, tearing down the tunnel")
-		return true
+		return closeTunnel
 	} else {
 		//if we reach here, the cert is no longer valid, but we're configured to keep tunnels from now-invalid certs open
-		return false
+		return doNothing
 	}
 }
 
@@ -526,11 +814,42 @@ func (cm *connectionManager) sendPunch(hostinfo *HostInfo) {
 			cm.metricsTxPunchy.Inc(1)
 			cm.intf.outside.WriteTo([]byte{1}, addr)
 		})
+		return
+	}
 
-	} else if hostinfo.remote.IsValid() {
+	if hostinfo.remote.IsValid() {
 		cm.metricsTxPunchy.Inc(1)
 		cm.intf.outside.WriteTo([]byte{1}, hostinfo.remote)
 	}
+
+	if cm.staticPunch.Load() && hostinfo.remotes != nil {
+		// Keep the nat state for every static address warm so a failover does not have to wait on a punch
+		for _, addr := range hostinfo.remotes.CopyStaticAddrs() {
+			if addr != hostinfo.remote {
+				cm.metricsTxPunchy.Inc(1)
+				cm.intf.outside.WriteTo([]byte{1}, addr)
+			}
+		}
+	}
+}
+
+// sendStaticFailoverTests sends a test packet to every other static address of a host that has stopped answering on
+// its current remote. The first reply roams the tunnel onto that address before the tunnel would be torn down.
+func (cm *connectionManager) sendStaticFailoverTests(hostinfo *HostInfo, p, nb, out []byte) {
+	if hostinfo.remotes == nil || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	for _, addr := range hostinfo.remotes.CopyStaticAddrs() {
+		if addr == hostinfo.remote {
+			continue
+		}
+
+		if cm.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(cm.l).WithField("udpAddr", addr).Debug("Testing static address for failover")
+		}
+		cm.intf.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, p, nb, out)
+	}
 }
 
 func (cm *connectionManager) tryRehandshake(hostinfo *HostInfo) {
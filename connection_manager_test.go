@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"net/netip"
@@ -285,7 +286,7 @@ func Test_NewConnectionManager_DisconnectInactive(t *testing.T) {
 
 	// Finally advance beyond the inactivity timeout
 	decision, _, _ = nc.makeTrafficDecision(hostinfo.localIndexId, now.Add(time.Minute*10))
-	assert.Equal(t, closeTunnel, decision)
+	assert.Equal(t, dropInactive, decision)
 	assert.Equal(t, now, hostinfo.lastUsed)
 	assert.False(t, hostinfo.pendingDeletion.Load())
 	assert.False(t, hostinfo.out.Load())
@@ -380,15 +381,56 @@ func Test_NewConnectionManagerTest_DisconnectInvalid(t *testing.T) {
 	// Check if to disconnect with invalid certificate.
 	// Should be alive.
 	nextTick := now.Add(45 * time.Second)
-	invalid := nc.isInvalidCertificate(nextTick, hostinfo)
-	assert.False(t, invalid)
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, true))
 
 	// Move ahead 61s.
 	// Check if to disconnect with invalid certificate.
-	// Should be disconnected.
+	// Should re-handshake once in case the peer has a new certificate, then be disconnected.
 	nextTick = now.Add(61 * time.Second)
-	invalid = nc.isInvalidCertificate(nextTick, hostinfo)
-	assert.True(t, invalid)
+	assert.Equal(t, rehandshakeInvalid, nc.checkCertificate(nextTick, hostinfo, true))
+	assert.Equal(t, closeTunnel, nc.checkCertificate(nextTick, hostinfo, true))
+
+	// Tunnels that are not the primary have nothing to gain from a handshake
+	assert.Equal(t, closeTunnel, nc.checkCertificate(nextTick, &HostInfo{ConnectionState: hostinfo.ConnectionState}, false))
+
+	// In audit mode the tunnel is kept, and counted once, until the audit ends
+	require.NoError(t, conf.LoadString("pki:\n  disconnect_invalid: audit\n  disconnect_invalid_audit_until: "+
+		now.Add(90*time.Second).UTC().Format(time.RFC3339)+"\n"))
+	ifce.reloadDisconnectInvalid(conf)
+	audited := nc.metricsAuditedInvalid.Count()
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, false))
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, false))
+	assert.Equal(t, audited+1, nc.metricsAuditedInvalid.Count())
+	assert.Equal(t, closeTunnel, nc.checkCertificate(now.Add(91*time.Second), hostinfo, false))
+
+	// Quoted times are strings to yaml
+	require.NoError(t, conf.LoadString("pki:\n  disconnect_invalid: audit\n  disconnect_invalid_audit_until: '"+
+		now.Add(90*time.Second).UTC().Format(time.RFC3339)+"'\n"))
+	ifce.reloadDisconnectInvalid(conf)
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, false))
+	assert.Equal(t, closeTunnel, nc.checkCertificate(now.Add(91*time.Second), hostinfo, false))
+
+	// Without an end the audit goes on forever
+	require.NoError(t, conf.LoadString("pki:\n  disconnect_invalid: audit\n"))
+	ifce.reloadDisconnectInvalid(conf)
+	assert.Equal(t, doNothing, nc.checkCertificate(now.Add(time.Hour), hostinfo, false))
+
+	require.NoError(t, conf.LoadString("pki:\n  disconnect_invalid: true\n"))
+	ifce.reloadDisconnectInvalid(conf)
+	assert.Equal(t, closeTunnel, nc.checkCertificate(nextTick, hostinfo, false))
+
+	// Within pki.expired_grace the tunnel is kept and flagged once
+	var events []InterfaceEvent
+	ifce.events.subscribe(func(e InterfaceEvent) { events = append(events, e) })
+	// Pretend the peer was just asked to renew, the test tunnel has no keys to send with
+	hostinfo.certRenewRequested.Store(nextTick.UnixNano())
+	ncp.SetExpiredGrace(time.Minute)
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, true))
+	assert.Equal(t, doNothing, nc.checkCertificate(nextTick, hostinfo, true))
+	assert.True(t, hostinfo.certInGrace.Load())
+	assert.True(t, copyHostInfo(hostinfo, nil).CertInGrace)
+	assert.Equal(t, []InterfaceEvent{InterfacePeerCertInGrace}, events)
+	assert.Equal(t, closeTunnel, nc.checkCertificate(now.Add(121*time.Second), hostinfo, false))
 }
 
 type dummyCert struct {
@@ -505,3 +547,172 @@ func (d *dummyCert) MarshalJSON() ([]byte, error) {
 func (d *dummyCert) Copy() cert.Certificate {
 	return d
 }
+
+func Test_connectionManager_timersFor(t *testing.T) {
+	l := test.NewLogger()
+	conf := config.NewC(l)
+	require.NoError(t, conf.LoadString(`
+timers:
+  groups:
+    voip:
+      connection_alive_interval: 2s
+      pending_deletion_interval: 5
+    batch:
+      connection_alive_interval: 30s
+      inactivity_timeout: 2h
+      drop_inactive: true
+    infra:
+      drop_inactive: false
+`))
+
+	hostMap := newHostMap(l)
+	nc := newConnectionManagerFromConfig(l, conf, hostMap, NewPunchyFromConfig(l, conf))
+
+	newHostInfo := func(groups ...string) *HostInfo {
+		ig := map[string]struct{}{}
+		for _, g := range groups {
+			ig[g] = struct{}{}
+		}
+		return &HostInfo{ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: ig},
+		}}
+	}
+
+	// Handshakes in progress and hosts in no configured group get the global timers
+	check, pending, inactivity := nc.timersFor(&HostInfo{})
+	assert.Equal(t, 9*time.Second, check)
+	assert.Equal(t, 20*time.Second, pending)
+	assert.Equal(t, 10*time.Minute, inactivity)
+
+	check, pending, inactivity = nc.timersFor(newHostInfo("web"))
+	assert.Equal(t, 9*time.Second, check)
+	assert.Equal(t, 20*time.Second, pending)
+	assert.Equal(t, 10*time.Minute, inactivity)
+
+	// Unset values fall back to the global timers
+	check, pending, inactivity = nc.timersFor(newHostInfo("voip"))
+	assert.Equal(t, 2*time.Second, check)
+	assert.Equal(t, 5*time.Second, pending)
+	assert.Equal(t, 10*time.Minute, inactivity)
+
+	check, pending, inactivity = nc.timersFor(newHostInfo("batch"))
+	assert.Equal(t, 30*time.Second, check)
+	assert.Equal(t, 20*time.Second, pending)
+	assert.Equal(t, 2*time.Hour, inactivity)
+
+	// The shortest value wins for a host in several groups
+	check, pending, inactivity = nc.timersFor(newHostInfo("voip", "batch"))
+	assert.Equal(t, 2*time.Second, check)
+	assert.Equal(t, 5*time.Second, pending)
+	assert.Equal(t, 2*time.Hour, inactivity)
+
+	// Groups can turn dropping idle tunnels on and off, keeping the tunnel wins when they disagree
+	assert.False(t, nc.dropInactiveFor(newHostInfo("voip")))
+	assert.True(t, nc.dropInactiveFor(newHostInfo("batch")))
+	assert.False(t, nc.dropInactiveFor(newHostInfo("batch", "infra")))
+	nc.dropInactive.Store(true)
+	assert.True(t, nc.dropInactiveFor(newHostInfo("voip")))
+	assert.False(t, nc.dropInactiveFor(newHostInfo("infra")))
+	nc.dropInactive.Store(false)
+
+	// The wheel was sized to hold the longest group timer
+	assert.Equal(t, 30*time.Second, nc.trafficTimer.t.wheelDuration)
+
+	// Groups can be changed with a reload
+	require.NoError(t, conf.ReloadConfigString(`
+timers:
+  groups:
+    voip:
+      connection_alive_interval: 1s
+`))
+	check, _, _ = nc.timersFor(newHostInfo("voip"))
+	assert.Equal(t, time.Second, check)
+	check, _, inactivity = nc.timersFor(newHostInfo("batch"))
+	assert.Equal(t, 9*time.Second, check)
+	assert.Equal(t, 10*time.Minute, inactivity)
+	assert.False(t, nc.dropInactiveFor(newHostInfo("batch")))
+
+	// An invalid reload keeps the previous groups
+	require.NoError(t, conf.ReloadConfigString(`
+timers:
+  groups:
+    voip:
+      connection_alive_interval: soon
+`))
+	check, _, _ = nc.timersFor(newHostInfo("voip"))
+	assert.Equal(t, time.Second, check)
+}
+
+// recordingConn is a udp.Conn that remembers where every packet was written
+type recordingConn struct {
+	udp.NoopConn
+	sent []netip.AddrPort
+}
+
+func (c *recordingConn) WriteTo(_ []byte, addr netip.AddrPort) error {
+	c.sent = append(c.sent, addr)
+	return nil
+}
+
+func Test_connectionManager_staticFailover(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+
+	conf := config.NewC(l)
+	conf.Settings["static_map"] = map[string]any{"failover": true, "punch": true}
+	conf.Settings["punchy"] = map[string]any{"punch": true}
+	punchy := NewPunchyFromConfig(l, conf)
+	nc := newConnectionManagerFromConfig(l, conf, hostMap, punchy)
+	assert.True(t, nc.staticFailover.Load())
+	assert.True(t, nc.staticPunch.Load())
+
+	conn := &recordingConn{}
+	ifce := &Interface{
+		hostMap:           hostMap,
+		outside:           conn,
+		writers:           []udp.Conn{conn},
+		lightHouse:        newTestLighthouse(),
+		connectionManager: nc,
+		messageMetrics:    newMessageMetricsOnlyRecvError(),
+		l:                 l,
+	}
+	nc.intf = ifce
+
+	current := netip.MustParseAddrPort("1.1.1.1:4242")
+	other := netip.MustParseAddrPort("2.2.2.2:4242")
+	vpnAddr := netip.MustParseAddr("172.1.1.2")
+
+	remotes := NewRemoteList([]netip.Addr{vpnAddr}, nil)
+	hr, err := NewHostnameResults(context.Background(), l, time.Minute, "ip4", time.Second, []string{current.String(), other.String()}, func() {})
+	require.NoError(t, err)
+	remotes.unlockedSetHostnamesResults(hr)
+
+	suite := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+	hostinfo := &HostInfo{
+		remote:   current,
+		remotes:  remotes,
+		vpnAddrs: []netip.Addr{vpnAddr},
+		ConnectionState: &ConnectionState{
+			eKey: NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{1}, 0)),
+		},
+	}
+
+	// Punches go to every static address
+	nc.sendPunch(hostinfo)
+	assert.ElementsMatch(t, []netip.AddrPort{current, other}, conn.sent)
+
+	// A failing tunnel is tested on the static addresses it is not using
+	conn.sent = nil
+	nc.sendStaticFailoverTests(hostinfo, []byte{}, make([]byte, 12), make([]byte, mtu))
+	assert.Equal(t, []netip.AddrPort{other}, conn.sent)
+
+	// Neither happens when turned off
+	require.NoError(t, conf.ReloadConfigString("punchy:\n  punch: true\nstatic_map:\n  failover: false\n  punch: false"))
+	assert.False(t, nc.staticFailover.Load())
+	assert.False(t, nc.staticPunch.Load())
+
+	conn.sent = nil
+	nc.sendPunch(hostinfo)
+	assert.Equal(t, []netip.AddrPort{current}, conn.sent)
+}
@@ -16,12 +16,22 @@ import (
 const ReplayWindow = 1024
 
 type ConnectionState struct {
-	eKey           *NebulaCipherState
-	dKey           *NebulaCipherState
-	H              *noise.HandshakeState
-	myCert         cert.Certificate
-	peerCert       *cert.CachedCertificate
-	initiator      bool
+	eKey       *NebulaCipherState
+	dKey       *NebulaCipherState
+	H          *noise.HandshakeState
+	myCert     cert.Certificate
+	peerCert   *cert.CachedCertificate
+	initiator  bool
+	cipher     string
+	nullCipher bool
+	// compression is what we compress data packets to the peer with, see compression.go
+	compression compressionAlgorithm
+	// peerSourcePorts is how many source ports the peer sends data from, 0 if it does not know about them
+	peerSourcePorts uint32
+	// peerHopSchedule is the port hopping schedule the peer follows, 0 if it does not hop
+	peerHopSchedule uint32
+	// resumeSecret authenticates resume requests for the tunnel, see session_resumption.go
+	resumeSecret   []byte
 	messageCounter atomic.Uint64
 	window         *Bits
 	writeLock      sync.Mutex
@@ -31,10 +41,14 @@ func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, i
 	var dhFunc noise.DHFunc
 	switch crt.Curve() {
 	case cert.Curve_CURVE25519:
-		dhFunc = noise.DH25519
+		if cs.keyInDevice {
+			dhFunc = noiseutil.DH25519Device
+		} else {
+			dhFunc = noise.DH25519
+		}
 	case cert.Curve_P256:
-		if cs.pkcs11Backed {
-			dhFunc = noiseutil.DHP256PKCS11
+		if cs.keyInDevice {
+			dhFunc = noiseutil.DHP256Device
 		} else {
 			dhFunc = noiseutil.DHP256
 		}
@@ -69,6 +83,7 @@ func NewConnectionState(l *logrus.Logger, cs *CertState, crt cert.Certificate, i
 	ci := &ConnectionState{
 		H:         hs,
 		initiator: initiator,
+		cipher:    cs.cipher,
 		window:    NewBits(ReplayWindow),
 		myCert:    crt,
 	}
@@ -5,7 +5,9 @@ import (
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
@@ -35,6 +37,24 @@ type Control struct {
 	dnsStart               func()
 	lighthouseStart        func()
 	connectionManagerStart func(context.Context)
+	podNetworkStart        func(context.Context)
+	wireguardGatewayStart  func(context.Context)
+	networkMonitorStart    func(context.Context)
+	lanDiscoveryStart      func(context.Context)
+	healthStart            func(context.Context)
+	vpnSettings            *vpnSettings
+	hostDns                *hostDns
+	groupSets              *groupSets
+	doctor                 *doctor
+	warmRestart            *warmRestart
+	preconnectStart        func(context.Context)
+	flowLog                *flowLog
+	ruleLearner            *ruleLearner
+	whoisStart             func(context.Context)
+	identityProxyStart     func(context.Context)
+	svid                   *svidIssuer
+	controlChannelStart    func(context.Context)
+	statsStop              func()
 }
 
 type ControlHostInfo struct {
@@ -47,6 +67,80 @@ type ControlHostInfo struct {
 	CurrentRemote          netip.AddrPort   `json:"currentRemote"`
 	CurrentRelaysToMe      []netip.Addr     `json:"currentRelaysToMe"`
 	CurrentRelaysThroughMe []netip.Addr     `json:"currentRelaysThroughMe"`
+
+	// Cipher and Curve are what was negotiated for the tunnel
+	Cipher string `json:"cipher"`
+	Curve  string `json:"curve"`
+	// NullCipher is set when the tunnel only authenticates traffic, see null_cipher.go
+	NullCipher bool `json:"nullCipher"`
+	// Path is direct when CurrentRemote is in use, relay when traffic goes through CurrentRelay
+	Path         string     `json:"path"`
+	CurrentRelay netip.Addr `json:"currentRelay"`
+
+	LastRoam       time.Time      `json:"lastRoam"`
+	LastRoamRemote netip.AddrPort `json:"lastRoamRemote"`
+	LastRebind     time.Time      `json:"lastRebind"`
+	// LastUsed is when the connection manager last saw traffic on the tunnel, zero until its first check
+	LastUsed time.Time `json:"lastUsed"`
+	// CertInGrace is set when Cert was expired but admitted within pki.expired_grace
+	CertInGrace bool `json:"certInGrace"`
+	// ClockSkew is how far the peer's clock was ahead of ours when last measured, nil until it is, see clock_skew.go
+	ClockSkew *time.Duration `json:"clockSkew,omitempty"`
+	// Labels are the labels the peer put in its config, as the lighthouses told us, see lighthouse_labels.go
+	Labels map[string]string `json:"labels,omitempty"`
+
+	Counters ControlTunnelCounters `json:"counters"`
+	// Compression shows how data packets to and from the peer are compressed, see compression.go
+	Compression ControlCompression `json:"compression"`
+
+	// Handshake is only set for hosts in the pending hostmap
+	Handshake *ControlHandshakeInfo `json:"handshake,omitempty"`
+}
+
+// ControlTunnelCounters holds the data packets and bytes that went through a tunnel, control traffic is not counted
+type ControlTunnelCounters struct {
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+}
+
+// ControlCompression holds the algorithm we compress a tunnel with and the bytes of data packets before and after
+// compression, only packets that went through the compressor are counted
+type ControlCompression struct {
+	Algorithm         string `json:"algorithm"`
+	TxBytes           uint64 `json:"txBytes"`
+	TxCompressedBytes uint64 `json:"txCompressedBytes"`
+	RxBytes           uint64 `json:"rxBytes"`
+	RxCompressedBytes uint64 `json:"rxCompressedBytes"`
+}
+
+// TxRatio is how many times smaller packets we sent got, 0 before any were compressed
+func (c ControlCompression) TxRatio() float64 {
+	if c.TxCompressedBytes == 0 {
+		return 0
+	}
+	return float64(c.TxBytes) / float64(c.TxCompressedBytes)
+}
+
+// RxRatio is how many times smaller packets we received were, 0 before any were compressed
+func (c ControlCompression) RxRatio() float64 {
+	if c.RxCompressedBytes == 0 {
+		return 0
+	}
+	return float64(c.RxBytes) / float64(c.RxCompressedBytes)
+}
+
+// ControlHandshakeInfo describes how far along a pending handshake is
+type ControlHandshakeInfo struct {
+	Attempts          int64     `json:"attempts"`
+	RemainingAttempts int64     `json:"remainingAttempts"`
+	StartTime         time.Time `json:"startTime"`
+	// Remotes and Relays are what the last attempt sent to
+	Remotes []netip.AddrPort `json:"remotes"`
+	Relays  []netip.Addr     `json:"relays"`
+	// LastError is why the last attempt did not get a handshake out, empty if it did
+	LastError string `json:"lastError,omitempty"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -54,6 +148,10 @@ func (c *Control) Start() {
 	// Activate the interface
 	c.f.activate()
 
+	if c.hostDns != nil {
+		c.hostDns.Start()
+	}
+
 	// Call all the delayed funcs that waited patiently for the interface to be created.
 	if c.sshStart != nil {
 		go c.sshStart()
@@ -67,6 +165,42 @@ func (c *Control) Start() {
 	if c.connectionManagerStart != nil {
 		go c.connectionManagerStart(c.ctx)
 	}
+	if c.podNetworkStart != nil {
+		go c.podNetworkStart(c.ctx)
+	}
+	if c.wireguardGatewayStart != nil {
+		go c.wireguardGatewayStart(c.ctx)
+	}
+	if c.networkMonitorStart != nil {
+		go c.networkMonitorStart(c.ctx)
+	}
+	if c.lanDiscoveryStart != nil {
+		go c.lanDiscoveryStart(c.ctx)
+	}
+	if c.healthStart != nil {
+		go c.healthStart(c.ctx)
+	}
+	if c.whoisStart != nil {
+		go c.whoisStart(c.ctx)
+	}
+	if c.groupSets != nil {
+		go c.groupSets.Start(c.ctx)
+	}
+	if c.controlChannelStart != nil {
+		go c.controlChannelStart(c.ctx)
+	}
+	if c.identityProxyStart != nil {
+		c.identityProxyStart(c.ctx)
+	}
+	if c.svid != nil {
+		go c.svid.Start(c.ctx)
+	}
+	if c.warmRestart != nil {
+		go c.warmRestart.Start(c.ctx)
+	}
+	if c.preconnectStart != nil {
+		go c.preconnectStart(c.ctx)
+	}
 	if c.lighthouseStart != nil {
 		c.lighthouseStart()
 	}
@@ -81,14 +215,32 @@ func (c *Control) Context() context.Context {
 
 // Stop signals nebula to shutdown and close all tunnels, returns after the shutdown is complete
 func (c *Control) Stop() {
+	// Remember our tunnels before they are closed
+	if c.warmRestart != nil {
+		c.warmRestart.Stop()
+	}
+
 	// Stop the handshakeManager (and other services), to prevent new tunnels from
 	// being created while we're shutting them all down.
 	c.cancel()
 
-	c.CloseAllTunnels(false)
+	// Peers have to keep their side of the tunnels for us to resume them after the restart
+	if c.warmRestart == nil || c.warmRestart.resumption == nil {
+		c.CloseAllTunnels(false)
+	}
+	if c.hostDns != nil {
+		c.hostDns.Stop()
+	}
+	if c.groupSets != nil {
+		c.groupSets.Stop()
+	}
 	if err := c.f.Close(); err != nil {
 		c.l.WithError(err).Error("Close interface failed")
 	}
+	// Push stats one last time, hosts that come and go would otherwise lose what happened since the last interval
+	if c.statsStop != nil {
+		c.statsStop()
+	}
 	c.l.Info("Goodbye")
 }
 
@@ -105,13 +257,7 @@ func (c *Control) ShutdownBlock(sigChan chan os.Signal) {
 
 // RebindUDPServer asks the UDP listener to rebind it's listener. Mainly used on mobile clients when interfaces change
 func (c *Control) RebindUDPServer() {
-	_ = c.f.outside.Rebind()
-
-	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
-	c.f.lightHouse.SendUpdate()
-
-	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
-	c.f.rebindCount++
+	c.f.rebind()
 }
 
 // ListHostmapHosts returns details about the actual or pending (handshaking) hostmap by vpn ip
@@ -123,6 +269,26 @@ func (c *Control) ListHostmapHosts(pendingMap bool) []ControlHostInfo {
 	}
 }
 
+// ListPendingHandshakes returns the handshakes we started and have not heard back on, oldest first
+func (c *Control) ListPendingHandshakes() []ControlHostInfo {
+	return listPendingHandshakes(c.f.handshakeManager)
+}
+
+func listPendingHandshakes(hm *HandshakeManager) []ControlHostInfo {
+	hosts := listHostMapHosts(hm)
+	// Handshake is nil for a handshake that finished while we were listing
+	start := func(h ControlHostInfo) time.Time {
+		if h.Handshake == nil {
+			return time.Time{}
+		}
+		return h.Handshake.StartTime
+	}
+	slices.SortFunc(hosts, func(a, b ControlHostInfo) int {
+		return start(a).Compare(start(b))
+	})
+	return hosts
+}
+
 // ListHostmapIndexes returns details about the actual or pending (handshaking) hostmap by local index id
 func (c *Control) ListHostmapIndexes(pendingMap bool) []ControlHostInfo {
 	if pendingMap {
@@ -132,6 +298,15 @@ func (c *Control) ListHostmapIndexes(pendingMap bool) []ControlHostInfo {
 	}
 }
 
+// QueryHostmap returns a page of the actual or pending (handshaking) hostmap, in vpn address order, that matches q.
+// Unlike ListHostmapHosts only the hosts in the page are copied, which keeps large hostmaps cheap to walk.
+func (c *Control) QueryHostmap(q HostmapQuery) HostmapPage {
+	if q.Pending {
+		return queryHostmap(c.f.handshakeManager, q, time.Now())
+	}
+	return queryHostmap(c.f.hostMap, q, time.Now())
+}
+
 // GetCertByVpnIp returns the authenticated certificate of the given vpn IP, or nil if not found
 func (c *Control) GetCertByVpnIp(vpnIp netip.Addr) cert.Certificate {
 	if c.f.myVpnAddrsTable.Contains(vpnIp) {
@@ -151,6 +326,20 @@ func (c *Control) CreateTunnel(vpnIp netip.Addr) {
 	c.f.handshakeManager.StartHandshake(vpnIp, nil)
 }
 
+// RehandshakeVpnIp replaces the tunnel to vpnIp with a new handshake, new keys, and the current certificates of both
+// hosts. The old tunnel is closed on both ends once the new one is up. Returns false if there is no tunnel to vpnIp.
+// Caller should take care to Unmap() any 4in6 addresses prior to calling.
+func (c *Control) RehandshakeVpnIp(vpnIp netip.Addr) bool {
+	return c.f.handshakeManager.Rehandshake(vpnIp)
+}
+
+// Connect brings up a tunnel to vpnIp without waiting for traffic to need it. The lighthouses are queried and the
+// handshake starts right away, Connect returns once the tunnel is up, the handshake gives up, or ctx is done.
+// Caller should take care to Unmap() any 4in6 addresses prior to calling.
+func (c *Control) Connect(ctx context.Context, vpnIp netip.Addr) ConnectStatus {
+	return c.f.connect(ctx, vpnIp)
+}
+
 // PrintTunnel creates a new tunnel to the given vpn ip.
 func (c *Control) PrintTunnel(vpnIp netip.Addr) *ControlHostInfo {
 	hi := c.f.hostMap.QueryVpnAddr(vpnIp)
@@ -170,6 +359,11 @@ func (c *Control) QueryLighthouse(vpnIp netip.Addr) *CacheMap {
 	return hi.CopyCache()
 }
 
+// Labels returns the labels from our own config, the ones we send to the lighthouses
+func (c *Control) Labels() map[string]string {
+	return labelsToMap(c.f.lightHouse.GetLabels())
+}
+
 // GetHostInfoByVpnAddr returns a single tunnels hostInfo, or nil if not found
 // Caller should take care to Unmap() any 4in6 addresses prior to calling.
 func (c *Control) GetHostInfoByVpnAddr(vpnAddr netip.Addr, pending bool) *ControlHostInfo {
@@ -185,8 +379,22 @@ func (c *Control) GetHostInfoByVpnAddr(vpnAddr netip.Addr, pending bool) *Contro
 		return nil
 	}
 
-	ch := copyHostInfo(h, c.f.hostMap.GetPreferredRanges())
-	return &ch
+	ch := []ControlHostInfo{copyHostInfo(h, c.f.hostMap.GetPreferredRanges())}
+	if pending {
+		c.f.handshakeManager.handshakeProgress(ch)
+	}
+	return &ch[0]
+}
+
+// GetRemoteHistory returns the underlay addresses recently seen for the tunnel to vpnAddr, most recent first.
+// Returns nil if there is no tunnel.
+func (c *Control) GetRemoteHistory(vpnAddr netip.Addr) []ControlRemoteHistory {
+	h := c.f.hostMap.QueryVpnAddr(vpnAddr)
+	if h == nil {
+		return nil
+	}
+
+	return h.remoteHistory.copy()
 }
 
 // SetRemoteForTunnel forces a tunnel to use a specific remote
@@ -273,6 +481,64 @@ func (c *Control) Device() overlay.Device {
 	return c.f.inside
 }
 
+// VpnSettings returns the routes, DNS servers, and MTU the tun device should have. Apps that hand nebula a tun fd, like
+// an Android VpnService, must apply these themselves since nebula can not. The value marshals to JSON for apps that
+// can not use Go types directly.
+func (c *Control) VpnSettings() overlay.VpnSettings {
+	return c.vpnSettings.get()
+}
+
+// OnVpnSettingsChange registers cb to be called with the new settings when a config reload changes them, so the app
+// can rebuild the device. cb is called from the reload goroutine and should not block.
+func (c *Control) OnVpnSettingsChange(cb func(overlay.VpnSettings)) {
+	c.vpnSettings.onChange(cb)
+}
+
+// OnFlowAccepted registers cb to be called with every new inbound flow the firewall accepts, whether or not
+// firewall.flow_log is enabled, until the returned func is called. cb is called from the flow log goroutine and should
+// not block.
+func (c *Control) OnFlowAccepted(cb func(FlowEvent)) func() {
+	return c.flowLog.subscribe(cb)
+}
+
+// OnInterfaceEvent registers cb to be called with every InterfaceEvent until the returned func is called, so apps
+// embedding nebula can react to it starting, stopping, rebinding, or picking up a new certificate. cb is called from
+// whichever goroutine caused the event and should not block.
+func (c *Control) OnInterfaceEvent(cb func(InterfaceEvent)) func() {
+	return c.f.events.subscribe(cb)
+}
+
+// LearnFirewallRules records the inbound flows the firewall accepts for d, forgetting anything learned before. Use
+// SuggestFirewallRules to see the rules that would allow what was seen.
+func (c *Control) LearnFirewallRules(d time.Duration) error {
+	return c.ruleLearner.start(d)
+}
+
+// StopLearningFirewallRules stops learning before the duration given to LearnFirewallRules is up
+func (c *Control) StopLearningFirewallRules() {
+	c.ruleLearner.stop()
+}
+
+// SuggestFirewallRules returns the fewest inbound rules that allow every flow seen since LearnFirewallRules was called
+func (c *Control) SuggestFirewallRules() RuleSuggestion {
+	return c.ruleLearner.suggest()
+}
+
+// SVID returns the X.509 SVID for our nebula identity, or nil if svid is not enabled. A new SVID is issued before the
+// old one expires so call this again for every new tls connection, or use the files in svid.dir.
+func (c *Control) SVID() *SVID {
+	if c.svid == nil {
+		return nil
+	}
+	return c.svid.current.Load()
+}
+
+// Doctor checks our certificate, networks, mtu, lighthouse reachability, and clock and reports what needs fixing. It
+// waits up to wait for lighthouses we do not have a tunnel to yet, Start must have been called.
+func (c *Control) Doctor(wait time.Duration) DoctorReport {
+	return c.doctor.run(c.ctx, wait)
+}
+
 func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 	chi := ControlHostInfo{
 		VpnAddrs:               make([]netip.Addr, len(h.vpnAddrs)),
@@ -282,14 +548,55 @@ func copyHostInfo(h *HostInfo, preferredRanges []netip.Prefix) ControlHostInfo {
 		CurrentRelaysToMe:      h.relayState.CopyRelayIps(),
 		CurrentRelaysThroughMe: h.relayState.CopyRelayForIps(),
 		CurrentRemote:          h.remote,
+		LastRoam:               h.lastRoam,
+		LastRoamRemote:         h.lastRoamRemote,
+		LastRebind:             h.lastRebind,
+		CertInGrace:            h.certInGrace.Load(),
+		Labels:                 h.remotes.Labels(),
+		Counters: ControlTunnelCounters{
+			TxPackets: h.counters.txPackets.Load(),
+			TxBytes:   h.counters.txBytes.Load(),
+			RxPackets: h.counters.rxPackets.Load(),
+			RxBytes:   h.counters.rxBytes.Load(),
+		},
+		Compression: ControlCompression{
+			Algorithm:         compressionNone.String(),
+			TxBytes:           h.counters.txCompressIn.Load(),
+			TxCompressedBytes: h.counters.txCompressOut.Load(),
+			RxBytes:           h.counters.rxDecompressOut.Load(),
+			RxCompressedBytes: h.counters.rxDecompressIn.Load(),
+		},
 	}
 
 	for i, a := range h.vpnAddrs {
 		chi.VpnAddrs[i] = a
 	}
 
+	if lastUsed := h.lastUsedNano.Load(); lastUsed != 0 {
+		chi.LastUsed = time.Unix(0, lastUsed)
+	}
+
+	if skew := h.clockSkew.Load(); skew != nil {
+		s := *skew
+		chi.ClockSkew = &s
+	}
+
+	if h.remote.IsValid() {
+		chi.Path = "direct"
+	} else if len(chi.CurrentRelaysToMe) > 0 {
+		// Relays are tried in order when sending, the first is normally the one in use
+		chi.Path = "relay"
+		chi.CurrentRelay = chi.CurrentRelaysToMe[0]
+	}
+
 	if h.ConnectionState != nil {
 		chi.MessageCounter = h.ConnectionState.messageCounter.Load()
+		chi.Cipher = h.ConnectionState.cipher
+		chi.NullCipher = h.ConnectionState.nullCipher
+		chi.Compression.Algorithm = h.ConnectionState.compression.String()
+		if h.ConnectionState.myCert != nil {
+			chi.Curve = h.ConnectionState.Curve().String()
+		}
 	}
 
 	if c := h.GetCert(); c != nil {
@@ -305,6 +612,10 @@ func listHostMapHosts(hl controlHostLister) []ControlHostInfo {
 	hl.ForEachVpnAddr(func(hostinfo *HostInfo) {
 		hosts = append(hosts, copyHostInfo(hostinfo, pr))
 	})
+
+	if hm, ok := hl.(*HandshakeManager); ok {
+		hm.handshakeProgress(hosts)
+	}
 	return hosts
 }
 
@@ -314,5 +625,9 @@ func listHostMapIndexes(hl controlHostLister) []ControlHostInfo {
 	hl.ForEachIndex(func(hostinfo *HostInfo) {
 		hosts = append(hosts, copyHostInfo(hostinfo, pr))
 	})
+
+	if hm, ok := hl.(*HandshakeManager); ok {
+		hm.handshakeProgress(hosts)
+	}
 	return hosts
 }
@@ -0,0 +1,248 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// The control channel is a small, versioned local api for GUI frontends like tray applications. It is http with json
+// bodies, served over a named pipe on Windows and a unix socket everywhere else, so access is controlled by the
+// operating system instead of credentials.
+//
+//	GET  /v1/status                   nebula and certificate state, tunnel and lighthouse counts
+//	GET  /v1/peers                    every established tunnel
+//	POST /v1/tunnels/start?addr=...   start a handshake with a vpn address
+//	POST /v1/tunnels/stop?addr=...    close the tunnel to a vpn address
+//	POST /v1/stop                     shut nebula down, same as ssh stop
+//
+// The channel lives inside the nebula process, starting nebula is left to the service manager. Fields are only ever
+// added to the v1 responses, anything incompatible gets a new version prefix.
+
+// ControlChannelStatus is the response to GET /v1/status
+type ControlChannelStatus struct {
+	Version string `json:"version"`
+	// State is starting, running, or stopping
+	State          string         `json:"state"`
+	Name           string         `json:"name"`
+	VpnAddrs       []netip.Addr   `json:"vpnAddrs"`
+	Networks       []netip.Prefix `json:"networks"`
+	CertNotAfter   time.Time      `json:"certNotAfter"`
+	Tunnels        int            `json:"tunnels"`
+	PendingTunnels int            `json:"pendingTunnels"`
+	// Lighthouses is how many lighthouses are configured, LighthousesConnected how many of them we have a tunnel to
+	Lighthouses          int `json:"lighthouses"`
+	LighthousesConnected int `json:"lighthousesConnected"`
+}
+
+// ControlChannelPeer is a single tunnel in the response to GET /v1/peers
+type ControlChannelPeer struct {
+	VpnAddrs      []netip.Addr   `json:"vpnAddrs"`
+	Name          string         `json:"name"`
+	Groups        []string       `json:"groups"`
+	Lighthouse    bool           `json:"lighthouse"`
+	CurrentRemote netip.AddrPort `json:"currentRemote"`
+	// Path is direct or relay, see ControlHostInfo
+	Path     string                `json:"path"`
+	LastUsed time.Time             `json:"lastUsed"`
+	Counters ControlTunnelCounters `json:"counters"`
+}
+
+type controlChannel struct {
+	l       *logrus.Logger
+	f       *Interface
+	sigChan chan os.Signal
+}
+
+func newControlChannelFromConfig(l *logrus.Logger, c *config.C, f *Interface, sigChan chan os.Signal) (func(context.Context), error) {
+	if !c.GetBool("control_channel.enabled", false) {
+		return nil, nil
+	}
+
+	listen := c.GetString("control_channel.listen", defaultControlChannelListen)
+	if listen == "" {
+		return nil, errors.New("control_channel.listen must not be empty")
+	}
+
+	listenFn, err := controlChannelListener(c, listen)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &controlChannel{l: l, f: f, sigChan: sigChan}
+	return func(ctx context.Context) {
+		cc.serve(ctx, listen, listenFn)
+	}, nil
+}
+
+func (cc *controlChannel) serve(ctx context.Context, listen string, listenFn func() (net.Listener, error)) {
+	ln, err := listenFn()
+	if err != nil {
+		cc.l.WithError(err).WithField("listen", listen).Error("Failed to start the control channel listener")
+		return
+	}
+
+	srv := &http.Server{Handler: cc.mux(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	cc.l.WithField("listen", listen).Info("Control channel listening")
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		cc.l.WithError(err).Error("Control channel listener stopped")
+	}
+}
+
+func (cc *controlChannel) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", cc.handleStatus)
+	mux.HandleFunc("GET /v1/peers", cc.handlePeers)
+	mux.HandleFunc("POST /v1/tunnels/start", cc.handleTunnelStart)
+	mux.HandleFunc("POST /v1/tunnels/stop", cc.handleTunnelStop)
+	mux.HandleFunc("POST /v1/stop", cc.handleStop)
+	return mux
+}
+
+func (cc *controlChannel) handleStatus(rw http.ResponseWriter, _ *http.Request) {
+	cs := cc.f.pki.getCertState()
+	crt := cs.GetDefaultCertificate()
+
+	res := ControlChannelStatus{
+		Version:      cc.f.version,
+		State:        "running",
+		Name:         crt.Name(),
+		VpnAddrs:     cs.myVpnAddrs,
+		Networks:     crt.Networks(),
+		CertNotAfter: crt.NotAfter(),
+	}
+
+	switch {
+	case cc.f.closed.Load():
+		res.State = "stopping"
+	case !cc.f.activated.Load():
+		res.State = "starting"
+	}
+
+	cc.f.hostMap.ForEachIndex(func(*HostInfo) {
+		res.Tunnels++
+	})
+	cc.f.handshakeManager.ForEachIndex(func(*HostInfo) {
+		res.PendingTunnels++
+	})
+
+	for _, addr := range cc.f.lightHouse.GetLighthouses() {
+		res.Lighthouses++
+		if cc.f.hostMap.QueryVpnAddr(addr) != nil {
+			res.LighthousesConnected++
+		}
+	}
+
+	writeControlChannelJSON(rw, res)
+}
+
+func (cc *controlChannel) handlePeers(rw http.ResponseWriter, _ *http.Request) {
+	peers := make([]ControlChannelPeer, 0)
+	pr := cc.f.hostMap.GetPreferredRanges()
+	cc.f.hostMap.ForEachIndex(func(h *HostInfo) {
+		chi := copyHostInfo(h, pr)
+		p := ControlChannelPeer{
+			VpnAddrs:      chi.VpnAddrs,
+			Lighthouse:    cc.f.lightHouse.IsAnyLighthouseAddr(h.vpnAddrs),
+			CurrentRemote: chi.CurrentRemote,
+			Path:          chi.Path,
+			LastUsed:      chi.LastUsed,
+			Counters:      chi.Counters,
+		}
+
+		if chi.Cert != nil {
+			p.Name = chi.Cert.Name()
+			p.Groups = chi.Cert.Groups()
+		}
+
+		peers = append(peers, p)
+	})
+
+	writeControlChannelJSON(rw, peers)
+}
+
+func (cc *controlChannel) handleTunnelStart(rw http.ResponseWriter, r *http.Request) {
+	addr, ok := controlChannelAddr(rw, r)
+	if !ok {
+		return
+	}
+
+	if cc.f.myVpnAddrsTable.Contains(addr) {
+		http.Error(rw, fmt.Sprintf("%s is one of our addresses", addr), http.StatusBadRequest)
+		return
+	}
+
+	if !cc.f.peerFilter.Load().allowsAddr(addr) {
+		http.Error(rw, fmt.Sprintf("peer_filter does not allow %s", addr), http.StatusForbidden)
+		return
+	}
+
+	if cc.f.hostMap.QueryVpnAddr(addr) == nil {
+		cc.f.handshakeManager.StartHandshake(addr, nil)
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func (cc *controlChannel) handleTunnelStop(rw http.ResponseWriter, r *http.Request) {
+	addr, ok := controlChannelAddr(rw, r)
+	if !ok {
+		return
+	}
+
+	h := cc.f.hostMap.QueryVpnAddr(addr)
+	if h == nil {
+		http.Error(rw, fmt.Sprintf("no tunnel to %s", addr), http.StatusNotFound)
+		return
+	}
+
+	h.logger(cc.l).Info("Control channel closed the tunnel")
+	cc.f.sendCloseTunnel(h)
+	cc.f.closeTunnel(h)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (cc *controlChannel) handleStop(rw http.ResponseWriter, _ *http.Request) {
+	if cc.sigChan == nil {
+		http.Error(rw, "stop is not supported by this nebula, use the service manager", http.StatusNotImplemented)
+		return
+	}
+
+	cc.l.Info("Control channel requested a shutdown")
+	select {
+	case cc.sigChan <- syscall.SIGTERM:
+	default:
+		// A shutdown is already pending
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func controlChannelAddr(rw http.ResponseWriter, r *http.Request) (netip.Addr, bool) {
+	raw := r.URL.Query().Get("addr")
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("addr must be an ip address, got %q", raw), http.StatusBadRequest)
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func writeControlChannelJSON(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+
+package nebula
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/slackhq/nebula/config"
+)
+
+const defaultControlChannelListen = "/var/run/nebula/control.sock"
+
+// controlChannelListener listens on the unix socket at listen, access is controlled with control_channel.mode
+func controlChannelListener(c *config.C, listen string) (func() (net.Listener, error), error) {
+	mode, err := strconv.ParseUint(c.GetString("control_channel.mode", "0660"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("control_channel.mode must be octal file permissions: %w", err)
+	}
+
+	return func() (net.Listener, error) {
+		// A socket left behind by a nebula that did not shut down cleanly would stop us from listening
+		if fi, err := os.Lstat(listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(listen)
+		}
+
+		ln, err := net.Listen("unix", listen)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := os.Chmod(listen, os.FileMode(mode)); err != nil {
+			_ = ln.Close()
+			return nil, fmt.Errorf("failed to set the socket permissions: %w", err)
+		}
+
+		return ln, nil
+	}, nil
+}
@@ -0,0 +1,104 @@
+package nebula
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlChannel(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+	myAddr := netip.MustParseAddr("10.42.0.1")
+	myAddrs := new(bart.Lite)
+	myAddrs.Insert(netip.PrefixFrom(myAddr, myAddr.BitLen()))
+
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(t.Context(), l, c, &CertState{myVpnNetworksTable: new(bart.Lite)}, nil, nil)
+	require.NoError(t, err)
+
+	ifce := &Interface{
+		hostMap:         hostMap,
+		pki:             &PKI{},
+		l:               l,
+		version:         "1.2.3",
+		lightHouse:      lh,
+		myVpnAddrsTable: myAddrs,
+	}
+	ifce.handshakeManager = NewHandshakeManager(l, hostMap, lh, nil, defaultHandshakeConfig)
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            &dummyCert{name: "me"},
+		myVpnAddrs:        []netip.Addr{myAddr},
+		myVpnAddrsTable:   myAddrs,
+	})
+	ifce.activated.Store(true)
+
+	peerAddr := netip.MustParseAddr("10.42.0.9")
+	hostMap.unlockedAddHostInfo(&HostInfo{
+		vpnAddrs:     []netip.Addr{peerAddr},
+		localIndexId: 1,
+		remote:       netip.MustParseAddrPort("1.2.3.4:4242"),
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{
+				Certificate: &dummyCert{name: "laptop", groups: []string{"eng"}},
+			},
+		},
+	}, ifce)
+
+	sigChan := make(chan os.Signal, 1)
+	mux := (&controlChannel{l: l, f: ifce, sigChan: sigChan}).mux()
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/v1/status")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status ControlChannelStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, "1.2.3", status.Version)
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, "me", status.Name)
+	assert.Equal(t, []netip.Addr{myAddr}, status.VpnAddrs)
+	assert.Equal(t, 1, status.Tunnels)
+
+	rec = do(http.MethodGet, "/v1/peers")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var peers []ControlChannelPeer
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &peers))
+	require.Len(t, peers, 1)
+	assert.Equal(t, "laptop", peers[0].Name)
+	assert.Equal(t, []string{"eng"}, peers[0].Groups)
+	assert.Equal(t, []netip.Addr{peerAddr}, peers[0].VpnAddrs)
+	assert.Equal(t, netip.MustParseAddrPort("1.2.3.4:4242"), peers[0].CurrentRemote)
+	assert.Equal(t, "direct", peers[0].Path)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "/v1/status").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/v1/tunnels/start?addr=laptop").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/v1/tunnels/start?addr=10.42.0.1").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/v1/tunnels/stop?addr=10.42.0.10").Code)
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/v1/tunnels/start?addr=10.42.0.10").Code)
+	assert.NotNil(t, ifce.handshakeManager.QueryVpnAddr(netip.MustParseAddr("10.42.0.10")))
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/v1/stop").Code)
+	assert.Equal(t, syscall.SIGTERM, <-sigChan)
+
+	// Without a signal channel there is nothing to stop
+	mux = (&controlChannel{l: l, f: ifce}).mux()
+	assert.Equal(t, http.StatusNotImplemented, do(http.MethodPost, "/v1/stop").Code)
+}
@@ -0,0 +1,29 @@
+package nebula
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/slackhq/nebula/config"
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/ipc/namedpipe"
+)
+
+const defaultControlChannelListen = `\\.\pipe\nebula\control`
+
+// defaultControlChannelSDDL gives SYSTEM and Administrators full access, nobody else can open the pipe
+const defaultControlChannelSDDL = "O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+// controlChannelListener listens on the named pipe at listen, access is controlled with the DACL in
+// control_channel.security_descriptor
+func controlChannelListener(c *config.C, listen string) (func() (net.Listener, error), error) {
+	sddl := c.GetString("control_channel.security_descriptor", defaultControlChannelSDDL)
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return nil, fmt.Errorf("control_channel.security_descriptor is not a valid SDDL string: %w", err)
+	}
+
+	return func() (net.Listener, error) {
+		return (&namedpipe.ListenConfig{SecurityDescriptor: sd}).Listen(listen)
+	}, nil
+}
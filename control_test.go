@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
@@ -42,22 +43,31 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 	vpnIp, ok := netip.AddrFromSlice(ipNet.IP)
 	assert.True(t, ok)
 
-	crt := &dummyCert{}
-	hm.unlockedAddHostInfo(&HostInfo{
+	crt := &dummyCert{curve: cert.Curve_P256}
+	lastRoam := time.Now()
+	hostinfo := &HostInfo{
 		remote:  remote1,
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
 			peerCert: &cert.CachedCertificate{Certificate: crt},
+			myCert:   crt,
+			cipher:   "aes",
 		},
-		remoteIndexId: 200,
-		localIndexId:  201,
-		vpnAddrs:      []netip.Addr{vpnIp},
+		remoteIndexId:  200,
+		localIndexId:   201,
+		vpnAddrs:       []netip.Addr{vpnIp},
+		lastRoam:       lastRoam,
+		lastRoamRemote: remote2,
 		relayState: RelayState{
 			relays:         nil,
 			relayForByAddr: map[netip.Addr]*Relay{},
 			relayForByIdx:  map[uint32]*Relay{},
 		},
-	}, &Interface{})
+	}
+	hostinfo.counters.tx(100)
+	hostinfo.counters.rx(50)
+	hostinfo.counters.rx(60)
+	hm.unlockedAddHostInfo(hostinfo, &Interface{})
 
 	vpnIp2, ok := netip.AddrFromSlice(ipNet2.IP)
 	assert.True(t, ok)
@@ -97,10 +107,17 @@ func TestControl_GetHostInfoByVpnIp(t *testing.T) {
 		CurrentRemote:          remote1,
 		CurrentRelaysToMe:      []netip.Addr{},
 		CurrentRelaysThroughMe: []netip.Addr{},
+		Cipher:                 "aes",
+		Curve:                  "P256",
+		Path:                   "direct",
+		LastRoam:               lastRoam,
+		LastRoamRemote:         remote2,
+		Counters:               ControlTunnelCounters{TxPackets: 1, TxBytes: 100, RxPackets: 2, RxBytes: 110},
+		Compression:            ControlCompression{Algorithm: "none"},
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnAddrs", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe"}, thi)
+	assertFields(t, []string{"VpnAddrs", "LocalIndex", "RemoteIndex", "RemoteAddrs", "Cert", "MessageCounter", "CurrentRemote", "CurrentRelaysToMe", "CurrentRelaysThroughMe", "Cipher", "Curve", "NullCipher", "Path", "CurrentRelay", "LastRoam", "LastRoamRemote", "LastRebind", "LastUsed", "CertInGrace", "ClockSkew", "Labels", "Counters", "Compression", "Handshake"}, thi)
 	assert.Equal(t, &expectedInfo, thi)
 	test.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
@@ -87,6 +87,11 @@ func (c *Control) GetUDPTxChan() <-chan *udp.Packet {
 	return c.f.outside.(*udp.TesterConn).TxPackets
 }
 
+// ImpairUDP degrades packets this control sends to toAddr, an invalid toAddr applies to every destination
+func (c *Control) ImpairUDP(toAddr netip.AddrPort, i udp.Impairment) {
+	c.f.outside.(*udp.TesterConn).Impair(toAddr, i)
+}
+
 func (c *Control) GetTunTxChan() <-chan []byte {
 	return c.f.inside.(*overlay.TestTun).TxPackets
 }
@@ -152,6 +157,11 @@ func (c *Control) InjectTunUDPPacket(toAddr netip.Addr, toPort uint16, fromAddr
 	c.f.inside.(*overlay.TestTun).Send(buffer.Bytes())
 }
 
+// InjectTunPacket puts a raw ip packet on the tun interface
+func (c *Control) InjectTunPacket(b []byte) {
+	c.f.inside.(*overlay.TestTun).Send(b)
+}
+
 func (c *Control) GetVpnAddrs() []netip.Addr {
 	return c.f.myVpnAddrs
 }
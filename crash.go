@@ -0,0 +1,173 @@
+package nebula
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	// crashMaxHosts limits how many tunnels are listed in a crash report
+	crashMaxHosts = 1000
+	// crashMaxStacks limits the size of the goroutine dump in a crash report
+	crashMaxStacks = 64 << 20
+)
+
+type crashConfig struct {
+	// dir is where crash reports are written, empty if they are disabled
+	dir string
+	// configHash identifies the running config without including any of it in the report
+	configHash string
+}
+
+func (f *Interface) reloadCrash(c *config.C) {
+	cc := &crashConfig{configHash: c.Hash()}
+	if c.GetBool("crash.enabled", true) {
+		cc.dir = c.GetString("crash.dir", os.TempDir())
+	}
+
+	old := f.crash.Swap(cc)
+	if old != nil && old.dir != cc.dir {
+		f.l.WithField("dir", cc.dir).Info("crash.dir changed")
+	}
+}
+
+// recoverPanic is deferred by the packet routines. A panic writes a crash report before it is raised again, so nebula
+// still exits the way it always has.
+func (f *Interface) recoverPanic(routine string, i int) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	cc := f.crash.Load()
+	if cc != nil && cc.dir != "" {
+		path, err := f.writeCrashReport(cc, fmt.Sprintf("%s %d", routine, i), r, stack)
+		if err != nil {
+			f.l.WithError(err).WithField("dir", cc.dir).Error("Failed to write a crash report")
+		} else {
+			f.l.WithField("routine", routine).WithField("crashReport", path).Error("Packet routine panicked, wrote a crash report")
+		}
+	}
+
+	panic(r)
+}
+
+func (f *Interface) writeCrashReport(cc *crashConfig, routine string, r any, stack []byte) (string, error) {
+	now := time.Now()
+	path := filepath.Join(cc.dir, fmt.Sprintf("nebula-crash-%s-%d.txt", now.UTC().Format("20060102T150405Z"), os.Getpid()))
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	f.crashReport(fd, cc, now, routine, r, stack)
+	return path, fd.Sync()
+}
+
+// crashReport writes a snapshot of our state. Certificates, keys, the config itself, and the underlay addresses of our
+// peers are left out so the report can be shared. Locks are only tried, the panic may have happened while holding one.
+func (f *Interface) crashReport(w io.Writer, cc *crashConfig, now time.Time, routine string, r any, stack []byte) {
+	fmt.Fprintln(w, "nebula crash report")
+	fmt.Fprintf(w, "time: %s\n", now.UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(w, "version: %s\n", f.version)
+	fmt.Fprintf(w, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(w, "uptime: %s\n", now.Sub(f.createTime).Round(time.Second))
+	fmt.Fprintf(w, "config sha256: %s\n", cc.configHash)
+	fmt.Fprintf(w, "routine: %s\n", routine)
+	fmt.Fprintf(w, "panic: %v\n", r)
+
+	fmt.Fprintln(w, "\n== hostmap ==")
+	f.crashHostMap(w)
+
+	fmt.Fprintln(w, "\n== pending handshakes ==")
+	f.crashPendingHandshakes(w, now)
+
+	fmt.Fprintln(w, "\n== panicking routine ==")
+	_, _ = w.Write(stack)
+
+	fmt.Fprintln(w, "\n== all goroutines ==")
+	_, _ = w.Write(allStacks())
+}
+
+func (f *Interface) crashHostMap(w io.Writer) {
+	hm := f.hostMap
+	if hm == nil {
+		return
+	}
+
+	if !hm.TryRLock() {
+		fmt.Fprintln(w, "hostmap is locked, skipped")
+		return
+	}
+	defer hm.RUnlock()
+
+	fmt.Fprintf(w, "hosts: %d, indexes: %d, remote indexes: %d, relays: %d\n",
+		len(hm.Hosts), len(hm.Indexes), len(hm.RemoteIndexes), len(hm.Relays))
+
+	n := 0
+	for _, h := range hm.Indexes {
+		if n == crashMaxHosts {
+			fmt.Fprintf(w, "... %d more\n", len(hm.Indexes)-n)
+			break
+		}
+		n++
+
+		path := "direct"
+		if !h.remote.IsValid() {
+			path = "relay"
+		}
+		fmt.Fprintf(w, "%v localIndex=%d remoteIndex=%d path=%s\n", h.vpnAddrs, h.localIndexId, h.remoteIndexId, path)
+	}
+}
+
+func (f *Interface) crashPendingHandshakes(w io.Writer, now time.Time) {
+	hm := f.handshakeManager
+	if hm == nil {
+		return
+	}
+
+	if !hm.TryRLock() {
+		fmt.Fprintln(w, "pending hostmap is locked, skipped")
+		return
+	}
+	defer hm.RUnlock()
+
+	fmt.Fprintf(w, "pending: %d\n", len(hm.vpnIps))
+	n := 0
+	for _, hh := range hm.vpnIps {
+		if n == crashMaxHosts {
+			fmt.Fprintf(w, "... %d more\n", len(hm.vpnIps)-n)
+			break
+		}
+		n++
+
+		if !hh.TryLock() {
+			fmt.Fprintf(w, "%v localIndex=%d locked\n", hh.hostinfo.vpnAddrs, hh.hostinfo.localIndexId)
+			continue
+		}
+		fmt.Fprintf(w, "%v localIndex=%d attempts=%d age=%s ready=%v\n", hh.hostinfo.vpnAddrs, hh.hostinfo.localIndexId,
+			hh.counter, now.Sub(hh.startTime).Round(time.Millisecond), hh.ready)
+		hh.Unlock()
+	}
+}
+
+// allStacks returns the stacks of every goroutine, growing the buffer until they fit
+func allStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= crashMaxStacks {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
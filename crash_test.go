@@ -0,0 +1,84 @@
+package nebula
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterface_recoverPanic(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	lh := newTestLighthouse()
+	ifce := &Interface{
+		hostMap:          hostMap,
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		lightHouse:       lh,
+		version:          "1.2.3",
+		l:                l,
+	}
+
+	remote := netip.MustParseAddrPort("203.0.113.7:4242")
+	hostMap.unlockedAddHostInfo(&HostInfo{
+		vpnAddrs:        []netip.Addr{netip.MustParseAddr("172.1.1.2")},
+		localIndexId:    10,
+		remoteIndexId:   20,
+		remote:          remote,
+		ConnectionState: &ConnectionState{},
+	}, ifce)
+	ifce.handshakeManager.StartHandshake(netip.MustParseAddr("172.1.1.3"), nil)
+
+	dir := t.TempDir()
+	c := config.NewC(l)
+	c.Settings["crash"] = map[string]any{"dir": dir}
+	c.Settings["pki"] = map[string]any{"key": "very secret"}
+	ifce.reloadCrash(c)
+
+	// The panic is raised again once the report is written
+	assert.PanicsWithValue(t, "boom", func() {
+		defer ifce.recoverPanic("listenOut", 3)
+		panic("boom")
+	})
+
+	files, err := filepath.Glob(filepath.Join(dir, "nebula-crash-*.txt"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	b, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	report := string(b)
+
+	assert.Contains(t, report, "version: 1.2.3")
+	assert.Contains(t, report, "routine: listenOut 3")
+	assert.Contains(t, report, "panic: boom")
+	assert.Contains(t, report, "config sha256: "+c.Hash())
+	assert.Contains(t, report, "hosts: 1, indexes: 1, remote indexes: 1, relays: 0")
+	assert.Contains(t, report, "[172.1.1.2] localIndex=10 remoteIndex=20 path=direct")
+	assert.Contains(t, report, "pending: 1")
+	assert.Contains(t, report, "[172.1.1.3] localIndex=")
+	assert.Contains(t, report, "== all goroutines ==")
+	assert.Contains(t, report, "TestInterface_recoverPanic")
+
+	// Nothing that could identify the peer or leak secrets
+	assert.NotContains(t, report, remote.Addr().String())
+	assert.NotContains(t, report, "very secret")
+
+	// Disabled reports still panic, but leave nothing behind
+	c.Settings["crash"] = map[string]any{"enabled": false, "dir": dir}
+	ifce.reloadCrash(c)
+	assert.Panics(t, func() {
+		defer ifce.recoverPanic("listenIn", 0)
+		panic("boom")
+	})
+
+	files, err = filepath.Glob(filepath.Join(dir, "nebula-crash-*.txt"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
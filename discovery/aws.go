@@ -0,0 +1,326 @@
+package discovery
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	awsEC2APIVersion       = "2016-11-15"
+	awsDefaultIMDSEndpoint = "http://169.254.169.254"
+)
+
+// awsProvider discovers hosts by listing EC2 instances with the DescribeInstances api
+type awsProvider struct {
+	region         string
+	endpoint       string
+	imdsEndpoint   string
+	vpnAddrTag     string
+	filters        url.Values
+	port           uint16
+	includePrivate bool
+	client         *http.Client
+
+	credsLock sync.Mutex
+	creds     awsCredentials
+}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func newAWSProvider(o options) (*awsProvider, error) {
+	if err := o.Require("region"); err != nil {
+		return nil, err
+	}
+
+	port, err := o.Port("port", DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &awsProvider{
+		region:         o.String("region", ""),
+		imdsEndpoint:   strings.TrimSuffix(o.String("metadata_endpoint", awsDefaultIMDSEndpoint), "/"),
+		vpnAddrTag:     o.String("vpn_addr_tag", "nebula-vpn-addrs"),
+		filters:        url.Values{},
+		port:           port,
+		includePrivate: o.String("include_private", "false") == "true",
+		client:         &http.Client{},
+	}
+	p.endpoint = strings.TrimSuffix(o.String("endpoint", fmt.Sprintf("https://ec2.%s.amazonaws.com", p.region)), "/")
+
+	// Only consider running instances unless the user has decided otherwise
+	filters := map[string][]string{"instance-state-name": {"running"}}
+	filters["tag-key"] = []string{p.vpnAddrTag}
+	if rf, ok := o["filters"]; ok {
+		fm, ok := rf.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("filters has invalid type: %T", rf)
+		}
+
+		for k, v := range fm {
+			switch vv := v.(type) {
+			case []any:
+				filters[k] = nil
+				for _, sv := range vv {
+					filters[k] = append(filters[k], fmt.Sprintf("%v", sv))
+				}
+			default:
+				filters[k] = []string{fmt.Sprintf("%v", vv)}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(filters))
+	for k := range filters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		prefix := "Filter." + strconv.Itoa(i+1)
+		p.filters.Set(prefix+".Name", name)
+		for j, v := range filters[name] {
+			p.filters.Set(prefix+".Value."+strconv.Itoa(j+1), v)
+		}
+	}
+
+	if ak := os.Getenv("AWS_ACCESS_KEY_ID"); ak != "" {
+		p.creds = awsCredentials{
+			AccessKeyId:     ak,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+
+	return p, nil
+}
+
+func (p *awsProvider) Name() string {
+	return "aws:" + p.region
+}
+
+type ec2DescribeInstancesResponse struct {
+	NextToken    string `xml:"nextToken"`
+	Reservations []struct {
+		Instances []struct {
+			InstanceId       string `xml:"instanceId"`
+			IpAddress        string `xml:"ipAddress"`
+			PrivateIpAddress string `xml:"privateIpAddress"`
+			Ipv6Address      string `xml:"ipv6Address"`
+			Tags             []struct {
+				Key   string `xml:"key"`
+				Value string `xml:"value"`
+			} `xml:"tagSet>item"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+}
+
+func (p *awsProvider) Discover(ctx context.Context) (Hosts, error) {
+	hosts := Hosts{}
+	nextToken := ""
+
+	for {
+		q := url.Values{}
+		for k, v := range p.filters {
+			q[k] = v
+		}
+		q.Set("Action", "DescribeInstances")
+		q.Set("Version", awsEC2APIVersion)
+		if nextToken != "" {
+			q.Set("NextToken", nextToken)
+		}
+
+		var res ec2DescribeInstancesResponse
+		if err := p.do(ctx, q, &res); err != nil {
+			return nil, err
+		}
+
+		for _, r := range res.Reservations {
+			for _, i := range r.Instances {
+				var vpnAddrs string
+				for _, t := range i.Tags {
+					if t.Key == p.vpnAddrTag {
+						vpnAddrs = t.Value
+						break
+					}
+				}
+
+				ips := []string{i.IpAddress, i.Ipv6Address}
+				if p.includePrivate {
+					ips = append(ips, i.PrivateIpAddress)
+				}
+
+				if err := hosts.addHost(vpnAddrs, ips, p.port); err != nil {
+					return nil, fmt.Errorf("instance %s: %w", i.InstanceId, err)
+				}
+			}
+		}
+
+		if res.NextToken == "" {
+			return hosts, nil
+		}
+		nextToken = res.NextToken
+	}
+}
+
+func (p *awsProvider) do(ctx context.Context, q url.Values, out any) error {
+	creds, err := p.credentials(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	// SigV4 requires spaces to be encoded as %20, not +
+	query := strings.ReplaceAll(q.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint+"/?"+query, nil)
+	if err != nil {
+		return err
+	}
+
+	signAWSRequest(req, query, creds, p.region, "ec2", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+// credentials returns static credentials from the environment if they were provided, otherwise the instance role
+// credentials are fetched from the instance metadata service and cached until shortly before they expire
+func (p *awsProvider) credentials(ctx context.Context) (awsCredentials, error) {
+	p.credsLock.Lock()
+	defer p.credsLock.Unlock()
+
+	if p.creds.AccessKeyId != "" && (p.creds.Expiration.IsZero() || time.Until(p.creds.Expiration) > 5*time.Minute) {
+		return p.creds, nil
+	}
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, p.imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+
+	token, err := p.imdsGet(tokenReq)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	roleReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.imdsEndpoint+"/latest/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	roleReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	role, err := p.imdsGet(roleReq)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	roleName := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	if roleName == "" {
+		return awsCredentials{}, fmt.Errorf("no instance role is attached")
+	}
+
+	credsReq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.imdsEndpoint+"/latest/meta-data/iam/security-credentials/"+roleName, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	credsReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	b, err := p.imdsGet(credsReq)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	var creds awsCredentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return awsCredentials{}, err
+	}
+
+	p.creds = creds
+	return creds, nil
+}
+
+func (p *awsProvider) imdsGet(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// signAWSRequest adds an AWS signature version 4 Authorization header to a bodyless request
+func signAWSRequest(req *http.Request, canonicalQuery string, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	signedHeaders := "host;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\nx-amz-date:" + amzDate + "\n"
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + creds.Token + "\n"
+	}
+
+	emptyHash := sha256.Sum256(nil)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		"/",
+		canonicalQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(emptyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyId+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
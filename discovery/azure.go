@@ -0,0 +1,239 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	azureDefaultIMDSEndpoint = "http://169.254.169.254"
+	azureComputeAPIVersion   = "2023-09-01"
+	azureNetworkAPIVersion   = "2018-10-01"
+)
+
+// azureProvider discovers hosts by listing the instances of a virtual machine scale set
+type azureProvider struct {
+	subscription   string
+	resourceGroup  string
+	scaleSet       string
+	endpoint       string
+	imdsEndpoint   string
+	vpnAddrTag     string
+	port           uint16
+	includePrivate bool
+	client         *http.Client
+
+	tokenLock   sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newAzureProvider(o options) (*azureProvider, error) {
+	if err := o.Require("subscription", "resource_group", "scale_set"); err != nil {
+		return nil, err
+	}
+
+	port, err := o.Port("port", DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &azureProvider{
+		subscription:   o.String("subscription", ""),
+		resourceGroup:  o.String("resource_group", ""),
+		scaleSet:       o.String("scale_set", ""),
+		endpoint:       strings.TrimSuffix(o.String("endpoint", "https://management.azure.com"), "/"),
+		imdsEndpoint:   strings.TrimSuffix(o.String("metadata_endpoint", azureDefaultIMDSEndpoint), "/"),
+		vpnAddrTag:     o.String("vpn_addr_tag", "nebula-vpn-addrs"),
+		port:           port,
+		includePrivate: o.String("include_private", "false") == "true",
+		client:         &http.Client{},
+	}, nil
+}
+
+func (p *azureProvider) Name() string {
+	return "azure:" + p.resourceGroup + "/" + p.scaleSet
+}
+
+type azureVMList struct {
+	Value []struct {
+		InstanceId string            `json:"instanceId"`
+		Name       string            `json:"name"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+type azurePublicIPList struct {
+	Value []struct {
+		Properties struct {
+			IpAddress       string `json:"ipAddress"`
+			IpConfiguration struct {
+				Id string `json:"id"`
+			} `json:"ipConfiguration"`
+		} `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+type azureNetworkInterfaceList struct {
+	Value []struct {
+		Properties struct {
+			VirtualMachine struct {
+				Id string `json:"id"`
+			} `json:"virtualMachine"`
+			IpConfigurations []struct {
+				Properties struct {
+					PrivateIPAddress string `json:"privateIPAddress"`
+				} `json:"properties"`
+			} `json:"ipConfigurations"`
+		} `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+func (p *azureProvider) Discover(ctx context.Context) (Hosts, error) {
+	base := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s",
+		p.endpoint, url.PathEscape(p.subscription), url.PathEscape(p.resourceGroup), url.PathEscape(p.scaleSet))
+
+	// Collect the underlay ips for each scale set instance id
+	ips := map[string][]string{}
+
+	next := base + "/publicipaddresses?api-version=" + azureNetworkAPIVersion
+	for next != "" {
+		var res azurePublicIPList
+		if err := p.get(ctx, next, &res); err != nil {
+			return nil, err
+		}
+
+		for _, v := range res.Value {
+			id := azureInstanceId(v.Properties.IpConfiguration.Id)
+			ips[id] = append(ips[id], v.Properties.IpAddress)
+		}
+		next = res.NextLink
+	}
+
+	if p.includePrivate {
+		next = base + "/networkInterfaces?api-version=" + azureNetworkAPIVersion
+		for next != "" {
+			var res azureNetworkInterfaceList
+			if err := p.get(ctx, next, &res); err != nil {
+				return nil, err
+			}
+
+			for _, v := range res.Value {
+				id := azureInstanceId(v.Properties.VirtualMachine.Id)
+				for _, ic := range v.Properties.IpConfigurations {
+					ips[id] = append(ips[id], ic.Properties.PrivateIPAddress)
+				}
+			}
+			next = res.NextLink
+		}
+	}
+
+	hosts := Hosts{}
+	next = base + "/virtualMachines?api-version=" + azureComputeAPIVersion
+	for next != "" {
+		var res azureVMList
+		if err := p.get(ctx, next, &res); err != nil {
+			return nil, err
+		}
+
+		for _, vm := range res.Value {
+			if err := hosts.addHost(vm.Tags[p.vpnAddrTag], ips[vm.InstanceId], p.port); err != nil {
+				return nil, fmt.Errorf("instance %s: %w", vm.Name, err)
+			}
+		}
+		next = res.NextLink
+	}
+
+	return hosts, nil
+}
+
+// azureInstanceId extracts the scale set instance id from a resource id that lives beneath a scale set vm
+func azureInstanceId(resourceId string) string {
+	parts := strings.Split(resourceId, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], "virtualMachines") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func (p *azureProvider) get(ctx context.Context, u string, out any) error {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get access token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// accessToken fetches a managed identity token for the resource manager api from the instance metadata service
+func (p *azureProvider) accessToken(ctx context.Context) (string, error) {
+	p.tokenLock.Lock()
+	defer p.tokenLock.Unlock()
+
+	if p.token != "" && time.Until(p.tokenExpiry) > time.Minute {
+		return p.token, nil
+	}
+
+	u := p.imdsEndpoint + "/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" +
+		url.QueryEscape("https://management.azure.com/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+
+	expiresIn, err := strconv.ParseInt(t.ExpiresIn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid expires_in: %w", err)
+	}
+
+	p.token = t.AccessToken
+	p.tokenExpiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return p.token, nil
+}
@@ -0,0 +1,263 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const (
+	DefaultInterval = 5 * time.Minute
+	DefaultTimeout  = 30 * time.Second
+	DefaultPort     = 4242
+)
+
+// Hosts maps a vpn addr to the underlay addresses discovered for it
+type Hosts map[netip.Addr][]netip.AddrPort
+
+// Provider enumerates nebula hosts from an external inventory, typically a cloud provider API
+type Provider interface {
+	// Name returns a human readable identifier for the provider, used in logs
+	Name() string
+
+	// Discover returns the current set of hosts known to the provider
+	Discover(ctx context.Context) (Hosts, error)
+}
+
+// Config is the parsed form of the static_map.discovery config stanza
+type Config struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	Providers []Provider
+}
+
+// NewConfigFromConfig parses the discovery stanza at k. A nil Config is returned if no providers are configured.
+func NewConfigFromConfig(c *config.C, k string) (*Config, error) {
+	r := c.Get(k)
+	if r == nil {
+		return nil, nil
+	}
+
+	if _, ok := r.(map[string]any); !ok {
+		return nil, fmt.Errorf("config `%s` has invalid type: %T", k, r)
+	}
+
+	dc := &Config{
+		Interval: c.GetDuration(k+".interval", DefaultInterval),
+		Timeout:  c.GetDuration(k+".timeout", DefaultTimeout),
+	}
+
+	if dc.Interval <= 0 {
+		return nil, fmt.Errorf("config `%s.interval` must be greater than 0", k)
+	}
+
+	rawProviders := c.Get(k + ".providers")
+	if rawProviders == nil {
+		return nil, nil
+	}
+
+	providers, ok := rawProviders.([]any)
+	if !ok {
+		return nil, fmt.Errorf("config `%s.providers` has invalid type: %T", k, rawProviders)
+	}
+
+	for i, rp := range providers {
+		pm, ok := rp.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("config `%s.providers` entry %d has invalid type: %T", k, i+1, rp)
+		}
+
+		p, err := newProvider(pm)
+		if err != nil {
+			return nil, fmt.Errorf("config `%s.providers` entry %d: %w", k, i+1, err)
+		}
+
+		dc.Providers = append(dc.Providers, p)
+	}
+
+	if len(dc.Providers) == 0 {
+		return nil, nil
+	}
+
+	return dc, nil
+}
+
+func newProvider(m map[string]any) (Provider, error) {
+	opts := options(m)
+	t := opts.String("type", "")
+	switch t {
+	case "aws":
+		return newAWSProvider(opts)
+	case "gcp":
+		return newGCPProvider(opts)
+	case "azure":
+		return newAzureProvider(opts)
+	case "":
+		return nil, errors.New("type must be provided")
+	default:
+		return nil, fmt.Errorf("unknown type: %s", t)
+	}
+}
+
+// Discover queries every provider and merges the results. Providers that fail are logged and skipped, the returned
+// bool is false if any provider failed so callers can avoid dropping hosts due to a transient api error.
+func (dc *Config) Discover(ctx context.Context, l *logrus.Logger) (Hosts, bool) {
+	hosts := Hosts{}
+	complete := true
+
+	for _, p := range dc.Providers {
+		pctx, cancel := context.WithTimeout(ctx, dc.Timeout)
+		found, err := p.Discover(pctx)
+		cancel()
+		if err != nil {
+			l.WithError(err).WithField("provider", p.Name()).Error("Failed to discover hosts")
+			complete = false
+			continue
+		}
+
+		for vpnAddr, addrs := range found {
+			hosts.add(vpnAddr, addrs...)
+		}
+
+		if l.Level >= logrus.DebugLevel {
+			l.WithField("provider", p.Name()).WithField("hosts", len(found)).Debug("Discovered hosts")
+		}
+	}
+
+	return hosts, complete
+}
+
+func (h Hosts) add(vpnAddr netip.Addr, addrs ...netip.AddrPort) {
+	existing := h[vpnAddr]
+	for _, addr := range addrs {
+		if !slices.Contains(existing, addr) {
+			existing = append(existing, addr)
+		}
+	}
+	h[vpnAddr] = existing
+}
+
+// Equal reports whether both sets of hosts contain the same vpn addrs and underlay addresses, ignoring order
+func (h Hosts) Equal(o Hosts) bool {
+	if len(h) != len(o) {
+		return false
+	}
+
+	for vpnAddr, addrs := range h {
+		oAddrs, ok := o[vpnAddr]
+		if !ok || len(addrs) != len(oAddrs) {
+			return false
+		}
+
+		for _, addr := range addrs {
+			if !slices.Contains(oAddrs, addr) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// addHost parses the vpn addrs found in the instance tag value and records every underlay ip for each of them
+func (h Hosts) addHost(rawVpnAddrs string, ips []string, port uint16) error {
+	var vpnAddrs []netip.Addr
+	for _, rawVpnAddr := range strings.FieldsFunc(rawVpnAddrs, isListSeparator) {
+		vpnAddr, err := netip.ParseAddr(rawVpnAddr)
+		if err != nil {
+			return fmt.Errorf("invalid vpn addr %q: %w", rawVpnAddr, err)
+		}
+		vpnAddrs = append(vpnAddrs, vpnAddr)
+	}
+
+	var addrs []netip.AddrPort
+	for _, rawIp := range ips {
+		if rawIp == "" {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(rawIp)
+		if err != nil {
+			return fmt.Errorf("invalid ip %q: %w", rawIp, err)
+		}
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), port))
+	}
+
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	for _, vpnAddr := range vpnAddrs {
+		h.add(vpnAddr, addrs...)
+	}
+
+	return nil
+}
+
+func isListSeparator(r rune) bool {
+	return r == ',' || r == ' ' || r == ';'
+}
+
+// options is a small helper for reading provider specific settings
+type options map[string]any
+
+func (o options) String(k, d string) string {
+	v, ok := o[k]
+	if !ok || v == nil {
+		return d
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func (o options) Port(k string, d uint16) (uint16, error) {
+	v, ok := o[k]
+	if !ok || v == nil {
+		return d, nil
+	}
+
+	p, err := strconv.ParseUint(fmt.Sprintf("%v", v), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", k, v)
+	}
+
+	return uint16(p), nil
+}
+
+func (o options) Require(keys ...string) error {
+	for _, k := range keys {
+		if o.String(k, "") == "" {
+			return fmt.Errorf("%s must be provided", k)
+		}
+	}
+	return nil
+}
+
+// httpStatusError is returned when a provider api responds with a non 2xx status
+type httpStatusError struct {
+	url    string
+	status int
+	body   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s: %s", e.status, e.url, e.body)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	b := make([]byte, 512)
+	n, _ := resp.Body.Read(b)
+	return &httpStatusError{url: resp.Request.URL.String(), status: resp.StatusCode, body: strings.TrimSpace(string(b[:n]))}
+}
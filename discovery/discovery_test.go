@@ -0,0 +1,222 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	dc, err := NewConfigFromConfig(c, "static_map.discovery")
+	require.NoError(t, err)
+	assert.Nil(t, dc)
+
+	c.Settings["static_map"] = map[string]any{"discovery": "nope"}
+	_, err = NewConfigFromConfig(c, "static_map.discovery")
+	require.EqualError(t, err, "config `static_map.discovery` has invalid type: string")
+
+	c.Settings["static_map"] = map[string]any{"discovery": map[string]any{
+		"providers": []any{map[string]any{"type": "nope"}},
+	}}
+	_, err = NewConfigFromConfig(c, "static_map.discovery")
+	require.EqualError(t, err, "config `static_map.discovery.providers` entry 1: unknown type: nope")
+
+	c.Settings["static_map"] = map[string]any{"discovery": map[string]any{
+		"providers": []any{map[string]any{"type": "aws"}},
+	}}
+	_, err = NewConfigFromConfig(c, "static_map.discovery")
+	require.EqualError(t, err, "config `static_map.discovery.providers` entry 1: region must be provided")
+
+	c.Settings["static_map"] = map[string]any{"discovery": map[string]any{
+		"interval": "1m",
+		"providers": []any{
+			map[string]any{"type": "aws", "region": "us-east-1"},
+			map[string]any{"type": "gcp", "project": "p", "zone": "z", "instance_group": "ig"},
+			map[string]any{"type": "azure", "subscription": "s", "resource_group": "rg", "scale_set": "ss"},
+		},
+	}}
+	dc, err = NewConfigFromConfig(c, "static_map.discovery")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, dc.Interval)
+	assert.Equal(t, DefaultTimeout, dc.Timeout)
+	require.Len(t, dc.Providers, 3)
+	assert.Equal(t, "aws:us-east-1", dc.Providers[0].Name())
+	assert.Equal(t, "gcp:p/zones/z/ig", dc.Providers[1].Name())
+	assert.Equal(t, "azure:rg/ss", dc.Providers[2].Name())
+}
+
+func TestAWSProvider_Discover(t *testing.T) {
+	pages := []string{
+		`<DescribeInstancesResponse>
+  <reservationSet><item><instancesSet>
+    <item>
+      <instanceId>i-1</instanceId>
+      <ipAddress>1.1.1.1</ipAddress>
+      <privateIpAddress>172.16.0.1</privateIpAddress>
+      <tagSet><item><key>nebula-vpn-addrs</key><value>10.0.0.1,fd00::1</value></item></tagSet>
+    </item>
+  </instancesSet></item></reservationSet>
+  <nextToken>page2</nextToken>
+</DescribeInstancesResponse>`,
+		`<DescribeInstancesResponse>
+  <reservationSet><item><instancesSet>
+    <item>
+      <instanceId>i-2</instanceId>
+      <ipAddress>2.2.2.2</ipAddress>
+      <ipv6Address>2001:db8::2</ipv6Address>
+      <tagSet><item><key>nebula-vpn-addrs</key><value>10.0.0.2</value></item></tagSet>
+    </item>
+  </instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`,
+	}
+
+	var queries []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+		queries = append(queries, r.URL.RawQuery)
+		io.WriteString(w, pages[len(queries)-1])
+	}))
+	defer ts.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	p, err := newAWSProvider(options{
+		"region":   "us-east-1",
+		"endpoint": ts.URL,
+		"filters":  map[string]any{"tag:role": []any{"lighthouse", "relay"}},
+	})
+	require.NoError(t, err)
+
+	hosts, err := p.Discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Hosts{
+		netip.MustParseAddr("10.0.0.1"): {netip.MustParseAddrPort("1.1.1.1:4242")},
+		netip.MustParseAddr("fd00::1"):  {netip.MustParseAddrPort("1.1.1.1:4242")},
+		netip.MustParseAddr("10.0.0.2"): {netip.MustParseAddrPort("2.2.2.2:4242"), netip.MustParseAddrPort("[2001:db8::2]:4242")},
+	}, hosts)
+
+	require.Len(t, queries, 2)
+	assert.Equal(t, "Action=DescribeInstances&Filter.1.Name=instance-state-name&Filter.1.Value.1=running&"+
+		"Filter.2.Name=tag-key&Filter.2.Value.1=nebula-vpn-addrs&Filter.3.Name=tag%3Arole&Filter.3.Value.1=lighthouse&"+
+		"Filter.3.Value.2=relay&Version=2016-11-15", queries[0])
+	assert.Contains(t, queries[1], "NextToken=page2")
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// get-vanilla from the aws signature version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+
+	creds := awsCredentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWSRequest(req, "", creds, "us-east-1", "service", now)
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestGCPProvider_Discover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			io.WriteString(w, `{"access_token":"tok","expires_in":3600}`)
+		case "/compute/v1/projects/p/zones/z/instanceGroups/ig/listInstances":
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+			io.WriteString(w, `{"items":[{"instance":"https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/lh1"}]}`)
+		case "/compute/v1/projects/p/zones/z/instances/lh1":
+			io.WriteString(w, `{"name":"lh1","networkInterfaces":[{"networkIP":"10.128.0.5","accessConfigs":[{"natIP":"3.3.3.3"}]}],
+				"metadata":{"items":[{"key":"nebula-vpn-addrs","value":"10.0.0.3"}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	p, err := newGCPProvider(options{
+		"project":           "p",
+		"zone":              "z",
+		"instance_group":    "ig",
+		"endpoint":          ts.URL,
+		"metadata_endpoint": ts.URL,
+		"include_private":   true,
+		"port":              4243,
+	})
+	require.NoError(t, err)
+
+	hosts, err := p.Discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Hosts{
+		netip.MustParseAddr("10.0.0.3"): {netip.MustParseAddrPort("3.3.3.3:4243"), netip.MustParseAddrPort("10.128.0.5:4243")},
+	}, hosts)
+}
+
+func TestAzureProvider_Discover(t *testing.T) {
+	base := "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/ss"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			assert.Equal(t, "true", r.Header.Get("Metadata"))
+			io.WriteString(w, `{"access_token":"tok","expires_in":"3600"}`)
+		case base + "/publicipaddresses":
+			io.WriteString(w, `{"value":[
+				{"properties":{"ipAddress":"4.4.4.4","ipConfiguration":{"id":"`+base+`/virtualMachines/0/networkInterfaces/nic/ipConfigurations/ip"}}},
+				{"properties":{"ipAddress":"5.5.5.5","ipConfiguration":{"id":"`+base+`/virtualMachines/1/networkInterfaces/nic/ipConfigurations/ip"}}}
+			]}`)
+		case base + "/virtualMachines":
+			assert.Equal(t, "Bearer tok", r.Header.Get("Authorization"))
+			io.WriteString(w, `{"value":[
+				{"instanceId":"0","name":"ss_0","tags":{"nebula-vpn-addrs":"10.0.0.4"}},
+				{"instanceId":"1","name":"ss_1","tags":{}}
+			]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	p, err := newAzureProvider(options{
+		"subscription":      "s",
+		"resource_group":    "rg",
+		"scale_set":         "ss",
+		"endpoint":          ts.URL,
+		"metadata_endpoint": ts.URL,
+	})
+	require.NoError(t, err)
+
+	hosts, err := p.Discover(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Hosts{
+		netip.MustParseAddr("10.0.0.4"): {netip.MustParseAddrPort("4.4.4.4:4242")},
+	}, hosts)
+}
+
+func TestHosts_Equal(t *testing.T) {
+	a := Hosts{netip.MustParseAddr("10.0.0.1"): {netip.MustParseAddrPort("1.1.1.1:1"), netip.MustParseAddrPort("2.2.2.2:2")}}
+	b := Hosts{netip.MustParseAddr("10.0.0.1"): {netip.MustParseAddrPort("2.2.2.2:2"), netip.MustParseAddrPort("1.1.1.1:1")}}
+	assert.True(t, a.Equal(b))
+
+	b[netip.MustParseAddr("10.0.0.1")] = b[netip.MustParseAddr("10.0.0.1")][:1]
+	assert.False(t, a.Equal(b))
+	assert.False(t, a.Equal(nil))
+	assert.True(t, Hosts{}.Equal(nil))
+}
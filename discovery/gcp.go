@@ -0,0 +1,231 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcpDefaultMetadataEndpoint = "http://metadata.google.internal"
+
+// gcpProvider discovers hosts by listing the members of a GCE instance group
+type gcpProvider struct {
+	project          string
+	location         string
+	instanceGroup    string
+	endpoint         string
+	metadataEndpoint string
+	vpnAddrKey       string
+	port             uint16
+	includePrivate   bool
+	client           *http.Client
+
+	tokenLock   sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newGCPProvider(o options) (*gcpProvider, error) {
+	if err := o.Require("project", "instance_group"); err != nil {
+		return nil, err
+	}
+
+	port, err := o.Port("port", DefaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &gcpProvider{
+		project:          o.String("project", ""),
+		instanceGroup:    o.String("instance_group", ""),
+		endpoint:         strings.TrimSuffix(o.String("endpoint", "https://compute.googleapis.com"), "/"),
+		metadataEndpoint: strings.TrimSuffix(o.String("metadata_endpoint", gcpDefaultMetadataEndpoint), "/"),
+		vpnAddrKey:       o.String("vpn_addr_key", "nebula-vpn-addrs"),
+		port:             port,
+		includePrivate:   o.String("include_private", "false") == "true",
+		client:           &http.Client{},
+	}
+
+	zone := o.String("zone", "")
+	region := o.String("region", "")
+	switch {
+	case zone != "" && region != "":
+		return nil, fmt.Errorf("only one of zone or region may be provided")
+	case zone != "":
+		p.location = "zones/" + zone
+	case region != "":
+		p.location = "regions/" + region
+	default:
+		return nil, fmt.Errorf("zone or region must be provided")
+	}
+
+	return p, nil
+}
+
+func (p *gcpProvider) Name() string {
+	return "gcp:" + p.project + "/" + p.location + "/" + p.instanceGroup
+}
+
+type gcpListInstancesResponse struct {
+	Items []struct {
+		Instance string `json:"instance"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+type gcpInstance struct {
+	Name              string `json:"name"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+		Ipv6AccessConfigs []struct {
+			ExternalIpv6 string `json:"externalIpv6"`
+		} `json:"ipv6AccessConfigs"`
+	} `json:"networkInterfaces"`
+	Metadata struct {
+		Items []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"items"`
+	} `json:"metadata"`
+}
+
+func (p *gcpProvider) Discover(ctx context.Context) (Hosts, error) {
+	hosts := Hosts{}
+	listURL := fmt.Sprintf("%s/compute/v1/projects/%s/%s/instanceGroups/%s/listInstances",
+		p.endpoint, url.PathEscape(p.project), p.location, url.PathEscape(p.instanceGroup))
+
+	pageToken := ""
+	for {
+		u := listURL
+		if pageToken != "" {
+			u += "?pageToken=" + url.QueryEscape(pageToken)
+		}
+
+		var res gcpListInstancesResponse
+		if err := p.do(ctx, http.MethodPost, u, []byte(`{"instanceState":"RUNNING"}`), &res); err != nil {
+			return nil, err
+		}
+
+		for _, item := range res.Items {
+			var i gcpInstance
+			if err := p.do(ctx, http.MethodGet, p.rewrite(item.Instance), nil, &i); err != nil {
+				return nil, err
+			}
+
+			var vpnAddrs string
+			for _, m := range i.Metadata.Items {
+				if m.Key == p.vpnAddrKey {
+					vpnAddrs = m.Value
+					break
+				}
+			}
+
+			var ips []string
+			for _, ni := range i.NetworkInterfaces {
+				for _, ac := range ni.AccessConfigs {
+					ips = append(ips, ac.NatIP)
+				}
+				for _, ac := range ni.Ipv6AccessConfigs {
+					ips = append(ips, ac.ExternalIpv6)
+				}
+				if p.includePrivate {
+					ips = append(ips, ni.NetworkIP)
+				}
+			}
+
+			if err := hosts.addHost(vpnAddrs, ips, p.port); err != nil {
+				return nil, fmt.Errorf("instance %s: %w", i.Name, err)
+			}
+		}
+
+		if res.NextPageToken == "" {
+			return hosts, nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// rewrite points an instance self link at the configured endpoint, self links always reference the public api
+func (p *gcpProvider) rewrite(selfLink string) string {
+	i := strings.Index(selfLink, "/compute/v1/")
+	if i < 0 {
+		return selfLink
+	}
+	return p.endpoint + selfLink[i:]
+}
+
+func (p *gcpProvider) do(ctx context.Context, method, u string, body []byte, out any) error {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get access token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// accessToken fetches a token for the default service account from the metadata server
+func (p *gcpProvider) accessToken(ctx context.Context) (string, error) {
+	p.tokenLock.Lock()
+	defer p.tokenLock.Unlock()
+
+	if p.token != "" && time.Until(p.tokenExpiry) > time.Minute {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		p.metadataEndpoint+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+
+	p.token = t.AccessToken
+	p.tokenExpiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return p.token, nil
+}
@@ -0,0 +1,148 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+// dnsClientIdle is how long a client can go without a query before we forget its rate limit bucket
+const dnsClientIdle = time.Minute
+
+type dnsResult string
+
+const (
+	dnsAnswered    dnsResult = "answered"
+	dnsRefused     dnsResult = "refused"
+	dnsRateLimited dnsResult = "rate_limited"
+)
+
+// dnsAccess decides who may query the dns listener and how often. This host and localhost are always allowed and never
+// limited, host_dns sends every lookup on this host through them.
+type dnsAccess struct {
+	sync.Mutex
+	// groups is empty when anyone may query, otherwise a peer needs a certificate with at least one of them
+	groups    []string
+	rate      uint64
+	burst     uint64
+	clients   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+	queryLog  bool
+
+	metricRefused     metrics.Counter
+	metricRateLimited metrics.Counter
+}
+
+func newDnsAccess() *dnsAccess {
+	return &dnsAccess{
+		clients:           map[netip.Addr]*tokenBucket{},
+		metricRefused:     metrics.GetOrRegisterCounter("dns.refused", nil),
+		metricRateLimited: metrics.GetOrRegisterCounter("dns.rate_limited", nil),
+	}
+}
+
+func (a *dnsAccess) reload(c *config.C) {
+	groups := c.GetStringSlice("lighthouse.dns.allow_groups", []string{})
+	rate := max(c.GetInt("lighthouse.dns.rate_limit", 0), 0)
+	burst := max(c.GetInt("lighthouse.dns.rate_limit_burst", 0), 0)
+	if burst == 0 {
+		burst = rate * 2
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.groups = groups
+	if uint64(rate) != a.rate || uint64(burst) != a.burst {
+		// Start everyone over with the new limits
+		a.clients = map[netip.Addr]*tokenBucket{}
+	}
+	a.rate = uint64(rate)
+	a.burst = uint64(burst)
+	a.queryLog = c.GetBool("lighthouse.dns.query_log", false)
+}
+
+// allow takes a query from client out of its rate limit bucket
+func (a *dnsAccess) allow(client netip.Addr, now time.Time) bool {
+	a.Lock()
+	if a.rate == 0 {
+		a.Unlock()
+		return true
+	}
+
+	if now.Sub(a.lastSweep) >= dnsClientIdle {
+		for addr, b := range a.clients {
+			b.Lock()
+			idle := now.Sub(b.last) >= dnsClientIdle
+			b.Unlock()
+			if idle {
+				delete(a.clients, addr)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	b := a.clients[client]
+	if b == nil {
+		b = newTokenBucket(a.rate, a.burst)
+		a.clients[client] = b
+	}
+	a.Unlock()
+
+	if !b.allow(now, 1) {
+		a.metricRateLimited.Inc(1)
+		return false
+	}
+	return true
+}
+
+// allowGroups reports whether a peer in groups may query
+func (a *dnsAccess) allowGroups(groups []string) bool {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.groups) == 0 {
+		return true
+	}
+
+	for _, g := range groups {
+		if slices.Contains(a.groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted reports whether only some peers may query
+func (a *dnsAccess) restricted() bool {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.groups) > 0
+}
+
+func (a *dnsAccess) logQueries() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.queryLog
+}
+
+// dnsClientAddr returns the address a query came from
+func dnsClientAddr(addr net.Addr) netip.Addr {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return v.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return v.AddrPort().Addr().Unmap()
+	case nil:
+		return netip.Addr{}
+	}
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gaissmai/bart"
 	"github.com/miekg/dns"
@@ -22,11 +24,25 @@ var dnsAddr string
 
 type dnsRecords struct {
 	sync.RWMutex
-	l               *logrus.Logger
-	dnsMap4         map[string]netip.Addr
-	dnsMap6         map[string]netip.Addr
+	l       *logrus.Logger
+	dnsMap4 map[string]netip.Addr
+	dnsMap6 map[string]netip.Addr
+	// ptrMap holds the name for every address in dnsMap4 and dnsMap6
+	ptrMap          map[netip.Addr]string
 	hostMap         *HostMap
 	myVpnAddrsTable *bart.Lite
+	// domains are optional suffixes, `host.domain.` is answered the same as `host.`. The first one is added to the
+	// names we answer PTR queries with.
+	domains []string
+	aliases map[string]dnsAlias
+	access  *dnsAccess
+}
+
+// dnsAlias is an extra name from lighthouse.dns.aliases, it is answered with the records for a host or with fixed
+// addresses
+type dnsAlias struct {
+	host  string
+	addrs []netip.Addr
 }
 
 func newDnsRecords(l *logrus.Logger, cs *CertState, hostMap *HostMap) *dnsRecords {
@@ -34,29 +50,127 @@ func newDnsRecords(l *logrus.Logger, cs *CertState, hostMap *HostMap) *dnsRecord
 		l:               l,
 		dnsMap4:         make(map[string]netip.Addr),
 		dnsMap6:         make(map[string]netip.Addr),
+		ptrMap:          make(map[netip.Addr]string),
+		aliases:         make(map[string]dnsAlias),
 		hostMap:         hostMap,
 		myVpnAddrsTable: cs.myVpnAddrsTable,
+		access:          newDnsAccess(),
 	}
 }
 
-func (d *dnsRecords) Query(q uint16, data string) netip.Addr {
+// unlockedName lowercases a query name and strips the first of lighthouse.dns.domains it ends with
+func (d *dnsRecords) unlockedName(data string) string {
 	data = strings.ToLower(data)
+	for _, domain := range d.domains {
+		if strings.HasSuffix(data, "."+domain+".") {
+			return strings.TrimSuffix(data, domain+".")
+		}
+	}
+	return data
+}
+
+// unlockedLookup returns the first ipv4 and ipv6 address for a query name, following aliases
+func (d *dnsRecords) unlockedLookup(data string) (v4, v6 netip.Addr) {
+	data = d.unlockedName(data)
+	if alias, ok := d.aliases[data]; ok {
+		if alias.host == "" {
+			for _, addr := range alias.addrs {
+				if addr.Is4() && !v4.IsValid() {
+					v4 = addr
+				} else if addr.Is6() && !v6.IsValid() {
+					v6 = addr
+				}
+			}
+			return v4, v6
+		}
+		data = alias.host
+	}
+
+	return d.dnsMap4[data], d.dnsMap6[data]
+}
+
+// Has reports if there is any record for the name, a host with only ipv6 addresses has no A record but still exists
+func (d *dnsRecords) Has(data string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	v4, v6 := d.unlockedLookup(data)
+	return v4.IsValid() || v6.IsValid()
+}
+
+func (d *dnsRecords) Query(q uint16, data string) netip.Addr {
 	d.RLock()
 	defer d.RUnlock()
+	v4, v6 := d.unlockedLookup(data)
 	switch q {
 	case dns.TypeA:
-		if r, ok := d.dnsMap4[data]; ok {
-			return r
-		}
+		return v4
 	case dns.TypeAAAA:
-		if r, ok := d.dnsMap6[data]; ok {
-			return r
-		}
+		return v6
 	}
 
 	return netip.Addr{}
 }
 
+// QueryPtr returns the host name for a reverse lookup name, with the first of lighthouse.dns.domains appended
+func (d *dnsRecords) QueryPtr(data string) string {
+	addr, ok := parsePtrName(data)
+	if !ok {
+		return ""
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+	name, ok := d.ptrMap[addr]
+	if !ok {
+		return ""
+	}
+	if len(d.domains) > 0 {
+		name += d.domains[0] + "."
+	}
+	return name
+}
+
+// parsePtrName reads the address out of an in-addr.arpa or ip6.arpa name
+func parsePtrName(data string) (netip.Addr, bool) {
+	data = strings.ToLower(data)
+	switch {
+	case strings.HasSuffix(data, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(data, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(labels)
+		addr, err := netip.ParseAddr(strings.Join(labels, "."))
+		return addr, err == nil && addr.Is4()
+
+	case strings.HasSuffix(data, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(data, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var b [16]byte
+		for i, n := range nibbles {
+			if len(n) != 1 {
+				return netip.Addr{}, false
+			}
+			v, err := strconv.ParseUint(n, 16, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			// The least significant nibble comes first
+			pos := 31 - i
+			if pos%2 == 0 {
+				b[pos/2] |= byte(v) << 4
+			} else {
+				b[pos/2] |= byte(v)
+			}
+		}
+		return netip.AddrFrom16(b), true
+	}
+
+	return netip.Addr{}, false
+}
+
 func (d *dnsRecords) QueryCert(data string) string {
 	ip, err := netip.ParseAddr(data[:len(data)-1])
 	if err != nil {
@@ -90,9 +204,11 @@ func (d *dnsRecords) Add(host string, addresses []netip.Addr) {
 	for _, addr := range addresses {
 		if addr.Is4() && !haveV4 {
 			d.dnsMap4[host] = addr
+			d.ptrMap[addr] = host
 			haveV4 = true
 		} else if addr.Is6() && !haveV6 {
 			d.dnsMap6[host] = addr
+			d.ptrMap[addr] = host
 			haveV6 = true
 		}
 		if haveV4 && haveV6 {
@@ -101,6 +217,57 @@ func (d *dnsRecords) Add(host string, addresses []netip.Addr) {
 	}
 }
 
+func (d *dnsRecords) reloadDomain(c *config.C) {
+	var domains []string
+	add := func(domain string) {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain != "" && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	add(c.GetString("lighthouse.dns.domain", ""))
+	for _, domain := range c.GetStringSlice("lighthouse.dns.domains", []string{}) {
+		add(domain)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.domains = domains
+}
+
+func (d *dnsRecords) reloadAliases(c *config.C) error {
+	aliases := map[string]dnsAlias{}
+	for k, v := range c.GetMap("lighthouse.dns.aliases", map[string]any{}) {
+		name := strings.ToLower(strings.Trim(fmt.Sprintf("%v", k), ".")) + "."
+		if name == "." {
+			return fmt.Errorf("lighthouse.dns.aliases has an empty name")
+		}
+
+		switch target := v.(type) {
+		case string:
+			aliases[name] = dnsAlias{host: strings.ToLower(strings.Trim(target, ".")) + "."}
+		case []any:
+			alias := dnsAlias{}
+			for _, a := range target {
+				addr, err := netip.ParseAddr(fmt.Sprintf("%v", a))
+				if err != nil {
+					return fmt.Errorf("lighthouse.dns.aliases.%s has an invalid address: %w", k, err)
+				}
+				alias.addrs = append(alias.addrs, addr)
+			}
+			aliases[name] = alias
+		default:
+			return fmt.Errorf("lighthouse.dns.aliases.%s should be a host name or a list of addresses", k)
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.aliases = aliases
+	return nil
+}
+
 func (d *dnsRecords) isSelfNebulaOrLocalhost(addr string) bool {
 	a, _, _ := net.SplitHostPort(addr)
 	b, err := netip.ParseAddr(a)
@@ -108,12 +275,45 @@ func (d *dnsRecords) isSelfNebulaOrLocalhost(addr string) bool {
 		return false
 	}
 
+	return d.isSelfOrLocalhost(b)
+}
+
+func (d *dnsRecords) isSelfOrLocalhost(b netip.Addr) bool {
 	if b.IsLoopback() {
 		return true
 	}
 
 	//if we found it in this table, it's good
-	return d.myVpnAddrsTable.Contains(b)
+	return d.myVpnAddrsTable != nil && d.myVpnAddrsTable.Contains(b)
+}
+
+// checkAccess decides if a query from client gets an answer, peer is the name on the client's certificate if it is a
+// nebula peer we have a tunnel with
+func (d *dnsRecords) checkAccess(client netip.Addr, now time.Time) (result dnsResult, peer string) {
+	if d.isSelfOrLocalhost(client) {
+		return dnsAnswered, ""
+	}
+
+	var groups []string
+	if client.IsValid() {
+		if hostinfo := d.hostMap.QueryVpnAddr(client); hostinfo != nil {
+			if c := hostinfo.GetCert(); c != nil {
+				peer = c.Certificate.Name()
+				groups = c.Certificate.Groups()
+			}
+		}
+	}
+
+	if d.access.restricted() && (peer == "" || !d.access.allowGroups(groups)) {
+		d.access.metricRefused.Inc(1)
+		return dnsRefused, peer
+	}
+
+	if !d.access.allow(client, now) {
+		return dnsRateLimited, peer
+	}
+
+	return dnsAnswered, peer
 }
 
 func (d *dnsRecords) parseQuery(m *dns.Msg, w dns.ResponseWriter) {
@@ -129,6 +329,15 @@ func (d *dnsRecords) parseQuery(m *dns.Msg, w dns.ResponseWriter) {
 					m.Answer = append(m.Answer, rr)
 				}
 			}
+		case dns.TypePTR:
+			d.l.Debugf("Query for PTR %s", q.Name)
+			name := d.QueryPtr(q.Name)
+			if name != "" {
+				rr, err := dns.NewRR(fmt.Sprintf("%s PTR %s", q.Name, name))
+				if err == nil {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
 		case dns.TypeTXT:
 			// We only answer these queries from nebula nodes or localhost
 			if !d.isSelfNebulaOrLocalhost(w.RemoteAddr().String()) {
@@ -146,6 +355,13 @@ func (d *dnsRecords) parseQuery(m *dns.Msg, w dns.ResponseWriter) {
 	}
 
 	if len(m.Answer) == 0 {
+		// Answering NXDOMAIN for a host that only lacks this record type would let resolvers cache that the whole name
+		// does not exist, hiding the records it does have
+		for _, q := range m.Question {
+			if (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && d.Has(q.Name) {
+				return
+			}
+		}
 		m.Rcode = dns.RcodeNameError
 	}
 }
@@ -155,6 +371,22 @@ func (d *dnsRecords) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m.SetReply(r)
 	m.Compress = false
 
+	client := dnsClientAddr(w.RemoteAddr())
+	result, peer := d.checkAccess(client, time.Now())
+	if d.access.logQueries() {
+		defer d.logQuery(client, peer, result, r, m)
+	}
+
+	switch result {
+	case dnsRateLimited:
+		// No answer at all, so that a flood of queries gets nothing back to amplify
+		return
+	case dnsRefused:
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
 	switch r.Opcode {
 	case dns.OpcodeQuery:
 		d.parseQuery(m, w)
@@ -163,19 +395,50 @@ func (d *dnsRecords) handleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(m)
 }
 
-func dnsMain(l *logrus.Logger, cs *CertState, hostMap *HostMap, c *config.C) func() {
+func (d *dnsRecords) logQuery(client netip.Addr, peer string, result dnsResult, r, m *dns.Msg) {
+	questions := make([]string, len(r.Question))
+	for i, q := range r.Question {
+		questions[i] = q.Name + " " + dns.TypeToString[q.Qtype]
+	}
+
+	fields := logrus.Fields{
+		"client":    client,
+		"questions": questions,
+		"result":    result,
+	}
+	if peer != "" {
+		fields["peer"] = peer
+	}
+	if result != dnsRateLimited {
+		fields["rcode"] = dns.RcodeToString[m.Rcode]
+		fields["answers"] = len(m.Answer)
+	}
+	d.l.WithFields(fields).Info("DNS query")
+}
+
+func dnsMain(l *logrus.Logger, cs *CertState, hostMap *HostMap, c *config.C) (func(), error) {
 	dnsR = newDnsRecords(l, cs, hostMap)
+	dnsR.reloadDomain(c)
+	dnsR.access.reload(c)
+	if err := dnsR.reloadAliases(c); err != nil {
+		return nil, err
+	}
 
 	// attach request handler func
 	dns.HandleFunc(".", dnsR.handleDnsRequest)
 
 	c.RegisterReloadCallback(func(c *config.C) {
+		dnsR.reloadDomain(c)
+		dnsR.access.reload(c)
+		if err := dnsR.reloadAliases(c); err != nil {
+			l.WithError(err).Error("Failed to reload lighthouse.dns.aliases, keeping the old aliases")
+		}
 		reloadDns(l, c)
 	})
 
 	return func() {
 		startDns(l, c)
-	}
+	}, nil
 }
 
 func getDnsServerAddr(c *config.C) string {
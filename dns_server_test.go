@@ -1,13 +1,18 @@
 package nebula
 
 import (
+	"net"
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/gaissmai/bart"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParsequery(t *testing.T) {
@@ -33,6 +38,44 @@ func TestParsequery(t *testing.T) {
 	ds.parseQuery(m, nil)
 	assert.NotNil(t, m.Answer)
 	assert.Equal(t, "fd01::24", m.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// Names under lighthouse.dns.domain resolve as well
+	ds.Add("host1.", addrs)
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"dns": map[string]any{"domain": "Neb."}}
+	ds.reloadDomain(c)
+
+	m = &dns.Msg{}
+	m.SetQuestion("HOST1.neb.", dns.TypeA)
+	ds.parseQuery(m, nil)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, "HOST1.neb.", m.Answer[0].Header().Name)
+	assert.Equal(t, "1.2.3.4", m.Answer[0].(*dns.A).A.String())
+
+	m = &dns.Msg{}
+	m.SetQuestion("host1.other.", dns.TypeA)
+	ds.parseQuery(m, nil)
+	assert.Empty(t, m.Answer)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+}
+
+func TestParsequery_v6Only(t *testing.T) {
+	l := logrus.New()
+	ds := newDnsRecords(l, &CertState{}, &HostMap{})
+	ds.Add("v6only.", []netip.Addr{netip.MustParseAddr("fd00::2")})
+
+	m := &dns.Msg{}
+	m.SetQuestion("v6only.", dns.TypeAAAA)
+	ds.parseQuery(m, nil)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, "fd00::2", m.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// The name exists, it just has no A record
+	m = &dns.Msg{}
+	m.SetQuestion("v6only.", dns.TypeA)
+	ds.parseQuery(m, nil)
+	assert.Empty(t, m.Answer)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
 }
 
 func Test_getDnsServerAddr(t *testing.T) {
@@ -71,3 +114,167 @@ func Test_getDnsServerAddr(t *testing.T) {
 	}
 	assert.Equal(t, "[::]:1", getDnsServerAddr(c))
 }
+
+type testDnsWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *testDnsWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *testDnsWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func TestDnsAccess(t *testing.T) {
+	l := logrus.New()
+	hostMap := newHostMap(l)
+	addPeer := func(name, addr string, groups ...string) {
+		crt := &dummyCert{name: name, groups: groups}
+		vpnAddr := netip.MustParseAddr(addr)
+		hostMap.Hosts[vpnAddr] = &HostInfo{
+			ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{Certificate: crt}},
+			vpnAddrs:        []netip.Addr{vpnAddr},
+		}
+	}
+	addPeer("laptop", "10.0.0.2", "laptops")
+	addPeer("printer", "10.0.0.3", "printers")
+
+	myVpnAddrsTable := new(bart.Lite)
+	myVpnAddrsTable.Insert(netip.MustParsePrefix("10.0.0.1/32"))
+	ds := newDnsRecords(l, &CertState{myVpnAddrsTable: myVpnAddrsTable}, hostMap)
+	ds.Add("host1.", []netip.Addr{netip.MustParseAddr("10.0.0.4")})
+
+	query := func(from string) *testDnsWriter {
+		w := &testDnsWriter{remote: &net.UDPAddr{IP: net.ParseIP(from), Port: 5300}}
+		r := &dns.Msg{}
+		r.SetQuestion("host1.", dns.TypeA)
+		ds.handleDnsRequest(w, r)
+		return w
+	}
+
+	// Anyone may query by default
+	w := query("192.168.1.1")
+	require.Len(t, w.msgs, 1)
+	assert.Len(t, w.msgs[0].Answer, 1)
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"dns": map[string]any{
+		"allow_groups":     []any{"laptops"},
+		"rate_limit":       1,
+		"rate_limit_burst": 2,
+	}}
+	ds.access.reload(c)
+
+	// Only peers in an allowed group get an answer
+	w = query("10.0.0.2")
+	require.Len(t, w.msgs, 1)
+	assert.Len(t, w.msgs[0].Answer, 1)
+
+	for _, from := range []string{"10.0.0.3", "10.0.0.9", "192.168.1.1"} {
+		w = query(from)
+		require.Len(t, w.msgs, 1, from)
+		assert.Equal(t, dns.RcodeRefused, w.msgs[0].Rcode, from)
+		assert.Empty(t, w.msgs[0].Answer, from)
+	}
+
+	// The burst is spent after one more query, the rest are dropped without an answer
+	w = query("10.0.0.2")
+	assert.Len(t, w.msgs, 1)
+	w = query("10.0.0.2")
+	assert.Empty(t, w.msgs)
+
+	// This host and localhost are never limited
+	for range 5 {
+		assert.Len(t, query("127.0.0.1").msgs, 1)
+		assert.Len(t, query("10.0.0.1").msgs, 1)
+	}
+
+	// Clients get their own bucket
+	assert.True(t, ds.access.allow(netip.MustParseAddr("10.0.0.5"), time.Now()))
+}
+
+func TestDnsAccess_idle(t *testing.T) {
+	a := newDnsAccess()
+	c := config.NewC(nil)
+	c.Settings["lighthouse"] = map[string]any{"dns": map[string]any{"rate_limit": 1}}
+	a.reload(c)
+	assert.Equal(t, uint64(2), a.burst)
+
+	now := time.Now()
+	assert.True(t, a.allow(netip.MustParseAddr("10.0.0.2"), now))
+	assert.True(t, a.allow(netip.MustParseAddr("10.0.0.3"), now.Add(30*time.Second)))
+	assert.Len(t, a.clients, 2)
+
+	// Idle clients are forgotten
+	assert.True(t, a.allow(netip.MustParseAddr("10.0.0.3"), now.Add(dnsClientIdle+time.Second)))
+	assert.Len(t, a.clients, 1)
+}
+
+func TestDnsDomainsAndAliases(t *testing.T) {
+	l := logrus.New()
+	ds := newDnsRecords(l, &CertState{}, &HostMap{})
+	ds.Add("host1.", []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("fd00::2")})
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"dns": map[string]any{
+		"domain":  "neb",
+		"domains": []any{".Mesh.Internal.", "neb"},
+		"aliases": map[string]any{
+			"git":     "HOST1",
+			"printer": []any{"10.0.0.20", "fd00::20"},
+		},
+	}}
+	ds.reloadDomain(c)
+	require.NoError(t, ds.reloadAliases(c))
+	assert.Equal(t, []string{"neb", "mesh.internal"}, ds.domains)
+
+	for _, name := range []string{"host1.", "host1.neb.", "host1.mesh.internal.", "git.", "git.mesh.internal."} {
+		assert.Equal(t, netip.MustParseAddr("10.0.0.2"), ds.Query(dns.TypeA, name), name)
+		assert.Equal(t, netip.MustParseAddr("fd00::2"), ds.Query(dns.TypeAAAA, name), name)
+	}
+	assert.Equal(t, netip.MustParseAddr("10.0.0.20"), ds.Query(dns.TypeA, "printer.neb."))
+	assert.Equal(t, netip.MustParseAddr("fd00::20"), ds.Query(dns.TypeAAAA, "printer."))
+	assert.False(t, ds.Has("host1.other."))
+
+	// Reverse lookups answer with the first domain
+	m := &dns.Msg{}
+	m.SetQuestion("2.0.0.10.in-addr.arpa.", dns.TypePTR)
+	ds.parseQuery(m, nil)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, "host1.neb.", m.Answer[0].(*dns.PTR).Ptr)
+
+	m = &dns.Msg{}
+	m.SetQuestion("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR)
+	ds.parseQuery(m, nil)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, "host1.neb.", m.Answer[0].(*dns.PTR).Ptr)
+
+	m = &dns.Msg{}
+	m.SetQuestion("3.0.0.10.in-addr.arpa.", dns.TypePTR)
+	ds.parseQuery(m, nil)
+	assert.Empty(t, m.Answer)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+
+	// Bad aliases are refused and the old ones kept
+	c.Settings["lighthouse"] = map[string]any{"dns": map[string]any{"aliases": map[string]any{"printer": []any{"nope"}}}}
+	require.Error(t, ds.reloadAliases(c))
+	assert.True(t, ds.Has("git."))
+}
+
+func Test_parsePtrName(t *testing.T) {
+	addr, ok := parsePtrName("4.3.2.1.IN-ADDR.ARPA.")
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("1.2.3.4"), addr)
+
+	addr, ok = parsePtrName("b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.")
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("4321:0:1:2:3:4:567:89ab"), addr)
+
+	for _, name := range []string{"3.2.1.in-addr.arpa.", "x.3.2.1.in-addr.arpa.", "1.ip6.arpa.", "host1."} {
+		_, ok = parsePtrName(name)
+		assert.False(t, ok, name)
+	}
+}
@@ -0,0 +1,360 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	// DefaultDoctorWait is how long the doctor waits for lighthouses to answer a handshake
+	DefaultDoctorWait = 10 * time.Second
+
+	doctorCertExpiryWarning = 30 * 24 * time.Hour
+	doctorClockProbeTimeout = 2 * time.Second
+
+	// doctorTunnelOverhead is the nebula header, the aead tag, and the udp and ipv4 headers around every tun packet
+	doctorTunnelOverhead = header.Len + 16 + 8 + 20
+)
+
+type DoctorSeverity string
+
+const (
+	DoctorOk      DoctorSeverity = "ok"
+	DoctorWarning DoctorSeverity = "warning"
+	DoctorError   DoctorSeverity = "error"
+)
+
+// DoctorFinding is a single result from Control.Doctor, Fix says what to do about anything that is not ok
+type DoctorFinding struct {
+	Check    string         `json:"check"`
+	Severity DoctorSeverity `json:"severity"`
+	Message  string         `json:"message"`
+	Fix      string         `json:"fix,omitempty"`
+}
+
+type DoctorReport []DoctorFinding
+
+// Failed returns true if any finding is an error
+func (r DoctorReport) Failed() bool {
+	for _, f := range r {
+		if f.Severity == DoctorError {
+			return true
+		}
+	}
+	return false
+}
+
+func (r DoctorReport) String() string {
+	var b strings.Builder
+	for _, f := range r {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", f.Severity, f.Check, f.Message)
+		if f.Fix != "" {
+			fmt.Fprintf(&b, "    fix: %s\n", f.Fix)
+		}
+	}
+	return b.String()
+}
+
+// doctor checks a running node for the mistakes that most often keep it off the network
+type doctor struct {
+	f           *Interface
+	vpnSettings *vpnSettings
+}
+
+func (d *doctor) run(ctx context.Context, wait time.Duration) DoctorReport {
+	now := time.Now()
+	var r DoctorReport
+	r = append(r, d.checkCertificates(now)...)
+	r = append(r, d.checkNetworks()...)
+	r = append(r, d.checkMTU()...)
+	r = append(r, d.checkLighthouses(ctx, wait)...)
+	r = append(r, d.checkClock(ctx)...)
+	return r
+}
+
+func (d *doctor) checkCertificates(now time.Time) DoctorReport {
+	var r DoctorReport
+	cs := d.f.pki.getCertState()
+	caPool := d.f.pki.GetCAPool()
+
+	for _, crt := range []cert.Certificate{cs.v1Cert, cs.v2Cert} {
+		if crt == nil {
+			continue
+		}
+
+		check := fmt.Sprintf("certificate v%d", crt.Version())
+		_, _, err := caPool.VerifyCertificateWithGrace(now, crt)
+		severity := DoctorError
+		if err == nil {
+			// Only valid thanks to pki.clock_skew_tolerance or pki.expired_grace
+			severity = DoctorWarning
+		}
+
+		switch {
+		case now.Before(crt.NotBefore()):
+			r = append(r, DoctorFinding{check, severity,
+				fmt.Sprintf("not valid until %s", crt.NotBefore().Format(time.RFC3339)),
+				"check the system clock, if it is right the certificate was signed on a host with a clock in the future"})
+			continue
+		case crt.Expired(now):
+			r = append(r, DoctorFinding{check, severity,
+				fmt.Sprintf("expired at %s", crt.NotAfter().Format(time.RFC3339)),
+				"sign a new certificate and reload nebula"})
+			continue
+		case err != nil:
+			r = append(r, DoctorFinding{check, DoctorError,
+				fmt.Sprintf("does not verify against pki.ca: %s", err),
+				"sign a new certificate with a CA from pki.ca, or add the CA that signed it to pki.ca"})
+			continue
+		}
+
+		if left := crt.NotAfter().Sub(now); left < doctorCertExpiryWarning {
+			r = append(r, DoctorFinding{check, DoctorWarning,
+				fmt.Sprintf("expires in %s at %s", left.Round(time.Minute), crt.NotAfter().Format(time.RFC3339)),
+				"sign a new certificate and reload nebula before it expires"})
+		} else {
+			r = append(r, DoctorFinding{check, DoctorOk,
+				fmt.Sprintf("%s is valid until %s", crt.Name(), crt.NotAfter().Format(time.RFC3339)), ""})
+		}
+
+		ca, err := caPool.GetCAForCert(crt)
+		if err == nil && ca.Certificate.NotAfter().Sub(now) < doctorCertExpiryWarning {
+			r = append(r, DoctorFinding{check, DoctorWarning,
+				fmt.Sprintf("signing CA %s expires at %s", ca.Certificate.Name(), ca.Certificate.NotAfter().Format(time.RFC3339)),
+				"add a new CA to pki.ca on every host and sign new certificates with it"})
+		}
+	}
+
+	return r
+}
+
+func (d *doctor) checkNetworks() DoctorReport {
+	var r DoctorReport
+	cs := d.f.pki.getCertState()
+
+	deviceNetworks := d.f.inside.Networks()
+	for _, n := range cs.myVpnNetworks {
+		if !slices.Contains(deviceNetworks, n) {
+			r = append(r, DoctorFinding{"networks", DoctorError,
+				fmt.Sprintf("tun device %s does not have %s from our certificate", d.f.inside.Name(), n),
+				"restart nebula, the tun device addresses can not change while it runs"})
+		}
+	}
+
+	if assigned, ok := deviceAddrs(d.f.inside.Name()); ok {
+		for _, n := range cs.myVpnNetworks {
+			if !slices.Contains(assigned, n.Addr()) {
+				r = append(r, DoctorFinding{"networks", DoctorError,
+					fmt.Sprintf("%s is not assigned to %s", n.Addr(), d.f.inside.Name()),
+					"check that nothing else manages the tun device, or restart nebula"})
+			}
+		}
+	}
+
+	outside := func(kind string, addrs []netip.Addr) {
+		for _, addr := range addrs {
+			if !cs.myVpnNetworksTable.Contains(addr) {
+				r = append(r, DoctorFinding{"networks", DoctorWarning,
+					fmt.Sprintf("%s %s is not within our networks %v", kind, addr, cs.myVpnNetworks),
+					fmt.Sprintf("%s should be nebula addresses, traffic to this one will not be routed to the tun device", kind)})
+			}
+		}
+	}
+	outside("lighthouse", d.f.lightHouse.GetLighthouses())
+	outside("relay", d.f.lightHouse.GetRelaysForMe())
+
+	static := make([]netip.Addr, 0, len(d.f.lightHouse.GetStaticHostList()))
+	for addr := range d.f.lightHouse.GetStaticHostList() {
+		static = append(static, addr)
+	}
+	slices.SortFunc(static, netip.Addr.Compare)
+	outside("static_host_map entry", static)
+
+	if len(r) == 0 {
+		r = append(r, DoctorFinding{"networks", DoctorOk, fmt.Sprintf("tun device and config match our networks %v", cs.myVpnNetworks), ""})
+	}
+
+	return r
+}
+
+// deviceAddrs returns the addresses the os has on the named interface, false if there is no such interface as with a
+// userspace device
+func deviceAddrs(name string) ([]netip.Addr, bool) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, false
+	}
+
+	raw, err := iface.Addrs()
+	if err != nil {
+		return nil, false
+	}
+
+	var addrs []netip.Addr
+	for _, a := range raw {
+		if n, ok := a.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(n.IP); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+	}
+	return addrs, true
+}
+
+func (d *doctor) checkMTU() DoctorReport {
+	s := d.vpnSettings.get()
+
+	for _, n := range s.Networks {
+		if n.Addr().Is6() && s.MTU < 1280 {
+			return DoctorReport{{"mtu", DoctorError,
+				fmt.Sprintf("tun.mtu %d is below 1280, the minimum for ipv6", s.MTU),
+				"raise tun.mtu to at least 1280"}}
+		}
+	}
+
+	// The largest link is the most generous guess at the path to our peers
+	linkMTU := 0
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == d.f.inside.Name() {
+			continue
+		}
+		linkMTU = max(linkMTU, iface.MTU)
+	}
+
+	if linkMTU == 0 {
+		return DoctorReport{{"mtu", DoctorOk, fmt.Sprintf("tun.mtu is %d, no link mtu to compare it to", s.MTU), ""}}
+	}
+
+	if s.MTU+doctorTunnelOverhead > linkMTU {
+		return DoctorReport{{"mtu", DoctorWarning,
+			fmt.Sprintf("tun.mtu %d plus %d bytes of overhead is larger than the largest link mtu %d, big packets will be fragmented or dropped", s.MTU, doctorTunnelOverhead, linkMTU),
+			fmt.Sprintf("set tun.mtu to %d or less", linkMTU-doctorTunnelOverhead)}}
+	}
+
+	return DoctorReport{{"mtu", DoctorOk, fmt.Sprintf("tun.mtu %d fits within the link mtu %d", s.MTU, linkMTU), ""}}
+}
+
+// checkLighthouses handshakes with every lighthouse we do not have a tunnel to and reports the ones that never answer
+func (d *doctor) checkLighthouses(ctx context.Context, wait time.Duration) DoctorReport {
+	if d.f.lightHouse.amLighthouse {
+		return DoctorReport{{"lighthouses", DoctorOk, "this host is a lighthouse", ""}}
+	}
+
+	lighthouses := d.f.lightHouse.GetLighthouses()
+	if len(lighthouses) == 0 {
+		return DoctorReport{{"lighthouses", DoctorWarning, "no lighthouses are configured",
+			"set lighthouse.hosts, or make sure static_host_map covers every host this one talks to"}}
+	}
+
+	for _, addr := range lighthouses {
+		if d.f.hostMap.QueryVpnAddr(addr) == nil {
+			d.f.getOrHandshakeNoRouting(addr, nil)
+		}
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	connected := func() bool {
+		for _, addr := range lighthouses {
+			if d.f.hostMap.QueryVpnAddr(addr) == nil {
+				return false
+			}
+		}
+		return true
+	}
+
+wait:
+	for !connected() {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-deadline.C:
+			break wait
+		case <-tick.C:
+		}
+	}
+
+	var r DoctorReport
+	for _, addr := range lighthouses {
+		if hostinfo := d.f.hostMap.QueryVpnAddr(addr); hostinfo != nil {
+			via := hostinfo.remote.String()
+			if !hostinfo.remote.IsValid() {
+				via = "a relay"
+			}
+			r = append(r, DoctorFinding{"lighthouses", DoctorOk, fmt.Sprintf("%s is reachable via %s", addr, via), ""})
+			continue
+		}
+
+		var attempts int64
+		var remotes []netip.AddrPort
+		if hh := d.f.handshakeManager.queryVpnIp(addr); hh != nil {
+			hh.Lock()
+			attempts = hh.counter
+			remotes = slices.Clone(hh.lastRemotes)
+			hh.Unlock()
+		}
+
+		if len(remotes) == 0 {
+			r = append(r, DoctorFinding{"lighthouses", DoctorError,
+				fmt.Sprintf("no underlay address is known for %s", addr),
+				"add the lighthouse's public ip and port to static_host_map"})
+			continue
+		}
+
+		r = append(r, DoctorFinding{"lighthouses", DoctorError,
+			fmt.Sprintf("%s did not answer %d handshake attempts to %v", addr, attempts, remotes),
+			"check that nebula is running on the lighthouse and that udp to those addresses is not blocked by a firewall on either side"})
+	}
+
+	return r
+}
+
+// checkClock compares our clock to every lighthouse we have a tunnel to
+func (d *doctor) checkClock(ctx context.Context) DoctorReport {
+	warning := d.f.clockProbes.warningThreshold()
+	if warning <= 0 {
+		warning = defaultClockSkewWarning
+	}
+
+	var r DoctorReport
+	for _, addr := range d.f.lightHouse.GetLighthouses() {
+		hostinfo := d.f.hostMap.QueryVpnAddr(addr)
+		if hostinfo == nil {
+			continue
+		}
+
+		s, err := d.f.clockProbes.probe(ctx, d.f, hostinfo)
+		if err != nil {
+			r = append(r, DoctorFinding{"clock", DoctorWarning, fmt.Sprintf("%s: %s", addr, err), ""})
+			continue
+		}
+
+		if s.remote.IsZero() {
+			r = append(r, DoctorFinding{"clock", DoctorOk, fmt.Sprintf("%s does not report its time, it may be running an older nebula", addr), ""})
+			continue
+		}
+
+		skew := s.skew()
+		if skew.Abs() > warning {
+			r = append(r, DoctorFinding{"clock", DoctorWarning,
+				fmt.Sprintf("our clock is %s off from %s", skew.Round(time.Millisecond), addr),
+				"sync the clocks on both hosts with ntp, certificate validity depends on them"})
+		} else {
+			r = append(r, DoctorFinding{"clock", DoctorOk, fmt.Sprintf("our clock is within %s of %s", skew.Abs().Round(time.Millisecond), addr), ""})
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,164 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDoctor(t *testing.T, crt cert.Certificate, cas ...cert.Certificate) (*doctor, *LightHouse) {
+	l := test.NewLogger()
+	lh := newTestLighthouse()
+	lh.relaysForMe.Store(&[]netip.Addr{})
+
+	networksTable := new(bart.Lite)
+	for _, n := range crt.Networks() {
+		networksTable.Insert(n.Masked())
+	}
+
+	caPool := cert.NewCAPool()
+	for _, ca := range cas {
+		require.NoError(t, caPool.AddCA(ca))
+	}
+
+	dev, err := overlay.NewUserDevice(crt.Networks())
+	require.NoError(t, err)
+
+	f := &Interface{
+		hostMap:    newHostMap(l),
+		inside:     dev,
+		lightHouse: lh,
+		pki:        &PKI{},
+		l:          l,
+	}
+	f.pki.caPool.Store(caPool)
+	f.pki.cs.Store(&CertState{
+		initiatingVersion:  crt.Version(),
+		v2Cert:             crt,
+		myVpnNetworks:      crt.Networks(),
+		myVpnNetworksTable: networksTable,
+	})
+
+	v := &vpnSettings{l: l}
+	v.current.Store(&overlay.VpnSettings{Networks: crt.Networks(), MTU: 1300})
+	return &doctor{f: f, vpnSettings: v}, lh
+}
+
+func TestDoctorReport(t *testing.T) {
+	r := DoctorReport{
+		{"a", DoctorOk, "fine", ""},
+		{"b", DoctorWarning, "meh", "do something"},
+	}
+	assert.False(t, r.Failed())
+	assert.Equal(t, "[ok] a: fine\n[warning] b: meh\n    fix: do something\n", r.String())
+
+	r = append(r, DoctorFinding{"c", DoctorError, "broken", ""})
+	assert.True(t, r.Failed())
+}
+
+func TestDoctor_checkCertificates(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, now.Add(-time.Hour), now.Add(24*time.Hour*365), nil, nil, nil)
+	crt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "host", now.Add(-time.Minute), now.Add(24*time.Hour*90), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, nil, nil)
+
+	d, _ := newTestDoctor(t, crt, ca)
+	r := d.checkCertificates(now)
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorOk, r[0].Severity)
+
+	// expiring soon
+	r = d.checkCertificates(now.Add(24 * time.Hour * 80))
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorWarning, r[0].Severity)
+	assert.Contains(t, r[0].Message, "expires in")
+
+	r = d.checkCertificates(now.Add(24 * time.Hour * 91))
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorError, r[0].Severity)
+	assert.Contains(t, r[0].Message, "expired at")
+
+	r = d.checkCertificates(now.Add(-time.Hour))
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorError, r[0].Severity)
+	assert.Contains(t, r[0].Message, "not valid until")
+
+	// signed by a CA we do not trust
+	other, _, _, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	d, _ = newTestDoctor(t, crt, other)
+	r = d.checkCertificates(now)
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorError, r[0].Severity)
+	assert.Contains(t, r[0].Message, "does not verify against pki.ca")
+}
+
+func TestDoctor_checkNetworks(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	crt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "host", now.Add(-time.Minute), now.Add(time.Minute), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, nil, nil)
+
+	d, lh := newTestDoctor(t, crt, ca)
+	r := d.checkNetworks()
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorOk, r[0].Severity)
+
+	lh.lighthouses.Store(&[]netip.Addr{netip.MustParseAddr("10.1.0.2"), netip.MustParseAddr("192.168.0.1")})
+	r = d.checkNetworks()
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorWarning, r[0].Severity)
+	assert.Contains(t, r[0].Message, "lighthouse 192.168.0.1 is not within our networks")
+
+	// the device does not have what the cert says
+	d.f.inside, _ = overlay.NewUserDevice([]netip.Prefix{netip.MustParsePrefix("10.2.0.1/16")})
+	r = d.checkNetworks()
+	require.Len(t, r, 2)
+	assert.Equal(t, DoctorError, r[0].Severity)
+	assert.Contains(t, r[0].Message, "does not have 10.1.0.1/16")
+}
+
+func TestDoctor_checkMTU(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	crt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "host", now.Add(-time.Minute), now.Add(time.Minute), []netip.Prefix{netip.MustParsePrefix("fd00::1/64")}, nil, nil)
+
+	d, _ := newTestDoctor(t, crt, ca)
+	d.vpnSettings.current.Store(&overlay.VpnSettings{Networks: crt.Networks(), MTU: 1200})
+	r := d.checkMTU()
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorError, r[0].Severity)
+	assert.Contains(t, r[0].Message, "below 1280")
+}
+
+func TestDoctor_checkLighthouses(t *testing.T) {
+	now := time.Now()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, now.Add(-time.Hour), now.Add(time.Hour), nil, nil, nil)
+	crt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "host", now.Add(-time.Minute), now.Add(time.Minute), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/16")}, nil, nil)
+
+	d, lh := newTestDoctor(t, crt, ca)
+	r := d.checkLighthouses(context.Background(), 0)
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorWarning, r[0].Severity)
+
+	lh.amLighthouse = true
+	r = d.checkLighthouses(context.Background(), 0)
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorOk, r[0].Severity)
+	lh.amLighthouse = false
+
+	lhAddr := netip.MustParseAddr("10.1.0.2")
+	lh.lighthouses.Store(&[]netip.Addr{lhAddr})
+	remote := netip.MustParseAddrPort("1.2.3.4:4242")
+	d.f.hostMap.unlockedAddHostInfo(&HostInfo{vpnAddrs: []netip.Addr{lhAddr}, localIndexId: 1, remote: remote, ConnectionState: &ConnectionState{}}, d.f)
+	r = d.checkLighthouses(context.Background(), 0)
+	require.Len(t, r, 1)
+	assert.Equal(t, DoctorOk, r[0].Severity)
+	assert.Equal(t, "10.1.0.2 is reachable via 1.2.3.4:4242", r[0].Message)
+}
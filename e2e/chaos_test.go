@@ -0,0 +1,133 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2e
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/e2etest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosLighthouseLoss(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version1, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	lhControl, lhVpnIpNet, lhUdpAddr, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "lh  ", "10.128.0.1/24", m{"lighthouse": m{"am_lighthouse": true}})
+
+	o := m{
+		"static_host_map": m{
+			lhVpnIpNet[0].Addr().String(): []string{lhUdpAddr.String()},
+		},
+		"lighthouse": m{
+			"hosts":            []string{lhVpnIpNet[0].Addr().String()},
+			"local_allow_list": m{"10.0.0.0/24": true, "::/0": false},
+		},
+	}
+	myControl, myVpnIpNet, _, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "me  ", "10.128.0.2/24", o)
+	theirControl, theirVpnIpNet, _, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "them", "10.128.0.3/24", o)
+
+	r := router.NewR(t, lhControl, myControl, theirControl)
+	defer r.RenderFlow()
+
+	lhControl.Start()
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel between me and them through the lighthouse")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	took := e2etest.NewScenario(t, r).
+		At(time.Second, "kill the lighthouse", e2etest.Kill(lhControl)).
+		Converge(10*time.Second, func() bool {
+			return myControl.GetHostInfoByVpnAddr(lhVpnIpNet[0].Addr(), false) == nil &&
+				theirControl.GetHostInfoByVpnAddr(lhVpnIpNet[0].Addr(), false) == nil
+		})
+	t.Logf("Lighthouse tunnels were gone %v after it died", took)
+
+	t.Log("The tunnel between me and them does not need the lighthouse")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestChaosPublicAddrChange(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version1, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "me  ", "10.128.0.1/24", nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "them", "10.128.0.2/24", nil)
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	newAddr := netip.MustParseAddrPort("10.0.0.99:4242")
+	took := e2etest.NewScenario(t, r).
+		At(0, "their nat picks a new public address", e2etest.SetPublicAddr(r, theirControl, newAddr)).
+		At(time.Second, "they send me a packet", func() {
+			theirControl.InjectTunUDPPacket(myVpnIpNet[0].Addr(), 80, theirVpnIpNet[0].Addr(), 80, []byte("Hi from them"))
+		}).
+		Converge(5*time.Second, func() bool {
+			hi := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false)
+			return hi != nil && hi.CurrentRemote == newAddr
+		})
+	t.Logf("Roamed to their new address %v after their packet", took)
+
+	history := myControl.GetRemoteHistory(theirVpnIpNet[0].Addr())
+	require.Len(t, history, 2)
+	assert.Equal(t, newAddr, history[0].Addr)
+	assert.True(t, history[0].Validated)
+	assert.Equal(t, theirUdpAddr, history[1].Addr)
+
+	p := myControl.GetFromTun(true)
+	e2etest.AssertUdpPacket(t, []byte("Hi from them"), p, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), 80, 80)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestChaosCAExpiry(t *testing.T) {
+	// Leave enough time for the first handshake
+	expires := time.Now().Add(10 * time.Second)
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version1, cert.Curve_CURVE25519, time.Now().Add(-time.Hour), expires, nil, nil, []string{})
+	newExpiringServer := func(name, network string) (*nebula.Control, []netip.Prefix, netip.AddrPort) {
+		c, _, key, _ := cert_test.NewTestCert(cert.Version1, cert.Curve_CURVE25519, ca, caKey, name, time.Time{}, expires, []netip.Prefix{netip.MustParsePrefix(network)}, nil, []string{})
+		control, vpnNetworks, udpAddr, _ := e2etest.NewServer([]cert.Certificate{ca}, []cert.Certificate{c}, key, m{"pki": m{"disconnect_invalid": true}})
+		return control, vpnNetworks, udpAddr
+	}
+	myControl, myVpnIpNet, myUdpAddr := newExpiringServer("me  ", "10.128.0.1/24")
+	theirControl, theirVpnIpNet, theirUdpAddr := newExpiringServer("them", "10.128.0.2/24")
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	myControl.Start()
+	theirControl.Start()
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	took := e2etest.NewScenario(t, r).
+		At(time.Until(expires), "the ca expires", func() {}).
+		Converge(15*time.Second, func() bool {
+			return myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false) == nil &&
+				theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false) == nil
+		})
+	t.Logf("Tunnels closed %v after the ca expired", took)
+	assert.Less(t, took, 15*time.Second)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
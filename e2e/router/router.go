@@ -37,6 +37,9 @@ type R struct {
 	// map[from address + ":" + to address] => ip:port to rewrite in the udp packet to receiver
 	outNat map[string]netip.AddrPort
 
+	// A map of a control's listen address to the address its packets appear to come from, see SetPublicAddr
+	publicAddrs map[netip.AddrPort]netip.AddrPort
+
 	// A map of vpn ip to the nebula control it belongs to
 	vpnControls map[netip.Addr]*nebula.Control
 
@@ -120,6 +123,7 @@ func NewR(t testing.TB, controls ...*nebula.Control) *R {
 		vpnControls:  make(map[netip.Addr]*nebula.Control),
 		inNat:        make(map[netip.AddrPort]*nebula.Control),
 		outNat:       make(map[string]netip.AddrPort),
+		publicAddrs:  make(map[netip.AddrPort]netip.AddrPort),
 		flow:         []flowEntry{},
 		ignoreFlows:  []ignoreFlow{},
 		fn:           filepath.Join("mermaid", fmt.Sprintf("%s.md", t.Name())),
@@ -177,6 +181,26 @@ func (r *R) AddRoute(ip netip.Addr, port uint16, c *nebula.Control) {
 	r.inNat[inAddr] = c
 }
 
+// SetPublicAddr makes every packet from c appear to come from addr and routes packets for addr to c, like a NAT
+// picking a new public address for c. c is still reachable at its listen address.
+func (r *R) SetPublicAddr(c *nebula.Control, addr netip.AddrPort) {
+	r.Lock()
+	defer r.Unlock()
+
+	if other, ok := r.inNat[addr]; ok && other != c {
+		panic("Duplicate listen address inNat: " + addr.String())
+	}
+	r.inNat[addr] = c
+	r.publicAddrs[c.GetUDPAddr()] = addr
+}
+
+// ImpairLink degrades the packets from sends to to, see udp.Impairment. Packets to addresses added with AddRoute are
+// not covered, use Control.ImpairUDP with that address instead. A zero Impairment restores the link.
+// Dropped and held packets never reach the router so they do not show up in the flow logs.
+func (r *R) ImpairLink(from, to *nebula.Control, i udp.Impairment) {
+	from.ImpairUDP(to.GetUDPAddr(), i)
+}
+
 // RenderFlow renders the packet flow seen up until now and stops further automatic renders from happening.
 func (r *R) RenderFlow() {
 	r.cancelRender()
@@ -468,7 +492,12 @@ func (r *R) RouteForAllUntilTxTun(receiver *nebula.Control) []byte {
 	}
 
 	for {
-		x, rx, _ := reflect.Select(sc)
+		x, rx, ok := reflect.Select(sc)
+		if !ok {
+			// This control was stopped, stop listening to it
+			sc[x].Chan = reflect.Value{}
+			continue
+		}
 		r.Lock()
 
 		if x == 0 {
@@ -627,7 +656,12 @@ func (r *R) RouteForAllExitFunc(whatDo ExitFunc) {
 	}
 
 	for {
-		x, rx, _ := reflect.Select(sc)
+		x, rx, ok := reflect.Select(sc)
+		if !ok {
+			// This control was stopped, stop listening to it
+			sc[x].Chan = reflect.Value{}
+			continue
+		}
 		r.Lock()
 
 		p := rx.Interface().(*udp.Packet)
@@ -662,6 +696,58 @@ func (r *R) RouteForAllExitFunc(whatDo ExitFunc) {
 	}
 }
 
+// RouteForAllFor will route for every registered controller until d has passed, even if nothing is sent
+func (r *R) RouteForAllFor(d time.Duration) {
+	sc := make([]reflect.SelectCase, 0, len(r.controls)+1)
+	cm := make([]*nebula.Control, 0, len(r.controls))
+
+	for _, c := range r.controls {
+		sc = append(sc, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(c.GetUDPTxChan()),
+		})
+		cm = append(cm, c)
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	sc = append(sc, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(timer.C),
+	})
+
+	for {
+		x, rx, ok := reflect.Select(sc)
+		if x == len(cm) {
+			return
+		}
+
+		if !ok {
+			// This control was stopped, stop listening to it
+			sc[x].Chan = reflect.Value{}
+			continue
+		}
+
+		p := rx.Interface().(*udp.Packet)
+		if len(p.Data) < header.Len {
+			// Punches only keep real nat state alive, the tester conns would choke on them
+			continue
+		}
+
+		r.Lock()
+		receiver := r.getControl(cm[x].GetUDPAddr(), p.To, p)
+		if receiver == nil {
+			r.Unlock()
+			panic("Can't RouteForAllFor for host: " + p.To.String())
+		}
+
+		fp := r.unlockedInjectFlow(cm[x], receiver, p, false)
+		receiver.InjectUDPPacket(p)
+		fp.WasReceived()
+		r.Unlock()
+	}
+}
+
 // FlushAll will route for every registered controller, exiting once there are no packets left to route
 func (r *R) FlushAll() {
 	sc := make([]reflect.SelectCase, len(r.controls))
@@ -688,9 +774,15 @@ func (r *R) FlushAll() {
 
 	for {
 		x, rx, ok := reflect.Select(sc)
-		if !ok {
+		if x == len(cm) {
 			return
 		}
+
+		if !ok {
+			// This control was stopped, stop listening to it
+			sc[x].Chan = reflect.Value{}
+			continue
+		}
 		r.Lock()
 
 		p := rx.Interface().(*udp.Packet)
@@ -708,6 +800,10 @@ func (r *R) FlushAll() {
 // getControl performs or seeds NAT translation and returns the control for toAddr, p from fields may change
 // This is an internal router function, the caller must hold the lock
 func (r *R) getControl(fromAddr, toAddr netip.AddrPort, p *udp.Packet) *nebula.Control {
+	if publicAddr, ok := r.publicAddrs[fromAddr]; ok {
+		p.From = publicAddr
+	}
+
 	if newAddr, ok := r.outNat[fromAddr.String()+":"+toAddr.String()]; ok {
 		p.From = newAddr
 	}
@@ -746,9 +842,15 @@ func (r *R) formatUdpPacket(p *packet) string {
 		from = c.GetUDPAddr().String()
 	}
 
-	udpLayer := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
-	if udpLayer == nil {
-		panic("not a udp packet")
+	udpLayer, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		// Anything else, like a ping, is only named by its protocol
+		return fmt.Sprintf(
+			"    %s-->>%s: %v\n",
+			normalizeName(from),
+			normalizeName(p.to.GetUDPAddr().String()),
+			packet.Layers()[1].LayerType(),
+		)
 	}
 
 	data := packet.ApplicationLayer()
@@ -4,15 +4,23 @@
 package e2e
 
 import (
+	"bytes"
 	"fmt"
+	"maps"
 	"net/netip"
 	"testing"
 	"time"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/cert_test"
 	"github.com/slackhq/nebula/e2e/router"
+	"github.com/slackhq/nebula/e2etest"
+	"github.com/slackhq/nebula/header"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
 )
 
@@ -20,8 +28,8 @@ func TestDropInactiveTunnels(t *testing.T) {
 	// The goal of this test is to ensure the shortest inactivity timeout will close the tunnel on both sides
 	// under ideal conditions
 	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version1, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
-	myControl, myVpnIpNet, myUdpAddr, _ := newSimpleServer(cert.Version1, ca, caKey, "me", "10.128.0.1/24", m{"tunnels": m{"drop_inactive": true, "inactivity_timeout": "5s"}})
-	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServer(cert.Version1, ca, caKey, "them", "10.128.0.2/24", m{"tunnels": m{"drop_inactive": true, "inactivity_timeout": "10m"}})
+	myControl, myVpnIpNet, myUdpAddr, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "me", "10.128.0.1/24", m{"tunnels": m{"drop_inactive": true, "inactivity_timeout": "5s"}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewSimpleServer(cert.Version1, ca, caKey, "them", "10.128.0.2/24", m{"tunnels": m{"drop_inactive": true, "inactivity_timeout": "10m"}})
 
 	// Share our underlay information
 	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
@@ -34,7 +42,7 @@ func TestDropInactiveTunnels(t *testing.T) {
 	r := router.NewR(t, myControl, theirControl)
 
 	r.Log("Assert the tunnel between me and them works")
-	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 
 	r.Log("Go inactive and wait for the tunnels to get dropped")
 	waitStart := time.Now()
@@ -82,8 +90,8 @@ func TestCertUpgrade(t *testing.T) {
 	theirCert, _, theirPrivKey, _ := cert_test.NewTestCert(cert.Version1, cert.Curve_CURVE25519, ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.128.0.2/24")}, nil, []string{})
 	theirCert2, _ := cert_test.NewTestCertDifferentVersion(theirCert, cert.Version2, ca2, caKey2)
 
-	myControl, myVpnIpNet, myUdpAddr, myC := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert}, myPrivKey, m{})
-	theirControl, theirVpnIpNet, theirUdpAddr, _ := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
+	myControl, myVpnIpNet, myUdpAddr, myC := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert}, myPrivKey, m{})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
 
 	// Share our underlay information
 	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
@@ -97,7 +105,7 @@ func TestCertUpgrade(t *testing.T) {
 	defer r.RenderFlow()
 
 	r.Log("Assert the tunnel between me and them works")
-	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 	r.Log("yay")
 	//todo ???
 	time.Sleep(1 * time.Second)
@@ -130,7 +138,7 @@ func TestCertUpgrade(t *testing.T) {
 	r.Log("yay, spin until their sees it")
 	waitStart := time.Now()
 	for {
-		assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+		e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 		c := theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false)
 		if c == nil {
 			r.Log("nil")
@@ -176,8 +184,8 @@ func TestCertDowngrade(t *testing.T) {
 	theirCert, _, theirPrivKey, _ := cert_test.NewTestCert(cert.Version1, cert.Curve_CURVE25519, ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.128.0.2/24")}, nil, []string{})
 	theirCert2, _ := cert_test.NewTestCertDifferentVersion(theirCert, cert.Version2, ca2, caKey2)
 
-	myControl, myVpnIpNet, myUdpAddr, myC := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert2}, myPrivKey, m{})
-	theirControl, theirVpnIpNet, theirUdpAddr, _ := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
+	myControl, myVpnIpNet, myUdpAddr, myC := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert2}, myPrivKey, m{})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
 
 	// Share our underlay information
 	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
@@ -191,9 +199,9 @@ func TestCertDowngrade(t *testing.T) {
 	defer r.RenderFlow()
 
 	r.Log("Assert the tunnel between me and them works")
-	//assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+	//e2etest.AssertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
 	//r.Log("yay")
-	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 	r.Log("yay")
 	//todo ???
 	time.Sleep(1 * time.Second)
@@ -222,7 +230,7 @@ func TestCertDowngrade(t *testing.T) {
 	r.Log("yay, spin until their sees it")
 	waitStart := time.Now()
 	for {
-		assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+		e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 		c := theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false)
 		c2 := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false)
 		if c == nil || c2 == nil {
@@ -264,8 +272,8 @@ func TestCertMismatchCorrection(t *testing.T) {
 	theirCert, _, theirPrivKey, _ := cert_test.NewTestCert(cert.Version1, cert.Curve_CURVE25519, ca, caKey, "them", time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix("10.128.0.2/24")}, nil, []string{})
 	theirCert2, _ := cert_test.NewTestCertDifferentVersion(theirCert, cert.Version2, ca2, caKey2)
 
-	myControl, myVpnIpNet, myUdpAddr, _ := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert2}, myPrivKey, m{})
-	theirControl, theirVpnIpNet, theirUdpAddr, _ := newServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
+	myControl, myVpnIpNet, myUdpAddr, _ := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{myCert2}, myPrivKey, m{})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewServer([]cert.Certificate{ca, ca2}, []cert.Certificate{theirCert, theirCert2}, theirPrivKey, m{})
 
 	// Share our underlay information
 	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
@@ -279,9 +287,9 @@ func TestCertMismatchCorrection(t *testing.T) {
 	defer r.RenderFlow()
 
 	r.Log("Assert the tunnel between me and them works")
-	//assertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
+	//e2etest.AssertTunnel(t, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), theirControl, myControl, r)
 	//r.Log("yay")
-	assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 	r.Log("yay")
 	//todo ???
 	time.Sleep(1 * time.Second)
@@ -289,7 +297,7 @@ func TestCertMismatchCorrection(t *testing.T) {
 
 	waitStart := time.Now()
 	for {
-		assertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+		e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
 		c := theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false)
 		c2 := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false)
 		if c == nil || c2 == nil {
@@ -321,10 +329,10 @@ func TestCertMismatchCorrection(t *testing.T) {
 
 func TestCrossStackRelaysWork(t *testing.T) {
 	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
-	myControl, myVpnIpNet, _, _ := newSimpleServer(cert.Version2, ca, caKey, "me     ", "10.128.0.1/24,fc00::1/64", m{"relay": m{"use_relays": true}})
-	relayControl, relayVpnIpNet, relayUdpAddr, _ := newSimpleServer(cert.Version2, ca, caKey, "relay  ", "10.128.0.128/24,fc00::128/64", m{"relay": m{"am_relay": true}})
+	myControl, myVpnIpNet, _, _ := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "me     ", "10.128.0.1/24,fc00::1/64", m{"relay": m{"use_relays": true}})
+	relayControl, relayVpnIpNet, relayUdpAddr, _ := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "relay  ", "10.128.0.128/24,fc00::128/64", m{"relay": m{"am_relay": true}})
 	theirUdp := netip.MustParseAddrPort("10.0.0.2:4242")
-	theirControl, theirVpnIpNet, theirUdpAddr, _ := newSimpleServerWithUdp(cert.Version2, ca, caKey, "them   ", "fc00::2/64", theirUdp, m{"relay": m{"use_relays": true}})
+	theirControl, theirVpnIpNet, theirUdpAddr, _ := e2etest.NewSimpleServerWithUdp(cert.Version2, ca, caKey, "them   ", "fc00::2/64", theirUdp, m{"relay": m{"use_relays": true}})
 
 	//myVpnV4 := myVpnIpNet[0]
 	myVpnV6 := myVpnIpNet[1]
@@ -352,12 +360,12 @@ func TestCrossStackRelaysWork(t *testing.T) {
 
 	p := r.RouteForAllUntilTxTun(theirControl)
 	r.Log("Assert the tunnel works")
-	assertUdpPacket(t, []byte("Hi from me"), p, myVpnV6.Addr(), theirVpnV6.Addr(), 80, 80)
+	e2etest.AssertUdpPacket(t, []byte("Hi from me"), p, myVpnV6.Addr(), theirVpnV6.Addr(), 80, 80)
 
 	t.Log("reply?")
 	theirControl.InjectTunUDPPacket(myVpnV6.Addr(), 80, theirVpnV6.Addr(), 80, []byte("Hi from them"))
 	p = r.RouteForAllUntilTxTun(myControl)
-	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnV6.Addr(), myVpnV6.Addr(), 80, 80)
+	e2etest.AssertUdpPacket(t, []byte("Hi from them"), p, theirVpnV6.Addr(), myVpnV6.Addr(), 80, 80)
 
 	r.RenderHostmaps("Final hostmaps", myControl, relayControl, theirControl)
 	//t.Log("finish up")
@@ -365,3 +373,269 @@ func TestCrossStackRelaysWork(t *testing.T) {
 	//theirControl.Stop()
 	//relayControl.Stop()
 }
+
+func TestNullCipher(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	newFabricServer := func(name, network string, overrides m) (*nebula.Control, []netip.Prefix, netip.AddrPort) {
+		c, _, key, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix(network)}, nil, []string{"fabric"})
+		control, vpnNetworks, udpAddr, _ := e2etest.NewServer([]cert.Certificate{ca}, []cert.Certificate{c}, key, overrides)
+		return control, vpnNetworks, udpAddr
+	}
+
+	nullCipher := m{"null_cipher": m{"groups": []string{"fabric"}}}
+	myControl, myVpnIpNet, myUdpAddr := newFabricServer("me", "10.128.0.1/24", nullCipher)
+	theirControl, theirVpnIpNet, theirUdpAddr := newFabricServer("them", "10.128.0.2/24", nullCipher)
+	otherControl, otherVpnIpNet, otherUdpAddr := newFabricServer("other", "10.128.0.3/24", nil)
+
+	// Share our underlay information
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet[0].Addr(), otherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	sendData := func(to *nebula.Control, toAddr netip.Addr, data string) []byte {
+		myControl.InjectTunUDPPacket(toAddr, 80, myVpnIpNet[0].Addr(), 80, []byte(data))
+		h := &header.H{}
+		for {
+			p := myControl.GetFromUDP(true)
+			assert.NoError(t, h.Parse(p.Data))
+			to.InjectUDPPacket(p)
+			if h.Type == header.Message && h.Subtype == header.MessageNone {
+				e2etest.AssertUdpPacket(t, []byte(data), to.GetFromTun(true), myVpnIpNet[0].Addr(), toAddr, 80, 80)
+				return p.Data
+			}
+		}
+	}
+
+	r.Log("Both sides allow the null cipher for each other, payloads are readable on the wire")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	assert.True(t, myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false).NullCipher)
+	assert.True(t, theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).NullCipher)
+	assert.Contains(t, string(sendData(theirControl, theirVpnIpNet[0].Addr(), "Hi in the clear")), "Hi in the clear")
+
+	r.Log("Other does not allow it, so the tunnel is encrypted")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), myControl, otherControl, r)
+	assert.False(t, myControl.GetHostInfoByVpnAddr(otherVpnIpNet[0].Addr(), false).NullCipher)
+	assert.False(t, otherControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).NullCipher)
+	assert.NotContains(t, string(sendData(otherControl, otherVpnIpNet[0].Addr(), "Hi in secret")), "Hi in secret")
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestCompression(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	newServer := func(name, network string, overrides m) (*nebula.Control, []netip.Prefix, netip.AddrPort) {
+		c, _, key, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix(network)}, nil, []string{"satellite"})
+		control, vpnNetworks, udpAddr, _ := e2etest.NewServer([]cert.Certificate{ca}, []cert.Certificate{c}, key, overrides)
+		return control, vpnNetworks, udpAddr
+	}
+
+	myControl, myVpnIpNet, myUdpAddr := newServer("me", "10.128.0.1/24", m{"compression": m{
+		"groups": m{"satellite": "zstd"},
+		"hosts":  m{"10.128.0.3": "lz4"},
+	}})
+	theirControl, theirVpnIpNet, theirUdpAddr := newServer("them", "10.128.0.2/24", nil)
+	otherControl, otherVpnIpNet, otherUdpAddr := newServer("other", "10.128.0.3/24", nil)
+
+	// Share our underlay information
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet[0].Addr(), otherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	sendData := func(from, to *nebula.Control, fromAddr, toAddr netip.Addr, data []byte) header.MessageSubType {
+		from.InjectTunUDPPacket(toAddr, 80, fromAddr, 80, data)
+		h := &header.H{}
+		for {
+			p := from.GetFromUDP(true)
+			assert.NoError(t, h.Parse(p.Data))
+			to.InjectUDPPacket(p)
+			if h.Type == header.Message && h.Subtype != header.MessageRelay {
+				e2etest.AssertUdpPacket(t, data, to.GetFromTun(true), fromAddr, toAddr, 80, 80)
+				return h.Subtype
+			}
+		}
+	}
+	data := bytes.Repeat([]byte("a very compressible satellite payload "), 20)
+
+	r.Log("We compress to them with zstd, they do not compress back")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	assert.Equal(t, header.MessageZstd, sendData(myControl, theirControl, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), data))
+	assert.Equal(t, header.MessageNone, sendData(theirControl, myControl, theirVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), data))
+
+	mine := myControl.GetHostInfoByVpnAddr(theirVpnIpNet[0].Addr(), false).Compression
+	assert.Equal(t, "zstd", mine.Algorithm)
+	assert.Greater(t, mine.TxRatio(), 5.0)
+	theirs := theirControl.GetHostInfoByVpnAddr(myVpnIpNet[0].Addr(), false).Compression
+	assert.Equal(t, "none", theirs.Algorithm)
+	assert.Equal(t, mine.TxRatio(), theirs.RxRatio())
+
+	r.Log("Packets that do not shrink are sent as they are")
+	assert.Equal(t, header.MessageNone, sendData(myControl, theirControl, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), []byte("short")))
+
+	r.Log("The host entry for other wins over its group")
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), myControl, otherControl, r)
+	assert.Equal(t, "lz4", myControl.GetHostInfoByVpnAddr(otherVpnIpNet[0].Addr(), false).Compression.Algorithm)
+	assert.Equal(t, header.MessageLZ4, sendData(myControl, otherControl, myVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), data))
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestBroadcastDomain(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	newGroupServer := func(name, network string, groups []string) (*nebula.Control, []netip.Prefix, netip.AddrPort) {
+		c, _, key, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, name, time.Now(), time.Now().Add(5*time.Minute), []netip.Prefix{netip.MustParsePrefix(network)}, nil, groups)
+		control, vpnNetworks, udpAddr, _ := e2etest.NewServer([]cert.Certificate{ca}, []cert.Certificate{c}, key, m{"broadcast": m{"groups": []string{"lan"}}})
+		return control, vpnNetworks, udpAddr
+	}
+
+	myControl, myVpnIpNet, myUdpAddr := newGroupServer("me", "10.128.0.1/24", []string{"lan"})
+	theirControl, theirVpnIpNet, theirUdpAddr := newGroupServer("them", "10.128.0.2/24", []string{"lan"})
+	otherControl, otherVpnIpNet, otherUdpAddr := newGroupServer("other", "10.128.0.3/24", []string{"web"})
+
+	// Share our underlay information
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIpNet[0].Addr(), otherUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+	otherControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	r := router.NewR(t, myControl, theirControl, otherControl)
+	defer r.RenderFlow()
+
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), otherVpnIpNet[0].Addr(), myControl, otherControl, r)
+
+	r.Log("An mDNS query goes only to the host in the broadcast group")
+	mdns := netip.MustParseAddr("224.0.0.251")
+	myControl.InjectTunUDPPacket(mdns, 5353, myVpnIpNet[0].Addr(), 5353, []byte("Who is there?"))
+	p := myControl.GetFromUDP(true)
+	assert.Equal(t, theirUdpAddr, p.To)
+	theirControl.InjectUDPPacket(p)
+	e2etest.AssertUdpPacket(t, []byte("Who is there?"), theirControl.GetFromTun(true), myVpnIpNet[0].Addr(), mdns, 5353, 5353)
+	assert.Nil(t, myControl.GetFromUDP(false))
+
+	r.Log("Broadcasts from hosts outside the group are dropped")
+	otherControl.InjectTunUDPPacket(mdns, 5353, otherVpnIpNet[0].Addr(), 5353, []byte("Me!"))
+	p = otherControl.GetFromUDP(true)
+	assert.Equal(t, myUdpAddr, p.To)
+	myControl.InjectUDPPacket(p)
+
+	// Packets are handled in order, the next thing out of our tun is unicast
+	otherControl.InjectTunUDPPacket(myVpnIpNet[0].Addr(), 80, otherVpnIpNet[0].Addr(), 80, []byte("Hi"))
+	myControl.InjectUDPPacket(otherControl.GetFromUDP(true))
+	e2etest.AssertUdpPacket(t, []byte("Hi"), myControl.GetFromTun(true), otherVpnIpNet[0].Addr(), myVpnIpNet[0].Addr(), 80, 80)
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl, otherControl)
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
+func TestAnswerPing(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+	myControl, myVpnIpNet, myUdpAddr, _ := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "me", "10.128.0.1/24,ff::1/64", nil)
+	theirControl, theirVpnIpNet, theirUdpAddr, theirConfig := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "them", "10.128.0.2/24,ff::2/64", m{"tun": m{"answer_ping": true}})
+
+	// Share our underlay information
+	myControl.InjectLightHouseAddr(theirVpnIpNet[0].Addr(), theirUdpAddr)
+	theirControl.InjectLightHouseAddr(myVpnIpNet[0].Addr(), myUdpAddr)
+
+	// Start the servers
+	myControl.Start()
+	theirControl.Start()
+
+	r := router.NewR(t, myControl, theirControl)
+	defer r.RenderFlow()
+
+	ping := func(from, to netip.Addr) []byte {
+		buffer := gopacket.NewSerializeBuffer()
+		opt := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+		payload := gopacket.Payload("ping")
+		var err error
+		if to.Is4() {
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: from.AsSlice(), DstIP: to.AsSlice()}
+			icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: 1, Seq: 1}
+			err = gopacket.SerializeLayers(buffer, opt, ip, icmp, payload)
+		} else {
+			ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: from.AsSlice(), DstIP: to.AsSlice()}
+			icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+			require.NoError(t, icmp.SetNetworkLayerForChecksum(ip))
+			err = gopacket.SerializeLayers(buffer, opt, ip, icmp, &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1}, payload)
+		}
+		require.NoError(t, err)
+		return buffer.Bytes()
+	}
+
+	assertReply := func(p []byte, from, to netip.Addr) {
+		pkt := gopacket.NewPacket(p, layers.LayerTypeIPv4, gopacket.Default)
+		if to.Is6() {
+			pkt = gopacket.NewPacket(p, layers.LayerTypeIPv6, gopacket.Default)
+		}
+		require.Nil(t, pkt.ErrorLayer())
+		src, dst := pkt.NetworkLayer().NetworkFlow().Endpoints()
+		assert.Equal(t, from.AsSlice(), src.Raw())
+		assert.Equal(t, to.AsSlice(), dst.Raw())
+		if to.Is4() {
+			icmp := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			assert.Equal(t, uint8(layers.ICMPv4TypeEchoReply), icmp.TypeCode.Type())
+		} else {
+			icmp := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+			assert.Equal(t, uint8(layers.ICMPv6TypeEchoReply), icmp.TypeCode.Type())
+		}
+		assert.True(t, bytes.HasSuffix(p, []byte("ping")))
+	}
+
+	e2etest.AssertTunnel(t, myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr(), myControl, theirControl, r)
+
+	for i := range myVpnIpNet {
+		me, them := myVpnIpNet[i].Addr(), theirVpnIpNet[i].Addr()
+		r.Log("They answer a ping to", them, "without it reaching their tun")
+		myControl.InjectTunPacket(ping(me, them))
+		assertReply(r.RouteForAllUntilTxTun(myControl), them, me)
+		assert.Nil(t, theirControl.GetFromTun(false))
+	}
+
+	r.Log("With answer_ping off the ping goes to their tun")
+	// Settings is copied rather than changed in place so the reload sees the change
+	settings := maps.Clone(theirConfig.Settings)
+	tun := maps.Clone(settings["tun"].(m))
+	tun["answer_ping"] = false
+	settings["tun"] = tun
+	rc, err := yaml.Marshal(settings)
+	require.NoError(t, err)
+	require.NoError(t, theirConfig.ReloadConfigString(string(rc)))
+	request := ping(myVpnIpNet[0].Addr(), theirVpnIpNet[0].Addr())
+	myControl.InjectTunPacket(request)
+	assert.Equal(t, request, r.RouteForAllUntilTxTun(theirControl))
+
+	r.RenderHostmaps("Final hostmaps", myControl, theirControl)
+	myControl.Stop()
+	theirControl.Stop()
+}
@@ -0,0 +1,15 @@
+// Package e2etest spins up nebula instances that talk over in-memory udp and tun devices so a mesh can be tested
+// without touching the network. Build with the e2e_testing tag, which swaps in the tester udp and tun implementations,
+// and use github.com/slackhq/nebula/e2e/router to move packets between the instances.
+//
+//	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(10*time.Minute), nil, nil, []string{})
+//	myControl, myVpnNets, _, _ := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "me", "10.128.0.1/24", nil)
+//	theirControl, theirVpnNets, theirUdp, _ := e2etest.NewSimpleServer(cert.Version2, ca, caKey, "them", "10.128.0.2/24", nil)
+//	myControl.InjectLightHouseAddr(theirVpnNets[0].Addr(), theirUdp)
+//
+//	r := router.NewR(t, myControl, theirControl)
+//	defer r.RenderFlow()
+//	myControl.Start()
+//	theirControl.Start()
+//	e2etest.AssertTunnel(t, myVpnNets[0].Addr(), theirVpnNets[0].Addr(), myControl, theirControl, r)
+package e2etest
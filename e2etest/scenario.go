@@ -0,0 +1,121 @@
+//go:build e2e_testing
+// +build e2e_testing
+
+package e2etest
+
+import (
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+
+	"dario.cat/mergo"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/e2e/router"
+	"go.yaml.in/yaml/v3"
+)
+
+// scenarioTick is how long packets are routed between checks for due steps and convergence
+const scenarioTick = 10 * time.Millisecond
+
+// Scenario scripts faults against a running mesh. Unlike the rest of the router helpers it runs in real time, packets
+// are routed continuously so nebula's own timers drive recovery and the time it takes can be asserted on.
+//
+//	s := e2etest.NewScenario(t, r).
+//		At(time.Second, "kill the lighthouse", e2etest.Kill(lhControl)).
+//		At(2*time.Second, "move them", e2etest.SetPublicAddr(r, theirControl, newAddr))
+//	took := s.Converge(10*time.Second, func() bool { ... })
+type Scenario struct {
+	t     testing.TB
+	r     *router.R
+	steps []scenarioStep
+}
+
+type scenarioStep struct {
+	at   time.Duration
+	name string
+	do   func()
+}
+
+// NewScenario returns an empty scenario that routes packets with r
+func NewScenario(t testing.TB, r *router.R) *Scenario {
+	return &Scenario{t: t, r: r}
+}
+
+// At schedules do to run at offset at from the start of Converge
+func (s *Scenario) At(at time.Duration, name string, do func()) *Scenario {
+	s.steps = append(s.steps, scenarioStep{at: at, name: name, do: do})
+	return s
+}
+
+// Converge routes packets for the whole mesh, running each step when it is due, until every step has run and cond
+// returns true. It fails the test if cond does not hold within the given time after the last step and returns how
+// long after the last step it took.
+func (s *Scenario) Converge(within time.Duration, cond func() bool) time.Duration {
+	s.t.Helper()
+	sort.SliceStable(s.steps, func(i, j int) bool { return s.steps[i].at < s.steps[j].at })
+
+	start := time.Now()
+	settled := start
+	next := 0
+	for {
+		for next < len(s.steps) && time.Since(start) >= s.steps[next].at {
+			step := s.steps[next]
+			s.r.Logf("T+%v %s", step.at, step.name)
+			step.do()
+			settled = time.Now()
+			next++
+		}
+
+		if next == len(s.steps) {
+			if cond() {
+				took := time.Since(settled)
+				s.r.Logf("Converged %v after the last step", took)
+				return took
+			}
+
+			if time.Since(settled) > within {
+				s.t.Fatalf("Scenario did not converge within %v of the last step", within)
+			}
+		}
+
+		s.r.RouteForAllFor(scenarioTick)
+	}
+}
+
+// Kill stops c, the router quietly drops anything sent to it afterward
+func Kill(c *nebula.Control) func() {
+	return func() {
+		c.Stop()
+	}
+}
+
+// SetPublicAddr changes the address c's packets appear to come from, see router.R.SetPublicAddr
+func SetPublicAddr(r *router.R, c *nebula.Control, addr netip.AddrPort) func() {
+	return func() {
+		r.SetPublicAddr(c, addr)
+	}
+}
+
+// Reload merges overrides over c and reloads it, for example to swap pki.ca for a new certificate authority
+func Reload(c *config.C, overrides M) func() {
+	return func() {
+		final := M{}
+		if err := mergo.Merge(&final, overrides); err != nil {
+			panic(err)
+		}
+		if err := mergo.Merge(&final, c.Settings); err != nil {
+			panic(err)
+		}
+
+		b, err := yaml.Marshal(final)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := c.ReloadConfigString(string(b)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package enroll
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clockLeeway is how far our clock may be from the provider's when checking token times
+const clockLeeway = time.Minute
+
+// Claims are the claims of a verified id token
+type Claims map[string]any
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// VerifyIDToken checks the signature of an id token against the keys of the provider, that the provider issued it to
+// our client, and that it is valid at now. Only RS256 and ES256 signatures are accepted.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, now time.Time) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the id token is not a signed jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("the id token header is invalid: %w", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("the id token signature is invalid: %w", err)
+	}
+
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, digest[:], sig); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("the id token claims are invalid: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("the id token was issued by %q, not %q", iss, p.Issuer)
+	}
+	if !claims.hasAudience(p.ClientID) {
+		return nil, errors.New("the id token was not issued to this client")
+	}
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, errors.New("the id token has no expiry")
+	}
+	if now.After(exp.Add(clockLeeway)) {
+		return nil, errors.New("the id token is expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(clockLeeway).Before(nbf) {
+		return nil, errors.New("the id token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+// signingKey returns the key with id kid from the provider, the only key if kid is empty
+func (p *Provider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.do(req, &set); err != nil {
+		return nil, fmt.Errorf("failed to get the provider keys: %w", err)
+	}
+
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if kid == "" || k.Kid == kid {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("the provider has no single key for key id %q", kid)
+	}
+	return keys[0].publicKey()
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("the rsa key %q is invalid: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("the rsa key %q has an invalid exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("the ec key %q uses the unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("the ec key %q is invalid: %w", k.Kid, err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("the ec key %q is invalid: %w", k.Kid, err)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("the ec key %q is not on its curve", k.Kid)
+		}
+		return pub, nil
+
+	default:
+		return nil, fmt.Errorf("the key %q has the unsupported type %q", k.Kid, k.Kty)
+	}
+}
+
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) error {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("the id token algorithm does not match the key")
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) != nil {
+			return errors.New("the id token signature is invalid")
+		}
+
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("the id token algorithm does not match the key")
+		}
+		// A jws ecdsa signature is r and s as fixed size big endian numbers
+		if len(sig) != 64 {
+			return errors.New("the id token signature is invalid")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("the id token signature is invalid")
+		}
+
+	default:
+		return fmt.Errorf("the id token algorithm %q is not supported", alg)
+	}
+	return nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (c Claims) hasAudience(aud string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == aud
+	case []any:
+		return slices.Contains(v, any(aud))
+	}
+	return false
+}
+
+// IssuedAt returns when the provider issued the token, if the token says
+func (c Claims) IssuedAt() (time.Time, bool) {
+	return c.time("iat")
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
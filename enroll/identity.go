@@ -0,0 +1,81 @@
+package enroll
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ClaimMapping turns the claims of an id token into the name and groups of a certificate
+type ClaimMapping struct {
+	// NameClaim holds the certificate name, email when empty
+	NameClaim string
+	// GroupsClaim holds the groups, a list of strings or a single string, groups when empty
+	GroupsClaim string
+	// GroupPrefix is put in front of every group, so groups from the provider can not pass for host groups
+	GroupPrefix string
+	// AllowedGroups are the only provider groups copied to the certificate, before GroupPrefix is added. When it is set
+	// a person in none of them is refused.
+	AllowedGroups []string
+}
+
+// Identity is who a certificate is issued to
+type Identity struct {
+	Name   string
+	Groups []string
+}
+
+// Identity returns who the claims say the certificate is for
+func (m ClaimMapping) Identity(c Claims) (Identity, error) {
+	nameClaim := m.NameClaim
+	if nameClaim == "" {
+		nameClaim = "email"
+	}
+	groupsClaim := m.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	name, _ := c[nameClaim].(string)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Identity{}, fmt.Errorf("the id token has no %s claim", nameClaim)
+	}
+
+	if nameClaim == "email" {
+		// Anyone can put an unverified address on an account with some providers
+		if verified, ok := c["email_verified"].(bool); ok && !verified {
+			return Identity{}, errors.New("the email address in the id token is not verified")
+		}
+	}
+
+	var raw []string
+	switch v := c[groupsClaim].(type) {
+	case string:
+		raw = []string{v}
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				raw = append(raw, s)
+			}
+		}
+	}
+
+	id := Identity{Name: name}
+	for _, g := range raw {
+		g = strings.TrimSpace(g)
+		if g == "" || (len(m.AllowedGroups) > 0 && !slices.Contains(m.AllowedGroups, g)) {
+			continue
+		}
+		id.Groups = append(id.Groups, m.GroupPrefix+g)
+	}
+	slices.Sort(id.Groups)
+	id.Groups = slices.Compact(id.Groups)
+
+	if len(m.AllowedGroups) > 0 && len(id.Groups) == 0 {
+		return Identity{}, fmt.Errorf("%s is not in any of the allowed groups", name)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,226 @@
+// Package enroll issues certificates to people instead of hosts. A person signs in with an OpenID Connect provider using
+// the device flow, which works from a terminal, and the verified id token says who they are and which groups they are
+// in. The resulting certificate is short lived, so access follows the identity provider.
+package enroll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// defaultPollInterval is what RFC 8628 says to use when the provider does not give an interval
+	defaultPollInterval = 5 * time.Second
+	// maxResponseLen bounds what we read from the provider
+	maxResponseLen = 1 << 20
+)
+
+var (
+	ErrAccessDenied = errors.New("the sign in was denied")
+	ErrExpired      = errors.New("the sign in was not completed in time")
+)
+
+// Provider is an OpenID Connect provider and the client registered with it for nebula
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Scopes are asked for along with openid, usually profile, email, and whatever makes the provider include groups
+	Scopes     []string
+	HTTPClient *http.Client
+
+	deviceEndpoint string
+	tokenEndpoint  string
+	jwksURI        string
+}
+
+// DeviceAuthorization is a started sign in. Show VerificationURI and UserCode, or VerificationURIComplete, to the person
+// and call Provider.PollToken.
+type DeviceAuthorization struct {
+	DeviceCode              string
+	UserCode                string
+	VerificationURI         string
+	VerificationURIComplete string
+	Expires                 time.Time
+	Interval                time.Duration
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Discover loads the endpoints of the provider from its openid-configuration
+func (p *Provider) Discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Issuer         string `json:"issuer"`
+		DeviceEndpoint string `json:"device_authorization_endpoint"`
+		TokenEndpoint  string `json:"token_endpoint"`
+		JWKSURI        string `json:"jwks_uri"`
+	}
+	if err := p.do(req, &doc); err != nil {
+		return fmt.Errorf("failed to discover the provider: %w", err)
+	}
+
+	if doc.Issuer != p.Issuer {
+		return fmt.Errorf("the provider says its issuer is %q, not %q", doc.Issuer, p.Issuer)
+	}
+	if doc.DeviceEndpoint == "" {
+		return errors.New("the provider does not support the device flow")
+	}
+	if doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("the provider configuration is missing the token endpoint or jwks uri")
+	}
+
+	p.deviceEndpoint = doc.DeviceEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.jwksURI = doc.JWKSURI
+	return nil
+}
+
+// StartDeviceFlow asks the provider for a code the person enters to sign in
+func (p *Provider) StartDeviceFlow(ctx context.Context) (*DeviceAuthorization, error) {
+	form := url.Values{
+		"client_id": {p.ClientID},
+		"scope":     {strings.Join(append([]string{"openid"}, p.Scopes...), " ")},
+	}
+
+	var resp struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if err := p.post(ctx, p.deviceEndpoint, form, &resp); err != nil {
+		return nil, fmt.Errorf("failed to start the device flow: %w", err)
+	}
+
+	if resp.DeviceCode == "" || resp.UserCode == "" || resp.VerificationURI == "" {
+		return nil, errors.New("the provider did not return a device code")
+	}
+
+	da := &DeviceAuthorization{
+		DeviceCode:              resp.DeviceCode,
+		UserCode:                resp.UserCode,
+		VerificationURI:         resp.VerificationURI,
+		VerificationURIComplete: resp.VerificationURIComplete,
+		Expires:                 time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+		Interval:                time.Duration(resp.Interval) * time.Second,
+	}
+	if da.Interval <= 0 {
+		da.Interval = defaultPollInterval
+	}
+	return da, nil
+}
+
+// PollToken waits for the person to finish signing in and returns the raw id token. Verify it with VerifyIDToken.
+func (p *Provider) PollToken(ctx context.Context, da *DeviceAuthorization) (string, error) {
+	form := url.Values{
+		"grant_type":  {deviceCodeGrantType},
+		"device_code": {da.DeviceCode},
+		"client_id":   {p.ClientID},
+	}
+	interval := da.Interval
+
+	for {
+		if time.Now().After(da.Expires) {
+			return "", ErrExpired
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var resp struct {
+			IDToken string `json:"id_token"`
+		}
+		err := p.post(ctx, p.tokenEndpoint, form, &resp)
+
+		var oe *oauthError
+		switch {
+		case err == nil:
+			if resp.IDToken == "" {
+				return "", errors.New("the provider did not return an id token, is the openid scope allowed for this client")
+			}
+			return resp.IDToken, nil
+		case errors.As(err, &oe) && oe.Code == "authorization_pending":
+		case errors.As(err, &oe) && oe.Code == "slow_down":
+			interval += 5 * time.Second
+		case errors.As(err, &oe) && oe.Code == "access_denied":
+			return "", ErrAccessDenied
+		case errors.As(err, &oe) && oe.Code == "expired_token":
+			return "", ErrExpired
+		default:
+			return "", fmt.Errorf("failed to get a token: %w", err)
+		}
+	}
+}
+
+// oauthError is an error response from the provider, RFC 6749 section 5.2
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+func (p *Provider) post(ctx context.Context, endpoint string, form url.Values, v any) error {
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return p.do(req, v)
+}
+
+func (p *Provider) do(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseLen))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		oe := &oauthError{}
+		if json.Unmarshal(body, oe) == nil && oe.Code != "" {
+			return oe
+		}
+		return fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+
+	return json.Unmarshal(body, v)
+}
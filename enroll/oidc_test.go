@@ -0,0 +1,193 @@
+package enroll
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProvider is an identity provider that lets a device code sign in after pending polls
+type testProvider struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	pending int
+	denied  bool
+	claims  map[string]any
+	alg     string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tp := &testProvider{rsaKey: rsaKey, ecKey: ecKey, alg: "RS256"}
+	mux := http.NewServeMux()
+	tp.Server = httptest.NewServer(mux)
+	t.Cleanup(tp.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                        tp.URL,
+			"device_authorization_endpoint": tp.URL + "/device",
+			"token_endpoint":                tp.URL + "/token",
+			"jwks_uri":                      tp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "nebula", r.FormValue("client_id"))
+		assert.Equal(t, "openid email groups", r.FormValue("scope"))
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "device-1",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": tp.URL + "/activate",
+			"expires_in":       60,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, deviceCodeGrantType, r.FormValue("grant_type"))
+		assert.Equal(t, "device-1", r.FormValue("device_code"))
+		switch {
+		case tp.denied:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"access_denied"}`))
+		case tp.pending > 0:
+			tp.pending--
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"authorization_pending"}`))
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"id_token": tp.sign(t, tp.claims)})
+		}
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]any{
+			{"kid": "rsa", "kty": "RSA", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+
+	return tp
+}
+
+func (tp *testProvider) sign(t *testing.T, claims map[string]any) string {
+	kid := "rsa"
+	if tp.alg == "ES256" {
+		kid = "ec"
+	}
+	header, err := json.Marshal(map[string]any{"alg": tp.alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if tp.alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, tp.ecKey, digest[:])
+		require.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, tp.rsaKey, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestProvider_deviceFlow(t *testing.T) {
+	tp := newTestProvider(t)
+	now := time.Now()
+	tp.pending = 2
+	tp.claims = map[string]any{
+		"iss":    tp.URL,
+		"aud":    []any{"nebula", "other"},
+		"exp":    now.Add(time.Hour).Unix(),
+		"email":  "ada@example.com",
+		"groups": []any{"eng", "ops"},
+	}
+
+	ctx := context.Background()
+	p := &Provider{Issuer: tp.URL, ClientID: "nebula", Scopes: []string{"email", "groups"}}
+	require.NoError(t, p.Discover(ctx))
+
+	da, err := p.StartDeviceFlow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "ABCD-EFGH", da.UserCode)
+	assert.Equal(t, defaultPollInterval, da.Interval)
+
+	da.Interval = time.Millisecond
+	raw, err := p.PollToken(ctx, da)
+	require.NoError(t, err)
+	assert.Zero(t, tp.pending)
+
+	claims, err := p.VerifyIDToken(ctx, raw, now)
+	require.NoError(t, err)
+	assert.Equal(t, "ada@example.com", claims["email"])
+
+	// Tokens that are expired, for someone else, or tampered with are refused
+	_, err = p.VerifyIDToken(ctx, raw, now.Add(2*time.Hour))
+	require.EqualError(t, err, "the id token is expired")
+
+	other := &Provider{Issuer: tp.URL, ClientID: "someone-else", jwksURI: p.jwksURI}
+	_, err = other.VerifyIDToken(ctx, raw, now)
+	require.EqualError(t, err, "the id token was not issued to this client")
+
+	tp.claims["email"] = "mallory@example.com"
+	rawParts := strings.Split(raw, ".")
+	forgedParts := strings.Split(tp.sign(t, tp.claims), ".")
+	_, err = p.VerifyIDToken(ctx, rawParts[0]+"."+forgedParts[1]+"."+rawParts[2], now)
+	require.EqualError(t, err, "the id token signature is invalid")
+
+	// ES256 works as well
+	tp.alg = "ES256"
+	claims, err = p.VerifyIDToken(ctx, tp.sign(t, tp.claims), now)
+	require.NoError(t, err)
+	assert.Equal(t, "mallory@example.com", claims["email"])
+
+	// And a denied sign in stops the polling
+	tp.denied = true
+	_, err = p.PollToken(ctx, da)
+	require.ErrorIs(t, err, ErrAccessDenied)
+}
+
+func TestClaimMapping_Identity(t *testing.T) {
+	claims := Claims{"email": "ada@example.com", "email_verified": true, "groups": []any{"ops", "eng", "ops"}}
+
+	id, err := ClaimMapping{}.Identity(claims)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Name: "ada@example.com", Groups: []string{"eng", "ops"}}, id)
+
+	id, err = ClaimMapping{GroupPrefix: "sso:", AllowedGroups: []string{"ops"}}.Identity(claims)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sso:ops"}, id.Groups)
+
+	_, err = ClaimMapping{AllowedGroups: []string{"admins"}}.Identity(claims)
+	require.EqualError(t, err, "ada@example.com is not in any of the allowed groups")
+
+	id, err = ClaimMapping{NameClaim: "preferred_username", GroupsClaim: "role"}.Identity(Claims{"preferred_username": "ada", "role": "dba"})
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Name: "ada", Groups: []string{"dba"}}, id)
+
+	_, err = ClaimMapping{}.Identity(Claims{"sub": "1234"})
+	require.EqualError(t, err, "the id token has no email claim")
+
+	_, err = ClaimMapping{}.Identity(Claims{"email": "ada@example.com", "email_verified": false})
+	require.EqualError(t, err, "the email address in the id token is not verified")
+}
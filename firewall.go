@@ -26,6 +26,25 @@ type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, cidr, localCidr string, caName string, caSha string) error
 }
 
+// firewallRuleSource contributes rules for addresses this host routes on behalf of others, such as pods or wireguard
+// peers. Sources are consulted every time the firewall is rebuilt.
+type firewallRuleSource interface {
+	addFirewallRules(fw FirewallInterface) error
+}
+
+// addLocalGroupRules allows inbound traffic to addr from hosts in any of groups. A single rule requires every group,
+// so each group gets its own rule.
+func addLocalGroupRules(fw FirewallInterface, addr netip.Addr, groups []string) error {
+	local := netip.PrefixFrom(addr, addr.BitLen()).String()
+	for _, g := range groups {
+		err := fw.AddRule(true, firewall.ProtoAny, firewall.PortAny, firewall.PortAny, []string{g}, "", "", local, "", "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type conn struct {
 	Expires time.Time // Time when this conntrack entry will expire
 
@@ -57,12 +76,19 @@ type Firewall struct {
 	routableNetworks *bart.Lite
 
 	// assignedNetworks is a list of vpn networks assigned to us in the certificate.
-	assignedNetworks  []netip.Prefix
+	assignedNetworks []netip.Prefix
+	// unsafeNetworks is a list of unsafe networks assigned to us in the certificate, the networks we route for.
+	unsafeNetworks    []netip.Prefix
 	hasUnsafeNetworks bool
 
 	rules        string
 	rulesVersion uint16
 
+	// inRuleSpecs and flowLog are used to tell which rule accepted an inbound flow, see flow_log.go
+	inRuleSpecs     []firewallRuleSpec
+	inRuleSpecsOnce sync.Once
+	flowLog         *flowLog
+
 	defaultLocalCIDRAny bool
 	incomingMetrics     firewallMetrics
 	outgoingMetrics     firewallMetrics
@@ -158,8 +184,10 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 	}
 
 	hasUnsafeNetworks := false
+	var unsafeNetworks []netip.Prefix
 	for _, n := range c.UnsafeNetworks() {
 		routableNetworks.Insert(n)
+		unsafeNetworks = append(unsafeNetworks, n)
 		hasUnsafeNetworks = true
 	}
 
@@ -175,6 +203,7 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		DefaultTimeout:    defaultTimeout,
 		routableNetworks:  routableNetworks,
 		assignedNetworks:  assignedNetworks,
+		unsafeNetworks:    unsafeNetworks,
 		hasUnsafeNetworks: hasUnsafeNetworks,
 		l:                 l,
 
@@ -263,17 +292,32 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "cidr": cidr, "localCidr": localCidr, "caName": caName, "caSha": caSha}).
 		Info("Firewall rule added")
 
-	var (
-		ft *FirewallTable
-		fp firewallPort
-	)
+	switch localCidr {
+	case "", "any", "vpn":
+	case "unsafe":
+		if !f.hasUnsafeNetworks {
+			f.l.WithField("localCidr", localCidr).Warn("Firewall rule will never match, our certificate has no unsafe networks")
+		}
+	default:
+		if network, err := netip.ParsePrefix(localCidr); err == nil && !f.isLocalNetwork(network) {
+			f.l.WithField("localCidr", localCidr).Warn("Firewall rule will never match, local_cidr is not within our vpn or unsafe networks")
+		}
+	}
 
+	ft := f.OutRules
 	if incoming {
 		ft = f.InRules
-	} else {
-		ft = f.OutRules
+		f.inRuleSpecs = append(f.inRuleSpecs, firewallRuleSpec{
+			proto: proto, startPort: startPort, endPort: endPort, groups: groups, host: host,
+			cidr: cidr, localCidr: localCidr, caName: caName, caSha: caSha,
+		})
 	}
 
+	return ft.addRule(f, proto, startPort, endPort, groups, host, cidr, localCidr, caName, caSha)
+}
+
+func (ft *FirewallTable) addRule(f *Firewall, proto uint8, startPort int32, endPort int32, groups []string, host string, cidr, localCidr, caName string, caSha string) error {
+	var fp firewallPort
 	switch proto {
 	case firewall.ProtoTCP:
 		fp = ft.TCP
@@ -375,7 +419,9 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, c *config.C, fw
 			}
 		}
 
-		if r.LocalCidr != "" && r.LocalCidr != "any" {
+		switch r.LocalCidr {
+		case "", "any", "vpn", "unsafe":
+		default:
 			_, err = netip.ParsePrefix(r.LocalCidr)
 			if err != nil {
 				return fmt.Errorf("%s rule #%v; local_cidr did not parse; %s", table, i, err)
@@ -404,13 +450,25 @@ var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
+	return f.drop(fp, incoming, false, h, caPool, localCache)
+}
+
+// DropBroadcast is Drop for a packet to a broadcast or multicast address of the broadcast domain. That address is
+// neither ours nor in the peer's certificate so it is left out of the address checks, the rules still apply.
+func (f *Firewall) DropBroadcast(fp firewall.Packet, incoming bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
+	return f.drop(fp, incoming, true, h, caPool, localCache)
+}
+
+func (f *Firewall) drop(fp firewall.Packet, incoming, broadcast bool, h *HostInfo, caPool *cert.CAPool, localCache firewall.ConntrackCache) error {
 	// Check if we spoke to this tuple, if we did then allow this packet
 	if f.inConns(fp, h, caPool, localCache) {
 		return nil
 	}
 
 	// Make sure remote address matches nebula certificate, and determine how to treat it
-	if h.networks == nil {
+	if broadcast && !incoming {
+		// The remote is the broadcast address
+	} else if h.networks == nil {
 		// Simple case: Certificate has one address and no unsafe networks
 		if h.vpnAddrs[0] != fp.RemoteAddr {
 			f.metrics(incoming).droppedRemoteAddr.Inc(1)
@@ -436,8 +494,8 @@ func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *
 		}
 	}
 
-	// Make sure we are supposed to be handling this local ip address
-	if !f.routableNetworks.Contains(fp.LocalAddr) {
+	// Make sure we are supposed to be handling this local ip address, unless it is the broadcast address
+	if !(broadcast && incoming) && !f.routableNetworks.Contains(fp.LocalAddr) {
 		f.metrics(incoming).droppedLocalAddr.Inc(1)
 		return ErrInvalidLocalIP
 	}
@@ -456,6 +514,10 @@ func (f *Firewall) Drop(fp firewall.Packet, incoming bool, h *HostInfo, caPool *
 	// We always want to conntrack since it is a faster operation
 	f.addConn(fp, incoming)
 
+	if incoming && f.flowLog.wanted() {
+		f.logFlow(fp, h, caPool)
+	}
+
 	return nil
 }
 
@@ -867,9 +929,24 @@ func (fr *FirewallRule) match(p firewall.Packet, c *cert.CachedCertificate) bool
 }
 
 func (flc *firewallLocalCIDR) addRule(f *Firewall, localCidr string) error {
-	if localCidr == "any" {
+	switch localCidr {
+	case "any":
 		flc.Any = true
 		return nil
+
+	case "vpn":
+		// Only traffic for us, never the networks we route for, regardless of default_local_cidr_any
+		for _, network := range f.assignedNetworks {
+			flc.LocalCIDR.Insert(network)
+		}
+		return nil
+
+	case "unsafe":
+		// Only traffic we route for, any of the unsafe networks in our certificate
+		for _, network := range f.unsafeNetworks {
+			flc.LocalCIDR.Insert(network)
+		}
+		return nil
 	}
 
 	if localCidr == "" {
@@ -893,6 +970,21 @@ func (flc *firewallLocalCIDR) addRule(f *Firewall, localCidr string) error {
 	return nil
 }
 
+// isLocalNetwork reports whether any part of network is one of our vpn networks or one of the unsafe networks we route
+func (f *Firewall) isLocalNetwork(network netip.Prefix) bool {
+	for _, n := range f.assignedNetworks {
+		if n.Overlaps(network) {
+			return true
+		}
+	}
+	for _, n := range f.unsafeNetworks {
+		if n.Overlaps(network) {
+			return true
+		}
+	}
+	return false
+}
+
 func (flc *firewallLocalCIDR) match(p firewall.Packet, c *cert.CachedCertificate) bool {
 	if flc == nil {
 		return false
@@ -780,6 +780,83 @@ func TestFirewall_DropIPSpoofing(t *testing.T) {
 	assert.Equal(t, fw.Drop(p, true, &h1, cp, nil), ErrInvalidRemoteIP)
 }
 
+func TestFirewall_LocalCidrScopes(t *testing.T) {
+	l := test.NewLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(netip.MustParsePrefix("10.0.0.1/24"))
+
+	// A gateway routing two lans
+	gateway := dummyCert{
+		name:     "gateway",
+		networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")},
+		unsafeNetworks: []netip.Prefix{
+			netip.MustParsePrefix("192.168.1.0/24"),
+			netip.MustParsePrefix("192.168.2.0/24"),
+		},
+	}
+
+	peer := dummyCert{
+		name:     "laptop",
+		networks: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{Certificate: &peer},
+		},
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+	}
+	h.buildNetworks(myVpnNetworksTable, &peer)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &gateway)
+	fw.defaultLocalCIDRAny = true
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 22, 22, []string{"any"}, "", "", "vpn", "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 80, 80, []string{"any"}, "", "", "192.168.1.0/24", "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 443, 443, []string{"any"}, "", "", "unsafe", "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 53, 53, []string{"any"}, "", "", "", "", ""))
+	cp := cert.NewCAPool()
+
+	drop := func(local string, port uint16) error {
+		resetConntrack(fw)
+		return fw.Drop(firewall.Packet{
+			LocalAddr:  netip.MustParseAddr(local),
+			RemoteAddr: netip.MustParseAddr("10.0.0.2"),
+			LocalPort:  port,
+			RemotePort: 40000,
+			Protocol:   firewall.ProtoTCP,
+		}, true, &h, cp, nil)
+	}
+
+	// vpn only reaches the gateway itself, even with default_local_cidr_any
+	require.NoError(t, drop("10.0.0.1", 22))
+	assert.Equal(t, ErrNoMatchingRule, drop("192.168.1.5", 22))
+
+	// One lan out of the two routed
+	require.NoError(t, drop("192.168.1.5", 80))
+	assert.Equal(t, ErrNoMatchingRule, drop("192.168.2.5", 80))
+	assert.Equal(t, ErrNoMatchingRule, drop("10.0.0.1", 80))
+
+	// unsafe reaches every routed lan but not the gateway
+	require.NoError(t, drop("192.168.1.5", 443))
+	require.NoError(t, drop("192.168.2.5", 443))
+	assert.Equal(t, ErrNoMatchingRule, drop("10.0.0.1", 443))
+
+	// No local_cidr still follows default_local_cidr_any
+	require.NoError(t, drop("10.0.0.1", 53))
+	require.NoError(t, drop("192.168.2.5", 53))
+
+	// Rules that can never match are called out
+	ob.Reset()
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 80, 80, []string{"any"}, "", "", "172.16.0.0/24", "", ""))
+	assert.Contains(t, ob.String(), "local_cidr is not within our vpn or unsafe networks")
+
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &peer)
+	ob.Reset()
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 80, 80, []string{"any"}, "", "", "unsafe", "", ""))
+	assert.Contains(t, ob.String(), "our certificate has no unsafe networks")
+}
+
 func BenchmarkLookup(b *testing.B) {
 	ml := func(m map[string]struct{}, a [][]string) {
 		for n := 0; n < b.N; n++ {
@@ -0,0 +1,332 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+)
+
+// With firewall.flow_log enabled every new inbound flow the firewall accepts is recorded along with the peer that sent
+// it and the rule that let it in. Seeing which rules are used, by whom, and for what is the first step to replacing
+// broad rules with the ones that are actually needed. Flows are handed off to a goroutine so a slow file or subscriber
+// never holds up the packet path, when it falls behind flows are dropped and counted.
+
+// flowLogQueue is how many flows can wait to be written before we start dropping them
+const flowLogQueue = 1024
+
+// FlowRule is the firewall rule that accepted a flow, in the same terms as the firewall config
+type FlowRule struct {
+	Port      string   `json:"port"`
+	Proto     string   `json:"proto"`
+	Host      string   `json:"host,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Cidr      string   `json:"cidr,omitempty"`
+	LocalCidr string   `json:"localCidr,omitempty"`
+	CAName    string   `json:"caName,omitempty"`
+	CASha     string   `json:"caSha,omitempty"`
+}
+
+func (r *FlowRule) String() string {
+	if r == nil {
+		return "none"
+	}
+
+	s := "port: " + r.Port + ", proto: " + r.Proto
+	if r.Host != "" {
+		s += ", host: " + r.Host
+	}
+	if len(r.Groups) > 0 {
+		s += fmt.Sprintf(", groups: %v", r.Groups)
+	}
+	if r.Cidr != "" {
+		s += ", cidr: " + r.Cidr
+	}
+	if r.LocalCidr != "" {
+		s += ", local_cidr: " + r.LocalCidr
+	}
+	if r.CAName != "" {
+		s += ", ca_name: " + r.CAName
+	}
+	if r.CASha != "" {
+		s += ", ca_sha: " + r.CASha
+	}
+	return s
+}
+
+// FlowEvent is a new inbound flow accepted by the firewall
+type FlowEvent struct {
+	Time            time.Time    `json:"time"`
+	PeerName        string       `json:"peerName"`
+	PeerVpnAddrs    []netip.Addr `json:"peerVpnAddrs"`
+	PeerGroups      []string     `json:"peerGroups"`
+	PeerFingerprint string       `json:"peerFingerprint"`
+	Proto           string       `json:"proto"`
+	LocalAddr       netip.Addr   `json:"localAddr"`
+	LocalPort       uint16       `json:"localPort"`
+	RemoteAddr      netip.Addr   `json:"remoteAddr"`
+	RemotePort      uint16       `json:"remotePort"`
+	// Rule is nil if no single rule matched the flow, which should not happen
+	Rule *FlowRule `json:"rule"`
+}
+
+// firewallRuleSpec is an inbound rule as it was given to AddRule, flows are matched against each rule on its own to
+// find the one that accepted them
+type firewallRuleSpec struct {
+	proto                                uint8
+	startPort, endPort                   int32
+	groups                               []string
+	host, cidr, localCidr, caName, caSha string
+	table                                *FirewallTable
+}
+
+type flowLog struct {
+	l      *logrus.Logger
+	events chan FlowEvent
+
+	sync.RWMutex
+	enabled     bool
+	file        *os.File
+	path        string
+	subscribers map[int]func(FlowEvent)
+	nextSub     int
+
+	dropped metrics.Counter
+}
+
+func newFlowLogFromConfig(ctx context.Context, l *logrus.Logger, c *config.C) (*flowLog, error) {
+	fl := &flowLog{
+		l:           l,
+		events:      make(chan FlowEvent, flowLogQueue),
+		subscribers: map[int]func(FlowEvent){},
+		dropped:     metrics.GetOrRegisterCounter("firewall.flow_log.dropped", nil),
+	}
+
+	if err := fl.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := fl.reload(c, false); err != nil {
+			l.WithError(err).Error("Failed to reload firewall.flow_log")
+		}
+	})
+
+	go fl.run(ctx)
+	return fl, nil
+}
+
+func (fl *flowLog) reload(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("firewall.flow_log") {
+		return nil
+	}
+
+	enabled := c.GetBool("firewall.flow_log.enabled", false)
+	path := c.GetString("firewall.flow_log.file", "")
+
+	var file *os.File
+	if enabled && path != "" {
+		var err error
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open firewall.flow_log.file: %w", err)
+		}
+	}
+
+	fl.Lock()
+	old := fl.file
+	fl.enabled = enabled
+	fl.file = file
+	fl.path = path
+	fl.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+
+	if enabled {
+		fl.l.WithField("file", path).Info("Logging accepted inbound flows")
+	}
+	return nil
+}
+
+// subscribe calls cb with every flow we log, even when firewall.flow_log.enabled is false, until the returned func is
+// called
+func (fl *flowLog) subscribe(cb func(FlowEvent)) func() {
+	fl.Lock()
+	defer fl.Unlock()
+	id := fl.nextSub
+	fl.nextSub++
+	fl.subscribers[id] = cb
+
+	return func() {
+		fl.Lock()
+		delete(fl.subscribers, id)
+		fl.Unlock()
+	}
+}
+
+// wanted reports whether anyone is interested in flows, it is safe to call on a nil flowLog
+func (fl *flowLog) wanted() bool {
+	if fl == nil {
+		return false
+	}
+
+	fl.RLock()
+	defer fl.RUnlock()
+	return fl.enabled || len(fl.subscribers) > 0
+}
+
+// add queues e without blocking
+func (fl *flowLog) add(e FlowEvent) {
+	select {
+	case fl.events <- e:
+	default:
+		fl.dropped.Inc(1)
+	}
+}
+
+func (fl *flowLog) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			fl.Lock()
+			if fl.file != nil {
+				_ = fl.file.Close()
+				fl.file = nil
+			}
+			fl.Unlock()
+			return
+
+		case e := <-fl.events:
+			fl.write(e)
+		}
+	}
+}
+
+func (fl *flowLog) write(e FlowEvent) {
+	fl.RLock()
+	if fl.enabled {
+		if fl.file != nil {
+			b, err := json.Marshal(e)
+			if err == nil {
+				_, err = fl.file.Write(append(b, '\n'))
+			}
+			if err != nil {
+				fl.l.WithError(err).WithField("file", fl.path).Error("Failed to write to firewall.flow_log.file")
+			}
+		} else {
+			fl.l.WithFields(logrus.Fields{
+				"peerName":   e.PeerName,
+				"peerGroups": e.PeerGroups,
+				"proto":      e.Proto,
+				"localAddr":  e.LocalAddr,
+				"localPort":  e.LocalPort,
+				"remoteAddr": e.RemoteAddr,
+				"rule":       e.Rule.String(),
+			}).Info("Accepted inbound flow")
+		}
+	}
+
+	subscribers := make([]func(FlowEvent), 0, len(fl.subscribers))
+	for _, cb := range fl.subscribers {
+		subscribers = append(subscribers, cb)
+	}
+	fl.RUnlock()
+
+	// Subscribers are called without the lock so they can subscribe and unsubscribe
+	for _, cb := range subscribers {
+		cb(e)
+	}
+}
+
+// flowRule describes the rule the way it would be written in the firewall config
+func (s *firewallRuleSpec) flowRule() *FlowRule {
+	return &FlowRule{
+		Port:      portString(s.startPort, s.endPort),
+		Proto:     protoString(s.proto),
+		Host:      s.host,
+		Groups:    s.groups,
+		Cidr:      s.cidr,
+		LocalCidr: s.localCidr,
+		CAName:    s.caName,
+		CASha:     s.caSha,
+	}
+}
+
+func portString(startPort, endPort int32) string {
+	switch {
+	case startPort == firewall.PortAny:
+		return "any"
+	case startPort == firewall.PortFragment:
+		return "fragment"
+	case startPort == endPort:
+		return strconv.Itoa(int(startPort))
+	default:
+		return fmt.Sprintf("%d-%d", startPort, endPort)
+	}
+}
+
+func protoString(proto uint8) string {
+	switch proto {
+	case firewall.ProtoAny:
+		return "any"
+	case firewall.ProtoTCP:
+		return "tcp"
+	case firewall.ProtoUDP:
+		return "udp"
+	case firewall.ProtoICMP, firewall.ProtoICMPv6:
+		return "icmp"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// logFlow records a new inbound flow that was accepted from h
+func (f *Firewall) logFlow(fp firewall.Packet, h *HostInfo, caPool *cert.CAPool) {
+	peer := h.ConnectionState.peerCert
+	e := FlowEvent{
+		Time:            time.Now(),
+		PeerName:        peer.Certificate.Name(),
+		PeerVpnAddrs:    h.vpnAddrs,
+		PeerGroups:      peer.Certificate.Groups(),
+		PeerFingerprint: peer.Fingerprint,
+		Proto:           protoString(fp.Protocol),
+		LocalAddr:       fp.LocalAddr,
+		LocalPort:       fp.LocalPort,
+		RemoteAddr:      fp.RemoteAddr,
+		RemotePort:      fp.RemotePort,
+	}
+
+	f.inRuleSpecsOnce.Do(f.buildInRuleSpecs)
+	for i := range f.inRuleSpecs {
+		if f.inRuleSpecs[i].table.match(fp, true, peer, caPool) {
+			e.Rule = f.inRuleSpecs[i].flowRule()
+			break
+		}
+	}
+
+	f.flowLog.add(e)
+}
+
+// buildInRuleSpecs gives every inbound rule a table of its own, this is put off until the first flow is logged since
+// rules with large port ranges are costly
+func (f *Firewall) buildInRuleSpecs() {
+	for i := range f.inRuleSpecs {
+		s := &f.inRuleSpecs[i]
+		s.table = newFirewallTable()
+		if err := s.table.addRule(f, s.proto, s.startPort, s.endPort, s.groups, s.host, s.cidr, s.localCidr, s.caName, s.caSha); err != nil {
+			f.l.WithError(err).Error("Failed to build a firewall rule for the flow log")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowLog(t *testing.T) {
+	l := test.NewLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "flows.json")
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("firewall:\n  flow_log:\n    enabled: true\n    file: "+path))
+	fl, err := newFlowLogFromConfig(ctx, l, c)
+	require.NoError(t, err)
+
+	events := make(chan FlowEvent, 10)
+	fl.subscribe(func(e FlowEvent) { events <- e })
+
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(netip.MustParsePrefix("1.1.1.1/8"))
+	dc := dummyCert{
+		name:     "host1",
+		networks: []netip.Prefix{netip.MustParsePrefix("1.2.3.4/24")},
+		groups:   []string{"web"},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{
+				Certificate:    &dc,
+				InvertedGroups: map[string]struct{}{"web": {}},
+				Fingerprint:    "abc",
+			},
+		},
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("1.2.3.4")},
+	}
+	h.buildNetworks(myVpnNetworksTable, &dc)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &dc)
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 22, 22, []string{"admin"}, "", "", "", "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoTCP, 80, 443, []string{"web"}, "", "", "", "", ""))
+	require.NoError(t, fw.AddRule(true, firewall.ProtoAny, 0, 0, nil, "host1", "", "", "", ""))
+	require.NoError(t, fw.AddRule(false, firewall.ProtoAny, 0, 0, nil, "any", "", "", "", ""))
+	fw.flowLog = fl
+	cp := cert.NewCAPool()
+
+	p := firewall.Packet{
+		LocalAddr:  netip.MustParseAddr("1.2.3.4"),
+		RemoteAddr: netip.MustParseAddr("1.2.3.4"),
+		LocalPort:  443,
+		RemotePort: 50000,
+		Protocol:   firewall.ProtoTCP,
+	}
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	e := <-events
+	assert.Equal(t, "host1", e.PeerName)
+	assert.Equal(t, "abc", e.PeerFingerprint)
+	assert.Equal(t, []string{"web"}, e.PeerGroups)
+	assert.Equal(t, "tcp", e.Proto)
+	assert.Equal(t, uint16(443), e.LocalPort)
+	assert.Equal(t, &FlowRule{Port: "80-443", Proto: "tcp", Groups: []string{"web"}}, e.Rule)
+
+	// The same flow again is in conntrack and is not logged twice
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+
+	// The first rule that matches wins
+	p.Protocol = firewall.ProtoUDP
+	p.LocalPort = 53
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	e = <-events
+	assert.Equal(t, &FlowRule{Port: "any", Proto: "any", Host: "host1"}, e.Rule)
+
+	// Outbound flows are not logged
+	p.LocalPort = 54
+	require.NoError(t, fw.Drop(p, false, &h, cp, nil))
+	select {
+	case e = <-events:
+		t.Fatalf("unexpected flow %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+	var got FlowEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &got))
+	assert.Equal(t, "host1", got.PeerName)
+	assert.Equal(t, "80-443", got.Rule.Port)
+
+	// Turning it off stops the file but not the subscribers
+	require.NoError(t, c.ReloadConfigString("firewall:\n  flow_log:\n    enabled: false"))
+	p.LocalPort = 55
+	require.NoError(t, fw.Drop(p, true, &h, cp, nil))
+	<-events
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(b)), "\n"), 2)
+}
@@ -0,0 +1,276 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/groupset"
+)
+
+// groupSetsInterval is how often the sets are checked against the tunnels we have
+const groupSetsInterval = time.Second
+
+// groupSets keeps a host firewall set per group in group_sets.groups filled with the vpn addresses of the peers in that
+// group we have a tunnel with
+type groupSets struct {
+	l       *logrus.Logger
+	hostMap *HostMap
+
+	sync.Mutex
+	cfg *groupSetsConfig
+	// last is what the sets were synced to, nil when they must be synced on the next check
+	last    []groupset.Set
+	failing bool
+	started bool
+}
+
+type groupSetsConfig struct {
+	set    groupset.Config
+	prefix string
+	groups []string
+}
+
+func newGroupSetsFromConfig(l *logrus.Logger, c *config.C, hostMap *HostMap) (*groupSets, error) {
+	g := &groupSets{l: l, hostMap: hostMap}
+
+	cfg, err := parseGroupSets(c)
+	if err != nil {
+		return nil, err
+	}
+	g.cfg = cfg
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if !c.HasChanged("group_sets") {
+			return
+		}
+
+		cfg, err := parseGroupSets(c)
+		if err != nil {
+			g.l.WithError(err).Error("Failed to reload group_sets, keeping the previous settings")
+			return
+		}
+
+		g.Lock()
+		defer g.Unlock()
+		if g.started {
+			// Sets we no longer fill would otherwise keep the peers they had forever
+			g.flush(g.cfg, cfg)
+		}
+		g.cfg = cfg
+		g.last = nil
+		g.failing = false
+	})
+
+	return g, nil
+}
+
+// parseGroupSets returns nil when group_sets is disabled
+func parseGroupSets(c *config.C) (*groupSetsConfig, error) {
+	if !c.GetBool("group_sets.enabled", false) {
+		return nil, nil
+	}
+
+	cfg := &groupSetsConfig{
+		set: groupset.Config{
+			Backend: c.GetString("group_sets.backend", groupset.BackendNftables),
+			Family:  c.GetString("group_sets.family", "inet"),
+			Table:   c.GetString("group_sets.table", "nebula"),
+		},
+		prefix: c.GetString("group_sets.prefix", "nebula_"),
+		groups: c.GetStringSlice("group_sets.groups", []string{}),
+	}
+
+	switch cfg.set.Backend {
+	case groupset.BackendNftables:
+		switch cfg.set.Family {
+		case "inet", "ip", "ip6", "bridge", "netdev":
+		default:
+			return nil, fmt.Errorf("group_sets.family %q is not an nftables family", cfg.set.Family)
+		}
+		if err := groupset.CheckName(cfg.set, cfg.set.Table); err != nil {
+			return nil, fmt.Errorf("group_sets.table is invalid: %w", err)
+		}
+	case groupset.BackendIpset:
+	default:
+		return nil, fmt.Errorf("group_sets.backend must be %s or %s", groupset.BackendNftables, groupset.BackendIpset)
+	}
+
+	if len(cfg.groups) == 0 {
+		return nil, errors.New("group_sets.groups must list at least one group")
+	}
+
+	for _, group := range cfg.groups {
+		v4, v6 := cfg.setNames(group)
+		for _, name := range []string{v4, v6} {
+			if err := groupset.CheckName(cfg.set, name); err != nil {
+				return nil, fmt.Errorf("group %q in group_sets.groups can not be a set name: %w", group, err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// setNames returns the names of the ipv4 and ipv6 sets for group. Characters that can not be in a set name are
+// replaced with an underscore.
+func (cfg *groupSetsConfig) setNames(group string) (string, string) {
+	name := cfg.prefix + strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, group)
+	return name, name + "_v6"
+}
+
+// contents returns what every set should hold right now
+func (cfg *groupSetsConfig) contents(hm *HostMap) []groupset.Set {
+	members := map[string][]netip.Addr{}
+
+	hm.RLock()
+	// A peer with addresses from more than one network is in Hosts more than once
+	seen := map[*HostInfo]struct{}{}
+	for _, h := range hm.Hosts {
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+
+		c := h.GetCert()
+		if c == nil {
+			continue
+		}
+		for _, group := range c.Certificate.Groups() {
+			if slices.Contains(cfg.groups, group) {
+				members[group] = append(members[group], h.vpnAddrs...)
+			}
+		}
+	}
+	hm.RUnlock()
+
+	sets := make([]groupset.Set, 0, len(cfg.groups)*2)
+	for _, group := range cfg.groups {
+		v4Name, v6Name := cfg.setNames(group)
+		v4 := groupset.Set{Name: v4Name}
+		v6 := groupset.Set{Name: v6Name, V6: true}
+		for _, addr := range members[group] {
+			if addr.Is4() {
+				v4.Addrs = append(v4.Addrs, addr)
+			} else {
+				v6.Addrs = append(v6.Addrs, addr)
+			}
+		}
+		slices.SortFunc(v4.Addrs, netip.Addr.Compare)
+		slices.SortFunc(v6.Addrs, netip.Addr.Compare)
+		v4.Addrs = slices.Compact(v4.Addrs)
+		v6.Addrs = slices.Compact(v6.Addrs)
+		sets = append(sets, v4, v6)
+	}
+	return sets
+}
+
+// sync brings the sets up to date if the tunnels changed since the last time, the lock must be held
+func (g *groupSets) sync() {
+	if g.cfg == nil {
+		return
+	}
+
+	sets := g.cfg.contents(g.hostMap)
+	if g.last != nil && slices.EqualFunc(sets, g.last, groupSetEqual) {
+		return
+	}
+
+	if err := groupset.Sync(g.cfg.set, sets); err != nil {
+		// Log once, not every check
+		if !g.failing {
+			if errors.Is(err, groupset.ErrNotSupported) {
+				g.l.Warn("group_sets is not supported on this platform")
+			} else {
+				g.l.WithError(err).Error("Failed to update group sets")
+			}
+		}
+		g.failing = true
+		g.last = nil
+		return
+	}
+
+	if g.failing {
+		g.l.Info("Group sets are being updated again")
+	}
+	g.failing = false
+	g.last = sets
+}
+
+// flush empties the sets old fills that new does not, new may be nil to empty all of them. The lock must be held.
+func (g *groupSets) flush(old, new *groupSetsConfig) {
+	if old == nil {
+		return
+	}
+
+	var empty []groupset.Set
+	for _, group := range old.groups {
+		v4, v6 := old.setNames(group)
+		if new != nil && new.set == old.set && new.prefix == old.prefix && slices.Contains(new.groups, group) {
+			continue
+		}
+		empty = append(empty, groupset.Set{Name: v4}, groupset.Set{Name: v6, V6: true})
+	}
+
+	if err := groupset.Sync(old.set, empty); err != nil && !errors.Is(err, groupset.ErrNotSupported) {
+		g.l.WithError(err).Error("Failed to empty group sets")
+	}
+}
+
+func groupSetEqual(a, b groupset.Set) bool {
+	return a.Name == b.Name && a.V6 == b.V6 && slices.Equal(a.Addrs, b.Addrs)
+}
+
+// Start keeps the sets up to date until ctx is done
+func (g *groupSets) Start(ctx context.Context) {
+	g.Lock()
+	if ctx.Err() != nil {
+		// Stopped before we got going
+		g.Unlock()
+		return
+	}
+	g.started = true
+	g.sync()
+	g.Unlock()
+
+	ticker := time.NewTicker(groupSetsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.Lock()
+			if g.started {
+				g.sync()
+			}
+			g.Unlock()
+		}
+	}
+}
+
+// Stop empties the sets, we have no tunnels once nebula is gone
+func (g *groupSets) Stop() {
+	g.Lock()
+	defer g.Unlock()
+	if !g.started {
+		return
+	}
+
+	g.started = false
+	g.flush(g.cfg, nil)
+	g.last = nil
+}
@@ -0,0 +1,75 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/groupset"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGroupSets(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	cfg, err := parseGroupSets(c)
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	c.Settings["group_sets"] = map[string]any{"enabled": true}
+	_, err = parseGroupSets(c)
+	require.EqualError(t, err, "group_sets.groups must list at least one group")
+
+	c.Settings["group_sets"] = map[string]any{"enabled": true, "backend": "pf", "groups": []any{"ops"}}
+	_, err = parseGroupSets(c)
+	require.EqualError(t, err, "group_sets.backend must be nftables or ipset")
+
+	c.Settings["group_sets"] = map[string]any{"enabled": true, "family": "arp", "groups": []any{"ops"}}
+	_, err = parseGroupSets(c)
+	require.EqualError(t, err, `group_sets.family "arp" is not an nftables family`)
+
+	c.Settings["group_sets"] = map[string]any{"enabled": true, "backend": "ipset", "groups": []any{"a-group-with-a-very-long-name"}}
+	_, err = parseGroupSets(c)
+	require.ErrorContains(t, err, `group "a-group-with-a-very-long-name" in group_sets.groups can not be a set name`)
+
+	c.Settings["group_sets"] = map[string]any{"enabled": true, "groups": []any{"ops", "db admins"}}
+	cfg, err = parseGroupSets(c)
+	require.NoError(t, err)
+	assert.Equal(t, groupset.Config{Backend: "nftables", Family: "inet", Table: "nebula"}, cfg.set)
+
+	v4, v6 := cfg.setNames("db admins")
+	assert.Equal(t, "nebula_db_admins", v4)
+	assert.Equal(t, "nebula_db_admins_v6", v6)
+}
+
+func TestGroupSetsConfig_contents(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	f := &Interface{}
+
+	add := func(index uint32, groups []string, addrs ...string) {
+		h := &HostInfo{localIndexId: index, ConnectionState: &ConnectionState{}}
+		for _, a := range addrs {
+			h.vpnAddrs = append(h.vpnAddrs, netip.MustParseAddr(a))
+		}
+		h.ConnectionState.peerCert = &cert.CachedCertificate{Certificate: &dummyCert{groups: groups}}
+		hm.unlockedAddHostInfo(h, f)
+	}
+
+	add(1, []string{"ops", "web"}, "10.0.0.3")
+	add(2, []string{"ops"}, "10.0.0.1", "fd00::1")
+	add(3, []string{"web"}, "10.0.0.2")
+
+	cfg := &groupSetsConfig{prefix: "nebula_", groups: []string{"ops", "db"}}
+	assert.Equal(t, []groupset.Set{
+		{Name: "nebula_ops", Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.3")}},
+		{Name: "nebula_ops_v6", V6: true, Addrs: []netip.Addr{netip.MustParseAddr("fd00::1")}},
+		// Groups without connected peers still get their sets, so rules using them load
+		{Name: "nebula_db"},
+		{Name: "nebula_db_v6", V6: true},
+	}, cfg.contents(hm))
+}
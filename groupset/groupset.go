@@ -0,0 +1,111 @@
+// Package groupset keeps sets of addresses in the host firewall, so nftables or iptables rules can match overlay
+// traffic by the nebula groups of the peer sending it.
+package groupset
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+var ErrNotSupported = errors.New("group sets are not supported on this platform")
+
+const (
+	BackendNftables = "nftables"
+	BackendIpset    = "ipset"
+
+	// maxIpsetNameLen is IPSET_MAXNAMELEN without the trailing nul
+	maxIpsetNameLen = 31
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// Config says where the sets live
+type Config struct {
+	// Backend is BackendNftables or BackendIpset
+	Backend string
+	// Family and Table hold the sets with nftables. The table is created if it is missing and never deleted, rules
+	// using the sets have to live in it too.
+	Family string
+	Table  string
+}
+
+// Set is the full contents of one set. Addrs must all be of the family V6 says.
+type Set struct {
+	Name  string
+	V6    bool
+	Addrs []netip.Addr
+}
+
+// CheckName returns an error if name can not be used for a set with cfg.Backend
+func CheckName(cfg Config, name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("%q is not a valid set name", name)
+	}
+	if cfg.Backend == BackendIpset && len(name) > maxIpsetNameLen {
+		return fmt.Errorf("%q is longer than the %d characters ipset allows", name, maxIpsetNameLen)
+	}
+	return nil
+}
+
+// Sync creates any of sets that do not exist yet and replaces the contents of all of them
+func Sync(cfg Config, sets []Set) error {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	switch cfg.Backend {
+	case BackendNftables:
+		return run("nft", nftScript(cfg, sets), "-f", "-")
+	case BackendIpset:
+		return run("ipset", ipsetScript(sets), "restore")
+	default:
+		return fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
+
+// nftScript returns an nft batch for sets, nft applies it as a single transaction
+func nftScript(cfg Config, sets []Set) string {
+	var b strings.Builder
+	table := cfg.Family + " " + cfg.Table
+	fmt.Fprintf(&b, "add table %s\n", table)
+	for _, s := range sets {
+		typ := "ipv4_addr"
+		if s.V6 {
+			typ = "ipv6_addr"
+		}
+		fmt.Fprintf(&b, "add set %s %s { type %s; }\n", table, s.Name, typ)
+		fmt.Fprintf(&b, "flush set %s %s\n", table, s.Name)
+		if len(s.Addrs) > 0 {
+			fmt.Fprintf(&b, "add element %s %s { %s }\n", table, s.Name, joinAddrs(s.Addrs, ", "))
+		}
+	}
+	return b.String()
+}
+
+// ipsetScript returns input for ipset restore for sets
+func ipsetScript(sets []Set) string {
+	var b strings.Builder
+	for _, s := range sets {
+		family := "inet"
+		if s.V6 {
+			family = "inet6"
+		}
+		fmt.Fprintf(&b, "create %s hash:ip family %s -exist\n", s.Name, family)
+		fmt.Fprintf(&b, "flush %s\n", s.Name)
+		for _, a := range s.Addrs {
+			fmt.Fprintf(&b, "add %s %s -exist\n", s.Name, a)
+		}
+	}
+	return b.String()
+}
+
+func joinAddrs(addrs []netip.Addr, sep string) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, sep)
+}
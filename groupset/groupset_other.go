@@ -0,0 +1,8 @@
+//go:build android || !linux
+
+package groupset
+
+// run is not available here, nftables and ipset only exist on linux
+func run(_, _ string, _ ...string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,45 @@
+package groupset
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckName(t *testing.T) {
+	nft := Config{Backend: BackendNftables}
+	ipset := Config{Backend: BackendIpset}
+
+	require.NoError(t, CheckName(nft, "nebula_ops-team"))
+	require.EqualError(t, CheckName(nft, "nebula ops"), `"nebula ops" is not a valid set name`)
+	require.EqualError(t, CheckName(nft, "0nebula"), `"0nebula" is not a valid set name`)
+
+	long := "nebula_a_group_with_a_long_name_v6"
+	require.NoError(t, CheckName(nft, long))
+	require.EqualError(t, CheckName(ipset, long), `"`+long+`" is longer than the 31 characters ipset allows`)
+}
+
+func TestScripts(t *testing.T) {
+	sets := []Set{
+		{Name: "nebula_ops", Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")}},
+		{Name: "nebula_ops_v6", V6: true},
+	}
+
+	assert.Equal(t, `add table inet nebula
+add set inet nebula nebula_ops { type ipv4_addr; }
+flush set inet nebula nebula_ops
+add element inet nebula nebula_ops { 10.0.0.1, 10.0.0.2 }
+add set inet nebula nebula_ops_v6 { type ipv6_addr; }
+flush set inet nebula nebula_ops_v6
+`, nftScript(Config{Backend: BackendNftables, Family: "inet", Table: "nebula"}, sets))
+
+	assert.Equal(t, `create nebula_ops hash:ip family inet -exist
+flush nebula_ops
+add nebula_ops 10.0.0.1 -exist
+add nebula_ops 10.0.0.2 -exist
+create nebula_ops_v6 hash:ip family inet6 -exist
+flush nebula_ops_v6
+`, ipsetScript(sets))
+}
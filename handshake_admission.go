@@ -0,0 +1,175 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	mathrand "math/rand/v2"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// After a site wide restart every node handshakes with the lighthouses at once. Two things spread that out. Each node
+// waits a random part of handshakes.startup_jitter before its first handshakes, and a host with handshakes.admission
+// answers only so many handshakes a second. Everyone over the limit gets a retry after message instead, which costs the
+// busy host no certificate checks and no key exchange. The initiator stops sending to that remote until then but keeps
+// trying any others, and only when every remote is holding it back does it wait rather than retry and time out.
+
+const (
+	// retryAfterLen is the header and how long to wait in milliseconds
+	retryAfterLen = header.Len + 4
+	// maxHandshakeRetryAfter caps how long a retry after message can hold a handshake, it is not authenticated
+	maxHandshakeRetryAfter = time.Minute
+	// maxHandshakeRetryAfters caps how many retry after messages a single handshake will honor, for the same reason
+	maxHandshakeRetryAfters = 3
+)
+
+type handshakeAdmission struct {
+	bucket     *tokenBucket
+	retryAfter time.Duration
+
+	metricDeferred metrics.Counter
+}
+
+// newHandshakeAdmissionFromConfig returns nil when handshakes.admission is not configured
+func newHandshakeAdmissionFromConfig(c *config.C) (*handshakeAdmission, error) {
+	rate := c.GetInt("handshakes.admission.rate", 0)
+	if rate == 0 {
+		return nil, nil
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("handshakes.admission.rate must be positive")
+	}
+
+	burst := c.GetInt("handshakes.admission.burst", rate*2)
+	if burst < 1 {
+		return nil, fmt.Errorf("handshakes.admission.burst must be positive")
+	}
+
+	retryAfter := c.GetDuration("handshakes.admission.retry_after", 5*time.Second)
+	if retryAfter <= 0 || retryAfter > maxHandshakeRetryAfter {
+		return nil, fmt.Errorf("handshakes.admission.retry_after must be more than 0 and at most %s", maxHandshakeRetryAfter)
+	}
+
+	return &handshakeAdmission{
+		bucket:         newTokenBucket(uint64(rate), uint64(burst)),
+		retryAfter:     retryAfter,
+		metricDeferred: metrics.GetOrRegisterCounter("handshake_manager.admission.deferred", nil),
+	}, nil
+}
+
+// admit reports whether we should answer a new handshake now. If not it returns how long the initiator should wait,
+// between retry_after and twice that so the deferred hosts do not all come back at once.
+func (a *handshakeAdmission) admit(now time.Time) (bool, time.Duration) {
+	if a == nil || a.bucket.allow(now, 1) {
+		return true, 0
+	}
+
+	a.metricDeferred.Inc(1)
+	return false, a.retryAfter + time.Duration(mathrand.Int64N(int64(a.retryAfter)))
+}
+
+func marshalRetryAfter(initiatorIndex uint32, d time.Duration) []byte {
+	b := make([]byte, retryAfterLen)
+	header.Encode(b, header.Version, header.Handshake, header.HandshakeRetryAfter, initiatorIndex, 2)
+	binary.BigEndian.PutUint32(b[header.Len:], uint32(d.Milliseconds()))
+	return b
+}
+
+// sendRetryAfter tells the initiator of a handshake we are not answering to come back after d
+func (hm *HandshakeManager) sendRetryAfter(via ViaSender, initiatorIndex uint32, d time.Duration) {
+	if via.IsRelayed {
+		// The relay would have to carry it for us, just let the initiator retry
+		return
+	}
+
+	hm.messageMetrics.Tx(header.Handshake, header.HandshakeRetryAfter, 1)
+	if err := hm.outside.WriteTo(marshalRetryAfter(initiatorIndex, d), via.UdpAddr); err != nil {
+		hm.l.WithError(err).WithField("udpAddr", via.UdpAddr).Error("Failed to send handshake retry after")
+	}
+}
+
+// handleRetryAfter holds one of our handshakes back from the remote that says it is busy
+func (hm *HandshakeManager) handleRetryAfter(via ViaSender, packet []byte, h *header.H) {
+	if via.IsRelayed || len(packet) < retryAfterLen {
+		return
+	}
+
+	hh := hm.queryIndex(h.RemoteIndex)
+	if hh == nil {
+		return
+	}
+
+	hh.Lock()
+	defer hh.Unlock()
+	if !slices.Contains(hh.lastRemotes, via.UdpAddr) {
+		// Only a host we sent the handshake to may hold it
+		return
+	}
+
+	d := min(time.Duration(binary.BigEndian.Uint32(packet[header.Len:]))*time.Millisecond, maxHandshakeRetryAfter)
+	if hh.retryAfters >= maxHandshakeRetryAfters {
+		hh.hostinfo.logger(hm.l).WithFields(logrus.Fields{"udpAddr": via.UdpAddr, "retryAfter": d}).
+			Debug("Ignoring handshake retry after, this handshake has been deferred too many times")
+		return
+	}
+
+	if hh.heldRemotes == nil {
+		hh.heldRemotes = map[netip.AddrPort]time.Time{}
+	}
+	hh.heldRemotes[via.UdpAddr] = time.Now().Add(d)
+	hh.retryAfters++
+	hh.lastError = fmt.Sprintf("%s is busy, retrying after %s", via.UdpAddr, d)
+	hm.metricRetryAfter.Inc(1)
+	hh.hostinfo.logger(hm.l).WithFields(logrus.Fields{"udpAddr": via.UdpAddr, "retryAfter": d}).
+		Info("Handshake deferred by a busy host")
+}
+
+// unlockedHeldUntil returns when hh may send its next attempt, hh must be locked. Busy remotes only hold the attempt
+// back when there is no other remote or relay left to try. Holds that are over are forgotten.
+func (hm *HandshakeManager) unlockedHeldUntil(hh *HandshakeHostInfo) time.Time {
+	now := time.Now()
+	maps.DeleteFunc(hh.heldRemotes, func(_ netip.AddrPort, until time.Time) bool {
+		return !until.After(now)
+	})
+	if len(hh.heldRemotes) == 0 {
+		return hm.startupHold
+	}
+
+	remotes := hh.lastRemotes
+	if rl := hh.hostinfo.remotes; rl != nil {
+		if hm.config.useRelays && len(rl.relays) > 0 {
+			return hm.startupHold
+		}
+		remotes = rl.CopyAddrs(hm.mainHostMap.GetPreferredRanges())
+		remotes = append(remotes, hm.lanCandidates(hh.hostinfo.vpnAddrs[0], rl, remotes)...)
+	}
+
+	var heldUntil time.Time
+	for _, addr := range remotes {
+		until, ok := hh.heldRemotes[addr]
+		if !ok {
+			return hm.startupHold
+		}
+		if heldUntil.IsZero() || until.Before(heldUntil) {
+			heldUntil = until
+		}
+	}
+
+	if heldUntil.After(hm.startupHold) {
+		return heldUntil
+	}
+	return hm.startupHold
+}
+
+// unlockedIsHeld reports whether addr asked hh not to send to it yet, hh must be locked
+func (hh *HandshakeHostInfo) unlockedIsHeld(addr netip.AddrPort) bool {
+	_, ok := hh.heldRemotes[addr]
+	return ok
+}
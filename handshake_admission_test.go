@@ -0,0 +1,170 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeAdmission(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+	a, err := newHandshakeAdmissionFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	// No admission answers everything
+	ok, _ := a.admit(time.Now())
+	assert.True(t, ok)
+
+	c.Settings["handshakes"] = map[string]any{"admission": map[string]any{"rate": -1}}
+	_, err = newHandshakeAdmissionFromConfig(c)
+	require.Error(t, err)
+
+	c.Settings["handshakes"] = map[string]any{"admission": map[string]any{"rate": 1, "retry_after": "2m"}}
+	_, err = newHandshakeAdmissionFromConfig(c)
+	require.Error(t, err)
+
+	c.Settings["handshakes"] = map[string]any{"admission": map[string]any{"rate": 1, "burst": 2, "retry_after": "1s"}}
+	a, err = newHandshakeAdmissionFromConfig(c)
+	require.NoError(t, err)
+
+	now := time.Now()
+	for range 2 {
+		ok, _ = a.admit(now)
+		assert.True(t, ok)
+	}
+
+	for range 10 {
+		ok, retryAfter := a.admit(now)
+		assert.False(t, ok)
+		assert.GreaterOrEqual(t, retryAfter, time.Second)
+		assert.Less(t, retryAfter, 2*time.Second)
+	}
+
+	ok, _ = a.admit(now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func newRetryAfterTest(t *testing.T, remotes ...netip.AddrPort) (*HandshakeManager, *HandshakeHostInfo, func(netip.AddrPort, time.Duration)) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+	hm := NewHandshakeManager(l, hostMap, newTestLighthouse(), &udp.NoopConn{}, defaultHandshakeConfig)
+	hm.f = &Interface{handshakeManager: hm, pki: &PKI{}, l: l}
+	hm.f.pki.cs.Store(&CertState{initiatingVersion: cert.Version1, v1Cert: &dummyCert{version: cert.Version1}})
+
+	vpnAddr := netip.MustParseAddr("172.1.1.2")
+	hm.StartHandshake(vpnAddr, nil)
+	hh := hm.queryVpnIp(vpnAddr)
+	hh.lastRemotes = remotes
+	require.NoError(t, hm.allocateIndex(hh))
+	index := hh.hostinfo.localIndexId
+
+	h := &header.H{}
+	return hm, hh, func(from netip.AddrPort, d time.Duration) {
+		p := marshalRetryAfter(index, d)
+		require.NoError(t, h.Parse(p))
+		assert.Equal(t, header.HandshakeRetryAfter, h.Subtype)
+		hm.HandleIncoming(ViaSender{UdpAddr: from}, p, h)
+	}
+}
+
+func TestHandshakeManager_retryAfter(t *testing.T) {
+	busy := netip.MustParseAddrPort("10.0.0.1:4242")
+	hm, hh, retryAfter := newRetryAfterTest(t, busy)
+	vpnAddr := hh.hostinfo.vpnAddrs[0]
+
+	// Only a host we sent to may hold the handshake
+	retryAfter(netip.MustParseAddrPort("10.0.0.2:4242"), 10*time.Second)
+	assert.Empty(t, hh.heldRemotes)
+
+	retryAfter(busy, 10*time.Second)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), hh.heldRemotes[busy], time.Second)
+	assert.Contains(t, hh.lastError, "is busy")
+
+	// Waiting on our only remote does not use up attempts
+	counter := hh.counter
+	hm.handleOutbound(vpnAddr, false)
+	hm.handleOutbound(vpnAddr, true)
+	assert.Equal(t, counter, hh.counter)
+	assert.Contains(t, hm.vpnIps, vpnAddr)
+
+	// A busy host can not hold us forever
+	retryAfter(busy, time.Hour)
+	assert.WithinDuration(t, time.Now().Add(maxHandshakeRetryAfter), hh.heldRemotes[busy], time.Second)
+
+	// Once the wait is over we try again
+	hh.heldRemotes[busy] = time.Now().Add(-time.Second)
+	hm.handleOutbound(vpnAddr, false)
+	assert.Equal(t, counter+1, hh.counter)
+	assert.Empty(t, hh.heldRemotes)
+}
+
+func TestHandshakeManager_retryAfterOtherRemotes(t *testing.T) {
+	busy := netip.MustParseAddrPort("10.0.0.1:4242")
+	other := netip.MustParseAddrPort("10.0.0.2:4242")
+	hm, hh, retryAfter := newRetryAfterTest(t, busy, other)
+	vpnAddr := hh.hostinfo.vpnAddrs[0]
+
+	hh.hostinfo.remotes = NewRemoteList([]netip.Addr{vpnAddr}, nil)
+	hh.hostinfo.remotes.unlockedSetV4(vpnAddr, vpnAddr, []*V4AddrPort{
+		netAddrToProtoV4AddrPort(busy.Addr(), busy.Port()),
+		netAddrToProtoV4AddrPort(other.Addr(), other.Port()),
+	}, func(netip.Addr, *V4AddrPort) bool { return true })
+	hh.ready = true
+	hh.hostinfo.HandshakePacket = map[uint8][]byte{0: make([]byte, header.Len)}
+
+	// A busy remote does not hold back the others
+	retryAfter(busy, 10*time.Second)
+	counter := hh.counter
+	hm.handleOutbound(vpnAddr, false)
+	assert.Equal(t, counter+1, hh.counter)
+	assert.Equal(t, []netip.AddrPort{other}, hh.lastRemotes)
+
+	// Until every remote is busy
+	retryAfter(other, 10*time.Second)
+	hm.handleOutbound(vpnAddr, false)
+	assert.Equal(t, counter+1, hh.counter)
+
+	// A relay is still worth trying
+	hm.config.useRelays = true
+	hh.hostinfo.remotes.relays = []netip.Addr{netip.MustParseAddr("172.1.1.3")}
+	assert.Equal(t, hm.startupHold, hm.unlockedHeldUntil(hh))
+	hh.hostinfo.remotes.relays = nil
+
+	// Only so many retry afters are honored for one handshake
+	clear(hh.heldRemotes)
+	hh.lastRemotes = []netip.AddrPort{busy, other}
+	for range maxHandshakeRetryAfters {
+		retryAfter(busy, 10*time.Second)
+	}
+	assert.Len(t, hh.heldRemotes, 1)
+	retryAfter(other, 10*time.Second)
+	assert.Len(t, hh.heldRemotes, 1)
+	assert.Equal(t, maxHandshakeRetryAfters, hh.retryAfters)
+}
+
+func TestHandshakeManager_startupJitter(t *testing.T) {
+	l := test.NewLogger()
+	hc := defaultHandshakeConfig
+	hc.startupJitter = time.Minute
+
+	before := time.Now()
+	hm := NewHandshakeManager(l, newHostMap(l), newTestLighthouse(), &udp.NoopConn{}, hc)
+	assert.False(t, hm.startupHold.Before(before))
+	assert.True(t, hm.startupHold.Before(before.Add(time.Minute+time.Second)))
+
+	busy := netip.MustParseAddrPort("10.0.0.1:4242")
+	hh := &HandshakeHostInfo{hostinfo: &HostInfo{}, lastRemotes: []netip.AddrPort{busy}}
+	assert.Equal(t, hm.startupHold, hm.unlockedHeldUntil(hh))
+	hh.heldRemotes = map[netip.AddrPort]time.Time{busy: hm.startupHold.Add(time.Second)}
+	assert.Equal(t, hh.heldRemotes[busy], hm.unlockedHeldUntil(hh))
+}
@@ -2,6 +2,7 @@ package nebula
 
 import (
 	"bytes"
+	"fmt"
 	"net/netip"
 	"time"
 
@@ -18,8 +19,9 @@ import (
 func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 	err := f.handshakeManager.allocateIndex(hh)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to generate index")
+		hh.lastError = "failed to generate index: " + err.Error()
 		return false
 	}
 
@@ -39,28 +41,31 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 
 	crt := cs.getCertificate(v)
 	if crt == nil {
-		f.l.WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).
 			WithField("certVersion", v).
 			Error("Unable to handshake with host because no certificate is available")
+		hh.lastError = fmt.Sprintf("no version %d certificate is available", v)
 		return false
 	}
 
 	crtHs := cs.getHandshakeBytes(v)
 	if crtHs == nil {
-		f.l.WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).
 			WithField("certVersion", v).
 			Error("Unable to handshake with host because no certificate handshake bytes is available")
+		hh.lastError = fmt.Sprintf("no version %d certificate handshake bytes are available", v)
 		return false
 	}
 
-	ci, err := NewConnectionState(f.l, cs, crt, true, noise.HandshakeIX)
+	ci, err := NewConnectionState(f.handshakeManager.l, cs, crt, true, noise.HandshakeIX)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).
 			WithField("certVersion", v).
 			Error("Failed to create connection state")
+		hh.lastError = "failed to create connection state: " + err.Error()
 		return false
 	}
 	hh.hostinfo.ConnectionState = ci
@@ -71,14 +76,19 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 			Time:           uint64(time.Now().UnixNano()),
 			Cert:           crtHs,
 			CertVersion:    uint32(v),
+			NullCipher:     f.offerNullCipher(),
+			SourcePorts:    f.sourcePortCount(),
+			HopSchedule:    f.portHopper.scheduleID(),
+			Compression:    uint32(supportedCompression),
 		},
 	}
 
 	hsBytes, err := hs.Marshal()
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("certVersion", v).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to marshal handshake message")
+		hh.lastError = "failed to marshal handshake message: " + err.Error()
 		return false
 	}
 
@@ -86,17 +96,19 @@ func ixHandshakeStage0(f *Interface, hh *HandshakeHostInfo) bool {
 
 	msg, _, _, err := ci.H.WriteMessage(h, hsBytes)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hh.hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).Error("Failed to call noise.WriteMessage")
+		hh.lastError = "failed to write handshake message: " + err.Error()
 		return false
 	}
 
 	// We are sending handshake packet 1, so we don't expect to receive
 	// handshake packet 1 from the responder
-	ci.window.Update(f.l, 1)
+	ci.window.Update(f.handshakeManager.l, 1)
 
 	hh.hostinfo.HandshakePacket[0] = msg
 	hh.ready = true
+	hh.readyTime = time.Now()
 	return true
 }
 
@@ -104,27 +116,27 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	cs := f.pki.getCertState()
 	crt := cs.GetDefaultCertificate()
 	if crt == nil {
-		f.l.WithField("from", via).
+		f.handshakeManager.l.WithField("from", via).
 			WithField("handshake", m{"stage": 0, "style": "ix_psk0"}).
 			WithField("certVersion", cs.initiatingVersion).
 			Error("Unable to handshake with host because no certificate is available")
 		return
 	}
 
-	ci, err := NewConnectionState(f.l, cs, crt, false, noise.HandshakeIX)
+	ci, err := NewConnectionState(f.handshakeManager.l, cs, crt, false, noise.HandshakeIX)
 	if err != nil {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			Error("Failed to create connection state")
 		return
 	}
 
 	// Mark packet 1 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 1)
+	ci.window.Update(f.handshakeManager.l, 1)
 
 	msg, _, _, err := ci.H.ReadMessage(nil, packet[header.Len:])
 	if err != nil {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			Error("Failed to call noise.ReadMessage")
 		return
@@ -133,42 +145,54 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	hs := &NebulaHandshake{}
 	err = hs.Unmarshal(msg)
 	if err != nil || hs.Details == nil {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			Error("Failed unmarshal handshake message")
 		return
 	}
 
+	// Turning away a handshake before checking the certificate or doing the key exchange keeps it cheap
+	if ok, retryAfter := f.handshakeManager.config.admission.admit(time.Now()); !ok {
+		if f.handshakeManager.l.Level >= logrus.DebugLevel {
+			f.handshakeManager.l.WithField("from", via).WithField("retryAfter", retryAfter).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Debug("Deferring handshake, too many handshakes")
+		}
+		f.handshakeManager.sendRetryAfter(via, hs.Details.InitiatorIndex, retryAfter)
+		return
+	}
+
 	rc, err := cert.Recombine(cert.Version(hs.Details.CertVersion), hs.Details.Cert, ci.H.PeerStatic(), ci.Curve())
 	if err != nil {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			Info("Handshake did not contain a certificate")
 		return
 	}
 
-	remoteCert, err := f.pki.GetCAPool().VerifyCertificate(time.Now(), rc)
+	remoteCert, certInGrace, err := f.pki.GetCAPool().VerifyCertificateWithGrace(time.Now(), rc)
 	if err != nil {
 		fp, fperr := rc.Fingerprint()
 		if fperr != nil {
 			fp = "<error generating certificate fingerprint>"
 		}
 
-		e := f.l.WithError(err).WithField("from", via).
+		e := f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			WithField("certVpnNetworks", rc.Networks()).
 			WithField("certFingerprint", fp)
 
-		if f.l.Level >= logrus.DebugLevel {
+		if f.handshakeManager.l.Level >= logrus.DebugLevel {
 			e = e.WithField("cert", rc)
 		}
 
 		e.Info("Invalid certificate from host")
+		f.clockProbes.rejected(f.l, err, rc, time.Now())
 		return
 	}
 
 	if !bytes.Equal(remoteCert.Certificate.PublicKey(), ci.H.PeerStatic()) {
-		f.l.WithField("from", via).
+		f.handshakeManager.l.WithField("from", via).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			WithField("cert", remoteCert).Info("public key mismatch between certificate and handshake")
 		return
@@ -178,8 +202,8 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 		// We started off using the wrong certificate version, lets see if we can match the version that was sent to us
 		myCertOtherVersion := cs.getCertificate(remoteCert.Certificate.Version())
 		if myCertOtherVersion == nil {
-			if f.l.Level >= logrus.DebugLevel {
-				f.l.WithError(err).WithFields(m{
+			if f.handshakeManager.l.Level >= logrus.DebugLevel {
+				f.handshakeManager.l.WithError(err).WithFields(m{
 					"from":      via,
 					"handshake": m{"stage": 1, "style": "ix_psk0"},
 					"cert":      remoteCert,
@@ -192,7 +216,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	}
 
 	if len(remoteCert.Certificate.Networks()) == 0 {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("cert", remoteCert).
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 			Info("No networks in certificate")
@@ -209,7 +233,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	vpnAddrs := make([]netip.Addr, len(vpnNetworks))
 	for i, network := range vpnNetworks {
 		if f.myVpnAddrsTable.Contains(network.Addr()) {
-			f.l.WithField("vpnNetworks", vpnNetworks).WithField("from", via).
+			f.handshakeManager.l.WithField("vpnNetworks", vpnNetworks).WithField("from", via).
 				WithField("certName", certName).
 				WithField("certVersion", certVersion).
 				WithField("fingerprint", fingerprint).
@@ -226,15 +250,33 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	if !via.IsRelayed {
 		// We only want to apply the remote allow list for direct tunnels here
 		if !f.lightHouse.GetRemoteAllowList().AllowAll(vpnAddrs, via.UdpAddr.Addr()) {
-			f.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 				Debug("lighthouse.remote_allow_list denied incoming handshake")
 			return
 		}
 	}
 
-	myIndex, err := generateIndex(f.l)
+	if !f.peerFilter.Load().allows(remoteCert) {
+		f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			WithField("certName", certName).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("peer_filter denied incoming handshake")
+		return
+	}
+
+	sr := f.securityRequirements.Load()
+	if err := sr.check(remoteCert.Certificate); err != nil {
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			WithField("certName", certName).
+			WithField("fips", sr.fipsMode()).
+			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+			Info("Certificate does not meet security.min_requirements")
+		return
+	}
+
+	myIndex, err := generateIndex(f.handshakeManager.l)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -257,7 +299,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 		},
 	}
 
-	msgRxL := f.l.WithFields(m{
+	msgRxL := f.handshakeManager.l.WithFields(m{
 		"vpnAddrs":       vpnAddrs,
 		"from":           via,
 		"certName":       certName,
@@ -288,10 +330,19 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	hs.Details.CertVersion = uint32(ci.myCert.Version())
 	// Update the time in case their clock is way off from ours
 	hs.Details.Time = uint64(time.Now().UnixNano())
+	// Only keep the null cipher if they offered it and we allow it for them over a direct path, see null_cipher.go
+	hs.Details.NullCipher = hs.Details.NullCipher && !via.IsRelayed && f.allowsNullCipher(remoteCert)
+	ci.nullCipher = hs.Details.NullCipher
+	ci.peerSourcePorts = hs.Details.SourcePorts
+	hs.Details.SourcePorts = f.sourcePortCount()
+	ci.peerHopSchedule = hs.Details.HopSchedule
+	hs.Details.HopSchedule = f.portHopper.scheduleID()
+	ci.compression = f.compressionFor(remoteCert, hs.Details.Compression)
+	hs.Details.Compression = uint32(supportedCompression)
 
 	hsBytes, err := hs.Marshal()
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -303,7 +354,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	nh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeIXPSK0, hs.Details.InitiatorIndex, 2)
 	msg, dKey, eKey, err := ci.H.WriteMessage(nh, hsBytes)
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -311,7 +362,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 			WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Error("Failed to call noise.WriteMessage")
 		return
 	} else if dKey == nil || eKey == nil {
-		f.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -330,15 +381,22 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 
 	// We are sending handshake packet 2, so we don't expect to receive
 	// handshake packet 2 from the initiator.
-	ci.window.Update(f.l, 2)
+	ci.window.Update(f.handshakeManager.l, 2)
 
 	ci.peerCert = remoteCert
 	ci.dKey = NewNebulaCipherState(dKey)
 	ci.eKey = NewNebulaCipherState(eKey)
+	ci.resumeSecret = newResumeSecret(false, eKey, dKey)
+	if ci.nullCipher {
+		ci.dKey.authOnly = true
+		ci.eKey.authOnly = true
+		msgRxL.Warn("Tunnel negotiated the null cipher, traffic is authenticated but NOT encrypted")
+	}
 
 	hostinfo.remotes = f.lightHouse.QueryCache(vpnAddrs)
 	if !via.IsRelayed {
 		hostinfo.SetRemote(via.UdpAddr)
+		hostinfo.remoteHistory.seen(via.UdpAddr, true, time.Now())
 	}
 	hostinfo.buildNetworks(f.myVpnNetworksTable, remoteCert.Certificate)
 
@@ -358,30 +416,30 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 			if !via.IsRelayed {
 				err := f.outside.WriteTo(msg, via.UdpAddr)
 				if err != nil {
-					f.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("from", via).
+					f.handshakeManager.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("from", via).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						WithError(err).Error("Failed to send handshake message")
 				} else {
-					f.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("from", via).
+					f.handshakeManager.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("from", via).
 						WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 						Info("Handshake message sent")
 				}
 				return
 			} else {
 				if via.relay == nil {
-					f.l.Error("Handshake send failed: both addr and via.relay are nil.")
+					f.handshakeManager.l.Error("Handshake send failed: both addr and via.relay are nil.")
 					return
 				}
 				hostinfo.relayState.InsertRelayTo(via.relayHI.vpnAddrs[0])
 				f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
-				f.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("relay", via.relayHI.vpnAddrs[0]).
+				f.handshakeManager.l.WithField("vpnAddrs", existing.vpnAddrs).WithField("relay", via.relayHI.vpnAddrs[0]).
 					WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("cached", true).
 					Info("Handshake message sent")
 				return
 			}
 		case ErrExistingHostInfo:
 			// This means there was an existing tunnel and this handshake was older than the one we are currently based on
-			f.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 				WithField("certName", certName).
 				WithField("certVersion", certVersion).
 				WithField("oldHandshakeTime", existing.lastHandshakeTime).
@@ -397,7 +455,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 			return
 		case ErrLocalIndexCollision:
 			// This means we failed to insert because of collision on localIndexId. Just let the next handshake packet retry
-			f.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 				WithField("certName", certName).
 				WithField("certVersion", certVersion).
 				WithField("fingerprint", fingerprint).
@@ -410,7 +468,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 		default:
 			// Shouldn't happen, but just in case someone adds a new error type to CheckAndComplete
 			// And we forget to update it here
-			f.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+			f.handshakeManager.l.WithError(err).WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 				WithField("certName", certName).
 				WithField("certVersion", certVersion).
 				WithField("fingerprint", fingerprint).
@@ -426,7 +484,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	f.messageMetrics.Tx(header.Handshake, header.MessageSubType(msg[1]), 1)
 	if !via.IsRelayed {
 		err = f.outside.WriteTo(msg, via.UdpAddr)
-		log := f.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+		log := f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -440,7 +498,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 		}
 	} else {
 		if via.relay == nil {
-			f.l.Error("Handshake send failed: both addr and via.relay are nil.")
+			f.handshakeManager.l.Error("Handshake send failed: both addr and via.relay are nil.")
 			return
 		}
 		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnAddrs[0])
@@ -448,7 +506,7 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 		// it's correctly marked as working.
 		via.relayHI.relayState.UpdateRelayForByIdxState(via.remoteIdx, Established)
 		f.SendVia(via.relayHI, via.relay, msg, make([]byte, 12), make([]byte, mtu), false)
-		f.l.WithField("vpnAddrs", vpnAddrs).WithField("relay", via.relayHI.vpnAddrs[0]).
+		f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("relay", via.relayHI.vpnAddrs[0]).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
 			WithField("fingerprint", fingerprint).
@@ -459,6 +517,9 @@ func ixHandshakeStage1(f *Interface, via ViaSender, packet []byte, h *header.H)
 	}
 
 	f.connectionManager.AddTrafficWatch(hostinfo)
+	if certInGrace {
+		f.peerCertInGrace(hostinfo, time.Now())
+	}
 
 	hostinfo.remotes.RefreshFromHandshake(vpnAddrs)
 
@@ -478,7 +539,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	if !via.IsRelayed {
 		// The vpnAddr we know about is the one we tried to handshake with, use it to apply the remote allow list.
 		if !f.lightHouse.GetRemoteAllowList().AllowAll(hostinfo.vpnAddrs, via.UdpAddr.Addr()) {
-			f.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).Debug("lighthouse.remote_allow_list denied incoming handshake")
+			f.handshakeManager.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).Debug("lighthouse.remote_allow_list denied incoming handshake")
 			return false
 		}
 	}
@@ -486,7 +547,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	ci := hostinfo.ConnectionState
 	msg, eKey, dKey, err := ci.H.ReadMessage(nil, packet[header.Len:])
 	if err != nil {
-		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).WithField("header", h).
 			Error("Failed to call noise.ReadMessage")
 
@@ -495,7 +556,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 		// near future
 		return false
 	} else if dKey == nil || eKey == nil {
-		f.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Error("Noise did not arrive at a key")
 
@@ -507,7 +568,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	hs := &NebulaHandshake{}
 	err = hs.Unmarshal(msg)
 	if err != nil || hs.Details == nil {
-		f.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("vpnAddrs", hostinfo.vpnAddrs).WithField("from", via).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).Error("Failed unmarshal handshake message")
 
 		// The handshake state machine is complete, if things break now there is no chance to recover. Tear down and start again
@@ -516,42 +577,43 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 
 	rc, err := cert.Recombine(cert.Version(hs.Details.CertVersion), hs.Details.Cert, ci.H.PeerStatic(), ci.Curve())
 	if err != nil {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("vpnAddrs", hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			Info("Handshake did not contain a certificate")
 		return true
 	}
 
-	remoteCert, err := f.pki.GetCAPool().VerifyCertificate(time.Now(), rc)
+	remoteCert, certInGrace, err := f.pki.GetCAPool().VerifyCertificateWithGrace(time.Now(), rc)
 	if err != nil {
-		fp, err := rc.Fingerprint()
-		if err != nil {
+		fp, fperr := rc.Fingerprint()
+		if fperr != nil {
 			fp = "<error generating certificate fingerprint>"
 		}
 
-		e := f.l.WithError(err).WithField("from", via).
+		e := f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("vpnAddrs", hostinfo.vpnAddrs).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			WithField("certFingerprint", fp).
 			WithField("certVpnNetworks", rc.Networks())
 
-		if f.l.Level >= logrus.DebugLevel {
+		if f.handshakeManager.l.Level >= logrus.DebugLevel {
 			e = e.WithField("cert", rc)
 		}
 
 		e.Info("Invalid certificate from host")
+		f.clockProbes.rejected(f.l, err, rc, time.Now())
 		return true
 	}
 	if !bytes.Equal(remoteCert.Certificate.PublicKey(), ci.H.PeerStatic()) {
-		f.l.WithField("from", via).
+		f.handshakeManager.l.WithField("from", via).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
 			WithField("cert", remoteCert).Info("public key mismatch between certificate and handshake")
 		return true
 	}
 
 	if len(remoteCert.Certificate.Networks()) == 0 {
-		f.l.WithError(err).WithField("from", via).
+		f.handshakeManager.l.WithError(err).WithField("from", via).
 			WithField("vpnAddrs", hostinfo.vpnAddrs).
 			WithField("cert", remoteCert).
 			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
@@ -565,6 +627,35 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	fingerprint := remoteCert.Fingerprint
 	issuer := remoteCert.Certificate.Issuer()
 
+	if !f.peerFilter.Load().allows(remoteCert) {
+		f.handshakeManager.l.WithField("from", via).
+			WithField("vpnAddrs", hostinfo.vpnAddrs).
+			WithField("certName", certName).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("peer_filter denied handshake response")
+		return true
+	}
+
+	sr := f.securityRequirements.Load()
+	if err := sr.check(remoteCert.Certificate); err != nil {
+		f.handshakeManager.l.WithError(err).WithField("from", via).
+			WithField("vpnAddrs", hostinfo.vpnAddrs).
+			WithField("certName", certName).
+			WithField("fips", sr.fipsMode()).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Info("Certificate does not meet security.min_requirements")
+		return true
+	}
+
+	if hs.Details.NullCipher && !f.allowsNullCipher(remoteCert) {
+		f.handshakeManager.l.WithField("from", via).
+			WithField("vpnAddrs", hostinfo.vpnAddrs).
+			WithField("certName", remoteCert.Certificate.Name()).
+			WithField("handshake", m{"stage": 2, "style": "ix_psk0"}).
+			Error("Host chose the null cipher but null_cipher.groups does not allow it for them")
+		return true
+	}
+
 	hostinfo.remoteIndexId = hs.Details.ResponderIndex
 	hostinfo.lastHandshakeTime = hs.Details.Time
 
@@ -572,10 +663,20 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	ci.peerCert = remoteCert
 	ci.dKey = NewNebulaCipherState(dKey)
 	ci.eKey = NewNebulaCipherState(eKey)
+	ci.resumeSecret = newResumeSecret(true, eKey, dKey)
+	ci.nullCipher = hs.Details.NullCipher
+	if ci.nullCipher {
+		ci.dKey.authOnly = true
+		ci.eKey.authOnly = true
+	}
+	ci.peerSourcePorts = hs.Details.SourcePorts
+	ci.peerHopSchedule = hs.Details.HopSchedule
+	ci.compression = f.compressionFor(remoteCert, hs.Details.Compression)
 
 	// Make sure the current udpAddr being used is set for responding
 	if !via.IsRelayed {
 		hostinfo.SetRemote(via.UdpAddr)
+		hostinfo.remoteHistory.seen(via.UdpAddr, true, time.Now())
 	} else {
 		hostinfo.relayState.InsertRelayTo(via.relayHI.vpnAddrs[0])
 	}
@@ -596,7 +697,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 
 	// Ensure the right host responded
 	if !correctHostResponded {
-		f.l.WithField("intendedVpnAddrs", hostinfo.vpnAddrs).WithField("haveVpnNetworks", vpnNetworks).
+		f.handshakeManager.l.WithField("intendedVpnAddrs", hostinfo.vpnAddrs).WithField("haveVpnNetworks", vpnNetworks).
 			WithField("from", via).
 			WithField("certName", certName).
 			WithField("certVersion", certVersion).
@@ -613,7 +714,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 			newHH.hostinfo.remotes = hostinfo.remotes
 			newHH.hostinfo.remotes.BlockRemote(via)
 
-			f.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).
+			f.handshakeManager.l.WithField("blockedUdpAddrs", newHH.hostinfo.remotes.CopyBlockedRemotes()).
 				WithField("vpnNetworks", vpnNetworks).
 				WithField("remotes", newHH.hostinfo.remotes.CopyAddrs(f.hostMap.GetPreferredRanges())).
 				Info("Blocked addresses for handshakes")
@@ -631,10 +732,10 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	}
 
 	// Mark packet 2 as seen so it doesn't show up as missed
-	ci.window.Update(f.l, 2)
+	ci.window.Update(f.handshakeManager.l, 2)
 
 	duration := time.Since(hh.startTime).Nanoseconds()
-	msgRxL := f.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
+	msgRxL := f.handshakeManager.l.WithField("vpnAddrs", vpnAddrs).WithField("from", via).
 		WithField("certName", certName).
 		WithField("certVersion", certVersion).
 		WithField("fingerprint", fingerprint).
@@ -650,6 +751,10 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 		msgRxL.Info("Handshake message received, but no vpnNetworks in common.")
 	}
 
+	if ci.nullCipher {
+		msgRxL.Warn("Tunnel negotiated the null cipher, traffic is authenticated but NOT encrypted")
+	}
+
 	// Build up the radix for the firewall if we have subnets in the cert
 	hostinfo.vpnAddrs = vpnAddrs
 	hostinfo.buildNetworks(f.myVpnNetworksTable, remoteCert.Certificate)
@@ -657,9 +762,21 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 	// Complete our handshake and update metrics, this will replace any existing tunnels for the vpnAddrs here
 	f.handshakeManager.Complete(hostinfo, f)
 	f.connectionManager.AddTrafficWatch(hostinfo)
+	if certInGrace {
+		f.peerCertInGrace(hostinfo, time.Now())
+	}
+
+	// A forced rehandshake retires the tunnel it replaces, the peer drops it when it sees the close
+	if old := hh.replaces; old != nil && old != hostinfo {
+		hostinfo.logger(f.handshakeManager.l).WithField("oldLocalIndex", old.localIndexId).
+			Info("Closing the tunnel replaced by a rehandshake")
+		f.connectionManager.migrateRelayUsed(old, hostinfo)
+		f.sendCloseTunnel(old)
+		f.closeTunnel(old)
+	}
 
-	if f.l.Level >= logrus.DebugLevel {
-		hostinfo.logger(f.l).Debugf("Sending %d stored packets", len(hh.packetStore))
+	if f.handshakeManager.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.handshakeManager.l).Debugf("Sending %d stored packets", len(hh.packetStore))
 	}
 
 	if len(hh.packetStore) > 0 {
@@ -673,6 +790,7 @@ func ixHandshakeStage2(f *Interface, via ViaSender, hh *HandshakeHostInfo, packe
 
 	hostinfo.remotes.RefreshFromHandshake(vpnAddrs)
 	f.metricHandshakes.Update(duration)
+	f.handshakeManager.metricLatency.record(hh, via.IsRelayed, time.Now())
 
 	return false
 }
@@ -6,6 +6,9 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	mathrand "math/rand/v2"
 	"net/netip"
 	"slices"
 	"sync"
@@ -40,6 +43,15 @@ type HandshakeConfig struct {
 	triggerBuffer int
 	useRelays     bool
 
+	// multiplier switches the retry schedule from linear to exponential backoff when greater than 0
+	multiplier float64
+	// jitter randomizes each retry delay by up to this fraction of itself
+	jitter float64
+	// startupJitter holds the handshakes of a freshly started host for a random part of itself
+	startupJitter time.Duration
+	// admission limits how many handshakes we answer, nil answers them all
+	admission *handshakeAdmission
+
 	messageMetrics *MessageMetrics
 }
 
@@ -58,22 +70,37 @@ type HandshakeManager struct {
 	messageMetrics         *MessageMetrics
 	metricInitiated        metrics.Counter
 	metricTimedOut         metrics.Counter
+	metricLatency          *handshakeLatencyMetrics
+	metricRetryAfter       metrics.Counter
 	f                      *Interface
 	l                      *logrus.Logger
 
 	// can be used to trigger outbound handshake for the given vpnIp
 	trigger chan netip.Addr
+
+	// startupHold is when handshakes may start going out, see handshakes.startup_jitter
+	startupHold time.Time
 }
 
 type HandshakeHostInfo struct {
 	sync.Mutex
 
 	startTime                 time.Time        // Time that we first started trying with this handshake
+	readyTime                 time.Time        // Time that our handshake packet was ready
+	sentTime                  time.Time        // Time that we first sent our handshake packet, directly or via a relay
 	ready                     bool             // Is the handshake ready
 	initiatingVersionOverride cert.Version     // Should we use a non-default cert version for this handshake?
 	counter                   int64            // How many attempts have we made so far
 	lastRemotes               []netip.AddrPort // Remotes that we sent to during the previous attempt
+	lastRelays                []netip.Addr     // Relays that we tried during the previous attempt
+	lastError                 string           // Why the previous attempt did not get a handshake out, if it did not
 	packetStore               []*cachedPacket  // A set of packets to be transmitted once the handshake completes
+	replaces                  *HostInfo        // An established tunnel to close once this handshake completes, see Rehandshake
+
+	// Busy remotes and when we may send to them again, and how many retry after messages we have honored in all.
+	// See handshake_admission.go
+	heldRemotes map[netip.AddrPort]time.Time
+	retryAfters int
 
 	hostinfo *HostInfo
 }
@@ -104,6 +131,11 @@ func (hh *HandshakeHostInfo) cachePacket(l *logrus.Logger, t header.MessageType,
 }
 
 func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *LightHouse, outside udp.Conn, config HandshakeConfig) *HandshakeManager {
+	startupHold := time.Now()
+	if config.startupJitter > 0 {
+		startupHold = startupHold.Add(time.Duration(mathrand.Int64N(int64(config.startupJitter))))
+	}
+
 	return &HandshakeManager{
 		vpnIps:                 map[netip.Addr]*HandshakeHostInfo{},
 		indexes:                map[uint32]*HandshakeHostInfo{},
@@ -112,11 +144,14 @@ func NewHandshakeManager(l *logrus.Logger, mainHostMap *HostMap, lightHouse *Lig
 		outside:                outside,
 		config:                 config,
 		trigger:                make(chan netip.Addr, config.triggerBuffer),
-		OutboundHandshakeTimer: NewLockingTimerWheel[netip.Addr](config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
+		OutboundHandshakeTimer: NewLockingTimerWheel[netip.Addr](config.tryInterval, config.timeout()),
 		messageMetrics:         config.messageMetrics,
 		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
 		metricTimedOut:         metrics.GetOrRegisterCounter("handshake_manager.timed_out", nil),
+		metricLatency:          newHandshakeLatencyMetrics(),
+		metricRetryAfter:       metrics.GetOrRegisterCounter("handshake_manager.retry_after", nil),
 		l:                      l,
+		startupHold:            startupHold,
 	}
 }
 
@@ -158,6 +193,17 @@ func (hm *HandshakeManager) HandleIncoming(via ViaSender, packet []byte, h *head
 				hm.DeleteHostInfo(newHostinfo.hostinfo)
 			}
 		}
+
+	case header.HandshakeRetryAfter:
+		hm.handleRetryAfter(via, packet, h)
+
+	case header.HandshakeResume:
+		switch h.MessageCounter {
+		case 1:
+			hm.f.resumption.handleRequest(via, packet, h)
+		case 2:
+			hm.f.resumption.handleResponse(via, packet, h)
+		}
 	}
 }
 
@@ -181,6 +227,14 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 	defer hh.Unlock()
 
 	hostinfo := hh.hostinfo
+	// Waiting on busy remotes or out the startup jitter does not use up attempts
+	if wait := time.Until(hm.unlockedHeldUntil(hh)); wait > 0 {
+		if !lighthouseTriggered {
+			hm.OutboundHandshakeTimer.Add(vpnIp, wait)
+		}
+		return
+	}
+
 	// If we are out of time, clean up
 	if hh.counter >= hm.config.retries {
 		hh.hostinfo.logger(hm.l).WithField("udpAddrs", hh.hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())).
@@ -194,13 +248,15 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 		return
 	}
 
-	// Increment the counter to increase our delay, linear backoff
+	// Increment the counter to increase our delay
 	hh.counter++
 
+	hh.lastError = ""
+
 	// Check if we have a handshake packet to transmit yet
 	if !hh.ready {
 		if !ixHandshakeStage0(hm.f, hh) {
-			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
+			hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.retryDelay(hh.counter))
 			return
 		}
 	}
@@ -213,7 +269,10 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 		hostinfo.remotes = hm.lightHouse.QueryCache([]netip.Addr{vpnIp})
 	}
 
-	remotes := hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges())
+	// Remotes that told us they are busy are skipped until they are ready for us again
+	remotes := slices.DeleteFunc(hostinfo.remotes.CopyAddrs(hm.mainHostMap.GetPreferredRanges()), hh.unlockedIsHeld)
+	lanRemotes := slices.DeleteFunc(hm.lanCandidates(vpnIp, hostinfo.remotes, remotes), hh.unlockedIsHeld)
+	remotes = append(remotes, lanRemotes...)
 	remotesHaveChanged := !slices.Equal(remotes, hh.lastRemotes)
 
 	// We only care about a lighthouse trigger if we have new remotes to send to.
@@ -237,7 +296,7 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 
 	// Send the handshake to all known ips, stage 2 takes care of assigning the hostinfo.remote based on the first to reply
 	var sentTo []netip.AddrPort
-	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr netip.AddrPort, _ bool) {
+	sendHandshake := func(addr netip.AddrPort, _ bool) {
 		hm.messageMetrics.Tx(header.Handshake, header.MessageSubType(hostinfo.HandshakePacket[0][1]), 1)
 		err := hm.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
 		if err != nil {
@@ -245,11 +304,24 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 				WithField("initiatorIndex", hostinfo.localIndexId).
 				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
 				WithError(err).Error("Failed to send handshake message")
+			hh.lastError = fmt.Sprintf("failed to send handshake to %s: %s", addr, err)
 
 		} else {
 			sentTo = append(sentTo, addr)
 		}
+	}
+	hostinfo.remotes.ForEach(hm.mainHostMap.GetPreferredRanges(), func(addr netip.AddrPort, preferred bool) {
+		if !hh.unlockedIsHeld(addr) {
+			sendHandshake(addr, preferred)
+		}
 	})
+	for _, addr := range lanRemotes {
+		sendHandshake(addr, false)
+	}
+
+	if len(sentTo) > 0 && hh.sentTime.IsZero() {
+		hh.sentTime = time.Now()
+	}
 
 	// Don't be too noisy or confusing if we fail to send a handshake - if we don't get through we'll eventually log a timeout,
 	// so only log when the list of remotes has changed
@@ -265,7 +337,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			Debug("Handshake message sent")
 	}
 
+	if len(remotes) == 0 && (!hm.config.useRelays || len(hostinfo.remotes.relays) == 0) {
+		hh.lastError = "no underlay address or relay is known yet, waiting on the lighthouses"
+	}
+
+	hh.lastRelays = nil
 	if hm.config.useRelays && len(hostinfo.remotes.relays) > 0 {
+		hh.lastRelays = slices.Clone(hostinfo.remotes.relays)
 		hostinfo.logger(hm.l).WithField("relays", hostinfo.remotes.relays).Info("Attempt to relay through hosts")
 		// Send a RelayRequest to all known Relay IP's
 		for _, relay := range hostinfo.remotes.relays {
@@ -304,11 +382,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 					case cert.Version1:
 						if !hm.f.myVpnAddrs[0].Is4() {
 							hostinfo.logger(hm.l).Error("can not establish v1 relay with a v6 network because the relay is not running a current nebula version")
+							hh.lastError = "can not establish v1 relay with a v6 network because the relay is not running a current nebula version"
 							continue
 						}
 
 						if !vpnIp.Is4() {
 							hostinfo.logger(hm.l).Error("can not establish v1 relay with a v6 remote network because the relay is not running a current nebula version")
+							hh.lastError = "can not establish v1 relay with a v6 remote network because the relay is not running a current nebula version"
 							continue
 						}
 
@@ -346,6 +426,9 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 			case Established:
 				hostinfo.logger(hm.l).WithField("relay", relay.String()).Info("Send handshake via relay")
 				hm.f.SendVia(relayHostInfo, existingRelay, hostinfo.HandshakePacket[0], make([]byte, 12), make([]byte, mtu), false)
+				if hh.sentTime.IsZero() {
+					hh.sentTime = time.Now()
+				}
 			case Disestablished:
 				// Mark this relay as 'requested'
 				relayHostInfo.relayState.UpdateRelayForByIpState(vpnIp, Requested)
@@ -362,11 +445,13 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 				case cert.Version1:
 					if !hm.f.myVpnAddrs[0].Is4() {
 						hostinfo.logger(hm.l).Error("can not establish v1 relay with a v6 network because the relay is not running a current nebula version")
+						hh.lastError = "can not establish v1 relay with a v6 network because the relay is not running a current nebula version"
 						continue
 					}
 
 					if !vpnIp.Is4() {
 						hostinfo.logger(hm.l).Error("can not establish v1 relay with a v6 remote network because the relay is not running a current nebula version")
+						hh.lastError = "can not establish v1 relay with a v6 remote network because the relay is not running a current nebula version"
 						continue
 					}
 
@@ -412,10 +497,19 @@ func (hm *HandshakeManager) handleOutbound(vpnIp netip.Addr, lighthouseTriggered
 
 	// If a lighthouse triggered this attempt then we are still in the timer wheel and do not need to re-add
 	if !lighthouseTriggered {
-		hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.tryInterval*time.Duration(hh.counter))
+		hm.OutboundHandshakeTimer.Add(vpnIp, hm.config.retryDelay(hh.counter))
 	}
 }
 
+// lanCandidates returns the addresses lan_discovery heard vpnIp on that are not already in known or blocked in remotes.
+// They are only ever tried for the handshake, never added to the lighthouse address map.
+func (hm *HandshakeManager) lanCandidates(vpnIp netip.Addr, remotes *RemoteList, known []netip.AddrPort) []netip.AddrPort {
+	if hm.f == nil || hm.f.lanDiscovery == nil {
+		return nil
+	}
+	return hm.f.lanDiscovery.candidates(vpnIp, slices.Concat(known, remotes.CopyBlockedRemotes()))
+}
+
 // GetOrHandshake will try to find a hostinfo with a fully formed tunnel or start a new handshake if one is not present
 // The 2nd argument will be true if the hostinfo is ready to transmit traffic
 func (hm *HandshakeManager) GetOrHandshake(vpnIp netip.Addr, cacheCb func(*HandshakeHostInfo)) (*HostInfo, bool) {
@@ -581,6 +675,21 @@ func (hm *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 	hm.mainHostMap.unlockedAddHostInfo(hostinfo, f)
 }
 
+// Rehandshake starts a new handshake with vpnAddr even though we have a tunnel to it. The tunnel keeps carrying
+// traffic until the handshake completes, then it is closed on both sides so its keys are never used again.
+// Returns false if there is no tunnel to vpnAddr.
+func (hm *HandshakeManager) Rehandshake(vpnAddr netip.Addr) bool {
+	existing := hm.mainHostMap.QueryVpnAddr(vpnAddr)
+	if existing == nil {
+		return false
+	}
+
+	hm.StartHandshake(vpnAddr, func(hh *HandshakeHostInfo) {
+		hh.replaces = existing
+	})
+	return true
+}
+
 // allocateIndex generates a unique localIndexId for this HostInfo
 // and adds it to the pendingHostMap. Will error if we are unable to generate
 // a unique localIndexId
@@ -687,6 +796,34 @@ func (hm *HandshakeManager) ForEachIndex(f controlEach) {
 	}
 }
 
+// handshakeProgress fills in how far along each pending handshake in hosts is
+func (hm *HandshakeManager) handshakeProgress(hosts []ControlHostInfo) {
+	hm.RLock()
+	pending := make([]*HandshakeHostInfo, len(hosts))
+	for i := range hosts {
+		pending[i] = hm.indexes[hosts[i].LocalIndex]
+	}
+	hm.RUnlock()
+
+	// The HandshakeHostInfo lock is taken before the HandshakeManager lock elsewhere, never hold both here
+	for i, hh := range pending {
+		if hh == nil {
+			continue
+		}
+
+		hh.Lock()
+		hosts[i].Handshake = &ControlHandshakeInfo{
+			Attempts:          hh.counter,
+			RemainingAttempts: max(hm.config.retries-hh.counter, 0),
+			StartTime:         hh.startTime,
+			Remotes:           slices.Clone(hh.lastRemotes),
+			Relays:            slices.Clone(hh.lastRelays),
+			LastError:         hh.lastError,
+		}
+		hh.Unlock()
+	}
+}
+
 func (hm *HandshakeManager) EmitStats() {
 	hm.RLock()
 	hostLen := len(hm.vpnIps)
@@ -722,6 +859,28 @@ func generateIndex(l *logrus.Logger) (uint32, error) {
 	return index, nil
 }
 
-func hsTimeout(tries int64, interval time.Duration) time.Duration {
-	return time.Duration(tries / 2 * ((2 * int64(interval)) + (tries-1)*int64(interval)))
+// retryDelay returns how long to wait after the given attempt before trying again. The delay grows linearly with each
+// attempt unless a multiplier is configured, jitter is applied on top.
+func (hc HandshakeConfig) retryDelay(attempt int64) time.Duration {
+	d := hc.baseRetryDelay(attempt)
+	if hc.jitter > 0 {
+		d = time.Duration(float64(d) * (1 + hc.jitter*(2*mathrand.Float64()-1)))
+	}
+	return d
+}
+
+func (hc HandshakeConfig) baseRetryDelay(attempt int64) time.Duration {
+	if hc.multiplier > 0 {
+		return time.Duration(float64(hc.tryInterval) * math.Pow(hc.multiplier, float64(attempt-1)))
+	}
+	return hc.tryInterval * time.Duration(attempt)
+}
+
+// timeout is the longest a handshake can take before it is given up on
+func (hc HandshakeConfig) timeout() time.Duration {
+	var total time.Duration
+	for i := int64(1); i <= hc.retries; i++ {
+		total += time.Duration(float64(hc.baseRetryDelay(i)) * (1 + hc.jitter))
+	}
+	return total
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/slackhq/nebula/test"
 	"github.com/slackhq/nebula/udp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_NewHandshakeManagerVpnIp(t *testing.T) {
@@ -58,6 +59,21 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	// Confirm they are still in the pending index list
 	assert.Contains(t, blah.vpnIps, ip)
 
+	// and that the pending hostmap shows how many attempts are left
+	hosts := listHostMapHosts(blah)
+	require.Len(t, hosts, 1)
+	require.NotNil(t, hosts[0].Handshake)
+	assert.Positive(t, hosts[0].Handshake.Attempts)
+	assert.Equal(t, int64(DefaultHandshakeRetries), hosts[0].Handshake.Attempts+hosts[0].Handshake.RemainingAttempts)
+
+	// and why the handshake has not gone anywhere, the dummy certificate can not build a handshake message
+	pending := listPendingHandshakes(blah)
+	require.Len(t, pending, 1)
+	require.NotNil(t, pending[0].Handshake)
+	assert.Contains(t, pending[0].Handshake.LastError, "failed to write handshake message")
+	assert.Empty(t, pending[0].Handshake.Relays)
+	assert.False(t, pending[0].Handshake.StartTime.IsZero())
+
 	// Tick 1 more time, a minute will certainly flush it out
 	blah.NextOutboundHandshakeTimerTick(now.Add(time.Minute))
 
@@ -65,6 +81,28 @@ func Test_NewHandshakeManagerVpnIp(t *testing.T) {
 	assert.NotContains(t, blah.vpnIps, ip)
 }
 
+func TestHandshakeConfig_retryDelay(t *testing.T) {
+	hc := HandshakeConfig{tryInterval: time.Second, retries: 4}
+
+	// Linear by default
+	assert.Equal(t, time.Second, hc.retryDelay(1))
+	assert.Equal(t, 3*time.Second, hc.retryDelay(3))
+	assert.Equal(t, 10*time.Second, hc.timeout())
+
+	hc.multiplier = 2
+	assert.Equal(t, time.Second, hc.retryDelay(1))
+	assert.Equal(t, 4*time.Second, hc.retryDelay(3))
+	assert.Equal(t, 15*time.Second, hc.timeout())
+
+	hc.jitter = 0.5
+	for range 100 {
+		d := hc.retryDelay(3)
+		assert.GreaterOrEqual(t, d, 2*time.Second)
+		assert.LessOrEqual(t, d, 6*time.Second)
+	}
+	assert.Equal(t, 22500*time.Millisecond, hc.timeout())
+}
+
 func testCountTimerWheelEntries(tw *LockingTimerWheel[netip.Addr]) (c int) {
 	for _, i := range tw.t.wheel {
 		n := i.Head
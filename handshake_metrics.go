@@ -0,0 +1,62 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// handshakeStageMetrics are the latencies of the handshakes we initiate, in nanoseconds, for one way of reaching peers
+type handshakeStageMetrics struct {
+	// stage0 is the time from starting the handshake to having our first message ready
+	stage0 metrics.Histogram
+	// lighthouse is the time from starting the handshake to sending our first message, most of which is spent waiting
+	// on a lighthouse for addresses to send to
+	lighthouse metrics.Histogram
+	// stage1 is the time from sending our first message to receiving the answer, retries included
+	stage1 metrics.Histogram
+	// total is the time from starting the handshake to the tunnel being up
+	total metrics.Histogram
+}
+
+func newHandshakeStageMetrics(path string) handshakeStageMetrics {
+	h := func(name string) metrics.Histogram {
+		return metrics.GetOrRegisterHistogram("handshake_manager.latency."+path+"."+name, nil, metrics.NewExpDecaySample(1028, 0.015))
+	}
+	return handshakeStageMetrics{
+		stage0:     h("stage0"),
+		lighthouse: h("lighthouse"),
+		stage1:     h("stage1"),
+		total:      h("total"),
+	}
+}
+
+// handshakeLatencyMetrics splits handshake latencies by whether the tunnel came up directly or through a relay
+type handshakeLatencyMetrics struct {
+	direct handshakeStageMetrics
+	relay  handshakeStageMetrics
+}
+
+func newHandshakeLatencyMetrics() *handshakeLatencyMetrics {
+	return &handshakeLatencyMetrics{
+		direct: newHandshakeStageMetrics("direct"),
+		relay:  newHandshakeStageMetrics("relay"),
+	}
+}
+
+// record adds a handshake we initiated that completed at now
+func (m *handshakeLatencyMetrics) record(hh *HandshakeHostInfo, relayed bool, now time.Time) {
+	s := &m.direct
+	if relayed {
+		s = &m.relay
+	}
+
+	if !hh.readyTime.IsZero() {
+		s.stage0.Update(hh.readyTime.Sub(hh.startTime).Nanoseconds())
+	}
+	if !hh.sentTime.IsZero() {
+		s.lighthouse.Update(hh.sentTime.Sub(hh.startTime).Nanoseconds())
+		s.stage1.Update(now.Sub(hh.sentTime).Nanoseconds())
+	}
+	s.total.Update(now.Sub(hh.startTime).Nanoseconds())
+}
@@ -0,0 +1,38 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeLatencyMetrics_record(t *testing.T) {
+	// The registered histograms are shared with every other test, use our own
+	h := func() metrics.Histogram { return metrics.NewHistogram(metrics.NewUniformSample(10)) }
+	stages := func() handshakeStageMetrics {
+		return handshakeStageMetrics{stage0: h(), lighthouse: h(), stage1: h(), total: h()}
+	}
+	m := &handshakeLatencyMetrics{direct: stages(), relay: stages()}
+	start := time.Unix(1_700_000_000, 0)
+
+	hh := &HandshakeHostInfo{
+		startTime: start,
+		readyTime: start.Add(time.Millisecond),
+		sentTime:  start.Add(50 * time.Millisecond),
+	}
+	m.record(hh, false, start.Add(80*time.Millisecond))
+
+	assert.Equal(t, int64(time.Millisecond), m.direct.stage0.Max())
+	assert.Equal(t, int64(50*time.Millisecond), m.direct.lighthouse.Max())
+	assert.Equal(t, int64(30*time.Millisecond), m.direct.stage1.Max())
+	assert.Equal(t, int64(80*time.Millisecond), m.direct.total.Max())
+	assert.Zero(t, m.relay.total.Count())
+
+	// Relayed tunnels are kept apart, stages we never reached are left out
+	m.record(&HandshakeHostInfo{startTime: start}, true, start.Add(time.Second))
+	assert.Equal(t, int64(1), m.relay.total.Count())
+	assert.Zero(t, m.relay.stage1.Count())
+	assert.Equal(t, int64(1), m.direct.total.Count())
+}
@@ -52,6 +52,9 @@ var typeMap = map[MessageType]string{
 const (
 	MessageNone  MessageSubType = 0
 	MessageRelay MessageSubType = 1
+	// MessageLZ4 and MessageZstd are data messages whose payload was compressed before encryption
+	MessageLZ4  MessageSubType = 2
+	MessageZstd MessageSubType = 3
 )
 
 const (
@@ -62,6 +65,16 @@ const (
 const (
 	HandshakeIXPSK0 MessageSubType = 0
 	HandshakeXXPSK0 MessageSubType = 1
+	// HandshakeResume brings back a tunnel from a session ticket after a restart, see session_resumption.go
+	HandshakeResume MessageSubType = 2
+	// HandshakeRetryAfter is sent by a busy host in place of its half of a handshake, see handshake_admission.go
+	HandshakeRetryAfter MessageSubType = 3
+)
+
+const (
+	ControlNone MessageSubType = 0
+	// ControlRenewCert tells the peer its certificate is expired and was only admitted for a grace period, see cert_grace.go
+	ControlRenewCert MessageSubType = 1
 )
 
 var ErrHeaderTooShort = errors.New("header is too short")
@@ -77,15 +90,22 @@ var subTypeMap = map[MessageType]*map[MessageSubType]string{
 	Message: {
 		MessageNone:  "none",
 		MessageRelay: "relay",
+		MessageLZ4:   "lz4",
+		MessageZstd:  "zstd",
 	},
 	RecvError:   &subTypeNoneMap,
 	LightHouse:  &subTypeNoneMap,
 	Test:        &subTypeTestMap,
 	CloseTunnel: &subTypeNoneMap,
 	Handshake: {
-		HandshakeIXPSK0: "ix_psk0",
+		HandshakeIXPSK0:     "ix_psk0",
+		HandshakeResume:     "resume",
+		HandshakeRetryAfter: "retry_after",
+	},
+	Control: {
+		ControlNone:      "none",
+		ControlRenewCert: "renew_cert",
 	},
-	Control: &subTypeNoneMap,
 }
 
 type H struct {
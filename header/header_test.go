@@ -90,15 +90,22 @@ func TestTypeMap(t *testing.T) {
 		Message: {
 			MessageNone:  "none",
 			MessageRelay: "relay",
+			MessageLZ4:   "lz4",
+			MessageZstd:  "zstd",
 		},
 		RecvError:   &subTypeNoneMap,
 		LightHouse:  &subTypeNoneMap,
 		Test:        &subTypeTestMap,
 		CloseTunnel: &subTypeNoneMap,
 		Handshake: {
-			HandshakeIXPSK0: "ix_psk0",
+			HandshakeIXPSK0:     "ix_psk0",
+			HandshakeResume:     "resume",
+			HandshakeRetryAfter: "retry_after",
+		},
+		Control: {
+			ControlNone:      "none",
+			ControlRenewCert: "renew_cert",
 		},
-		Control: &subTypeNoneMap,
 	}, subTypeMap)
 }
 
@@ -119,3 +126,34 @@ func TestHeader_MarshalJSON(t *testing.T) {
 		string(b),
 	)
 }
+
+func FuzzHeaderDecode(f *testing.F) {
+	for _, tt := range headerBigEndianTests {
+		f.Add(tt.expectedBytes)
+	}
+	f.Add([]byte{})
+	f.Add(Encode(make([]byte, Len), Version, Handshake, HandshakeIXPSK0, 0, 1))
+	f.Add(Encode(make([]byte, Len), Version, Message, MessageRelay, 0xffffffff, 0xffffffffffffffff))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h := &H{}
+		err := h.Parse(b)
+		if len(b) < Len {
+			require.ErrorIs(t, err, ErrHeaderTooShort)
+			return
+		}
+		require.NoError(t, err)
+
+		// A parsed header must encode back to the same bytes, other than reserved which is always written as 0
+		expected := append([]byte{}, b[:Len]...)
+		expected[2], expected[3] = 0, 0
+		out, err := h.Encode(make([]byte, Len))
+		require.NoError(t, err)
+		assert.Equal(t, expected, out)
+
+		_ = h.String()
+		_, _ = h.MarshalJSON()
+		_ = h.TypeName()
+		_ = h.SubTypeName()
+	})
+}
@@ -0,0 +1,157 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// healthCheck returns nil when the thing it checks is healthy
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// health serves /healthz, /livez, and /readyz for container orchestrators
+type health struct {
+	l   *logrus.Logger
+	f   *Interface
+	ctx context.Context
+}
+
+// newHealthFromConfig registers the health endpoints. When prometheus stats are served on the same address the
+// endpoints are added to that listener and nil is returned, otherwise the returned func runs a listener of its own.
+func newHealthFromConfig(ctx context.Context, l *logrus.Logger, c *config.C, f *Interface) (func(context.Context), error) {
+	if !c.GetBool("health.enabled", false) {
+		return nil, nil
+	}
+
+	h := &health{l: l, f: f, ctx: ctx}
+
+	statsListen := ""
+	if c.GetString("stats.type", "") == "prometheus" {
+		statsListen = c.GetString("stats.listen", "")
+	}
+
+	listen := c.GetString("health.listen", statsListen)
+	if listen == "" {
+		return nil, errors.New("health.listen must be provided when prometheus stats are not enabled")
+	}
+
+	if listen == statsListen {
+		// The prometheus listener serves the default mux
+		h.register(http.DefaultServeMux)
+		l.WithField("listen", listen).Info("Health endpoints sharing the stats listener")
+		return nil, nil
+	}
+
+	mux := http.NewServeMux()
+	h.register(mux)
+	return func(ctx context.Context) {
+		h.serve(ctx, listen, mux)
+	}, nil
+}
+
+func (h *health) register(mux *http.ServeMux) {
+	mux.Handle("/healthz", h.handler("healthz", nil))
+	mux.Handle("/livez", h.handler("livez", []healthCheck{{"interface", h.checkRunning}}))
+	mux.Handle("/readyz", h.handler("readyz", []healthCheck{
+		{"interface", h.checkRunning},
+		{"certificate", h.checkCertificate},
+		{"lighthouse", h.checkLighthouse},
+	}))
+}
+
+func (h *health) serve(ctx context.Context, listen string, mux *http.ServeMux) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		h.l.WithError(err).WithField("listen", listen).Error("Failed to start the health listener")
+		return
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	h.l.WithField("listen", listen).Info("Health endpoints listening")
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		h.l.WithError(err).Error("Health listener stopped")
+	}
+}
+
+// handler runs every check and reports each result, the response is a 503 if any of them fail
+func (h *health) handler(name string, checks []healthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		failed := false
+		for _, c := range checks {
+			if err := c.check(); err != nil {
+				failed = true
+				fmt.Fprintf(&b, "[-]%s failed: %s\n", c.name, err)
+			} else {
+				fmt.Fprintf(&b, "[+]%s ok\n", c.name)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(&b, "%s check failed\n", name)
+		} else {
+			fmt.Fprintf(&b, "%s check passed\n", name)
+		}
+		_, _ = w.Write([]byte(b.String()))
+	})
+}
+
+func (h *health) checkRunning() error {
+	if h.ctx.Err() != nil || h.f.closed.Load() {
+		return errors.New("shutting down")
+	}
+
+	if !h.f.activated.Load() {
+		return errors.New("not active yet")
+	}
+
+	return nil
+}
+
+func (h *health) checkCertificate() error {
+	crt := h.f.pki.getCertState().GetDefaultCertificate()
+	now := time.Now()
+	if now.Before(crt.NotBefore()) {
+		return fmt.Errorf("not valid until %s", crt.NotBefore().Format(time.RFC3339))
+	}
+
+	if crt.Expired(now) {
+		return fmt.Errorf("expired at %s", crt.NotAfter().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// checkLighthouse passes if we have a tunnel to at least one lighthouse, or if we do not use lighthouses
+func (h *health) checkLighthouse() error {
+	lighthouses := h.f.lightHouse.GetLighthouses()
+	if h.f.lightHouse.amLighthouse || len(lighthouses) == 0 {
+		return nil
+	}
+
+	for _, addr := range lighthouses {
+		if h.f.hostMap.QueryVpnAddr(addr) != nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no tunnel to any of %d lighthouses", len(lighthouses))
+}
@@ -0,0 +1,103 @@
+package nebula
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	lh := newTestLighthouse()
+	lhAddr := netip.MustParseAddr("172.1.1.1")
+	lh.lighthouses.Store(&[]netip.Addr{lhAddr})
+
+	crt := &dummyCert{version: cert.Version1, notBefore: time.Now().Add(-time.Hour), notAfter: time.Now().Add(time.Hour)}
+	ifce := &Interface{
+		hostMap:    hostMap,
+		lightHouse: lh,
+		pki:        &PKI{},
+		l:          l,
+	}
+	ifce.pki.cs.Store(&CertState{initiatingVersion: cert.Version1, v1Cert: crt})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := &health{l: l, f: ifce, ctx: ctx}
+	mux := http.NewServeMux()
+	h.register(mux)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	// healthz only says the process is up
+	code, _ := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, body := get("/livez")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]interface failed: not active yet")
+
+	ifce.activated.Store(true)
+	code, _ = get("/livez")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Not ready until we can reach a lighthouse
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[+]interface ok")
+	assert.Contains(t, body, "[+]certificate ok")
+	assert.Contains(t, body, "[-]lighthouse failed: no tunnel to any of 1 lighthouses")
+
+	hostMap.unlockedAddHostInfo(&HostInfo{vpnAddrs: []netip.Addr{lhAddr}, localIndexId: 1, ConnectionState: &ConnectionState{}}, ifce)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, "readyz check passed")
+
+	crt.notBefore = time.Now().Add(time.Hour)
+	code, body = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]certificate failed: not valid until")
+
+	// Shutting down fails liveness but healthz keeps answering
+	cancel()
+	code, body = get("/livez")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, body, "[-]interface failed: shutting down")
+
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestNewHealthFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	start, err := newHealthFromConfig(context.Background(), l, c, &Interface{})
+	require.NoError(t, err)
+	assert.Nil(t, start)
+
+	// Without prometheus there is no port to share
+	c.Settings["health"] = map[string]any{"enabled": true}
+	_, err = newHealthFromConfig(context.Background(), l, c, &Interface{})
+	require.Error(t, err)
+
+	c.Settings["health"] = map[string]any{"enabled": true, "listen": "127.0.0.1:0"}
+	start, err = newHealthFromConfig(context.Background(), l, c, &Interface{})
+	require.NoError(t, err)
+	assert.NotNil(t, start)
+}
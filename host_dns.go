@@ -0,0 +1,193 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/hostdns"
+)
+
+// hostDns keeps the host resolver sending host_dns.domain to nebula DNS while nebula runs
+type hostDns struct {
+	l      *logrus.Logger
+	device string
+
+	sync.Mutex
+	cfg     *hostdns.Config
+	revert  func() error
+	started bool
+}
+
+func newHostDnsFromConfig(l *logrus.Logger, c *config.C, device string) (*hostDns, error) {
+	h := &hostDns{l: l, device: device}
+
+	cfg, err := h.parse(c)
+	if err != nil {
+		return nil, err
+	}
+	h.cfg = cfg
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if !c.HasChanged("host_dns") && !c.HasChanged("lighthouse") {
+			return
+		}
+
+		cfg, err := h.parse(c)
+		if err != nil {
+			h.l.WithError(err).Error("Failed to reload host_dns, keeping the previous settings")
+			return
+		}
+
+		h.Lock()
+		defer h.Unlock()
+		if hostDnsConfigEqual(h.cfg, cfg) {
+			return
+		}
+		h.cfg = cfg
+		if h.started {
+			h.apply()
+		}
+	})
+
+	return h, nil
+}
+
+// parse returns the registration host_dns asks for, nil when it is disabled
+func (h *hostDns) parse(c *config.C) (*hostdns.Config, error) {
+	if !c.GetBool("host_dns.enabled", false) {
+		return nil, nil
+	}
+
+	cfg := &hostdns.Config{
+		Domain: strings.ToLower(strings.Trim(c.GetString("host_dns.domain", ""), ".")),
+		Device: h.device,
+	}
+	if cfg.Domain == "" {
+		return nil, errors.New("host_dns.domain must be set")
+	}
+
+	for i, raw := range c.GetStringSlice("host_dns.servers", []string{}) {
+		s, err := parseDnsServer(raw)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v in host_dns.servers is invalid: %w", i+1, err)
+		}
+		cfg.Servers = append(cfg.Servers, s)
+	}
+
+	if len(cfg.Servers) > 0 {
+		return cfg, nil
+	}
+
+	// By default ask our own dns listener if we have one, otherwise the lighthouses
+	if c.GetBool("lighthouse.am_lighthouse", false) && c.GetBool("lighthouse.serve_dns", false) {
+		ap, err := netip.ParseAddrPort(getDnsServerAddr(c))
+		if err != nil {
+			return nil, fmt.Errorf("lighthouse.dns.host is not an ip address: %w", err)
+		}
+		addr := ap.Addr()
+		if addr.IsUnspecified() {
+			addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+		cfg.Servers = append(cfg.Servers, netip.AddrPortFrom(addr, ap.Port()))
+		return cfg, nil
+	}
+
+	for _, raw := range c.GetStringSlice("lighthouse.hosts", []string{}) {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			// lighthouse.hosts validation has more to say about this
+			continue
+		}
+		cfg.Servers = append(cfg.Servers, netip.AddrPortFrom(addr, 53))
+	}
+
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("host_dns.servers must be set when there are no lighthouses")
+	}
+
+	return cfg, nil
+}
+
+// parseDnsServer accepts an ip, which uses port 53, or an ip and port
+func parseDnsServer(raw string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(raw); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+
+	host, port, err := net.SplitHostPort(raw)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+func hostDnsConfigEqual(a, b *hostdns.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Domain == b.Domain && a.Device == b.Device && slices.Equal(a.Servers, b.Servers)
+}
+
+// apply replaces whatever is registered with the current config, the lock must be held
+func (h *hostDns) apply() {
+	h.unset()
+	if h.cfg == nil {
+		return
+	}
+
+	revert, err := hostdns.Set(h.l, *h.cfg)
+	if errors.Is(err, hostdns.ErrNotSupported) {
+		h.l.Warn("host_dns is not supported on this platform")
+		return
+	} else if err != nil {
+		h.l.WithError(err).WithField("domain", h.cfg.Domain).Error("Failed to configure host dns")
+		return
+	}
+
+	h.revert = revert
+	h.l.WithField("domain", h.cfg.Domain).WithField("servers", h.cfg.Servers).Info("Configured host dns")
+}
+
+// unset removes our registration if there is one, the lock must be held
+func (h *hostDns) unset() {
+	if h.revert == nil {
+		return
+	}
+
+	if err := h.revert(); err != nil {
+		h.l.WithError(err).Error("Failed to remove host dns configuration")
+	}
+	h.revert = nil
+}
+
+// Start registers the domain once the tun device is up
+func (h *hostDns) Start() {
+	h.Lock()
+	defer h.Unlock()
+	h.started = true
+	h.apply()
+}
+
+// Stop removes the registration, it runs before the tun device goes away
+func (h *hostDns) Stop() {
+	h.Lock()
+	defer h.Unlock()
+	h.started = false
+	h.unset()
+}
@@ -0,0 +1,60 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/hostdns"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostDns_parse(t *testing.T) {
+	l := test.NewLogger()
+	h := &hostDns{l: l, device: "nebula1"}
+	c := config.NewC(l)
+
+	cfg, err := h.parse(c)
+	require.NoError(t, err)
+	assert.Nil(t, cfg)
+
+	c.Settings["host_dns"] = map[string]any{"enabled": true}
+	_, err = h.parse(c)
+	require.EqualError(t, err, "host_dns.domain must be set")
+
+	c.Settings["host_dns"] = map[string]any{"enabled": true, "domain": ".Neb."}
+	_, err = h.parse(c)
+	require.EqualError(t, err, "host_dns.servers must be set when there are no lighthouses")
+
+	// Lighthouses are asked by default
+	c.Settings["lighthouse"] = map[string]any{"hosts": []any{"10.0.0.1", "10.0.0.2"}}
+	cfg, err = h.parse(c)
+	require.NoError(t, err)
+	assert.Equal(t, &hostdns.Config{
+		Domain:  "neb",
+		Device:  "nebula1",
+		Servers: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:53"), netip.MustParseAddrPort("10.0.0.2:53")},
+	}, cfg)
+
+	// A lighthouse serving dns asks itself
+	c.Settings["lighthouse"] = map[string]any{
+		"am_lighthouse": true,
+		"serve_dns":     true,
+		"dns":           map[string]any{"host": "0.0.0.0", "port": 5353},
+	}
+	cfg, err = h.parse(c)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:5353")}, cfg.Servers)
+
+	// Explicit servers win
+	c.Settings["host_dns"] = map[string]any{"enabled": true, "domain": "neb", "servers": []any{"10.0.0.9", "[fd00::9]:5353"}}
+	cfg, err = h.parse(c)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("10.0.0.9:53"), netip.MustParseAddrPort("[fd00::9]:5353")}, cfg.Servers)
+
+	c.Settings["host_dns"] = map[string]any{"enabled": true, "domain": "neb", "servers": []any{"dns.example"}}
+	_, err = h.parse(c)
+	require.ErrorContains(t, err, "entry 1 in host_dns.servers is invalid")
+}
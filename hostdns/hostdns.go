@@ -0,0 +1,85 @@
+// Package hostdns points the host resolver at nebula DNS for a single domain, so overlay hostnames resolve system-wide
+// while every other name keeps using the resolvers the host already has.
+package hostdns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrNotSupported = errors.New("host dns integration is not supported on this platform")
+
+// Config is a split DNS registration
+type Config struct {
+	// Domain is the suffix to resolve through Servers, without leading or trailing dots
+	Domain  string
+	Servers []netip.AddrPort
+	// Device is our tun device, systemd-resolved attaches the configuration to it
+	Device string
+}
+
+// Set registers cfg with the host resolver. The returned func removes the registration again and must be called
+// before nebula exits, some platforms would otherwise keep sending the domain to a server that is gone.
+func Set(l *logrus.Logger, cfg Config) (func() error, error) {
+	if cfg.Domain == "" {
+		return nil, errors.New("a domain is required")
+	}
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("at least one server is required")
+	}
+	return set(l, cfg)
+}
+
+// resolvectlArgs returns the resolvectl invocations that send Domain to Servers over Device
+func resolvectlArgs(cfg Config) [][]string {
+	dns := []string{"dns", cfg.Device}
+	for _, s := range cfg.Servers {
+		if s.Port() == 53 {
+			dns = append(dns, s.Addr().String())
+		} else {
+			dns = append(dns, s.String())
+		}
+	}
+
+	// The ~ makes it a routing only domain, it is not added to the search list
+	return [][]string{dns, {"domain", cfg.Device, "~" + cfg.Domain}}
+}
+
+// resolverHeader marks the files in /etc/resolver that we wrote and may remove
+const resolverHeader = "# Added by nebula, removed when it stops\n"
+
+// resolverFile returns the contents of a macOS /etc/resolver file for cfg. The format only has a single port, servers
+// using any other port than the first are left out.
+func resolverFile(l *logrus.Logger, cfg Config) string {
+	var b strings.Builder
+	b.WriteString(resolverHeader)
+
+	port := cfg.Servers[0].Port()
+	for _, s := range cfg.Servers {
+		if s.Port() != port {
+			l.WithField("server", s).Warn("Skipping host dns server, every server must use the same port on this platform")
+			continue
+		}
+		fmt.Fprintf(&b, "nameserver %s\n", s.Addr())
+	}
+	fmt.Fprintf(&b, "port %d\n", port)
+
+	return b.String()
+}
+
+// nrptServers returns the server list for a Windows NRPT rule, which can only use port 53
+func nrptServers(l *logrus.Logger, cfg Config) string {
+	var servers []string
+	for _, s := range cfg.Servers {
+		if s.Port() != 53 {
+			l.WithField("server", s).Warn("Skipping host dns server, only port 53 is supported on this platform")
+			continue
+		}
+		servers = append(servers, s.Addr().String())
+	}
+	return strings.Join(servers, "; ")
+}
@@ -0,0 +1,44 @@
+//go:build !ios
+
+package hostdns
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const resolverDir = "/etc/resolver"
+
+func set(l *logrus.Logger, cfg Config) (func() error, error) {
+	path := filepath.Join(resolverDir, cfg.Domain)
+
+	// Never replace a resolver someone else configured
+	b, err := os.ReadFile(path)
+	if err == nil && !strings.HasPrefix(string(b), resolverHeader) {
+		return nil, fmt.Errorf("%s already exists and was not written by nebula", path)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(resolverDir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, []byte(resolverFile(l, cfg)), 0644); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,39 @@
+//go:build !android
+
+package hostdns
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+func set(l *logrus.Logger, cfg Config) (func() error, error) {
+	resolvectl, err := exec.LookPath("resolvectl")
+	if err != nil {
+		return nil, fmt.Errorf("systemd-resolved is required: %w", err)
+	}
+
+	revert := func() error {
+		return run(resolvectl, "revert", cfg.Device)
+	}
+
+	for _, args := range resolvectlArgs(cfg) {
+		if err := run(resolvectl, args...); err != nil {
+			_ = revert()
+			return nil, err
+		}
+	}
+
+	return revert, nil
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
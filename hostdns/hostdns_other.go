@@ -0,0 +1,10 @@
+//go:build android || ios || !(linux || darwin || windows)
+
+package hostdns
+
+import "github.com/sirupsen/logrus"
+
+// set is not available here, mobile platforms configure DNS through their VPN APIs instead
+func set(_ *logrus.Logger, _ Config) (func() error, error) {
+	return nil, ErrNotSupported
+}
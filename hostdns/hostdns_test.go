@@ -0,0 +1,40 @@
+package hostdns
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSet_validates(t *testing.T) {
+	l := test.NewLogger()
+	_, err := Set(l, Config{Servers: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:53")}})
+	require.EqualError(t, err, "a domain is required")
+
+	_, err = Set(l, Config{Domain: "neb"})
+	require.EqualError(t, err, "at least one server is required")
+}
+
+func TestFormats(t *testing.T) {
+	l := test.NewLogger()
+	cfg := Config{
+		Domain: "neb",
+		Device: "nebula1",
+		Servers: []netip.AddrPort{
+			netip.MustParseAddrPort("10.0.0.1:53"),
+			netip.MustParseAddrPort("[fd00::1]:53"),
+			netip.MustParseAddrPort("10.0.0.2:5353"),
+		},
+	}
+
+	assert.Equal(t, [][]string{
+		{"dns", "nebula1", "10.0.0.1", "fd00::1", "10.0.0.2:5353"},
+		{"domain", "nebula1", "~neb"},
+	}, resolvectlArgs(cfg))
+
+	assert.Equal(t, resolverHeader+"nameserver 10.0.0.1\nnameserver fd00::1\nport 53\n", resolverFile(l, cfg))
+	assert.Equal(t, "10.0.0.1; fd00::1", nrptServers(l, cfg))
+}
@@ -0,0 +1,54 @@
+package hostdns
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/registry"
+)
+
+// nrptKey holds the local Name Resolution Policy Table, the DNS client picks up changes to it on its own
+const nrptKey = `SYSTEM\CurrentControlSet\Services\Dnscache\Parameters\DnsPolicyConfig`
+
+func set(l *logrus.Logger, cfg Config) (func() error, error) {
+	servers := nrptServers(l, cfg)
+	if servers == "" {
+		return nil, fmt.Errorf("no usable servers")
+	}
+
+	path := nrptKey + `\nebula-` + cfg.Domain
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, path, registry.SET_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the NRPT rule: %w", err)
+	}
+	defer k.Close()
+
+	revert := func() error {
+		return registry.DeleteKey(registry.LOCAL_MACHINE, path)
+	}
+
+	err = setValues(k, cfg.Domain, servers)
+	if err != nil {
+		_ = revert()
+		return nil, fmt.Errorf("failed to write the NRPT rule: %w", err)
+	}
+
+	return revert, nil
+}
+
+func setValues(k registry.Key, domain, servers string) error {
+	if err := k.SetDWordValue("Version", 2); err != nil {
+		return err
+	}
+	if err := k.SetStringsValue("Name", []string{"." + domain}); err != nil {
+		return err
+	}
+	if err := k.SetStringValue("GenericDNSServers", servers); err != nil {
+		return err
+	}
+	// Only the generic DNS servers option is in use
+	if err := k.SetDWordValue("ConfigOptions", 8); err != nil {
+		return err
+	}
+	return k.SetStringValue("IPSECCARestriction", "")
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/netip"
 	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -60,6 +61,7 @@ type HostMap struct {
 	RemoteIndexes   map[uint32]*HostInfo
 	Hosts           map[netip.Addr]*HostInfo
 	preferredRanges atomic.Pointer[[]netip.Prefix]
+	latencyConfig   atomic.Pointer[latencyConfig]
 	l               *logrus.Logger
 }
 
@@ -153,6 +155,20 @@ func (rs *RelayState) CopyRelayForIps() []netip.Addr {
 	return currentRelays
 }
 
+// HasRelays reports if we know of any relays to reach this host through
+func (rs *RelayState) HasRelays() bool {
+	rs.RLock()
+	defer rs.RUnlock()
+	return len(rs.relays) > 0
+}
+
+// HasRelayFor reports if we are a relay for this host
+func (rs *RelayState) HasRelayFor() bool {
+	rs.RLock()
+	defer rs.RUnlock()
+	return len(rs.relayForByAddr) > 0
+}
+
 func (rs *RelayState) CopyRelayForIdxs() []uint32 {
 	rs.RLock()
 	defer rs.RUnlock()
@@ -255,6 +271,8 @@ type HostInfo struct {
 	// for a punch from the remote end of this tunnel. The goal being to prime their conntrack for our traffic just like
 	// with a handshake
 	lastRebindCount int8
+	// lastRebind is when this tunnel last noticed a rebind and asked the lighthouse for a punch
+	lastRebind time.Time
 
 	// lastHandshakeTime records the time the remote side told us about at the stage when the handshake was completed locally
 	// Stage 1 packet will contain it if I am a responder, stage 2 packet if I am an initiator
@@ -264,6 +282,31 @@ type HostInfo struct {
 	lastRoam       time.Time
 	lastRoamRemote netip.AddrPort
 
+	// remoteHistory holds the underlay addresses we recently got packets from for this tunnel
+	remoteHistory remoteHistory
+
+	// counters tracks the data packets and bytes sent and received over this tunnel
+	counters tunnelCounters
+
+	// paths tracks the round trip time to each remote when preferred_latency or relay.discover is enabled
+	paths pathLatency
+
+	// pathMTU is set when a packet did not fit the path to remote, see listen.path_mtu_discovery
+	pathMTU atomic.Pointer[learnedMTU]
+
+	// tunWriteFailures counts our unreachable tun writes of this host's packets in a row, and tunHeldUntil is when we
+	// hand its packets to the tun device again after too many, see tun.write_errors
+	tunWriteFailures atomic.Uint32
+	tunHeldUntil     atomic.Int64
+
+	// certInGrace is set when the peer certificate was admitted within pki.expired_grace, certRenewRequested is when we
+	// last asked the peer to renew it
+	certInGrace        atomic.Bool
+	certRenewRequested atomic.Int64
+
+	// clockSkew is how far the peer's clock was ahead of ours when last measured, nil until a test reply told us
+	clockSkew atomic.Pointer[time.Duration]
+
 	// Used to track other hostinfos for this vpn ip since only 1 can be primary
 	// Synchronised via hostmap lock and not the hostinfo lock.
 	next, prev *HostInfo
@@ -275,6 +318,35 @@ type HostInfo struct {
 	// This value will be behind against actual tunnel utilization in the hot path.
 	// This should only be used by the ConnectionManagers ticker routine.
 	lastUsed time.Time
+	// lastUsedNano mirrors lastUsed in unix nanoseconds for readers outside the ConnectionManager, like Control.QueryHostmap
+	lastUsedNano atomic.Int64
+
+	// auditedInvalidCert is set once pki.disconnect_invalid audit has logged this tunnel's invalid certificate.
+	// This should only be used by the ConnectionManagers ticker routine.
+	auditedInvalidCert bool
+	// rehandshakedInvalidCert is set once we have tried a new handshake because the peer certificate is no longer valid.
+	// This should only be used by the ConnectionManagers ticker routine.
+	rehandshakedInvalidCert bool
+}
+
+// tunnelCounters counts the data packets that made it through a tunnel, control traffic is not included
+type tunnelCounters struct {
+	txPackets, txBytes atomic.Uint64
+	rxPackets, rxBytes atomic.Uint64
+
+	// The bytes of data packets before and after compression, only packets that went through the compressor count
+	txCompressIn, txCompressOut     atomic.Uint64
+	rxDecompressIn, rxDecompressOut atomic.Uint64
+}
+
+func (c *tunnelCounters) tx(n int) {
+	c.txPackets.Add(1)
+	c.txBytes.Add(uint64(n))
+}
+
+func (c *tunnelCounters) rx(n int) {
+	c.rxPackets.Add(1)
+	c.rxBytes.Add(uint64(n))
 }
 
 type ViaSender struct {
@@ -358,21 +430,132 @@ func (hm *HostMap) reload(c *config.C, initial bool) {
 			hm.l.WithField("oldPreferredRanges", *oldRanges).WithField("newPreferredRanges", preferredRanges).Info("preferred_ranges changed")
 		}
 	}
+
+	if initial || c.HasChanged("preferred_latency") {
+		lc := newLatencyConfigFromConfig(c)
+		hm.latencyConfig.Store(lc)
+		if !initial {
+			if lc != nil {
+				hm.l.WithField("hysteresis", lc.hysteresis).Info("preferred_latency enabled")
+			} else {
+				hm.l.Info("preferred_latency disabled")
+			}
+		}
+	}
 }
 
-// EmitStats reports host, index, and relay counts to the stats collection system
+// certExpiryBuckets are the windows peer certificate expiry is counted in, each bucket includes the ones before it
+var certExpiryBuckets = []struct {
+	name   string
+	within time.Duration
+}{
+	{"expired", 0},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// hostMapSummary describes the established tunnels in the hostmap
+type hostMapSummary struct {
+	tunnels int64
+	relayed int64
+	// ciphers and curves count tunnels by the cipher and curve they use
+	ciphers map[string]int64
+	curves  map[string]int64
+	// certExpiring counts peers by certExpiryBuckets
+	certExpiring []int64
+}
+
+func (hm *HostMap) summarize(now time.Time) hostMapSummary {
+	s := hostMapSummary{
+		ciphers:      map[string]int64{"aes": 0, "chachapoly": 0, "null": 0},
+		curves:       map[string]int64{},
+		certExpiring: make([]int64, len(certExpiryBuckets)),
+	}
+	for _, name := range cert.Curve_name {
+		s.curves[strings.ToLower(name)] = 0
+	}
+
+	hm.RLock()
+	defer hm.RUnlock()
+
+	for _, h := range hm.Indexes {
+		s.tunnels++
+		if !h.remote.IsValid() {
+			s.relayed++
+		}
+
+		ci := h.ConnectionState
+		if ci == nil {
+			continue
+		}
+		if ci.nullCipher {
+			s.ciphers["null"]++
+		} else {
+			s.ciphers[ci.cipher]++
+		}
+		if ci.myCert != nil {
+			s.curves[strings.ToLower(ci.myCert.Curve().String())]++
+		}
+	}
+
+	// A peer with addresses from more than one network is in Hosts more than once
+	seen := map[*HostInfo]struct{}{}
+	for _, h := range hm.Hosts {
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+
+		c := h.GetCert()
+		if c == nil {
+			continue
+		}
+		left := c.Certificate.NotAfter().Sub(now)
+		for i, b := range certExpiryBuckets {
+			if left <= b.within {
+				s.certExpiring[i]++
+			}
+		}
+	}
+
+	return s
+}
+
+// EmitStats reports host, index, relay, and null cipher tunnel counts to the stats collection system, along with a
+// summary of the established tunnels
 func (hm *HostMap) EmitStats() {
 	hm.RLock()
 	hostLen := len(hm.Hosts)
 	indexLen := len(hm.Indexes)
 	remoteIndexLen := len(hm.RemoteIndexes)
 	relaysLen := len(hm.Relays)
+	nullCipherLen := 0
+	for _, h := range hm.Indexes {
+		if h.ConnectionState != nil && h.ConnectionState.nullCipher {
+			nullCipherLen++
+		}
+	}
 	hm.RUnlock()
 
 	metrics.GetOrRegisterGauge("hostmap.main.hosts", nil).Update(int64(hostLen))
 	metrics.GetOrRegisterGauge("hostmap.main.indexes", nil).Update(int64(indexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.remoteIndexes", nil).Update(int64(remoteIndexLen))
 	metrics.GetOrRegisterGauge("hostmap.main.relayIndexes", nil).Update(int64(relaysLen))
+	metrics.GetOrRegisterGauge("hostmap.main.nullCipher", nil).Update(int64(nullCipherLen))
+
+	s := hm.summarize(time.Now())
+	metrics.GetOrRegisterGauge("hostmap.main.tunnels.total", nil).Update(s.tunnels)
+	metrics.GetOrRegisterGauge("hostmap.main.tunnels.direct", nil).Update(s.tunnels - s.relayed)
+	metrics.GetOrRegisterGauge("hostmap.main.tunnels.relayed", nil).Update(s.relayed)
+	for name, n := range s.ciphers {
+		metrics.GetOrRegisterGauge("hostmap.main.tunnels.cipher."+name, nil).Update(n)
+	}
+	for name, n := range s.curves {
+		metrics.GetOrRegisterGauge("hostmap.main.tunnels.curve."+name, nil).Update(n)
+	}
+	for i, b := range certExpiryBuckets {
+		metrics.GetOrRegisterGauge("hostmap.main.peers.cert_expiring."+b.name, nil).Update(s.certExpiring[i])
+	}
 }
 
 // DeleteHostInfo will fully unlink the hostinfo and return true if it was the final hostinfo for this vpn ip
@@ -608,6 +791,10 @@ func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 		remoteCert := hostinfo.ConnectionState.peerCert
 		dnsR.Add(remoteCert.Certificate.Name()+".", hostinfo.vpnAddrs)
 	}
+	if existing := hm.Hosts[hostinfo.vpnAddrs[0]]; existing != nil {
+		logPeerCertChange(hm.l, existing, hostinfo)
+	}
+
 	for _, addr := range hostinfo.vpnAddrs {
 		hm.unlockedInnerAddHostInfo(addr, hostinfo, f)
 	}
@@ -622,6 +809,20 @@ func (hm *HostMap) unlockedAddHostInfo(hostinfo *HostInfo, f *Interface) {
 	}
 }
 
+// logPeerCertChange notes when a new tunnel to a peer brings a different certificate than the tunnel it replaces,
+// the identity the firewall sees for the peer changes with it
+func logPeerCertChange(l *logrus.Logger, existing, hostinfo *HostInfo) {
+	oldCert, newCert := existing.GetCert(), hostinfo.GetCert()
+	if oldCert == nil || newCert == nil || oldCert.Fingerprint == newCert.Fingerprint {
+		return
+	}
+
+	hostinfo.logger(l).
+		WithField("oldCertificate", m{"fingerprint": oldCert.Fingerprint, "name": oldCert.Certificate.Name(), "groups": oldCert.Certificate.Groups()}).
+		WithField("newCertificate", m{"fingerprint": newCert.Fingerprint, "name": newCert.Certificate.Name(), "groups": newCert.Certificate.Groups()}).
+		Info("Peer certificate changed")
+}
+
 func (hm *HostMap) unlockedInnerAddHostInfo(vpnAddr netip.Addr, hostinfo *HostInfo, f *Interface) {
 	existing := hm.Hosts[vpnAddr]
 	hm.Hosts[vpnAddr] = hostinfo
@@ -647,6 +848,11 @@ func (hm *HostMap) GetPreferredRanges() []netip.Prefix {
 	return *hm.preferredRanges.Load()
 }
 
+// GetLatencyConfig returns the preferred_latency config, or nil if latency based path selection is disabled
+func (hm *HostMap) GetLatencyConfig() *latencyConfig {
+	return hm.latencyConfig.Load()
+}
+
 func (hm *HostMap) ForEachVpnAddr(f controlEach) {
 	hm.RLock()
 	defer hm.RUnlock()
@@ -670,27 +876,12 @@ func (hm *HostMap) ForEachIndex(f controlEach) {
 func (i *HostInfo) TryPromoteBest(preferredRanges []netip.Prefix, ifce *Interface) {
 	c := i.promoteCounter.Add(1)
 	if c%ifce.tryPromoteEvery.Load() == 0 {
-		remote := i.remote
-
-		// return early if we are already on a preferred remote
-		if remote.IsValid() {
-			rIP := remote.Addr()
-			for _, l := range preferredRanges {
-				if l.Contains(rIP) {
-					return
-				}
-			}
+		if ifce.hostMap.GetLatencyConfig() != nil {
+			// Measure every path and let handleLatencyReply pick the fastest
+			i.probeLatency(preferredRanges, ifce)
+		} else {
+			i.probePreferred(preferredRanges, ifce)
 		}
-
-		i.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, preferred bool) {
-			if remote.IsValid() && (!addr.IsValid() || !preferred) {
-				return
-			}
-
-			// Try to send a test packet to that host, this should
-			// cause it to detect a roaming event and switch remotes
-			ifce.sendTo(header.Test, header.TestRequest, i.ConnectionState, i, addr, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
-		})
 	}
 
 	// Re query our lighthouses for new remotes occasionally
@@ -705,6 +896,31 @@ func (i *HostInfo) TryPromoteBest(preferredRanges []netip.Prefix, ifce *Interfac
 	}
 }
 
+// probePreferred sends a test packet to our preferred remotes if we are not already on one
+func (i *HostInfo) probePreferred(preferredRanges []netip.Prefix, ifce *Interface) {
+	remote := i.remote
+
+	// return early if we are already on a preferred remote
+	if remote.IsValid() {
+		rIP := remote.Addr()
+		for _, l := range preferredRanges {
+			if l.Contains(rIP) {
+				return
+			}
+		}
+	}
+
+	i.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, preferred bool) {
+		if remote.IsValid() && (!addr.IsValid() || !preferred) {
+			return
+		}
+
+		// Try to send a test packet to that host, this should
+		// cause it to detect a roaming event and switch remotes
+		ifce.sendTo(header.Test, header.TestRequest, i.ConnectionState, i, addr, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+	})
+}
+
 func (i *HostInfo) GetCert() *cert.CachedCertificate {
 	if i.ConnectionState != nil {
 		return i.ConnectionState.peerCert
@@ -0,0 +1,160 @@
+package nebula
+
+import (
+	"container/heap"
+	"net/netip"
+	"time"
+)
+
+// defaultHostmapPageSize is used when HostmapQuery.Limit is not set
+const defaultHostmapPageSize = 500
+
+// HostmapRelayUsage selects hosts by how relays are involved in their tunnel, see HostmapQuery
+type HostmapRelayUsage int
+
+const (
+	// HostmapRelayAny does not filter on relays
+	HostmapRelayAny HostmapRelayUsage = iota
+	// HostmapRelayNone matches tunnels with a direct path
+	HostmapRelayNone
+	// HostmapRelayVia matches tunnels that only reach the host through a relay
+	HostmapRelayVia
+	// HostmapRelayingFor matches hosts we are a relay for
+	HostmapRelayingFor
+)
+
+// HostmapQuery selects a page of hosts, in vpn address order, for Control.QueryHostmap. The zero value returns the first
+// page of the main hostmap.
+type HostmapQuery struct {
+	// Pending lists the hosts we are handshaking with instead of the main hostmap
+	Pending bool
+
+	// After resumes the listing after this vpn address, pass HostmapPage.Next to get the following page
+	After netip.Addr
+	// Limit caps how many hosts are returned, defaults to 500
+	Limit int
+
+	// Group only matches hosts with this group in their certificate
+	Group string
+	// Relay only matches hosts by how relays are involved in their tunnel
+	Relay HostmapRelayUsage
+	// StaleFor only matches tunnels the connection manager has not seen traffic on for at least this long
+	StaleFor time.Duration
+}
+
+// HostmapPage is a single page of a hostmap listing
+type HostmapPage struct {
+	Hosts []ControlHostInfo `json:"hosts"`
+	// Next is where the following page starts, it is invalid when this was the last page
+	Next netip.Addr `json:"next"`
+	// Matched is how many hosts after HostmapQuery.After matched the query, including the ones in this page
+	Matched int `json:"matched"`
+}
+
+func (q *HostmapQuery) matches(h *HostInfo, now time.Time) bool {
+	if len(h.vpnAddrs) == 0 || !h.vpnAddrs[0].IsValid() {
+		return false
+	}
+
+	if q.After.IsValid() && h.vpnAddrs[0].Compare(q.After) <= 0 {
+		return false
+	}
+
+	if q.Group != "" && !hostInGroups(h, []string{q.Group}) {
+		return false
+	}
+
+	switch q.Relay {
+	case HostmapRelayNone:
+		if !h.remote.IsValid() {
+			return false
+		}
+	case HostmapRelayVia:
+		if h.remote.IsValid() || !h.relayState.HasRelays() {
+			return false
+		}
+	case HostmapRelayingFor:
+		if !h.relayState.HasRelayFor() {
+			return false
+		}
+	}
+
+	if q.StaleFor > 0 {
+		lastUsed := h.lastUsedNano.Load()
+		// Tunnels the connection manager has not checked yet are new, not stale
+		if lastUsed == 0 || now.Sub(time.Unix(0, lastUsed)) < q.StaleFor {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostmapPageHeap keeps the lowest vpn addresses seen so far with the highest on top, so it can be evicted in favor of
+// a lower one
+type hostmapPageHeap []*HostInfo
+
+func (h hostmapPageHeap) Len() int { return len(h) }
+func (h hostmapPageHeap) Less(i, j int) bool {
+	return h[i].vpnAddrs[0].Compare(h[j].vpnAddrs[0]) > 0
+}
+func (h hostmapPageHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *hostmapPageHeap) Push(x any)   { *h = append(*h, x.(*HostInfo)) }
+func (h *hostmapPageHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// queryHostmap walks hl once, holding its lock only for the walk, and keeps just the hosts that make up the requested
+// page. Hosts are only copied after the lock is released.
+func queryHostmap(hl controlHostLister, q HostmapQuery, now time.Time) HostmapPage {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultHostmapPageSize
+	}
+
+	page := HostmapPage{}
+	seen := map[*HostInfo]struct{}{}
+	top := make(hostmapPageHeap, 0, limit+1)
+	hl.ForEachVpnAddr(func(h *HostInfo) {
+		// Hosts with multiple vpn addresses are visited once per address, they are rare enough to track on their own
+		if len(h.vpnAddrs) > 1 {
+			if _, ok := seen[h]; ok {
+				return
+			}
+			seen[h] = struct{}{}
+		}
+
+		if !q.matches(h, now) {
+			return
+		}
+
+		page.Matched++
+		if len(top) == limit && h.vpnAddrs[0].Compare(top[0].vpnAddrs[0]) > 0 {
+			return
+		}
+
+		heap.Push(&top, h)
+		if len(top) > limit {
+			heap.Pop(&top)
+		}
+	})
+
+	page.Hosts = make([]ControlHostInfo, len(top))
+	pr := hl.GetPreferredRanges()
+	for i := len(top) - 1; i >= 0; i-- {
+		page.Hosts[i] = copyHostInfo(heap.Pop(&top).(*HostInfo), pr)
+	}
+
+	if hm, ok := hl.(*HandshakeManager); ok {
+		hm.handshakeProgress(page.Hosts)
+	}
+
+	if page.Matched > len(page.Hosts) {
+		page.Next = page.Hosts[len(page.Hosts)-1].VpnAddrs[0]
+	}
+
+	return page
+}
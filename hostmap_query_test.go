@@ -0,0 +1,121 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHostmap(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	hm.preferredRanges.Store(&[]netip.Prefix{})
+	now := time.Now()
+
+	addHost := func(i int, groups []string) *HostInfo {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+
+		h := &HostInfo{
+			remote:       netip.MustParseAddrPort("1.2.3.4:4242"),
+			remotes:      NewRemoteList(nil, nil),
+			localIndexId: uint32(i),
+			vpnAddrs:     []netip.Addr{netip.AddrFrom4([4]byte{10, 128, 0, byte(i)})},
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: inverted},
+			},
+			relayState: RelayState{
+				relayForByAddr: map[netip.Addr]*Relay{},
+				relayForByIdx:  map[uint32]*Relay{},
+			},
+		}
+		h.lastUsedNano.Store(now.UnixNano())
+		hm.unlockedAddHostInfo(h, &Interface{})
+		return h
+	}
+
+	for i := 10; i > 0; i-- {
+		groups := []string{"all"}
+		if i%2 == 0 {
+			groups = append(groups, "even")
+		}
+		addHost(i, groups)
+	}
+
+	addrs := func(p HostmapPage) []netip.Addr {
+		var out []netip.Addr
+		for _, h := range p.Hosts {
+			out = append(out, h.VpnAddrs[0])
+		}
+		return out
+	}
+	addr := func(i byte) netip.Addr { return netip.AddrFrom4([4]byte{10, 128, 0, i}) }
+
+	// Page through everything in order
+	p := queryHostmap(hm, HostmapQuery{Limit: 4}, now)
+	assert.Equal(t, []netip.Addr{addr(1), addr(2), addr(3), addr(4)}, addrs(p))
+	assert.Equal(t, 10, p.Matched)
+	assert.Equal(t, addr(4), p.Next)
+
+	p = queryHostmap(hm, HostmapQuery{Limit: 4, After: p.Next}, now)
+	assert.Equal(t, []netip.Addr{addr(5), addr(6), addr(7), addr(8)}, addrs(p))
+	assert.Equal(t, 6, p.Matched)
+
+	p = queryHostmap(hm, HostmapQuery{Limit: 4, After: p.Next}, now)
+	assert.Equal(t, []netip.Addr{addr(9), addr(10)}, addrs(p))
+	assert.False(t, p.Next.IsValid())
+
+	// Filters
+	p = queryHostmap(hm, HostmapQuery{Group: "even", Limit: 2}, now)
+	assert.Equal(t, []netip.Addr{addr(2), addr(4)}, addrs(p))
+	assert.Equal(t, 5, p.Matched)
+
+	p = queryHostmap(hm, HostmapQuery{Group: "nope"}, now)
+	assert.Empty(t, p.Hosts)
+	assert.False(t, p.Next.IsValid())
+
+	relayed := hm.Hosts[addr(3)]
+	relayed.remote = netip.AddrPort{}
+	relayed.relayState.InsertRelayTo(addr(9))
+	hm.Hosts[addr(5)].relayState.InsertRelay(addr(6), 100, &Relay{})
+
+	p = queryHostmap(hm, HostmapQuery{Relay: HostmapRelayVia}, now)
+	assert.Equal(t, []netip.Addr{addr(3)}, addrs(p))
+	assert.Equal(t, "relay", p.Hosts[0].Path)
+
+	p = queryHostmap(hm, HostmapQuery{Relay: HostmapRelayingFor}, now)
+	assert.Equal(t, []netip.Addr{addr(5)}, addrs(p))
+
+	p = queryHostmap(hm, HostmapQuery{Relay: HostmapRelayNone}, now)
+	assert.Equal(t, 9, p.Matched)
+
+	hm.Hosts[addr(7)].lastUsedNano.Store(now.Add(-time.Hour).UnixNano())
+	hm.Hosts[addr(8)].lastUsedNano.Store(0)
+	p = queryHostmap(hm, HostmapQuery{StaleFor: time.Minute}, now)
+	require.Equal(t, []netip.Addr{addr(7)}, addrs(p))
+	assert.Equal(t, now.Add(-time.Hour).UnixNano(), p.Hosts[0].LastUsed.UnixNano())
+}
+
+func TestQueryHostmap_multipleVpnAddrs(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	hm.preferredRanges.Store(&[]netip.Prefix{})
+
+	h := &HostInfo{
+		remotes:      NewRemoteList(nil, nil),
+		localIndexId: 1,
+		vpnAddrs:     []netip.Addr{netip.MustParseAddr("10.128.0.1"), netip.MustParseAddr("fd00::1")},
+	}
+	hm.unlockedAddHostInfo(h, &Interface{})
+
+	p := queryHostmap(hm, HostmapQuery{}, time.Now())
+	assert.Len(t, p.Hosts, 1)
+	assert.Equal(t, 1, p.Matched)
+}
@@ -3,7 +3,9 @@ package nebula
 import (
 	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/test"
 	"github.com/stretchr/testify/assert"
@@ -244,3 +246,38 @@ func TestHostMap_RelayState(t *testing.T) {
 	assert.Equal(t, []netip.Addr{}, h1.relayState.relays)
 
 }
+
+func TestHostMap_summarize(t *testing.T) {
+	l := test.NewLogger()
+	hm := newHostMap(l)
+	f := &Interface{}
+	now := time.Now()
+
+	add := func(index uint32, remote string, crt *dummyCert, ci *ConnectionState, addrs ...string) {
+		h := &HostInfo{localIndexId: index, ConnectionState: ci}
+		for _, a := range addrs {
+			h.vpnAddrs = append(h.vpnAddrs, netip.MustParseAddr(a))
+		}
+		if remote != "" {
+			h.remote = netip.MustParseAddrPort(remote)
+		}
+		ci.peerCert = &cert.CachedCertificate{Certificate: crt}
+		hm.unlockedAddHostInfo(h, f)
+	}
+
+	my25519 := &dummyCert{curve: cert.Curve_CURVE25519}
+	myP256 := &dummyCert{curve: cert.Curve_P256}
+	add(1, "1.1.1.1:4242", &dummyCert{notAfter: now.Add(-time.Hour)}, &ConnectionState{cipher: "aes", myCert: my25519}, "10.0.0.1")
+	add(2, "", &dummyCert{notAfter: now.Add(3 * 24 * time.Hour)}, &ConnectionState{cipher: "aes", myCert: my25519}, "10.0.0.2", "fd00::2")
+	add(3, "1.1.1.3:4242", &dummyCert{notAfter: now.Add(20 * 24 * time.Hour)}, &ConnectionState{cipher: "aes", nullCipher: true, myCert: myP256}, "10.0.0.3")
+	add(4, "", &dummyCert{notAfter: now.Add(365 * 24 * time.Hour)}, &ConnectionState{cipher: "chachapoly", myCert: my25519}, "10.0.0.4")
+
+	s := hm.summarize(now)
+	assert.Equal(t, int64(4), s.tunnels)
+	assert.Equal(t, int64(2), s.relayed)
+	assert.Equal(t, map[string]int64{"aes": 2, "chachapoly": 1, "null": 1}, s.ciphers)
+	assert.Equal(t, map[string]int64{"curve25519": 3, "p256": 1}, s.curves)
+
+	// The dual stack peer is only counted once, and buckets include the ones before them
+	assert.Equal(t, []int64{1, 2, 3}, s.certExpiring)
+}
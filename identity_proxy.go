@@ -0,0 +1,149 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// An identity proxy accepts http requests on one of our overlay addresses and forwards them to a local backend with
+// the identity of the peer that sent them added as headers. The backend gets authenticated callers without speaking
+// nebula, it only has to trust the proxy. Requests from addresses we have no tunnel to are refused, as are requests
+// from ourselves, and any identity headers the caller sent are removed so they can not be forged.
+
+const (
+	identityHeaderPrefix      = "x-nebula-"
+	identityHeaderName        = "X-Nebula-Name"
+	identityHeaderGroups      = "X-Nebula-Groups"
+	identityHeaderFingerprint = "X-Nebula-Fingerprint"
+	identityHeaderVpnAddr     = "X-Nebula-Vpn-Addr"
+)
+
+type identityProxy struct {
+	l       *logrus.Logger
+	f       *Interface
+	listen  netip.AddrPort
+	backend *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+// newIdentityProxiesFromConfig reads identity_proxy, a list of `{listen: <vpn addr>:<port>, backend: <url>}`
+func newIdentityProxiesFromConfig(l *logrus.Logger, c *config.C, f *Interface) (func(context.Context), error) {
+	r := c.Get("identity_proxy")
+	if r == nil {
+		return nil, nil
+	}
+
+	rawProxies, ok := r.([]any)
+	if !ok {
+		return nil, util.NewContextualError("identity_proxy is not an array", nil, nil)
+	}
+
+	cs := f.pki.getCertState()
+	var proxies []*identityProxy
+	for i, rp := range rawProxies {
+		rm, ok := rp.(map[string]any)
+		if !ok {
+			return nil, util.NewContextualError("identity_proxy entry is invalid", m{"entry": i + 1}, nil)
+		}
+
+		listen, err := netip.ParseAddrPort(fmt.Sprint(rm["listen"]))
+		if err != nil {
+			return nil, util.NewContextualError("Unable to parse identity_proxy listen", m{"listen": rm["listen"], "entry": i + 1}, err)
+		}
+
+		// Binding anywhere else would accept connections that did not come through a tunnel
+		if !cs.myVpnAddrsTable.Contains(listen.Addr()) {
+			return nil, util.NewContextualError("identity_proxy listen must be one of our vpn addresses", m{"listen": listen, "entry": i + 1}, nil)
+		}
+
+		backend, err := url.Parse(fmt.Sprint(rm["backend"]))
+		if err != nil || (backend.Scheme != "http" && backend.Scheme != "https") || backend.Host == "" {
+			return nil, util.NewContextualError("identity_proxy backend must be an http or https url", m{"backend": rm["backend"], "entry": i + 1}, err)
+		}
+
+		proxies = append(proxies, newIdentityProxy(l, f, listen, backend))
+	}
+
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+
+	return func(ctx context.Context) {
+		for _, p := range proxies {
+			go p.serve(ctx)
+		}
+	}, nil
+}
+
+func newIdentityProxy(l *logrus.Logger, f *Interface, listen netip.AddrPort, backend *url.URL) *identityProxy {
+	p := &identityProxy{l: l, f: f, listen: listen, backend: backend}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(backend)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.l.WithError(err).WithField("backend", backend).Warn("Identity proxy failed to reach the backend")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return p
+}
+
+func (p *identityProxy) serve(ctx context.Context) {
+	ln, err := net.Listen("tcp", p.listen.String())
+	if err != nil {
+		p.l.WithError(err).WithField("listen", p.listen).Error("Failed to start the identity proxy")
+		return
+	}
+
+	srv := &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	p.l.WithField("listen", p.listen).WithField("backend", p.backend).Info("Identity proxy listening")
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.l.WithError(err).WithField("listen", p.listen).Error("Identity proxy stopped")
+	}
+}
+
+func (p *identityProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "unable to identify the caller", http.StatusForbidden)
+		return
+	}
+
+	id, ok := p.f.whois(remote.Addr().Unmap())
+	if !ok || id.Self {
+		http.Error(w, "unable to identify the caller", http.StatusForbidden)
+		return
+	}
+
+	// Some backends treat underscores as dashes, remove anything that could be read as one of ours
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ReplaceAll(strings.ToLower(k), "_", "-"), identityHeaderPrefix) {
+			delete(r.Header, k)
+		}
+	}
+	r.Header.Set(identityHeaderName, id.Name)
+	r.Header.Set(identityHeaderGroups, strings.Join(id.Groups, ","))
+	r.Header.Set(identityHeaderFingerprint, id.Fingerprint)
+	r.Header.Set(identityHeaderVpnAddr, remote.Addr().Unmap().String())
+
+	p.proxy.ServeHTTP(w, r)
+}
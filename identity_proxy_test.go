@@ -0,0 +1,97 @@
+package nebula
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityProxy(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	myAddr := netip.MustParseAddr("10.42.0.1")
+	myAddrs := new(bart.Lite)
+	myAddrs.Insert(netip.PrefixFrom(myAddr, myAddr.BitLen()))
+
+	ifce := &Interface{hostMap: hostMap, pki: &PKI{}, l: l}
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            &dummyCert{name: "me"},
+		myVpnAddrs:        []netip.Addr{myAddr},
+		myVpnAddrsTable:   myAddrs,
+	})
+	hostMap.unlockedAddHostInfo(&HostInfo{
+		vpnAddrs:     []netip.Addr{netip.MustParseAddr("10.42.0.9")},
+		localIndexId: 1,
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{
+				Certificate: &dummyCert{name: "laptop", groups: []string{"eng", "admin"}},
+				Fingerprint: "abc",
+			},
+		},
+	}, ifce)
+
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+
+	p := newIdentityProxy(l, ifce, netip.MustParseAddrPort("10.42.0.1:8080"), u)
+	do := func(remote string, header http.Header) int {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Forged identity headers are replaced
+	require.Equal(t, http.StatusOK, do("10.42.0.9:51234", http.Header{
+		"X-Nebula-Name":   {"root"},
+		"X_nebula_groups": {"admin"},
+		"Accept":          {"text/plain"},
+	}))
+	assert.Equal(t, "laptop", got.Get("X-Nebula-Name"))
+	assert.Equal(t, "eng,admin", got.Get("X-Nebula-Groups"))
+	assert.Equal(t, "abc", got.Get("X-Nebula-Fingerprint"))
+	assert.Equal(t, "10.42.0.9", got.Get("X-Nebula-Vpn-Addr"))
+	assert.Empty(t, got.Values("X_nebula_groups"))
+	assert.Equal(t, "text/plain", got.Get("Accept"))
+	assert.Equal(t, "10.42.0.9", got.Get("X-Forwarded-For"))
+
+	// Callers we can not identify never reach the backend
+	assert.Equal(t, http.StatusForbidden, do("10.42.0.10:51234", nil))
+	assert.Equal(t, http.StatusForbidden, do("10.42.0.1:51234", nil))
+	assert.Nil(t, got)
+
+	// Listening anywhere but our vpn addresses is refused
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("identity_proxy:\n  - listen: 0.0.0.0:8080\n    backend: http://127.0.0.1:3000\n"))
+	_, err = newIdentityProxiesFromConfig(l, c, ifce)
+	require.ErrorContains(t, err, "must be one of our vpn addresses")
+
+	require.NoError(t, c.LoadString("identity_proxy:\n  - listen: 10.42.0.1:8080\n    backend: 127.0.0.1:3000\n"))
+	_, err = newIdentityProxiesFromConfig(l, c, ifce)
+	require.ErrorContains(t, err, "must be an http or https url")
+
+	require.NoError(t, c.LoadString("identity_proxy:\n  - listen: 10.42.0.1:8080\n    backend: http://127.0.0.1:3000\n"))
+	start, err := newIdentityProxiesFromConfig(l, c, ifce)
+	require.NoError(t, err)
+	assert.NotNil(t, start)
+}
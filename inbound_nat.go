@@ -0,0 +1,152 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gaissmai/bart"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// Inbound NAT publishes a local service on one of our overlay addresses. Packets from the tunnel to the overlay
+// address and port have their destination rewritten to the local address and port before they reach the tun device,
+// and replies from the local service get the overlay address and port back before they are sent. The firewall sees
+// the overlay side in both directions, rules are written for what peers connect to.
+//
+// The mapping is stateless, anything the local service sends from its address and port is translated. The local
+// address can be a loopback address on linux only with net.ipv4.conf.<tun>.route_localnet set to 1.
+
+type natKey struct {
+	proto uint8
+	addr  netip.AddrPort
+}
+
+type inboundNAT struct {
+	// in maps an overlay address and port to the local one
+	in map[natKey]netip.AddrPort
+	// out maps a local address and port back to the overlay one
+	out map[natKey]netip.AddrPort
+}
+
+// newInboundNATFromConfig reads inbound_nat, a list of `{proto: tcp|udp|any, overlay: <vpn addr>:<port>, local: <addr>:<port>}`
+func newInboundNATFromConfig(c *config.C, myVpnAddrsTable *bart.Lite) (*inboundNAT, error) {
+	n := &inboundNAT{in: map[natKey]netip.AddrPort{}, out: map[natKey]netip.AddrPort{}}
+
+	r := c.Get("inbound_nat")
+	if r == nil {
+		return n, nil
+	}
+
+	rawRules, ok := r.([]any)
+	if !ok {
+		return nil, fmt.Errorf("inbound_nat is not an array")
+	}
+
+	for i, rr := range rawRules {
+		rm, ok := rr.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("inbound_nat entry #%d is not a map", i+1)
+		}
+
+		var protos []uint8
+		switch p := strings.ToLower(fmt.Sprint(rm["proto"])); p {
+		case "tcp":
+			protos = []uint8{firewall.ProtoTCP}
+		case "udp":
+			protos = []uint8{firewall.ProtoUDP}
+		case "any", "<nil>":
+			protos = []uint8{firewall.ProtoTCP, firewall.ProtoUDP}
+		default:
+			return nil, fmt.Errorf("inbound_nat entry #%d proto must be tcp, udp, or any, got %q", i+1, p)
+		}
+
+		overlay, err := netip.ParseAddrPort(fmt.Sprint(rm["overlay"]))
+		if err != nil {
+			return nil, fmt.Errorf("inbound_nat entry #%d overlay is invalid: %w", i+1, err)
+		}
+		if !myVpnAddrsTable.Contains(overlay.Addr()) {
+			return nil, fmt.Errorf("inbound_nat entry #%d overlay %v is not one of our vpn addresses", i+1, overlay)
+		}
+
+		local, err := netip.ParseAddrPort(fmt.Sprint(rm["local"]))
+		if err != nil {
+			return nil, fmt.Errorf("inbound_nat entry #%d local is invalid: %w", i+1, err)
+		}
+		if local.Addr().Is4() != overlay.Addr().Is4() {
+			return nil, fmt.Errorf("inbound_nat entry #%d overlay and local must be the same ip family", i+1)
+		}
+		if overlay.Port() == 0 || local.Port() == 0 {
+			return nil, fmt.Errorf("inbound_nat entry #%d overlay and local must have a port", i+1)
+		}
+		if local == overlay {
+			return nil, fmt.Errorf("inbound_nat entry #%d overlay and local are the same", i+1)
+		}
+
+		for _, proto := range protos {
+			ik := natKey{proto: proto, addr: overlay}
+			lk := natKey{proto: proto, addr: local}
+			if _, dup := n.in[ik]; dup {
+				return nil, fmt.Errorf("inbound_nat entry #%d overlay %v is already mapped", i+1, overlay)
+			}
+			// Replies could not be told apart if two overlay ports went to the same local one
+			if _, dup := n.out[lk]; dup {
+				return nil, fmt.Errorf("inbound_nat entry #%d local %v is already mapped", i+1, local)
+			}
+			n.in[ik] = local
+			n.out[lk] = overlay
+		}
+	}
+
+	return n, nil
+}
+
+func (n *inboundNAT) enabled() bool {
+	return n != nil && len(n.in) > 0
+}
+
+// translateIn rewrites the destination of a packet from the tunnel that is for a mapped overlay address and port
+func (n *inboundNAT) translateIn(packet []byte, fp *firewall.Packet) {
+	if fp.Fragment {
+		return
+	}
+
+	local, ok := n.in[natKey{proto: fp.Protocol, addr: netip.AddrPortFrom(fp.LocalAddr, fp.LocalPort)}]
+	if ok && iputil.RewriteDestination(packet, local) {
+		fp.LocalAddr = local.Addr()
+		fp.LocalPort = local.Port()
+	}
+}
+
+// translateOut rewrites the source of a packet from the tun device that a mapped local service sent
+func (n *inboundNAT) translateOut(packet []byte, fp *firewall.Packet) {
+	if fp.Fragment {
+		return
+	}
+
+	overlay, ok := n.out[natKey{proto: fp.Protocol, addr: netip.AddrPortFrom(fp.LocalAddr, fp.LocalPort)}]
+	if ok && iputil.RewriteSource(packet, overlay) {
+		fp.LocalAddr = overlay.Addr()
+		fp.LocalPort = overlay.Port()
+	}
+}
+
+func (f *Interface) reloadInboundNAT(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("inbound_nat") {
+		return
+	}
+
+	n, err := newInboundNATFromConfig(c, f.myVpnAddrsTable)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load inbound_nat config, keeping the previous one")
+		return
+	}
+
+	f.inboundNAT.Store(n)
+	if n.enabled() {
+		f.l.WithFields(logrus.Fields{"mappings": len(n.in)}).Info("Loaded inbound_nat config")
+	}
+}
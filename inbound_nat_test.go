@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInboundNAT(t *testing.T) {
+	l := test.NewLogger()
+	myAddrs := new(bart.Lite)
+	myAddrs.Insert(netip.MustParsePrefix("10.42.0.1/32"))
+
+	c := config.NewC(l)
+	load := func(s string) (*inboundNAT, error) {
+		require.NoError(t, c.LoadString(s))
+		return newInboundNATFromConfig(c, myAddrs)
+	}
+
+	n, err := load("tun:\n  disabled: true\n")
+	require.NoError(t, err)
+	assert.False(t, n.enabled())
+
+	_, err = load("inbound_nat:\n  - overlay: 10.42.0.2:80\n    local: 127.0.0.1:8080\n")
+	require.ErrorContains(t, err, "is not one of our vpn addresses")
+	_, err = load("inbound_nat:\n  - overlay: 10.42.0.1:80\n    local: '[::1]:8080'\n")
+	require.ErrorContains(t, err, "same ip family")
+	_, err = load("inbound_nat:\n  - proto: icmp\n    overlay: 10.42.0.1:80\n    local: 127.0.0.1:8080\n")
+	require.ErrorContains(t, err, "proto must be")
+	_, err = load("inbound_nat:\n  - overlay: 10.42.0.1:80\n    local: 127.0.0.1:8080\n  - proto: udp\n    overlay: 10.42.0.1:81\n    local: 127.0.0.1:8080\n")
+	require.ErrorContains(t, err, "local 127.0.0.1:8080 is already mapped")
+
+	n, err = load("inbound_nat:\n  - proto: tcp\n    overlay: 10.42.0.1:80\n    local: 127.0.0.1:8080\n")
+	require.NoError(t, err)
+	assert.True(t, n.enabled())
+
+	build := func(src, dst string, sport, dport layers.TCPPort) []byte {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+		tcp := &layers.TCP{SrcPort: sport, DstPort: dport, SYN: true}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+		require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload("hi")))
+		return buf.Bytes()
+	}
+
+	// A connection from a peer to the overlay port reaches the local service
+	p := build("10.42.0.9", "10.42.0.1", 51234, 80)
+	fp := &firewall.Packet{}
+	require.NoError(t, newPacket(p, true, fp))
+	n.translateIn(p, fp)
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), fp.LocalAddr)
+	assert.Equal(t, uint16(8080), fp.LocalPort)
+	assert.Equal(t, build("10.42.0.9", "127.0.0.1", 51234, 8080), p)
+
+	// The reply goes back out from the overlay port
+	p = build("127.0.0.1", "10.42.0.9", 8080, 51234)
+	fp = &firewall.Packet{}
+	require.NoError(t, newPacket(p, false, fp))
+	n.translateOut(p, fp)
+	assert.Equal(t, netip.MustParseAddr("10.42.0.1"), fp.LocalAddr)
+	assert.Equal(t, uint16(80), fp.LocalPort)
+	assert.Equal(t, build("10.42.0.1", "10.42.0.9", 80, 51234), p)
+
+	// Other ports are left alone
+	p = build("10.42.0.9", "10.42.0.1", 51234, 443)
+	before := append([]byte{}, p...)
+	fp = &firewall.Packet{}
+	require.NoError(t, newPacket(p, true, fp))
+	n.translateIn(p, fp)
+	assert.Equal(t, before, p)
+}
@@ -1,7 +1,9 @@
 package nebula
 
 import (
+	"errors"
 	"net/netip"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/firewall"
@@ -9,6 +11,7 @@ import (
 	"github.com/slackhq/nebula/iputil"
 	"github.com/slackhq/nebula/noiseutil"
 	"github.com/slackhq/nebula/routing"
+	"github.com/slackhq/nebula/udp"
 )
 
 func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
@@ -20,6 +23,10 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
+	if n := f.inboundNAT.Load(); n.enabled() {
+		n.translateOut(packet, fwPacket)
+	}
+
 	// Ignore local broadcast packets
 	if f.dropLocalBroadcast {
 		if f.myBroadcastAddrsTable.Contains(fwPacket.RemoteAddr) {
@@ -33,10 +40,7 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		// routes packets from the Nebula addr to the Nebula addr through the Nebula
 		// TUN device.
 		if immediatelyForwardToSelf {
-			_, err := f.readers[q].Write(packet)
-			if err != nil {
-				f.l.WithError(err).Error("Failed to forward to tun")
-			}
+			f.writeToTun(nil, packet, q)
 		}
 		// Otherwise, drop. On linux, we should never see these packets - Linux
 		// routes packets from the nebula addr to the nebula addr through the loopback device.
@@ -48,6 +52,11 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 		return
 	}
 
+	if f.overlayBroadcast(fwPacket.RemoteAddr) {
+		f.sendBroadcast(packet, fwPacket, nb, out, q, localCache)
+		return
+	}
+
 	hostinfo, ready := f.getOrHandshakeConsiderRouting(fwPacket, func(hh *HandshakeHostInfo) {
 		hh.cachePacket(f.l, header.Message, 0, packet, f.sendMessageNow, f.cachedPacketMetrics)
 	})
@@ -68,6 +77,17 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *firewall.Packet
 
 	dropReason := f.firewall.Drop(*fwPacket, false, hostinfo, f.pki.GetCAPool(), localCache)
 	if dropReason == nil {
+		if s := f.shaper.Load(); s.enabled() && !s.allow(hostinfo, len(packet)) {
+			// Over the configured rate, dropping lets the inside connection back off
+			return
+		}
+
+		if !f.fitsPathMTU(hostinfo, packet, out, q) {
+			return
+		}
+
+		f.clampMSS(fwPacket, packet)
+
 		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, packet, nb, out, q)
 
 	} else {
@@ -91,10 +111,7 @@ func (f *Interface) rejectInside(packet []byte, out []byte, q int) {
 		return
 	}
 
-	_, err := f.readers[q].Write(out)
-	if err != nil {
-		f.l.WithError(err).Error("Failed to write to tun")
-	}
+	f.writeToTun(nil, out, q)
 }
 
 func (f *Interface) rejectOutside(packet []byte, ci *ConnectionState, hostinfo *HostInfo, nb, out []byte, q int) {
@@ -130,6 +147,9 @@ func (f *Interface) Handshake(vpnAddr netip.Addr) {
 // If the 2nd return var is false then the hostinfo is not ready to be used in a tunnel
 func (f *Interface) getOrHandshakeNoRouting(vpnAddr netip.Addr, cacheCallback func(*HandshakeHostInfo)) (*HostInfo, bool) {
 	if f.myVpnNetworksTable.Contains(vpnAddr) {
+		if !f.peerFilter.Load().allowsAddr(vpnAddr) {
+			return nil, false
+		}
 		return f.handshakeManager.GetOrHandshake(vpnAddr, cacheCallback)
 	}
 
@@ -339,6 +359,26 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 	useRelay := !remote.IsValid() && !hostinfo.remote.IsValid()
 	fullOut := out
 
+	// raw is the packet from the tun device, p is what we encrypt, they differ when it was compressed
+	data := t == header.Message && st == header.MessageNone
+	raw := p
+	if data && ci.compression != compressionNone {
+		cc := f.compression.Load()
+		if cc != nil && len(p) >= cc.minSize {
+			buf := compressionBufs.Get().(*[]byte)
+			defer compressionBufs.Put(buf)
+
+			if cp, ok := ci.compression.compress(*buf, p); ok {
+				p = cp
+				st = ci.compression.subtype()
+			}
+			hostinfo.counters.txCompressIn.Add(uint64(len(raw)))
+			hostinfo.counters.txCompressOut.Add(uint64(len(p)))
+			cc.txBytes.Inc(int64(len(raw)))
+			cc.txCompressedBytes.Inc(int64(len(p)))
+		}
+	}
+
 	if useRelay {
 		if len(out) < header.Len {
 			// out always has a capacity of mtu, but not always a length greater than the header.Len.
@@ -366,6 +406,7 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		// finally used again. This tunnel would eventually be torn down and recreated if this action didn't help.
 		f.lightHouse.QueryServer(hostinfo.vpnAddrs[0])
 		hostinfo.lastRebindCount = f.rebindCount
+		hostinfo.lastRebind = time.Now()
 		if f.l.Level >= logrus.DebugLevel {
 			f.l.WithField("vpnAddrs", hostinfo.vpnAddrs).Debug("Lighthouse update triggered for punch due to rebind counter")
 		}
@@ -384,15 +425,27 @@ func (f *Interface) sendNoMetrics(t header.MessageType, st header.MessageSubType
 		return
 	}
 
+	var dscp uint8
+	w, to := f.writers[q], hostinfo.remote
+	if data {
+		hostinfo.counters.tx(len(raw))
+		if qc := f.qos.Load(); qc.enabled() {
+			dscp = qc.dscp(hostinfo, raw)
+		}
+		w, to = f.dataWriter(q, hostinfo, raw)
+	}
+
 	if remote.IsValid() {
-		err = f.writers[q].WriteTo(out, remote)
+		err = writeOutside(f.writers[q], out, remote, dscp)
 		if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
 	} else if hostinfo.remote.IsValid() {
-		err = f.writers[q].WriteTo(out, hostinfo.remote)
-		if err != nil {
+		err = writeOutside(w, out, to, dscp)
+		if data && errors.Is(err, udp.ErrPacketTooBig) {
+			f.learnPathMTU(hostinfo, w, raw, fullOut, q)
+		} else if err != nil {
 			hostinfo.logger(f.l).WithError(err).
 				WithField("udpAddr", remote).Error("Failed to write outgoing packet")
 		}
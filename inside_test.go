@@ -0,0 +1,230 @@
+package nebula
+
+import (
+	"io"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/gaissmai/bart"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/require"
+)
+
+// benchConn is a udp.Conn that remembers the size of the last packet written
+type benchConn struct {
+	udp.NoopConn
+	lastLen int
+}
+
+func (c *benchConn) WriteTo(b []byte, _ netip.AddrPort) error {
+	c.lastLen = len(b)
+	return nil
+}
+
+// benchTun is an inside device that remembers the size of the last packet written
+type benchTun struct {
+	test.NoopTun
+	lastLen int
+}
+
+func (t *benchTun) Write(b []byte) (int, error) {
+	t.lastLen = len(b)
+	return len(b), nil
+}
+
+// benchPacketPath is a single established tunnel wired into just enough of an Interface to push packets through the
+// real inside and outside data paths, including the firewall, header, and cipher code.
+type benchPacketPath struct {
+	f        *Interface
+	hostinfo *HostInfo
+	conn     *benchConn
+	tun      *benchTun
+
+	myVpnAddr   netip.Addr
+	peerVpnAddr netip.Addr
+	peerUdpAddr netip.AddrPort
+}
+
+func newBenchPacketPath(b *testing.B) *benchPacketPath {
+	l := test.NewLogger()
+	myNet := netip.MustParsePrefix("10.128.0.1/24")
+	peerNet := netip.MustParsePrefix("10.128.0.2/24")
+
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+	myCrt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "me", time.Now(), time.Now().Add(time.Hour), []netip.Prefix{myNet}, nil, nil)
+	peerCrt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "peer", time.Now(), time.Now().Add(time.Hour), []netip.Prefix{peerNet}, nil, nil)
+
+	fw := NewFirewall(l, time.Minute, time.Minute, time.Minute, myCrt)
+	require.NoError(b, fw.AddRule(false, firewall.ProtoAny, firewall.PortAny, firewall.PortAny, nil, "any", "", "", "", ""))
+	require.NoError(b, fw.AddRule(true, firewall.ProtoAny, firewall.PortAny, firewall.PortAny, nil, "any", "", "", "", ""))
+
+	myVpnAddrsTable := new(bart.Lite)
+	myVpnAddrsTable.Insert(netip.PrefixFrom(myNet.Addr(), myNet.Addr().BitLen()))
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(myNet.Masked())
+
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+	lh := newTestLighthouse()
+	conn := &benchConn{}
+	tun := &benchTun{}
+	conf := config.NewC(l)
+
+	f := &Interface{
+		hostMap:               hostMap,
+		outside:               conn,
+		inside:                tun,
+		pki:                   &PKI{},
+		firewall:              fw,
+		lightHouse:            lh,
+		handshakeManager:      NewHandshakeManager(l, hostMap, lh, conn, defaultHandshakeConfig),
+		connectionManager:     newConnectionManagerFromConfig(l, conf, hostMap, NewPunchyFromConfig(l, conf)),
+		myBroadcastAddrsTable: new(bart.Lite),
+		myVpnAddrs:            []netip.Addr{myNet.Addr()},
+		myVpnAddrsTable:       myVpnAddrsTable,
+		myVpnNetworks:         []netip.Prefix{myNet},
+		myVpnNetworksTable:    myVpnNetworksTable,
+		writers:               []udp.Conn{conn},
+		readers:               []io.ReadWriteCloser{tun},
+		messageMetrics:        newMessageMetricsOnlyRecvError(),
+		l:                     l,
+	}
+	f.connectionManager.intf = f
+	f.handshakeManager.f = f
+	// Keep roaming probes and lighthouse queries out of the measured path
+	f.tryPromoteEvery.Store(math.MaxUint32)
+	f.reQueryEvery.Store(math.MaxUint32)
+
+	// Both directions share a key so packets we encrypt on the inside path can be fed back through the outside path
+	suite := noise.NewCipherSuite(noise.DH25519, noiseutil.CipherAESGCM, noise.HashSHA256)
+	key := NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{1, 2, 3}, 0))
+
+	peerUdpAddr := netip.MustParseAddrPort("1.2.3.4:4242")
+	hostinfo := &HostInfo{
+		remote:        peerUdpAddr,
+		vpnAddrs:      []netip.Addr{peerNet.Addr()},
+		remotes:       NewRemoteList([]netip.Addr{peerNet.Addr()}, nil),
+		localIndexId:  1000,
+		remoteIndexId: 1000,
+		relayState:    RelayState{relayForByAddr: map[netip.Addr]*Relay{}, relayForByIdx: map[uint32]*Relay{}},
+		ConnectionState: &ConnectionState{
+			eKey:     key,
+			dKey:     key,
+			myCert:   myCrt,
+			peerCert: &cert.CachedCertificate{Certificate: peerCrt, InvertedGroups: map[string]struct{}{}},
+			window:   NewBits(ReplayWindow),
+		},
+	}
+	hostMap.unlockedAddHostInfo(hostinfo, f)
+
+	return &benchPacketPath{
+		f:           f,
+		hostinfo:    hostinfo,
+		conn:        conn,
+		tun:         tun,
+		myVpnAddr:   myNet.Addr(),
+		peerVpnAddr: peerNet.Addr(),
+		peerUdpAddr: peerUdpAddr,
+	}
+}
+
+// udpPacket builds an ipv4 udp packet with a payload of size bytes
+func (p *benchPacketPath) udpPacket(b *testing.B, src, dst netip.Addr, size int) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    src.AsSlice(),
+		DstIP:    dst.AsSlice(),
+	}
+	udpLayer := &layers.UDP{SrcPort: 4000, DstPort: 80}
+	require.NoError(b, udpLayer.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	require.NoError(b, gopacket.SerializeLayers(buf, opts, ip, udpLayer, gopacket.Payload(make([]byte, size))))
+	return buf.Bytes()
+}
+
+var benchPacketSizes = []struct {
+	name string
+	size int
+}{
+	{"64B", 64},
+	{"512B", 512},
+	{"1300B", 1300},
+}
+
+func BenchmarkInsidePacketPath(b *testing.B) {
+	for _, s := range benchPacketSizes {
+		b.Run(s.name, func(b *testing.B) {
+			p := newBenchPacketPath(b)
+			packet := p.udpPacket(b, p.myVpnAddr, p.peerVpnAddr, s.size)
+			fwPacket := &firewall.Packet{}
+			nb := make([]byte, 12, 12)
+			out := make([]byte, mtu)
+			cache := firewall.NewConntrackCacheTicker(0)
+
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				p.f.consumeInsidePacket(packet, fwPacket, nb, out, 0, cache.Get(p.f.l))
+			}
+
+			b.StopTimer()
+			require.Equal(b, header.Len+len(packet)+16, p.conn.lastLen)
+		})
+	}
+}
+
+func BenchmarkOutsidePacketPath(b *testing.B) {
+	for _, s := range benchPacketSizes {
+		b.Run(s.name, func(b *testing.B) {
+			p := newBenchPacketPath(b)
+			inner := p.udpPacket(b, p.peerVpnAddr, p.myVpnAddr, s.size)
+
+			// Encrypt the packet the way the peer would have
+			nb := make([]byte, 12, 12)
+			packet := header.Encode(make([]byte, mtu), header.Version, header.Message, header.MessageNone, p.hostinfo.localIndexId, 1)
+			packet, err := p.hostinfo.ConnectionState.eKey.EncryptDanger(packet, packet, inner, 1, nb)
+			require.NoError(b, err)
+
+			h := &header.H{}
+			fwPacket := &firewall.Packet{}
+			out := make([]byte, mtu)
+			via := ViaSender{UdpAddr: p.peerUdpAddr}
+			lhh := p.f.lightHouse.NewRequestHandler()
+			cache := firewall.NewConntrackCacheTicker(0)
+			window := p.hostinfo.ConnectionState.window
+
+			b.SetBytes(int64(len(inner)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				p.f.readOutsidePackets(via, out[:0], packet, h, fwPacket, lhh, nb, 0, cache.Get(p.f.l))
+
+				// The same packet is replayed each time, rewind the replay window so it is accepted again
+				window.current = 0
+				window.bits[1] = false
+			}
+
+			b.StopTimer()
+			require.Equal(b, len(inner), p.tun.lastLen)
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"dario.cat/mergo"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"go.yaml.in/yaml/v3"
+)
+
+// A config with an instances section runs one nebula per entry in the same process, each with its own certificate,
+// listeners, tun device, and firewall. Settings outside of instances are shared, an instance only has to set what is
+// different for it. This lets one process be a public lighthouse or relay and a private node on another network.
+
+// Instances is the Control for every instance in a config, see MainInstances
+type Instances struct {
+	names    []string
+	controls []*Control
+	cancel   context.CancelFunc
+	l        *logrus.Logger
+}
+
+// HasInstances reports whether c defines instances, they are run with MainInstances instead of Main
+func HasInstances(c *config.C) bool {
+	return len(c.GetMap("instances", nil)) > 0
+}
+
+// MainInstances calls Main for every instance in c. Reloading c reloads every instance, adding or removing instances
+// requires a restart.
+func MainInstances(c *config.C, configTest bool, buildVersion string, logger *logrus.Logger, sigChan chan os.Signal) (retcon *Instances, reterr error) {
+	settings, err := instanceSettings(logger, c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inst := &Instances{cancel: cancel, l: logger}
+	defer func() {
+		if reterr != nil {
+			cancel()
+			if !configTest {
+				inst.Stop()
+			}
+		}
+	}()
+
+	for _, name := range sortedKeys(settings) {
+		ic := config.NewC(logger)
+		if err = ic.LoadString(settings[name]); err != nil {
+			return nil, fmt.Errorf("failed to load instance %s: %w", name, err)
+		}
+
+		ctrl, err := Main(ic, configTest, buildVersion, instanceLogger(logger, name), nil, sigChan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start instance %s: %w", name, err)
+		}
+
+		inst.names = append(inst.names, name)
+		inst.controls = append(inst.controls, ctrl)
+		c.RegisterReloadCallback(func(c *config.C) {
+			inst.reload(c, name, ic)
+		})
+	}
+
+	if !configTest {
+		c.CatchHUP(ctx)
+	}
+
+	return inst, nil
+}
+
+func (i *Instances) reload(c *config.C, name string, ic *config.C) {
+	settings, err := instanceSettings(i.l, c)
+	if err != nil {
+		i.l.WithError(err).WithField("instance", name).Error("Failed to reload instance")
+		return
+	}
+
+	raw, ok := settings[name]
+	if !ok {
+		i.l.WithField("instance", name).Warn("Instance was removed from the config, restart nebula to stop it")
+		return
+	}
+
+	if err := ic.ReloadConfigString(raw); err != nil {
+		i.l.WithError(err).WithField("instance", name).Error("Failed to reload instance")
+	}
+}
+
+// Start starts every instance, this is a nonblocking call. To block use Instances.ShutdownBlock()
+func (i *Instances) Start() {
+	for _, ctrl := range i.controls {
+		ctrl.Start()
+	}
+}
+
+// Stop shuts every instance down, returns after they all are
+func (i *Instances) Stop() {
+	i.cancel()
+	for j := len(i.controls) - 1; j >= 0; j-- {
+		i.controls[j].Stop()
+	}
+}
+
+// ShutdownBlock will listen for and block on term and interrupt signals, calling Instances.Stop() once signalled
+func (i *Instances) ShutdownBlock(sigChan chan os.Signal) {
+	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT)
+
+	rawSig := <-sigChan
+	sig := rawSig.String()
+	i.l.WithField("signal", sig).Info("Caught signal, shutting down")
+	i.Stop()
+}
+
+// Control returns the Control of the named instance, or nil if there is none
+func (i *Instances) Control(name string) *Control {
+	for j, n := range i.names {
+		if n == name {
+			return i.controls[j]
+		}
+	}
+	return nil
+}
+
+// instanceSettings returns the yaml config of every instance, the shared settings merged under its own
+func instanceSettings(l *logrus.Logger, c *config.C) (map[string]string, error) {
+	instances := c.GetMap("instances", nil)
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instances are configured")
+	}
+
+	shared := map[string]any{}
+	for k, v := range c.Settings {
+		if k != "instances" {
+			shared[k] = v
+		}
+	}
+
+	out := map[string]string{}
+	claimed := map[string]string{}
+	for k, v := range instances {
+		name := fmt.Sprint(k)
+		own, ok := v.(map[string]any)
+		if !ok && v != nil {
+			return nil, fmt.Errorf("instances.%s must be a map of settings", name)
+		}
+
+		// Round trip through yaml so instances never share a map with each other or the shared settings
+		m, err := copySettings(own)
+		if err != nil {
+			return nil, err
+		}
+		s, err := copySettings(shared)
+		if err != nil {
+			return nil, err
+		}
+		if err = mergo.Merge(&m, s); err != nil {
+			return nil, fmt.Errorf("failed to merge the shared settings into instance %s: %w", name, err)
+		}
+
+		ic := config.NewC(l)
+		ic.Settings = m
+		if err = claimProcessWide(claimed, name, ic); err != nil {
+			return nil, err
+		}
+
+		b, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = string(b)
+	}
+
+	return out, nil
+}
+
+// claimProcessWide makes sure only one instance uses the things there is one of per process
+func claimProcessWide(claimed map[string]string, name string, c *config.C) error {
+	claim := func(what string) error {
+		if other, ok := claimed[what]; ok {
+			return fmt.Errorf("instances %s and %s can not both use %s", other, name, what)
+		}
+		claimed[what] = name
+		return nil
+	}
+
+	// Metrics are process wide, every instance reports into the same registry
+	if c.GetString("stats.type", "") != "" {
+		if err := claim("stats"); err != nil {
+			return err
+		}
+	}
+
+	if c.GetBool("lighthouse.serve_dns", false) {
+		if err := claim("lighthouse.serve_dns"); err != nil {
+			return err
+		}
+	}
+
+	if dev := c.GetString("tun.dev", ""); dev != "" && !c.GetBool("tun.disabled", false) {
+		if err := claim("tun device " + dev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copySettings(m map[string]any) (map[string]any, error) {
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+	if err = yaml.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instanceLogger is a logger that writes where l does and tags every entry with the instance name
+func instanceLogger(l *logrus.Logger, name string) *logrus.Logger {
+	il := logrus.New()
+	il.Out = l.Out
+	il.Level = l.Level
+	for level, hooks := range l.Hooks {
+		il.Hooks[level] = append([]logrus.Hook{}, hooks...)
+	}
+	il.AddHook(instanceHook(name))
+	return il
+}
+
+type instanceHook string
+
+func (h instanceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h instanceHook) Fire(e *logrus.Entry) error {
+	e.Data["instance"] = string(h)
+	return nil
+}
@@ -0,0 +1,86 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceSettings(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+logging:
+  level: debug
+listen:
+  host: 0.0.0.0
+  port: 4242
+instances:
+  relay:
+    relay:
+      am_relay: true
+    tun:
+      disabled: true
+  private:
+    listen:
+      port: 4243
+    tun:
+      dev: nebula1
+`))
+	assert.True(t, HasInstances(c))
+	assert.False(t, HasInstances(config.NewC(l)))
+
+	settings, err := instanceSettings(l, c)
+	require.NoError(t, err)
+	require.Len(t, settings, 2)
+
+	relay := config.NewC(l)
+	require.NoError(t, relay.LoadString(settings["relay"]))
+	assert.True(t, relay.GetBool("relay.am_relay", false))
+	assert.Equal(t, 4242, relay.GetInt("listen.port", 0))
+	assert.Equal(t, "debug", relay.GetString("logging.level", ""))
+	assert.Nil(t, relay.Get("instances"))
+
+	// Instance settings win over the shared ones, the rest of the map is kept
+	private := config.NewC(l)
+	require.NoError(t, private.LoadString(settings["private"]))
+	assert.False(t, private.GetBool("relay.am_relay", false))
+	assert.Equal(t, 4243, private.GetInt("listen.port", 0))
+	assert.Equal(t, "0.0.0.0", private.GetString("listen.host", ""))
+
+	// Merging must not leak one instance into the shared settings
+	assert.Equal(t, 4242, c.GetInt("listen.port", 0))
+
+	// Things there is one of per process can only be used by one instance
+	require.NoError(t, c.LoadString(`
+stats:
+  type: prometheus
+instances:
+  a: {}
+  b: {}
+`))
+	_, err = instanceSettings(l, c)
+	require.ErrorContains(t, err, "can not both use stats")
+
+	require.NoError(t, c.LoadString(`
+instances:
+  a:
+    tun:
+      dev: nebula1
+  b:
+    tun:
+      dev: nebula1
+`))
+	_, err = instanceSettings(l, c)
+	require.ErrorContains(t, err, "can not both use tun device nebula1")
+
+	require.NoError(t, c.LoadString(`
+instances:
+  a: nope
+`))
+	_, err = instanceSettings(l, c)
+	require.ErrorContains(t, err, "instances.a must be a map of settings")
+}
@@ -8,6 +8,8 @@ import (
 	"net/netip"
 	"os"
 	"runtime"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/firewall"
 	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/netmon"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/udp"
 )
@@ -56,6 +59,13 @@ type Interface struct {
 	inside                overlay.Device
 	pki                   *PKI
 	firewall              *Firewall
+	firewallLock          sync.Mutex
+	firewallRuleSources   []firewallRuleSource
+	wireguardGateway      *wireguardGateway
+	warmRestart           *warmRestart
+	resumption            *sessionResumption
+	preconnect            *preconnect
+	lanDiscovery          *lanDiscovery
 	connectionManager     *connectionManager
 	handshakeManager      *HandshakeManager
 	serveDns              bool
@@ -70,9 +80,34 @@ type Interface struct {
 	dropMulticast         bool
 	routines              int
 	disconnectInvalid     atomic.Bool
+	answerPing            atomic.Bool
+	mssClamping           atomic.Bool
+	routeMTU              *overlay.RouteMTU
+	tunWriteErrors        *tunWriteErrors
+	qos                   atomic.Pointer[qosConfig]
+	shaper                atomic.Pointer[shaper]
+	crash                 atomic.Pointer[crashConfig]
+	nullCipherGroups      atomic.Pointer[[]string]
+	compression           atomic.Pointer[compressionConfig]
+	broadcast             atomic.Pointer[broadcastDomain]
+	inboundNAT            atomic.Pointer[inboundNAT]
+	peerFilter            atomic.Pointer[peerFilter]
+	securityRequirements  atomic.Pointer[securityRequirements]
+	logs                  *logSubsystems
 	closed                atomic.Bool
+	activated             atomic.Bool
 	relayManager          *relayManager
 
+	// events are the lifecycle callbacks of embedders, see interface_events.go
+	events interfaceEvents
+
+	// disconnectInvalidAudit is set when pki.disconnect_invalid is audit, invalid certificates are only logged until
+	// the time it holds, or forever if it is zero
+	disconnectInvalidAudit atomic.Pointer[time.Time]
+
+	// macs is only set when the inside device is a tap, see tap.go
+	macs *macTable
+
 	tryPromoteEvery atomic.Uint32
 	reQueryEvery    atomic.Uint32
 	reQueryWait     atomic.Int64
@@ -84,10 +119,17 @@ type Interface struct {
 	rebindCount int8
 	version     string
 
+	// clockProbes reads our peers' clocks to find skew in ours
+	clockProbes clockProbes
+
 	conntrackCacheTimeout time.Duration
 
 	writers []udp.Conn
 	readers []io.ReadWriteCloser
+	// sourcePorts are the extra sockets data is spread over, see source_ports.go
+	sourcePorts []udp.Conn
+	// portHopper moves tunnel data over the port hopping schedule, see port_hopping.go
+	portHopper *portHopper
 
 	metricHandshakes    metrics.Histogram
 	messageMetrics      *MessageMetrics
@@ -187,6 +229,7 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		relayManager:          c.relayManager,
 		connectionManager:     c.connectionManager,
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
+		tunWriteErrors:        newTunWriteErrors(),
 
 		metricHandshakes: metrics.GetOrRegisterHistogram("handshakes", nil, metrics.NewExpDecaySample(1028, 0.015)),
 		messageMetrics:   c.MessageMetrics,
@@ -198,11 +241,16 @@ func NewInterface(ctx context.Context, c *InterfaceConfig) (*Interface, error) {
 		l: c.l,
 	}
 
+	if td, ok := c.Inside.(overlay.TapDevice); ok && td.IsTap() {
+		ifce.macs = newMACTable()
+	}
+
 	ifce.tryPromoteEvery.Store(c.tryPromoteEvery)
 	ifce.reQueryEvery.Store(c.reQueryEvery)
 	ifce.reQueryWait.Store(int64(c.reQueryWait))
 
 	ifce.connectionManager.intf = ifce
+	ifce.events.certsChanged(cs)
 
 	return ifce, nil
 }
@@ -248,6 +296,9 @@ func (f *Interface) activate() {
 		f.inside.Close()
 		f.l.Fatal(err)
 	}
+
+	f.activated.Store(true)
+	f.emitEvent(InterfaceActivated)
 }
 
 func (f *Interface) run() {
@@ -256,6 +307,14 @@ func (f *Interface) run() {
 		go f.listenOut(i)
 	}
 
+	// Hosts answer on whichever port they saw our packets come from
+	for _, li := range f.sourcePorts {
+		go f.listenOutOn(li, 0)
+	}
+	if f.portHopper != nil {
+		f.portHopper.start(func(li udp.Conn) { go f.listenOutOn(li, 0) })
+	}
+
 	// Launch n queues to read packets from tun dev
 	for i := 0; i < f.routines; i++ {
 		go f.listenIn(f.readers[i], i)
@@ -263,14 +322,17 @@ func (f *Interface) run() {
 }
 
 func (f *Interface) listenOut(i int) {
-	runtime.LockOSThread()
-
-	var li udp.Conn
 	if i > 0 {
-		li = f.writers[i]
+		f.listenOutOn(f.writers[i], i)
 	} else {
-		li = f.outside
+		f.listenOutOn(f.outside, i)
 	}
+}
+
+// listenOutOn reads packets from li, replies that need a writer use routine i
+func (f *Interface) listenOutOn(li udp.Conn, i int) {
+	runtime.LockOSThread()
+	defer f.recoverPanic("listenOut", i)
 
 	ctCache := firewall.NewConntrackCacheTicker(f.conntrackCacheTimeout)
 	lhh := f.lightHouse.NewRequestHandler()
@@ -286,6 +348,7 @@ func (f *Interface) listenOut(i int) {
 
 func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	runtime.LockOSThread()
+	defer f.recoverPanic("listenIn", i)
 
 	packet := make([]byte, mtu)
 	out := make([]byte, mtu)
@@ -297,7 +360,8 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 	for {
 		n, err := reader.Read(packet)
 		if err != nil {
-			if errors.Is(err, os.ErrClosed) && f.closed.Load() {
+			// Pipe backed devices, like the user device, report EOF once closed
+			if (errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF)) && f.closed.Load() {
 				return
 			}
 
@@ -306,7 +370,43 @@ func (f *Interface) listenIn(reader io.ReadWriteCloser, i int) {
 			os.Exit(2)
 		}
 
-		f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		if f.macs != nil {
+			f.consumeInsideFrame(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		} else {
+			f.consumeInsidePacket(packet[:n], fwPacket, nb, out, i, conntrackCache.Get(f.l))
+		}
+	}
+}
+
+// rebind refreshes the udp listeners after a local network change, sends our new addresses to the lighthouses, and has
+// active tunnels ask their remotes to punch back to us
+func (f *Interface) rebind() {
+	for _, w := range f.writers {
+		_ = w.Rebind()
+	}
+	for _, w := range f.sourcePorts {
+		_ = w.Rebind()
+	}
+
+	// Trigger a lighthouse update, useful for mobile clients that should have an update interval of 0
+	f.lightHouse.SendUpdate()
+
+	// Let the main interface know that we rebound so that underlying tunnels know to trigger punches from their remotes
+	f.rebindCount++
+	f.emitEvent(InterfaceRebind)
+}
+
+// watchNetwork rebinds whenever the host network changes, so tunnels recover right away instead of waiting on timers
+func (f *Interface) watchNetwork(ctx context.Context) {
+	err := netmon.Watch(ctx, f.l, f.inside.Name(), netmon.DefaultSettle, func(reason string) {
+		f.l.WithField("reason", reason).Info("Network change detected, rebinding")
+		f.rebind()
+	})
+
+	if errors.Is(err, netmon.ErrNotSupported) {
+		f.l.Debug("Network change monitoring is not supported on this platform")
+	} else if err != nil {
+		f.l.WithError(err).Warn("Failed to start network change monitoring")
 	}
 }
 
@@ -315,20 +415,92 @@ func (f *Interface) RegisterConfigChangeCallbacks(c *config.C) {
 	c.RegisterReloadCallback(f.reloadSendRecvError)
 	c.RegisterReloadCallback(f.reloadAcceptRecvError)
 	c.RegisterReloadCallback(f.reloadDisconnectInvalid)
+	c.RegisterReloadCallback(f.reloadBlocklist)
 	c.RegisterReloadCallback(f.reloadMisc)
+	c.RegisterReloadCallback(f.reloadQos)
+	c.RegisterReloadCallback(f.reloadShaper)
+	c.RegisterReloadCallback(f.reloadCrash)
+	c.RegisterReloadCallback(f.reloadClockSkew)
+	c.RegisterReloadCallback(f.reloadNullCipher)
+	c.RegisterReloadCallback(f.reloadCompression)
+	c.RegisterReloadCallback(f.reloadBroadcast)
+	c.RegisterReloadCallback(f.reloadInboundNAT)
+	c.RegisterReloadCallback(f.reloadPeerFilter)
+	c.RegisterReloadCallback(f.reloadSecurityRequirements)
+	c.RegisterReloadCallback(f.reloadCertEvents)
+	c.RegisterReloadCallback(f.reloadAnswerPing)
+	c.RegisterReloadCallback(f.reloadMSSClamping)
+	c.RegisterReloadCallback(f.reloadTunWriteErrors)
 
 	for _, udpConn := range f.writers {
 		c.RegisterReloadCallback(udpConn.ReloadConfig)
 	}
+	for _, udpConn := range f.sourcePorts {
+		c.RegisterReloadCallback(udpConn.ReloadConfig)
+	}
 }
 
 func (f *Interface) reloadDisconnectInvalid(c *config.C) {
 	initial := c.InitialLoad()
-	if initial || c.HasChanged("pki.disconnect_invalid") {
+	if !initial && !c.HasChanged("pki.disconnect_invalid") && !c.HasChanged("pki.disconnect_invalid_audit_until") {
+		return
+	}
+
+	if c.GetString("pki.disconnect_invalid", "") != "audit" {
+		f.disconnectInvalidAudit.Store(nil)
 		f.disconnectInvalid.Store(c.GetBool("pki.disconnect_invalid", true))
 		if !initial {
 			f.l.Infof("pki.disconnect_invalid changed to %v", f.disconnectInvalid.Load())
 		}
+		return
+	}
+
+	// A date rather than a duration so restarts do not extend the audit and every host in the fleet agrees on it
+	var until time.Time
+	switch raw := c.Get("pki.disconnect_invalid_audit_until").(type) {
+	case nil:
+	case time.Time:
+		// yaml turns unquoted timestamps into times for us
+		until = raw
+	default:
+		var err error
+		until, err = time.Parse(time.RFC3339, fmt.Sprint(raw))
+		if err != nil {
+			f.l.WithError(err).WithField("value", raw).
+				Error("pki.disconnect_invalid_audit_until is not an RFC3339 time, invalid certificates will only be logged")
+		}
+	}
+
+	f.disconnectInvalidAudit.Store(&until)
+	f.disconnectInvalid.Store(true)
+	if until.IsZero() {
+		f.l.Info("pki.disconnect_invalid is in audit mode, tunnels with invalid certificates will be logged but not disconnected")
+	} else {
+		f.l.WithField("until", until).
+			Info("pki.disconnect_invalid is in audit mode, tunnels with invalid certificates will be disconnected after the audit ends")
+	}
+}
+
+// reloadBlocklist closes the tunnels to newly blocklisted certs right away instead of waiting for the connection
+// manager to get to them. The PKI reload callback runs before ours, the CA pool already has the new blocklist.
+func (f *Interface) reloadBlocklist(c *config.C) {
+	if !c.HasChanged("pki.blocklist") {
+		return
+	}
+
+	caPool := f.pki.GetCAPool()
+	var blocked []*HostInfo
+	f.hostMap.ForEachIndex(func(h *HostInfo) {
+		if crt := h.GetCert(); crt != nil && caPool.IsCertificateBlocklisted(crt.Certificate, crt.Fingerprint) {
+			blocked = append(blocked, h)
+		}
+	})
+
+	for _, h := range blocked {
+		h.logger(f.l).WithField("fingerprint", h.GetCert().Fingerprint).
+			Info("Remote certificate is blocked, tearing down the tunnel")
+		f.sendCloseTunnel(h)
+		f.closeTunnel(h)
 	}
 }
 
@@ -339,13 +511,29 @@ func (f *Interface) reloadFirewall(c *config.C) {
 		return
 	}
 
-	fw, err := NewFirewallFromConfig(f.l, f.pki.getCertState(), c)
+	f.rebuildFirewall(c)
+}
+
+// rebuildFirewall replaces the running firewall with one built from config and all rule sources, keeping conntrack
+func (f *Interface) rebuildFirewall(c *config.C) {
+	f.firewallLock.Lock()
+	defer f.firewallLock.Unlock()
+
+	fw, err := NewFirewallFromConfig(f.firewall.l, f.pki.getCertState(), c)
 	if err != nil {
 		f.l.WithError(err).Error("Error while creating firewall during reload")
 		return
 	}
 
+	for _, src := range f.firewallRuleSources {
+		if err := src.addFirewallRules(fw); err != nil {
+			f.l.WithError(err).Error("Error while creating firewall during reload")
+			return
+		}
+	}
+
 	oldFw := f.firewall
+	fw.flowLog = oldFw.flowLog
 	conntrack := oldFw.Conntrack
 	conntrack.Lock()
 	defer conntrack.Unlock()
@@ -456,6 +644,7 @@ func (f *Interface) emitStats(ctx context.Context, i time.Duration) {
 		case <-ticker.C:
 			f.firewall.EmitStats()
 			f.handshakeManager.EmitStats()
+			f.clockProbes.emitStats(f.hostMap)
 			udpStats()
 
 			certState := f.pki.getCertState()
@@ -484,13 +673,16 @@ func (f *Interface) GetCertState() *CertState {
 func (f *Interface) Close() error {
 	f.closed.Store(true)
 
-	for _, u := range f.writers {
+	for _, u := range slices.Concat(f.writers, f.sourcePorts) {
 		err := u.Close()
 		if err != nil {
 			f.l.WithError(err).Error("Error while closing udp socket")
 		}
 	}
+	f.portHopper.close()
 
 	// Release the tun device
-	return f.inside.Close()
+	err := f.inside.Close()
+	f.emitEvent(InterfaceClosed)
+	return err
 }
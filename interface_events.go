@@ -0,0 +1,127 @@
+package nebula
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// InterfaceEvent is a lifecycle change of the Interface, see Control.OnInterfaceEvent
+type InterfaceEvent int
+
+const (
+	// InterfaceActivated is sent once the tun device is up and nebula is ready to move packets
+	InterfaceActivated InterfaceEvent = iota
+	// InterfaceClosed is sent once nebula has shut down and released the tun device
+	InterfaceClosed
+	// InterfaceRebind is sent after the udp listeners were refreshed, usually for a local network change
+	InterfaceRebind
+	// InterfaceCertReloaded is sent when a config reload picked up a different certificate
+	InterfaceCertReloaded
+	// InterfaceTunWriteFailing is sent when writes to the tun device keep failing, see tun.write_errors
+	InterfaceTunWriteFailing
+	// InterfacePeerCertInGrace is sent when a tunnel is admitted with a peer certificate that is expired but within
+	// pki.expired_grace
+	InterfacePeerCertInGrace
+	// InterfaceCertRenewRequested is sent when a peer says our certificate is expired and needs renewing
+	InterfaceCertRenewRequested
+)
+
+func (e InterfaceEvent) String() string {
+	switch e {
+	case InterfaceActivated:
+		return "activated"
+	case InterfaceClosed:
+		return "closed"
+	case InterfaceRebind:
+		return "rebind"
+	case InterfaceCertReloaded:
+		return "cert_reloaded"
+	case InterfaceTunWriteFailing:
+		return "tun_write_failing"
+	case InterfacePeerCertInGrace:
+		return "peer_cert_in_grace"
+	case InterfaceCertRenewRequested:
+		return "cert_renew_requested"
+	default:
+		return "unknown"
+	}
+}
+
+// interfaceEvents fans InterfaceEvents out to the callbacks of embedders
+type interfaceEvents struct {
+	sync.RWMutex
+	subscribers map[int]func(InterfaceEvent)
+	nextSub     int
+
+	// certs are the fingerprints of our certificates as of the last InterfaceCertReloaded, the pki stores a new
+	// CertState on every reload whether the certificates changed or not
+	certs []string
+}
+
+func (ie *interfaceEvents) subscribe(cb func(InterfaceEvent)) func() {
+	ie.Lock()
+	defer ie.Unlock()
+	if ie.subscribers == nil {
+		ie.subscribers = map[int]func(InterfaceEvent){}
+	}
+
+	id := ie.nextSub
+	ie.nextSub++
+	ie.subscribers[id] = cb
+
+	return func() {
+		ie.Lock()
+		delete(ie.subscribers, id)
+		ie.Unlock()
+	}
+}
+
+func (ie *interfaceEvents) emit(e InterfaceEvent) {
+	ie.RLock()
+	subscribers := make([]func(InterfaceEvent), 0, len(ie.subscribers))
+	for _, cb := range ie.subscribers {
+		subscribers = append(subscribers, cb)
+	}
+	ie.RUnlock()
+
+	for _, cb := range subscribers {
+		cb(e)
+	}
+}
+
+// certsChanged records the fingerprints of cs and reports if they differ from the last call
+func (ie *interfaceEvents) certsChanged(cs *CertState) bool {
+	var certs []string
+	for _, c := range []cert.Certificate{cs.v1Cert, cs.v2Cert} {
+		if c == nil {
+			continue
+		}
+		fp, _ := c.Fingerprint()
+		certs = append(certs, fp)
+	}
+
+	ie.Lock()
+	defer ie.Unlock()
+	if slices.Equal(ie.certs, certs) {
+		return false
+	}
+
+	ie.certs = certs
+	return true
+}
+
+// reloadCertEvents sends InterfaceCertReloaded when a reload changed our certificates. It must be registered after
+// the pki so it sees the new certificates.
+func (f *Interface) reloadCertEvents(_ *config.C) {
+	if f.events.certsChanged(f.pki.getCertState()) {
+		f.emitEvent(InterfaceCertReloaded)
+	}
+}
+
+func (f *Interface) emitEvent(e InterfaceEvent) {
+	f.l.WithField("event", e).Debug("Interface event")
+	f.events.emit(e)
+}
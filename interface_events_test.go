@@ -0,0 +1,50 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceEvents(t *testing.T) {
+	l := test.NewLogger()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Time{}, time.Time{}, nil, nil, nil)
+	networks := []netip.Prefix{netip.MustParsePrefix("10.42.0.1/24")}
+	crt, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "me", time.Time{}, time.Time{}, networks, nil, nil)
+	renewed, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "me", time.Time{}, time.Time{}, networks, nil, nil)
+
+	ifce := &Interface{pki: &PKI{}, l: l}
+	ifce.pki.cs.Store(&CertState{initiatingVersion: cert.Version2, v2Cert: crt})
+	ifce.events.certsChanged(ifce.pki.getCertState())
+	ctrl := &Control{f: ifce}
+
+	var a, b []InterfaceEvent
+	unsubA := ctrl.OnInterfaceEvent(func(e InterfaceEvent) { a = append(a, e) })
+	ctrl.OnInterfaceEvent(func(e InterfaceEvent) { b = append(b, e) })
+
+	ifce.emitEvent(InterfaceActivated)
+	assert.Equal(t, []InterfaceEvent{InterfaceActivated}, a)
+	assert.Equal(t, []InterfaceEvent{InterfaceActivated}, b)
+
+	// A reload that did not change our certificate is quiet
+	c := config.NewC(l)
+	ifce.pki.cs.Store(&CertState{initiatingVersion: cert.Version2, v2Cert: crt})
+	ifce.reloadCertEvents(c)
+	assert.Len(t, b, 1)
+
+	ifce.pki.cs.Store(&CertState{initiatingVersion: cert.Version2, v2Cert: renewed})
+	ifce.reloadCertEvents(c)
+	assert.Equal(t, []InterfaceEvent{InterfaceActivated, InterfaceCertReloaded}, b)
+
+	unsubA()
+	ifce.emitEvent(InterfaceClosed)
+	assert.Len(t, a, 2)
+	assert.Equal(t, InterfaceClosed, b[2])
+	assert.Equal(t, "cert_reloaded", InterfaceCertReloaded.String())
+}
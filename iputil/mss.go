@@ -0,0 +1,110 @@
+package iputil
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	tcpFlagSyn    = 0x02
+	tcpOptionEnd  = 0
+	tcpOptionNop  = 1
+	tcpOptionMSS  = 2
+	tcpHeaderLen  = 20
+	tcpOptionsMax = 40
+)
+
+// ClampTCPMSS lowers the maximum segment size option of a tcp syn or syn ack to mss and updates the tcp checksum. It
+// returns true if the packet was changed. Anything that is not an unfragmented tcp syn with a larger mss is left alone.
+func ClampTCPMSS(packet []byte, mss uint16) bool {
+	if len(packet) < 1 {
+		return false
+	}
+
+	var transport []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[9] != 6 {
+			return false
+		}
+
+		// A syn is never going to be a later fragment
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+
+		ihl := int(packet[0]&0x0f) << 2
+		if ihl < ipv4.HeaderLen || len(packet) < ihl {
+			return false
+		}
+		transport = packet[ihl:]
+
+	case ipv6.Version:
+		// We don't walk extension headers, the tcp header must come right after ours
+		if len(packet) < ipv6.HeaderLen || packet[6] != 6 {
+			return false
+		}
+		transport = packet[ipv6.HeaderLen:]
+
+	default:
+		return false
+	}
+
+	if len(transport) < tcpHeaderLen || transport[13]&tcpFlagSyn == 0 {
+		return false
+	}
+
+	dataOffset := int(transport[12]>>4) << 2
+	if dataOffset <= tcpHeaderLen || dataOffset > tcpHeaderLen+tcpOptionsMax || len(transport) < dataOffset {
+		return false
+	}
+
+	options := transport[tcpHeaderLen:dataOffset]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return false
+		case tcpOptionNop:
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) {
+			return false
+		}
+
+		optLen := int(options[i+1])
+		if optLen < 2 || i+optLen > len(options) {
+			return false
+		}
+
+		if options[i] == tcpOptionMSS && optLen == 4 {
+			old := options[i+2 : i+4]
+			if binary.BigEndian.Uint16(old) <= mss {
+				return false
+			}
+
+			var newMSS [2]byte
+			binary.BigEndian.PutUint16(newMSS[:], mss)
+
+			// The option may not be 2 byte aligned within the tcp header, adjust the checksum for the aligned word
+			// around it so the ones' complement math works out
+			off := tcpHeaderLen + i + 2
+			start := off &^ 1
+			end := (off + 3) &^ 1
+			var before [4]byte
+			n := copy(before[:], transport[start:end])
+			copy(old, newMSS[:])
+
+			csum := transport[16:18]
+			binary.BigEndian.PutUint16(csum, checksumAdjust(binary.BigEndian.Uint16(csum), before[:n], transport[start:end]))
+			return true
+		}
+
+		i += optLen
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package iputil
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTCPSyn builds a syn from 10.42.0.9 to 192.168.1.5 with options, or the same over ipv6 when v6 is set
+func testTCPSyn(v6 bool, options []byte) []byte {
+	ipLen := 20
+	if v6 {
+		ipLen = 40
+	}
+
+	p := make([]byte, ipLen+20+len(options))
+	tcp := p[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 51234)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = byte((20+len(options))/4) << 4
+	tcp[13] = tcpFlagSyn
+	copy(tcp[20:], options)
+
+	if v6 {
+		p[0] = 0x60
+		binary.BigEndian.PutUint16(p[4:], uint16(len(tcp)))
+		p[6] = 6
+		p[7] = 64
+		p[23] = 9
+		p[39] = 5
+		binary.BigEndian.PutUint16(tcp[16:], tcpipChecksum(tcp, ipv6PseudoheaderChecksum(p[8:24], p[24:40], 6, uint32(len(tcp)))))
+		return p
+	}
+
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = 6
+	copy(p[12:], []byte{10, 42, 0, 9})
+	copy(p[16:], []byte{192, 168, 1, 5})
+	binary.BigEndian.PutUint16(p[10:], tcpipChecksum(p[:20], 0))
+	binary.BigEndian.PutUint16(tcp[16:], tcpipChecksum(tcp, ipv4PseudoheaderChecksum(p[12:16], p[16:20], 6, uint32(len(tcp)))))
+	return p
+}
+
+func Test_ClampTCPMSS(t *testing.T) {
+	// mss 1460 then window scale and sack permitted
+	p := testTCPSyn(false, []byte{2, 4, 0x05, 0xb4, 1, 3, 3, 7, 4, 2, 0, 0})
+	transportChecksumOk(t, p)
+	assert.True(t, ClampTCPMSS(p, 1260))
+	assert.Equal(t, uint16(1260), binary.BigEndian.Uint16(p[42:]))
+	transportChecksumOk(t, p)
+
+	// Already small enough
+	assert.False(t, ClampTCPMSS(p, 1300))
+	assert.Equal(t, uint16(1260), binary.BigEndian.Uint16(p[42:]))
+
+	// An mss that is not 2 byte aligned in the header
+	p = testTCPSyn(false, []byte{1, 2, 4, 0x05, 0xb4, 1, 1, 0})
+	assert.True(t, ClampTCPMSS(p, 1000))
+	assert.Equal(t, uint16(1000), binary.BigEndian.Uint16(p[43:]))
+	transportChecksumOk(t, p)
+
+	p = testTCPSyn(true, []byte{2, 4, 0x05, 0xa0, 1, 1, 4, 2})
+	transportChecksumOk(t, p)
+	assert.True(t, ClampTCPMSS(p, 1220))
+	assert.Equal(t, uint16(1220), binary.BigEndian.Uint16(p[62:]))
+	transportChecksumOk(t, p)
+
+	// Only syns are touched
+	p = testTCPSyn(false, []byte{2, 4, 0x05, 0xb4})
+	p[33] = 0x10
+	assert.False(t, ClampTCPMSS(p, 1000))
+
+	// No mss option, or one hidden behind the end of the option list
+	assert.False(t, ClampTCPMSS(testTCPSyn(false, []byte{1, 1, 4, 2}), 1000))
+	assert.False(t, ClampTCPMSS(testTCPSyn(false, []byte{0, 0, 0, 0, 2, 4, 0x05, 0xb4}), 1000))
+
+	// An mss option running past the end of the options
+	assert.False(t, ClampTCPMSS(testTCPSyn(false, []byte{1, 1, 2, 4}), 1000))
+
+	// Not tcp
+	p = testTCPSyn(false, []byte{2, 4, 0x05, 0xb4})
+	p[9] = 17
+	assert.False(t, ClampTCPMSS(p, 1000))
+	assert.False(t, ClampTCPMSS(nil, 1000))
+}
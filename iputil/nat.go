@@ -0,0 +1,127 @@
+package iputil
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// RewriteSource replaces the source address and port of an unfragmented tcp or udp packet and updates its checksums.
+// It returns false and leaves packet alone if the packet is anything else or addr is not of the packet's ip family.
+func RewriteSource(packet []byte, addr netip.AddrPort) bool {
+	return rewriteAddrPort(packet, false, addr)
+}
+
+// RewriteDestination is RewriteSource for the destination address and port
+func RewriteDestination(packet []byte, addr netip.AddrPort) bool {
+	return rewriteAddrPort(packet, true, addr)
+}
+
+func rewriteAddrPort(packet []byte, dst bool, addr netip.AddrPort) bool {
+	if len(packet) < 1 {
+		return false
+	}
+
+	var ipAddr, transport []byte
+	var proto byte
+	var ipChecksum []byte
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if !addr.Addr().Is4() || len(packet) < ipv4.HeaderLen {
+			return false
+		}
+
+		// Only the first fragment has the ports and the others would keep the old address
+		if packet[6]&0x20 != 0 || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return false
+		}
+
+		ihl := int(packet[0]&0x0f) << 2
+		if ihl < ipv4.HeaderLen || len(packet) < ihl {
+			return false
+		}
+
+		proto = packet[9]
+		ipChecksum = packet[10:12]
+		ipAddr = packet[12:16]
+		if dst {
+			ipAddr = packet[16:20]
+		}
+		transport = packet[ihl:]
+
+	case ipv6.Version:
+		if !addr.Addr().Is6() || len(packet) < ipv6.HeaderLen {
+			return false
+		}
+
+		// We don't walk extension headers, the transport header must come right after ours
+		proto = packet[6]
+		ipAddr = packet[8:24]
+		if dst {
+			ipAddr = packet[24:40]
+		}
+		transport = packet[ipv6.HeaderLen:]
+
+	default:
+		return false
+	}
+
+	var csum []byte
+	switch proto {
+	case 6: // tcp
+		if len(transport) < 20 {
+			return false
+		}
+		csum = transport[16:18]
+	case 17: // udp
+		if len(transport) < 8 {
+			return false
+		}
+		csum = transport[6:8]
+	default:
+		return false
+	}
+
+	port := transport[0:2]
+	if dst {
+		port = transport[2:4]
+	}
+
+	newAddr := addr.Addr().AsSlice()
+	var newPort [2]byte
+	binary.BigEndian.PutUint16(newPort[:], addr.Port())
+
+	// A zero udp checksum over ipv4 means there is none, it stays that way
+	if proto != 17 || ipChecksum == nil || binary.BigEndian.Uint16(csum) != 0 {
+		c := checksumAdjust(binary.BigEndian.Uint16(csum), ipAddr, newAddr)
+		c = checksumAdjust(c, port, newPort[:])
+		if proto == 17 && c == 0 {
+			c = 0xffff
+		}
+		binary.BigEndian.PutUint16(csum, c)
+	}
+
+	if ipChecksum != nil {
+		binary.BigEndian.PutUint16(ipChecksum, checksumAdjust(binary.BigEndian.Uint16(ipChecksum), ipAddr, newAddr))
+	}
+
+	copy(ipAddr, newAddr)
+	copy(port, newPort[:])
+	return true
+}
+
+// checksumAdjust updates csum for the bytes old being replaced with new, see RFC 1624. old and new must be the same
+// even length.
+func checksumAdjust(csum uint16, old, new []byte) uint16 {
+	sum := uint32(^csum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
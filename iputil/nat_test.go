@@ -0,0 +1,91 @@
+package iputil
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// transportChecksumOk verifies the ip and transport checksums of an ipv4 or ipv6 packet with no options
+func transportChecksumOk(t *testing.T, p []byte) {
+	if p[0]>>4 == 4 {
+		assert.Zero(t, tcpipChecksum(p[:20], 0), "ipv4 header checksum")
+		l := uint32(len(p) - 20)
+		assert.Zero(t, tcpipChecksum(p[20:], ipv4PseudoheaderChecksum(p[12:16], p[16:20], uint32(p[9]), l)))
+		return
+	}
+
+	l := uint32(len(p) - 40)
+	assert.Zero(t, tcpipChecksum(p[40:], ipv6PseudoheaderChecksum(p[8:24], p[24:40], uint32(p[6]), l)))
+}
+
+func Test_RewriteAddrPort(t *testing.T) {
+	// ipv4 tcp from 10.42.0.9:51234 to 10.42.0.1:80
+	p := make([]byte, 20+20+5)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = 6
+	copy(p[12:], []byte{10, 42, 0, 9})
+	copy(p[16:], []byte{10, 42, 0, 1})
+	binary.BigEndian.PutUint16(p[10:], tcpipChecksum(p[:20], 0))
+	binary.BigEndian.PutUint16(p[20:], 51234)
+	binary.BigEndian.PutUint16(p[22:], 80)
+	p[32] = 5 << 4
+	copy(p[40:], "hello")
+	binary.BigEndian.PutUint16(p[36:], tcpipChecksum(p[20:], ipv4PseudoheaderChecksum(p[12:16], p[16:20], 6, 25)))
+	transportChecksumOk(t, p)
+
+	assert.True(t, RewriteDestination(p, netip.MustParseAddrPort("127.0.0.1:8080")))
+	assert.Equal(t, []byte{127, 0, 0, 1}, p[16:20])
+	assert.Equal(t, uint16(8080), binary.BigEndian.Uint16(p[22:]))
+	assert.Equal(t, []byte{10, 42, 0, 9}, p[12:16])
+	transportChecksumOk(t, p)
+
+	assert.True(t, RewriteSource(p, netip.MustParseAddrPort("10.42.0.2:443")))
+	assert.Equal(t, []byte{10, 42, 0, 2}, p[12:16])
+	assert.Equal(t, uint16(443), binary.BigEndian.Uint16(p[20:]))
+	transportChecksumOk(t, p)
+
+	// Wrong family, fragments and other protocols are left alone
+	before := append([]byte{}, p...)
+	assert.False(t, RewriteDestination(p, netip.MustParseAddrPort("[::1]:80")))
+	p[6] = 0x20
+	assert.False(t, RewriteDestination(p, netip.MustParseAddrPort("127.0.0.1:80")))
+	p[6] = 0
+	p[9] = 1
+	assert.False(t, RewriteDestination(p, netip.MustParseAddrPort("127.0.0.1:80")))
+	p[9] = 6
+	assert.Equal(t, before, p)
+
+	// ipv4 udp with no checksum keeps none
+	u := make([]byte, 20+8)
+	u[0] = 0x45
+	u[9] = 17
+	copy(u[16:], []byte{10, 42, 0, 1})
+	binary.BigEndian.PutUint16(u[10:], tcpipChecksum(u[:20], 0))
+	assert.True(t, RewriteDestination(u, netip.MustParseAddrPort("127.0.0.1:53")))
+	assert.Zero(t, binary.BigEndian.Uint16(u[26:]))
+	assert.Zero(t, tcpipChecksum(u[:20], 0))
+
+	// ipv6 udp
+	p = make([]byte, 40+8+3)
+	p[0] = 0x60
+	binary.BigEndian.PutUint16(p[4:], 11)
+	p[6] = 17
+	copy(p[8:], netip.MustParseAddr("fd42::9").AsSlice())
+	copy(p[24:], netip.MustParseAddr("fd42::1").AsSlice())
+	binary.BigEndian.PutUint16(p[40:], 5353)
+	binary.BigEndian.PutUint16(p[42:], 53)
+	binary.BigEndian.PutUint16(p[44:], 11)
+	copy(p[48:], "abc")
+	binary.BigEndian.PutUint16(p[46:], tcpipChecksum(p[40:], ipv6PseudoheaderChecksum(p[8:24], p[24:40], 17, 11)))
+	transportChecksumOk(t, p)
+
+	assert.True(t, RewriteDestination(p, netip.MustParseAddrPort("[::1]:5300")))
+	assert.Equal(t, netip.IPv6Loopback().AsSlice(), p[24:40])
+	assert.Equal(t, uint16(5300), binary.BigEndian.Uint16(p[42:]))
+	transportChecksumOk(t, p)
+}
@@ -28,6 +28,11 @@ func CreateRejectPacket(packet []byte, out []byte) []byte {
 }
 
 func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
+	return ipv4CreateUnreachablePacket(packet, out, 3, 0)
+}
+
+// ipv4CreateUnreachablePacket builds an ICMP Destination Unreachable with code for packet, mtu is only sent with code 4
+func ipv4CreateUnreachablePacket(packet []byte, out []byte, code byte, mtu uint16) []byte {
 	ihl := int(packet[0]&0x0f) << 2
 
 	if len(packet) < ihl {
@@ -71,14 +76,14 @@ func ipv4CreateRejectICMPPacket(packet []byte, out []byte) []byte {
 
 	// ICMP Destination Unreachable
 	icmpOut := out[ipv4.HeaderLen:]
-	icmpOut[0] = 3 // type (Destination unreachable)
-	icmpOut[1] = 3 // code (Port unreachable error)
-	icmpOut[2] = 0 // checksum
-	icmpOut[3] = 0 //  .
-	icmpOut[4] = 0 // unused
-	icmpOut[5] = 0 //  .
-	icmpOut[6] = 0 //  .
-	icmpOut[7] = 0 //  .
+	icmpOut[0] = 3              // type (Destination unreachable)
+	icmpOut[1] = code           // code (3 port unreachable, 4 fragmentation needed)
+	icmpOut[2] = 0              // checksum
+	icmpOut[3] = 0              //  .
+	icmpOut[4] = 0              // unused
+	icmpOut[5] = 0              //  .
+	icmpOut[6] = byte(mtu >> 8) // next-hop mtu
+	icmpOut[7] = byte(mtu)      //  .
 
 	// Copy original IP header and first 8 bytes as body
 	copy(icmpOut[8:], packet[:packetLen])
@@ -165,6 +170,78 @@ func ipv4CreateRejectTCPPacket(packet []byte, out []byte) []byte {
 	return out
 }
 
+// CreatePacketTooBig tells the sender of packet that it must send packets no larger than mtu. IPv6 packets get an
+// ICMPv6 Packet Too Big and IPv4 packets with the don't fragment bit get an ICMP Fragmentation Needed. Nothing is
+// created for other IPv4 packets or in response to ICMP errors.
+func CreatePacketTooBig(packet []byte, out []byte, mtu int) []byte {
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen || packet[6]&0x40 == 0 {
+			return nil
+		}
+		ihl := int(packet[0]&0x0f) << 2
+		if packet[9] == 1 && len(packet) > ihl && packet[ihl] != 0 && packet[ihl] != 8 {
+			return nil
+		}
+		return ipv4CreateUnreachablePacket(packet, out, 4, uint16(min(mtu, 0xffff)))
+
+	case 6:
+		return ipv6CreatePacketTooBig(packet, out, mtu)
+	}
+
+	return nil
+}
+
+func ipv6CreatePacketTooBig(packet []byte, out []byte, mtu int) []byte {
+	const ipv6HeaderLen = 40
+	// Errors must not be sent for errors, or larger than the minimum ipv6 mtu
+	const maxOutLen = 1280
+
+	if len(packet) < ipv6HeaderLen || packet[6] == 58 && len(packet) > ipv6HeaderLen && packet[ipv6HeaderLen] < 128 {
+		return nil
+	}
+
+	outLen := min(ipv6HeaderLen+8+len(packet), maxOutLen)
+	if outLen > cap(out) {
+		return nil
+	}
+
+	out = out[:outLen]
+	icmpLen := outLen - ipv6HeaderLen
+
+	ipHdr := out[0:ipv6HeaderLen]
+	ipHdr[0] = 6 << 4                                      // version, traffic class
+	ipHdr[1] = 0                                           // traffic class, flow label
+	ipHdr[2] = 0                                           //  .
+	ipHdr[3] = 0                                           //  .
+	binary.BigEndian.PutUint16(ipHdr[4:], uint16(icmpLen)) // payload length
+	ipHdr[6] = 58                                          // next header (icmpv6)
+	ipHdr[7] = 64                                          // hop limit
+
+	// Swap dest / src IPs
+	copy(ipHdr[8:24], packet[24:40])
+	copy(ipHdr[24:40], packet[8:24])
+
+	icmpOut := out[ipv6HeaderLen:]
+	icmpOut[0] = 2 // type (Packet too big)
+	icmpOut[1] = 0 // code
+	icmpOut[2] = 0 // checksum
+	icmpOut[3] = 0 //  .
+	binary.BigEndian.PutUint32(icmpOut[4:], uint32(mtu))
+
+	// As much of the original packet as fits
+	copy(icmpOut[8:], packet)
+
+	csum := ipv6PseudoheaderChecksum(ipHdr[8:24], ipHdr[24:40], 58, uint32(icmpLen))
+	binary.BigEndian.PutUint16(icmpOut[2:], tcpipChecksum(icmpOut, csum))
+
+	return out
+}
+
 func CreateICMPEchoResponse(packet, out []byte) []byte {
 	// Return early if this is not a simple ICMP Echo Request
 	//TODO: make constants out of these
@@ -199,6 +276,39 @@ func CreateICMPEchoResponse(packet, out []byte) []byte {
 	return out
 }
 
+// CreateICMPv6EchoResponse answers a simple ICMPv6 Echo Request, one without extension headers
+func CreateICMPv6EchoResponse(packet, out []byte) []byte {
+	const ipv6HeaderLen = 40
+
+	if len(packet) < ipv6HeaderLen+8 || len(packet) > 9001 || packet[0]>>4 != 6 || packet[6] != 58 || packet[ipv6HeaderLen] != 128 {
+		return nil
+	}
+
+	icmpLen := int(binary.BigEndian.Uint16(packet[4:]))
+	if icmpLen != len(packet)-ipv6HeaderLen || cap(out) < len(packet) {
+		return nil
+	}
+
+	out = out[:len(packet)]
+	copy(out, packet)
+
+	// Swap dest / src IPs
+	ipHdr := out[0:ipv6HeaderLen]
+	copy(ipHdr[8:24], packet[24:40])
+	copy(ipHdr[24:40], packet[8:24])
+	ipHdr[7] = 64 // hop limit
+
+	// Change type to ICMPv6 Echo Reply and recalculate checksum
+	icmp := out[ipv6HeaderLen:]
+	icmp[0] = 129
+	icmp[2] = 0
+	icmp[3] = 0
+	csum := ipv6PseudoheaderChecksum(ipHdr[8:24], ipHdr[24:40], 58, uint32(icmpLen))
+	binary.BigEndian.PutUint16(icmp[2:], tcpipChecksum(icmp, csum))
+
+	return out
+}
+
 // calculates the TCP/IP checksum defined in rfc1071. The passed-in
 // csum is any initial checksum data that's already been computed.
 //
@@ -236,3 +346,14 @@ func ipv4PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint3
 	csum += length >> 16
 	return csum
 }
+
+func ipv6PseudoheaderChecksum(src, dst []byte, proto, length uint32) (csum uint32) {
+	for i := 0; i < 16; i += 2 {
+		csum += uint32(src[i])<<8 | uint32(src[i+1])
+		csum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	csum += proto
+	csum += length & 0xffff
+	csum += length >> 16
+	return csum
+}
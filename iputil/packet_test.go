@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/ipv4"
 )
 
@@ -71,3 +72,86 @@ func Test_CreateRejectPacket(t *testing.T) {
 	assert.NotNil(t, rejectPacket)
 	assert.Len(t, rejectPacket, expectedLen)
 }
+
+func Test_CreatePacketTooBig(t *testing.T) {
+	out := make([]byte, 9001)
+
+	// ipv6 gets as much of the packet back as fits in the minimum mtu
+	p := make([]byte, 1500)
+	p[0] = 0x60
+	p[6] = 17
+	p[23] = 1
+	p[39] = 2
+	b := CreatePacketTooBig(p, out, 1400)
+	assert.Len(t, b, 1280)
+	assert.Equal(t, byte(58), b[6])
+	assert.Equal(t, p[8:24], b[24:40])
+	assert.Equal(t, p[24:40], b[8:24])
+	assert.Equal(t, []byte{2, 0}, b[40:42])
+	assert.Equal(t, []byte{0, 0, 0x05, 0x78}, b[44:48])
+	assert.Equal(t, p[:1280-48], b[48:])
+	assert.Zero(t, tcpipChecksum(b[40:], ipv6PseudoheaderChecksum(b[8:24], b[24:40], 58, uint32(len(b)-40))))
+
+	// Never in response to an icmpv6 error
+	p[6] = 58
+	p[40] = 1
+	assert.Nil(t, CreatePacketTooBig(p, out, 1400))
+	p[40] = 128
+	assert.NotNil(t, CreatePacketTooBig(p, out, 1400))
+
+	// ipv4 only when the sender asked us not to fragment
+	h := ipv4.Header{Len: 20, TotalLen: 1500, Src: net.IPv4(10, 0, 0, 1), Dst: net.IPv4(10, 0, 0, 2), Protocol: 17}
+	p4, err := h.Marshal()
+	require.NoError(t, err)
+	p4 = append(p4, make([]byte, 1480)...)
+	assert.Nil(t, CreatePacketTooBig(p4, out, 1400))
+
+	h.Flags = ipv4.DontFragment
+	p4, err = h.Marshal()
+	require.NoError(t, err)
+	p4 = append(p4, make([]byte, 1480)...)
+	b = CreatePacketTooBig(p4, out, 1400)
+	assert.Len(t, b, ipv4.HeaderLen+8+20+8)
+	assert.Equal(t, []byte{3, 4}, b[20:22])
+	assert.Equal(t, []byte{0x05, 0x78}, b[26:28])
+	assert.Zero(t, tcpipChecksum(b[20:], 0))
+
+	assert.Nil(t, CreatePacketTooBig(nil, out, 1400))
+	assert.Nil(t, CreatePacketTooBig([]byte{0x60, 0}, out, 1400))
+}
+
+func Test_CreateICMPv6EchoResponse(t *testing.T) {
+	out := make([]byte, 9001)
+
+	p := make([]byte, 40+8+4)
+	p[0] = 0x60
+	p[5] = 12 // payload length
+	p[6] = 58
+	p[7] = 3
+	p[23] = 1
+	p[39] = 2
+	p[40] = 128
+	copy(p[44:], []byte{0, 1, 0, 7, 'p', 'i', 'n', 'g'})
+
+	b := CreateICMPv6EchoResponse(p, out)
+	require.Len(t, b, len(p))
+	assert.Equal(t, p[8:24], b[24:40])
+	assert.Equal(t, p[24:40], b[8:24])
+	assert.Equal(t, byte(64), b[7])
+	assert.Equal(t, byte(129), b[40])
+	assert.Equal(t, p[44:], b[44:])
+	assert.Zero(t, tcpipChecksum(b[40:], ipv6PseudoheaderChecksum(b[8:24], b[24:40], 58, uint32(len(b)-40))))
+
+	// Only echo requests without extension headers, and only when the reply fits
+	p[40] = 129
+	assert.Nil(t, CreateICMPv6EchoResponse(p, out))
+	p[40] = 128
+	p[6] = 0
+	assert.Nil(t, CreateICMPv6EchoResponse(p, out))
+	p[6] = 58
+	p[5] = 13
+	assert.Nil(t, CreateICMPv6EchoResponse(p, out))
+	p[5] = 12
+	assert.Nil(t, CreateICMPv6EchoResponse(p, make([]byte, 10)))
+	assert.Nil(t, CreateICMPv6EchoResponse(p[:40], out))
+}
@@ -0,0 +1,158 @@
+package k8s
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+var ErrPoolExhausted = errors.New("no free addresses remain in the pod network")
+
+// Allocation is an overlay address handed to a single pod
+type Allocation struct {
+	PodUID         string     `json:"podUid"`
+	Pod            string     `json:"pod"`
+	Namespace      string     `json:"namespace"`
+	ServiceAccount string     `json:"serviceAccount"`
+	Addr           netip.Addr `json:"addr"`
+	Groups         []string   `json:"groups"`
+}
+
+// Allocator hands out addresses from a prefix, keyed by pod uid. The network and broadcast addresses of v4 prefixes as
+// well as the first address, which is reserved for the node, are never handed out.
+type Allocator struct {
+	sync.Mutex
+	prefix netip.Prefix
+	byUID  map[string]*Allocation
+	byAddr map[netip.Addr]*Allocation
+	next   netip.Addr
+}
+
+func NewAllocator(prefix netip.Prefix) *Allocator {
+	prefix = prefix.Masked()
+	return &Allocator{
+		prefix: prefix,
+		byUID:  map[string]*Allocation{},
+		byAddr: map[netip.Addr]*Allocation{},
+		next:   prefix.Addr().Next().Next(),
+	}
+}
+
+// Prefix returns the pod network addresses are allocated from
+func (a *Allocator) Prefix() netip.Prefix {
+	return a.prefix
+}
+
+// Gateway returns the reserved node address within the pod network
+func (a *Allocator) Gateway() netip.Addr {
+	return a.prefix.Addr().Next()
+}
+
+// Allocate returns the existing allocation for the pod uid or assigns a new address. Allocations are copied in and out.
+func (a *Allocator) Allocate(req Allocation) (Allocation, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if existing, ok := a.byUID[req.PodUID]; ok {
+		return copyAllocation(existing), nil
+	}
+
+	addr, ok := a.unlockedFindFree()
+	if !ok {
+		return Allocation{}, ErrPoolExhausted
+	}
+
+	req.Addr = addr
+	req.Groups = append([]string(nil), req.Groups...)
+	na := &req
+	a.byUID[na.PodUID] = na
+	a.byAddr[addr] = na
+	a.next = addr.Next()
+
+	return copyAllocation(na), nil
+}
+
+// Release frees the address held by the pod uid, reporting if an allocation existed
+func (a *Allocator) Release(podUID string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	existing, ok := a.byUID[podUID]
+	if !ok {
+		return false
+	}
+
+	delete(a.byUID, podUID)
+	delete(a.byAddr, existing.Addr)
+	return true
+}
+
+// List returns a copy of all allocations ordered by address
+func (a *Allocator) List() []Allocation {
+	a.Lock()
+	defer a.Unlock()
+
+	out := make([]Allocation, 0, len(a.byUID))
+	for _, v := range a.byUID {
+		out = append(out, copyAllocation(v))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Addr.Less(out[j].Addr)
+	})
+	return out
+}
+
+// unlockedFindFree walks the prefix once starting from the address after the last allocation
+func (a *Allocator) unlockedFindFree() (netip.Addr, bool) {
+	first := a.prefix.Addr().Next().Next()
+	start := a.next
+	if !a.prefix.Contains(start) {
+		start = first
+	}
+
+	addr := start
+	wrapped := false
+	for {
+		if !addr.IsValid() || !a.prefix.Contains(addr) {
+			if wrapped || start == first {
+				return netip.Addr{}, false
+			}
+			addr = first
+			wrapped = true
+		}
+
+		if wrapped && addr == start {
+			return netip.Addr{}, false
+		}
+
+		if a.usable(addr) {
+			if _, taken := a.byAddr[addr]; !taken {
+				return addr, true
+			}
+		}
+
+		addr = addr.Next()
+	}
+}
+
+func (a *Allocator) usable(addr netip.Addr) bool {
+	if !a.prefix.Contains(addr) || addr == a.prefix.Addr() || addr == a.Gateway() {
+		return false
+	}
+
+	if addr.Is4() {
+		// Avoid the broadcast address
+		next := addr.Next()
+		return next.IsValid() && a.prefix.Contains(next)
+	}
+
+	return true
+}
+
+func copyAllocation(a *Allocation) Allocation {
+	c := *a
+	c.Groups = append([]string(nil), a.Groups...)
+	return c
+}
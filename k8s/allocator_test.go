@@ -0,0 +1,64 @@
+package k8s
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocator_Allocate(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("10.42.0.7/29"))
+	assert.Equal(t, netip.MustParsePrefix("10.42.0.0/29"), a.Prefix())
+	assert.Equal(t, netip.MustParseAddr("10.42.0.1"), a.Gateway())
+
+	// .0 is the network, .1 the gateway, and .7 broadcast, leaving 5 usable addresses
+	var got []netip.Addr
+	for _, uid := range []string{"a", "b", "c", "d", "e"} {
+		al, err := a.Allocate(Allocation{PodUID: uid, Groups: []string{"g"}})
+		require.NoError(t, err)
+		got = append(got, al.Addr)
+	}
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("10.42.0.2"),
+		netip.MustParseAddr("10.42.0.3"),
+		netip.MustParseAddr("10.42.0.4"),
+		netip.MustParseAddr("10.42.0.5"),
+		netip.MustParseAddr("10.42.0.6"),
+	}, got)
+
+	_, err := a.Allocate(Allocation{PodUID: "f"})
+	require.ErrorIs(t, err, ErrPoolExhausted)
+
+	// Repeated requests for the same pod are idempotent
+	al, err := a.Allocate(Allocation{PodUID: "c"})
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.42.0.4"), al.Addr)
+	assert.Equal(t, []string{"g"}, al.Groups)
+
+	// Released addresses are reused once the pool wraps
+	assert.True(t, a.Release("c"))
+	assert.False(t, a.Release("c"))
+	al, err = a.Allocate(Allocation{PodUID: "f"})
+	require.NoError(t, err)
+	assert.Equal(t, netip.MustParseAddr("10.42.0.4"), al.Addr)
+
+	list := a.List()
+	require.Len(t, list, 5)
+	assert.Equal(t, "f", list[2].PodUID)
+}
+
+func TestAllocator_AllocateV6(t *testing.T) {
+	a := NewAllocator(netip.MustParsePrefix("fd42::/126"))
+
+	// v6 has no broadcast so the last address is usable
+	for _, want := range []string{"fd42::2", "fd42::3"} {
+		al, err := a.Allocate(Allocation{PodUID: want})
+		require.NoError(t, err)
+		assert.Equal(t, netip.MustParseAddr(want), al.Addr)
+	}
+
+	_, err := a.Allocate(Allocation{PodUID: "x"})
+	require.ErrorIs(t, err, ErrPoolExhausted)
+}
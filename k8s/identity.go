@@ -0,0 +1,158 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+var ErrUnauthenticated = errors.New("service account token was not authenticated")
+
+// Identity is the verified service account a pod is running as
+type Identity struct {
+	Namespace      string
+	ServiceAccount string
+	PodName        string
+	PodUID         string
+}
+
+// TokenReviewer verifies service account tokens presented by pods
+type TokenReviewer interface {
+	Review(ctx context.Context, token string) (Identity, error)
+}
+
+// apiTokenReviewer verifies tokens with the kubernetes TokenReview api
+type apiTokenReviewer struct {
+	host      string
+	token     string
+	audiences []string
+	client    *http.Client
+}
+
+// NewInClusterTokenReviewer builds a TokenReviewer using the credentials kubernetes mounts into every pod
+func NewInClusterTokenReviewer(audiences []string) (TokenReviewer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	token, err := os.ReadFile(inClusterTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	ca, err := os.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found in the service account ca")
+	}
+
+	return &apiTokenReviewer{
+		host:      "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		audiences: audiences,
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}},
+	}, nil
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool   `json:"authenticated"`
+	Error         string `json:"error"`
+	User          struct {
+		Username string              `json:"username"`
+		Extra    map[string][]string `json:"extra"`
+	} `json:"user"`
+}
+
+func (r *apiTokenReviewer) Review(ctx context.Context, token string) (Identity, error) {
+	b, err := json.Marshal(tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: r.audiences},
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.host+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(b))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("unexpected status from TokenReview: %s", resp.Status)
+	}
+
+	var tr tokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return Identity{}, err
+	}
+
+	return identityFromReview(tr.Status)
+}
+
+func identityFromReview(s tokenReviewStatus) (Identity, error) {
+	if !s.Authenticated {
+		if s.Error != "" {
+			return Identity{}, fmt.Errorf("%w: %s", ErrUnauthenticated, s.Error)
+		}
+		return Identity{}, ErrUnauthenticated
+	}
+
+	// Service account usernames take the form system:serviceaccount:<namespace>:<name>
+	parts := strings.Split(s.User.Username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return Identity{}, fmt.Errorf("%w: %s is not a service account", ErrUnauthenticated, s.User.Username)
+	}
+
+	id := Identity{Namespace: parts[2], ServiceAccount: parts[3]}
+
+	// Bound tokens carry the pod they were issued to
+	if v := s.User.Extra["authentication.kubernetes.io/pod-name"]; len(v) > 0 {
+		id.PodName = v[0]
+	}
+	if v := s.User.Extra["authentication.kubernetes.io/pod-uid"]; len(v) > 0 {
+		id.PodUID = v[0]
+	}
+
+	return id, nil
+}
@@ -0,0 +1,273 @@
+// Package k8s hands out overlay addresses to the pods on a node when nebula runs as a DaemonSet.
+//
+// Pods, or a sidecar or CNI plugin acting for them, talk to nebula over a small versioned api: json over http on a
+// unix socket. It is not gRPC on purpose, nebula carries no gRPC dependency and a CNI plugin or shell hook can drive
+// this api with curl and nothing else. Version 1 of the api is:
+//
+//	POST /v1/allocate {"token", "podUid", "pod", "namespace", "serviceAccount"}
+//	  200 {"podUid", "pod", "namespace", "serviceAccount", "addr", "groups", "network", "gateway", "mtu"}
+//	POST /v1/release {"token", "podUid"}
+//	  204 with no body
+//	GET /v1/allocations
+//	  200 [{"podUid", "pod", "namespace", "serviceAccount", "addr", "groups"}, ...]
+//
+// Any error is answered with a 4xx or 5xx status and {"error": "..."}. Within a version fields are only ever added,
+// clients must ignore fields they do not know. Removing or changing the meaning of a field, path, or status means a new
+// version under a new path prefix, /v2, served alongside the old one.
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Policy maps a service account, as `namespace/name`, to the firewall groups that may reach its pods.
+// `namespace/*` and `*` entries are consulted when no exact match exists.
+type Policy map[string][]string
+
+// Groups returns the groups for the service account and whether the service account is allowed an address at all
+func (p Policy) Groups(namespace, serviceAccount string) ([]string, bool) {
+	for _, k := range []string{namespace + "/" + serviceAccount, namespace + "/*", "*"} {
+		if g, ok := p[k]; ok {
+			return g, true
+		}
+	}
+	return nil, false
+}
+
+// AllocateRequest is sent by a pod, or a sidecar on its behalf, to obtain an overlay address
+type AllocateRequest struct {
+	// Token is the pods service account token, required when token verification is enabled
+	Token string `json:"token,omitempty"`
+
+	PodUID         string `json:"podUid"`
+	Pod            string `json:"pod"`
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"serviceAccount"`
+}
+
+// AllocateResponse describes the address assigned to the pod
+type AllocateResponse struct {
+	Allocation
+	Network string `json:"network"`
+	Gateway string `json:"gateway"`
+	MTU     int    `json:"mtu"`
+}
+
+// ReleaseRequest returns a pods address to the pool
+type ReleaseRequest struct {
+	Token  string `json:"token,omitempty"`
+	PodUID string `json:"podUid"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server serves the pod api described in the package doc, assigning overlay addresses to pods
+type Server struct {
+	l         *logrus.Logger
+	allocator *Allocator
+	reviewer  TokenReviewer
+	policy    Policy
+	mtu       int
+	onChange  func()
+
+	srv *http.Server
+}
+
+// NewServer creates a pod api server. If reviewer is nil the identity claimed in the request is trusted, access to the
+// socket must then be restricted by other means. onChange is called after any allocation is added or removed.
+func NewServer(l *logrus.Logger, allocator *Allocator, reviewer TokenReviewer, policy Policy, mtu int, onChange func()) *Server {
+	s := &Server{
+		l:         l,
+		allocator: allocator,
+		reviewer:  reviewer,
+		policy:    policy,
+		mtu:       mtu,
+		onChange:  onChange,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/allocate", s.handleAllocate)
+	mux.HandleFunc("POST /v1/release", s.handleRelease)
+	mux.HandleFunc("GET /v1/allocations", s.handleList)
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	return s
+}
+
+// Allocator returns the allocator backing this server
+func (s *Server) Allocator() *Allocator {
+	return s.allocator
+}
+
+// Listen creates the unix socket at path, replacing any stale socket left behind by a previous process
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0o660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// Serve blocks serving requests on ln until Close is called
+func (s *Server) Serve(ln net.Listener) error {
+	err := s.srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func (s *Server) handleAllocate(w http.ResponseWriter, r *http.Request) {
+	var req AllocateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	id, err := s.identify(r.Context(), req.Token, Identity{
+		Namespace:      req.Namespace,
+		ServiceAccount: req.ServiceAccount,
+		PodName:        req.Pod,
+		PodUID:         req.PodUID,
+	})
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if id.PodUID == "" || id.Namespace == "" || id.ServiceAccount == "" {
+		writeError(w, http.StatusBadRequest, errors.New("podUid, namespace, and serviceAccount are required"))
+		return
+	}
+
+	groups, ok := s.policy.Groups(id.Namespace, id.ServiceAccount)
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Errorf("service account %s/%s is not allowed an address", id.Namespace, id.ServiceAccount))
+		return
+	}
+
+	a, err := s.allocator.Allocate(Allocation{
+		PodUID:         id.PodUID,
+		Pod:            id.PodName,
+		Namespace:      id.Namespace,
+		ServiceAccount: id.ServiceAccount,
+		Groups:         groups,
+	})
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	s.l.WithField("allocation", a).Info("Assigned pod address")
+	s.onChange()
+
+	writeJSON(w, http.StatusOK, AllocateResponse{
+		Allocation: a,
+		Network:    s.allocator.Prefix().String(),
+		Gateway:    s.allocator.Gateway().String(),
+		MTU:        s.mtu,
+	})
+}
+
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	if s.reviewer != nil {
+		id, err := s.identify(r.Context(), req.Token, Identity{})
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		// Only the service account that owns an allocation may release it
+		for _, a := range s.allocator.List() {
+			if a.PodUID == req.PodUID && (a.Namespace != id.Namespace || a.ServiceAccount != id.ServiceAccount) {
+				writeError(w, http.StatusForbidden, errors.New("allocation belongs to a different service account"))
+				return
+			}
+		}
+	}
+
+	if !s.allocator.Release(req.PodUID) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no allocation for pod %s", req.PodUID))
+		return
+	}
+
+	s.l.WithField("podUid", req.PodUID).Info("Released pod address")
+	s.onChange()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.allocator.List())
+}
+
+// identify returns the verified identity behind token, or claimed when token verification is disabled
+func (s *Server) identify(ctx context.Context, token string, claimed Identity) (Identity, error) {
+	if s.reviewer == nil {
+		return claimed, nil
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return Identity{}, errors.New("a service account token is required")
+	}
+
+	id, err := s.reviewer.Review(ctx, token)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	// Bound tokens name their pod, fall back to the claim for legacy tokens
+	if id.PodUID == "" {
+		id.PodUID = claimed.PodUID
+		id.PodName = claimed.PodName
+	}
+
+	return id, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
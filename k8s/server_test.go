@@ -0,0 +1,140 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticReviewer map[string]Identity
+
+func (r staticReviewer) Review(_ context.Context, token string) (Identity, error) {
+	id, ok := r[token]
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+	return id, nil
+}
+
+func doJSON(t *testing.T, s *Server, method, path string, body any) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(b)))
+	return w
+}
+
+func TestServer(t *testing.T) {
+	changes := 0
+	reviewer := staticReviewer{
+		"web-token":   {Namespace: "prod", ServiceAccount: "web", PodName: "web-1", PodUID: "uid-web"},
+		"other-token": {Namespace: "prod", ServiceAccount: "other", PodUID: "uid-other"},
+		"batch-token": {Namespace: "batch", ServiceAccount: "job"},
+	}
+	policy := Policy{
+		"prod/web": {"frontend", "monitoring"},
+		"prod/*":   {"internal"},
+	}
+	s := NewServer(test.NewLogger(), NewAllocator(netip.MustParsePrefix("10.42.0.0/24")), reviewer, policy, 1300, func() { changes++ })
+
+	w := doJSON(t, s, http.MethodPost, "/v1/allocate", AllocateRequest{Token: "bad"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Claims in the request are ignored in favor of the verified token
+	w = doJSON(t, s, http.MethodPost, "/v1/allocate", AllocateRequest{Token: "web-token", Namespace: "kube-system", ServiceAccount: "admin"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp AllocateResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "uid-web", resp.PodUID)
+	assert.Equal(t, "prod", resp.Namespace)
+	assert.Equal(t, netip.MustParseAddr("10.42.0.2"), resp.Addr)
+	assert.Equal(t, []string{"frontend", "monitoring"}, resp.Groups)
+	assert.Equal(t, "10.42.0.0/24", resp.Network)
+	assert.Equal(t, "10.42.0.1", resp.Gateway)
+	assert.Equal(t, 1300, resp.MTU)
+	assert.Equal(t, 1, changes)
+
+	// Service accounts without a policy entry are refused
+	w = doJSON(t, s, http.MethodPost, "/v1/allocate", AllocateRequest{Token: "batch-token", PodUID: "uid-batch"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doJSON(t, s, http.MethodPost, "/v1/allocate", AllocateRequest{Token: "other-token"})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []string{"internal"}, resp.Groups)
+
+	w = doJSON(t, s, http.MethodGet, "/v1/allocations", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list []Allocation
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list, 2)
+
+	// Only the owning service account may release an address
+	w = doJSON(t, s, http.MethodPost, "/v1/release", ReleaseRequest{Token: "other-token", PodUID: "uid-web"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doJSON(t, s, http.MethodPost, "/v1/release", ReleaseRequest{Token: "web-token", PodUID: "uid-web"})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, 3, changes)
+
+	w = doJSON(t, s, http.MethodPost, "/v1/release", ReleaseRequest{Token: "web-token", PodUID: "uid-web"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestIdentityFromReview(t *testing.T) {
+	var s tokenReviewStatus
+	_, err := identityFromReview(s)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	s.Authenticated = true
+	s.User.Username = "alice"
+	_, err = identityFromReview(s)
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	s.User.Username = "system:serviceaccount:prod:web"
+	s.User.Extra = map[string][]string{
+		"authentication.kubernetes.io/pod-name": {"web-1"},
+		"authentication.kubernetes.io/pod-uid":  {"uid-web"},
+	}
+	id, err := identityFromReview(s)
+	require.NoError(t, err)
+	assert.Equal(t, Identity{Namespace: "prod", ServiceAccount: "web", PodName: "web-1", PodUID: "uid-web"}, id)
+}
+
+// TestServer_v1WireFormat pins the field names of the v1 api, changing them needs a new api version
+func TestServer_v1WireFormat(t *testing.T) {
+	s := NewServer(test.NewLogger(), NewAllocator(netip.MustParsePrefix("10.42.0.0/24")), nil, Policy{"*": {"pods"}}, 1300, func() {})
+
+	w := doJSON(t, s, http.MethodPost, "/v1/allocate", map[string]string{
+		"podUid": "uid-web", "pod": "web-1", "namespace": "prod", "serviceAccount": "web",
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"podUid": "uid-web", "pod": "web-1", "namespace": "prod", "serviceAccount": "web", "addr": "10.42.0.2",
+		"groups": ["pods"], "network": "10.42.0.0/24", "gateway": "10.42.0.1", "mtu": 1300
+	}`, w.Body.String())
+
+	w = doJSON(t, s, http.MethodGet, "/v1/allocations", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{
+		"podUid": "uid-web", "pod": "web-1", "namespace": "prod", "serviceAccount": "web", "addr": "10.42.0.2",
+		"groups": ["pods"]
+	}]`, w.Body.String())
+
+	w = doJSON(t, s, http.MethodPost, "/v1/release", map[string]string{"podUid": "uid-missing"})
+	require.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "no allocation for pod uid-missing"}`, w.Body.String())
+}
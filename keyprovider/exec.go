@@ -0,0 +1,52 @@
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/anmitsu/go-shlex"
+	"github.com/slackhq/nebula/cert"
+)
+
+// execTimeout is how long the command for an exec key has to print it
+const execTimeout = 30 * time.Second
+
+// execProvider runs a command that prints a PEM private key, ex: exec:/usr/local/bin/unwrap-nebula-key --host web-1
+// This covers anything with a command line client, such as decrypting a key wrapped by AWS KMS with the aws cli.
+type execProvider struct{}
+
+func (execProvider) Load(uri string) (Key, error) {
+	args, err := shlex.Split(strings.TrimPrefix(uri, "exec:"), true)
+	if err != nil {
+		return Key{}, fmt.Errorf("unable to parse exec key command: %w", err)
+	}
+	if len(args) == 0 {
+		return Key{}, errors.New("exec key has no command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Key{}, fmt.Errorf("exec key command %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return keyFromPEM(stdout.Bytes())
+}
+
+func keyFromPEM(b []byte) (Key, error) {
+	raw, _, curve, err := cert.UnmarshalPrivateKeyFromPEM(b)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Private: raw, Curve: curve}, nil
+}
@@ -0,0 +1,93 @@
+// Package keyprovider loads the private key of a nebula host from somewhere other than the config, and does the
+// handshake DH for keys that never leave the device holding them. pki.key names such a key by uri, the part before the
+// first colon picks the provider. pkcs11, exec, and vault are built in, programs embedding nebula can Register more.
+package keyprovider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// Key is a private key loaded by a Provider
+type Key struct {
+	// Private is the raw private key. When InDevice is true it is the uri instead, DH is handed it back.
+	Private []byte
+	Curve   cert.Curve
+	// InDevice is true when the key can not leave the provider and every DH with it must go through the provider
+	InDevice bool
+}
+
+// Provider loads the private key named by a uri
+type Provider interface {
+	Load(uri string) (Key, error)
+}
+
+// DeviceProvider is a Provider that keeps its keys, such as a hardware security module or a TPM
+type DeviceProvider interface {
+	Provider
+	// DH does an ECDH between the key named by uri and peerPublicKey
+	DH(uri string, peerPublicKey []byte) ([]byte, error)
+}
+
+var (
+	lock      sync.RWMutex
+	providers = map[string]Provider{}
+)
+
+func init() {
+	Register("pkcs11", pkcs11Provider{})
+	Register("exec", execProvider{})
+	Register("vault", vaultProvider{})
+}
+
+// Register makes p handle uris starting with scheme:, replacing any provider registered for scheme before
+func Register(scheme string, p Provider) {
+	lock.Lock()
+	defer lock.Unlock()
+	providers[scheme] = p
+}
+
+// Lookup returns the provider for uri, if any
+func Lookup(uri string) (Provider, bool) {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, false
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+	p, ok := providers[scheme]
+	return p, ok
+}
+
+// InDevice reports whether key is the uri of a key held by a DeviceProvider rather than a raw key
+func InDevice(key []byte) bool {
+	p, ok := Lookup(string(key))
+	if !ok {
+		return false
+	}
+	_, ok = p.(DeviceProvider)
+	return ok
+}
+
+// DH does an ECDH between the device key named by uri and peerPublicKey
+func DH(uri string, peerPublicKey []byte) ([]byte, error) {
+	p, ok := Lookup(uri)
+	if !ok {
+		return nil, fmt.Errorf("no key provider for %s", scheme(uri))
+	}
+
+	dp, ok := p.(DeviceProvider)
+	if !ok {
+		return nil, fmt.Errorf("key provider %s does not hold keys", scheme(uri))
+	}
+	return dp.DH(uri, peerPublicKey)
+}
+
+func scheme(uri string) string {
+	s, _, _ := strings.Cut(uri, ":")
+	return s
+}
@@ -0,0 +1,140 @@
+package keyprovider
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDevice struct {
+	key *ecdh.PrivateKey
+}
+
+func (d testDevice) Load(uri string) (Key, error) {
+	return Key{Private: []byte(uri), Curve: cert.Curve_CURVE25519, InDevice: true}, nil
+}
+
+func (d testDevice) DH(_ string, peerPublicKey []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return d.key.ECDH(pub)
+}
+
+func TestRegister(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	Register("testdevice", testDevice{key: key})
+
+	p, ok := Lookup("testdevice:slot=1")
+	require.True(t, ok)
+	k, err := p.Load("testdevice:slot=1")
+	require.NoError(t, err)
+	assert.True(t, k.InDevice)
+	assert.True(t, InDevice(k.Private))
+
+	// Raw keys, paths, and providers that hand over their keys are not devices
+	assert.False(t, InDevice(key.Bytes()))
+	assert.False(t, InDevice([]byte("/etc/nebula/host.key")))
+	assert.False(t, InDevice([]byte(`C:\nebula\host.key`)))
+	assert.False(t, InDevice([]byte("exec:cat host.key")))
+	_, ok = Lookup("/etc/nebula/host.key")
+	assert.False(t, ok)
+
+	peer, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	secret, err := DH("testdevice:slot=1", peer.PublicKey().Bytes())
+	require.NoError(t, err)
+	want, err := peer.ECDH(key.PublicKey())
+	require.NoError(t, err)
+	assert.Equal(t, want, secret)
+
+	_, err = DH("exec:cat host.key", peer.PublicKey().Bytes())
+	require.ErrorContains(t, err, "key provider exec does not hold keys")
+	_, err = DH("nope:thing", peer.PublicKey().Bytes())
+	require.ErrorContains(t, err, "no key provider for nope")
+}
+
+func testKeyPEM(t *testing.T) ([]byte, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key.Bytes(), cert.MarshalPrivateKeyToPEM(cert.Curve_CURVE25519, key.Bytes())
+}
+
+func TestExecProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses cat")
+	}
+
+	raw, pem := testKeyPEM(t)
+	path := filepath.Join(t.TempDir(), "host key.pem")
+	require.NoError(t, os.WriteFile(path, pem, 0600))
+
+	k, err := execProvider{}.Load(`exec:cat "` + path + `"`)
+	require.NoError(t, err)
+	assert.Equal(t, raw, k.Private)
+	assert.Equal(t, cert.Curve_CURVE25519, k.Curve)
+	assert.False(t, k.InDevice)
+
+	_, err = execProvider{}.Load("exec:cat /does/not/exist")
+	require.ErrorContains(t, err, "exec key command cat failed")
+	_, err = execProvider{}.Load("exec:")
+	require.ErrorContains(t, err, "exec key has no command")
+}
+
+func TestVaultProvider(t *testing.T) {
+	raw, pem := testKeyPEM(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/nebula/web-1":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": map[string]any{"key": string(pem)}}})
+		case "/v1/kv/nebula/web-1":
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"private": string(pem)}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "s.token")
+
+	// kv version 2
+	k, err := vaultProvider{}.Load("vault:secret/data/nebula/web-1")
+	require.NoError(t, err)
+	assert.Equal(t, raw, k.Private)
+
+	// kv version 1 with another field name
+	k, err = vaultProvider{}.Load("vault:kv/nebula/web-1?field=private")
+	require.NoError(t, err)
+	assert.Equal(t, raw, k.Private)
+
+	_, err = vaultProvider{}.Load("vault:kv/nebula/web-1")
+	require.ErrorContains(t, err, "vault secret kv/nebula/web-1 has no key field")
+	_, err = vaultProvider{}.Load("vault:kv/nebula/web-2")
+	require.ErrorContains(t, err, "404")
+
+	t.Setenv("VAULT_TOKEN", "wrong")
+	_, err = vaultProvider{}.Load("vault:secret/data/nebula/web-1")
+	require.ErrorContains(t, err, "403")
+
+	t.Setenv("VAULT_ADDR", "")
+	_, err = vaultProvider{}.Load("vault:secret/data/nebula/web-1")
+	require.ErrorContains(t, err, "VAULT_ADDR must be set")
+}
@@ -0,0 +1,28 @@
+package keyprovider
+
+import (
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/pkclient"
+)
+
+// pkcs11Provider uses a P256 key in a PKCS#11 token, ex: pkcs11:slot-id=0;object=nebula?module-path=/usr/lib/libsofthsm2.so
+// TPM2 devices can be used through tpm2-pkcs11.
+type pkcs11Provider struct{}
+
+func (pkcs11Provider) Load(uri string) (Key, error) {
+	return Key{Private: []byte(uri), Curve: cert.Curve_P256, InDevice: true}, nil
+}
+
+func (pkcs11Provider) DH(uri string, peerPublicKey []byte) ([]byte, error) {
+	//this is not the most performant way to do this (a long-lived client would be better)
+	//but, it works, and helps avoid problems with stale sessions and HSMs used by multiple users.
+	client, err := pkclient.FromUrl(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer func(client *pkclient.PKClient) {
+		_ = client.Close()
+	}(client)
+
+	return client.DeriveNoise(peerPublicKey)
+}
@@ -0,0 +1,38 @@
+package keyprovider
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// vaultProvider reads a PEM private key from a HashiCorp Vault kv secret, ex: vault:secret/data/nebula/web-1?field=key
+// The secret is read the same way as a vault:// config secret reference. field defaults to key.
+type vaultProvider struct{}
+
+func (vaultProvider) Load(uri string) (Key, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "vault:"), "?")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return Key{}, errors.New("vault key has no secret path")
+	}
+
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return Key{}, fmt.Errorf("unable to parse vault key options: %w", err)
+	}
+	field := q.Get("field")
+	if field == "" {
+		field = "key"
+	}
+
+	pem, err := config.ResolveSecret("vault://" + path + "#" + field)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return keyFromPEM([]byte(pem))
+}
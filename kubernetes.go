@@ -0,0 +1,118 @@
+package nebula
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/k8s"
+	"github.com/slackhq/nebula/overlay"
+)
+
+const defaultPodSocket = "/var/run/nebula/pods.sock"
+
+// podNetwork hands out addresses from an unsafe network to the pods on this node and opens the firewall for them
+type podNetwork struct {
+	l      *logrus.Logger
+	path   string
+	server *k8s.Server
+
+	// onChange is called when allocations change, it is wired to a firewall rebuild once the interface exists
+	onChange func()
+}
+
+func newPodNetworkFromConfig(l *logrus.Logger, c *config.C, cs *CertState) (*podNetwork, error) {
+	if !c.GetBool("kubernetes.enabled", false) {
+		return nil, nil
+	}
+
+	rawNetwork := c.GetString("kubernetes.pod_network", "")
+	network, err := netip.ParsePrefix(rawNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes.pod_network is not a valid cidr: %q", rawNetwork)
+	}
+
+	if !cs.unsafeNetworksContain(network) {
+		l.WithField("podNetwork", network).
+			Warn("kubernetes.pod_network is not within the unsafe networks of this hosts certificate, pod traffic will be dropped")
+	}
+
+	policy, err := podPolicyFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var reviewer k8s.TokenReviewer
+	if c.GetBool("kubernetes.verify_tokens", true) {
+		reviewer, err = k8s.NewInClusterTokenReviewer(c.GetStringSlice("kubernetes.audiences", nil))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure kubernetes token verification: %w", err)
+		}
+	}
+
+	p := &podNetwork{
+		l:        l,
+		path:     c.GetString("kubernetes.listen", defaultPodSocket),
+		onChange: func() {},
+	}
+	p.server = k8s.NewServer(
+		l,
+		k8s.NewAllocator(network),
+		reviewer,
+		policy,
+		c.GetInt("tun.mtu", overlay.DefaultMTU),
+		func() { p.onChange() },
+	)
+
+	return p, nil
+}
+
+func podPolicyFromConfig(c *config.C) (k8s.Policy, error) {
+	policy := k8s.Policy{}
+	for k, v := range c.GetMap("kubernetes.service_accounts", map[string]any{}) {
+		rawGroups, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("kubernetes.service_accounts.%v must be a list of groups", k)
+		}
+
+		groups := make([]string, len(rawGroups))
+		for i, g := range rawGroups {
+			groups[i] = fmt.Sprint(g)
+		}
+		policy[fmt.Sprint(k)] = groups
+	}
+
+	return policy, nil
+}
+
+// Start serves the pod api until the context is canceled
+func (p *podNetwork) Start(ctx context.Context) {
+	ln, err := k8s.Listen(p.path)
+	if err != nil {
+		p.l.WithError(err).WithField("listen", p.path).Error("Failed to listen for kubernetes pod requests")
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		p.server.Close()
+	}()
+
+	p.l.WithField("listen", p.path).Info("Kubernetes pod api listening")
+	if err := p.server.Serve(ln); err != nil {
+		p.l.WithError(err).Error("Kubernetes pod api failed")
+	}
+}
+
+// addFirewallRules allows inbound traffic to each pod from any host holding one of the groups mapped to its service account
+func (p *podNetwork) addFirewallRules(fw FirewallInterface) error {
+	for _, a := range p.server.Allocator().List() {
+		if err := addLocalGroupRules(fw, a.Addr, a.Groups); err != nil {
+			return fmt.Errorf("failed to add firewall rule for pod %s/%s: %w", a.Namespace, a.Pod, err)
+		}
+	}
+
+	return nil
+}
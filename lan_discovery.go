@@ -0,0 +1,217 @@
+package nebula
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/beacon"
+	"github.com/slackhq/nebula/header"
+)
+
+const (
+	// lanPeerExpiry is how many missed announcements it takes to forget a lan address
+	lanPeerExpiry = 3
+
+	// maxLanPeers caps how many vpn addrs we hold lan addresses for, announcements for new vpn addrs are ignored
+	// while the table is full
+	maxLanPeers = 1024
+
+	// maxLanAddrsPerPeer caps how many lan addresses we hold for a single vpn addr
+	maxLanAddrsPerPeer = 4
+)
+
+// lanDiscovery keeps the lan addresses of hosts heard through lan_discovery announcements. Announcements are not
+// authenticated so the addresses are kept apart from the lighthouse address map and only ever offered to the
+// handshake manager as extra candidates, the handshake proves who is actually there.
+type lanDiscovery struct {
+	sync.Mutex
+	f  *Interface
+	bc *beacon.Config
+
+	// peers maps each announced vpn addr to the lan addresses we heard it on and when
+	peers map[netip.Addr]map[netip.AddrPort]time.Time
+}
+
+func newLanDiscovery(f *Interface, bc *beacon.Config) *lanDiscovery {
+	return &lanDiscovery{
+		f:     f,
+		bc:    bc,
+		peers: map[netip.Addr]map[netip.AddrPort]time.Time{},
+	}
+}
+
+func (ld *lanDiscovery) Start(ctx context.Context) {
+	err := beacon.Run(ctx, ld.f.l, ld.bc, ld.announce, func(a beacon.Announcement, from netip.Addr) {
+		ld.heard(a, from, time.Now())
+	})
+	if err != nil {
+		ld.f.l.WithError(err).Error("Failed to start lan discovery")
+		return
+	}
+
+	ld.f.l.WithField("group", ld.bc.Group).WithField("interfaces", ld.bc.Interfaces).Info("Lan discovery started")
+
+	ticker := time.NewTicker(ld.bc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ld.expire(now)
+		}
+	}
+}
+
+func (ld *lanDiscovery) announce() (beacon.Announcement, bool) {
+	crt := ld.f.pki.getCertState().GetDefaultCertificate()
+	fp, err := crt.Fingerprint()
+	if err != nil {
+		ld.f.l.WithError(err).Error("Failed to fingerprint our certificate for lan discovery")
+		return beacon.Announcement{}, false
+	}
+
+	return beacon.Announcement{
+		VpnAddrs:    ld.f.myVpnAddrs,
+		Fingerprint: fp,
+		Port:        uint16(ld.f.lightHouse.nebulaPort),
+	}, true
+}
+
+// allowedVpnAddr reports if vpnAddr is one a peer could hold, it must be within our networks and those of a CA we trust
+func (ld *lanDiscovery) allowedVpnAddr(vpnAddr netip.Addr) bool {
+	if !ld.f.lightHouse.myVpnNetworksTable.Contains(vpnAddr) {
+		return false
+	}
+
+	for _, ca := range ld.f.pki.GetCAPool().CAs {
+		networks := ca.Certificate.Networks()
+		if len(networks) == 0 {
+			// This CA may sign any vpn addr
+			return true
+		}
+		for _, network := range networks {
+			if network.Contains(vpnAddr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// heard records an announcement received from the underlay address from
+func (ld *lanDiscovery) heard(a beacon.Announcement, from netip.Addr, now time.Time) {
+	var vpnAddrs []netip.Addr
+	for _, vpnAddr := range a.VpnAddrs {
+		if ld.f.myVpnAddrsTable.Contains(vpnAddr) {
+			// Our own announcement looped back to us
+			return
+		}
+		if ld.allowedVpnAddr(vpnAddr) {
+			vpnAddrs = append(vpnAddrs, vpnAddr)
+		}
+	}
+
+	addr := netip.AddrPortFrom(from, a.Port)
+	if len(vpnAddrs) == 0 {
+		ld.f.l.WithField("vpnAddrs", a.VpnAddrs).WithField("udpAddr", addr).
+			Debug("Ignoring lan discovery announcement for vpn addrs outside our networks")
+		return
+	}
+
+	if !ld.f.lightHouse.shouldAdd(vpnAddrs, from) {
+		return
+	}
+
+	// A tunnel we already have tells us who really owns the vpn addr, don't let an announcement argue with it
+	hostinfo := ld.f.hostMap.QueryVpnAddr(vpnAddrs[0])
+	if hostinfo != nil {
+		if crt := hostinfo.GetCert(); crt != nil && crt.Fingerprint != a.Fingerprint {
+			ld.f.l.WithField("vpnAddr", vpnAddrs[0]).WithField("udpAddr", addr).
+				WithField("fingerprint", a.Fingerprint).
+				Debug("Ignoring lan discovery announcement that does not match the tunnel certificate")
+			return
+		}
+	}
+
+	added := false
+	ld.Lock()
+	for _, vpnAddr := range vpnAddrs {
+		addrs := ld.peers[vpnAddr]
+		if addrs == nil {
+			if len(ld.peers) >= maxLanPeers {
+				continue
+			}
+			addrs = map[netip.AddrPort]time.Time{}
+			ld.peers[vpnAddr] = addrs
+		}
+
+		if _, ok := addrs[addr]; !ok {
+			if len(addrs) >= maxLanAddrsPerPeer {
+				continue
+			}
+			added = true
+		}
+		addrs[addr] = now
+	}
+	ld.Unlock()
+
+	if !added {
+		return
+	}
+
+	ld.f.l.WithField("vpnAddrs", vpnAddrs).WithField("udpAddr", addr).Info("Found host through lan discovery")
+
+	// Probe the lan address of an existing tunnel, a reply roams the tunnel onto it
+	if hostinfo != nil && hostinfo.remote != addr && hostinfo.ConnectionState != nil {
+		ld.f.sendTo(header.Test, header.TestRequest, hostinfo.ConnectionState, hostinfo, addr, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+		return
+	}
+
+	// Kick a pending handshake so it tries the new address now rather than on its next retry
+	if ld.f.handshakeManager != nil && ld.f.handshakeManager.QueryVpnAddr(vpnAddrs[0]) != nil {
+		select {
+		case ld.f.handshakeManager.trigger <- vpnAddrs[0]:
+		default:
+		}
+	}
+}
+
+// candidates returns the lan addresses we heard vpnAddr on, other than the ones in skip
+func (ld *lanDiscovery) candidates(vpnAddr netip.Addr, skip []netip.AddrPort) []netip.AddrPort {
+	if ld == nil {
+		return nil
+	}
+
+	ld.Lock()
+	defer ld.Unlock()
+
+	var out []netip.AddrPort
+	for addr := range ld.peers[vpnAddr] {
+		if !slices.Contains(skip, addr) {
+			out = append(out, addr)
+		}
+	}
+	slices.SortFunc(out, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	return out
+}
+
+// expire forgets lan addresses we have not heard an announcement for in a while
+func (ld *lanDiscovery) expire(now time.Time) {
+	ld.Lock()
+	defer ld.Unlock()
+
+	for vpnAddr, addrs := range ld.peers {
+		maps.DeleteFunc(addrs, func(_ netip.AddrPort, seen time.Time) bool {
+			return now.Sub(seen) > lanPeerExpiry*ld.bc.Interval
+		})
+
+		if len(addrs) == 0 {
+			delete(ld.peers, vpnAddr)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/beacon"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLanDiscovery(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+
+	myVpnAddr := netip.MustParseAddr("10.128.0.1")
+	myVpnAddrsTable := new(bart.Lite)
+	myVpnAddrsTable.Insert(netip.PrefixFrom(myVpnAddr, 32))
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(netip.MustParsePrefix("10.128.0.0/24"))
+
+	ca, _, _, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), []netip.Prefix{netip.MustParsePrefix("10.128.0.0/25")}, nil, nil)
+	caPool := cert.NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	conf := config.NewC(l)
+	conn := &recordingConn{}
+	lh := newTestLighthouse()
+	lh.remoteAllowList.Store(&RemoteAllowList{})
+	lh.myVpnNetworksTable = myVpnNetworksTable
+	ifce := &Interface{
+		hostMap:           hostMap,
+		outside:           conn,
+		writers:           []udp.Conn{conn},
+		lightHouse:        lh,
+		pki:               &PKI{},
+		myVpnAddrs:        []netip.Addr{myVpnAddr},
+		myVpnAddrsTable:   myVpnAddrsTable,
+		connectionManager: newConnectionManagerFromConfig(l, conf, hostMap, NewPunchyFromConfig(l, conf)),
+		handshakeManager:  NewHandshakeManager(l, hostMap, lh, conn, defaultHandshakeConfig),
+		messageMetrics:    newMessageMetricsOnlyRecvError(),
+		l:                 l,
+	}
+	ifce.pki.caPool.Store(caPool)
+	ifce.connectionManager.intf = ifce
+	ifce.handshakeManager.f = ifce
+	lh.ifce = ifce
+
+	ld := newLanDiscovery(ifce, &beacon.Config{Interval: time.Second})
+	ifce.lanDiscovery = ld
+	peer := netip.MustParseAddr("10.128.0.2")
+	lanAddr := netip.MustParseAddrPort("192.168.1.2:4242")
+	now := time.Now()
+
+	// Our own announcements are ignored
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{myVpnAddr}, Fingerprint: "me", Port: 4242}, netip.MustParseAddr("192.168.1.1"), now)
+	assert.Empty(t, ld.peers)
+
+	// So are vpn addrs outside our networks or those of our CAs
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.200.0.2")}, Fingerprint: "peer", Port: 4242}, lanAddr.Addr(), now)
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{netip.MustParseAddr("10.128.0.200")}, Fingerprint: "peer", Port: 4242}, lanAddr.Addr(), now)
+	assert.Empty(t, ld.peers)
+
+	// A new host is a handshake candidate but never makes it into the lighthouse address map
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{peer}, Fingerprint: "peer", Port: 4242}, lanAddr.Addr(), now)
+	assert.Equal(t, []netip.AddrPort{lanAddr}, ld.candidates(peer, nil))
+	assert.Empty(t, ld.candidates(peer, []netip.AddrPort{lanAddr}))
+	assert.Empty(t, lh.addrMap)
+
+	// Blocked remotes are not offered to the handshake manager again
+	remotes := NewRemoteList([]netip.Addr{peer}, nil)
+	assert.Equal(t, []netip.AddrPort{lanAddr}, ifce.handshakeManager.lanCandidates(peer, remotes, nil))
+	remotes.BlockRemote(ViaSender{UdpAddr: lanAddr})
+	assert.Empty(t, ifce.handshakeManager.lanCandidates(peer, remotes, nil))
+
+	// An existing tunnel with a different certificate wins over an announcement
+	suite := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+	hostinfo := &HostInfo{
+		remote:        netip.MustParseAddrPort("1.1.1.1:4242"),
+		remotes:       NewRemoteList([]netip.Addr{peer}, nil),
+		vpnAddrs:      []netip.Addr{peer},
+		localIndexId:  100,
+		remoteIndexId: 200,
+		ConnectionState: &ConnectionState{
+			eKey:     NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{1}, 0)),
+			peerCert: &cert.CachedCertificate{Certificate: &dummyCert{}, Fingerprint: "peer"},
+		},
+	}
+	hostMap.unlockedAddHostInfo(hostinfo, ifce)
+
+	otherAddr := netip.MustParseAddrPort("192.168.1.3:4242")
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{peer}, Fingerprint: "imposter", Port: 4242}, otherAddr.Addr(), now)
+	assert.Equal(t, []netip.AddrPort{lanAddr}, ld.candidates(peer, nil))
+	assert.Empty(t, conn.sent)
+
+	// A new lan address for an established tunnel is probed so the tunnel can roam to it
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{peer}, Fingerprint: "peer", Port: 4242}, otherAddr.Addr(), now.Add(2*time.Second))
+	assert.Equal(t, []netip.AddrPort{lanAddr, otherAddr}, ld.candidates(peer, nil))
+	assert.Equal(t, []netip.AddrPort{otherAddr}, conn.sent)
+
+	// Hearing a known address again does not probe again
+	ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{peer}, Fingerprint: "peer", Port: 4242}, otherAddr.Addr(), now.Add(2*time.Second))
+	assert.Len(t, conn.sent, 1)
+
+	// Addresses we stop hearing about are forgotten
+	ld.expire(now.Add(4 * time.Second))
+	assert.Equal(t, []netip.AddrPort{otherAddr}, ld.candidates(peer, nil))
+
+	ld.expire(now.Add(10 * time.Second))
+	assert.Empty(t, ld.candidates(peer, nil))
+	assert.Empty(t, ld.peers)
+	assert.Empty(t, lh.addrMap)
+}
+
+func TestLanDiscovery_limits(t *testing.T) {
+	l := test.NewLogger()
+	myVpnAddrsTable := new(bart.Lite)
+	myVpnAddrsTable.Insert(netip.MustParsePrefix("10.0.0.1/32"))
+	myVpnNetworksTable := new(bart.Lite)
+	myVpnNetworksTable.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+
+	ca, _, _, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+	caPool := cert.NewCAPool()
+	require.NoError(t, caPool.AddCA(ca))
+
+	lh := newTestLighthouse()
+	lh.remoteAllowList.Store(&RemoteAllowList{})
+	lh.myVpnNetworksTable = myVpnNetworksTable
+	ifce := &Interface{
+		hostMap:         newHostMap(l),
+		lightHouse:      lh,
+		pki:             &PKI{},
+		myVpnAddrsTable: myVpnAddrsTable,
+		l:               l,
+	}
+	ifce.pki.caPool.Store(caPool)
+	ld := newLanDiscovery(ifce, &beacon.Config{Interval: time.Second})
+	now := time.Now()
+
+	// A single vpn addr holds a bounded number of lan addresses
+	peer := netip.MustParseAddr("10.0.0.2")
+	for i := range maxLanAddrsPerPeer + 2 {
+		ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{peer}, Port: 4242}, netip.AddrFrom4([4]byte{192, 168, 1, byte(i + 2)}), now)
+	}
+	assert.Len(t, ld.candidates(peer, nil), maxLanAddrsPerPeer)
+
+	// And the table holds a bounded number of vpn addrs
+	for i := range maxLanPeers + 10 {
+		vpnAddr := netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)})
+		ld.heard(beacon.Announcement{VpnAddrs: []netip.Addr{vpnAddr}, Port: 4242}, netip.MustParseAddr("192.168.1.2"), now)
+	}
+	assert.Len(t, ld.peers, maxLanPeers)
+}
@@ -5,10 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"net"
 	"net/netip"
 	"slices"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +16,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/discovery"
 	"github.com/slackhq/nebula/header"
 	"github.com/slackhq/nebula/udp"
 	"github.com/slackhq/nebula/util"
@@ -58,21 +57,51 @@ type LightHouse struct {
 	// since static should be rare
 	staticList  atomic.Pointer[map[netip.Addr]struct{}]
 	lighthouses atomic.Pointer[[]netip.Addr]
+	shards      atomic.Pointer[lighthouseShards]
+
+	// discoveryLock guards the inputs used to build staticList, static_host_map entries and hosts found by
+	// static_map.discovery are merged together
+	discoveryLock    sync.Mutex
+	configStaticList map[netip.Addr]struct{}
+	discovered       discovery.Hosts
+	discoveryEnabled bool
+	discoveryCancel  context.CancelFunc
+
+	remoteCacheCancel context.CancelFunc
 
 	interval     atomic.Int64
 	updateCancel context.CancelFunc
 	ifce         EncWriter
 	nebulaPort   uint32 // 32 bits because protobuf does not have a uint16
 
-	advertiseAddrs atomic.Pointer[[]netip.AddrPort]
+	advertiseAddrs atomic.Pointer[[]advertiseAddr]
+
+	// amRelay is relay.am_relay, relay-only advertised addresses from peers are only kept when it is true
+	amRelay atomic.Bool
 
 	// Addr's of relays that can be used by peers to access me
 	relaysForMe atomic.Pointer[[]netip.Addr]
 
+	// relayDiscovery tracks relay advertisements, see relay.advertise and relay.discover
+	relayDiscovery relayDiscovery
+
+	// subscriptions tracks who wants address changes pushed to them, see lighthouse.subscribe
+	subscriptions lighthouseSubscriptions
+	notifyChan    chan netip.Addr
+
 	queryChan chan netip.Addr
 
 	calculatedRemotes atomic.Pointer[bart.Table[[]*calculatedRemote]] // Maps VpnAddr to []*calculatedRemote
 
+	// health tracks how well each lighthouse answers our queries, see lighthouse_health.go
+	health *lighthouseHealth
+
+	// splitBrainThreshold is how long lighthouses may disagree about a host before we pick one, see lighthouse_split_brain.go
+	splitBrainThreshold atomic.Int64
+
+	// labels are our own key=value labels from the config, sent with our updates, see lighthouse_labels.go
+	labels atomic.Pointer[[]string]
+
 	metrics           *MessageMetrics
 	metricHolepunchTx metrics.Counter
 	l                 *logrus.Logger
@@ -106,6 +135,8 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 		punchConn:          pc,
 		punchy:             p,
 		queryChan:          make(chan netip.Addr, c.GetUint32("handshakes.query_buffer", 64)),
+		notifyChan:         make(chan netip.Addr, 64),
+		health:             newLighthouseHealth(),
 		l:                  l,
 	}
 	lighthouses := make([]netip.Addr, 0)
@@ -136,6 +167,7 @@ func NewLightHouseFromConfig(ctx context.Context, l *logrus.Logger, c *config.C,
 	})
 
 	h.startQueryWorker()
+	h.startNotifyWorker()
 
 	return &h, nil
 }
@@ -157,11 +189,28 @@ func (lh *LightHouse) GetLocalAllowList() *LocalAllowList {
 }
 
 func (lh *LightHouse) GetAdvertiseAddrs() []netip.AddrPort {
-	return *lh.advertiseAddrs.Load()
+	advAddrs := *lh.advertiseAddrs.Load()
+	addrs := make([]netip.AddrPort, len(advAddrs))
+	for i, a := range advAddrs {
+		addrs[i] = a.addr
+	}
+	return addrs
 }
 
 func (lh *LightHouse) GetRelaysForMe() []netip.Addr {
-	return *lh.relaysForMe.Load()
+	relays := *lh.relaysForMe.Load()
+	discovered := lh.relayDiscovery.getSelected()
+	if len(discovered) == 0 {
+		return relays
+	}
+
+	relays = slices.Clone(relays)
+	for _, addr := range discovered {
+		if !slices.Contains(relays, addr) {
+			relays = append(relays, addr)
+		}
+	}
+	return relays
 }
 
 func (lh *LightHouse) getCalculatedRemotes() *bart.Table[[]*calculatedRemote] {
@@ -174,41 +223,12 @@ func (lh *LightHouse) GetUpdateInterval() int64 {
 
 func (lh *LightHouse) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("lighthouse.advertise_addrs") {
-		rawAdvAddrs := c.GetStringSlice("lighthouse.advertise_addrs", []string{})
-		advAddrs := make([]netip.AddrPort, 0)
-
-		for i, rawAddr := range rawAdvAddrs {
-			host, sport, err := net.SplitHostPort(rawAddr)
-			if err != nil {
-				return util.NewContextualError("Unable to parse lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-
-			addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
-			if err != nil {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-			if len(addrs) == 0 {
-				return util.NewContextualError("Unable to lookup lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, nil)
-			}
-
-			port, err := strconv.Atoi(sport)
-			if err != nil {
-				return util.NewContextualError("Unable to parse port in lighthouse.advertise_addrs entry", m{"addr": rawAddr, "entry": i + 1}, err)
-			}
-
-			if port == 0 {
-				port = int(lh.nebulaPort)
-			}
-
-			//TODO: we could technically insert all returned addrs instead of just the first one if a dns lookup was used
-			addr := addrs[0].Unmap()
-			if lh.myVpnNetworksTable.Contains(addr) {
-				lh.l.WithField("addr", rawAddr).WithField("entry", i+1).
-					Warn("Ignoring lighthouse.advertise_addrs report because it is within the nebula network range")
-				continue
-			}
-
-			advAddrs = append(advAddrs, netip.AddrPortFrom(addr, uint16(port)))
+		advAddrs, err := newAdvertiseAddrsFromConfig(c, lh.nebulaPort, lh.myVpnNetworksTable.Contains, func(rawAddr string, entry int) {
+			lh.l.WithField("addr", rawAddr).WithField("entry", entry).
+				Warn("Ignoring lighthouse.advertise_addrs report because it is within the nebula network range")
+		})
+		if err != nil {
+			return err
 		}
 
 		lh.advertiseAddrs.Store(&advAddrs)
@@ -218,6 +238,12 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	lh.reloadSplitBrain(c, initial)
+
+	if err := lh.reloadLabels(c, initial); err != nil {
+		return util.NewContextualError("Invalid labels", nil, err)
+	}
+
 	if initial || c.HasChanged("lighthouse.interval") {
 		lh.interval.Store(int64(c.GetInt("lighthouse.interval", 10)))
 
@@ -269,6 +295,18 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
+	// Discovery must be (re)configured before lighthouse.hosts are parsed so they know whether discovery may still find them
+	if initial || c.HasChanged("static_map.discovery") {
+		err := lh.reloadDiscovery(c)
+		if err != nil {
+			return err
+		}
+
+		if !initial {
+			lh.l.Info("static_map.discovery has changed")
+		}
+	}
+
 	//NOTE: many things will get much simpler when we combine static_host_map and lighthouse.hosts in config
 	if initial || c.HasChanged("static_host_map") || c.HasChanged("static_map.cadence") || c.HasChanged("static_map.network") || c.HasChanged("static_map.lookup_timeout") {
 		// Clean up. Entries still in the static_host_map will be re-built.
@@ -289,7 +327,10 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 			return err
 		}
 
-		lh.staticList.Store(&staticList)
+		lh.discoveryLock.Lock()
+		lh.configStaticList = staticList
+		lh.unlockedStoreStaticList()
+		lh.discoveryLock.Unlock()
 		if !initial {
 			if c.HasChanged("static_host_map") {
 				lh.l.Info("static_host_map has changed")
@@ -306,20 +347,37 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 		}
 	}
 
-	if initial || c.HasChanged("lighthouse.hosts") {
-		lhList, err := lh.parseLighthouses(c)
+	if initial || c.HasChanged("lighthouse.hosts") || c.HasChanged("lighthouse.shards") {
+		shards, err := lh.parseLighthouses(c)
 		if err != nil {
 			return err
 		}
 
-		lh.lighthouses.Store(&lhList)
+		lh.lighthouses.Store(&shards.all)
+		lh.shards.Store(shards)
 		if !initial {
 			//NOTE: we are not tearing down existing lighthouse connections because they might be used for non lighthouse traffic
-			lh.l.Info("lighthouse.hosts has changed")
+			if c.HasChanged("lighthouse.hosts") {
+				lh.l.Info("lighthouse.hosts has changed")
+			}
+			if c.HasChanged("lighthouse.shards") {
+				lh.l.Info("lighthouse.shards has changed")
+			}
 		}
 	}
 
-	if initial || c.HasChanged("relay.relays") {
+	if initial || c.HasChanged("lighthouse.remote_cache") {
+		err := lh.reloadRemoteCache(c, initial)
+		if err != nil {
+			return err
+		}
+
+		if !initial {
+			lh.l.Info("lighthouse.remote_cache has changed")
+		}
+	}
+
+	if initial || c.HasChanged("relay.relays") || c.HasChanged("relay.use_lighthouses") || c.HasChanged("lighthouse.hosts") || c.HasChanged("lighthouse.shards") {
 		switch c.GetBool("relay.am_relay", false) {
 		case true:
 			// Relays aren't allowed to specify other relays
@@ -339,31 +397,71 @@ func (lh *LightHouse) reload(c *config.C, initial bool) error {
 					relaysForMe = append(relaysForMe, configRIP)
 				}
 			}
+			if c.GetBool("relay.use_lighthouses", false) && !lh.amLighthouse {
+				for _, addr := range lh.GetLighthouses() {
+					if !slices.Contains(relaysForMe, addr) {
+						relaysForMe = append(relaysForMe, addr)
+					}
+				}
+			}
 			lh.relaysForMe.Store(&relaysForMe)
 		}
 	}
 
+	if initial || c.HasChanged("relay") {
+		rc, err := newRelayDiscoveryConfigFromConfig(c)
+		if err != nil {
+			return util.NewContextualError("Failed to load relay advertise or discover config", nil, err)
+		}
+
+		lh.relayDiscovery.config.Store(rc)
+		lh.amRelay.Store(c.GetBool("relay.am_relay", false))
+		if !rc.discover {
+			lh.relayDiscovery.selected.Store(nil)
+		}
+	}
+
+	if initial || c.HasChanged("lighthouse.subscribe") {
+		sc, err := newSubscribeConfigFromConfig(c)
+		if err != nil {
+			return util.NewContextualError("Failed to load lighthouse.subscribe config", nil, err)
+		}
+
+		lh.subscriptions.config.Store(sc)
+		if !initial {
+			lh.l.Info("lighthouse.subscribe has changed")
+		}
+	}
+
 	return nil
 }
 
-func (lh *LightHouse) parseLighthouses(c *config.C) ([]netip.Addr, error) {
+func (lh *LightHouse) parseLighthouses(c *config.C) (*lighthouseShards, error) {
 	lhs := c.GetStringSlice("lighthouse.hosts", []string{})
-	if lh.amLighthouse && len(lhs) != 0 {
+	if lh.amLighthouse && (len(lhs) != 0 || c.Get("lighthouse.shards") != nil) {
 		lh.l.Warn("lighthouse.am_lighthouse enabled on node but upstream lighthouses exist in config")
 	}
-	out := make([]netip.Addr, len(lhs))
+	hosts := make([]netip.Addr, len(lhs))
 
 	for i, host := range lhs {
 		addr, err := netip.ParseAddr(host)
 		if err != nil {
 			return nil, util.NewContextualError("Unable to parse lighthouse host entry", m{"host": host, "entry": i + 1}, err)
 		}
+		hosts[i] = addr
+	}
 
+	shards, err := parseLighthouseShards(c, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := shards.all
+	for _, addr := range out {
 		if !lh.myVpnNetworksTable.Contains(addr) {
 			lh.l.WithFields(m{"vpnAddr": addr, "networks": lh.myVpnNetworks}).
 				Warn("lighthouse host is not within our networks, lighthouse functionality will work but layer 3 network traffic to the lighthouse will not")
 		}
-		out[i] = addr
 	}
 
 	if !lh.amLighthouse && len(out) == 0 {
@@ -371,13 +469,20 @@ func (lh *LightHouse) parseLighthouses(c *config.C) ([]netip.Addr, error) {
 	}
 
 	staticList := lh.GetStaticHostList()
+	discoveryEnabled := lh.isDiscoveryEnabled()
 	for i := range out {
 		if _, ok := staticList[out[i]]; !ok {
+			if discoveryEnabled {
+				// Discovery runs in the background and may still find it
+				lh.l.WithField("lighthouseAddr", out[i]).
+					Warn("lighthouse does not have a static_host_map entry yet, waiting for static_map.discovery to find it")
+				continue
+			}
 			return nil, fmt.Errorf("lighthouse %s does not have a static_host_map entry", out[i])
 		}
 	}
 
-	return out, nil
+	return shards, nil
 }
 
 func getStaticMapCadence(c *config.C) (time.Duration, error) {
@@ -478,9 +583,11 @@ func (lh *LightHouse) QueryServer(vpnAddr netip.Addr) {
 	lh.queryChan <- vpnAddr
 }
 
+// QueryCache returns the RemoteList for a host, making one if needed. vpnAddrs must come from a verified certificate,
+// lists known for any of them are merged together
 func (lh *LightHouse) QueryCache(vpnAddrs []netip.Addr) *RemoteList {
 	lh.RLock()
-	if v, ok := lh.addrMap[vpnAddrs[0]]; ok {
+	if v, ok := lh.unlockedGetMappedRemoteList(vpnAddrs); ok {
 		lh.RUnlock()
 		return v
 	}
@@ -489,7 +596,7 @@ func (lh *LightHouse) QueryCache(vpnAddrs []netip.Addr) *RemoteList {
 	lh.Lock()
 	defer lh.Unlock()
 	// Add an entry if we don't already have one
-	return lh.unlockedGetRemoteList(vpnAddrs) //todo CERT-V2 this contains addrmap lookups we could potentially skip
+	return lh.unlockedGetMergedRemoteList(vpnAddrs) //todo CERT-V2 this contains addrmap lookups we could potentially skip
 }
 
 // queryAndPrepMessage is a lock helper on RemoteList, assisting the caller to build a lighthouse message containing
@@ -522,6 +629,9 @@ func (lh *LightHouse) queryAndPrepMessage(vpnAddr netip.Addr, f func(*cache) (in
 }
 
 func (lh *LightHouse) DeleteVpnAddrs(allVpnAddrs []netip.Addr) {
+	lh.relayDiscovery.forget(allVpnAddrs)
+	lh.subscriptions.forget(allVpnAddrs)
+
 	// First we check the static host map. If any of the VpnAddrs to be deleted are present, do nothing.
 	staticList := lh.GetStaticHostList()
 	for _, addr := range allVpnAddrs {
@@ -634,6 +744,22 @@ func (lh *LightHouse) addCalculatedRemotes(vpnAddr netip.Addr) bool {
 	return len(calculatedV4) > 0 || len(calculatedV6) > 0
 }
 
+// unlockedGetMappedRemoteList returns the RemoteList for allAddrs if every one of them already maps to it
+func (lh *LightHouse) unlockedGetMappedRemoteList(allAddrs []netip.Addr) (*RemoteList, bool) {
+	am, ok := lh.addrMap[allAddrs[0]]
+	if !ok {
+		return nil, false
+	}
+
+	for _, addr := range allAddrs[1:] {
+		if lh.addrMap[addr] != am {
+			return nil, false
+		}
+	}
+
+	return am, true
+}
+
 // unlockedGetRemoteList assumes you have the lh lock
 func (lh *LightHouse) unlockedGetRemoteList(allAddrs []netip.Addr) *RemoteList {
 	// before we go and make a new remotelist, we need to make sure we don't have one for any of this set of vpnaddrs yet
@@ -654,6 +780,32 @@ func (lh *LightHouse) unlockedGetRemoteList(allAddrs []netip.Addr) *RemoteList {
 	return am
 }
 
+// unlockedGetMergedRemoteList assumes you have the lh lock and returns the one RemoteList every addr in allAddrs maps to.
+// A dual stack host may have been known by each of its addresses apart so far, any lists found are merged into the
+// first. allAddrs must come from a verified certificate, they decide which hosts are the same.
+func (lh *LightHouse) unlockedGetMergedRemoteList(allAddrs []netip.Addr) *RemoteList {
+	am := lh.unlockedGetRemoteList(allAddrs)
+	for _, addr := range allAddrs {
+		other, ok := lh.addrMap[addr]
+		if ok && other != am {
+			am.Lock()
+			other.Lock()
+			am.unlockedMerge(other)
+			other.Unlock()
+			am.Unlock()
+
+			// Anything else still pointing at the merged list follows it
+			for k, v := range lh.addrMap {
+				if v == other {
+					lh.addrMap[k] = am
+				}
+			}
+		}
+		lh.addrMap[addr] = am
+	}
+	return am
+}
+
 func (lh *LightHouse) shouldAdd(vpnAddrs []netip.Addr, to netip.Addr) bool {
 	allow := lh.GetRemoteAllowList().AllowAll(vpnAddrs, to)
 	if lh.l.Level >= logrus.TraceLevel {
@@ -671,8 +823,18 @@ func (lh *LightHouse) shouldAdd(vpnAddrs []netip.Addr, to netip.Addr) bool {
 	return true
 }
 
+// acceptsAddrTag reports if we have a use for an address with the given tag. Relay-only addresses are meant for the
+// relays and lighthouses that carry traffic for the host, everyone else should reach it through them.
+func (lh *LightHouse) acceptsAddrTag(tag AddrTag) bool {
+	return tag != AddrTag_RelayOnly || lh.amLighthouse || lh.amRelay.Load()
+}
+
 // unlockedShouldAddV4 checks if to is allowed by our allow list
 func (lh *LightHouse) unlockedShouldAddV4(vpnAddr netip.Addr, to *V4AddrPort) bool {
+	if !lh.acceptsAddrTag(to.Tag) {
+		return false
+	}
+
 	udpAddr := protoV4AddrPortToNetAddrPort(to)
 	allow := lh.GetRemoteAllowList().Allow(vpnAddr, udpAddr.Addr())
 	if lh.l.Level >= logrus.TraceLevel {
@@ -693,6 +855,10 @@ func (lh *LightHouse) unlockedShouldAddV4(vpnAddr netip.Addr, to *V4AddrPort) bo
 
 // unlockedShouldAddV6 checks if to is allowed by our allow list
 func (lh *LightHouse) unlockedShouldAddV6(vpnAddr netip.Addr, to *V6AddrPort) bool {
+	if !lh.acceptsAddrTag(to.Tag) {
+		return false
+	}
+
 	udpAddr := protoV6AddrPortToNetAddrPort(to)
 	allow := lh.GetRemoteAllowList().Allow(vpnAddr, udpAddr.Addr())
 	if lh.l.Level >= logrus.TraceLevel {
@@ -766,8 +932,9 @@ func (lh *LightHouse) innerQueryServer(addr netip.Addr, nb, out []byte) {
 	var v1Query, v2Query []byte
 	var err error
 	var v cert.Version
-	queried := 0
-	lighthouses := lh.GetLighthouses()
+	var queried []netip.Addr
+	now := time.Now()
+	lighthouses := lh.health.order(lh.queryLighthouses(addr), now)
 
 	for _, lhVpnAddr := range lighthouses {
 		hi := lh.ifce.GetHostInfo(lhVpnAddr)
@@ -799,7 +966,7 @@ func (lh *LightHouse) innerQueryServer(addr netip.Addr, nb, out []byte) {
 			}
 
 			lh.ifce.SendMessageToVpnAddr(header.LightHouse, 0, lhVpnAddr, v1Query, nb, out)
-			queried++
+			queried = append(queried, lhVpnAddr)
 
 		} else if v == cert.Version2 {
 			if v2Query == nil {
@@ -816,7 +983,7 @@ func (lh *LightHouse) innerQueryServer(addr netip.Addr, nb, out []byte) {
 			}
 
 			lh.ifce.SendMessageToVpnAddr(header.LightHouse, 0, lhVpnAddr, v2Query, nb, out)
-			queried++
+			queried = append(queried, lhVpnAddr)
 
 		} else {
 			lh.l.Debugf("Can not query lighthouse for %v using unknown protocol version: %v", addr, v)
@@ -824,7 +991,13 @@ func (lh *LightHouse) innerQueryServer(addr netip.Addr, nb, out []byte) {
 		}
 	}
 
-	lh.metricTx(NebulaMeta_HostQuery, int64(queried))
+	lh.health.sent(addr, queried, now)
+	lh.metricTx(NebulaMeta_HostQuery, int64(len(queried)))
+}
+
+// LighthouseHealth returns how well each lighthouse has been answering our queries
+func (lh *LightHouse) LighthouseHealth() []LighthouseHealth {
+	return lh.health.snapshot(lh.GetLighthouses(), time.Now())
 }
 
 func (lh *LightHouse) StartUpdateWorker() {
@@ -857,11 +1030,24 @@ func (lh *LightHouse) SendUpdate() {
 	var v4 []*V4AddrPort
 	var v6 []*V6AddrPort
 
-	for _, e := range lh.GetAdvertiseAddrs() {
-		if e.Addr().Is4() {
-			v4 = append(v4, netAddrToProtoV4AddrPort(e.Addr(), e.Port()))
+	lh.discoverRelays()
+	rc := lh.relayDiscovery.getConfig()
+	var relayAds []*RelayAdvertisement
+	if rc.advertise {
+		relayAds = []*RelayAdvertisement{{Tags: rc.advertiseTags}}
+	}
+	subscriptions := lh.subscriptionTargets()
+	labels := lh.GetLabels()
+
+	for _, e := range *lh.advertiseAddrs.Load() {
+		if e.addr.Addr().Is4() {
+			a := netAddrToProtoV4AddrPort(e.addr.Addr(), e.addr.Port())
+			a.Priority, a.Tag = e.priority, e.tag
+			v4 = append(v4, a)
 		} else {
-			v6 = append(v6, netAddrToProtoV6AddrPort(e.Addr(), e.Port()))
+			a := netAddrToProtoV6AddrPort(e.addr.Addr(), e.addr.Port())
+			a.Priority, a.Tag = e.priority, e.tag
+			v6 = append(v6, a)
 		}
 	}
 
@@ -885,7 +1071,7 @@ func (lh *LightHouse) SendUpdate() {
 	var v1Update, v2Update []byte
 	var err error
 	updated := 0
-	lighthouses := lh.GetLighthouses()
+	lighthouses := lh.updateLighthouses()
 
 	for _, lhVpnAddr := range lighthouses {
 		var v cert.Version
@@ -914,10 +1100,14 @@ func (lh *LightHouse) SendUpdate() {
 				msg := NebulaMeta{
 					Type: NebulaMeta_HostUpdateNotification,
 					Details: &NebulaMetaDetails{
-						V4AddrPorts:      v4,
-						V6AddrPorts:      v6,
-						OldRelayVpnAddrs: relays,
-						OldVpnAddr:       binary.BigEndian.Uint32(b[:]),
+						V4AddrPorts:         v4,
+						V6AddrPorts:         v6,
+						OldRelayVpnAddrs:    relays,
+						OldVpnAddr:          binary.BigEndian.Uint32(b[:]),
+						RelayAdvertisements: relayAds,
+						WantRelays:          rc.discover,
+						Subscriptions:       subscriptions,
+						Labels:              labels,
 					},
 				}
 
@@ -942,9 +1132,13 @@ func (lh *LightHouse) SendUpdate() {
 				msg := NebulaMeta{
 					Type: NebulaMeta_HostUpdateNotification,
 					Details: &NebulaMetaDetails{
-						V4AddrPorts:   v4,
-						V6AddrPorts:   v6,
-						RelayVpnAddrs: relays,
+						V4AddrPorts:         v4,
+						V6AddrPorts:         v6,
+						RelayVpnAddrs:       relays,
+						RelayAdvertisements: relayAds,
+						WantRelays:          rc.discover,
+						Subscriptions:       subscriptions,
+						Labels:              labels,
 					},
 				}
 
@@ -1012,8 +1206,11 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details.V6AddrPorts = details.V6AddrPorts[:0]
 	details.RelayVpnAddrs = details.RelayVpnAddrs[:0]
 	details.OldRelayVpnAddrs = details.OldRelayVpnAddrs[:0]
+	details.RelayAdvertisements = details.RelayAdvertisements[:0]
+	details.Subscriptions = details.Subscriptions[:0]
 	details.OldVpnAddr = 0
 	details.VpnAddr = nil
+	details.WantRelays = false
 	lhh.meta.Details = details
 
 	return lhh.meta
@@ -1051,7 +1248,7 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr netip.AddrPort, fromVpnAddrs [
 		lhh.handleHostPunchNotification(n, fromVpnAddrs, w)
 
 	case NebulaMeta_HostUpdateNotificationAck:
-		// noop
+		lhh.handleHostUpdateNotificationAck(n, fromVpnAddrs)
 	}
 }
 
@@ -1183,6 +1380,9 @@ func (lhh *LightHouseHandler) coalesceAnswers(v cert.Version, c *cache, n *Nebul
 		}
 	}
 
+	n.Details.ReportedAgeMs = reportedAgeMs(c.reportedAt, time.Now())
+	n.Details.Labels = c.labels
+
 	if c.relay != nil {
 		if v == cert.Version1 {
 			b := [4]byte{}
@@ -1218,6 +1418,8 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, fromVpnAddrs [
 		return
 	}
 	relays := n.Details.GetRelays()
+	now := time.Now()
+	lhh.lh.health.answered(fromVpnAddrs[0], certVpnAddr, now)
 
 	lhh.lh.Lock()
 	am := lhh.lh.unlockedGetRemoteList([]netip.Addr{certVpnAddr})
@@ -1227,8 +1429,13 @@ func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, fromVpnAddrs [
 	am.unlockedSetV4(fromVpnAddrs[0], certVpnAddr, n.Details.V4AddrPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(fromVpnAddrs[0], certVpnAddr, n.Details.V6AddrPorts, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(fromVpnAddrs[0], relays)
+	am.unlockedSetReportedAt(fromVpnAddrs[0], answerReportedAt(n.Details.ReportedAgeMs, now))
+	am.unlockedSetLabels(fromVpnAddrs[0], n.Details.Labels)
+	change, answers := am.unlockedCheckSplitBrain(now, time.Duration(lhh.lh.splitBrainThreshold.Load()))
 	am.Unlock()
 
+	lhh.lh.logSplitBrain(certVpnAddr, change, answers)
+
 	// Non-blocking attempt to trigger, skip if it would block
 	select {
 	case lhh.lh.handshakeTrigger <- certVpnAddr:
@@ -1271,17 +1478,27 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, fromVp
 	relays := n.Details.GetRelays()
 
 	lhh.lh.Lock()
-	am := lhh.lh.unlockedGetRemoteList(fromVpnAddrs)
+	am := lhh.lh.unlockedGetMergedRemoteList(fromVpnAddrs)
 	am.Lock()
 	lhh.lh.Unlock()
 
 	am.unlockedSetV4(fromVpnAddrs[0], fromVpnAddrs[0], n.Details.V4AddrPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(fromVpnAddrs[0], fromVpnAddrs[0], n.Details.V6AddrPorts, lhh.lh.unlockedShouldAddV6)
 	am.unlockedSetRelay(fromVpnAddrs[0], relays)
+	am.unlockedSetReportedAt(fromVpnAddrs[0], time.Now())
+	am.unlockedSetLabels(fromVpnAddrs[0], n.Details.Labels)
 	am.Unlock()
 
+	lhh.lh.relayDiscovery.setAdvertisement(fromVpnAddrs[0], n.Details.RelayAdvertisements)
+	lhh.lh.subscriptions.set(fromVpnAddrs[0], n.Details.Subscriptions)
+	lhh.lh.notifySubscribers(fromVpnAddrs)
+	wantRelays := n.Details.WantRelays
+
 	n = lhh.resetMeta()
 	n.Type = NebulaMeta_HostUpdateNotificationAck
+	if wantRelays {
+		n.Details.RelayAdvertisements = lhh.lh.relayDiscovery.advertisements(fromVpnAddrs)
+	}
 	switch useVersion {
 	case cert.Version1:
 		if !fromVpnAddrs[0].Is4() {
@@ -1291,7 +1508,7 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, fromVp
 		vpnAddrB := fromVpnAddrs[0].As4()
 		n.Details.OldVpnAddr = binary.BigEndian.Uint32(vpnAddrB[:])
 	case cert.Version2:
-		// do nothing, we want to send a blank message
+		// do nothing, v2 acks do not carry a vpn addr
 	default:
 		lhh.l.WithField("useVersion", useVersion).Error("invalid protocol version")
 		return
@@ -1307,6 +1524,18 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, fromVp
 	w.SendMessageToVpnAddr(header.LightHouse, 0, fromVpnAddrs[0], lhh.pb[:ln], lhh.nb, lhh.out[:0])
 }
 
+func (lhh *LightHouseHandler) handleHostUpdateNotificationAck(n *NebulaMeta, fromVpnAddrs []netip.Addr) {
+	if len(n.Details.RelayAdvertisements) == 0 || !lhh.lh.IsAnyLighthouseAddr(fromVpnAddrs) {
+		return
+	}
+
+	if !lhh.lh.relayDiscovery.getConfig().discover {
+		return
+	}
+
+	lhh.lh.relayDiscovery.learn(n.Details.RelayAdvertisements, time.Now())
+}
+
 func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, fromVpnAddrs []netip.Addr, w EncWriter) {
 	//It's possible the lighthouse is communicating with us using a non primary vpn addr,
 	//which means we need to compare all fromVpnAddrs against all configured lighthouse vpn addrs.
@@ -0,0 +1,138 @@
+package nebula
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/discovery"
+	"github.com/slackhq/nebula/util"
+)
+
+// reloadDiscovery (re)starts the static_map.discovery worker. Every pass runs in the background, including the first,
+// so a slow or unreachable provider can not hold up startup. Until it completes only static_host_map entries are known.
+func (lh *LightHouse) reloadDiscovery(c *config.C) error {
+	dc, err := discovery.NewConfigFromConfig(c, "static_map.discovery")
+	if err != nil {
+		return util.NewContextualError("Invalid static_map.discovery", nil, err)
+	}
+
+	lh.discoveryLock.Lock()
+	if lh.discoveryCancel != nil {
+		lh.discoveryCancel()
+		lh.discoveryCancel = nil
+	}
+	lh.discoveryEnabled = dc != nil
+	lh.discoveryLock.Unlock()
+
+	if dc == nil {
+		lh.setDiscovered(discovery.Hosts{}, true)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(lh.ctx)
+	lh.discoveryLock.Lock()
+	lh.discoveryCancel = cancel
+	lh.discoveryLock.Unlock()
+
+	go lh.runDiscovery(ctx, dc)
+	return nil
+}
+
+func (lh *LightHouse) runDiscovery(ctx context.Context, dc *discovery.Config) {
+	ticker := time.NewTicker(dc.Interval)
+	defer ticker.Stop()
+
+	for {
+		hosts, complete := dc.Discover(ctx, lh.l)
+		if ctx.Err() != nil {
+			return
+		}
+		lh.setDiscovered(hosts, complete)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isDiscoveryEnabled reports if static_map.discovery is configured, its hosts may not have been found yet
+func (lh *LightHouse) isDiscoveryEnabled() bool {
+	lh.discoveryLock.Lock()
+	defer lh.discoveryLock.Unlock()
+	return lh.discoveryEnabled
+}
+
+// GetDiscoveredHosts returns a copy of the hosts currently known through static_map.discovery
+func (lh *LightHouse) GetDiscoveredHosts() discovery.Hosts {
+	lh.discoveryLock.Lock()
+	defer lh.discoveryLock.Unlock()
+	return maps.Clone(lh.discovered)
+}
+
+// setDiscovered installs the latest discovery results into the address map. If complete is false at least one
+// provider failed and previously discovered hosts are kept rather than forgotten.
+func (lh *LightHouse) setDiscovered(hosts discovery.Hosts, complete bool) {
+	lh.discoveryLock.Lock()
+	defer lh.discoveryLock.Unlock()
+
+	if !complete {
+		for vpnAddr, addrs := range lh.discovered {
+			if _, ok := hosts[vpnAddr]; !ok {
+				hosts[vpnAddr] = addrs
+			}
+		}
+	}
+
+	if hosts.Equal(lh.discovered) {
+		return
+	}
+
+	lh.Lock()
+	for vpnAddr := range lh.discovered {
+		if _, ok := hosts[vpnAddr]; ok {
+			continue
+		}
+
+		if am := lh.addrMap[vpnAddr]; am != nil {
+			am.Lock()
+			am.unlockedSetDiscovered(nil)
+			am.Unlock()
+		}
+	}
+
+	for vpnAddr, addrs := range hosts {
+		if !lh.myVpnNetworksTable.Contains(vpnAddr) {
+			lh.l.WithFields(m{"vpnAddr": vpnAddr, "networks": lh.myVpnNetworks}).
+				Warn("Discovered host is not within our networks, layer 3 network traffic to this host will not work")
+		}
+
+		am := lh.unlockedGetRemoteList([]netip.Addr{vpnAddr})
+		am.Lock()
+		am.unlockedSetDiscovered(addrs)
+		am.Unlock()
+	}
+	lh.Unlock()
+
+	lh.l.WithField("hosts", hosts).Info("static_map.discovery hosts have changed")
+
+	lh.discovered = hosts
+	lh.unlockedStoreStaticList()
+}
+
+// unlockedStoreStaticList assumes you have the discoveryLock and publishes the union of static_host_map and discovered
+// hosts as the static host list
+func (lh *LightHouse) unlockedStoreStaticList() {
+	staticList := make(map[netip.Addr]struct{}, len(lh.configStaticList)+len(lh.discovered))
+	for vpnAddr := range lh.configStaticList {
+		staticList[vpnAddr] = struct{}{}
+	}
+	for vpnAddr := range lh.discovered {
+		staticList[vpnAddr] = struct{}{}
+	}
+	lh.staticList.Store(&staticList)
+}
@@ -0,0 +1,236 @@
+package nebula
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Every lighthouse we query is tracked so that queries go to the fastest lighthouses first and lighthouses that stop
+// answering are left alone for a while. Lighthouses only answer for hosts they know, so a query nobody answered says
+// nothing about anyone. A lighthouse misses a query when another lighthouse answered it and it did not.
+
+const (
+	// lighthouseQueryTimeout is how long a lighthouse has to answer a query before it is counted as missed
+	lighthouseQueryTimeout = 3 * time.Second
+	// lighthouseMaxMissed is how many queries in a row a lighthouse may miss before we back off from it
+	lighthouseMaxMissed  = 3
+	lighthouseMinBackoff = 10 * time.Second
+	lighthouseMaxBackoff = 5 * time.Minute
+	// lighthouseRTTWeight is how much a new round trip moves the smoothed round trip time
+	lighthouseRTTWeight = 0.25
+)
+
+// LighthouseHealth describes how well a lighthouse has been answering our queries
+type LighthouseHealth struct {
+	VpnAddr netip.Addr `json:"vpnAddr"`
+	Queries uint64     `json:"queries"`
+	Answers uint64     `json:"answers"`
+	Missed  uint64     `json:"missed"`
+	// RTT is the smoothed time it takes the lighthouse to answer, 0 if it never has
+	RTT time.Duration `json:"rtt"`
+	// BackoffUntil is set while we are not sending queries to the lighthouse
+	BackoffUntil time.Time `json:"backoffUntil,omitzero"`
+}
+
+type lighthouseStats struct {
+	LighthouseHealth
+	missedInARow int
+	backoff      time.Duration
+
+	metricQueries metrics.Counter
+	metricAnswers metrics.Counter
+	metricMissed  metrics.Counter
+	metricRTT     metrics.Histogram
+	metricBackoff metrics.Gauge
+}
+
+// pendingLighthouseQuery is a query for one vpn address, answered holds the lighthouses we asked and whether they
+// answered
+type pendingLighthouseQuery struct {
+	sent     time.Time
+	answered map[netip.Addr]bool
+	anyone   bool
+}
+
+type lighthouseHealth struct {
+	sync.Mutex
+	stats   map[netip.Addr]*lighthouseStats
+	pending map[netip.Addr]*pendingLighthouseQuery
+}
+
+func newLighthouseHealth() *lighthouseHealth {
+	return &lighthouseHealth{
+		stats:   map[netip.Addr]*lighthouseStats{},
+		pending: map[netip.Addr]*pendingLighthouseQuery{},
+	}
+}
+
+// unlockedStats returns the stats for a lighthouse, lh must be locked
+func (lh *lighthouseHealth) unlockedStats(addr netip.Addr) *lighthouseStats {
+	s := lh.stats[addr]
+	if s == nil {
+		prefix := "lighthouse.health." + addr.String() + "."
+		s = &lighthouseStats{
+			LighthouseHealth: LighthouseHealth{VpnAddr: addr},
+			metricQueries:    metrics.GetOrRegisterCounter(prefix+"queries", nil),
+			metricAnswers:    metrics.GetOrRegisterCounter(prefix+"answers", nil),
+			metricMissed:     metrics.GetOrRegisterCounter(prefix+"missed", nil),
+			metricRTT:        metrics.GetOrRegisterHistogram(prefix+"rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+			metricBackoff:    metrics.GetOrRegisterGauge(prefix+"backoff", nil),
+		}
+		lh.stats[addr] = s
+	}
+	return s
+}
+
+// order returns the lighthouses to query, fastest first. Lighthouses we are backing off from are left out unless we
+// are backing off from all of them.
+func (lh *lighthouseHealth) order(lighthouses []netip.Addr, now time.Time) []netip.Addr {
+	lh.Lock()
+	defer lh.Unlock()
+	lh.unlockedExpire(now)
+
+	out := make([]netip.Addr, 0, len(lighthouses))
+	for _, addr := range lighthouses {
+		s := lh.stats[addr]
+		if s != nil && now.Before(s.BackoffUntil) {
+			continue
+		}
+		out = append(out, addr)
+	}
+
+	if len(out) == 0 {
+		out = append(out, lighthouses...)
+	}
+
+	rtt := func(addr netip.Addr) time.Duration {
+		if s := lh.stats[addr]; s != nil && s.RTT > 0 {
+			return s.RTT
+		}
+		// Lighthouses that have not answered yet go after the ones that have
+		return lighthouseQueryTimeout
+	}
+	slices.SortStableFunc(out, func(a, b netip.Addr) int {
+		return cmp.Compare(rtt(a), rtt(b))
+	})
+	return out
+}
+
+// sent records a query for vpnAddr to lighthouses
+func (lh *lighthouseHealth) sent(vpnAddr netip.Addr, lighthouses []netip.Addr, now time.Time) {
+	if len(lighthouses) == 0 {
+		return
+	}
+
+	lh.Lock()
+	defer lh.Unlock()
+
+	p := lh.pending[vpnAddr]
+	if p == nil {
+		p = &pendingLighthouseQuery{sent: now, answered: map[netip.Addr]bool{}}
+		lh.pending[vpnAddr] = p
+	}
+
+	for _, addr := range lighthouses {
+		s := lh.unlockedStats(addr)
+		s.Queries++
+		s.metricQueries.Inc(1)
+		// A repeated query is measured from the first one, its answer can not be told apart
+		if _, ok := p.answered[addr]; !ok {
+			p.answered[addr] = false
+		}
+	}
+}
+
+// answered records an answer from a lighthouse about vpnAddr
+func (lh *lighthouseHealth) answered(lighthouse, vpnAddr netip.Addr, now time.Time) {
+	lh.Lock()
+	defer lh.Unlock()
+
+	p := lh.pending[vpnAddr]
+	if p == nil {
+		return
+	}
+
+	answered, ok := p.answered[lighthouse]
+	if !ok || answered {
+		return
+	}
+	p.answered[lighthouse] = true
+	p.anyone = true
+
+	s := lh.unlockedStats(lighthouse)
+	rtt := now.Sub(p.sent)
+	s.Answers++
+	s.metricAnswers.Inc(1)
+	s.metricRTT.Update(rtt.Nanoseconds())
+	if s.RTT == 0 {
+		s.RTT = rtt
+	} else {
+		s.RTT += time.Duration(lighthouseRTTWeight * float64(rtt-s.RTT))
+	}
+
+	s.missedInARow = 0
+	s.backoff = 0
+	s.BackoffUntil = time.Time{}
+	s.metricBackoff.Update(0)
+}
+
+// unlockedExpire settles queries older than the timeout, lh must be locked
+func (lh *lighthouseHealth) unlockedExpire(now time.Time) {
+	for _, s := range lh.stats {
+		if !s.BackoffUntil.IsZero() && !now.Before(s.BackoffUntil) {
+			// Back off is over, the next query tells us if the lighthouse is back
+			s.BackoffUntil = time.Time{}
+			s.metricBackoff.Update(0)
+		}
+	}
+
+	for vpnAddr, p := range lh.pending {
+		if now.Sub(p.sent) < lighthouseQueryTimeout {
+			continue
+		}
+		delete(lh.pending, vpnAddr)
+
+		if !p.anyone {
+			continue
+		}
+
+		for addr, answered := range p.answered {
+			if answered {
+				continue
+			}
+
+			s := lh.unlockedStats(addr)
+			s.Missed++
+			s.metricMissed.Inc(1)
+			s.missedInARow++
+			if s.missedInARow < lighthouseMaxMissed {
+				continue
+			}
+
+			s.backoff = min(max(s.backoff*2, lighthouseMinBackoff), lighthouseMaxBackoff)
+			// missedInARow stays put, missing the first query after the back off doubles it
+			s.BackoffUntil = now.Add(s.backoff)
+			s.metricBackoff.Update(1)
+		}
+	}
+}
+
+// snapshot returns the health of lighthouses
+func (lh *lighthouseHealth) snapshot(lighthouses []netip.Addr, now time.Time) []LighthouseHealth {
+	lh.Lock()
+	defer lh.Unlock()
+	lh.unlockedExpire(now)
+
+	out := make([]LighthouseHealth, len(lighthouses))
+	for i, addr := range lighthouses {
+		out[i] = lh.unlockedStats(addr).LighthouseHealth
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLighthouseHealth(t *testing.T) {
+	lh := newLighthouseHealth()
+	lh1, lh2, lh3 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3")
+	all := []netip.Addr{lh1, lh2, lh3}
+	now := time.Unix(1_700_000_000, 0)
+
+	query := func(vpnAddr netip.Addr, answers map[netip.Addr]time.Duration) []netip.Addr {
+		order := lh.order(all, now)
+		lh.sent(vpnAddr, order, now)
+		for addr, rtt := range answers {
+			lh.answered(addr, vpnAddr, now.Add(rtt))
+		}
+		now = now.Add(lighthouseQueryTimeout)
+		return order
+	}
+
+	host := netip.MustParseAddr("10.0.1.1")
+	assert.Equal(t, all, query(host, map[netip.Addr]time.Duration{lh1: 50 * time.Millisecond, lh2: 10 * time.Millisecond}))
+
+	// Faster lighthouses are asked first, lh3 never answered
+	assert.Equal(t, []netip.Addr{lh2, lh1, lh3}, lh.order(all, now))
+
+	// A query nobody answered is not held against anyone
+	query(netip.MustParseAddr("10.0.1.2"), nil)
+	h := lh.snapshot(all, now)
+	assert.Equal(t, uint64(1), h[2].Missed)
+
+	// Missing too many in a row backs off
+	for range lighthouseMaxMissed - 1 {
+		query(host, map[netip.Addr]time.Duration{lh1: 10 * time.Millisecond})
+	}
+	lh.order(all, now)
+	h = lh.snapshot(all, now)
+	assert.Equal(t, uint64(lighthouseMaxMissed), h[2].Missed)
+	assert.Equal(t, now.Add(lighthouseMinBackoff), h[2].BackoffUntil)
+	assert.Equal(t, []netip.Addr{lh2, lh1}, lh.order(all, now))
+
+	// Unless every lighthouse is backed off
+	assert.Equal(t, []netip.Addr{lh3}, lh.order([]netip.Addr{lh3}, now))
+
+	// Missing the first query after the back off doubles it, answering clears it
+	now = now.Add(lighthouseMinBackoff)
+	assert.Contains(t, lh.order(all, now), lh3)
+	query(host, map[netip.Addr]time.Duration{lh1: 10 * time.Millisecond})
+	lh.order(all, now)
+	assert.Equal(t, now.Add(2*lighthouseMinBackoff), lh.snapshot(all, now)[2].BackoffUntil)
+
+	now = now.Add(2 * lighthouseMinBackoff)
+	query(host, map[netip.Addr]time.Duration{lh3: 100 * time.Millisecond})
+	h = lh.snapshot(all, now)
+	assert.True(t, h[2].BackoffUntil.IsZero())
+	assert.Equal(t, 100*time.Millisecond, h[2].RTT)
+	assert.Equal(t, uint64(1), h[2].Answers)
+}
@@ -0,0 +1,142 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// Labels are free-form key=value pairs from the labels config, for inventory and cost attribution. Unlike cert groups
+// they carry no meaning for the firewall and can change with a reload. A host sends its labels with every lighthouse
+// update, the lighthouse hands them out with its answers for the host, and they show up on ControlHostInfo and in the
+// lighthouse cache. Labels are not signed, a host can claim any it likes.
+
+const (
+	// maxLabels caps how many labels a host may have, to keep lighthouse messages within one packet
+	maxLabels        = 32
+	maxLabelKeyLen   = 63
+	maxLabelValueLen = 255
+)
+
+func (lh *LightHouse) reloadLabels(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("labels") {
+		return nil
+	}
+
+	labels := []string{}
+	for k, v := range c.GetMap("labels", map[string]any{}) {
+		label := fmt.Sprintf("%v=%v", k, v)
+		if err := validateLabel(label); err != nil {
+			return fmt.Errorf("invalid labels entry %q: %w", label, err)
+		}
+		labels = append(labels, label)
+	}
+
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels, %d is more than the limit of %d", len(labels), maxLabels)
+	}
+
+	slices.Sort(labels)
+	lh.labels.Store(&labels)
+
+	if !initial {
+		lh.l.WithField("labels", labels).Info("labels has changed")
+	}
+	return nil
+}
+
+// GetLabels returns our own labels as key=value strings, sorted by key
+func (lh *LightHouse) GetLabels() []string {
+	return *lh.labels.Load()
+}
+
+// validateLabel checks a key=value label. Keys are made of letters, digits, '.', '_', '-' and '/'.
+func validateLabel(label string) error {
+	k, v, ok := strings.Cut(label, "=")
+	if !ok {
+		return fmt.Errorf("missing =")
+	}
+
+	if k == "" || len(k) > maxLabelKeyLen {
+		return fmt.Errorf("key must be 1 to %d characters", maxLabelKeyLen)
+	}
+
+	for _, r := range k {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("._-/", r):
+		default:
+			return fmt.Errorf("key contains %q", r)
+		}
+	}
+
+	if len(v) > maxLabelValueLen {
+		return fmt.Errorf("value must be at most %d characters", maxLabelValueLen)
+	}
+	return nil
+}
+
+// sanitizeLabels drops labels from the wire that are invalid or repeat a key, and caps them at maxLabels
+func sanitizeLabels(labels []string) []string {
+	var out []string
+	seen := map[string]struct{}{}
+	for _, label := range labels {
+		if len(out) >= maxLabels {
+			break
+		}
+		if validateLabel(label) != nil {
+			continue
+		}
+
+		k, _, _ := strings.Cut(label, "=")
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, label)
+	}
+	return out
+}
+
+// labelsToMap turns key=value labels into a map for the control and ssh apis, nil if there are none
+func labelsToMap(labels []string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(labels))
+	for _, label := range labels {
+		k, v, _ := strings.Cut(label, "=")
+		out[k] = v
+	}
+	return out
+}
+
+// unlockedSetLabels assumes you have the write lock and records the labels ownerVpnIp told us the host has
+func (r *RemoteList) unlockedSetLabels(ownerVpnIp netip.Addr, labels []string) {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	am.labels = sanitizeLabels(labels)
+}
+
+// Labels locks and returns the labels of the host, from the most recently updated lighthouse answer, or what the host
+// told us itself when we are its lighthouse
+func (r *RemoteList) Labels() map[string]string {
+	if r == nil {
+		return nil
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	latest, ok := r.unlockedLatestAnswer()
+	if !ok {
+		return nil
+	}
+	return labelsToMap(r.cache[latest].labels)
+}
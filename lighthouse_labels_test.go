@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLighthouse_labels(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	c.Settings["labels"] = map[string]any{"team": "payments", "cost-center": 1234}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &mockEncWriter{}
+	lhh := lh.NewRequestHandler()
+	assert.Equal(t, []string{"cost-center=1234", "team=payments"}, lh.GetLabels())
+
+	// The labels a host sends with its update are handed out with the answers for it
+	host := netip.MustParseAddr("10.128.0.4")
+	b, err := (&NebulaMeta{Type: NebulaMeta_HostUpdateNotification, Details: &NebulaMetaDetails{
+		VpnAddr:     netAddrToProtoAddr(host),
+		V4AddrPorts: []*V4AddrPort{netAddrToProtoV4AddrPort(netip.MustParseAddr("5.6.7.8"), 4242)},
+		Labels:      []string{"env=prod", "bad key=x", "env=dev"},
+	}}).Marshal()
+	require.NoError(t, err)
+	lhh.HandleRequest(netip.MustParseAddrPort("5.6.7.8:4242"), []netip.Addr{host}, b, &testEncWriter{})
+
+	r := newLHHostRequest(netip.MustParseAddrPort("1.2.3.4:4242"), netip.MustParseAddr("10.128.0.2"), host, lhh)
+	require.NotNil(t, r.msg)
+	assert.Equal(t, []string{"env=prod"}, r.msg.Details.Labels)
+	assert.Equal(t, map[string]string{"env": "prod"}, lh.QueryCache([]netip.Addr{host}).Labels())
+	assert.Equal(t, map[string]string{"env": "prod"}, (*lh.QueryCache([]netip.Addr{host}).CopyCache())[host.String()].Labels)
+
+	// Labels are reloadable and a bad one fails the reload
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  am_lighthouse: true\nlisten:\n  port: 4242\nlabels:\n  team: search\n"))
+	assert.Equal(t, []string{"team=search"}, lh.GetLabels())
+	require.Error(t, lh.reloadLabels(&config.C{Settings: map[string]any{"labels": map[string]any{"a b": "c"}}}, true))
+	assert.Equal(t, []string{"team=search"}, lh.GetLabels())
+}
+
+func TestValidateLabel(t *testing.T) {
+	assert.NoError(t, validateLabel("example.com/team=payments"))
+	assert.NoError(t, validateLabel("empty="))
+	assert.Error(t, validateLabel("novalue"))
+	assert.Error(t, validateLabel("=value"))
+	assert.Error(t, validateLabel("a b=c"))
+	assert.Error(t, validateLabel(string(make([]byte, maxLabelKeyLen+1))+"=v"))
+}
@@ -0,0 +1,167 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// Lighthouses already hold a tunnel to nearly every host, which makes them a relay of last resort when two hosts are
+// behind hard NAT and no dedicated relay exists. A lighthouse with relay.lighthouse.enabled approves each relay
+// allocation against a policy instead of relaying for anyone like am_relay does. Both ends must be in one of the
+// configured groups, the number of allocations is capped per host and in total, and the bytes each host pushes through
+// the lighthouse are rate limited.
+//
+// Hosts opt in with relay.use_lighthouses, which advertises their lighthouses as relays for them.
+
+type lighthouseRelay struct {
+	groups      []string
+	maxPerHost  int
+	maxTotal    int
+	rate, burst uint64
+
+	bucketsLock sync.Mutex
+	buckets     map[netip.Addr]*tokenBucket
+
+	approved metrics.Counter
+	denied   metrics.Counter
+	dropped  metrics.Counter
+}
+
+func newLighthouseRelayFromConfig(c *config.C) (*lighthouseRelay, error) {
+	if !c.GetBool("lighthouse.am_lighthouse", false) || !c.GetBool("relay.lighthouse.enabled", false) {
+		return nil, nil
+	}
+
+	lr := &lighthouseRelay{
+		groups:     c.GetStringSlice("relay.lighthouse.groups", []string{}),
+		maxPerHost: c.GetInt("relay.lighthouse.max_per_host", 4),
+		maxTotal:   c.GetInt("relay.lighthouse.max_allocations", 64),
+		buckets:    map[netip.Addr]*tokenBucket{},
+		approved:   metrics.GetOrRegisterCounter("relay.lighthouse.approved", nil),
+		denied:     metrics.GetOrRegisterCounter("relay.lighthouse.denied", nil),
+		dropped:    metrics.GetOrRegisterCounter("relay.lighthouse.dropped", nil),
+	}
+
+	if lr.maxPerHost < 1 {
+		return nil, fmt.Errorf("relay.lighthouse.max_per_host must be at least 1")
+	}
+	if lr.maxTotal < 1 {
+		return nil, fmt.Errorf("relay.lighthouse.max_allocations must be at least 1")
+	}
+
+	if c.Get("relay.lighthouse.rate") != nil {
+		b, err := bucketFromConfig(c.GetMap("relay.lighthouse", nil))
+		if err != nil {
+			return nil, fmt.Errorf("relay.lighthouse is invalid: %w", err)
+		}
+		lr.rate, lr.burst = uint64(b.rate), uint64(b.burst)
+	}
+
+	return lr, nil
+}
+
+// forwardingCount returns how many relays the host is forwarding through us
+func forwardingCount(h *HostInfo) int {
+	n := 0
+	for _, r := range h.relayState.CopyAllRelayFor() {
+		if r.Type == ForwardingType {
+			n++
+		}
+	}
+	return n
+}
+
+// allocations returns the number of relays we forward, each one has a forwarding entry on both of its hosts
+func allocations(hm *HostMap) int {
+	hm.RLock()
+	defer hm.RUnlock()
+
+	n := 0
+	for idx, h := range hm.Relays {
+		if r, ok := h.relayState.QueryRelayForByIdx(idx); ok && r.Type == ForwardingType {
+			n++
+		}
+	}
+	return n / 2
+}
+
+// approve decides if from may relay to target through us. Allocations that already exist are always approved so lost
+// requests can be retried.
+func (lr *lighthouseRelay) approve(hm *HostMap, from, target *HostInfo) error {
+	if _, ok := target.relayState.QueryRelayForByIp(from.vpnAddrs[0]); ok {
+		return nil
+	}
+
+	if !hostInGroups(from, lr.groups) {
+		lr.denied.Inc(1)
+		return fmt.Errorf("relayFrom is not in an allowed group")
+	}
+
+	if !hostInGroups(target, lr.groups) {
+		lr.denied.Inc(1)
+		return fmt.Errorf("relayTo is not in an allowed group")
+	}
+
+	if forwardingCount(from) >= lr.maxPerHost || forwardingCount(target) >= lr.maxPerHost {
+		lr.denied.Inc(1)
+		return fmt.Errorf("per host allocation quota of %d reached", lr.maxPerHost)
+	}
+
+	if allocations(hm) >= lr.maxTotal {
+		lr.denied.Inc(1)
+		return fmt.Errorf("allocation quota of %d reached", lr.maxTotal)
+	}
+
+	lr.approved.Inc(1)
+	return nil
+}
+
+// allow reports if n more bytes from the host fit within its relay rate
+func (lr *lighthouseRelay) allow(h *HostInfo, n int) bool {
+	if lr.rate == 0 {
+		return true
+	}
+
+	lr.bucketsLock.Lock()
+	b, ok := lr.buckets[h.vpnAddrs[0]]
+	if !ok {
+		b = newTokenBucket(lr.rate, lr.burst)
+		lr.buckets[h.vpnAddrs[0]] = b
+	}
+	lr.bucketsLock.Unlock()
+
+	if !b.allow(time.Now(), n) {
+		lr.dropped.Inc(1)
+		return false
+	}
+	return true
+}
+
+func (rm *relayManager) reloadLighthouseRelay(c *config.C, initial bool) error {
+	if !initial && !c.HasChanged("relay.lighthouse") {
+		return nil
+	}
+
+	lr, err := newLighthouseRelayFromConfig(c)
+	if err != nil {
+		return err
+	}
+
+	rm.lighthouseRelay.Store(lr)
+	if lr != nil {
+		rm.l.WithFields(logrus.Fields{
+			"groups":          lr.groups,
+			"max_per_host":    lr.maxPerHost,
+			"max_allocations": lr.maxTotal,
+			"rate":            lr.rate,
+		}).Info("Lighthouse relaying enabled")
+	}
+
+	return nil
+}
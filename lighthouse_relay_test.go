@@ -0,0 +1,124 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLighthouseRelayFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Off unless enabled on a lighthouse
+	c.Settings["relay"] = map[string]any{"lighthouse": map[string]any{"enabled": true}}
+	lr, err := newLighthouseRelayFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, lr)
+
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	lr, err = newLighthouseRelayFromConfig(c)
+	require.NoError(t, err)
+	require.NotNil(t, lr)
+	assert.Equal(t, 4, lr.maxPerHost)
+	assert.Equal(t, 64, lr.maxTotal)
+	assert.Zero(t, lr.rate)
+
+	c.Settings["relay"] = map[string]any{"lighthouse": map[string]any{
+		"enabled":         true,
+		"groups":          []any{"nat-hard"},
+		"max_per_host":    1,
+		"max_allocations": 2,
+		"rate":            "8mbps",
+	}}
+	lr, err = newLighthouseRelayFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"nat-hard"}, lr.groups)
+	assert.Equal(t, 1, lr.maxPerHost)
+	assert.Equal(t, 2, lr.maxTotal)
+	assert.Equal(t, uint64(1000000), lr.rate)
+	assert.Equal(t, uint64(100000), lr.burst)
+
+	c.Settings["relay"] = map[string]any{"lighthouse": map[string]any{"enabled": true, "max_per_host": 0}}
+	_, err = newLighthouseRelayFromConfig(c)
+	require.EqualError(t, err, "relay.lighthouse.max_per_host must be at least 1")
+
+	c.Settings["relay"] = map[string]any{"lighthouse": map[string]any{"enabled": true, "rate": "fast"}}
+	_, err = newLighthouseRelayFromConfig(c)
+	require.Error(t, err)
+}
+
+func TestLighthouseRelay_approve(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["relay"] = map[string]any{"lighthouse": map[string]any{
+		"enabled":         true,
+		"groups":          []any{"nat-hard"},
+		"max_per_host":    1,
+		"max_allocations": 1,
+	}}
+	lr, err := newLighthouseRelayFromConfig(c)
+	require.NoError(t, err)
+
+	hm := newHostMap(l)
+	newHost := func(addr string, groups ...string) *HostInfo {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		return &HostInfo{
+			vpnAddrs:        []netip.Addr{netip.MustParseAddr(addr)},
+			ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{InvertedGroups: inverted}},
+			relayState:      RelayState{relayForByAddr: map[netip.Addr]*Relay{}, relayForByIdx: map[uint32]*Relay{}},
+		}
+	}
+
+	a := newHost("10.1.0.1", "nat-hard")
+	b := newHost("10.1.0.2", "nat-hard")
+	outsider := newHost("10.1.0.3", "web")
+	d := newHost("10.1.0.4", "nat-hard")
+
+	require.EqualError(t, lr.approve(hm, outsider, a), "relayFrom is not in an allowed group")
+	require.EqualError(t, lr.approve(hm, a, outsider), "relayTo is not in an allowed group")
+	require.NoError(t, lr.approve(hm, a, b))
+
+	// Stand up the allocation the way handleCreateRelayRequest does
+	_, err = AddRelay(l, b, hm, a.vpnAddrs[0], nil, ForwardingType, Requested)
+	require.NoError(t, err)
+	_, err = AddRelay(l, a, hm, b.vpnAddrs[0], nil, ForwardingType, PeerRequested)
+	require.NoError(t, err)
+	assert.Equal(t, 1, allocations(hm))
+
+	// Retries of an existing allocation are fine
+	require.NoError(t, lr.approve(hm, a, b))
+	require.EqualError(t, lr.approve(hm, d, a), "per host allocation quota of 1 reached")
+
+	lr.maxPerHost = 4
+	require.EqualError(t, lr.approve(hm, d, a), "allocation quota of 1 reached")
+}
+
+func TestLighthouseRelay_allow(t *testing.T) {
+	lr := &lighthouseRelay{buckets: map[netip.Addr]*tokenBucket{}}
+	h := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.1")}}
+
+	// Unlimited without a rate
+	for i := 0; i < 100; i++ {
+		assert.True(t, lr.allow(h, minShaperBurst))
+	}
+
+	lr = &lighthouseRelay{rate: 1000, burst: minShaperBurst, buckets: map[netip.Addr]*tokenBucket{}}
+	lr.dropped = metrics.NewCounter()
+	assert.True(t, lr.allow(h, minShaperBurst))
+	assert.False(t, lr.allow(h, 1000))
+
+	// Each host has its own bucket
+	other := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.2")}}
+	assert.True(t, lr.allow(other, 1000))
+}
@@ -0,0 +1,203 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+const remoteCacheVersion = 1
+
+// remoteCacheConfig controls lighthouse.remote_cache, a file holding the underlay addresses we last knew for each
+// host so tunnels can be brought back up after a restart without waiting on, or even reaching, a lighthouse
+type remoteCacheConfig struct {
+	path     string
+	interval time.Duration
+	maxAge   time.Duration
+}
+
+type remoteCacheFile struct {
+	Version int                `json:"version"`
+	Hosts   []remoteCacheEntry `json:"hosts"`
+}
+
+type remoteCacheEntry struct {
+	VpnAddrs []netip.Addr     `json:"vpnAddrs"`
+	Addrs    []netip.AddrPort `json:"addrs"`
+	Updated  time.Time        `json:"updated"`
+}
+
+func newRemoteCacheConfigFromConfig(c *config.C) (*remoteCacheConfig, error) {
+	path := c.GetString("lighthouse.remote_cache.path", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	rc := &remoteCacheConfig{
+		path:     path,
+		interval: c.GetDuration("lighthouse.remote_cache.interval", 5*time.Minute),
+		maxAge:   c.GetDuration("lighthouse.remote_cache.max_age", 24*time.Hour),
+	}
+
+	if rc.interval <= 0 {
+		return nil, fmt.Errorf("lighthouse.remote_cache.interval must be greater than 0")
+	}
+
+	if rc.maxAge <= 0 {
+		return nil, fmt.Errorf("lighthouse.remote_cache.max_age must be greater than 0")
+	}
+
+	return rc, nil
+}
+
+// reloadRemoteCache (re)starts the lighthouse.remote_cache writer, the cache is only read on the initial load
+func (lh *LightHouse) reloadRemoteCache(c *config.C, initial bool) error {
+	rc, err := newRemoteCacheConfigFromConfig(c)
+	if err != nil {
+		return util.NewContextualError("Invalid lighthouse.remote_cache", nil, err)
+	}
+
+	if lh.remoteCacheCancel != nil {
+		lh.remoteCacheCancel()
+		lh.remoteCacheCancel = nil
+	}
+
+	if rc == nil {
+		return nil
+	}
+
+	if initial {
+		n, err := lh.loadRemoteCache(rc, time.Now())
+		if err != nil {
+			lh.l.WithError(err).WithField("path", rc.path).Warn("Failed to load the remote cache")
+		} else {
+			lh.l.WithField("path", rc.path).WithField("hosts", n).Info("Loaded the remote cache")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(lh.ctx)
+	lh.remoteCacheCancel = cancel
+	go lh.runRemoteCache(ctx, rc)
+	return nil
+}
+
+func (lh *LightHouse) runRemoteCache(ctx context.Context, rc *remoteCacheConfig) {
+	ticker := time.NewTicker(rc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Save once more on the way out so a clean shutdown does not lose recent changes
+			if err := lh.saveRemoteCache(rc, time.Now()); err != nil {
+				lh.l.WithError(err).WithField("path", rc.path).Error("Failed to save the remote cache")
+			}
+			return
+		case now := <-ticker.C:
+			if err := lh.saveRemoteCache(rc, now); err != nil {
+				lh.l.WithError(err).WithField("path", rc.path).Error("Failed to save the remote cache")
+			}
+		}
+	}
+}
+
+// loadRemoteCache seeds the address map from the cache file, returning the number of hosts loaded.
+// Entries older than max_age and static_host_map entries are skipped.
+func (lh *LightHouse) loadRemoteCache(rc *remoteCacheConfig, now time.Time) (int, error) {
+	b, err := os.ReadFile(rc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var f remoteCacheFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return 0, err
+	}
+
+	if f.Version != remoteCacheVersion {
+		return 0, fmt.Errorf("unsupported remote cache version %d", f.Version)
+	}
+
+	staticList := lh.GetStaticHostList()
+	loaded := 0
+
+	lh.Lock()
+	defer lh.Unlock()
+
+	for _, e := range f.Hosts {
+		if len(e.VpnAddrs) == 0 || len(e.Addrs) == 0 || now.Sub(e.Updated) > rc.maxAge {
+			continue
+		}
+
+		if _, ok := staticList[e.VpnAddrs[0]]; ok {
+			continue
+		}
+
+		am := lh.unlockedGetRemoteList(e.VpnAddrs)
+		am.Lock()
+		am.unlockedSetPersisted(e.Addrs, e.Updated)
+		am.Unlock()
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// saveRemoteCache writes every host we currently know addresses for. Hosts we have only heard about through the cache
+// keep the time they were last confirmed so they age out.
+func (lh *LightHouse) saveRemoteCache(rc *remoteCacheConfig, now time.Time) error {
+	staticList := lh.GetStaticHostList()
+
+	// Collect the remote lists first so we do not hold the lighthouse lock while walking them
+	seen := map[*RemoteList]struct{}{}
+	lh.RLock()
+	for vpnAddr, am := range lh.addrMap {
+		if _, ok := staticList[vpnAddr]; ok {
+			continue
+		}
+		seen[am] = struct{}{}
+	}
+	lh.RUnlock()
+
+	f := remoteCacheFile{Version: remoteCacheVersion, Hosts: []remoteCacheEntry{}}
+	for am := range seen {
+		if e, ok := am.persistEntry(now, rc.maxAge); ok {
+			f.Hosts = append(f.Hosts, e)
+		}
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash mid write does not leave a truncated cache behind
+	tmp, err := os.CreateTemp(filepath.Dir(rc.path), filepath.Base(rc.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), rc.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRemoteCacheLighthouse(t *testing.T, ctx context.Context, path string) (*LightHouse, *remoteCacheConfig) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{
+		"hosts":        []any{"10.128.0.2"},
+		"remote_cache": map[string]any{"path": path, "interval": "1h"},
+	}
+	c.Settings["static_host_map"] = map[string]any{"10.128.0.2": []any{"1.1.1.1:4242"}}
+
+	lh, err := NewLightHouseFromConfig(ctx, l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &mockEncWriter{}
+
+	rc, err := newRemoteCacheConfigFromConfig(c)
+	require.NoError(t, err)
+	return lh, rc
+}
+
+// newRemoteCachePath returns a cache path in a temp dir and a context for the lighthouses using it. The context is
+// canceled after the temp dir is removed, the final save of a stopping cache writer must not race the removal.
+func newRemoteCachePath(t *testing.T) (string, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return filepath.Join(t.TempDir(), "remotes.json"), ctx
+}
+
+func TestLighthouse_RemoteCache(t *testing.T) {
+	path, ctx := newRemoteCachePath(t)
+	lh, rc := newRemoteCacheLighthouse(t, ctx, path)
+
+	learned := netip.MustParseAddrPort("1.2.3.4:4242")
+	reported := netip.MustParseAddrPort("[1::2]:4242")
+	peer := netip.MustParseAddr("10.128.0.3")
+
+	am := lh.QueryCache([]netip.Addr{peer})
+	am.LearnRemote(peer, learned)
+	am.Lock()
+	am.unlockedSetV6(netip.MustParseAddr("10.128.0.2"), peer, []*V6AddrPort{netAddrToProtoV6AddrPort(reported.Addr(), reported.Port())}, lh.unlockedShouldAddV6)
+	am.Unlock()
+
+	// The static lighthouse entry has an address as well but comes from config, not the cache
+	now := time.Now()
+	require.NoError(t, lh.saveRemoteCache(rc, now))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var f remoteCacheFile
+	require.NoError(t, json.Unmarshal(b, &f))
+	require.Len(t, f.Hosts, 1)
+	assert.Equal(t, []netip.Addr{peer}, f.Hosts[0].VpnAddrs)
+	assert.Equal(t, []netip.AddrPort{learned, reported}, f.Hosts[0].Addrs)
+	assert.True(t, now.Equal(f.Hosts[0].Updated))
+
+	// A restarted node picks the addresses back up
+	lh2, rc2 := newRemoteCacheLighthouse(t, ctx, path)
+	am2 := lh2.Query(peer)
+	require.NotNil(t, am2)
+	assert.ElementsMatch(t, []netip.AddrPort{learned, reported}, am2.CopyAddrs(nil))
+
+	// Entries only known from the cache keep their timestamp when saved again
+	require.NoError(t, lh2.saveRemoteCache(rc2, now.Add(time.Hour)))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &f))
+	require.Len(t, f.Hosts, 1)
+	assert.True(t, now.Equal(f.Hosts[0].Updated))
+
+	// and are dropped once they are too old
+	require.NoError(t, lh2.saveRemoteCache(rc2, now.Add(rc2.maxAge+time.Second)))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &f))
+	assert.Empty(t, f.Hosts)
+}
+
+func TestLighthouse_RemoteCacheLoad(t *testing.T) {
+	path, ctx := newRemoteCachePath(t)
+	lh, rc := newRemoteCacheLighthouse(t, ctx, path)
+
+	// A missing file is not an error
+	n, err := lh.loadRemoteCache(rc, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	now := time.Now()
+	b, err := json.Marshal(remoteCacheFile{
+		Version: remoteCacheVersion,
+		Hosts: []remoteCacheEntry{
+			{
+				VpnAddrs: []netip.Addr{netip.MustParseAddr("10.128.0.3")},
+				Addrs:    []netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:4242")},
+				Updated:  now,
+			},
+			{
+				// Too old
+				VpnAddrs: []netip.Addr{netip.MustParseAddr("10.128.0.4")},
+				Addrs:    []netip.AddrPort{netip.MustParseAddrPort("1.2.3.5:4242")},
+				Updated:  now.Add(-rc.maxAge - time.Second),
+			},
+			{
+				// Static hosts come from config
+				VpnAddrs: []netip.Addr{netip.MustParseAddr("10.128.0.2")},
+				Addrs:    []netip.AddrPort{netip.MustParseAddrPort("1.2.3.6:4242")},
+				Updated:  now,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+
+	n, err = lh.loadRemoteCache(rc, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NotNil(t, lh.Query(netip.MustParseAddr("10.128.0.3")))
+	assert.Nil(t, lh.Query(netip.MustParseAddr("10.128.0.4")))
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}, lh.Query(netip.MustParseAddr("10.128.0.2")).CopyAddrs(nil))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2}`), 0600))
+	_, err = lh.loadRemoteCache(rc, now)
+	require.EqualError(t, err, "unsupported remote cache version 2")
+}
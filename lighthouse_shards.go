@@ -0,0 +1,182 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// lighthouseShards splits lighthouse responsibility by vpn network. Hosts report to and query the lighthouses of the
+// shard covering the vpn address in question, lighthouses that are not part of any shard serve every address.
+type lighthouseShards struct {
+	// table maps a vpn network to the lighthouses authoritative for it
+	table *bart.Table[[]netip.Addr]
+	// general are the lighthouses from lighthouse.hosts that are not part of a shard
+	general []netip.Addr
+	// all is every lighthouse, sharded or not
+	all []netip.Addr
+}
+
+// parseLighthouseShards reads lighthouse.shards, a list of `{networks: [<cidr>], hosts: [<lighthouse vpn addr>]}`.
+// hosts are the lighthouses from lighthouse.hosts, shard lighthouses are added to the returned all list.
+func parseLighthouseShards(c *config.C, hosts []netip.Addr) (*lighthouseShards, error) {
+	s := &lighthouseShards{
+		table: new(bart.Table[[]netip.Addr]),
+		all:   slices.Clone(hosts),
+	}
+
+	sharded := map[netip.Addr]struct{}{}
+	r := c.Get("lighthouse.shards")
+	if r != nil {
+		rawShards, ok := r.([]any)
+		if !ok {
+			return nil, util.NewContextualError("lighthouse.shards is not an array", nil, nil)
+		}
+
+		for i, rs := range rawShards {
+			rm, ok := rs.(map[string]any)
+			if !ok {
+				return nil, util.NewContextualError("lighthouse.shards entry is invalid", m{"entry": i + 1}, nil)
+			}
+
+			var lighthouses []netip.Addr
+			for _, rh := range toStringSlice(rm["hosts"]) {
+				addr, err := netip.ParseAddr(rh)
+				if err != nil {
+					return nil, util.NewContextualError("Unable to parse lighthouse.shards host", m{"host": rh, "entry": i + 1}, err)
+				}
+
+				lighthouses = append(lighthouses, addr)
+				sharded[addr] = struct{}{}
+				if !slices.Contains(s.all, addr) {
+					s.all = append(s.all, addr)
+				}
+			}
+
+			if len(lighthouses) == 0 {
+				return nil, util.NewContextualError("lighthouse.shards entry has no hosts", m{"entry": i + 1}, nil)
+			}
+
+			networks := toStringSlice(rm["networks"])
+			if len(networks) == 0 {
+				return nil, util.NewContextualError("lighthouse.shards entry has no networks", m{"entry": i + 1}, nil)
+			}
+
+			for _, rn := range networks {
+				network, err := netip.ParsePrefix(rn)
+				if err != nil {
+					return nil, util.NewContextualError("Unable to parse lighthouse.shards network", m{"network": rn, "entry": i + 1}, err)
+				}
+
+				network = network.Masked()
+				if _, ok := s.table.Get(network); ok {
+					return nil, util.NewContextualError("lighthouse.shards network is in more than one shard", m{"network": network, "entry": i + 1}, nil)
+				}
+				s.table.Insert(network, lighthouses)
+			}
+		}
+	}
+
+	for _, addr := range hosts {
+		if _, ok := sharded[addr]; !ok {
+			s.general = append(s.general, addr)
+		}
+	}
+
+	return s, nil
+}
+
+// toStringSlice accepts a single value or a list of values, as yaml would give us
+func toStringSlice(v any) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		out := make([]string, len(v))
+		for i := range v {
+			out[i] = fmt.Sprintf("%v", v[i])
+		}
+		return out
+	default:
+		return []string{fmt.Sprintf("%v", v)}
+	}
+}
+
+// forAddr returns the lighthouses responsible for vpnAddr, every lighthouse is responsible for an address outside
+// of all shards
+func (s *lighthouseShards) forAddr(vpnAddr netip.Addr) []netip.Addr {
+	shard, ok := s.table.Lookup(vpnAddr)
+	if !ok {
+		return s.all
+	}
+
+	if len(s.general) == 0 {
+		return shard
+	}
+
+	out := slices.Clone(shard)
+	for _, addr := range s.general {
+		if !slices.Contains(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// forAddrs returns the lighthouses responsible for any of vpnAddrs
+func (s *lighthouseShards) forAddrs(vpnAddrs []netip.Addr) []netip.Addr {
+	if len(vpnAddrs) == 1 {
+		return s.forAddr(vpnAddrs[0])
+	}
+
+	var out []netip.Addr
+	for _, vpnAddr := range vpnAddrs {
+		for _, addr := range s.forAddr(vpnAddr) {
+			if !slices.Contains(out, addr) {
+				out = append(out, addr)
+			}
+		}
+	}
+	return out
+}
+
+// queryLighthouses returns the lighthouses to ask about vpnAddr. If none of the responsible lighthouses have a tunnel
+// up we fall back to asking every lighthouse.
+func (lh *LightHouse) queryLighthouses(vpnAddr netip.Addr) []netip.Addr {
+	s := lh.shards.Load()
+	if s == nil {
+		return lh.GetLighthouses()
+	}
+
+	lighthouses := s.forAddr(vpnAddr)
+	if len(lighthouses) == len(s.all) {
+		return lighthouses
+	}
+
+	for _, lhVpnAddr := range lighthouses {
+		if lh.ifce.GetHostInfo(lhVpnAddr) != nil {
+			return lighthouses
+		}
+	}
+
+	return s.all
+}
+
+// updateLighthouses returns the lighthouses we report our underlay addresses to
+func (lh *LightHouse) updateLighthouses() []netip.Addr {
+	s := lh.shards.Load()
+	if s == nil {
+		return lh.GetLighthouses()
+	}
+
+	vpnAddrs := make([]netip.Addr, len(lh.myVpnNetworks))
+	for i := range lh.myVpnNetworks {
+		vpnAddrs[i] = lh.myVpnNetworks[i].Addr()
+	}
+
+	return s.forAddrs(vpnAddrs)
+}
@@ -0,0 +1,146 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shardEncWriter reports a tunnel to the lighthouses in up
+type shardEncWriter struct {
+	mockEncWriter
+	up map[netip.Addr]struct{}
+}
+
+func (w *shardEncWriter) GetHostInfo(vpnAddr netip.Addr) *HostInfo {
+	if _, ok := w.up[vpnAddr]; ok {
+		return &HostInfo{}
+	}
+	return nil
+}
+
+func newShardedLighthouse(t *testing.T, myVpnNet string, shards string) (*LightHouse, *config.C) {
+	l := test.NewLogger()
+	vpnNet := netip.MustParsePrefix(myVpnNet)
+	nt := new(bart.Lite)
+	nt.Insert(vpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{vpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+static_host_map:
+  10.0.0.1: ["1.1.1.1:4242"]
+  10.0.0.2: ["1.1.1.2:4242"]
+  10.0.128.1: ["1.1.1.3:4242"]
+  10.0.200.1: ["1.1.1.4:4242"]
+`+shards))
+
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	return lh, c
+}
+
+func TestLighthouseShards(t *testing.T) {
+	lh, _ := newShardedLighthouse(t, "10.0.0.10/16", `
+lighthouse:
+  hosts: [10.0.200.1]
+  shards:
+    - networks: [10.0.0.0/17]
+      hosts: [10.0.0.1, 10.0.0.2]
+    - networks: 10.0.128.0/17
+      hosts: 10.0.128.1
+`)
+	w := &shardEncWriter{up: map[netip.Addr]struct{}{}}
+	lh.ifce = w
+
+	lh1 := netip.MustParseAddr("10.0.0.1")
+	lh2 := netip.MustParseAddr("10.0.0.2")
+	lh3 := netip.MustParseAddr("10.0.128.1")
+	general := netip.MustParseAddr("10.0.200.1")
+
+	// Shard lighthouses are lighthouses
+	assert.ElementsMatch(t, []netip.Addr{lh1, lh2, lh3, general}, lh.GetLighthouses())
+	assert.True(t, lh.IsLighthouseAddr(lh3))
+
+	// We only report to our own shard and the general lighthouses
+	assert.ElementsMatch(t, []netip.Addr{lh1, lh2, general}, lh.updateLighthouses())
+
+	// With no tunnel to the responsible lighthouses we ask everyone
+	assert.ElementsMatch(t, []netip.Addr{lh1, lh2, lh3, general}, lh.queryLighthouses(netip.MustParseAddr("10.0.130.5")))
+
+	// Once one is up we only ask the shard and the general lighthouses
+	w.up[lh3] = struct{}{}
+	assert.ElementsMatch(t, []netip.Addr{lh3, general}, lh.queryLighthouses(netip.MustParseAddr("10.0.130.5")))
+
+	// Addresses outside of every shard go to every lighthouse
+	assert.ElementsMatch(t, []netip.Addr{lh1, lh2, lh3, general}, lh.queryLighthouses(netip.MustParseAddr("10.1.0.5")))
+}
+
+func TestLighthouseShards_reload(t *testing.T) {
+	lh, c := newShardedLighthouse(t, "10.0.0.10/16", `
+lighthouse:
+  hosts: [10.0.0.1, 10.0.128.1]
+`)
+	lh.ifce = &mockEncWriter{}
+	assert.Len(t, lh.updateLighthouses(), 2)
+
+	require.NoError(t, c.ReloadConfigString(`
+static_host_map:
+  10.0.0.1: ["1.1.1.1:4242"]
+  10.0.128.1: ["1.1.1.3:4242"]
+lighthouse:
+  shards:
+    - networks: [10.0.0.0/17]
+      hosts: [10.0.0.1]
+    - networks: [10.0.128.0/17]
+      hosts: [10.0.128.1]
+`))
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, lh.updateLighthouses())
+	assert.Len(t, lh.GetLighthouses(), 2)
+}
+
+func Test_parseLighthouseShards(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	c.Settings["lighthouse"] = map[string]any{"shards": "nope"}
+	_, err := parseLighthouseShards(c, nil)
+	require.EqualError(t, err, "lighthouse.shards is not an array")
+
+	c.Settings["lighthouse"] = map[string]any{"shards": []any{map[string]any{"networks": []any{"10.0.0.0/8"}}}}
+	_, err = parseLighthouseShards(c, nil)
+	require.EqualError(t, err, "lighthouse.shards entry has no hosts")
+
+	c.Settings["lighthouse"] = map[string]any{"shards": []any{map[string]any{"hosts": []any{"10.0.0.1"}}}}
+	_, err = parseLighthouseShards(c, nil)
+	require.EqualError(t, err, "lighthouse.shards entry has no networks")
+
+	c.Settings["lighthouse"] = map[string]any{"shards": []any{map[string]any{"hosts": []any{"nope"}, "networks": []any{"10.0.0.0/8"}}}}
+	_, err = parseLighthouseShards(c, nil)
+	require.ErrorContains(t, err, "Unable to parse lighthouse.shards host")
+
+	c.Settings["lighthouse"] = map[string]any{"shards": []any{
+		map[string]any{"hosts": []any{"10.0.0.1"}, "networks": []any{"10.0.0.0/8"}},
+		map[string]any{"hosts": []any{"10.0.0.2"}, "networks": []any{"10.1.2.3/8"}},
+	}}
+	_, err = parseLighthouseShards(c, nil)
+	require.EqualError(t, err, "lighthouse.shards network is in more than one shard")
+
+	// lighthouse.hosts that are also in a shard are not general lighthouses
+	c.Settings["lighthouse"] = map[string]any{"shards": []any{
+		map[string]any{"hosts": []any{"10.0.0.1"}, "networks": []any{"10.0.0.0/8"}},
+	}}
+	s, err := parseLighthouseShards(c, []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.2")}, s.general)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")}, s.all)
+}
@@ -0,0 +1,174 @@
+package nebula
+
+import (
+	"math"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+// A host sends its updates to every lighthouse, so they should all answer with the same addresses. One that missed
+// updates, say it was cut off from the host for a while, keeps answering with what it had and tunnels flap between
+// the old and the new addresses. We compare the answers of the lighthouses for a host, and once they disagreed for
+// longer than lighthouse.split_brain_threshold we log it and only use the answer of the lighthouse the host updated
+// most recently, until they agree again. Lighthouses say how old their answer is with ReportedAgeMs, answers from
+// lighthouses that do not are as old as when we got them.
+
+const defaultSplitBrainThreshold = time.Minute
+
+type splitBrainChange int
+
+const (
+	splitBrainUnchanged splitBrainChange = iota
+	splitBrainDetected
+	splitBrainResolved
+)
+
+// lighthouseAnswer is what one lighthouse last said about a host
+type lighthouseAnswer struct {
+	lighthouse netip.Addr
+	addrs      []netip.AddrPort
+	reportedAt time.Time
+}
+
+func (lh *LightHouse) reloadSplitBrain(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("lighthouse.split_brain_threshold") {
+		return
+	}
+
+	threshold := c.GetDuration("lighthouse.split_brain_threshold", defaultSplitBrainThreshold)
+	if threshold < 0 {
+		threshold = 0
+	}
+	lh.splitBrainThreshold.Store(int64(threshold))
+
+	if !initial {
+		lh.l.WithField("threshold", threshold).Info("lighthouse.split_brain_threshold changed")
+	}
+}
+
+// logSplitBrain reports a change in whether the lighthouses agree about vpnAddr
+func (lh *LightHouse) logSplitBrain(vpnAddr netip.Addr, change splitBrainChange, answers []lighthouseAnswer) {
+	switch change {
+	case splitBrainDetected:
+		metrics.GetOrRegisterCounter("lighthouse.split_brain.detected", nil).Inc(1)
+		now := time.Now()
+		seen := make([]m, len(answers))
+		for i, a := range answers {
+			seen[i] = m{"lighthouse": a.lighthouse, "addrs": a.addrs, "age": now.Sub(a.reportedAt).Round(time.Millisecond)}
+		}
+		lh.l.WithField("vpnAddr", vpnAddr).WithField("answers", seen).
+			Warn("Lighthouses disagree about the addresses of a host, using the most recently updated answer")
+
+	case splitBrainResolved:
+		metrics.GetOrRegisterCounter("lighthouse.split_brain.resolved", nil).Inc(1)
+		lh.l.WithField("vpnAddr", vpnAddr).Info("Lighthouses agree about the addresses of a host again")
+	}
+}
+
+// reportedAgeMs is the ReportedAgeMs of an answer last updated at reportedAt, zero if we do not know
+func reportedAgeMs(reportedAt, now time.Time) uint32 {
+	if reportedAt.IsZero() {
+		return 0
+	}
+	return uint32(min(max(now.Sub(reportedAt).Milliseconds(), 1), math.MaxUint32))
+}
+
+// answerReportedAt is when the host last updated a lighthouse whose answer with ageMs arrived at now
+func answerReportedAt(ageMs uint32, now time.Time) time.Time {
+	if ageMs == 0 {
+		return now
+	}
+	return now.Add(-time.Duration(ageMs) * time.Millisecond)
+}
+
+// unlockedSetReportedAt assumes you have the write lock and records when the addresses from ownerVpnIp were last
+// updated by the host
+func (r *RemoteList) unlockedSetReportedAt(ownerVpnIp netip.Addr, at time.Time) {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	am.reportedAt = at
+}
+
+// unlockedLighthouseAnswers assumes you have the lock and returns the answers in the cache, ordered by lighthouse.
+// Only lighthouse answers have reportedAt set.
+func (r *RemoteList) unlockedLighthouseAnswers() []lighthouseAnswer {
+	var answers []lighthouseAnswer
+	for owner, c := range r.cache {
+		if c.reportedAt.IsZero() {
+			continue
+		}
+
+		a := lighthouseAnswer{lighthouse: owner, reportedAt: c.reportedAt}
+		if c.v4 != nil {
+			for _, v := range c.v4.reported {
+				a.addrs = append(a.addrs, protoV4AddrPortToNetAddrPort(v))
+			}
+		}
+		if c.v6 != nil {
+			for _, v := range c.v6.reported {
+				a.addrs = append(a.addrs, protoV6AddrPortToNetAddrPort(v))
+			}
+		}
+		slices.SortFunc(a.addrs, netip.AddrPort.Compare)
+		a.addrs = slices.Compact(a.addrs)
+		answers = append(answers, a)
+	}
+
+	slices.SortFunc(answers, func(a, b lighthouseAnswer) int {
+		return a.lighthouse.Compare(b.lighthouse)
+	})
+	return answers
+}
+
+// unlockedLatestAnswer assumes you have the lock and returns the lighthouse the host updated most recently
+func (r *RemoteList) unlockedLatestAnswer() (netip.Addr, bool) {
+	var latest netip.Addr
+	var at time.Time
+	for owner, c := range r.cache {
+		if !c.reportedAt.IsZero() && c.reportedAt.After(at) {
+			latest, at = owner, c.reportedAt
+		}
+	}
+	return latest, latest.IsValid()
+}
+
+// unlockedCheckSplitBrain assumes you have the write lock and compares the lighthouse answers for this host. Once they
+// disagreed for threshold only the most recently updated answer is used, a threshold of 0 turns this off.
+func (r *RemoteList) unlockedCheckSplitBrain(now time.Time, threshold time.Duration) (splitBrainChange, []lighthouseAnswer) {
+	answers := r.unlockedLighthouseAnswers()
+	agree := true
+	for _, a := range answers[min(1, len(answers)):] {
+		if !slices.Equal(a.addrs, answers[0].addrs) {
+			agree = false
+			break
+		}
+	}
+
+	if agree || threshold <= 0 {
+		r.splitBrainSince = time.Time{}
+		if r.splitBrain {
+			r.splitBrain = false
+			r.shouldRebuild = true
+			return splitBrainResolved, answers
+		}
+		return splitBrainUnchanged, answers
+	}
+
+	if r.splitBrainSince.IsZero() {
+		r.splitBrainSince = now
+	}
+
+	if !r.splitBrain && now.Sub(r.splitBrainSince) >= threshold {
+		r.splitBrain = true
+		r.shouldRebuild = true
+		return splitBrainDetected, answers
+	}
+	return splitBrainUnchanged, answers
+}
@@ -0,0 +1,119 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLighthouse_splitBrain(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	lhA := netip.MustParseAddr("10.128.0.2")
+	lhB := netip.MustParseAddr("10.128.0.3")
+	target := netip.MustParseAddr("10.128.0.4")
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{
+		"hosts": []any{lhA.String(), lhB.String()},
+		// Any disagreement seen twice is long enough
+		"split_brain_threshold": "1ns",
+	}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	c.Settings["static_host_map"] = map[string]any{
+		lhA.String(): []any{"1.1.1.1:4242"},
+		lhB.String(): []any{"1.1.1.2:4242"},
+	}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &mockEncWriter{}
+	lhh := lh.NewRequestHandler()
+
+	oldAddr := netip.MustParseAddrPort("5.6.7.8:4242")
+	newAddr := netip.MustParseAddrPort("5.6.7.9:4242")
+	reply := func(from netip.Addr, addr netip.AddrPort, ageMs uint32) {
+		b, err := (&NebulaMeta{Type: NebulaMeta_HostQueryReply, Details: &NebulaMetaDetails{
+			VpnAddr:       netAddrToProtoAddr(target),
+			V4AddrPorts:   []*V4AddrPort{netAddrToProtoV4AddrPort(addr.Addr(), addr.Port())},
+			ReportedAgeMs: ageMs,
+		}}).Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(netip.MustParseAddrPort("1.1.1.1:4242"), []netip.Addr{from}, b, &testEncWriter{})
+	}
+	addrs := func() []netip.AddrPort {
+		return lh.QueryCache([]netip.Addr{target}).CopyAddrs(nil)
+	}
+	detected := metrics.GetOrRegisterCounter("lighthouse.split_brain.detected", nil).Count()
+
+	// lhA missed the host moving, lhB heard about it recently
+	reply(lhA, oldAddr, 60_000)
+	reply(lhB, newAddr, 10)
+	assert.ElementsMatch(t, []netip.AddrPort{oldAddr, newAddr}, addrs())
+	assert.Equal(t, detected, metrics.GetOrRegisterCounter("lighthouse.split_brain.detected", nil).Count())
+
+	// Still disagreeing past the threshold, only the most recent answer is used
+	reply(lhA, oldAddr, 60_000)
+	assert.Equal(t, []netip.AddrPort{newAddr}, addrs())
+	assert.Equal(t, detected+1, metrics.GetOrRegisterCounter("lighthouse.split_brain.detected", nil).Count())
+
+	// Once they agree both answers are used again
+	reply(lhA, newAddr, 5)
+	assert.Equal(t, []netip.AddrPort{newAddr}, addrs())
+	reply(lhA, oldAddr, 60_000)
+	assert.ElementsMatch(t, []netip.AddrPort{oldAddr, newAddr}, addrs())
+
+	// A threshold of 0 turns it off
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  hosts: [10.128.0.2, 10.128.0.3]\n  split_brain_threshold: 0s\n"+
+		"listen:\n  port: 4242\nstatic_host_map:\n  10.128.0.2: [1.1.1.1:4242]\n  10.128.0.3: [1.1.1.2:4242]\n"))
+	reply(lhA, oldAddr, 60_000)
+	reply(lhA, oldAddr, 60_000)
+	assert.ElementsMatch(t, []netip.AddrPort{oldAddr, newAddr}, addrs())
+}
+
+func TestLighthouse_reportedAge(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lh.ifce = &mockEncWriter{}
+	lhh := lh.NewRequestHandler()
+
+	host := netip.MustParseAddr("10.128.0.4")
+	newLHHostUpdate(netip.MustParseAddrPort("5.6.7.8:4242"), host, []netip.AddrPort{netip.MustParseAddrPort("5.6.7.8:4242")}, lhh)
+
+	r := newLHHostRequest(netip.MustParseAddrPort("1.2.3.4:4242"), netip.MustParseAddr("10.128.0.2"), host, lhh)
+	require.NotNil(t, r.msg)
+	assert.NotZero(t, r.msg.Details.ReportedAgeMs)
+	assert.Less(t, r.msg.Details.ReportedAgeMs, uint32(time.Minute.Milliseconds()))
+
+	now := time.Now()
+	assert.Zero(t, reportedAgeMs(time.Time{}, now))
+	assert.Equal(t, uint32(1), reportedAgeMs(now, now))
+	assert.Equal(t, now, answerReportedAt(0, now))
+	assert.Equal(t, now.Add(-time.Second), answerReportedAt(1000, now))
+}
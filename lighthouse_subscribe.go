@@ -0,0 +1,334 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// Hosts with lighthouse.subscribe.enabled list the peers they want to hear about with every lighthouse update. When a
+// lighthouse notices a subscribed peer has new addresses, from its update or from it roaming, the lighthouse pushes a
+// HostQueryReply to every subscriber right away instead of waiting for them to query again.
+
+// maxLighthouseSubscriptions caps how many peers a host subscribes to, to keep updates within a single packet
+const maxLighthouseSubscriptions = 32
+
+type subscribeConfig struct {
+	enabled bool
+	// hosts limits subscriptions to these peers, when empty every peer in our lighthouse cache is subscribed to
+	hosts []netip.Addr
+}
+
+func newSubscribeConfigFromConfig(c *config.C) (*subscribeConfig, error) {
+	sc := &subscribeConfig{
+		enabled: c.GetBool("lighthouse.subscribe.enabled", false),
+	}
+
+	if sc.enabled && c.GetBool("lighthouse.am_lighthouse", false) {
+		return nil, fmt.Errorf("lighthouse.subscribe.enabled can not be used with lighthouse.am_lighthouse")
+	}
+
+	for i, raw := range c.GetStringSlice("lighthouse.subscribe.hosts", []string{}) {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return nil, fmt.Errorf("lighthouse.subscribe.hosts entry %d is not a vpn address: %w", i+1, err)
+		}
+		sc.hosts = append(sc.hosts, addr)
+	}
+
+	if len(sc.hosts) > maxLighthouseSubscriptions {
+		return nil, fmt.Errorf("lighthouse.subscribe.hosts can not have more than %d entries", maxLighthouseSubscriptions)
+	}
+
+	return sc, nil
+}
+
+// lighthouseSubscriptions is usable as its zero value
+type lighthouseSubscriptions struct {
+	config atomic.Pointer[subscribeConfig]
+
+	sync.Mutex
+	// bySubscriber and byTarget are only used on lighthouses
+	bySubscriber map[netip.Addr][]netip.Addr
+	byTarget     map[netip.Addr]map[netip.Addr]struct{}
+	// answers holds what subscribers of a target were last told about it, to only push changes
+	answers map[netip.Addr]string
+}
+
+func (ls *lighthouseSubscriptions) getConfig() *subscribeConfig {
+	if sc := ls.config.Load(); sc != nil {
+		return sc
+	}
+	return &subscribeConfig{}
+}
+
+// set replaces the peers subscriber wants to hear about
+func (ls *lighthouseSubscriptions) set(subscriber netip.Addr, targets []*Addr) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	ls.unlockedRemove(subscriber)
+	if len(targets) == 0 {
+		return
+	}
+
+	if ls.bySubscriber == nil {
+		ls.bySubscriber = map[netip.Addr][]netip.Addr{}
+		ls.byTarget = map[netip.Addr]map[netip.Addr]struct{}{}
+		ls.answers = map[netip.Addr]string{}
+	}
+
+	addrs := make([]netip.Addr, 0, min(len(targets), maxLighthouseSubscriptions))
+	for _, t := range targets[:min(len(targets), maxLighthouseSubscriptions)] {
+		target := protoAddrToNetAddr(t)
+		if !target.IsValid() || target == subscriber || slices.Contains(addrs, target) {
+			continue
+		}
+
+		addrs = append(addrs, target)
+		subs, ok := ls.byTarget[target]
+		if !ok {
+			subs = map[netip.Addr]struct{}{}
+			ls.byTarget[target] = subs
+		}
+		subs[subscriber] = struct{}{}
+	}
+
+	ls.bySubscriber[subscriber] = addrs
+}
+
+// forget drops the subscriptions of a host we no longer have a tunnel to
+func (ls *lighthouseSubscriptions) forget(vpnAddrs []netip.Addr) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	for _, addr := range vpnAddrs {
+		ls.unlockedRemove(addr)
+	}
+}
+
+func (ls *lighthouseSubscriptions) unlockedRemove(subscriber netip.Addr) {
+	for _, target := range ls.bySubscriber[subscriber] {
+		subs := ls.byTarget[target]
+		delete(subs, subscriber)
+		if len(subs) == 0 {
+			delete(ls.byTarget, target)
+			delete(ls.answers, target)
+		}
+	}
+	delete(ls.bySubscriber, subscriber)
+}
+
+// subscribers returns the hosts that want to hear about target
+func (ls *lighthouseSubscriptions) subscribers(target netip.Addr) []netip.Addr {
+	ls.Lock()
+	defer ls.Unlock()
+
+	subs := make([]netip.Addr, 0, len(ls.byTarget[target]))
+	for addr := range ls.byTarget[target] {
+		subs = append(subs, addr)
+	}
+	return subs
+}
+
+// changed records answer as the latest for target and reports if subscribers need to hear about it
+func (ls *lighthouseSubscriptions) changed(target netip.Addr, answer string) bool {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if _, ok := ls.byTarget[target]; !ok {
+		return false
+	}
+
+	if old, ok := ls.answers[target]; ok && old == answer {
+		return false
+	}
+
+	ls.answers[target] = answer
+	return true
+}
+
+// retry forgets what subscribers of target were told so the next answer is pushed even if it did not change
+func (ls *lighthouseSubscriptions) retry(target netip.Addr) {
+	ls.Lock()
+	defer ls.Unlock()
+	delete(ls.answers, target)
+}
+
+// answerKey summarizes what a lighthouse would answer about the owner of c
+func (c *cache) answerKey() string {
+	var b strings.Builder
+	if c.v4 != nil {
+		if c.v4.learned != nil {
+			fmt.Fprintf(&b, "l%d:%d,", c.v4.learned.Addr, c.v4.learned.Port)
+		}
+		for _, v := range c.v4.reported {
+			fmt.Fprintf(&b, "%d:%d,", v.Addr, v.Port)
+		}
+	}
+
+	if c.v6 != nil {
+		if c.v6.learned != nil {
+			fmt.Fprintf(&b, "l%d.%d:%d,", c.v6.learned.Hi, c.v6.learned.Lo, c.v6.learned.Port)
+		}
+		for _, v := range c.v6.reported {
+			fmt.Fprintf(&b, "%d.%d:%d,", v.Hi, v.Lo, v.Port)
+		}
+	}
+
+	if c.relay != nil {
+		for _, r := range c.relay.relay {
+			fmt.Fprintf(&b, "r%s,", r)
+		}
+	}
+
+	return b.String()
+}
+
+// subscriptionTargets returns the peers to subscribe to with our next update
+func (lh *LightHouse) subscriptionTargets() []*Addr {
+	sc := lh.subscriptions.getConfig()
+	if !sc.enabled {
+		return nil
+	}
+
+	addrs := sc.hosts
+	if len(addrs) == 0 {
+		lh.RLock()
+		addrs = make([]netip.Addr, 0, len(lh.addrMap))
+		for addr := range lh.addrMap {
+			if !lh.IsLighthouseAddr(addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+		lh.RUnlock()
+
+		slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+		if len(addrs) > maxLighthouseSubscriptions {
+			addrs = addrs[:maxLighthouseSubscriptions]
+		}
+	}
+
+	targets := make([]*Addr, len(addrs))
+	for i, addr := range addrs {
+		targets[i] = netAddrToProtoAddr(addr)
+	}
+	return targets
+}
+
+// notifySubscribers queues a push to the subscribers of vpnAddrs if what we would answer about them changed
+func (lh *LightHouse) notifySubscribers(vpnAddrs []netip.Addr) {
+	if !lh.amLighthouse || len(vpnAddrs) == 0 {
+		return
+	}
+
+	var answer string
+	found, _, _ := lh.queryAndPrepMessage(vpnAddrs[0], func(c *cache) (int, error) {
+		answer = c.answerKey()
+		return 0, nil
+	})
+	if !found {
+		return
+	}
+
+	for _, addr := range vpnAddrs {
+		if !lh.subscriptions.changed(addr, answer) {
+			continue
+		}
+
+		// Non-blocking, the next update from the target will try again
+		select {
+		case lh.notifyChan <- addr:
+		default:
+			lh.subscriptions.retry(addr)
+		}
+	}
+}
+
+func (lh *LightHouse) startNotifyWorker() {
+	if !lh.amLighthouse {
+		return
+	}
+
+	notify := lh.notifyChan
+	go func() {
+		lhh := lh.NewRequestHandler()
+
+		for {
+			select {
+			case <-lh.ctx.Done():
+				return
+			case addr := <-notify:
+				lhh.pushHostQueryReply(addr)
+			}
+		}
+	}()
+}
+
+// pushHostQueryReply sends what we know about target to everyone subscribed to it, as if they had just queried us
+func (lhh *LightHouseHandler) pushHostQueryReply(target netip.Addr) {
+	var v1Reply, v2Reply []byte
+	pushed := 0
+	for _, sub := range lhh.lh.subscriptions.subscribers(target) {
+		hi := lhh.lh.ifce.GetHostInfo(sub)
+		if hi == nil {
+			continue
+		}
+
+		v := hi.ConnectionState.myCert.Version()
+		reply := &v2Reply
+		if v == cert.Version1 {
+			if !target.Is4() {
+				continue
+			}
+			reply = &v1Reply
+		} else if v != cert.Version2 {
+			continue
+		}
+
+		if *reply == nil {
+			found, ln, err := lhh.lh.queryAndPrepMessage(target, func(c *cache) (int, error) {
+				n := lhh.resetMeta()
+				n.Type = NebulaMeta_HostQueryReply
+				if v == cert.Version1 {
+					b := target.As4()
+					n.Details.OldVpnAddr = binary.BigEndian.Uint32(b[:])
+				} else {
+					n.Details.VpnAddr = netAddrToProtoAddr(target)
+				}
+
+				lhh.coalesceAnswers(v, c, n)
+				return n.MarshalTo(lhh.pb)
+			})
+			if !found {
+				return
+			}
+
+			if err != nil {
+				lhh.l.WithError(err).WithField("vpnAddr", target).Error("Failed to marshal lighthouse subscription push")
+				return
+			}
+
+			*reply = slices.Clone(lhh.pb[:ln])
+		}
+
+		lhh.lh.ifce.SendMessageToVpnAddr(header.LightHouse, 0, sub, *reply, lhh.nb, lhh.out[:0])
+		pushed++
+	}
+
+	if pushed > 0 {
+		lhh.lh.metricTx(NebulaMeta_HostQueryReply, int64(pushed))
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnAddr", target).WithField("subscribers", pushed).Debug("Pushed host update to subscribers")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSubscribeConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	sc, err := newSubscribeConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, sc.enabled)
+
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true, "subscribe": map[string]any{"enabled": true}}
+	_, err = newSubscribeConfigFromConfig(c)
+	require.EqualError(t, err, "lighthouse.subscribe.enabled can not be used with lighthouse.am_lighthouse")
+
+	c.Settings["lighthouse"] = map[string]any{"subscribe": map[string]any{"enabled": true, "hosts": []any{"nope"}}}
+	_, err = newSubscribeConfigFromConfig(c)
+	require.ErrorContains(t, err, "lighthouse.subscribe.hosts entry 1 is not a vpn address")
+
+	c.Settings["lighthouse"] = map[string]any{"subscribe": map[string]any{"enabled": true, "hosts": []any{"10.128.0.2"}}}
+	sc, err = newSubscribeConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, sc.enabled)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.128.0.2")}, sc.hosts)
+}
+
+func TestLighthouseSubscriptions(t *testing.T) {
+	ls := &lighthouseSubscriptions{}
+	a := netip.MustParseAddr("10.128.0.2")
+	b := netip.MustParseAddr("10.128.0.3")
+	target := netip.MustParseAddr("10.128.0.4")
+
+	// Nothing to push without subscribers
+	assert.False(t, ls.changed(target, "1"))
+
+	ls.set(a, []*Addr{netAddrToProtoAddr(target), netAddrToProtoAddr(a), netAddrToProtoAddr(target)})
+	ls.set(b, []*Addr{netAddrToProtoAddr(target)})
+	assert.ElementsMatch(t, []netip.Addr{a, b}, ls.subscribers(target))
+	assert.Equal(t, []netip.Addr{target}, ls.bySubscriber[a])
+
+	assert.True(t, ls.changed(target, "1"))
+	assert.False(t, ls.changed(target, "1"))
+	assert.True(t, ls.changed(target, "2"))
+	ls.retry(target)
+	assert.True(t, ls.changed(target, "2"))
+
+	// An update without subscriptions unsubscribes
+	ls.set(a, nil)
+	assert.Equal(t, []netip.Addr{b}, ls.subscribers(target))
+
+	ls.forget([]netip.Addr{b})
+	assert.Empty(t, ls.subscribers(target))
+	assert.Empty(t, ls.answers)
+}
+
+type subscribeTestWriter struct {
+	testEncWriter
+	sent []netip.Addr
+}
+
+func (tw *subscribeTestWriter) SendMessageToVpnAddr(t header.MessageType, st header.MessageSubType, vpnIp netip.Addr, p, nb, out []byte) {
+	tw.testEncWriter.SendMessageToVpnAddr(t, st, vpnIp, p, nb, out)
+	tw.sent = append(tw.sent, vpnIp)
+}
+
+func (tw *subscribeTestWriter) GetHostInfo(vpnIp netip.Addr) *HostInfo {
+	return &HostInfo{vpnAddrs: []netip.Addr{vpnIp}, ConnectionState: &ConnectionState{myCert: &dummyCert{version: cert.Version2}}}
+}
+
+func TestLighthouse_pushesSubscribedUpdates(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	// Take the pushes away from the worker so we can look at them
+	lh.notifyChan = make(chan netip.Addr, 64)
+
+	filter := NebulaMeta_HostQueryReply
+	w := &subscribeTestWriter{testEncWriter: testEncWriter{metaFilter: &filter}}
+	lh.ifce = w
+	lhh := lh.NewRequestHandler()
+
+	subscriber := netip.MustParseAddr("10.128.0.2")
+	target := netip.MustParseAddr("10.128.0.3")
+	update := func(from netip.Addr, details *NebulaMetaDetails) {
+		details.VpnAddr = netAddrToProtoAddr(from)
+		b, err := (&NebulaMeta{Type: NebulaMeta_HostUpdateNotification, Details: details}).Marshal()
+		require.NoError(t, err)
+		lhh.HandleRequest(netip.MustParseAddrPort("1.2.3.4:4242"), []netip.Addr{from}, b, w)
+	}
+	pushed := func() bool {
+		select {
+		case addr := <-lh.notifyChan:
+			assert.Equal(t, target, addr)
+			return true
+		default:
+			return false
+		}
+	}
+
+	update(subscriber, &NebulaMetaDetails{Subscriptions: []*Addr{netAddrToProtoAddr(target)}})
+	assert.False(t, pushed())
+
+	targetAddr := netip.MustParseAddrPort("5.6.7.8:4242")
+	update(target, &NebulaMetaDetails{V4AddrPorts: []*V4AddrPort{netAddrToProtoV4AddrPort(targetAddr.Addr(), targetAddr.Port())}})
+	require.True(t, pushed())
+
+	// The same addresses again are not pushed
+	update(target, &NebulaMetaDetails{V4AddrPorts: []*V4AddrPort{netAddrToProtoV4AddrPort(targetAddr.Addr(), targetAddr.Port())}})
+	assert.False(t, pushed())
+
+	// The target roaming is
+	newAddr := netip.MustParseAddrPort("5.6.7.9:4242")
+	lh.QueryCache([]netip.Addr{target}).LearnRemote(target, newAddr)
+	lh.notifySubscribers([]netip.Addr{target})
+	require.True(t, pushed())
+
+	w.sent = nil
+	lhh.pushHostQueryReply(target)
+	assert.Equal(t, []netip.Addr{subscriber}, w.sent)
+	require.NotNil(t, w.lastReply.msg)
+	assert.Equal(t, target, protoAddrToNetAddr(w.lastReply.msg.Details.VpnAddr))
+	assertIp4InArray(t, w.lastReply.msg.Details.V4AddrPorts, newAddr, targetAddr)
+
+	// Subscriptions go away with the subscriber
+	lh.DeleteVpnAddrs([]netip.Addr{subscriber})
+	update(target, &NebulaMetaDetails{})
+	assert.False(t, pushed())
+}
+
+func TestLighthouse_subscriptionTargets(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	lhAddr := netip.MustParseAddr("10.128.0.100")
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{
+		"hosts":     []any{lhAddr.String()},
+		"subscribe": map[string]any{"enabled": true},
+	}
+	c.Settings["static_host_map"] = map[string]any{lhAddr.String(): []any{"1.1.1.1:4242"}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+
+	peers := []netip.Addr{netip.MustParseAddr("10.128.0.3"), netip.MustParseAddr("10.128.0.2")}
+	for _, p := range peers {
+		lh.QueryCache([]netip.Addr{p})
+	}
+
+	targets := lh.subscriptionTargets()
+	require.Len(t, targets, 2)
+	assert.Equal(t, peers[1], protoAddrToNetAddr(targets[0]))
+	assert.Equal(t, peers[0], protoAddrToNetAddr(targets[1]))
+
+	lh.subscriptions.config.Store(&subscribeConfig{enabled: true, hosts: []netip.Addr{netip.MustParseAddr("10.128.0.9")}})
+	targets = lh.subscriptionTargets()
+	require.Len(t, targets, 1)
+	assert.Equal(t, netip.MustParseAddr("10.128.0.9"), protoAddrToNetAddr(targets[0]))
+}
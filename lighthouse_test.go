@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/gaissmai/bart"
 	"github.com/slackhq/nebula/cert"
@@ -53,6 +57,63 @@ func Test_lhStaticMapping(t *testing.T) {
 	require.EqualError(t, err, "lighthouse 10.128.0.3 does not have a static_host_map entry")
 }
 
+func Test_lhStaticMappingDiscovery(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/16")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			io.WriteString(w, `{"access_token":"tok","expires_in":"3600"}`)
+		case "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/lh/publicipaddresses":
+			io.WriteString(w, `{"value":[{"properties":{"ipAddress":"1.1.1.1","ipConfiguration":{"id":"/virtualMachines/0/nic"}}}]}`)
+		case "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/lh/virtualMachines":
+			io.WriteString(w, `{"value":[{"instanceId":"0","tags":{"nebula-vpn-addrs":"10.128.0.2"}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	// The lighthouse has no static_host_map entry, it must come from discovery
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"hosts": []any{"10.128.0.2"}}
+	c.Settings["static_map"] = map[string]any{"discovery": map[string]any{
+		"providers": []any{map[string]any{
+			"type":              "azure",
+			"subscription":      "s",
+			"resource_group":    "rg",
+			"scale_set":         "lh",
+			"endpoint":          ts.URL,
+			"metadata_endpoint": ts.URL,
+		}},
+	}}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+
+	// Discovery runs in the background, the lighthouse shows up once it is done
+	lhAddr := netip.MustParseAddr("10.128.0.2")
+	require.Eventually(t, func() bool {
+		_, ok := lh.GetStaticHostList()[lhAddr]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	lh.RLock()
+	am := lh.addrMap[lhAddr]
+	lh.RUnlock()
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("1.1.1.1:4242")}, am.CopyAddrs(nil))
+
+	// Removing discovery forgets the discovered addresses
+	require.NoError(t, c.ReloadConfigString("lighthouse:\n  hosts: []"))
+	assert.NotContains(t, lh.GetStaticHostList(), lhAddr)
+	assert.Empty(t, am.CopyAddrs(nil))
+}
+
 func TestReloadLighthouseInterval(t *testing.T) {
 	l := test.NewLogger()
 	myVpnNet := netip.MustParsePrefix("10.128.0.1/16")
@@ -194,6 +255,7 @@ func TestLighthouse_Memory(t *testing.T) {
 	c := config.NewC(l)
 	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
 	c.Settings["listen"] = map[string]any{"port": 4242}
+	c.Settings["listen"] = map[string]any{"port": 4242}
 
 	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
 	nt := new(bart.Lite)
@@ -279,6 +341,7 @@ func TestLighthouse_reload(t *testing.T) {
 	c := config.NewC(l)
 	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
 	c.Settings["listen"] = map[string]any{"port": 4242}
+	c.Settings["listen"] = map[string]any{"port": 4242}
 
 	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
 	nt := new(bart.Lite)
@@ -304,6 +367,61 @@ func TestLighthouse_reload(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func FuzzLighthouseHandleRequest(f *testing.F) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/0")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(f, err)
+
+	// Seed with each message type we handle, in both address formats
+	v4Addr := netip.MustParseAddrPort("1.2.3.4:4242")
+	v6Addr := netip.MustParseAddrPort("[1:2::3:4]:4242")
+	for _, typ := range []NebulaMeta_MessageType{
+		NebulaMeta_HostQuery,
+		NebulaMeta_HostQueryReply,
+		NebulaMeta_HostUpdateNotification,
+		NebulaMeta_HostPunchNotification,
+		NebulaMeta_HostUpdateNotificationAck,
+	} {
+		for _, details := range []*NebulaMetaDetails{
+			{
+				OldVpnAddr:  3,
+				V4AddrPorts: []*V4AddrPort{netAddrToProtoV4AddrPort(v4Addr.Addr(), v4Addr.Port())},
+			},
+			{
+				VpnAddr:     netAddrToProtoAddr(netip.MustParseAddr("fd00::3")),
+				V6AddrPorts: []*V6AddrPort{netAddrToProtoV6AddrPort(v6Addr.Addr(), v6Addr.Port())},
+				RelayVpnAddrs: []*Addr{
+					netAddrToProtoAddr(netip.MustParseAddr("0.0.0.5")),
+				},
+			},
+		} {
+			b, err := (&NebulaMeta{Type: typ, Details: details}).Marshal()
+			require.NoError(f, err)
+			f.Add(b)
+		}
+	}
+	f.Add([]byte{})
+
+	w := &mockEncWriter{}
+	lh.ifce = w
+	fromVpnAddrs := []netip.Addr{netip.MustParseAddr("0.0.0.3")}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		lhh := lh.NewRequestHandler()
+		lhh.HandleRequest(v4Addr, fromVpnAddrs, b, w)
+	})
+}
+
 func newLHHostRequest(fromAddr netip.AddrPort, myVpnIp, queryVpnIp netip.Addr, lhh *LightHouseHandler) testLhReply {
 	req := &NebulaMeta{
 		Type:    NebulaMeta_HostQuery,
@@ -613,3 +731,94 @@ func TestLighthouse_DeletesWork(t *testing.T) {
 	out = lh.Query(testHost)
 	assert.Nil(t, out)
 }
+
+func TestLighthouse_relayOnlyAddrs(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+
+	vpnAddr := netip.MustParseAddr("10.128.0.2")
+	relayOnly := newIp4AndPortFromString("1.2.3.4:4242")
+	relayOnly.Tag = AddrTag_RelayOnly
+	public := newIp4AndPortFromString("1.2.3.5:4242")
+	public.Tag = AddrTag_Public
+
+	assert.False(t, lh.unlockedShouldAddV4(vpnAddr, relayOnly))
+	assert.True(t, lh.unlockedShouldAddV4(vpnAddr, public))
+
+	c.Settings["relay"] = map[string]any{"am_relay": true}
+	require.NoError(t, lh.reload(c, true))
+	assert.True(t, lh.unlockedShouldAddV4(vpnAddr, relayOnly))
+}
+
+func TestLighthouse_dualStackRemoteList(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+
+	v4 := netip.MustParseAddr("10.128.0.2")
+	v6 := netip.MustParseAddr("fd00::2")
+
+	// Only the v4 address is known, like after a query reply
+	am := lh.unlockedGetRemoteList([]netip.Addr{v4})
+	assert.Nil(t, lh.Query(v6))
+
+	// A handshake or host update tells us about both
+	assert.Same(t, am, lh.QueryCache([]netip.Addr{v6, v4}))
+	assert.Same(t, am, lh.Query(v4))
+	assert.Same(t, am, lh.Query(v6))
+
+	// Same when the first address is the one we already knew
+	other := netip.MustParseAddr("10.128.0.3")
+	other6 := netip.MustParseAddr("fd00::3")
+	am = lh.unlockedGetRemoteList([]netip.Addr{other})
+	assert.Same(t, am, lh.QueryCache([]netip.Addr{other, other6}))
+	assert.Same(t, am, lh.Query(other6))
+
+	// Lists that only tell us about one address never join two hosts together
+	third := netip.MustParseAddr("10.128.0.4")
+	third6 := netip.MustParseAddr("fd00::4")
+	am = lh.unlockedGetRemoteList([]netip.Addr{third})
+	am6 := lh.unlockedGetRemoteList([]netip.Addr{third6})
+	assert.Same(t, am, lh.unlockedGetRemoteList([]netip.Addr{third, third6}))
+	assert.Same(t, am6, lh.Query(third6))
+
+	// Until a certificate says they are the same host, then nothing either list knew is lost
+	am.unlockedPrependV4(netip.MustParseAddr("10.128.0.1"), netAddrToProtoV4AddrPort(netip.MustParseAddr("1.1.1.1"), 4242))
+	am6.unlockedPrependV4(netip.MustParseAddr("10.128.0.1"), netAddrToProtoV4AddrPort(netip.MustParseAddr("2.2.2.2"), 4242))
+	am6.unlockedSetLearnedV4(third6, netAddrToProtoV4AddrPort(netip.MustParseAddr("3.3.3.3"), 4242))
+	am6.unlockedSetDiscovered([]netip.AddrPort{netip.MustParseAddrPort("4.4.4.4:4242")})
+	am6.unlockedSetPersisted([]netip.AddrPort{netip.MustParseAddrPort("5.5.5.5:4242")}, time.Now())
+
+	assert.Same(t, am, lh.QueryCache([]netip.Addr{third, third6}))
+	assert.Same(t, am, lh.Query(third6))
+	assert.ElementsMatch(t, []netip.AddrPort{
+		netip.MustParseAddrPort("1.1.1.1:4242"),
+		netip.MustParseAddrPort("2.2.2.2:4242"),
+		netip.MustParseAddrPort("3.3.3.3:4242"),
+		netip.MustParseAddrPort("4.4.4.4:4242"),
+		netip.MustParseAddrPort("5.5.5.5:4242"),
+	}, am.CopyAddrs(nil))
+
+	lh.DeleteVpnAddrs([]netip.Addr{v4, v6})
+	assert.Nil(t, lh.Query(v4))
+	assert.Nil(t, lh.Query(v6))
+}
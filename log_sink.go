@@ -0,0 +1,112 @@
+package nebula
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogSink receives log entries in place of the logger's own output. Embedders can implement it to route nebula logs
+// into the structured logger they already use, NewSlogSink does this for log/slog.
+type LogSink interface {
+	Log(e *logrus.Entry)
+}
+
+// SetLogSink sends every entry logged through l to sink instead of writing it to l.Out. Entries from a subsystem logger
+// carry a `subsystem` field. It must be called before Main so the subsystem loggers pick up the change.
+func SetLogSink(l *logrus.Logger, sink LogSink) {
+	l.SetOutput(io.Discard)
+	l.AddHook(&sinkHook{sink: sink})
+}
+
+type sinkHook struct {
+	sink LogSink
+}
+
+func (h *sinkHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *sinkHook) Fire(e *logrus.Entry) error {
+	h.sink.Log(e)
+	return nil
+}
+
+// NewSlogLogger returns a logger to pass to Main that sends everything to sl, for embedders that do not otherwise use
+// logrus. logging.level still applies, anything it lets through is then filtered by the level of sl.
+func NewSlogLogger(sl *slog.Logger) *logrus.Logger {
+	l := logrus.New()
+	SetLogSink(l, NewSlogSink(sl))
+	return l
+}
+
+type slogSink struct {
+	l *slog.Logger
+}
+
+// NewSlogSink returns a LogSink that writes to l. logrus trace and debug map to slog debug, fatal and panic to error.
+func NewSlogSink(l *slog.Logger) LogSink {
+	return &slogSink{l: l}
+}
+
+func (s *slogSink) Log(e *logrus.Entry) {
+	level := slogLevel(e.Level)
+	ctx := e.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	h := s.l.Handler()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+
+	var pc uintptr
+	if e.Caller != nil {
+		pc = e.Caller.PC
+	}
+
+	r := slog.NewRecord(e.Time, level, e.Message, pc)
+	r.AddAttrs(slogAttrs(e.Data)...)
+	_ = h.Handle(ctx, r)
+}
+
+// slogAttrs converts logrus fields to attributes with the same names. Nested fields, like the `m{}` used for
+// handshakes and firewall rules, become groups.
+func slogAttrs(fields map[string]any) []slog.Attr {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, k := range keys {
+		switch v := fields[k].(type) {
+		case map[string]any:
+			attrs = append(attrs, slog.Attr{Key: k, Value: slog.GroupValue(slogAttrs(v)...)})
+		case logrus.Fields:
+			attrs = append(attrs, slog.Attr{Key: k, Value: slog.GroupValue(slogAttrs(v)...)})
+		default:
+			attrs = append(attrs, slog.Any(k, v))
+		}
+	}
+
+	return attrs
+}
+
+func slogLevel(l logrus.Level) slog.Level {
+	switch l {
+	case logrus.TraceLevel, logrus.DebugLevel:
+		return slog.LevelDebug
+	case logrus.InfoLevel:
+		return slog.LevelInfo
+	case logrus.WarnLevel:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
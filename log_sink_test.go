@@ -0,0 +1,52 @@
+package nebula
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSlogSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	sl := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	l := logrus.New()
+	l.SetLevel(logrus.TraceLevel)
+	SetLogSink(l, NewSlogSink(sl))
+
+	logs := newLogSubsystems(l)
+	logs.get(LogSubsystemLighthouse).WithField("vpnAddr", "10.0.0.1").WithError(errors.New("boom")).Warn("no route")
+	assert.Equal(t, "level=WARN msg=\"no route\" error=boom subsystem=lighthouse vpnAddr=10.0.0.1\n", out.String())
+	out.Reset()
+
+	l.Trace("quiet")
+	assert.Equal(t, "level=DEBUG msg=quiet\n", out.String())
+	out.Reset()
+
+	// Nested fields keep their names as groups
+	l.WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).Info("Handshake message sent")
+	assert.Equal(t, "level=INFO msg=\"Handshake message sent\" handshake.stage=1 handshake.style=ix_psk0\n", out.String())
+}
+
+func TestNewSlogLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	l.Info("filtered by the handler")
+	assert.Empty(t, out.String())
+
+	l.WithField("vpnAddrs", []string{"10.0.0.1"}).Error("oops")
+	assert.Contains(t, out.String(), `"msg":"oops","vpnAddrs":["10.0.0.1"]}`)
+}
@@ -3,6 +3,7 @@ package nebula
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -43,3 +44,133 @@ func configLogger(l *logrus.Logger, c *config.C) error {
 
 	return nil
 }
+
+// Subsystems that can be given a log level of their own with logging.subsystems or the log-level ssh command
+const (
+	LogSubsystemHandshake  = "handshake"
+	LogSubsystemFirewall   = "firewall"
+	LogSubsystemLighthouse = "lighthouse"
+	LogSubsystemTun        = "tun"
+)
+
+var logSubsystemNames = []string{LogSubsystemHandshake, LogSubsystemFirewall, LogSubsystemLighthouse, LogSubsystemTun}
+
+// logSubsystems holds a logger for each subsystem. They share the output, formatter, and hooks of the root logger and
+// follow its level unless they have been given one of their own. Every entry is tagged with its subsystem.
+type logSubsystems struct {
+	sync.Mutex
+	root      *logrus.Logger
+	loggers   map[string]*logrus.Logger
+	overrides map[string]logrus.Level
+}
+
+func newLogSubsystems(root *logrus.Logger) *logSubsystems {
+	ls := &logSubsystems{
+		root:      root,
+		loggers:   map[string]*logrus.Logger{},
+		overrides: map[string]logrus.Level{},
+	}
+
+	for _, name := range logSubsystemNames {
+		l := logrus.New()
+		l.Hooks.Add(&subsystemHook{name: name, root: root})
+		ls.loggers[name] = l
+	}
+
+	ls.sync()
+	return ls
+}
+
+// get returns the logger for the named subsystem
+func (ls *logSubsystems) get(name string) *logrus.Logger {
+	return ls.loggers[name]
+}
+
+// reload applies logging.subsystems, it must be called after the root logger has been configured
+func (ls *logSubsystems) reload(c *config.C) error {
+	overrides := map[string]logrus.Level{}
+	for name, v := range c.GetMap("logging.subsystems", map[string]any{}) {
+		if _, ok := ls.loggers[name]; !ok {
+			return fmt.Errorf("unknown logging subsystem `%s`. possible subsystems: %s", name, logSubsystemNames)
+		}
+
+		level, err := logrus.ParseLevel(strings.ToLower(fmt.Sprintf("%v", v)))
+		if err != nil {
+			return fmt.Errorf("logging.subsystems.%s: %s; possible levels: %s", name, err, logrus.AllLevels)
+		}
+		overrides[name] = level
+	}
+
+	ls.Lock()
+	ls.overrides = overrides
+	ls.Unlock()
+
+	ls.sync()
+	return nil
+}
+
+// setLevel overrides the level of a subsystem until the next config reload
+func (ls *logSubsystems) setLevel(name string, level logrus.Level) error {
+	if _, ok := ls.loggers[name]; !ok {
+		return fmt.Errorf("unknown logging subsystem `%s`. possible subsystems: %s", name, logSubsystemNames)
+	}
+
+	ls.Lock()
+	ls.overrides[name] = level
+	ls.Unlock()
+
+	ls.sync()
+	return nil
+}
+
+// resetLevel makes a subsystem follow the root log level again
+func (ls *logSubsystems) resetLevel(name string) error {
+	if _, ok := ls.loggers[name]; !ok {
+		return fmt.Errorf("unknown logging subsystem `%s`. possible subsystems: %s", name, logSubsystemNames)
+	}
+
+	ls.Lock()
+	delete(ls.overrides, name)
+	ls.Unlock()
+
+	ls.sync()
+	return nil
+}
+
+// sync copies the current settings of the root logger to every subsystem logger, it must be called any time the root
+// logger is changed
+func (ls *logSubsystems) sync() {
+	ls.Lock()
+	defer ls.Unlock()
+
+	for name, l := range ls.loggers {
+		l.SetOutput(ls.root.Out)
+		l.SetFormatter(ls.root.Formatter)
+		l.SetReportCaller(ls.root.ReportCaller)
+		l.ExitFunc = ls.root.ExitFunc
+
+		if level, ok := ls.overrides[name]; ok {
+			l.SetLevel(level)
+		} else {
+			l.SetLevel(ls.root.GetLevel())
+		}
+	}
+}
+
+// subsystemHook tags entries with the subsystem they came from and passes them along to the hooks of the root logger
+type subsystemHook struct {
+	name string
+	root *logrus.Logger
+}
+
+func (h *subsystemHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *subsystemHook) Fire(e *logrus.Entry) error {
+	if _, ok := e.Data["subsystem"]; !ok {
+		e.Data["subsystem"] = h.name
+	}
+
+	return h.root.Hooks.Fire(e.Level, e)
+}
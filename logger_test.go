@@ -0,0 +1,61 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSubsystems(t *testing.T) {
+	out := &bytes.Buffer{}
+	root := logrus.New()
+	root.SetOutput(out)
+	root.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	root.SetLevel(logrus.InfoLevel)
+
+	c := config.NewC(root)
+	c.Settings["logging"] = map[string]any{"subsystems": map[string]any{"handshake": "debug"}}
+
+	logs := newLogSubsystems(root)
+	require.NoError(t, logs.reload(c))
+
+	hs := logs.get(LogSubsystemHandshake)
+	fw := logs.get(LogSubsystemFirewall)
+	assert.Equal(t, logrus.DebugLevel, hs.GetLevel())
+	assert.Equal(t, logrus.InfoLevel, fw.GetLevel())
+
+	// Entries go to the root output and are tagged
+	hs.Debug("hello")
+	assert.Equal(t, "level=debug msg=hello subsystem=handshake\n", out.String())
+	out.Reset()
+
+	fw.Debug("hidden")
+	assert.Empty(t, out.String())
+
+	// Subsystems without a level of their own follow the root logger
+	root.SetLevel(logrus.WarnLevel)
+	logs.sync()
+	assert.Equal(t, logrus.WarnLevel, fw.GetLevel())
+	assert.Equal(t, logrus.DebugLevel, hs.GetLevel())
+
+	require.NoError(t, logs.setLevel(LogSubsystemFirewall, logrus.TraceLevel))
+	assert.Equal(t, logrus.TraceLevel, fw.GetLevel())
+	require.NoError(t, logs.resetLevel(LogSubsystemHandshake))
+	assert.Equal(t, logrus.WarnLevel, hs.GetLevel())
+	require.Error(t, logs.setLevel("nope", logrus.InfoLevel))
+
+	// A reload replaces anything set at runtime
+	require.NoError(t, logs.reload(c))
+	assert.Equal(t, logrus.DebugLevel, hs.GetLevel())
+	assert.Equal(t, logrus.WarnLevel, fw.GetLevel())
+
+	c.Settings["logging"] = map[string]any{"subsystems": map[string]any{"nope": "debug"}}
+	require.EqualError(t, logs.reload(c), "unknown logging subsystem `nope`. possible subsystems: [handshake firewall lighthouse tun]")
+
+	c.Settings["logging"] = map[string]any{"subsystems": map[string]any{"tun": "loud"}}
+	require.Error(t, logs.reload(c))
+}
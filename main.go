@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/beacon"
 	"github.com/slackhq/nebula/config"
 	"github.com/slackhq/nebula/overlay"
 	"github.com/slackhq/nebula/sshd"
@@ -55,11 +56,22 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
 	}
 
+	logs := newLogSubsystems(l)
+	err = logs.reload(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to configure the logger", err)
+	}
+
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := configLogger(l, c)
 		if err != nil {
 			l.WithError(err).Error("Failed to configure the logger")
 		}
+
+		err = logs.reload(c)
+		if err != nil {
+			l.WithError(err).Error("Failed to configure the logger")
+		}
 	})
 
 	pki, err := NewPKIFromConfig(l, c)
@@ -67,12 +79,57 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		return nil, util.ContextualizeIfNeeded("Failed to load PKI from config", err)
 	}
 
-	fw, err := NewFirewallFromConfig(l, pki.getCertState(), c)
+	fw, err := NewFirewallFromConfig(logs.get(LogSubsystemFirewall), pki.getCertState(), c)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Error while loading firewall rules", err)
 	}
 	l.WithField("firewallHashes", fw.GetRuleHashes()).Info("Firewall started")
 
+	fw.flowLog, err = newFlowLogFromConfig(ctx, logs.get(LogSubsystemFirewall), c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load firewall.flow_log", err)
+	}
+
+	peerFilter, err := newPeerFilterFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load peer_filter", err)
+	}
+
+	securityRequirements, err := newSecurityRequirementsFromConfig(c, pki.getCertState().cipher)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load security.min_requirements", err)
+	}
+	if err := securityRequirements.checkFIPS(pki.getCertState()); err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to enable security.fips", err)
+	}
+	if securityRequirements.fipsMode() {
+		// security.fips can not change with a reload, so a reloaded cert is held to the mode we started in
+		pki.checkCertState = securityRequirements.checkFIPS
+	}
+
+	var firewallRuleSources []firewallRuleSource
+	podNet, err := newPodNetworkFromConfig(l, c, pki.getCertState())
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to configure kubernetes pod network", err)
+	}
+	if podNet != nil {
+		firewallRuleSources = append(firewallRuleSources, podNet)
+	}
+
+	wgGateway, err := newWireguardGatewayFromConfig(l, c, pki.getCertState())
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to configure wireguard gateway", err)
+	}
+	if wgGateway != nil {
+		firewallRuleSources = append(firewallRuleSources, wgGateway)
+	}
+
+	for _, src := range firewallRuleSources {
+		if err := src.addFirewallRules(fw); err != nil {
+			return nil, util.ContextualizeIfNeeded("Error while loading firewall rules", err)
+		}
+	}
+
 	ssh, err := sshd.NewSSHServer(l.WithField("subsystem", "sshd"))
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Error while creating SSH server", err)
@@ -87,6 +144,15 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 	}
 
+	statsIdentity := func() (string, []string) {
+		crt := pki.getCertState().GetDefaultCertificate()
+		return crt.Name(), crt.Groups()
+	}
+	statsStart, statsStop, err := startStats(l, c, statsIdentity, buildVersion, configTest)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to start stats emitter", err)
+	}
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// All non system modifying configuration consumption should live above this line
 	// tun config, listeners, anything modifying the computer should be below
@@ -136,7 +202,7 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 			deviceFactory = overlay.NewDeviceFromConfig
 		}
 
-		tun, err = deviceFactory(c, l, pki.getCertState().myVpnNetworks, routines)
+		tun, err = deviceFactory(c, logs.get(LogSubsystemTun), pki.getCertState().myVpnNetworks, routines)
 		if err != nil {
 			return nil, util.ContextualizeIfNeeded("Failed to get a tun/tap device", err)
 		}
@@ -150,8 +216,20 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	// set up our UDP listener
 	udpConns := make([]udp.Conn, routines)
+	var sourcePorts []udp.Conn
+	var portHopper *portHopper
 	port := c.GetInt("listen.port", 0)
 
+	xdpConfig, err := udp.NewXDPConfigFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.xdp", err)
+	}
+
+	obfuscation, err := newObfuscationFromConfig(l, c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load listen.obfuscation", err)
+	}
+
 	if !configTest {
 		rawListenHost := c.GetString("listen.host", "::")
 		var listenHost netip.Addr
@@ -172,11 +250,17 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 		for i := 0; i < routines; i++ {
 			l.Infof("listening on %v", netip.AddrPortFrom(listenHost, uint16(port)))
-			udpServer, err := udp.NewListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64))
+			var udpServer udp.Conn
+			if xdpConfig != nil {
+				udpServer, err = udp.NewXDPListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64), xdpConfig, i)
+			} else {
+				udpServer, err = udp.NewListener(l, listenHost, port, routines > 1, c.GetInt("listen.batch", 64))
+			}
 			if err != nil {
 				return nil, util.NewContextualError("Failed to open udp listener", m{"queue": i}, err)
 			}
 			udpServer.ReloadConfig(c)
+			udpServer = obfuscation.wrap(udpServer)
 			udpConns[i] = udpServer
 
 			// If port is dynamic, discover it before the next pass through the for loop
@@ -189,12 +273,32 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 				port = int(uPort.Port())
 			}
 		}
+
+		sourcePorts, err = newSourcePortsFromConfig(l, c, listenHost)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to open listen.source_ports", err)
+		}
+		for i, sp := range sourcePorts {
+			sourcePorts[i] = obfuscation.wrap(sp)
+		}
+
+		portHopper, err = newPortHopperFromConfig(l, c, func(port uint16) (udp.Conn, error) {
+			conn, err := udp.NewListener(l, listenHost, int(port), false, c.GetInt("listen.batch", 64))
+			if err != nil {
+				return nil, err
+			}
+			conn.ReloadConfig(c)
+			return obfuscation.wrap(conn), nil
+		})
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to load listen.port_hopping", err)
+		}
 	}
 
 	hostMap := NewHostMapFromConfig(l, c)
 	punchy := NewPunchyFromConfig(l, c)
 	connManager := newConnectionManagerFromConfig(l, c, hostMap, punchy)
-	lightHouse, err := NewLightHouseFromConfig(ctx, l, c, pki.getCertState(), udpConns[0], punchy)
+	lightHouse, err := NewLightHouseFromConfig(ctx, logs.get(LogSubsystemLighthouse), c, pki.getCertState(), udpConns[0], punchy)
 	if err != nil {
 		return nil, util.ContextualizeIfNeeded("Failed to initialize lighthouse handler", err)
 	}
@@ -213,13 +317,34 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		retries:       int64(c.GetInt("handshakes.retries", DefaultHandshakeRetries)),
 		triggerBuffer: c.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
 		useRelays:     useRelays,
+		multiplier:    c.GetFloat("handshakes.multiplier", 0),
+		jitter:        c.GetFloat("handshakes.jitter", 0),
+		startupJitter: c.GetDuration("handshakes.startup_jitter", 0),
 
 		messageMetrics: messageMetrics,
 	}
 
-	handshakeManager := NewHandshakeManager(l, hostMap, lightHouse, udpConns[0], handshakeConfig)
+	if handshakeConfig.multiplier != 0 && handshakeConfig.multiplier < 1 {
+		return nil, util.NewContextualError("handshakes.multiplier must be 1 or greater", m{"multiplier": handshakeConfig.multiplier}, nil)
+	}
+
+	if handshakeConfig.jitter < 0 || handshakeConfig.jitter >= 1 {
+		return nil, util.NewContextualError("handshakes.jitter must be at least 0 and less than 1", m{"jitter": handshakeConfig.jitter}, nil)
+	}
+
+	handshakeConfig.admission, err = newHandshakeAdmissionFromConfig(c)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load handshakes.admission", err)
+	}
+
+	handshakeManager := NewHandshakeManager(logs.get(LogSubsystemHandshake), hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
+	lanDiscoveryConfig, err := beacon.NewConfigFromConfig(c, "lan_discovery")
+	if err != nil {
+		return nil, util.NewContextualError("Failed to load lan_discovery", nil, err)
+	}
+
 	serveDns := false
 	if c.GetBool("lighthouse.serve_dns", false) {
 		if c.GetBool("lighthouse.am_lighthouse", false) {
@@ -261,12 +386,43 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		}
 
 		ifce.writers = udpConns
+		ifce.sourcePorts = sourcePorts
+		ifce.portHopper = portHopper
+		ifce.logs = logs
 		lightHouse.ifce = ifce
 
+		ifce.routeMTU, err = overlay.NewRouteMTUFromConfig(c, l, pki.getCertState().myVpnNetworks)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to load route mtus", err)
+		}
+
+		ifce.firewallRuleSources = firewallRuleSources
+		if podNet != nil {
+			podNet.onChange = func() { ifce.rebuildFirewall(c) }
+		}
+		if wgGateway != nil {
+			ifce.wireguardGateway = wgGateway
+			wgGateway.f = ifce
+		}
+
 		ifce.RegisterConfigChangeCallbacks(c)
 		ifce.reloadDisconnectInvalid(c)
 		ifce.reloadSendRecvError(c)
 		ifce.reloadAcceptRecvError(c)
+		ifce.reloadQos(c)
+		ifce.reloadShaper(c)
+		ifce.reloadCrash(c)
+		ifce.reloadClockSkew(c)
+		ifce.reloadNullCipher(c)
+		ifce.reloadCompression(c)
+		ifce.reloadBroadcast(c)
+		ifce.reloadInboundNAT(c)
+		ifce.reloadAnswerPing(c)
+		ifce.reloadMSSClamping(c)
+		ifce.reloadTunWriteErrors(c)
+		ifce.peerFilter.Store(peerFilter)
+		ifce.securityRequirements.Store(securityRequirements)
+		ifce.checkOwnSecurityRequirements(securityRequirements)
 
 		handshakeManager.f = ifce
 		go handshakeManager.Run(ctx)
@@ -278,13 +434,93 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 
 	go ifce.emitStats(ctx, c.GetDuration("stats.interval", time.Second*10))
 
-	attachCommands(l, c, ssh, ifce, sigChan)
+	vpnSettings, err := newVpnSettingsFromConfig(l, c, pki.getCertState().myVpnNetworks)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load vpn settings", err)
+	}
+
+	doc := &doctor{f: ifce, vpnSettings: vpnSettings}
+	learner := newRuleLearner(logs.get(LogSubsystemFirewall), fw.flowLog)
+	attachCommands(l, c, ssh, ifce, doc, learner, sigChan)
 
 	// Start DNS server last to allow using the nebula IP as lighthouse.dns.host
 	var dnsStart func()
 	if lightHouse.amLighthouse && serveDns {
 		l.Debugln("Starting dns server")
-		dnsStart = dnsMain(l, pki.getCertState(), hostMap, c)
+		dnsStart, err = dnsMain(l, pki.getCertState(), hostMap, c)
+		if err != nil {
+			return nil, util.ContextualizeIfNeeded("Failed to configure the dns server", err)
+		}
+	}
+
+	var podNetworkStart func(context.Context)
+	if podNet != nil {
+		podNetworkStart = podNet.Start
+	}
+
+	var wireguardGatewayStart func(context.Context)
+	if wgGateway != nil {
+		wireguardGatewayStart = wgGateway.Start
+	}
+
+	var networkMonitorStart func(context.Context)
+	if c.GetBool("listen.network_monitor", true) {
+		networkMonitorStart = ifce.watchNetwork
+	}
+
+	var lanDiscoveryStart func(context.Context)
+	if lanDiscoveryConfig != nil {
+		ifce.lanDiscovery = newLanDiscovery(ifce, lanDiscoveryConfig)
+		lanDiscoveryStart = ifce.lanDiscovery.Start
+	}
+
+	healthStart, err := newHealthFromConfig(ctx, l, c, ifce)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to start health endpoints", err)
+	}
+
+	whoisStart, err := newWhoisFromConfig(l, c, ifce)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load whois", err)
+	}
+
+	controlChannelStart, err := newControlChannelFromConfig(l, c, ifce, sigChan)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load control_channel", err)
+	}
+
+	identityProxyStart, err := newIdentityProxiesFromConfig(l, c, ifce)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load identity_proxy", err)
+	}
+
+	svid, err := newSVIDFromConfig(l, c, ifce)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load svid", err)
+	}
+
+	warmRestart, err := newWarmRestartFromConfig(l, c, ifce)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load tunnels.warm_restart", err)
+	}
+	ifce.warmRestart = warmRestart
+	if warmRestart != nil {
+		ifce.resumption = warmRestart.resumption
+	}
+	ifce.preconnect = newPreconnectFromConfig(l, c, ifce)
+
+	var deviceName string
+	if tun != nil {
+		deviceName = tun.Name()
+	}
+	hostDns, err := newHostDnsFromConfig(l, c, deviceName)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load host_dns", err)
+	}
+
+	groupSets, err := newGroupSetsFromConfig(l, c, hostMap)
+	if err != nil {
+		return nil, util.ContextualizeIfNeeded("Failed to load group_sets", err)
 	}
 
 	return &Control{
@@ -293,10 +529,28 @@ func Main(c *config.C, configTest bool, buildVersion string, logger *logrus.Logg
 		ctx,
 		cancel,
 		sshStart,
-		nil,
+		statsStart,
 		dnsStart,
 		lightHouse.StartUpdateWorker,
 		connManager.Start,
+		podNetworkStart,
+		wireguardGatewayStart,
+		networkMonitorStart,
+		lanDiscoveryStart,
+		healthStart,
+		vpnSettings,
+		hostDns,
+		groupSets,
+		doc,
+		warmRestart,
+		ifce.preconnect.Start,
+		fw.flowLog,
+		learner,
+		whoisStart,
+		identityProxyStart,
+		svid,
+		controlChannelStart,
+		statsStop,
 	}, nil
 }
 
@@ -0,0 +1,206 @@
+// Package mobile is a small, stable api over nebula meant for `gomobile bind`. Only types gomobile can export are used
+// in the exported api, richer data is returned as json.
+package mobile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+)
+
+// APIVersion is incremented whenever the exported api changes in a way that is not backwards compatible
+const APIVersion = 1
+
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateStopping = "stopping"
+	StateStopped  = "stopped"
+)
+
+// DefaultRebindDelay is how long rebinding waits for network change notifications to settle
+const DefaultRebindDelay = 500 * time.Millisecond
+
+// EventHandler is implemented by the platform to learn about changes in nebula. Calls are made from background
+// goroutines and must not block.
+type EventHandler interface {
+	OnStateChange(state string)
+}
+
+// Stats is a point in time snapshot of a running nebula
+type Stats struct {
+	Tunnels        int
+	PendingTunnels int
+	Rebinds        int64
+	UptimeSeconds  int64
+}
+
+type Nebula struct {
+	l       *logrus.Logger
+	c       *config.C
+	control *nebula.Control
+	handler EventHandler
+
+	rebindDelay time.Duration
+
+	mu          sync.Mutex
+	state       string
+	started     time.Time
+	rebinds     int64
+	rebindTimer *time.Timer
+}
+
+// New prepares nebula to run with configString, a yaml config, on the tun device already opened by the platform as
+// tunFd. handler may be nil.
+func New(configString string, tunFd int, handler EventHandler) (*Nebula, error) {
+	return newNebula(configString, overlay.NewFdDeviceFromConfig(&tunFd), handler)
+}
+
+func newNebula(configString string, deviceFactory overlay.DeviceFactory, handler EventHandler) (*Nebula, error) {
+	l := logrus.New()
+	c := config.NewC(l)
+	if err := c.LoadString(configString); err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	ctrl, err := nebula.Main(c, false, "", l, deviceFactory, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Nebula{
+		l:           l,
+		c:           c,
+		control:     ctrl,
+		handler:     handler,
+		rebindDelay: DefaultRebindDelay,
+		state:       StateStopped,
+	}, nil
+}
+
+// Start runs nebula in the background. A stopped Nebula can not be started again, create a new one instead.
+func (n *Nebula) Start() error {
+	n.mu.Lock()
+	if !n.started.IsZero() {
+		n.mu.Unlock()
+		return errors.New("nebula has already been started")
+	}
+	n.started = time.Now()
+	n.mu.Unlock()
+
+	n.setState(StateStarting)
+	n.control.Start()
+	n.setState(StateRunning)
+	return nil
+}
+
+// Stop shuts nebula down, closing all tunnels. It returns once shutdown is complete and is safe to call repeatedly.
+func (n *Nebula) Stop() {
+	n.mu.Lock()
+	if n.state != StateRunning {
+		n.mu.Unlock()
+		return
+	}
+	if n.rebindTimer != nil {
+		n.rebindTimer.Stop()
+	}
+	n.state = StateStopping
+	n.mu.Unlock()
+
+	n.notify(StateStopping)
+	n.control.Stop()
+	n.setState(StateStopped)
+}
+
+// State returns the current state, one of the State constants
+func (n *Nebula) State() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state
+}
+
+// Reload applies a new yaml config, the same as sending nebula a SIGHUP
+func (n *Nebula) Reload(configString string) error {
+	if err := n.c.ReloadConfigString(configString); err != nil {
+		return fmt.Errorf("failed to reload config: %w", err)
+	}
+	return nil
+}
+
+// Rebind should be called whenever the platform reports a network change. Bursts of notifications are collapsed into a
+// single rebind of the udp socket after things settle. It never blocks and may be called from any thread, including
+// while the app is in the background.
+func (n *Nebula) Rebind(reason string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state != StateRunning && n.state != StateStarting {
+		return
+	}
+
+	n.l.WithField("reason", reason).Debug("Network change, scheduling a rebind")
+	if n.rebindTimer != nil {
+		n.rebindTimer.Reset(n.rebindDelay)
+		return
+	}
+
+	n.rebindTimer = time.AfterFunc(n.rebindDelay, n.rebind)
+}
+
+func (n *Nebula) rebind() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Holding the lock keeps Stop from tearing down the interface underneath us
+	if n.state != StateRunning {
+		return
+	}
+	n.rebinds++
+
+	n.l.Info("Rebinding udp listener after a network change")
+	n.control.RebindUDPServer()
+}
+
+// Stats returns a snapshot of the running nebula
+func (n *Nebula) Stats() *Stats {
+	n.mu.Lock()
+	s := &Stats{Rebinds: n.rebinds}
+	if !n.started.IsZero() && n.state == StateRunning {
+		s.UptimeSeconds = int64(time.Since(n.started).Seconds())
+	}
+	n.mu.Unlock()
+
+	s.Tunnels = len(n.control.ListHostmapHosts(false))
+	s.PendingTunnels = len(n.control.ListHostmapHosts(true))
+	return s
+}
+
+// ListHostmap returns the established, or pending when pending is true, tunnels as json
+func (n *Nebula) ListHostmap(pending bool) (string, error) {
+	b, err := json.Marshal(n.control.ListHostmapHosts(pending))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (n *Nebula) setState(state string) {
+	n.mu.Lock()
+	n.state = state
+	n.mu.Unlock()
+
+	n.notify(state)
+}
+
+func (n *Nebula) notify(state string) {
+	if n.handler != nil {
+		n.handler.OnStateChange(state)
+	}
+}
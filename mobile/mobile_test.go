@@ -0,0 +1,102 @@
+package mobile
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingHandler struct {
+	sync.Mutex
+	states []string
+}
+
+func (h *recordingHandler) OnStateChange(state string) {
+	h.Lock()
+	defer h.Unlock()
+	h.states = append(h.states, state)
+}
+
+func testConfig(t *testing.T) string {
+	ca, _, caKey, caPem := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Time{}, time.Time{}, nil, nil, nil)
+	_, _, key, crtPem := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "phone", time.Time{}, time.Time{},
+		[]netip.Prefix{netip.MustParsePrefix("10.128.0.2/24")}, nil, nil)
+
+	indent := func(b []byte) string {
+		return strings.ReplaceAll(strings.TrimSpace(string(b)), "\n", "\n    ")
+	}
+
+	return fmt.Sprintf(`
+pki:
+  ca: |
+    %s
+  cert: |
+    %s
+  key: |
+    %s
+listen:
+  host: 127.0.0.1
+  port: 0
+logging:
+  level: error
+firewall:
+  outbound:
+    - port: any
+      proto: any
+      host: any
+`, indent(caPem), indent(crtPem), indent(key))
+}
+
+func TestNebula(t *testing.T) {
+	h := &recordingHandler{}
+
+	_, err := newNebula("not: [yaml", overlay.NewUserDeviceFromConfig, h)
+	require.ErrorContains(t, err, "failed to load config")
+
+	n, err := newNebula(testConfig(t), overlay.NewUserDeviceFromConfig, h)
+	require.NoError(t, err)
+	n.rebindDelay = 10 * time.Millisecond
+	assert.Equal(t, StateStopped, n.State())
+
+	// Rebinding before start is ignored
+	n.Rebind("early")
+	assert.Nil(t, n.rebindTimer)
+
+	require.NoError(t, n.Start())
+	assert.Equal(t, StateRunning, n.State())
+	require.Error(t, n.Start())
+
+	// A burst of network changes results in a single rebind
+	for i := 0; i < 5; i++ {
+		n.Rebind("wifi")
+	}
+	assert.Eventually(t, func() bool {
+		return n.Stats().Rebinds == 1
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	s := n.Stats()
+	assert.Equal(t, int64(1), s.Rebinds)
+	assert.Equal(t, 0, s.Tunnels)
+
+	hosts, err := n.ListHostmap(false)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", hosts)
+
+	n.Stop()
+	n.Stop()
+	assert.Equal(t, StateStopped, n.State())
+
+	h.Lock()
+	defer h.Unlock()
+	assert.Equal(t, []string{StateStarting, StateRunning, StateStopping, StateStopped}, h.states)
+}
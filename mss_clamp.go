@@ -0,0 +1,48 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/iputil"
+)
+
+// With tun.mss_clamping nebula lowers the mss that tcp syns advertise, in both directions, to what fits in the mtu of
+// the route to the far end. Hosts behind an unsafe route usually have a 1500 byte mtu and never learn about the smaller
+// one on the overlay, so without it their full sized segments, like a tls certificate, are dropped on the way.
+
+const (
+	// ipv4TCPOverhead and ipv6TCPOverhead are the ip and tcp header bytes a segment has to share the mtu with
+	ipv4TCPOverhead = 40
+	ipv6TCPOverhead = 60
+)
+
+func (f *Interface) reloadMSSClamping(c *config.C) {
+	initial := c.InitialLoad()
+	if !initial && !c.HasChanged("tun.mss_clamping") {
+		return
+	}
+
+	f.mssClamping.Store(c.GetBool("tun.mss_clamping", false))
+	if !initial {
+		f.l.Infof("tun.mss_clamping changed to %v", f.mssClamping.Load())
+	}
+}
+
+// clampMSS lowers the mss of a tcp syn in packet to fit the route to fwPacket.RemoteAddr, which is the far end for both
+// inbound and outbound packets
+func (f *Interface) clampMSS(fwPacket *firewall.Packet, packet []byte) {
+	if fwPacket.Protocol != firewall.ProtoTCP || f.routeMTU == nil || !f.mssClamping.Load() {
+		return
+	}
+
+	overhead := ipv4TCPOverhead
+	if fwPacket.RemoteAddr.Is6() {
+		overhead = ipv6TCPOverhead
+	}
+
+	mss := f.routeMTU.For(fwPacket.RemoteAddr) - overhead
+	if mss <= 0 {
+		return
+	}
+	iputil.ClampTCPMSS(packet, uint16(mss))
+}
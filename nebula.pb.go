@@ -22,6 +22,38 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
 
+// AddrTag lets the owner of an advertised address say how peers should treat it
+type AddrTag int32
+
+const (
+	AddrTag_Untagged  AddrTag = 0
+	AddrTag_Public    AddrTag = 1
+	AddrTag_Private   AddrTag = 2
+	AddrTag_RelayOnly AddrTag = 3
+)
+
+var AddrTag_name = map[int32]string{
+	0: "Untagged",
+	1: "Public",
+	2: "Private",
+	3: "RelayOnly",
+}
+
+var AddrTag_value = map[string]int32{
+	"Untagged":  0,
+	"Public":    1,
+	"Private":   2,
+	"RelayOnly": 3,
+}
+
+func (x AddrTag) String() string {
+	return proto.EnumName(AddrTag_name, int32(x))
+}
+
+func (AddrTag) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{0}
+}
+
 type NebulaMeta_MessageType int32
 
 const (
@@ -96,7 +128,7 @@ func (x NebulaPing_MessageType) String() string {
 }
 
 func (NebulaPing_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{5, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{6, 0}
 }
 
 type NebulaControl_MessageType int32
@@ -124,7 +156,7 @@ func (x NebulaControl_MessageType) String() string {
 }
 
 func (NebulaControl_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{8, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{9, 0}
 }
 
 type NebulaMeta struct {
@@ -180,13 +212,21 @@ func (m *NebulaMeta) GetDetails() *NebulaMetaDetails {
 }
 
 type NebulaMetaDetails struct {
-	OldVpnAddr       uint32        `protobuf:"varint,1,opt,name=OldVpnAddr,proto3" json:"OldVpnAddr,omitempty"` // Deprecated: Do not use.
-	VpnAddr          *Addr         `protobuf:"bytes,6,opt,name=VpnAddr,proto3" json:"VpnAddr,omitempty"`
-	OldRelayVpnAddrs []uint32      `protobuf:"varint,5,rep,packed,name=OldRelayVpnAddrs,proto3" json:"OldRelayVpnAddrs,omitempty"` // Deprecated: Do not use.
-	RelayVpnAddrs    []*Addr       `protobuf:"bytes,7,rep,name=RelayVpnAddrs,proto3" json:"RelayVpnAddrs,omitempty"`
-	V4AddrPorts      []*V4AddrPort `protobuf:"bytes,2,rep,name=V4AddrPorts,proto3" json:"V4AddrPorts,omitempty"`
-	V6AddrPorts      []*V6AddrPort `protobuf:"bytes,4,rep,name=V6AddrPorts,proto3" json:"V6AddrPorts,omitempty"`
-	Counter          uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	OldVpnAddr          uint32                `protobuf:"varint,1,opt,name=OldVpnAddr,proto3" json:"OldVpnAddr,omitempty"` // Deprecated: Do not use.
+	VpnAddr             *Addr                 `protobuf:"bytes,6,opt,name=VpnAddr,proto3" json:"VpnAddr,omitempty"`
+	OldRelayVpnAddrs    []uint32              `protobuf:"varint,5,rep,packed,name=OldRelayVpnAddrs,proto3" json:"OldRelayVpnAddrs,omitempty"` // Deprecated: Do not use.
+	RelayVpnAddrs       []*Addr               `protobuf:"bytes,7,rep,name=RelayVpnAddrs,proto3" json:"RelayVpnAddrs,omitempty"`
+	V4AddrPorts         []*V4AddrPort         `protobuf:"bytes,2,rep,name=V4AddrPorts,proto3" json:"V4AddrPorts,omitempty"`
+	V6AddrPorts         []*V6AddrPort         `protobuf:"bytes,4,rep,name=V6AddrPorts,proto3" json:"V6AddrPorts,omitempty"`
+	Counter             uint32                `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	RelayAdvertisements []*RelayAdvertisement `protobuf:"bytes,8,rep,name=RelayAdvertisements,proto3" json:"RelayAdvertisements,omitempty"`
+	WantRelays          bool                  `protobuf:"varint,9,opt,name=WantRelays,proto3" json:"WantRelays,omitempty"`
+	Subscriptions       []*Addr               `protobuf:"bytes,10,rep,name=Subscriptions,proto3" json:"Subscriptions,omitempty"`
+	// ReportedAgeMs is how long ago the host last updated the lighthouse about the addresses in a HostQueryReply, at
+	// least 1. It is 0 when the lighthouse does not say.
+	ReportedAgeMs uint32 `protobuf:"varint,11,opt,name=ReportedAgeMs,proto3" json:"ReportedAgeMs,omitempty"`
+	// Labels are the key=value labels of the host from its config, sent with host updates and query replies
+	Labels []string `protobuf:"bytes,12,rep,name=Labels,proto3" json:"Labels,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -273,6 +313,93 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetRelayAdvertisements() []*RelayAdvertisement {
+	if m != nil {
+		return m.RelayAdvertisements
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetWantRelays() bool {
+	if m != nil {
+		return m.WantRelays
+	}
+	return false
+}
+
+func (m *NebulaMetaDetails) GetSubscriptions() []*Addr {
+	if m != nil {
+		return m.Subscriptions
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetReportedAgeMs() uint32 {
+	if m != nil {
+		return m.ReportedAgeMs
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetLabels() []string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+type RelayAdvertisement struct {
+	VpnAddr *Addr    `protobuf:"bytes,1,opt,name=VpnAddr,proto3" json:"VpnAddr,omitempty"`
+	Tags    []string `protobuf:"bytes,2,rep,name=Tags,proto3" json:"Tags,omitempty"`
+}
+
+func (m *RelayAdvertisement) Reset()         { *m = RelayAdvertisement{} }
+func (m *RelayAdvertisement) String() string { return proto.CompactTextString(m) }
+func (*RelayAdvertisement) ProtoMessage()    {}
+func (*RelayAdvertisement) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{2}
+}
+func (m *RelayAdvertisement) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *RelayAdvertisement) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_RelayAdvertisement.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *RelayAdvertisement) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RelayAdvertisement.Merge(m, src)
+}
+func (m *RelayAdvertisement) XXX_Size() int {
+	return m.Size()
+}
+func (m *RelayAdvertisement) XXX_DiscardUnknown() {
+	xxx_messageInfo_RelayAdvertisement.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RelayAdvertisement proto.InternalMessageInfo
+
+func (m *RelayAdvertisement) GetVpnAddr() *Addr {
+	if m != nil {
+		return m.VpnAddr
+	}
+	return nil
+}
+
+func (m *RelayAdvertisement) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
 type Addr struct {
 	Hi uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
 	Lo uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
@@ -282,7 +409,7 @@ func (m *Addr) Reset()         { *m = Addr{} }
 func (m *Addr) String() string { return proto.CompactTextString(m) }
 func (*Addr) ProtoMessage()    {}
 func (*Addr) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{2}
+	return fileDescriptor_2d65afa7693df5ef, []int{3}
 }
 func (m *Addr) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -326,15 +453,17 @@ func (m *Addr) GetLo() uint64 {
 }
 
 type V4AddrPort struct {
-	Addr uint32 `protobuf:"varint,1,opt,name=Addr,proto3" json:"Addr,omitempty"`
-	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
+	Addr     uint32  `protobuf:"varint,1,opt,name=Addr,proto3" json:"Addr,omitempty"`
+	Port     uint32  `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
+	Priority uint32  `protobuf:"varint,3,opt,name=Priority,proto3" json:"Priority,omitempty"`
+	Tag      AddrTag `protobuf:"varint,4,opt,name=Tag,proto3,enum=nebula.AddrTag" json:"Tag,omitempty"`
 }
 
 func (m *V4AddrPort) Reset()         { *m = V4AddrPort{} }
 func (m *V4AddrPort) String() string { return proto.CompactTextString(m) }
 func (*V4AddrPort) ProtoMessage()    {}
 func (*V4AddrPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{3}
+	return fileDescriptor_2d65afa7693df5ef, []int{4}
 }
 func (m *V4AddrPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -377,17 +506,33 @@ func (m *V4AddrPort) GetPort() uint32 {
 	return 0
 }
 
+func (m *V4AddrPort) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *V4AddrPort) GetTag() AddrTag {
+	if m != nil {
+		return m.Tag
+	}
+	return AddrTag_Untagged
+}
+
 type V6AddrPort struct {
-	Hi   uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
-	Lo   uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
-	Port uint32 `protobuf:"varint,3,opt,name=Port,proto3" json:"Port,omitempty"`
+	Hi       uint64  `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
+	Lo       uint64  `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
+	Port     uint32  `protobuf:"varint,3,opt,name=Port,proto3" json:"Port,omitempty"`
+	Priority uint32  `protobuf:"varint,4,opt,name=Priority,proto3" json:"Priority,omitempty"`
+	Tag      AddrTag `protobuf:"varint,5,opt,name=Tag,proto3,enum=nebula.AddrTag" json:"Tag,omitempty"`
 }
 
 func (m *V6AddrPort) Reset()         { *m = V6AddrPort{} }
 func (m *V6AddrPort) String() string { return proto.CompactTextString(m) }
 func (*V6AddrPort) ProtoMessage()    {}
 func (*V6AddrPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4}
+	return fileDescriptor_2d65afa7693df5ef, []int{5}
 }
 func (m *V6AddrPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -437,6 +582,20 @@ func (m *V6AddrPort) GetPort() uint32 {
 	return 0
 }
 
+func (m *V6AddrPort) GetPriority() uint32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *V6AddrPort) GetTag() AddrTag {
+	if m != nil {
+		return m.Tag
+	}
+	return AddrTag_Untagged
+}
+
 type NebulaPing struct {
 	Type NebulaPing_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaPing_MessageType" json:"Type,omitempty"`
 	Time uint64                 `protobuf:"varint,2,opt,name=Time,proto3" json:"Time,omitempty"`
@@ -446,7 +605,7 @@ func (m *NebulaPing) Reset()         { *m = NebulaPing{} }
 func (m *NebulaPing) String() string { return proto.CompactTextString(m) }
 func (*NebulaPing) ProtoMessage()    {}
 func (*NebulaPing) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{5}
+	return fileDescriptor_2d65afa7693df5ef, []int{6}
 }
 func (m *NebulaPing) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -498,7 +657,7 @@ func (m *NebulaHandshake) Reset()         { *m = NebulaHandshake{} }
 func (m *NebulaHandshake) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshake) ProtoMessage()    {}
 func (*NebulaHandshake) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{6}
+	return fileDescriptor_2d65afa7693df5ef, []int{7}
 }
 func (m *NebulaHandshake) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -548,13 +707,19 @@ type NebulaHandshakeDetails struct {
 	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
 	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
 	CertVersion    uint32 `protobuf:"varint,8,opt,name=CertVersion,proto3" json:"CertVersion,omitempty"`
+	NullCipher     bool   `protobuf:"varint,9,opt,name=NullCipher,proto3" json:"NullCipher,omitempty"`
+	SourcePorts    uint32 `protobuf:"varint,10,opt,name=SourcePorts,proto3" json:"SourcePorts,omitempty"`
+	// Compression is a bitmask of the payload compression algorithms the sender can decompress
+	Compression uint32 `protobuf:"varint,11,opt,name=Compression,proto3" json:"Compression,omitempty"`
+	// HopSchedule identifies the port hopping schedule the sender follows, 0 when it does not hop
+	HopSchedule uint32 `protobuf:"varint,12,opt,name=HopSchedule,proto3" json:"HopSchedule,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
 func (m *NebulaHandshakeDetails) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshakeDetails) ProtoMessage()    {}
 func (*NebulaHandshakeDetails) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{7}
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
 }
 func (m *NebulaHandshakeDetails) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -625,6 +790,34 @@ func (m *NebulaHandshakeDetails) GetCertVersion() uint32 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetNullCipher() bool {
+	if m != nil {
+		return m.NullCipher
+	}
+	return false
+}
+
+func (m *NebulaHandshakeDetails) GetSourcePorts() uint32 {
+	if m != nil {
+		return m.SourcePorts
+	}
+	return 0
+}
+
+func (m *NebulaHandshakeDetails) GetCompression() uint32 {
+	if m != nil {
+		return m.Compression
+	}
+	return 0
+}
+
+func (m *NebulaHandshakeDetails) GetHopSchedule() uint32 {
+	if m != nil {
+		return m.HopSchedule
+	}
+	return 0
+}
+
 type NebulaControl struct {
 	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
 	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
@@ -639,7 +832,7 @@ func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
 func (m *NebulaControl) String() string { return proto.CompactTextString(m) }
 func (*NebulaControl) ProtoMessage()    {}
 func (*NebulaControl) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{8}
+	return fileDescriptor_2d65afa7693df5ef, []int{9}
 }
 func (m *NebulaControl) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -720,11 +913,13 @@ func (m *NebulaControl) GetRelayFromAddr() *Addr {
 }
 
 func init() {
+	proto.RegisterEnum("nebula.AddrTag", AddrTag_name, AddrTag_value)
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaControl_MessageType", NebulaControl_MessageType_name, NebulaControl_MessageType_value)
 	proto.RegisterType((*NebulaMeta)(nil), "nebula.NebulaMeta")
 	proto.RegisterType((*NebulaMetaDetails)(nil), "nebula.NebulaMetaDetails")
+	proto.RegisterType((*RelayAdvertisement)(nil), "nebula.RelayAdvertisement")
 	proto.RegisterType((*Addr)(nil), "nebula.Addr")
 	proto.RegisterType((*V4AddrPort)(nil), "nebula.V4AddrPort")
 	proto.RegisterType((*V6AddrPort)(nil), "nebula.V6AddrPort")
@@ -737,57 +932,72 @@ func init() {
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 785 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x55, 0xcd, 0x6e, 0xeb, 0x44,
-	0x14, 0x8e, 0x1d, 0x27, 0x4e, 0x4f, 0x7e, 0xae, 0x39, 0x15, 0xc1, 0x41, 0x22, 0x0a, 0x5e, 0x54,
-	0x57, 0x2c, 0x72, 0x51, 0x5a, 0xae, 0x58, 0x72, 0x1b, 0x84, 0xd2, 0xaa, 0x3f, 0x61, 0x54, 0x8a,
-	0xc4, 0x06, 0xb9, 0xf6, 0xd0, 0x58, 0x71, 0x3c, 0xa9, 0x3d, 0x41, 0xcd, 0x5b, 0xf0, 0x30, 0x3c,
-	0x04, 0xec, 0xba, 0x42, 0x2c, 0x51, 0xbb, 0x64, 0xc9, 0x0b, 0xa0, 0x19, 0xff, 0x27, 0x86, 0xbb,
-	0x9b, 0x73, 0xbe, 0xef, 0x3b, 0x73, 0xe6, 0xf3, 0x9c, 0x31, 0x74, 0x02, 0x7a, 0xb7, 0xf1, 0xed,
-	0xf1, 0x3a, 0x64, 0x9c, 0x61, 0x33, 0x8e, 0xac, 0xbf, 0x55, 0x80, 0x2b, 0xb9, 0xbc, 0xa4, 0xdc,
-	0xc6, 0x09, 0x68, 0x37, 0xdb, 0x35, 0x35, 0x95, 0x91, 0xf2, 0xba, 0x37, 0x19, 0x8e, 0x13, 0x4d,
-	0xce, 0x18, 0x5f, 0xd2, 0x28, 0xb2, 0xef, 0xa9, 0x60, 0x11, 0xc9, 0xc5, 0x63, 0xd0, 0xbf, 0xa6,
-	0xdc, 0xf6, 0xfc, 0xc8, 0x54, 0x47, 0xca, 0xeb, 0xf6, 0x64, 0xb0, 0x2f, 0x4b, 0x08, 0x24, 0x65,
-	0x5a, 0xff, 0x28, 0xd0, 0x2e, 0x94, 0xc2, 0x16, 0x68, 0x57, 0x2c, 0xa0, 0x46, 0x0d, 0xbb, 0x70,
-	0x30, 0x63, 0x11, 0xff, 0x76, 0x43, 0xc3, 0xad, 0xa1, 0x20, 0x42, 0x2f, 0x0b, 0x09, 0x5d, 0xfb,
-	0x5b, 0x43, 0xc5, 0x8f, 0xa1, 0x2f, 0x72, 0xdf, 0xad, 0x5d, 0x9b, 0xd3, 0x2b, 0xc6, 0xbd, 0x9f,
-	0x3c, 0xc7, 0xe6, 0x1e, 0x0b, 0x8c, 0x3a, 0x0e, 0xe0, 0x43, 0x81, 0x5d, 0xb2, 0x9f, 0xa9, 0x5b,
-	0x82, 0xb4, 0x14, 0x9a, 0x6f, 0x02, 0x67, 0x51, 0x82, 0x1a, 0xd8, 0x03, 0x10, 0xd0, 0xf7, 0x0b,
-	0x66, 0xaf, 0x3c, 0xa3, 0x89, 0x87, 0xf0, 0x2a, 0x8f, 0xe3, 0x6d, 0x75, 0xd1, 0xd9, 0xdc, 0xe6,
-	0x8b, 0xe9, 0x82, 0x3a, 0x4b, 0xa3, 0x25, 0x3a, 0xcb, 0xc2, 0x98, 0x72, 0x80, 0x9f, 0xc0, 0xa0,
-	0xba, 0xb3, 0x77, 0xce, 0xd2, 0x00, 0xeb, 0x77, 0x15, 0x3e, 0xd8, 0x33, 0x05, 0x2d, 0x80, 0x6b,
-	0xdf, 0xbd, 0x5d, 0x07, 0xef, 0x5c, 0x37, 0x94, 0xd6, 0x77, 0x4f, 0x55, 0x53, 0x21, 0x85, 0x2c,
-	0x1e, 0x81, 0x9e, 0x12, 0x9a, 0xd2, 0xe4, 0x4e, 0x6a, 0xb2, 0xc8, 0x91, 0x14, 0xc4, 0x31, 0x18,
-	0xd7, 0xbe, 0x4b, 0xa8, 0x6f, 0x6f, 0x93, 0x54, 0x64, 0x36, 0x46, 0xf5, 0xa4, 0xe2, 0x1e, 0x86,
-	0x13, 0xe8, 0x96, 0xc9, 0xfa, 0xa8, 0xbe, 0x57, 0xbd, 0x4c, 0xc1, 0x13, 0x68, 0xdf, 0x9e, 0x88,
-	0xe5, 0x9c, 0x85, 0x5c, 0x7c, 0x74, 0xa1, 0xc0, 0x54, 0x91, 0x43, 0xa4, 0x48, 0x93, 0xaa, 0xb7,
-	0xb9, 0x4a, 0xdb, 0x51, 0xbd, 0x2d, 0xa8, 0x72, 0x1a, 0x9a, 0xa0, 0x3b, 0x6c, 0x13, 0x70, 0x1a,
-	0x9a, 0x75, 0x61, 0x0c, 0x49, 0x43, 0xeb, 0x08, 0x34, 0x79, 0xe2, 0x1e, 0xa8, 0x33, 0x4f, 0xba,
-	0xa6, 0x11, 0x75, 0xe6, 0x89, 0xf8, 0x82, 0xc9, 0x9b, 0xa8, 0x11, 0xf5, 0x82, 0x59, 0x27, 0x00,
-	0x79, 0x1b, 0x88, 0xb1, 0x2a, 0x76, 0x99, 0xc4, 0x15, 0x10, 0x34, 0x81, 0x49, 0x4d, 0x97, 0xc8,
-	0xb5, 0xf5, 0x15, 0x40, 0xde, 0xc6, 0xfb, 0xf6, 0xc8, 0x2a, 0xd4, 0x0b, 0x15, 0x1e, 0xd3, 0xc1,
-	0x9a, 0x7b, 0xc1, 0xfd, 0xff, 0x0f, 0x96, 0x60, 0x54, 0x0c, 0x16, 0x82, 0x76, 0xe3, 0xad, 0x68,
-	0xb2, 0x8f, 0x5c, 0x5b, 0xd6, 0xde, 0xd8, 0x08, 0xb1, 0x51, 0xc3, 0x03, 0x68, 0xc4, 0x97, 0x50,
-	0xb1, 0x7e, 0x84, 0x57, 0x71, 0xdd, 0x99, 0x1d, 0xb8, 0xd1, 0xc2, 0x5e, 0x52, 0xfc, 0x32, 0x9f,
-	0x51, 0x45, 0x5e, 0x9f, 0x9d, 0x0e, 0x32, 0xe6, 0xee, 0xa0, 0x8a, 0x26, 0x66, 0x2b, 0xdb, 0x91,
-	0x4d, 0x74, 0x88, 0x5c, 0x5b, 0x7f, 0x28, 0xd0, 0xaf, 0xd6, 0x09, 0xfa, 0x94, 0x86, 0x5c, 0xee,
-	0xd2, 0x21, 0x72, 0x8d, 0x47, 0xd0, 0x3b, 0x0b, 0x3c, 0xee, 0xd9, 0x9c, 0x85, 0x67, 0x81, 0x4b,
-	0x1f, 0x13, 0xa7, 0x77, 0xb2, 0x82, 0x47, 0x68, 0xb4, 0x66, 0x81, 0x4b, 0x13, 0x5e, 0xec, 0xe7,
-	0x4e, 0x16, 0xfb, 0xd0, 0x9c, 0x32, 0xb6, 0xf4, 0xa8, 0xa9, 0x49, 0x67, 0x92, 0x28, 0xf3, 0xab,
-	0x91, 0xfb, 0x85, 0x23, 0x68, 0x8b, 0x1e, 0x6e, 0x69, 0x18, 0x79, 0x2c, 0x30, 0x5b, 0xb2, 0x60,
-	0x31, 0x75, 0xae, 0xb5, 0x9a, 0x86, 0x7e, 0xae, 0xb5, 0x74, 0xa3, 0x65, 0xfd, 0x5a, 0x87, 0x6e,
-	0x7c, 0xb0, 0x29, 0x0b, 0x78, 0xc8, 0x7c, 0xfc, 0xa2, 0xf4, 0xdd, 0x3e, 0x2d, 0xbb, 0x96, 0x90,
-	0x2a, 0x3e, 0xdd, 0xe7, 0x70, 0x98, 0x1d, 0x4e, 0x0e, 0x4f, 0xf1, 0xdc, 0x55, 0x90, 0x50, 0x64,
-	0xc7, 0x2c, 0x28, 0x62, 0x07, 0xaa, 0x20, 0xfc, 0x0c, 0x7a, 0xe9, 0x38, 0xdf, 0x30, 0x79, 0xa9,
-	0xb5, 0xec, 0xe9, 0xd8, 0x41, 0x8a, 0xcf, 0xc2, 0x37, 0x21, 0x5b, 0x49, 0x76, 0x23, 0x63, 0xef,
-	0x61, 0x38, 0x86, 0x76, 0xb1, 0x70, 0xd5, 0x93, 0x53, 0x24, 0x64, 0xcf, 0x48, 0x56, 0x5c, 0xaf,
-	0x50, 0x94, 0x29, 0xd6, 0xec, 0xbf, 0xfe, 0x00, 0x7d, 0xc0, 0x69, 0x48, 0x6d, 0x4e, 0x25, 0x9f,
-	0xd0, 0x87, 0x0d, 0x8d, 0xb8, 0xa1, 0xe0, 0x47, 0x70, 0x58, 0xca, 0x0b, 0x4b, 0x22, 0x6a, 0xa8,
-	0xa7, 0xc7, 0xbf, 0x3d, 0x0f, 0x95, 0xa7, 0xe7, 0xa1, 0xf2, 0xd7, 0xf3, 0x50, 0xf9, 0xe5, 0x65,
-	0x58, 0x7b, 0x7a, 0x19, 0xd6, 0xfe, 0x7c, 0x19, 0xd6, 0x7e, 0x18, 0xdc, 0x7b, 0x7c, 0xb1, 0xb9,
-	0x1b, 0x3b, 0x6c, 0xf5, 0x26, 0xf2, 0x6d, 0x67, 0xb9, 0x78, 0x78, 0x13, 0xb7, 0x74, 0xd7, 0x94,
-	0x3f, 0xc2, 0xe3, 0x7f, 0x03, 0x00, 0x00, 0xff, 0xff, 0xea, 0x6f, 0xbc, 0x50, 0x18, 0x07, 0x00,
-	0x00,
+	// 1034 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x56, 0xcd, 0x6e, 0xdb, 0x46,
+	0x10, 0x16, 0x25, 0xea, 0x6f, 0x24, 0xcb, 0xec, 0x1a, 0x75, 0x69, 0x03, 0x15, 0x14, 0xa2, 0x30,
+	0x8c, 0x1c, 0x94, 0xc2, 0x4e, 0x83, 0xde, 0x0a, 0x47, 0x45, 0xa1, 0x04, 0xfe, 0x51, 0xd7, 0x8e,
+	0x03, 0xf4, 0x52, 0xac, 0xc8, 0xad, 0xb4, 0x10, 0xc5, 0x65, 0xc8, 0xa5, 0x11, 0x9d, 0xfa, 0x0a,
+	0x7d, 0x8d, 0xde, 0xfb, 0x10, 0x3d, 0xe6, 0xd8, 0x43, 0x0f, 0x85, 0x7d, 0xec, 0xb1, 0x2f, 0x50,
+	0xec, 0xf2, 0x57, 0x12, 0xe3, 0xdc, 0x76, 0x66, 0xbe, 0x99, 0xfd, 0xf8, 0xcd, 0xee, 0x2c, 0xa1,
+	0xeb, 0xd1, 0x69, 0xe4, 0x92, 0xa1, 0x1f, 0x70, 0xc1, 0x51, 0x23, 0xb6, 0xac, 0x7f, 0xab, 0x00,
+	0x97, 0x6a, 0x79, 0x41, 0x05, 0x41, 0x27, 0xa0, 0xdf, 0xac, 0x7c, 0x6a, 0x6a, 0x03, 0xed, 0xb8,
+	0x77, 0xd2, 0x1f, 0x26, 0x39, 0x39, 0x62, 0x78, 0x41, 0xc3, 0x90, 0xcc, 0xa8, 0x44, 0x61, 0x85,
+	0x45, 0xa7, 0xd0, 0xfc, 0x9e, 0x0a, 0xc2, 0xdc, 0xd0, 0xac, 0x0e, 0xb4, 0xe3, 0xce, 0xc9, 0xc1,
+	0x76, 0x5a, 0x02, 0xc0, 0x29, 0xd2, 0xfa, 0x4f, 0x83, 0x4e, 0xa1, 0x14, 0x6a, 0x81, 0x7e, 0xc9,
+	0x3d, 0x6a, 0x54, 0xd0, 0x0e, 0xb4, 0xc7, 0x3c, 0x14, 0x3f, 0x46, 0x34, 0x58, 0x19, 0x1a, 0x42,
+	0xd0, 0xcb, 0x4c, 0x4c, 0x7d, 0x77, 0x65, 0x54, 0xd1, 0x21, 0xec, 0x4b, 0xdf, 0x1b, 0xdf, 0x21,
+	0x82, 0x5e, 0x72, 0xc1, 0x7e, 0x61, 0x36, 0x11, 0x8c, 0x7b, 0x46, 0x0d, 0x1d, 0xc0, 0xe7, 0x32,
+	0x76, 0xc1, 0xef, 0xa8, 0xb3, 0x16, 0xd2, 0xd3, 0xd0, 0x24, 0xf2, 0xec, 0xf9, 0x5a, 0xa8, 0x8e,
+	0x7a, 0x00, 0x32, 0xf4, 0x76, 0xce, 0xc9, 0x92, 0x19, 0x0d, 0xb4, 0x07, 0xbb, 0xb9, 0x1d, 0x6f,
+	0xdb, 0x94, 0xcc, 0x26, 0x44, 0xcc, 0x47, 0x73, 0x6a, 0x2f, 0x8c, 0x96, 0x64, 0x96, 0x99, 0x31,
+	0xa4, 0x8d, 0xbe, 0x84, 0x83, 0x72, 0x66, 0x67, 0xf6, 0xc2, 0x00, 0xeb, 0x77, 0x1d, 0x3e, 0xdb,
+	0x12, 0x05, 0x59, 0x00, 0x57, 0xae, 0x73, 0xeb, 0x7b, 0x67, 0x8e, 0x13, 0x28, 0xe9, 0x77, 0x5e,
+	0x56, 0x4d, 0x0d, 0x17, 0xbc, 0xe8, 0x08, 0x9a, 0x29, 0xa0, 0xa1, 0x44, 0xee, 0xa6, 0x22, 0x4b,
+	0x1f, 0x4e, 0x83, 0x68, 0x08, 0xc6, 0x95, 0xeb, 0x60, 0xea, 0x92, 0x55, 0xe2, 0x0a, 0xcd, 0xfa,
+	0xa0, 0x96, 0x54, 0xdc, 0x8a, 0xa1, 0x13, 0xd8, 0x59, 0x07, 0x37, 0x07, 0xb5, 0xad, 0xea, 0xeb,
+	0x10, 0xf4, 0x1c, 0x3a, 0xb7, 0xcf, 0xe5, 0x72, 0xc2, 0x03, 0x21, 0x9b, 0x2e, 0x33, 0x50, 0x9a,
+	0x91, 0x87, 0x70, 0x11, 0xa6, 0xb2, 0x5e, 0xe4, 0x59, 0xfa, 0x46, 0xd6, 0x8b, 0x42, 0x56, 0x0e,
+	0x43, 0x26, 0x34, 0x6d, 0x1e, 0x79, 0x82, 0x06, 0x66, 0x4d, 0x0a, 0x83, 0x53, 0x13, 0x9d, 0xc3,
+	0x9e, 0xa2, 0x75, 0xe6, 0xdc, 0xd1, 0x40, 0xb0, 0x90, 0x2e, 0xa9, 0x27, 0x42, 0xb3, 0xa5, 0xea,
+	0x1e, 0xa6, 0x75, 0xb7, 0x21, 0xb8, 0x2c, 0x0d, 0xf5, 0x01, 0xde, 0x12, 0x4f, 0xa8, 0x50, 0x68,
+	0xb6, 0x07, 0xda, 0x71, 0x0b, 0x17, 0x3c, 0x52, 0xa7, 0xeb, 0x68, 0x1a, 0xda, 0x01, 0xf3, 0x65,
+	0x3b, 0x43, 0x13, 0xca, 0x74, 0x5a, 0x83, 0xa0, 0xaf, 0xa4, 0xb6, 0x3e, 0x0f, 0x04, 0x75, 0xce,
+	0x66, 0xf4, 0x22, 0x34, 0x3b, 0xea, 0x0b, 0xd6, 0x9d, 0x68, 0x1f, 0x1a, 0xe7, 0x64, 0x4a, 0xdd,
+	0xd0, 0xec, 0x0e, 0x6a, 0xc7, 0x6d, 0x9c, 0x58, 0xd6, 0x04, 0xd0, 0x36, 0xd1, 0xe2, 0x39, 0xd0,
+	0x1e, 0x3b, 0x07, 0x08, 0xf4, 0x1b, 0x32, 0x8b, 0x9b, 0xd3, 0xc6, 0x6a, 0x6d, 0x1d, 0x81, 0xae,
+	0x62, 0x3d, 0xa8, 0x8e, 0x99, 0x4a, 0xd7, 0x71, 0x75, 0xcc, 0xa4, 0x7d, 0xce, 0xd5, 0xdd, 0xd5,
+	0x71, 0xf5, 0x9c, 0x5b, 0x21, 0x40, 0xde, 0x38, 0x59, 0x29, 0x3f, 0x97, 0x58, 0x4f, 0xab, 0xcb,
+	0x98, 0xca, 0xd9, 0xc1, 0x6a, 0x8d, 0x0e, 0xa1, 0x35, 0x09, 0x18, 0x0f, 0x98, 0x58, 0x25, 0xad,
+	0xca, 0x6c, 0xf4, 0x04, 0x6a, 0x37, 0x64, 0x66, 0xea, 0x6a, 0xaa, 0xec, 0x16, 0x19, 0xdf, 0x90,
+	0x19, 0x96, 0x31, 0xeb, 0x57, 0x80, 0xbc, 0xef, 0x9f, 0xa2, 0x98, 0x11, 0xa8, 0x7d, 0x84, 0x80,
+	0x5e, 0x4e, 0xa0, 0xfe, 0x08, 0x81, 0xf7, 0xe9, 0x20, 0x9c, 0x30, 0x6f, 0xf6, 0xf8, 0x20, 0x94,
+	0x88, 0x92, 0x41, 0x28, 0x35, 0x67, 0x4b, 0x9a, 0xd0, 0x54, 0x6b, 0xcb, 0xda, 0x1a, 0x73, 0x32,
+	0xd9, 0xa8, 0xa0, 0x36, 0xd4, 0xe3, 0xa1, 0xa1, 0x59, 0x3f, 0xc3, 0x6e, 0x5c, 0x77, 0x4c, 0x3c,
+	0x27, 0x9c, 0x93, 0x05, 0x45, 0xdf, 0xe6, 0x33, 0x35, 0x6e, 0xf3, 0x06, 0x83, 0x0c, 0xb9, 0x39,
+	0x58, 0x25, 0x89, 0xf1, 0x92, 0xd8, 0x8a, 0x44, 0x17, 0xab, 0xb5, 0xf5, 0x77, 0x15, 0xf6, 0xcb,
+	0xf3, 0x24, 0x7c, 0x44, 0x03, 0xa1, 0x76, 0xe9, 0x62, 0xb5, 0x46, 0x47, 0xd0, 0x7b, 0xe5, 0x31,
+	0xc1, 0x88, 0xe0, 0xc1, 0x2b, 0xcf, 0xa1, 0xef, 0x93, 0x3e, 0x6f, 0x78, 0x25, 0x0e, 0xd3, 0xd0,
+	0xe7, 0x9e, 0x43, 0x13, 0x5c, 0xdc, 0x8e, 0x0d, 0xaf, 0x3c, 0xe1, 0x23, 0xce, 0x17, 0x8c, 0xaa,
+	0xb6, 0xe8, 0x38, 0xb1, 0x32, 0xbd, 0xea, 0xb9, 0x5e, 0x68, 0x00, 0x1d, 0xc9, 0xe1, 0x96, 0x06,
+	0x21, 0xe3, 0x9e, 0xd9, 0x52, 0x05, 0x8b, 0x2e, 0x79, 0x53, 0x2f, 0x23, 0xd7, 0x1d, 0x31, 0x7f,
+	0x4e, 0x83, 0xf4, 0xa6, 0xe6, 0x1e, 0x59, 0xe1, 0x9a, 0x47, 0x81, 0x4d, 0xe3, 0x39, 0x03, 0x71,
+	0x85, 0x82, 0x4b, 0xed, 0xc1, 0x97, 0x7e, 0x40, 0x43, 0xb5, 0x47, 0x27, 0xd9, 0x23, 0x77, 0x49,
+	0xc4, 0x98, 0xfb, 0xd7, 0xf6, 0x9c, 0x3a, 0x91, 0x4b, 0xcd, 0x6e, 0x8c, 0x28, 0xb8, 0x5e, 0xeb,
+	0xad, 0x86, 0xd1, 0x7c, 0xad, 0xb7, 0x9a, 0x46, 0xcb, 0xfa, 0xa3, 0x06, 0x3b, 0xb1, 0xbc, 0x23,
+	0xee, 0x89, 0x80, 0xbb, 0xe8, 0x9b, 0xb5, 0xd3, 0xf3, 0x64, 0xbd, 0x77, 0x09, 0xa8, 0xe4, 0x00,
+	0x7d, 0x0d, 0x7b, 0x99, 0xc4, 0xea, 0xee, 0x17, 0xd5, 0x2f, 0x0b, 0xc9, 0x8c, 0x4c, 0xec, 0x42,
+	0x46, 0xdc, 0x87, 0xb2, 0x10, 0x7a, 0x0a, 0xbd, 0xf4, 0x11, 0xb8, 0xe1, 0xea, 0x62, 0xeb, 0xd9,
+	0x83, 0xb3, 0x11, 0x29, 0x3e, 0x26, 0x3f, 0x04, 0x7c, 0xa9, 0xd0, 0xf5, 0x0c, 0xbd, 0x15, 0x43,
+	0x43, 0xe8, 0x14, 0x0b, 0x97, 0x3d, 0x54, 0x45, 0x40, 0xf6, 0xf8, 0x64, 0xc5, 0x9b, 0x25, 0x19,
+	0xeb, 0x10, 0x6b, 0xfc, 0xb1, 0xff, 0x86, 0x7d, 0x40, 0xa3, 0x80, 0x12, 0x41, 0x15, 0x1e, 0xd3,
+	0x77, 0x11, 0x0d, 0x85, 0xa1, 0xa1, 0x2f, 0x60, 0x6f, 0xcd, 0x2f, 0x25, 0x09, 0xa9, 0x51, 0x7d,
+	0xfa, 0x1d, 0x34, 0x93, 0x01, 0x80, 0xba, 0xd0, 0x7a, 0xe3, 0x09, 0x32, 0x9b, 0x51, 0xc7, 0xa8,
+	0x20, 0x80, 0xc6, 0x24, 0x9a, 0xba, 0xcc, 0x36, 0x34, 0xd4, 0x81, 0xe6, 0x24, 0x60, 0x77, 0x44,
+	0x50, 0xa3, 0x2a, 0x7f, 0x00, 0x54, 0x91, 0x2b, 0xcf, 0x5d, 0x19, 0xb5, 0x97, 0xa7, 0x7f, 0xde,
+	0xf7, 0xb5, 0x0f, 0xf7, 0x7d, 0xed, 0x9f, 0xfb, 0xbe, 0xf6, 0xdb, 0x43, 0xbf, 0xf2, 0xe1, 0xa1,
+	0x5f, 0xf9, 0xeb, 0xa1, 0x5f, 0xf9, 0xe9, 0x60, 0xc6, 0xc4, 0x3c, 0x9a, 0x0e, 0x6d, 0xbe, 0x7c,
+	0x16, 0xba, 0xc4, 0x5e, 0xcc, 0xdf, 0x3d, 0x8b, 0xbf, 0x69, 0xda, 0x50, 0xff, 0x5f, 0xa7, 0xff,
+	0x0f, 0x00, 0xcf, 0x37, 0x0f, 0x9b, 0x8f, 0x09, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -850,6 +1060,58 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Labels) > 0 {
+		for iNdEx := len(m.Labels) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Labels[iNdEx])
+			copy(dAtA[i:], m.Labels[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Labels[iNdEx])))
+			i--
+			dAtA[i] = 0x62
+		}
+	}
+	if m.ReportedAgeMs != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.ReportedAgeMs))
+		i--
+		dAtA[i] = 0x58
+	}
+	if len(m.Subscriptions) > 0 {
+		for iNdEx := len(m.Subscriptions) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Subscriptions[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x52
+		}
+	}
+	if m.WantRelays {
+		i--
+		if m.WantRelays {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x48
+	}
+	if len(m.RelayAdvertisements) > 0 {
+		for iNdEx := len(m.RelayAdvertisements) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayAdvertisements[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x42
+		}
+	}
 	if len(m.RelayVpnAddrs) > 0 {
 		for iNdEx := len(m.RelayVpnAddrs) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -935,6 +1197,50 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *RelayAdvertisement) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *RelayAdvertisement) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *RelayAdvertisement) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Tags) > 0 {
+		for iNdEx := len(m.Tags) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Tags[iNdEx])
+			copy(dAtA[i:], m.Tags[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Tags[iNdEx])))
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if m.VpnAddr != nil {
+		{
+			size, err := m.VpnAddr.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *Addr) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -988,6 +1294,16 @@ func (m *V4AddrPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Tag != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Tag))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.Priority != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Priority))
+		i--
+		dAtA[i] = 0x18
+	}
 	if m.Port != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
 		i--
@@ -1021,6 +1337,16 @@ func (m *V6AddrPort) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Tag != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Tag))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.Priority != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Priority))
+		i--
+		dAtA[i] = 0x20
+	}
 	if m.Port != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Port))
 		i--
@@ -1134,6 +1460,31 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if m.HopSchedule != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.HopSchedule))
+		i--
+		dAtA[i] = 0x60
+	}
+	if m.Compression != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Compression))
+		i--
+		dAtA[i] = 0x58
+	}
+	if m.SourcePorts != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.SourcePorts))
+		i--
+		dAtA[i] = 0x50
+	}
+	if m.NullCipher {
+		i--
+		if m.NullCipher {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x48
+	}
 	if m.CertVersion != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.CertVersion))
 		i--
@@ -1309,6 +1660,49 @@ func (m *NebulaMetaDetails) Size() (n int) {
 			n += 1 + l + sovNebula(uint64(l))
 		}
 	}
+	if len(m.RelayAdvertisements) > 0 {
+		for _, e := range m.RelayAdvertisements {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if m.WantRelays {
+		n += 2
+	}
+	if len(m.Subscriptions) > 0 {
+		for _, e := range m.Subscriptions {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if m.ReportedAgeMs != 0 {
+		n += 1 + sovNebula(uint64(m.ReportedAgeMs))
+	}
+	if len(m.Labels) > 0 {
+		for _, s := range m.Labels {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *RelayAdvertisement) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.VpnAddr != nil {
+		l = m.VpnAddr.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Tags) > 0 {
+		for _, s := range m.Tags {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1339,6 +1733,12 @@ func (m *V4AddrPort) Size() (n int) {
 	if m.Port != 0 {
 		n += 1 + sovNebula(uint64(m.Port))
 	}
+	if m.Priority != 0 {
+		n += 1 + sovNebula(uint64(m.Priority))
+	}
+	if m.Tag != 0 {
+		n += 1 + sovNebula(uint64(m.Tag))
+	}
 	return n
 }
 
@@ -1357,6 +1757,12 @@ func (m *V6AddrPort) Size() (n int) {
 	if m.Port != 0 {
 		n += 1 + sovNebula(uint64(m.Port))
 	}
+	if m.Priority != 0 {
+		n += 1 + sovNebula(uint64(m.Priority))
+	}
+	if m.Tag != 0 {
+		n += 1 + sovNebula(uint64(m.Tag))
+	}
 	return n
 }
 
@@ -1417,6 +1823,18 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.CertVersion != 0 {
 		n += 1 + sovNebula(uint64(m.CertVersion))
 	}
+	if m.NullCipher {
+		n += 2
+	}
+	if m.SourcePorts != 0 {
+		n += 1 + sovNebula(uint64(m.SourcePorts))
+	}
+	if m.Compression != 0 {
+		n += 1 + sovNebula(uint64(m.Compression))
+	}
+	if m.HopSchedule != 0 {
+		n += 1 + sovNebula(uint64(m.HopSchedule))
+	}
 	return n
 }
 
@@ -1844,17 +2262,274 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayAdvertisements", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayAdvertisements = append(m.RelayAdvertisements, &RelayAdvertisement{})
+			if err := m.RelayAdvertisements[len(m.RelayAdvertisements)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WantRelays", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.WantRelays = bool(v != 0)
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Subscriptions", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Subscriptions = append(m.Subscriptions, &Addr{})
+			if err := m.Subscriptions[len(m.Subscriptions)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReportedAgeMs", wireType)
+			}
+			m.ReportedAgeMs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ReportedAgeMs |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Labels", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Labels = append(m.Labels, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *RelayAdvertisement) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: RelayAdvertisement: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: RelayAdvertisement: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field VpnAddr", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.VpnAddr == nil {
+				m.VpnAddr = &Addr{}
+			}
+			if err := m.VpnAddr.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tags", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Tags = append(m.Tags, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
 			}
 			iNdEx += skippy
 		}
@@ -2020,6 +2695,44 @@ func (m *V4AddrPort) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
+			}
+			m.Priority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Priority |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tag", wireType)
+			}
+			m.Tag = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Tag |= AddrTag(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2127,6 +2840,44 @@ func (m *V6AddrPort) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Priority", wireType)
+			}
+			m.Priority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Priority |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tag", wireType)
+			}
+			m.Tag = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Tag |= AddrTag(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -2514,6 +3265,83 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NullCipher", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.NullCipher = bool(v != 0)
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SourcePorts", wireType)
+			}
+			m.SourcePorts = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.SourcePorts |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			m.Compression = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Compression |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HopSchedule", wireType)
+			}
+			m.HopSchedule = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.HopSchedule |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -0,0 +1,74 @@
+// Package netmon watches the host for network changes that can strand tunnels, like roaming between wifi, ethernet,
+// and cellular.
+package netmon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrNotSupported = errors.New("network change monitoring is not supported on this platform")
+
+// DefaultSettle is how long to wait for a burst of changes to finish before reporting them
+const DefaultSettle = time.Second
+
+// change is a single notification from the platform
+type change struct {
+	// ifIndex is the interface the change happened on, 0 if unknown
+	ifIndex int
+	reason  string
+}
+
+// Watch calls onChange once a burst of network changes has settled. Changes to the interface named ignore, typically
+// our own tun device, are not reported. Watch returns once the platform watcher is running, it stops when ctx is done.
+func Watch(ctx context.Context, l *logrus.Logger, ignore string, settle time.Duration, onChange func(reason string)) error {
+	changes := make(chan change, 64)
+	if err := watch(ctx, l, changes); err != nil {
+		return err
+	}
+
+	go debounce(ctx, changes, ignore, settle, onChange)
+	return nil
+}
+
+// notify queues a change without blocking the platform watcher, a full queue already guarantees a report
+func notify(changes chan<- change, c change) {
+	select {
+	case changes <- c:
+	default:
+	}
+}
+
+func debounce(ctx context.Context, changes <-chan change, ignore string, settle time.Duration, onChange func(reason string)) {
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	defer timer.Stop()
+
+	reason := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case c := <-changes:
+			if ignore != "" && c.ifIndex > 0 {
+				if iface, err := net.InterfaceByIndex(c.ifIndex); err == nil && iface.Name == ignore {
+					continue
+				}
+			}
+
+			if reason == "" {
+				reason = c.reason
+			}
+			timer.Reset(settle)
+
+		case <-timer.C:
+			onChange(reason)
+			reason = ""
+		}
+	}
+}
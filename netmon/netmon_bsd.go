@@ -0,0 +1,97 @@
+//go:build (darwin && !ios) || freebsd || netbsd || openbsd
+
+package netmon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+func watch(ctx context.Context, l *logrus.Logger, changes chan<- change) error {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("failed to open routing socket: %w", err)
+	}
+
+	// Wake up periodically so a canceled context is noticed, closing the socket does not interrupt a blocked read
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to set routing socket timeout: %w", err)
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		// Interface messages repeat for many flag changes, only a link going up or down is worth a report
+		links := map[int]bool{}
+
+		b := make([]byte, 8192)
+		for ctx.Err() == nil {
+			n, err := unix.Read(fd, b)
+			if err != nil {
+				if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+					continue
+				}
+				l.WithError(err).Error("Failed to read from routing socket, network changes will not be monitored")
+				return
+			}
+
+			msgs, err := route.ParseRIB(route.RIBTypeRoute, b[:n])
+			if err != nil {
+				l.WithError(err).Debug("Failed to parse routing message")
+				continue
+			}
+
+			for _, m := range msgs {
+				switch m := m.(type) {
+				case *route.InterfaceMessage:
+					up := m.Flags&unix.IFF_UP != 0 && m.Flags&unix.IFF_RUNNING != 0
+					if was, ok := links[m.Index]; ok && was != up {
+						reason := "link down"
+						if up {
+							reason = "link up"
+						}
+						notify(changes, change{ifIndex: m.Index, reason: reason})
+					}
+					links[m.Index] = up
+
+				case *route.InterfaceAddrMessage:
+					switch m.Type {
+					case unix.RTM_NEWADDR:
+						notify(changes, change{ifIndex: m.Index, reason: "address added"})
+					case unix.RTM_DELADDR:
+						notify(changes, change{ifIndex: m.Index, reason: "address removed"})
+					}
+
+				case *route.RouteMessage:
+					// Only default routes say anything about which network we are on, other routes churn for many reasons
+					if isDefaultRoute(m) {
+						notify(changes, change{ifIndex: m.Index, reason: "default route changed"})
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func isDefaultRoute(m *route.RouteMessage) bool {
+	if len(m.Addrs) <= unix.RTAX_DST {
+		return false
+	}
+
+	switch a := m.Addrs[unix.RTAX_DST].(type) {
+	case *route.Inet4Addr:
+		return a.IP == [4]byte{}
+	case *route.Inet6Addr:
+		return a.IP == [16]byte{}
+	}
+	return false
+}
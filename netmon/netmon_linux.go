@@ -0,0 +1,80 @@
+//go:build !android
+
+package netmon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func watch(ctx context.Context, l *logrus.Logger, changes chan<- change) error {
+	done := make(chan struct{})
+	errCb := func(err error) { l.WithError(err).Error("netlink error while monitoring network changes") }
+
+	addrs := make(chan netlink.AddrUpdate)
+	err := netlink.AddrSubscribeWithOptions(addrs, done, netlink.AddrSubscribeOptions{ErrorCallback: errCb})
+	if err != nil {
+		close(done)
+		return fmt.Errorf("failed to subscribe to address changes: %w", err)
+	}
+
+	routes := make(chan netlink.RouteUpdate)
+	err = netlink.RouteSubscribeWithOptions(routes, done, netlink.RouteSubscribeOptions{ErrorCallback: errCb})
+	if err != nil {
+		close(done)
+		return fmt.Errorf("failed to subscribe to route changes: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		close(done)
+	}()
+
+	go func() {
+		for {
+			select {
+			case a, ok := <-addrs:
+				if !ok {
+					return
+				}
+
+				ip := a.LinkAddress.IP
+				if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+					continue
+				}
+
+				if a.NewAddr {
+					notify(changes, change{ifIndex: a.LinkIndex, reason: "address added"})
+				} else {
+					notify(changes, change{ifIndex: a.LinkIndex, reason: "address removed"})
+				}
+
+			case r, ok := <-routes:
+				if !ok {
+					return
+				}
+
+				// Only default routes say anything about which network we are on, other routes churn for many reasons
+				if r.Table != unix.RT_TABLE_MAIN || !isDefaultRoute(r.Route) {
+					continue
+				}
+
+				notify(changes, change{ifIndex: r.LinkIndex, reason: "default route changed"})
+			}
+		}
+	}()
+
+	return nil
+}
+
+func isDefaultRoute(r netlink.Route) bool {
+	if r.Dst == nil {
+		return true
+	}
+	ones, _ := r.Dst.Mask.Size()
+	return ones == 0
+}
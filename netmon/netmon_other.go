@@ -0,0 +1,14 @@
+//go:build android || ios || !(linux || darwin || freebsd || netbsd || openbsd || windows)
+
+package netmon
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watch is not available here, mobile platforms must forward their own network change notifications
+func watch(_ context.Context, _ *logrus.Logger, _ chan<- change) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,54 @@
+package netmon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan change)
+	reports := make(chan string, 10)
+	go debounce(ctx, changes, "", 50*time.Millisecond, func(reason string) {
+		reports <- reason
+	})
+
+	// A burst is reported once, with the first reason
+	changes <- change{reason: "address removed"}
+	changes <- change{reason: "default route changed"}
+	changes <- change{reason: "address added"}
+
+	select {
+	case r := <-reports:
+		assert.Equal(t, "address removed", r)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a report")
+	}
+
+	select {
+	case r := <-reports:
+		t.Fatalf("unexpected second report: %s", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	changes <- change{reason: "address added"}
+	select {
+	case r := <-reports:
+		assert.Equal(t, "address added", r)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a report")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	changes := make(chan change, 1)
+	notify(changes, change{reason: "a"})
+	// A full queue does not block
+	notify(changes, change{reason: "b"})
+	assert.Equal(t, "a", (<-changes).reason)
+}
@@ -0,0 +1,53 @@
+package netmon
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+)
+
+func watch(ctx context.Context, l *logrus.Logger, changes chan<- change) error {
+	addrCb, err := winipcfg.RegisterUnicastAddressChangeCallback(func(t winipcfg.MibNotificationType, row *winipcfg.MibUnicastIPAddressRow) {
+		addr := row.Address.Addr()
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			return
+		}
+
+		switch t {
+		case winipcfg.MibAddInstance:
+			notify(changes, change{ifIndex: int(row.InterfaceIndex), reason: "address added"})
+		case winipcfg.MibDeleteInstance:
+			notify(changes, change{ifIndex: int(row.InterfaceIndex), reason: "address removed"})
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to address changes: %w", err)
+	}
+
+	routeCb, err := winipcfg.RegisterRouteChangeCallback(func(t winipcfg.MibNotificationType, row *winipcfg.MibIPforwardRow2) {
+		// Only default routes say anything about which network we are on, other routes churn for many reasons
+		if t == winipcfg.MibInitialNotification || row.DestinationPrefix.Prefix().Bits() != 0 {
+			return
+		}
+
+		notify(changes, change{ifIndex: int(row.InterfaceIndex), reason: "default route changed"})
+	})
+	if err != nil {
+		_ = addrCb.Unregister()
+		return fmt.Errorf("failed to subscribe to route changes: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := addrCb.Unregister(); err != nil {
+			l.WithError(err).Error("Failed to unregister address change callback")
+		}
+		if err := routeCb.Unregister(); err != nil {
+			l.WithError(err).Error("Failed to unregister route change callback")
+		}
+	}()
+
+	return nil
+}
@@ -16,6 +16,8 @@ var noiseEndianness endianness = binary.BigEndian
 
 type NebulaCipherState struct {
 	c noise.Cipher
+	// authOnly is set for tunnels that negotiated the null cipher, payloads are sent in the clear and only authenticated
+	authOnly bool
 	//k [32]byte
 	//n uint64
 }
@@ -46,6 +48,12 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[2] = 0
 		nb[3] = 0
 		noiseEndianness.PutUint64(nb[4:], n)
+		if s.authOnly {
+			// Like relayed packets the payload is appended as is and signed along with the header
+			start := len(out)
+			out = append(out, plaintext...)
+			return s.c.(cipher.AEAD).Seal(out, nb, nil, joined(ad, out[start:])), nil
+		}
 		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
@@ -61,6 +69,17 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[2] = 0
 		nb[3] = 0
 		noiseEndianness.PutUint64(nb[4:], n)
+		if s.authOnly {
+			aead := s.c.(cipher.AEAD)
+			if len(ciphertext) < aead.Overhead() {
+				return nil, errors.New("message too short to be authenticated")
+			}
+			payload := ciphertext[:len(ciphertext)-aead.Overhead()]
+			if _, err := aead.Open(nil, nb, ciphertext[len(payload):], joined(ad, payload)); err != nil {
+				return nil, err
+			}
+			return append(out, payload...), nil
+		}
 		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
 	} else {
 		return []byte{}, nil
@@ -73,3 +92,19 @@ func (s *NebulaCipherState) Overhead() int {
 	}
 	return 0
 }
+
+// joined returns a followed by b. Packets keep the payload right after the header so there is usually nothing to copy.
+func joined(a, b []byte) []byte {
+	if len(a) == 0 {
+		return b
+	} else if len(b) == 0 {
+		return a
+	}
+
+	if cap(a) >= len(a)+len(b) && &a[:len(a)+1][len(a)] == &b[0] {
+		return a[:len(a)+len(b)]
+	}
+
+	j := make([]byte, 0, len(a)+len(b))
+	return append(append(j, a...), b...)
+}
@@ -0,0 +1,73 @@
+package noiseutil
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Acceleration names the CPU features Go uses to speed up cipher, one of the values the cipher config accepts, on this
+// host. It returns an empty string when the portable implementation is used.
+func Acceleration(cipher string) string {
+	switch cipher {
+	case "aes":
+		return aesAcceleration()
+	case "chachapoly":
+		return chachaPolyAcceleration()
+	}
+	return ""
+}
+
+// aesAcceleration mirrors what crypto/aes and crypto/cipher check before picking their assembly AES-GCM
+func aesAcceleration() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		if cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ && cpu.X86.HasSSE41 && cpu.X86.HasSSSE3 {
+			return "aes-ni+clmul"
+		}
+	case "arm64":
+		// Apple does not let us read the feature registers but every arm64 machine it ships has both
+		if cpu.ARM64.HasAES && cpu.ARM64.HasPMULL || runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+			return "armv8-aes+pmull"
+		}
+	case "s390x":
+		if cpu.S390X.HasAES && cpu.S390X.HasAESGCM {
+			return "cpacf-kma"
+		}
+	case "ppc64", "ppc64le":
+		if cpu.PPC64.IsPOWER8 {
+			return "power8-vcipher"
+		}
+	}
+	return ""
+}
+
+// chachaPolyAcceleration mirrors golang.org/x/crypto/chacha20poly1305, it only has vector code for some platforms
+func chachaPolyAcceleration() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		if cpu.X86.HasAVX2 && cpu.X86.HasBMI2 {
+			return "avx2"
+		} else if cpu.X86.HasSSSE3 {
+			return "ssse3"
+		}
+	case "arm64":
+		return "neon"
+	case "s390x":
+		if cpu.S390X.HasVX {
+			return "vx"
+		}
+	case "ppc64le":
+		return "vsx"
+	}
+	return ""
+}
+
+// FastestCipher returns aes when this host has AES-GCM acceleration and chachapoly otherwise, which is faster in
+// software
+func FastestCipher() string {
+	if aesAcceleration() != "" {
+		return "aes"
+	}
+	return "chachapoly"
+}
@@ -0,0 +1,43 @@
+package noiseutil
+
+import (
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceleration(t *testing.T) {
+	assert.Empty(t, Acceleration("rot13"))
+
+	if Acceleration("aes") != "" {
+		assert.Equal(t, "aes", FastestCipher())
+	} else {
+		assert.Equal(t, "chachapoly", FastestCipher())
+	}
+}
+
+// BenchmarkCiphers compares the ciphers nebula can use on this host, run it before choosing one for a network
+func BenchmarkCiphers(b *testing.B) {
+	for _, tc := range []struct {
+		name   string
+		cipher noise.CipherFunc
+	}{
+		{"aes", CipherAESGCM},
+		{"chachapoly", noise.CipherChaChaPoly},
+	} {
+		b.Run(tc.name+"/"+Acceleration(tc.name), func(b *testing.B) {
+			c := tc.cipher.Cipher([32]byte{1, 2, 3})
+			ad := make([]byte, 16)
+			plaintext := make([]byte, 1300)
+			out := make([]byte, 0, len(plaintext)+16)
+			b.SetBytes(int64(len(plaintext)))
+
+			n := uint64(0)
+			for b.Loop() {
+				n++
+				out = c.Encrypt(out[:0], n, ad, plaintext)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package noiseutil
+
+import (
+	"crypto/ecdh"
+	"fmt"
+
+	"github.com/slackhq/nebula/keyprovider"
+
+	"github.com/flynn/noise"
+)
+
+// DHP256Device is the NIST P-256 ECDH function for a static key that may be held by a keyprovider.DeviceProvider
+var DHP256Device noise.DHFunc = deviceDH{DHFunc: DHP256, validate: func(pubkey []byte) error {
+	_, err := ecdh.P256().NewPublicKey(pubkey)
+	return err
+}}
+
+// DH25519Device is the Curve25519 ECDH function for a static key that may be held by a keyprovider.DeviceProvider
+var DH25519Device noise.DHFunc = deviceDH{DHFunc: noise.DH25519, validate: func(pubkey []byte) error {
+	_, err := ecdh.X25519().NewPublicKey(pubkey)
+	return err
+}}
+
+type deviceDH struct {
+	noise.DHFunc
+	validate func(pubkey []byte) error
+}
+
+func (d deviceDH) DH(privkey, pubkey []byte) ([]byte, error) {
+	//for the static key "privkey" is actually a key provider uri
+	//to set up a handshake, we need to also do non-device DH with ephemeral keys. Handle that here.
+	if !keyprovider.InDevice(privkey) {
+		return d.DHFunc.DH(privkey, pubkey)
+	}
+
+	if err := d.validate(pubkey); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal pubkey: %w", err)
+	}
+
+	return keyprovider.DH(string(privkey), pubkey)
+}
@@ -0,0 +1,61 @@
+package noiseutil
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/keyprovider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testDevice struct {
+	dh  noise.DHFunc
+	key []byte
+}
+
+func (d testDevice) Load(uri string) (keyprovider.Key, error) {
+	return keyprovider.Key{Private: []byte(uri), Curve: cert.Curve_P256, InDevice: true}, nil
+}
+
+func (d testDevice) DH(_ string, peerPublicKey []byte) ([]byte, error) {
+	return d.dh.DH(d.key, peerPublicKey)
+}
+
+func TestDeviceDH(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		dh     noise.DHFunc
+		device noise.DHFunc
+	}{
+		{"P256", DHP256, DHP256Device},
+		{"25519", noise.DH25519, DH25519Device},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			static, err := tc.dh.GenerateKeypair(rand.Reader)
+			require.NoError(t, err)
+			keyprovider.Register("testdevice"+tc.name, testDevice{dh: tc.dh, key: static.Private})
+			uri := []byte("testdevice" + tc.name + ":key")
+
+			peer, err := tc.dh.GenerateKeypair(rand.Reader)
+			require.NoError(t, err)
+			want, err := tc.dh.DH(peer.Private, static.Public)
+			require.NoError(t, err)
+
+			// The static key is used through the device
+			got, err := tc.device.DH(uri, peer.Public)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			// Ephemeral keys are raw and used directly
+			got, err = tc.device.DH(static.Private, peer.Public)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			_, err = tc.device.DH(uri, []byte{1, 2, 3})
+			require.ErrorContains(t, err, "unable to unmarshal pubkey")
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package nebula
+
+import (
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// The null cipher is for hosts that already talk over an encrypted underlay, such as two nodes on the same datacenter
+// fabric, and would rather not pay for encrypting twice. Packets on a null cipher tunnel are still authenticated with
+// the tunnel key, so they can not be forged or replayed and the firewall still sees the peer's certificate, but anyone
+// on the path can read them.
+//
+// It is only used when both hosts list a group the other's certificate has in null_cipher.groups. The initiator offers
+// it and the responder accepts it inside the handshake, noise authenticates both so the path can not add or strip it.
+// Responders only accept it for direct handshakes, but a tunnel that later falls back to a relay stays unencrypted.
+
+// reloadNullCipher picks up null_cipher.groups, it only applies to tunnels handshaked after the change
+func (f *Interface) reloadNullCipher(c *config.C) {
+	initial := c.InitialLoad()
+	if !initial && !c.HasChanged("null_cipher") {
+		return
+	}
+
+	groups := c.GetStringSlice("null_cipher.groups", []string{})
+	f.nullCipherGroups.Store(&groups)
+
+	if len(groups) > 0 {
+		f.l.WithField("groups", groups).
+			Warn("null_cipher is enabled, tunnels with hosts in these groups will NOT be encrypted")
+	} else if !initial {
+		f.l.Info("null_cipher is disabled, new tunnels will be encrypted")
+	}
+}
+
+// offerNullCipher is whether we ask for the null cipher when initiating, we do not know who answers until they do
+func (f *Interface) offerNullCipher() bool {
+	if f.securityRequirements.Load().forbidsCipher("null") {
+		return false
+	}
+
+	groups := f.nullCipherGroups.Load()
+	return groups != nil && len(*groups) > 0
+}
+
+// allowsNullCipher reports whether peer is in any of our null_cipher.groups and security.min_requirements allows it
+func (f *Interface) allowsNullCipher(peer *cert.CachedCertificate) bool {
+	groups := f.nullCipherGroups.Load()
+	if groups == nil || peer == nil || f.securityRequirements.Load().forbidsCipher("null") {
+		return false
+	}
+
+	for _, g := range *groups {
+		if _, ok := peer.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
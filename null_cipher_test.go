@@ -0,0 +1,109 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNebulaCipherState_nullCipher(t *testing.T) {
+	for _, suite := range []noise.CipherSuite{
+		noise.NewCipherSuite(noise.DH25519, noiseutil.CipherAESGCM, noise.HashSHA256),
+		noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256),
+	} {
+		t.Run(string(suite.Name()), func(t *testing.T) {
+			key := NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{1, 2, 3}, 0))
+			key.authOnly = true
+			nb := make([]byte, 12)
+			payload := []byte("hello from the fabric")
+
+			out := header.Encode(make([]byte, header.Len, mtu), header.Version, header.Message, header.MessageNone, 1, 2)
+			packet, err := key.EncryptDanger(out, out, payload, 2, nb)
+			require.NoError(t, err)
+			assert.Len(t, packet, header.Len+len(payload)+key.Overhead())
+			assert.Equal(t, payload, packet[header.Len:header.Len+len(payload)])
+
+			plain, err := key.DecryptDanger(nil, packet[:header.Len], packet[header.Len:], 2, nb)
+			require.NoError(t, err)
+			assert.Equal(t, payload, plain)
+
+			// The header and payload do not have to be next to each other
+			plain, err = key.DecryptDanger(nil, bytes.Clone(packet[:header.Len]), bytes.Clone(packet[header.Len:]), 2, nb)
+			require.NoError(t, err)
+			assert.Equal(t, payload, plain)
+
+			// Everything is authenticated
+			_, err = key.DecryptDanger(nil, packet[:header.Len], packet[header.Len:], 3, nb)
+			require.Error(t, err)
+
+			tampered := bytes.Clone(packet)
+			tampered[header.Len] ^= 1
+			_, err = key.DecryptDanger(nil, tampered[:header.Len], tampered[header.Len:], 2, nb)
+			require.Error(t, err)
+
+			tampered = bytes.Clone(packet)
+			tampered[2] ^= 1
+			_, err = key.DecryptDanger(nil, tampered[:header.Len], tampered[header.Len:], 2, nb)
+			require.Error(t, err)
+
+			_, err = key.DecryptDanger(nil, packet[:header.Len], packet[header.Len:header.Len+2], 2, nb)
+			require.Error(t, err)
+
+			// An encrypting peer can not talk to us
+			key.authOnly = false
+			_, err = key.DecryptDanger(nil, packet[:header.Len], packet[header.Len:], 2, nb)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestInterface_allowsNullCipher(t *testing.T) {
+	l := test.NewLogger()
+	f := &Interface{l: l}
+	peer := &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: map[string]struct{}{"fabric": {}}}
+	other := &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: map[string]struct{}{"web": {}}}
+
+	assert.False(t, f.offerNullCipher())
+	assert.False(t, f.allowsNullCipher(peer))
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("null_cipher:\n  groups: [fabric]"))
+	f.reloadNullCipher(c)
+	assert.True(t, f.offerNullCipher())
+	assert.True(t, f.allowsNullCipher(peer))
+	assert.False(t, f.allowsNullCipher(other))
+	assert.False(t, f.allowsNullCipher(nil))
+
+	require.NoError(t, c.ReloadConfigString("null_cipher:\n  groups: []"))
+	f.reloadNullCipher(c)
+	assert.False(t, f.offerNullCipher())
+	assert.False(t, f.allowsNullCipher(peer))
+}
+
+func TestNebulaHandshakeDetails_nullCipher(t *testing.T) {
+	hs := &NebulaHandshake{Details: &NebulaHandshakeDetails{InitiatorIndex: 10, CertVersion: 2, NullCipher: true}}
+	b, err := hs.Marshal()
+	require.NoError(t, err)
+
+	got := &NebulaHandshake{}
+	require.NoError(t, got.Unmarshal(b))
+	assert.True(t, got.Details.GetNullCipher())
+	assert.Equal(t, uint32(2), got.Details.CertVersion)
+
+	// Hosts that never heard of it leave it out
+	hs.Details.NullCipher = false
+	b, err = hs.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, hs.Size(), len(b))
+	got = &NebulaHandshake{}
+	require.NoError(t, got.Unmarshal(b))
+	assert.False(t, got.Details.GetNullCipher())
+}
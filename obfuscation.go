@@ -0,0 +1,220 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/netip"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+	"golang.org/x/crypto/chacha20"
+)
+
+// Some networks block traffic that looks like nebula or wireguard by matching the plaintext packet headers and the
+// certificates in handshakes. With listen.obfuscation.key set every packet we send is scrambled with a keystream
+// derived from the key and a random nonce, and padded with a random number of bytes so packet sizes do not line up
+// either. Only the headers and handshakes are scrambled, everything else is already encrypted.
+//
+// This is not encryption and adds no security, anyone with the key can undo it. The key is shared out of band and
+// every host that talks to another must use the same one, packets without it are dropped.
+//
+// On the wire a packet is the nonce, the scrambled nebula packet, the padding and the scrambled padding length.
+
+const (
+	obfuscationNonceLen = 8
+
+	// defaultObfuscationPadding is the most random padding added to a packet
+	defaultObfuscationPadding = 16
+	maxObfuscationPadding     = 255
+)
+
+var errObfuscatedPacket = errors.New("packet was not obfuscated with our key")
+
+// obfuscation holds the listen.obfuscation config, nil when it is off
+type obfuscation struct {
+	key        [32]byte
+	maxPadding int
+	l          *logrus.Logger
+
+	bufs sync.Pool
+}
+
+func newObfuscationFromConfig(l *logrus.Logger, c *config.C) (*obfuscation, error) {
+	key, err := c.GetSecret("listen.obfuscation.key", "")
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	o := &obfuscation{
+		key:        sha256.Sum256([]byte("nebula obfuscation " + key)),
+		maxPadding: c.GetInt("listen.obfuscation.max_padding", defaultObfuscationPadding),
+		l:          l,
+	}
+
+	if o.maxPadding < 0 || o.maxPadding > maxObfuscationPadding {
+		return nil, fmt.Errorf("listen.obfuscation.max_padding must be between 0 and %d", maxObfuscationPadding)
+	}
+
+	o.bufs.New = func() any {
+		b := make([]byte, udp.MTU+o.overhead())
+		return &b
+	}
+
+	l.WithField("maxPadding", o.maxPadding).Info("Obfuscating outside packets")
+	return o, nil
+}
+
+// overhead is the most bytes obfuscation adds to a packet
+func (o *obfuscation) overhead() int {
+	return obfuscationNonceLen + o.maxPadding + 1
+}
+
+// wrap returns c with every packet through it obfuscated, or c as it is when obfuscation is off
+func (o *obfuscation) wrap(c udp.Conn) udp.Conn {
+	if o == nil {
+		return c
+	}
+	return &obfuscatedConn{Conn: c, o: o}
+}
+
+// keystream is the cipher for the packet with nonce, the first byte it produces masks the padding length
+func (o *obfuscation) keystream(nonce []byte) *chacha20.Cipher {
+	var n [chacha20.NonceSize]byte
+	copy(n[:], nonce)
+	// The key and nonce sizes are fixed, this can not fail
+	ks, _ := chacha20.NewUnauthenticatedCipher(o.key[:], n[:])
+	return ks
+}
+
+// scramble xors the headers of the nebula packet p with ks, and the body of a handshake. Relayed packets carry the
+// packet they relay in the clear after the relay header, its header and handshake are scrambled as well
+func scramble(ks *chacha20.Cipher, p []byte, decode bool) {
+	for len(p) >= header.Len {
+		var t header.MessageType
+		var st header.MessageSubType
+		if !decode {
+			// Read the header before it is scrambled
+			t, st = header.MessageType(p[0]&0x0f), header.MessageSubType(p[1])
+		}
+		ks.XORKeyStream(p[:header.Len], p[:header.Len])
+		if decode {
+			t, st = header.MessageType(p[0]&0x0f), header.MessageSubType(p[1])
+		}
+
+		p = p[header.Len:]
+
+		switch {
+		case t == header.Handshake:
+			ks.XORKeyStream(p, p)
+			return
+		case t == header.Message && st == header.MessageRelay:
+			continue
+		default:
+			return
+		}
+	}
+}
+
+// obfuscate writes p obfuscated to dst, which must fit p and the overhead
+func (o *obfuscation) obfuscate(dst, p []byte) []byte {
+	nonce := dst[:obfuscationNonceLen]
+	binary.LittleEndian.PutUint64(nonce, mathrand.Uint64())
+	ks := o.keystream(nonce)
+
+	padding := 0
+	if o.maxPadding > 0 {
+		padding = mathrand.IntN(o.maxPadding + 1)
+	}
+
+	out := append(dst[:obfuscationNonceLen], p...)
+	for range padding {
+		out = append(out, byte(mathrand.Uint32()))
+	}
+	out = append(out, byte(padding))
+
+	ks.XORKeyStream(out[len(out)-1:], out[len(out)-1:])
+	scramble(ks, out[obfuscationNonceLen:obfuscationNonceLen+len(p)], false)
+	return out
+}
+
+// deobfuscate undoes obfuscate in place and returns the nebula packet
+func (o *obfuscation) deobfuscate(b []byte) ([]byte, error) {
+	if len(b) < obfuscationNonceLen+header.Len+1 {
+		return nil, errObfuscatedPacket
+	}
+
+	ks := o.keystream(b[:obfuscationNonceLen])
+	ks.XORKeyStream(b[len(b)-1:], b[len(b)-1:])
+	end := len(b) - 1 - int(b[len(b)-1])
+	if end < obfuscationNonceLen+header.Len {
+		return nil, errObfuscatedPacket
+	}
+
+	p := b[obfuscationNonceLen:end]
+	scramble(ks, p, true)
+	if p[0]>>4 != header.Version {
+		return nil, errObfuscatedPacket
+	}
+
+	return p, nil
+}
+
+// obfuscatedConn obfuscates everything written to and read from the underlying listener
+type obfuscatedConn struct {
+	udp.Conn
+	o *obfuscation
+}
+
+func (c *obfuscatedConn) ListenOut(r udp.EncReader) {
+	c.Conn.ListenOut(func(addr netip.AddrPort, payload []byte) {
+		p, err := c.o.deobfuscate(payload)
+		if err != nil {
+			if c.o.l.Level >= logrus.DebugLevel {
+				c.o.l.WithField("udpAddr", addr).WithError(err).Debug("Dropping outside packet")
+			}
+			return
+		}
+		r(addr, p)
+	})
+}
+
+func (c *obfuscatedConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	buf := c.o.bufs.Get().(*[]byte)
+	defer c.o.bufs.Put(buf)
+	return c.Conn.WriteTo(c.o.obfuscate(*buf, b), addr)
+}
+
+// WriteToDSCP marks the packet when the underlying listener can, see udp.DSCPWriter
+func (c *obfuscatedConn) WriteToDSCP(b []byte, addr netip.AddrPort, dscp uint8) error {
+	dw, ok := c.Conn.(udp.DSCPWriter)
+	if !ok {
+		return c.WriteTo(b, addr)
+	}
+
+	buf := c.o.bufs.Get().(*[]byte)
+	defer c.o.bufs.Put(buf)
+	return dw.WriteToDSCP(c.o.obfuscate(*buf, b), addr, dscp)
+}
+
+// PathMTU leaves room for the obfuscation overhead, see udp.PathMTUConn
+func (c *obfuscatedConn) PathMTU(addr netip.AddrPort) (int, error) {
+	pc, ok := c.Conn.(udp.PathMTUConn)
+	if !ok {
+		return 0, fmt.Errorf("the udp listener can not report the path mtu")
+	}
+
+	mtu, err := pc.PathMTU(addr)
+	if err != nil {
+		return 0, err
+	}
+	return mtu - c.o.overhead(), nil
+}
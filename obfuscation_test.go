@@ -0,0 +1,100 @@
+package nebula
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewObfuscationFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	o, err := newObfuscationFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Nil(t, o)
+	assert.Equal(t, udp.NoopConn{}, o.wrap(udp.NoopConn{}))
+
+	c.Settings["listen"] = map[string]any{"obfuscation": map[string]any{"key": "hunter2"}}
+	o, err = newObfuscationFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, defaultObfuscationPadding, o.maxPadding)
+	assert.IsType(t, &obfuscatedConn{}, o.wrap(udp.NoopConn{}))
+
+	c.Settings["listen"] = map[string]any{"obfuscation": map[string]any{"key": "hunter2", "max_padding": 256}}
+	_, err = newObfuscationFromConfig(l, c)
+	require.EqualError(t, err, "listen.obfuscation.max_padding must be between 0 and 255")
+
+	// The key may be a secret reference
+	t.Setenv("NEBULA_TEST_OBFUSCATION_KEY", "hunter2")
+	c.Settings["listen"] = map[string]any{"obfuscation": map[string]any{"key": "env://NEBULA_TEST_OBFUSCATION_KEY"}}
+	ref, err := newObfuscationFromConfig(l, c)
+	require.NoError(t, err)
+	assert.Equal(t, o.key, ref.key)
+
+	c.Settings["listen"] = map[string]any{"obfuscation": map[string]any{"key": "env://NEBULA_TEST_MISSING"}}
+	_, err = newObfuscationFromConfig(l, c)
+	require.EqualError(t, err, "unable to resolve listen.obfuscation.key: environment variable NEBULA_TEST_MISSING is not set")
+}
+
+func TestObfuscation(t *testing.T) {
+	l := test.NewLogger()
+	newObfuscation := func(key string, padding int) *obfuscation {
+		c := config.NewC(l)
+		c.Settings["listen"] = map[string]any{"obfuscation": map[string]any{"key": key, "max_padding": padding}}
+		o, err := newObfuscationFromConfig(l, c)
+		require.NoError(t, err)
+		return o
+	}
+	newPacket := func(t header.MessageType, st header.MessageSubType, body []byte) []byte {
+		return append(header.Encode(make([]byte, header.Len), header.Version, t, st, 1, 2), body...)
+	}
+
+	o := newObfuscation("hunter2", 32)
+	body := bytes.Repeat([]byte("certificate "), 10)
+	handshake := newPacket(header.Handshake, header.HandshakeIXPSK0, body)
+	data := newPacket(header.Message, header.MessageNone, body)
+	relayed := append(newPacket(header.Message, header.MessageRelay, nil), handshake...)
+
+	for _, p := range [][]byte{handshake, data, relayed} {
+		buf := make([]byte, udp.MTU+o.overhead())
+		out := o.obfuscate(buf, p)
+		assert.GreaterOrEqual(t, len(out), len(p)+obfuscationNonceLen+1)
+		assert.LessOrEqual(t, len(out), len(p)+o.overhead())
+		assert.NotContains(t, string(out), string(p[:header.Len]))
+
+		got, err := o.deobfuscate(bytes.Clone(out))
+		require.NoError(t, err)
+		assert.Equal(t, p, got)
+
+		// A different key can not read it. Only the version is checked, 1 in 16 wrong keys get garbage through that
+		// the decryption after us drops.
+		got, err = newObfuscation("hunter3", 32).deobfuscate(bytes.Clone(out))
+		if err == nil {
+			assert.NotEqual(t, p, got)
+		} else {
+			require.ErrorIs(t, err, errObfuscatedPacket)
+		}
+	}
+
+	// Handshakes, even relayed ones, do not show their certificate, other messages are already encrypted
+	assert.NotContains(t, string(o.obfuscate(make([]byte, udp.MTU+o.overhead()), handshake)), "certificate")
+	assert.NotContains(t, string(o.obfuscate(make([]byte, udp.MTU+o.overhead()), relayed)), "certificate")
+	assert.Contains(t, string(o.obfuscate(make([]byte, udp.MTU+o.overhead()), data)), string(body))
+
+	// Packets that were never obfuscated are dropped
+	_, err := o.deobfuscate(bytes.Clone(data))
+	require.ErrorIs(t, err, errObfuscatedPacket)
+	_, err = o.deobfuscate([]byte("short"))
+	require.ErrorIs(t, err, errObfuscatedPacket)
+
+	// Without padding only the nonce and length are added
+	o = newObfuscation("hunter2", 0)
+	assert.Len(t, o.obfuscate(make([]byte, udp.MTU+o.overhead()), data), len(data)+obfuscationNonceLen+1)
+}
@@ -50,6 +50,10 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 	var ci *ConnectionState
 	if hostinfo != nil {
 		ci = hostinfo.ConnectionState
+		if ci != nil && !via.IsRelayed && via.UdpAddr != hostinfo.remote && !fromSourcePort(hostinfo, via, h) {
+			// Not authenticated yet, handleHostRoaming marks it validated if it decrypts
+			hostinfo.remoteHistory.seen(via.UdpAddr, false, time.Now())
+		}
 	}
 
 	switch h.Type {
@@ -59,8 +63,8 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 		}
 
 		switch h.Subtype {
-		case header.MessageNone:
-			if !f.decryptToTun(hostinfo, h.MessageCounter, out, packet, fwPacket, nb, q, localCache) {
+		case header.MessageNone, header.MessageLZ4, header.MessageZstd:
+			if !f.decryptToTun(hostinfo, h, out, packet, fwPacket, nb, q, localCache) {
 				return
 			}
 		case header.MessageRelay:
@@ -116,6 +120,9 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 				if targetRelay.State == Established {
 					switch targetRelay.Type {
 					case ForwardingType:
+						if !f.relayManager.allowForward(hostinfo, len(signedPayload)) {
+							return
+						}
 						// Forward this packet through the relay tunnel
 						// Find the target HostInfo
 						f.SendVia(targetHI, targetRelay, signedPayload, nb, out, false)
@@ -167,7 +174,15 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
 			f.handleHostRoaming(hostinfo, via)
-			f.send(header.Test, header.TestReply, ci, hostinfo, d, nb, out)
+			f.send(header.Test, header.TestReply, ci, hostinfo, clockProbeReply(d, time.Now()), nb, out)
+
+		} else if f.handleLatencyReply(hostinfo, via, d) {
+			// Latency probes go to every remote we know of, the replies decide on roaming instead of where they came from
+			f.connectionManager.In(hostinfo)
+			return
+
+		} else {
+			f.clockProbes.reply(f.l, hostinfo, d, time.Now())
 		}
 
 		// Fallthrough to the bottom to record incoming traffic
@@ -210,7 +225,12 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 			return
 		}
 
-		f.relayManager.HandleControlMsg(hostinfo, d, f)
+		switch h.Subtype {
+		case header.ControlRenewCert:
+			f.handleCertRenewRequest(hostinfo)
+		default:
+			f.relayManager.HandleControlMsg(hostinfo, d, f)
+		}
 
 	default:
 		f.messageMetrics.Rx(h.Type, h.Subtype, 1)
@@ -218,7 +238,9 @@ func (f *Interface) readOutsidePackets(via ViaSender, out []byte, packet []byte,
 		return
 	}
 
-	f.handleHostRoaming(hostinfo, via)
+	if !fromSourcePort(hostinfo, via, h) {
+		f.handleHostRoaming(hostinfo, via)
+	}
 
 	f.connectionManager.In(hostinfo)
 }
@@ -239,6 +261,8 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, via ViaSender) {
 	if !via.IsRelayed && hostinfo.remote != via.UdpAddr {
+		hostinfo.remoteHistory.seen(via.UdpAddr, true, time.Now())
+
 		if !f.lightHouse.GetRemoteAllowList().AllowAll(hostinfo.vpnAddrs, via.UdpAddr.Addr()) {
 			hostinfo.logger(f.l).WithField("newAddr", via.UdpAddr).Debug("lighthouse.remote_allow_list denied roaming")
 			return
@@ -252,11 +276,20 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, via ViaSender) {
 			return
 		}
 
+		if f.fasterThan(hostinfo, hostinfo.remote, via.UdpAddr) {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", via.UdpAddr).
+					Debug("Suppressing roam to a higher latency remote")
+			}
+			return
+		}
+
 		hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", via.UdpAddr).
 			Info("Host roamed to new udp ip/port.")
 		hostinfo.lastRoam = time.Now()
 		hostinfo.lastRoamRemote = hostinfo.remote
 		hostinfo.SetRemote(via.UdpAddr)
+		f.lightHouse.notifySubscribers(hostinfo.vpnAddrs)
 	}
 
 }
@@ -266,6 +299,7 @@ func (f *Interface) handleEncrypted(ci *ConnectionState, via ViaSender, h *heade
 	// If connectionstate does not exist, send a recv error, if possible, to encourage a fast reconnect
 	if ci == nil {
 		if !via.IsRelayed {
+			f.warmRestart.recognize(h.RemoteIndex, via.UdpAddr)
 			f.maybeSendRecvError(via.UdpAddr, h.RemoteIndex)
 		}
 		return false
@@ -472,8 +506,9 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
-func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
+func (f *Interface) decryptToTun(hostinfo *HostInfo, h *header.H, out []byte, packet []byte, fwPacket *firewall.Packet, nb []byte, q int, localCache firewall.ConntrackCache) bool {
 	var err error
+	messageCounter := h.MessageCounter
 
 	out, err = hostinfo.ConnectionState.dKey.DecryptDanger(out, packet[:header.Len], packet[header.Len:], messageCounter, nb)
 	if err != nil {
@@ -481,6 +516,29 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
+	if h.Subtype != header.MessageNone {
+		buf := compressionBufs.Get().(*[]byte)
+		defer compressionBufs.Put(buf)
+
+		compressed := out
+		out, err = decompress(h.Subtype, *buf, compressed)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).WithField("header", h).Warn("Failed to decompress packet")
+			return false
+		}
+
+		hostinfo.counters.rxDecompressIn.Add(uint64(len(compressed)))
+		hostinfo.counters.rxDecompressOut.Add(uint64(len(out)))
+		if cc := f.compression.Load(); cc != nil {
+			cc.rxCompressedBytes.Inc(int64(len(compressed)))
+			cc.rxBytes.Inc(int64(len(out)))
+		}
+	}
+
+	if f.macs != nil {
+		return f.receiveFrame(hostinfo, messageCounter, out, fwPacket, q, localCache)
+	}
+
 	err = newPacket(out, true, fwPacket)
 	if err != nil {
 		hostinfo.logger(f.l).WithError(err).WithField("packet", out).
@@ -494,11 +552,19 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 		return false
 	}
 
-	dropReason := f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	var dropReason error
+	broadcast := f.overlayBroadcast(fwPacket.LocalAddr)
+	if broadcast {
+		dropReason = f.acceptBroadcast(hostinfo, fwPacket, localCache)
+	} else {
+		dropReason = f.firewall.Drop(*fwPacket, true, hostinfo, f.pki.GetCAPool(), localCache)
+	}
 	if dropReason != nil {
 		// NOTE: We give `packet` as the `out` here since we already decrypted from it and we don't need it anymore
-		// This gives us a buffer to build the reject packet in
-		f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q)
+		// This gives us a buffer to build the reject packet in. Nobody is told about dropped broadcasts.
+		if !broadcast {
+			f.rejectOutside(out, hostinfo.ConnectionState, hostinfo, nb, packet, q)
+		}
 		if f.l.Level >= logrus.DebugLevel {
 			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).
 				WithField("reason", dropReason).
@@ -508,10 +574,20 @@ func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out
 	}
 
 	f.connectionManager.In(hostinfo)
-	_, err = f.readers[q].Write(out)
-	if err != nil {
-		f.l.WithError(err).Error("Failed to write to tun")
+	hostinfo.counters.rx(len(out))
+	// NOTE: As with rejects `packet` is free to build the reply in
+	if f.answerPingOutside(hostinfo, fwPacket, out, packet, nb, q) {
+		return true
+	}
+	f.clampMSS(fwPacket, out)
+	if n := f.inboundNAT.Load(); n.enabled() {
+		n.translateIn(out, fwPacket)
 	}
+	if f.wireguardGateway != nil && f.wireguardGateway.deliver(fwPacket.LocalAddr, out) {
+		return true
+	}
+
+	f.writeToTun(hostinfo, out, q)
 	return true
 }
 
@@ -7,12 +7,35 @@ import (
 	"github.com/slackhq/nebula/routing"
 )
 
+// Device is where nebula reads the packets it sends into tunnels and writes the packets that come out of them. The
+// builtin tun devices implement it, as can out-of-tree datapaths like DPDK, AF_XDP, or memif, see RegisterDevice.
+//
+// Every Read must return exactly one ip packet, or one ethernet frame for a TapDevice, and every Write is given
+// exactly one. Reads and Writes happen concurrently from several goroutines.
 type Device interface {
 	io.ReadWriteCloser
+
+	// Activate brings the device up and installs its routes. Nebula calls it once, before the first Read or Write,
+	// and other services wait for it before binding to the vpn addresses.
 	Activate() error
+
+	// Networks are the vpn networks from our certificate the device was created with
 	Networks() []netip.Prefix
+
+	// Name is the name of the device on the host, used in logs and to tell our device apart from the other
+	// interfaces of the host
 	Name() string
+
+	// RoutesFor returns the vpn addresses that handle traffic to ip, usually from tun.unsafe_routes. It is called for
+	// every packet to an address outside of our vpn networks and must not block. Devices that do not own a route
+	// table can embed a RouteTable.
 	RoutesFor(netip.Addr) routing.Gateways
+
+	// SupportsMultiqueue reports if NewMultiQueueReader can be called. When it can, nebula reads and writes the device
+	// from one queue per routine, see the routines config.
 	SupportsMultiqueue() bool
+
+	// NewMultiQueueReader returns another queue of the device. It is called routines - 1 times, the Device itself
+	// serves as the first queue.
 	NewMultiQueueReader() (io.ReadWriteCloser, error)
 }
@@ -0,0 +1,53 @@
+package overlay
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// builtinDriver is the tun.driver of the devices nebula ships with, a tun or tap device for the current platform
+const builtinDriver = "tun"
+
+var drivers = struct {
+	sync.RWMutex
+	factories map[string]DeviceFactory
+}{factories: map[string]DeviceFactory{}}
+
+// RegisterDevice makes a custom Device available to nebula as `tun.driver: name`, so an application embedding nebula
+// can plug in its own datapath without replacing the config handling in NewDeviceFromConfig. It is meant to be called
+// from an init func and panics if name is empty, the builtin tun, or already registered, like database/sql.Register.
+//
+// factory is given the whole config, vpn networks from our certificate, and the number of routines that will use the
+// device. Use NewRouteTableFromConfig for tun.routes and tun.unsafe_routes.
+func RegisterDevice(name string, factory DeviceFactory) {
+	if name == "" || name == builtinDriver {
+		panic(fmt.Sprintf("overlay: can not register a device named %q", name))
+	}
+
+	if factory == nil {
+		panic("overlay: RegisterDevice factory is nil")
+	}
+
+	drivers.Lock()
+	defer drivers.Unlock()
+	if _, ok := drivers.factories[name]; ok {
+		panic(fmt.Sprintf("overlay: RegisterDevice called twice for %q", name))
+	}
+	drivers.factories[name] = factory
+}
+
+// RegisteredDevices returns the names of the devices added with RegisterDevice, sorted
+func RegisteredDevices() []string {
+	drivers.RLock()
+	defer drivers.RUnlock()
+	return slices.Sorted(maps.Keys(drivers.factories))
+}
+
+func registeredDevice(name string) (DeviceFactory, bool) {
+	drivers.RLock()
+	defer drivers.RUnlock()
+	f, ok := drivers.factories[name]
+	return f, ok
+}
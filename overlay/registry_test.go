@@ -0,0 +1,52 @@
+package overlay
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDevice(t *testing.T) {
+	l := test.NewLogger()
+	vpnNetworks := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}
+
+	var gotRoutines int
+	RegisterDevice("test-memif", func(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, routines int) (Device, error) {
+		gotRoutines = routines
+		return NewUserDevice(vpnNetworks)
+	})
+	RegisterDevice("test-broken", func(*config.C, *logrus.Logger, []netip.Prefix, int) (Device, error) {
+		return nil, errors.New("no hugepages")
+	})
+
+	assert.Contains(t, RegisteredDevices(), "test-memif")
+	assert.Panics(t, func() { RegisterDevice("test-memif", NewUserDeviceFromConfig) })
+	assert.Panics(t, func() { RegisterDevice("tun", NewUserDeviceFromConfig) })
+	assert.Panics(t, func() { RegisterDevice("", NewUserDeviceFromConfig) })
+
+	c := config.NewC(l)
+	c.Settings["tun"] = map[string]any{"driver": "test-memif"}
+	d, err := NewDeviceFromConfig(c, l, vpnNetworks, 4)
+	require.NoError(t, err)
+	assert.IsType(t, &UserDevice{}, d)
+	assert.Equal(t, 4, gotRoutines)
+
+	c.Settings["tun"] = map[string]any{"driver": "test-broken"}
+	_, err = NewDeviceFromConfig(c, l, vpnNetworks, 1)
+	require.ErrorContains(t, err, "no hugepages")
+
+	c.Settings["tun"] = map[string]any{"driver": "af_xdp"}
+	_, err = NewDeviceFromConfig(c, l, vpnNetworks, 1)
+	require.ErrorContains(t, err, `tun.driver "af_xdp" is not registered`)
+
+	// tun.mode tap still needs a device that can carry frames
+	c.Settings["tun"] = map[string]any{"driver": "test-memif", "mode": "tap"}
+	_, err = NewDeviceFromConfig(c, l, vpnNetworks, 1)
+	require.ErrorContains(t, err, "tun.mode tap is not supported")
+}
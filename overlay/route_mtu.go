@@ -0,0 +1,67 @@
+package overlay
+
+import (
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/gaissmai/bart"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/util"
+)
+
+// RouteMTU knows the mtu of the path to an address, the mtu of the most specific route in tun.routes or
+// tun.unsafe_routes that sets one and tun.mtu for everything else. It follows config reloads.
+type RouteMTU struct {
+	vpnNetworks []netip.Prefix
+	defaultMTU  atomic.Int64
+	tree        atomic.Pointer[bart.Table[int]]
+}
+
+// NewRouteMTUFromConfig parses the routes in c and reloads them with it
+func NewRouteMTUFromConfig(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix) (*RouteMTU, error) {
+	rm := &RouteMTU{vpnNetworks: vpnNetworks}
+	if err := rm.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := rm.reload(c, false); err != nil {
+			util.LogWithContextIfNeeded("Failed to reload route mtus", err, l)
+		}
+	})
+
+	return rm, nil
+}
+
+func (rm *RouteMTU) reload(c *config.C, initial bool) error {
+	if initial || c.HasChanged("tun.mtu") {
+		rm.defaultMTU.Store(int64(c.GetInt("tun.mtu", DefaultMTU)))
+	}
+
+	changed, routes, err := getAllRoutesFromConfig(c, rm.vpnNetworks, initial)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	tree := new(bart.Table[int])
+	for _, r := range routes {
+		if r.MTU > 0 {
+			tree.Insert(r.Cidr, r.MTU)
+		}
+	}
+	rm.tree.Store(tree)
+	return nil
+}
+
+// For returns the mtu packets to addr have to fit in
+func (rm *RouteMTU) For(addr netip.Addr) int {
+	if mtu, ok := rm.tree.Load().Lookup(addr); ok {
+		return mtu
+	}
+	return int(rm.defaultMTU.Load())
+}
@@ -0,0 +1,48 @@
+package overlay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteMTU(t *testing.T) {
+	l := test.NewLogger()
+	vpnNetworks := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/16")}
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+tun:
+  mtu: 1400
+  routes:
+    - route: 10.0.8.0/24
+      mtu: 8800
+  unsafe_routes:
+    - route: 192.168.0.0/16
+      via: 10.0.0.2
+      mtu: 1200
+    - route: 192.168.1.0/24
+      via: 10.0.0.3
+`))
+
+	rm, err := NewRouteMTUFromConfig(c, l, vpnNetworks)
+	require.NoError(t, err)
+	assert.Equal(t, 1400, rm.For(netip.MustParseAddr("10.0.0.9")))
+	assert.Equal(t, 8800, rm.For(netip.MustParseAddr("10.0.8.9")))
+	assert.Equal(t, 1200, rm.For(netip.MustParseAddr("192.168.2.9")))
+	// A more specific route without an mtu of its own does not hide the one above it
+	assert.Equal(t, 1200, rm.For(netip.MustParseAddr("192.168.1.9")))
+
+	require.NoError(t, c.ReloadConfigString(`
+tun:
+  unsafe_routes:
+    - route: 192.168.0.0/16
+      via: 10.0.0.2
+      mtu: 1000
+`))
+	assert.Equal(t, 1300, rm.For(netip.MustParseAddr("10.0.8.9")))
+	assert.Equal(t, 1000, rm.For(netip.MustParseAddr("192.168.1.9")))
+}
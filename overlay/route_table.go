@@ -0,0 +1,77 @@
+package overlay
+
+import (
+	"net/netip"
+	"slices"
+	"sync/atomic"
+
+	"github.com/gaissmai/bart"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/routing"
+	"github.com/slackhq/nebula/util"
+)
+
+// RouteTable keeps tun.routes and tun.unsafe_routes current across config reloads for devices that do not manage a
+// route table of their own. Embed it to implement Device.RoutesFor.
+type RouteTable struct {
+	l           *logrus.Logger
+	vpnNetworks []netip.Prefix
+	routes      atomic.Pointer[[]Route]
+	tree        atomic.Pointer[bart.Table[routing.Gateways]]
+	onChange    func(routes, removed []Route)
+}
+
+// NewRouteTableFromConfig parses the routes in c and reloads them with it. onChange is the route hook, it is called
+// with every route and the routes that went away whenever a reload changes them, so the device can update its own
+// datapath. It may be nil, and is not called for the initial routes, see Routes.
+func NewRouteTableFromConfig(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, onChange func(routes, removed []Route)) (*RouteTable, error) {
+	rt := &RouteTable{l: l, vpnNetworks: vpnNetworks, onChange: onChange}
+	if err := rt.reload(c, true); err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *config.C) {
+		if err := rt.reload(c, false); err != nil {
+			util.LogWithContextIfNeeded("Failed to reload routes", err, l)
+		}
+	})
+
+	return rt, nil
+}
+
+func (rt *RouteTable) reload(c *config.C, initial bool) error {
+	changed, routes, err := getAllRoutesFromConfig(c, rt.vpnNetworks, initial)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return nil
+	}
+
+	tree, err := makeRouteTree(rt.l, routes, true)
+	if err != nil {
+		return err
+	}
+
+	old := rt.routes.Swap(&routes)
+	rt.tree.Store(tree)
+
+	if !initial && rt.onChange != nil {
+		rt.onChange(rt.Routes(), findRemovedRoutes(routes, *old))
+	}
+
+	return nil
+}
+
+// RoutesFor returns the gateways for ip, nil if there is no route to it
+func (rt *RouteTable) RoutesFor(ip netip.Addr) routing.Gateways {
+	r, _ := rt.tree.Load().Lookup(ip)
+	return r
+}
+
+// Routes returns a copy of the current routes
+func (rt *RouteTable) Routes() []Route {
+	return slices.Clone(*rt.routes.Load())
+}
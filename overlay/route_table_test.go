@@ -0,0 +1,54 @@
+package overlay
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteTable(t *testing.T) {
+	l := test.NewLogger()
+	vpnNetworks := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+tun:
+  unsafe_routes:
+    - route: 192.168.1.0/24
+      via: 10.0.0.2
+    - route: 192.168.2.0/24
+      via: 10.0.0.3
+`))
+
+	var changes [][2][]Route
+	rt, err := NewRouteTableFromConfig(c, l, vpnNetworks, func(routes, removed []Route) {
+		changes = append(changes, [2][]Route{routes, removed})
+	})
+	require.NoError(t, err)
+	assert.Len(t, rt.Routes(), 2)
+	assert.Empty(t, changes, "the initial routes are not a change")
+
+	gw := rt.RoutesFor(netip.MustParseAddr("192.168.1.9"))
+	require.Len(t, gw, 1)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.2"), gw[0].Addr())
+	assert.Nil(t, rt.RoutesFor(netip.MustParseAddr("192.168.3.9")))
+
+	require.NoError(t, c.ReloadConfigString(`
+tun:
+  unsafe_routes:
+    - route: 192.168.1.0/24
+      via: 10.0.0.4
+`))
+	require.Len(t, changes, 1)
+	require.Len(t, changes[0][0], 1)
+	require.Len(t, changes[0][1], 1)
+	assert.Equal(t, netip.MustParsePrefix("192.168.2.0/24"), changes[0][1][0].Cidr)
+
+	gw = rt.RoutesFor(netip.MustParseAddr("192.168.1.9"))
+	require.Len(t, gw, 1)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.4"), gw[0].Addr())
+	assert.Nil(t, rt.RoutesFor(netip.MustParseAddr("192.168.2.9")))
+}
@@ -15,14 +15,59 @@ const DefaultMTU = 1300
 // TODO: We may be able to remove routines
 type DeviceFactory func(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, routines int) (Device, error)
 
+// TapDevice is implemented by devices that can carry ethernet frames instead of ip packets, see tun.mode
+type TapDevice interface {
+	IsTap() bool
+}
+
 func NewDeviceFromConfig(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, routines int) (Device, error) {
+	tap, err := tapMode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := c.GetString("tun.driver", builtinDriver)
+
+	var d Device
 	switch {
 	case c.GetBool("tun.disabled", false):
-		tun := newDisabledTun(vpnNetworks, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
-		return tun, nil
+		d = newDisabledTun(vpnNetworks, c.GetInt("tun.tx_queue", 500), c.GetBool("stats.message_metrics", false), l)
+
+	case driver == builtinDriver:
+		d, err = newTun(c, l, vpnNetworks, routines > 1)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		factory, ok := registeredDevice(driver)
+		if !ok {
+			return nil, fmt.Errorf("tun.driver %q is not registered, known drivers are %v", driver, append([]string{builtinDriver}, RegisteredDevices()...))
+		}
+
+		d, err = factory(c, l, vpnNetworks, routines)
+		if err != nil {
+			return nil, util.NewContextualError("Failed to create the tun.driver device", map[string]any{"driver": driver}, err)
+		}
+	}
+
+	if td, ok := d.(TapDevice); tap && (!ok || !td.IsTap()) {
+		_ = d.Close()
+		return nil, fmt.Errorf("tun.mode tap is not supported by this device")
+	}
+
+	return d, nil
+}
 
+// tapMode reports whether tun.mode asks for a tap device
+func tapMode(c *config.C) (bool, error) {
+	switch c.GetString("tun.mode", "tun") {
+	case "tun":
+		return false, nil
+	case "tap":
+		return true, nil
 	default:
-		return newTun(c, l, vpnNetworks, routines > 1)
+		return false, fmt.Errorf("tun.mode must be tun or tap")
 	}
 }
 
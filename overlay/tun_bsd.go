@@ -0,0 +1,18 @@
+//go:build (freebsd || openbsd) && !e2e_testing
+// +build freebsd openbsd
+// +build !e2e_testing
+
+package overlay
+
+import "io"
+
+// sharedQueue gives another routine access to the tun device through the same descriptor. The BSD tun drivers have no
+// multiqueue support, but every read and write moves exactly one packet so routines can safely share the fd. The
+// device owns the descriptor, closing a queue does nothing.
+type sharedQueue struct {
+	io.ReadWriter
+}
+
+func (q sharedQueue) Close() error {
+	return nil
+}
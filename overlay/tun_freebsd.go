@@ -129,7 +129,6 @@ func (t *tun) Read(to []byte) (int, error) {
 	}
 }
 
-// Write is only valid for single threaded use
 func (t *tun) Write(from []byte) (int, error) {
 	// use writev() to write to the tunnel device, to eliminate the need for copying the buffer
 	if t.devFd < 0 {
@@ -451,11 +450,11 @@ func (t *tun) Name() string {
 }
 
 func (t *tun) SupportsMultiqueue() bool {
-	return false
+	return true
 }
 
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
-	return nil, fmt.Errorf("TODO: multiqueue not implemented for freebsd")
+	return sharedQueue{t}, nil
 }
 
 func (t *tun) addRoutes(logErrors bool) error {
@@ -548,7 +547,6 @@ func addRoute(prefix netip.Prefix, gateway netroute.Addr) error {
 				return fmt.Errorf("failed to create route.RouteMessage for change: %w", err)
 			}
 			_, err = unix.Write(sock, data[:])
-			fmt.Println("DOING CHANGE")
 			return err
 		}
 		return fmt.Errorf("failed to write route.RouteMessage to socket: %w", err)
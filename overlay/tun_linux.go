@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,6 +22,7 @@ import (
 	"github.com/slackhq/nebula/routing"
 	"github.com/slackhq/nebula/util"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 )
 
@@ -35,6 +37,13 @@ type tun struct {
 	deviceIndex int
 	ioctlFd     uintptr
 
+	// netns is the network namespace the device lives in when tun.netns is set, nl is bound to it
+	netns       netns.NsHandle
+	nl          *netlink.Handle
+	singleQueue bool
+	// tap is set when the device carries ethernet frames, tun.mode
+	tap bool
+
 	Routes                    atomic.Pointer[[]Route]
 	routeTree                 atomic.Pointer[bart.Table[routing.Gateways]]
 	routeChan                 chan struct{}
@@ -85,6 +94,45 @@ func newTunFromFd(c *config.C, l *logrus.Logger, deviceFd int, vpnNetworks []net
 }
 
 func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueue bool) (*tun, error) {
+	tap, err := tapMode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := openNetns(c.GetString("tun.netns", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	var t *tun
+	if fd := c.GetInt("tun.fd", -1); fd >= 0 {
+		t, err = newTunFromAdoptedFd(c, l, fd, vpnNetworks, tap)
+	} else {
+		err = inNetns(ns, func() error {
+			t, err = newTunDevice(c, l, vpnNetworks, multiqueue, tap)
+			return err
+		})
+	}
+	if err != nil {
+		closeNetns(ns)
+		return nil, err
+	}
+
+	if ns.IsOpen() {
+		t.netns = ns
+		t.nl, err = netlink.NewHandleAt(ns)
+		if err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to open netlink in tun.netns: %w", err)
+		}
+		l.WithField("netns", c.GetString("tun.netns", "")).WithField("device", t.Device).
+			Info("Using tun device in another network namespace")
+	}
+
+	return t, nil
+}
+
+func newTunDevice(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueue, tap bool) (*tun, error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		// If /dev/net/tun doesn't exist, try to create it (will happen in docker)
@@ -108,7 +156,7 @@ func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueu
 	}
 
 	var req ifReq
-	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	req.Flags = deviceFlags(tap)
 	if multiqueue {
 		req.Flags |= unix.IFF_MULTI_QUEUE
 	}
@@ -125,10 +173,98 @@ func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, multiqueu
 	}
 
 	t.Device = name
+	t.tap = tap
 
 	return t, nil
 }
 
+// deviceFlags are the TUNSETIFF flags for a tun or tap device without packet information
+func deviceFlags(tap bool) uint16 {
+	if tap {
+		return unix.IFF_TAP | unix.IFF_NO_PI
+	}
+	return unix.IFF_TUN | unix.IFF_NO_PI
+}
+
+// newTunFromAdoptedFd uses a tun device that was already attached to fd by whatever started us, tun.fd
+func newTunFromAdoptedFd(c *config.C, l *logrus.Logger, fd int, vpnNetworks []netip.Prefix, tap bool) (*tun, error) {
+	var req ifReq
+	if err := ioctl(uintptr(fd), uintptr(unix.TUNGETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
+		return nil, fmt.Errorf("tun.fd %d is not an attached tun device: %w", fd, err)
+	}
+
+	if want := deviceFlags(tap); req.Flags&(unix.IFF_TUN|unix.IFF_TAP|unix.IFF_NO_PI) != want {
+		if tap {
+			return nil, fmt.Errorf("tun.fd %d must be a tap device opened with IFF_TAP and IFF_NO_PI", fd)
+		}
+		return nil, fmt.Errorf("tun.fd %d must be a tun device opened with IFF_TUN and IFF_NO_PI", fd)
+	}
+
+	file := os.NewFile(uintptr(fd), "/dev/net/tun")
+	t, err := newTunGeneric(c, l, file, vpnNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Device = strings.Trim(string(req.Name[:]), "\x00")
+	t.singleQueue = req.Flags&unix.IFF_MULTI_QUEUE == 0
+	t.tap = tap
+	l.WithField("fd", fd).WithField("device", t.Device).Info("Adopted tun device from tun.fd")
+
+	return t, nil
+}
+
+// openNetns opens the network namespace at path, an empty path returns a closed handle which means our own namespace
+func openNetns(path string) (netns.NsHandle, error) {
+	if path == "" {
+		return netns.None(), nil
+	}
+
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return netns.None(), fmt.Errorf("failed to open tun.netns %s: %w", path, err)
+	}
+
+	return ns, nil
+}
+
+func closeNetns(ns netns.NsHandle) {
+	if ns.IsOpen() {
+		_ = ns.Close()
+	}
+}
+
+// inNetns runs fn with the calling thread moved into ns. Anything created by fn that is bound to a namespace when it is
+// created, like a tun device or a socket, stays in ns.
+func inNetns(ns netns.NsHandle, fn func() error) error {
+	if !ns.IsOpen() {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get the current network namespace: %w", err)
+	}
+	defer orig.Close()
+
+	if err = netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter tun.netns: %w", err)
+	}
+
+	err = fn()
+
+	if rerr := netns.Set(orig); rerr != nil {
+		// Leave the thread locked so the runtime throws it away instead of reusing it in the wrong namespace
+		return fmt.Errorf("failed to return from tun.netns: %w", rerr)
+	}
+	runtime.UnlockOSThread()
+
+	return err
+}
+
 func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, vpnNetworks []netip.Prefix) (*tun, error) {
 	t := &tun{
 		ReadWriteCloser:           file,
@@ -138,6 +274,8 @@ func newTunGeneric(c *config.C, l *logrus.Logger, file *os.File, vpnNetworks []n
 		useSystemRoutes:           c.GetBool("tun.use_system_route_table", false),
 		useSystemRoutesBufferSize: c.GetInt("tun.use_system_route_table_buffer_size", 0),
 		routesFromSystem:          map[netip.Prefix]routing.Gateways{},
+		netns:                     netns.None(),
+		nl:                        &netlink.Handle{},
 		l:                         l,
 	}
 
@@ -230,20 +368,33 @@ func (t *tun) reload(c *config.C, initial bool) error {
 	return nil
 }
 
+func (t *tun) IsTap() bool {
+	return t.tap
+}
+
 func (t *tun) SupportsMultiqueue() bool {
-	return true
+	return !t.singleQueue
 }
 
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
-	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
-	if err != nil {
-		return nil, err
-	}
+	var fd int
+	err := inNetns(t.netns, func() error {
+		var err error
+		fd, err = unix.Open("/dev/net/tun", os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
 
-	var req ifReq
-	req.Flags = uint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_MULTI_QUEUE)
-	copy(req.Name[:], t.Device)
-	if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
+		var req ifReq
+		req.Flags = deviceFlags(t.tap) | unix.IFF_MULTI_QUEUE
+		copy(req.Name[:], t.Device)
+		if err = ioctl(uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&req))); err != nil {
+			_ = unix.Close(fd)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -312,13 +463,13 @@ func (t *tun) addIPs(link netlink.Link) error {
 	//add all new addresses
 	for i := range newAddrs {
 		//AddrReplace still adds new IPs, but if their properties change it will change them as well
-		if err := netlink.AddrReplace(link, newAddrs[i]); err != nil {
+		if err := t.nl.AddrReplace(link, newAddrs[i]); err != nil {
 			return err
 		}
 	}
 
 	//iterate over remainder, remove whoever shouldn't be there
-	al, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	al, err := t.nl.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
 		return fmt.Errorf("failed to get tun address list: %s", err)
 	}
@@ -327,7 +478,7 @@ func (t *tun) addIPs(link netlink.Link) error {
 		if hasNetlinkAddr(newAddrs, al[i]) {
 			continue
 		}
-		err = netlink.AddrDel(link, &al[i])
+		err = t.nl.AddrDel(link, &al[i])
 		if err != nil {
 			t.l.WithError(err).Error("failed to remove address from tun address list")
 		} else {
@@ -345,11 +496,17 @@ func (t *tun) Activate() error {
 		t.watchRoutes()
 	}
 
-	s, err := unix.Socket(
-		unix.AF_INET, //because everything we use t.ioctlFd for is address family independent, this is fine
-		unix.SOCK_DGRAM,
-		unix.IPPROTO_IP,
-	)
+	// The socket used for ioctls must be in the same namespace as the device
+	var s int
+	err := inNetns(t.netns, func() error {
+		var err error
+		s, err = unix.Socket(
+			unix.AF_INET, //because everything we use t.ioctlFd for is address family independent, this is fine
+			unix.SOCK_DGRAM,
+			unix.IPPROTO_IP,
+		)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -361,7 +518,7 @@ func (t *tun) Activate() error {
 		return fmt.Errorf("failed to set tun device name: %s", err)
 	}
 
-	link, err := netlink.LinkByName(t.Device)
+	link, err := t.nl.LinkByName(t.Device)
 	if err != nil {
 		return fmt.Errorf("failed to get tun device link: %s", err)
 	}
@@ -379,7 +536,7 @@ func (t *tun) Activate() error {
 	}
 
 	const modeNone = 1
-	if err = netlink.LinkSetIP6AddrGenMode(link, modeNone); err != nil {
+	if err = t.nl.LinkSetIP6AddrGenMode(link, modeNone); err != nil {
 		t.l.WithError(err).Warn("Failed to disable link local address generation")
 	}
 
@@ -440,13 +597,13 @@ func (t *tun) setDefaultRoute(cidr netip.Prefix) error {
 		Table:     unix.RT_TABLE_MAIN,
 		Type:      unix.RTN_UNICAST,
 	}
-	err := netlink.RouteReplace(&nr)
+	err := t.nl.RouteReplace(&nr)
 	if err != nil {
 		t.l.WithError(err).WithField("cidr", cidr).Warn("Failed to set default route MTU, retrying")
 		//retry twice more -- on some systems there appears to be a race condition where if we set routes too soon, netlink says `invalid argument`
 		for i := 0; i < 2; i++ {
 			time.Sleep(100 * time.Millisecond)
-			err = netlink.RouteReplace(&nr)
+			err = t.nl.RouteReplace(&nr)
 			if err == nil {
 				break
 			} else {
@@ -486,7 +643,7 @@ func (t *tun) addRoutes(logErrors bool) error {
 			nr.Priority = r.Metric
 		}
 
-		err := netlink.RouteReplace(&nr)
+		err := t.nl.RouteReplace(&nr)
 		if err != nil {
 			retErr := util.NewContextualError("Failed to add route", map[string]any{"route": r}, err)
 			if logErrors {
@@ -525,7 +682,7 @@ func (t *tun) removeRoutes(routes []Route) {
 			nr.Priority = r.Metric
 		}
 
-		err := netlink.RouteDel(&nr)
+		err := t.nl.RouteDel(&nr)
 		if err != nil {
 			t.l.WithError(err).WithField("route", r).Error("Failed to remove route")
 		} else {
@@ -560,6 +717,9 @@ func (t *tun) watchRoutes() {
 		ReceiveBufferForceSize: t.useSystemRoutesBufferSize != 0,
 		ErrorCallback:          func(e error) { t.l.WithError(e).Errorf("netlink error") },
 	}
+	if t.netns.IsOpen() {
+		netlinkOptions.Namespace = &t.netns
+	}
 
 	if err := netlink.RouteSubscribeWithOptions(rch, doneChan, netlinkOptions); err != nil {
 		t.l.WithError(err).Errorf("failed to subscribe to system route changes")
@@ -602,7 +762,7 @@ func (t *tun) isGatewayInVpnNetworks(gwAddr netip.Addr) bool {
 func (t *tun) getGatewaysFromRoute(r *netlink.Route) routing.Gateways {
 	var gateways routing.Gateways
 
-	link, err := netlink.LinkByName(t.Device)
+	link, err := t.nl.LinkByName(t.Device)
 	if err != nil {
 		t.l.WithField("deviceName", t.Device).Error("Ignoring route update: failed to get link by name")
 		return gateways
@@ -715,5 +875,10 @@ func (t *tun) Close() error {
 		_ = os.NewFile(t.ioctlFd, "ioctlFd").Close()
 	}
 
+	if t.nl != nil {
+		t.nl.Close()
+	}
+	closeNetns(t.netns)
+
 	return nil
 }
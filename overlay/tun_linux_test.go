@@ -3,7 +3,16 @@
 
 package overlay
 
-import "testing"
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 var runAdvMSSTests = []struct {
 	name     string
@@ -32,3 +41,51 @@ func TestTunAdvMSS(t *testing.T) {
 		})
 	}
 }
+
+func TestNewTunFromAdoptedFd(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	_, err = newTunFromAdoptedFd(config.NewC(l), l, int(r.Fd()), nil, false)
+	require.ErrorContains(t, err, "is not an attached tun device")
+}
+
+func TestTapMode(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	c := config.NewC(l)
+
+	tap, err := tapMode(c)
+	require.NoError(t, err)
+	assert.False(t, tap)
+
+	c.Settings["tun"] = map[string]any{"mode": "tap"}
+	tap, err = tapMode(c)
+	require.NoError(t, err)
+	assert.True(t, tap)
+
+	c.Settings["tun"] = map[string]any{"mode": "bridge"}
+	_, err = tapMode(c)
+	require.ErrorContains(t, err, "tun.mode must be tun or tap")
+}
+
+func TestInNetns(t *testing.T) {
+	ns, err := openNetns("")
+	require.NoError(t, err)
+	assert.False(t, ns.IsOpen())
+
+	// Without a namespace fn runs as is
+	ran := false
+	require.NoError(t, inNetns(ns, func() error {
+		ran = true
+		return nil
+	}))
+	assert.True(t, ran)
+
+	_, err = openNetns("/nonexistent/ns/net")
+	require.ErrorContains(t, err, "failed to open tun.netns /nonexistent/ns/net")
+}
@@ -10,6 +10,7 @@ import (
 	"net/netip"
 	"os"
 	"regexp"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"unsafe"
@@ -57,8 +58,8 @@ type tun struct {
 	l           *logrus.Logger
 	f           *os.File
 	fd          int
-	// cache out buffer since we need to prepend 4 bytes for tun metadata
-	out []byte
+	// buffers to hold the 4 bytes of tun metadata, shared by every routine using the device
+	bufs sync.Pool
 }
 
 var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
@@ -96,6 +97,10 @@ func newTun(c *config.C, l *logrus.Logger, vpnNetworks []netip.Prefix, _ bool) (
 		MTU:         c.GetInt("tun.mtu", DefaultMTU),
 		l:           l,
 	}
+	t.bufs.New = func() any {
+		b := make([]byte, t.MTU+4)
+		return &b
+	}
 
 	err = t.reload(c, true)
 	if err != nil {
@@ -125,7 +130,9 @@ func (t *tun) Close() error {
 }
 
 func (t *tun) Read(to []byte) (int, error) {
-	buf := make([]byte, len(to)+4)
+	bp := t.getBuf(len(to) + 4)
+	defer t.bufs.Put(bp)
+	buf := *bp
 
 	n, err := t.f.Read(buf)
 
@@ -133,19 +140,15 @@ func (t *tun) Read(to []byte) (int, error) {
 	return n - 4, err
 }
 
-// Write is only valid for single threaded use
 func (t *tun) Write(from []byte) (int, error) {
-	buf := t.out
-	if cap(buf) < len(from)+4 {
-		buf = make([]byte, len(from)+4)
-		t.out = buf
-	}
-	buf = buf[:len(from)+4]
-
 	if len(from) == 0 {
 		return 0, syscall.EIO
 	}
 
+	bp := t.getBuf(len(from) + 4)
+	defer t.bufs.Put(bp)
+	buf := *bp
+
 	// Determine the IP Family for the NULL L2 Header
 	ipVer := from[0] >> 4
 	if ipVer == 4 {
@@ -162,6 +165,16 @@ func (t *tun) Write(from []byte) (int, error) {
 	return n - 4, err
 }
 
+// getBuf returns a pooled buffer of exactly n bytes, growing it if needed
+func (t *tun) getBuf(n int) *[]byte {
+	bp := t.bufs.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
 func (t *tun) addIp(cidr netip.Prefix) error {
 	if cidr.Addr().Is4() {
 		var req ifreqAlias4
@@ -311,11 +324,11 @@ func (t *tun) Name() string {
 }
 
 func (t *tun) SupportsMultiqueue() bool {
-	return false
+	return true
 }
 
 func (t *tun) NewMultiQueueReader() (io.ReadWriteCloser, error) {
-	return nil, fmt.Errorf("TODO: multiqueue not implemented for openbsd")
+	return sharedQueue{t}, nil
 }
 
 func (t *tun) addRoutes(logErrors bool) error {
@@ -0,0 +1,64 @@
+package overlay
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// VpnSettings is how the tun device should be set up. When nebula is handed an existing tun fd, as it is on Android, it
+// can not install routes or set DNS on its own and the app that owns the device has to apply these instead, for example
+// with a VpnService.Builder.
+type VpnSettings struct {
+	// Networks are the addresses from our certificate to assign to the device
+	Networks []netip.Prefix `json:"networks"`
+	// Routes are the unsafe_routes that should be sent to the device, routes with install: false are left out
+	Routes []netip.Prefix `json:"routes"`
+	// DNS and SearchDomains come from tun.dns, nebula itself does nothing with them
+	DNS           []netip.Addr `json:"dns"`
+	SearchDomains []string     `json:"searchDomains"`
+	MTU           int          `json:"mtu"`
+}
+
+// NewVpnSettingsFromConfig builds the settings a host app should apply to the tun device for the current config
+func NewVpnSettingsFromConfig(c *config.C, vpnNetworks []netip.Prefix) (VpnSettings, error) {
+	s := VpnSettings{
+		Networks:      slices.Clone(vpnNetworks),
+		Routes:        []netip.Prefix{},
+		DNS:           []netip.Addr{},
+		SearchDomains: c.GetStringSlice("tun.dns.search", []string{}),
+		MTU:           c.GetInt("tun.mtu", DefaultMTU),
+	}
+
+	unsafeRoutes, err := parseUnsafeRoutes(c, vpnNetworks)
+	if err != nil {
+		return VpnSettings{}, fmt.Errorf("could not parse tun.unsafe_routes: %w", err)
+	}
+
+	for _, r := range unsafeRoutes {
+		if r.Install {
+			s.Routes = append(s.Routes, r.Cidr)
+		}
+	}
+
+	for i, raw := range c.GetStringSlice("tun.dns.servers", []string{}) {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			return VpnSettings{}, fmt.Errorf("entry %v in tun.dns.servers is not a valid ip address: %w", i+1, err)
+		}
+		s.DNS = append(s.DNS, addr)
+	}
+
+	return s, nil
+}
+
+// Equal reports whether the host app would need to reconfigure the device to go from s to o
+func (s VpnSettings) Equal(o VpnSettings) bool {
+	return s.MTU == o.MTU &&
+		slices.Equal(s.Networks, o.Networks) &&
+		slices.Equal(s.Routes, o.Routes) &&
+		slices.Equal(s.DNS, o.DNS) &&
+		slices.Equal(s.SearchDomains, o.SearchDomains)
+}
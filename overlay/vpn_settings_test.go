@@ -0,0 +1,59 @@
+package overlay
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewVpnSettingsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	n := netip.MustParsePrefix("10.0.0.1/24")
+
+	s, err := NewVpnSettingsFromConfig(c, []netip.Prefix{n})
+	require.NoError(t, err)
+	assert.Equal(t, VpnSettings{
+		Networks:      []netip.Prefix{n},
+		Routes:        []netip.Prefix{},
+		DNS:           []netip.Addr{},
+		SearchDomains: []string{},
+		MTU:           DefaultMTU,
+	}, s)
+
+	c.Settings["tun"] = map[string]any{
+		"mtu": 1400,
+		"unsafe_routes": []any{
+			map[string]any{"route": "192.168.1.0/24", "via": "10.0.0.2"},
+			map[string]any{"route": "192.168.2.0/24", "via": "10.0.0.2", "install": false},
+		},
+		"dns": map[string]any{
+			"servers": []any{"10.0.0.53", "fd00::53"},
+			"search":  []any{"corp.example"},
+		},
+	}
+	s, err = NewVpnSettingsFromConfig(c, []netip.Prefix{n})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}, s.Routes)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.53"), netip.MustParseAddr("fd00::53")}, s.DNS)
+	assert.Equal(t, []string{"corp.example"}, s.SearchDomains)
+	assert.Equal(t, 1400, s.MTU)
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"networks":["10.0.0.1/24"],"routes":["192.168.1.0/24"],"dns":["10.0.0.53","fd00::53"],"searchDomains":["corp.example"],"mtu":1400}`, string(b))
+
+	other := s
+	other.DNS = []netip.Addr{netip.MustParseAddr("10.0.0.54"), netip.MustParseAddr("fd00::53")}
+	assert.True(t, s.Equal(s))
+	assert.False(t, s.Equal(other))
+
+	c.Settings["tun"] = map[string]any{"dns": map[string]any{"servers": []any{"dns.example"}}}
+	_, err = NewVpnSettingsFromConfig(c, []netip.Prefix{n})
+	require.ErrorContains(t, err, "entry 1 in tun.dns.servers is not a valid ip address")
+}
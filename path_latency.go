@@ -0,0 +1,254 @@
+package nebula
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+const defaultLatencyHysteresis = 5 * time.Millisecond
+
+// latencyProbeMagic prefixes the payload of test packets sent to measure a path, peers echo the payload back unchanged
+var latencyProbeMagic = []byte("nrtt")
+
+type latencyConfig struct {
+	// hysteresis is how much faster a remote must be before we move a tunnel to it
+	hysteresis time.Duration
+}
+
+func newLatencyConfigFromConfig(c *config.C) *latencyConfig {
+	if !c.GetBool("preferred_latency.enabled", false) {
+		return nil
+	}
+
+	hysteresis := c.GetDuration("preferred_latency.hysteresis", defaultLatencyHysteresis)
+	if hysteresis < 0 {
+		hysteresis = 0
+	}
+
+	return &latencyConfig{hysteresis: hysteresis}
+}
+
+type latencyProbe struct {
+	addr  netip.AddrPort
+	sent  time.Time
+	round uint64
+}
+
+type latencySample struct {
+	rtt   time.Duration
+	round uint64
+}
+
+// pathLatency tracks the round trip time to each remote of a tunnel. Every TryPromoteBest starts a new round of probes,
+// samples from older rounds are considered stale since that remote stopped answering.
+type pathLatency struct {
+	sync.Mutex
+	round   uint64
+	seq     uint64
+	pending map[uint64]latencyProbe
+	samples map[netip.AddrPort]latencySample
+}
+
+// startRound begins a new round of probes and forgets anything too old to be useful
+func (p *pathLatency) startRound() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.round++
+	for seq, probe := range p.pending {
+		if probe.round+1 < p.round {
+			delete(p.pending, seq)
+		}
+	}
+
+	for addr, s := range p.samples {
+		if s.round+1 < p.round {
+			delete(p.samples, addr)
+		}
+	}
+}
+
+// probe returns the payload for a test packet sent to addr
+func (p *pathLatency) probe(addr netip.AddrPort, now time.Time) []byte {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.pending == nil {
+		p.pending = map[uint64]latencyProbe{}
+	}
+
+	p.seq++
+	p.pending[p.seq] = latencyProbe{addr: addr, sent: now, round: p.round}
+	return binary.BigEndian.AppendUint64(bytes.Clone(latencyProbeMagic), p.seq)
+}
+
+// reply records the round trip time of the probe echoed back in d. It returns the remote the probe was sent to, or false
+// if d is not the reply to one of our probes.
+func (p *pathLatency) reply(d []byte, now time.Time) (netip.AddrPort, bool) {
+	if len(d) != len(latencyProbeMagic)+8 || !bytes.HasPrefix(d, latencyProbeMagic) {
+		return netip.AddrPort{}, false
+	}
+	seq := binary.BigEndian.Uint64(d[len(latencyProbeMagic):])
+
+	p.Lock()
+	defer p.Unlock()
+
+	probe, ok := p.pending[seq]
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+	delete(p.pending, seq)
+
+	if p.samples == nil {
+		p.samples = map[netip.AddrPort]latencySample{}
+	}
+
+	// Smooth the samples so a single slow reply does not move the tunnel around
+	rtt := now.Sub(probe.sent)
+	if s, ok := p.samples[probe.addr]; ok {
+		rtt = (s.rtt*7 + rtt) / 8
+	}
+	p.samples[probe.addr] = latencySample{rtt: rtt, round: p.round}
+
+	return probe.addr, true
+}
+
+// better returns true if candidate has been measured to be faster than current by more than hysteresis
+func (p *pathLatency) better(current, candidate netip.AddrPort, hysteresis time.Duration) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	cur, ok := p.unlockedFresh(current)
+	if !ok {
+		return false
+	}
+
+	cand, ok := p.unlockedFresh(candidate)
+	if !ok {
+		return false
+	}
+
+	return cand.rtt+hysteresis < cur.rtt
+}
+
+// answering returns true if addr replied to a recent probe
+func (p *pathLatency) answering(addr netip.AddrPort) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.unlockedFresh(addr)
+	return ok
+}
+
+func (p *pathLatency) unlockedFresh(addr netip.AddrPort) (latencySample, bool) {
+	s, ok := p.samples[addr]
+	if !ok || s.round+1 < p.round {
+		return s, false
+	}
+	return s, true
+}
+
+// rtt returns the smoothed round trip time to addr, if we have one
+func (p *pathLatency) rtt(addr netip.AddrPort) (time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+	s, ok := p.samples[addr]
+	return s.rtt, ok
+}
+
+// freshRtt returns the smoothed round trip time to addr if it replied to a recent probe
+func (p *pathLatency) freshRtt(addr netip.AddrPort) (time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+	s, ok := p.unlockedFresh(addr)
+	return s.rtt, ok
+}
+
+// probeLatency sends a test packet to every remote we know of for this host, including the current one, so the
+// replies can be compared in handleLatencyReply
+func (i *HostInfo) probeLatency(preferredRanges []netip.Prefix, ifce *Interface) {
+	i.paths.startRound()
+
+	now := time.Now()
+	sent := false
+	probe := func(addr netip.AddrPort) {
+		if !addr.IsValid() {
+			return
+		}
+		ifce.sendTo(header.Test, header.TestRequest, i.ConnectionState, i, addr, i.paths.probe(addr, now), make([]byte, 12, 12), make([]byte, mtu))
+	}
+
+	i.remotes.ForEach(preferredRanges, func(addr netip.AddrPort, _ bool) {
+		if addr == i.remote {
+			sent = true
+		}
+		probe(addr)
+	})
+
+	if !sent {
+		probe(i.remote)
+	}
+}
+
+// handleLatencyReply records a reply to one of our latency probes and moves the tunnel to a faster remote if there is
+// one. It returns false if d was not a latency probe, in which case the packet should be treated normally.
+func (f *Interface) handleLatencyReply(hostinfo *HostInfo, via ViaSender, d []byte) bool {
+	if via.IsRelayed {
+		return false
+	}
+
+	addr, ok := hostinfo.paths.reply(d, time.Now())
+	if !ok {
+		return false
+	}
+
+	if addr == hostinfo.remote || !hostinfo.remote.IsValid() {
+		return true
+	}
+
+	if !f.fasterThan(hostinfo, addr, hostinfo.remote) {
+		return true
+	}
+
+	if !hostinfo.lastRoam.IsZero() && time.Since(hostinfo.lastRoam) < RoamingSuppressSeconds*time.Second {
+		return true
+	}
+
+	if !f.lightHouse.GetRemoteAllowList().AllowAll(hostinfo.vpnAddrs, addr.Addr()) {
+		return true
+	}
+
+	curRtt, _ := hostinfo.paths.rtt(hostinfo.remote)
+	newRtt, _ := hostinfo.paths.rtt(addr)
+	hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
+		WithField("rtt", curRtt).WithField("newRtt", newRtt).
+		Info("Host roamed to a lower latency udp ip/port.")
+
+	hostinfo.lastRoam = time.Now()
+	hostinfo.lastRoamRemote = hostinfo.remote
+	hostinfo.SetRemote(addr)
+	return true
+}
+
+// fasterThan returns true if preferred_latency is enabled and a should be used over b. Preferred ranges still win,
+// latency is only compared between remotes that are equally preferred.
+func (f *Interface) fasterThan(hostinfo *HostInfo, a, b netip.AddrPort) bool {
+	lc := f.hostMap.GetLatencyConfig()
+	if lc == nil {
+		return false
+	}
+
+	preferredRanges := f.hostMap.GetPreferredRanges()
+	aPreferred := isPreferred(a.Addr(), preferredRanges)
+	bPreferred := isPreferred(b.Addr(), preferredRanges)
+	if aPreferred != bPreferred {
+		return aPreferred && hostinfo.paths.answering(a)
+	}
+
+	return hostinfo.paths.better(b, a, lc.hysteresis)
+}
@@ -0,0 +1,125 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathLatency(t *testing.T) {
+	var p pathLatency
+	a := netip.MustParseAddrPort("1.1.1.1:4242")
+	b := netip.MustParseAddrPort("2.2.2.2:4242")
+	now := time.Now()
+
+	p.startRound()
+	da := p.probe(a, now)
+	db := p.probe(b, now)
+
+	// Not one of ours
+	_, ok := p.reply([]byte("hello"), now)
+	assert.False(t, ok)
+
+	addr, ok := p.reply(da, now.Add(50*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, a, addr)
+
+	addr, ok = p.reply(db, now.Add(10*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, b, addr)
+
+	// A probe is only answered once
+	_, ok = p.reply(db, now.Add(10*time.Millisecond))
+	assert.False(t, ok)
+
+	assert.True(t, p.better(a, b, 5*time.Millisecond))
+	assert.False(t, p.better(b, a, 5*time.Millisecond))
+	assert.False(t, p.better(a, b, time.Second))
+
+	// A single slow reply is smoothed out
+	p.startRound()
+	_, ok = p.reply(p.probe(b, now), now.Add(100*time.Millisecond))
+	require.True(t, ok)
+	assert.True(t, p.better(a, b, 5*time.Millisecond))
+
+	// a stopped answering, it can no longer be compared against
+	p.startRound()
+	assert.False(t, p.better(a, b, 0))
+	assert.False(t, p.answering(a))
+	assert.True(t, p.answering(b))
+}
+
+func TestInterface_handleLatencyReply(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	c := config.NewC(l)
+	c.Settings["preferred_latency"] = map[string]any{"enabled": true, "hysteresis": "5ms"}
+	hostMap.reload(c, true)
+	require.NotNil(t, hostMap.GetLatencyConfig())
+
+	conn := &recordingConn{}
+	lh := newTestLighthouse()
+	lh.remoteAllowList.Store(&RemoteAllowList{})
+	ifce := &Interface{
+		hostMap:        hostMap,
+		outside:        conn,
+		writers:        []udp.Conn{conn},
+		lightHouse:     lh,
+		messageMetrics: newMessageMetricsOnlyRecvError(),
+		l:              l,
+	}
+
+	current := netip.MustParseAddrPort("1.1.1.1:4242")
+	fast := netip.MustParseAddrPort("2.2.2.2:4242")
+	vpnAddr := netip.MustParseAddr("172.1.1.2")
+
+	remotes := NewRemoteList([]netip.Addr{vpnAddr}, nil)
+	remotes.unlockedPrependV4(vpnAddr, netAddrToProtoV4AddrPort(fast.Addr(), fast.Port()))
+
+	suite := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
+	hostinfo := &HostInfo{
+		remote:   current,
+		remotes:  remotes,
+		vpnAddrs: []netip.Addr{vpnAddr},
+		ConnectionState: &ConnectionState{
+			eKey: NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{1}, 0)),
+		},
+	}
+
+	// Every remote is probed, including the current one
+	hostinfo.probeLatency(nil, ifce)
+	assert.ElementsMatch(t, []netip.AddrPort{current, fast}, conn.sent)
+
+	// Test replies that are not latency probes are handled as usual
+	assert.False(t, ifce.handleLatencyReply(hostinfo, ViaSender{UdpAddr: fast}, []byte("")))
+
+	now := time.Now()
+	slowProbe := hostinfo.paths.probe(current, now.Add(-50*time.Millisecond))
+	fastProbe := hostinfo.paths.probe(fast, now.Add(-10*time.Millisecond))
+
+	// A reply does not roam the tunnel to where it came from on its own
+	assert.True(t, ifce.handleLatencyReply(hostinfo, ViaSender{UdpAddr: fast}, fastProbe))
+	assert.Equal(t, current, hostinfo.remote)
+
+	// Once both are measured the faster remote wins
+	assert.True(t, ifce.handleLatencyReply(hostinfo, ViaSender{UdpAddr: current}, slowProbe))
+	assert.True(t, ifce.handleLatencyReply(hostinfo, ViaSender{UdpAddr: fast}, hostinfo.paths.probe(fast, now.Add(-10*time.Millisecond))))
+	assert.Equal(t, fast, hostinfo.remote)
+
+	// and normal roaming back to the slower remote is suppressed
+	ifce.handleHostRoaming(hostinfo, ViaSender{UdpAddr: current})
+	assert.Equal(t, fast, hostinfo.remote)
+
+	// Preferred ranges still take priority
+	hostMap.preferredRanges.Store(&[]netip.Prefix{netip.MustParsePrefix("1.1.1.0/24")})
+	hostinfo.lastRoam = time.Time{}
+	assert.True(t, ifce.handleLatencyReply(hostinfo, ViaSender{UdpAddr: current}, hostinfo.paths.probe(current, now.Add(-50*time.Millisecond))))
+	assert.Equal(t, current, hostinfo.remote)
+}
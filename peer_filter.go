@@ -0,0 +1,179 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// peerFilter decides who we are willing to have a tunnel with at all, before the firewall ever sees a packet. A peer is
+// refused if its certificate matches anything in peer_filter.deny. If peer_filter.allow has any entries the peer must
+// also match one of them. Certificates are only known once a handshake arrives, so when initiating we can only rule
+// out vpn addresses, groups and names are checked when the handshake completes.
+type peerFilter struct {
+	allow    peerMatcher
+	deny     peerMatcher
+	rejected metrics.Counter
+}
+
+type peerMatcher struct {
+	networks *bart.Lite
+	groups   []string
+	names    map[string]struct{}
+}
+
+func newPeerMatcherFromConfig(c *config.C, key string) (peerMatcher, error) {
+	pm := peerMatcher{names: map[string]struct{}{}}
+
+	for i, raw := range c.GetStringSlice(key+".cidrs", []string{}) {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return pm, fmt.Errorf("%s.cidrs entry %d is not a valid cidr: %w", key, i+1, err)
+		}
+
+		if pm.networks == nil {
+			pm.networks = new(bart.Lite)
+		}
+		pm.networks.Insert(prefix.Masked())
+	}
+
+	pm.groups = c.GetStringSlice(key+".groups", []string{})
+	for _, name := range c.GetStringSlice(key+".names", []string{}) {
+		pm.names[name] = struct{}{}
+	}
+
+	return pm, nil
+}
+
+func (pm *peerMatcher) empty() bool {
+	return pm.networks == nil && len(pm.groups) == 0 && len(pm.names) == 0
+}
+
+// onlyNetworks reports if the matcher can be fully evaluated with a vpn address
+func (pm *peerMatcher) onlyNetworks() bool {
+	return len(pm.groups) == 0 && len(pm.names) == 0
+}
+
+func (pm *peerMatcher) matchesAddr(addr netip.Addr) bool {
+	return pm.networks != nil && pm.networks.Contains(addr)
+}
+
+func (pm *peerMatcher) matches(peer *cert.CachedCertificate) bool {
+	if _, ok := pm.names[peer.Certificate.Name()]; ok {
+		return true
+	}
+
+	for _, g := range pm.groups {
+		if _, ok := peer.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	for _, network := range peer.Certificate.Networks() {
+		if pm.matchesAddr(network.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newPeerFilterFromConfig returns nil if peer_filter is not configured
+func newPeerFilterFromConfig(c *config.C) (*peerFilter, error) {
+	allow, err := newPeerMatcherFromConfig(c, "peer_filter.allow")
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := newPeerMatcherFromConfig(c, "peer_filter.deny")
+	if err != nil {
+		return nil, err
+	}
+
+	if allow.empty() && deny.empty() {
+		return nil, nil
+	}
+
+	return &peerFilter{
+		allow:    allow,
+		deny:     deny,
+		rejected: metrics.GetOrRegisterCounter("handshakes.peer_filter.rejected", nil),
+	}, nil
+}
+
+// allowsAddr reports if we may start a handshake with vpnAddr, a nil filter allows everyone
+func (pf *peerFilter) allowsAddr(vpnAddr netip.Addr) bool {
+	if pf == nil {
+		return true
+	}
+
+	if pf.deny.matchesAddr(vpnAddr) {
+		return false
+	}
+
+	if pf.allow.empty() || !pf.allow.onlyNetworks() {
+		// We can not tell until we see their certificate
+		return true
+	}
+
+	return pf.allow.matchesAddr(vpnAddr)
+}
+
+// allows reports if we may have a tunnel with the owner of peer, a nil filter allows everyone
+func (pf *peerFilter) allows(peer *cert.CachedCertificate) bool {
+	if pf == nil {
+		return true
+	}
+
+	if pf.deny.matches(peer) {
+		pf.rejected.Inc(1)
+		return false
+	}
+
+	if !pf.allow.empty() && !pf.allow.matches(peer) {
+		pf.rejected.Inc(1)
+		return false
+	}
+
+	return true
+}
+
+// reloadPeerFilter swaps in a new peer_filter and closes the tunnels it no longer allows
+func (f *Interface) reloadPeerFilter(c *config.C) {
+	if !c.HasChanged("peer_filter") {
+		return
+	}
+
+	pf, err := newPeerFilterFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load peer_filter config, keeping the previous one")
+		return
+	}
+
+	f.peerFilter.Store(pf)
+	if pf == nil {
+		f.l.Info("peer_filter is disabled")
+		return
+	}
+
+	f.l.Info("peer_filter has changed")
+
+	var refused []*HostInfo
+	f.hostMap.ForEachIndex(func(h *HostInfo) {
+		if crt := h.GetCert(); crt != nil && !pf.allows(crt) {
+			refused = append(refused, h)
+		}
+	})
+
+	for _, h := range refused {
+		h.logger(f.l).WithFields(logrus.Fields{"certName": h.GetCert().Certificate.Name()}).
+			Info("peer_filter no longer allows the remote, tearing down the tunnel")
+		f.sendCloseTunnel(h)
+		f.closeTunnel(h)
+	}
+}
@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPeerFilterFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	pf, err := newPeerFilterFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, pf)
+	assert.True(t, pf.allowsAddr(netip.MustParseAddr("10.0.0.1")))
+	assert.True(t, pf.allows(&cert.CachedCertificate{Certificate: &dummyCert{}}))
+
+	require.NoError(t, c.LoadString("peer_filter:\n  allow:\n    cidrs: [nope]"))
+	_, err = newPeerFilterFromConfig(c)
+	require.ErrorContains(t, err, "peer_filter.allow.cidrs entry 1 is not a valid cidr")
+}
+
+func TestPeerFilter(t *testing.T) {
+	l := test.NewLogger()
+	peer := func(name string, addr string, groups ...string) *cert.CachedCertificate {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		return &cert.CachedCertificate{
+			Certificate:    &dummyCert{name: name, networks: []netip.Prefix{netip.MustParsePrefix(addr + "/24")}, groups: groups},
+			InvertedGroups: inverted,
+		}
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+peer_filter:
+  allow:
+    cidrs: [10.0.0.0/24]
+  deny:
+    cidrs: [10.0.0.128/25]
+    names: [evil]
+`))
+	pf, err := newPeerFilterFromConfig(c)
+	require.NoError(t, err)
+
+	assert.True(t, pf.allowsAddr(netip.MustParseAddr("10.0.0.1")))
+	assert.False(t, pf.allowsAddr(netip.MustParseAddr("10.0.0.200")))
+	assert.False(t, pf.allowsAddr(netip.MustParseAddr("10.0.1.1")))
+
+	assert.True(t, pf.allows(peer("good", "10.0.0.1")))
+	assert.False(t, pf.allows(peer("evil", "10.0.0.1")))
+	assert.False(t, pf.allows(peer("good", "10.0.0.200")))
+	assert.False(t, pf.allows(peer("good", "10.0.1.1")))
+
+	// Groups can only be checked once we have their certificate
+	require.NoError(t, c.ReloadConfigString(`
+peer_filter:
+  allow:
+    groups: [ops]
+  deny:
+    groups: [contractors]
+`))
+	pf, err = newPeerFilterFromConfig(c)
+	require.NoError(t, err)
+
+	assert.True(t, pf.allowsAddr(netip.MustParseAddr("10.0.1.1")))
+	assert.True(t, pf.allows(peer("a", "10.0.1.1", "ops")))
+	assert.False(t, pf.allows(peer("b", "10.0.1.1", "dev")))
+	assert.False(t, pf.allows(peer("c", "10.0.1.1", "ops", "contractors")))
+}
@@ -14,9 +14,12 @@ import (
 	"time"
 
 	"github.com/gaissmai/bart"
+	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/keyprovider"
+	"github.com/slackhq/nebula/noiseutil"
 	"github.com/slackhq/nebula/util"
 )
 
@@ -24,6 +27,9 @@ type PKI struct {
 	cs     atomic.Pointer[CertState]
 	caPool atomic.Pointer[cert.CAPool]
 	l      *logrus.Logger
+
+	// checkCertState refuses a reloaded CertState that may not be used, like a non P256 certificate in security.fips mode
+	checkCertState func(*CertState) error
 }
 
 type CertState struct {
@@ -35,7 +41,7 @@ type CertState struct {
 
 	initiatingVersion cert.Version
 	privateKey        []byte
-	pkcs11Backed      bool
+	keyInDevice       bool
 	cipher            string
 
 	myVpnNetworks            []netip.Prefix
@@ -161,8 +167,15 @@ func (p *PKI) reloadCerts(c *config.C, initial bool) *util.ContextualError {
 		// Cipher cant be hot swapped so just leave it at what it was before
 		newState.cipher = currentState.cipher
 
+		if p.checkCertState != nil {
+			if err := p.checkCertState(newState); err != nil {
+				return util.NewContextualError("Refusing to use the new cert", nil, err)
+			}
+		}
+
 	} else {
 		newState.cipher = c.GetString("cipher", "aes")
+
 		//TODO: this sucks and we should make it not a global
 		switch newState.cipher {
 		case "aes":
@@ -176,6 +189,8 @@ func (p *PKI) reloadCerts(c *config.C, initial bool) *util.ContextualError {
 				nil,
 			)
 		}
+
+		p.logCipher(newState.cipher)
 	}
 
 	p.cs.Store(newState)
@@ -188,6 +203,25 @@ func (p *PKI) reloadCerts(c *config.C, initial bool) *util.ContextualError {
 	return nil
 }
 
+// logCipher reports the cipher in use, how this host accelerates it, and which cipher would be fastest here. It is only
+// advice, every host must use the same cipher so a mixed network has to pick one for all of them.
+func (p *PKI) logCipher(cipher string) {
+	accel := noiseutil.Acceleration(cipher)
+	l := p.l.WithField("cipher", cipher).WithField("acceleration", accel).WithField("fastest", noiseutil.FastestCipher())
+
+	accelerated := int64(0)
+	if accel != "" {
+		accelerated = 1
+		l.Info("Using cipher")
+	} else if cipher == "aes" {
+		l.Warn("Using cipher aes without hardware acceleration, chachapoly is faster on this host but every host must use the same cipher")
+	} else {
+		l.Info("Using cipher without hardware acceleration")
+	}
+
+	metrics.GetOrRegisterGauge("cipher.accelerated", nil).Update(accelerated)
+}
+
 func (p *PKI) reloadCAPool(c *config.C) *util.ContextualError {
 	caPool, err := loadCAPoolFromConfig(p.l, c)
 	if err != nil {
@@ -207,6 +241,16 @@ func (cs *CertState) GetDefaultCertificate() cert.Certificate {
 	return c
 }
 
+// unsafeNetworksContain reports if the prefix is entirely within one of the unsafe networks of the default certificate
+func (cs *CertState) unsafeNetworksContain(p netip.Prefix) bool {
+	for _, n := range cs.GetDefaultCertificate().UnsafeNetworks() {
+		if n.Bits() <= p.Bits() && n.Contains(p.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cs *CertState) getCertificate(v cert.Version) cert.Certificate {
 	switch v {
 	case cert.Version1:
@@ -263,12 +307,15 @@ func (cs *CertState) MarshalJSON() ([]byte, error) {
 func newCertStateFromConfig(c *config.C) (*CertState, error) {
 	var err error
 
-	privPathOrPEM := c.GetString("pki.key", "")
+	privPathOrPEM, err := c.GetSecret("pki.key", "")
+	if err != nil {
+		return nil, err
+	}
 	if privPathOrPEM == "" {
 		return nil, errors.New("no pki.key path or PEM data provided")
 	}
 
-	rawKey, curve, isPkcs11, err := loadPrivateKey(privPathOrPEM)
+	rawKey, curve, inDevice, err := loadPrivateKey(privPathOrPEM)
 	if err != nil {
 		return nil, err
 	}
@@ -344,13 +391,13 @@ func newCertStateFromConfig(c *config.C) (*CertState, error) {
 		return nil, fmt.Errorf("unknown pki.initiating_version: %v", rawInitiatingVersion)
 	}
 
-	return newCertState(initiatingVersion, v1, v2, isPkcs11, curve, rawKey)
+	return newCertState(initiatingVersion, v1, v2, inDevice, curve, rawKey)
 }
 
-func newCertState(dv cert.Version, v1, v2 cert.Certificate, pkcs11backed bool, privateKeyCurve cert.Curve, privateKey []byte) (*CertState, error) {
+func newCertState(dv cert.Version, v1, v2 cert.Certificate, keyInDevice bool, privateKeyCurve cert.Curve, privateKey []byte) (*CertState, error) {
 	cs := CertState{
 		privateKey:               privateKey,
-		pkcs11Backed:             pkcs11backed,
+		keyInDevice:              keyInDevice,
 		myVpnNetworksTable:       new(bart.Lite),
 		myVpnAddrsTable:          new(bart.Lite),
 		myVpnBroadcastAddrsTable: new(bart.Lite),
@@ -373,8 +420,11 @@ func newCertState(dv cert.Version, v1, v2 cert.Certificate, pkcs11backed bool, p
 	}
 
 	if v1 != nil {
-		if pkcs11backed {
-			//NOTE: We do not currently have a method to verify a public private key pair when the private key is in an hsm
+		if keyInDevice {
+			//NOTE: We do not currently have a method to verify a public private key pair when the private key is in a device
+			if v1.Curve() != privateKeyCurve {
+				return nil, fmt.Errorf("private key curve %s does not match the nebula cert curve %s", privateKeyCurve, v1.Curve())
+			}
 		} else {
 			if err := v1.VerifyPrivateKey(privateKeyCurve, privateKey); err != nil {
 				return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
@@ -394,8 +444,11 @@ func newCertState(dv cert.Version, v1, v2 cert.Certificate, pkcs11backed bool, p
 	}
 
 	if v2 != nil {
-		if pkcs11backed {
-			//NOTE: We do not currently have a method to verify a public private key pair when the private key is in an hsm
+		if keyInDevice {
+			//NOTE: We do not currently have a method to verify a public private key pair when the private key is in a device
+			if v2.Curve() != privateKeyCurve {
+				return nil, fmt.Errorf("private key curve %s does not match the nebula cert curve %s", privateKeyCurve, v2.Curve())
+			}
 		} else {
 			if err := v2.VerifyPrivateKey(privateKeyCurve, privateKey); err != nil {
 				return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
@@ -439,7 +492,7 @@ func newCertState(dv cert.Version, v1, v2 cert.Certificate, pkcs11backed bool, p
 	return &cs, nil
 }
 
-func loadPrivateKey(privPathOrPEM string) (rawKey []byte, curve cert.Curve, isPkcs11 bool, err error) {
+func loadPrivateKey(privPathOrPEM string) (rawKey []byte, curve cert.Curve, inDevice bool, err error) {
 	var pemPrivateKey []byte
 	if strings.Contains(privPathOrPEM, "-----BEGIN") {
 		pemPrivateKey = []byte(privPathOrPEM)
@@ -448,9 +501,12 @@ func loadPrivateKey(privPathOrPEM string) (rawKey []byte, curve cert.Curve, isPk
 		if err != nil {
 			return nil, curve, false, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
 		}
-	} else if strings.HasPrefix(privPathOrPEM, "pkcs11:") {
-		rawKey = []byte(privPathOrPEM)
-		return rawKey, cert.Curve_P256, true, nil
+	} else if p, ok := keyprovider.Lookup(privPathOrPEM); ok {
+		key, err := p.Load(privPathOrPEM)
+		if err != nil {
+			return nil, curve, false, fmt.Errorf("error while loading pki.key from %s: %w", strings.SplitN(privPathOrPEM, ":", 2)[0], err)
+		}
+		return key.Private, key.Curve, key.InDevice, nil
 	} else {
 		pemPrivateKey, err = os.ReadFile(privPathOrPEM)
 		if err != nil {
@@ -523,13 +579,63 @@ func loadCAPoolFromConfig(l *logrus.Logger, c *config.C) (*cert.CAPool, error) {
 		return nil, fmt.Errorf("error while adding CA certificate to CA trust store: %s", err)
 	}
 
+	// Entries are fingerprints unless they are name:<name or glob> or group:<group>, during an incident the name or
+	// group of a cert is often all that is known
 	bl := c.GetStringSlice("pki.blocklist", []string{})
 	if len(bl) > 0 {
-		for _, fp := range bl {
-			caPool.BlocklistFingerprint(fp)
+		var fingerprints, names, groups int
+		for _, entry := range bl {
+			switch {
+			case strings.HasPrefix(entry, "name:"):
+				if err := caPool.BlocklistName(strings.TrimPrefix(entry, "name:")); err != nil {
+					return nil, fmt.Errorf("invalid pki.blocklist entry %q: %w", entry, err)
+				}
+				names++
+			case strings.HasPrefix(entry, "group:"):
+				caPool.BlocklistGroup(strings.TrimPrefix(entry, "group:"))
+				groups++
+			default:
+				caPool.BlocklistFingerprint(entry)
+				fingerprints++
+			}
+		}
+
+		l.WithField("fingerprintCount", fingerprints).
+			WithField("nameCount", names).
+			WithField("groupCount", groups).
+			Info("Blocklisted certificates")
+	}
+
+	tolerance := c.GetDuration("pki.clock_skew_tolerance", 0)
+	if tolerance < 0 {
+		return nil, fmt.Errorf("pki.clock_skew_tolerance must not be negative: %v", tolerance)
+	}
+	caPool.SetClockSkewTolerance(tolerance)
+
+	grace := c.GetDuration("pki.expired_grace", 0)
+	if grace < 0 {
+		return nil, fmt.Errorf("pki.expired_grace must not be negative: %v", grace)
+	}
+	caPool.SetExpiredGrace(grace)
+
+	if path := c.GetString("pki.issuance_log.path", ""); path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pki.issuance_log.path file %s: %s", path, err)
+		}
+
+		il, err := cert.UnmarshalIssuanceLog(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error while loading pki.issuance_log.path: %w", err)
+		}
+
+		head := c.GetString("pki.issuance_log.head", "")
+		if head != "" && !il.HasHead(head) {
+			return nil, fmt.Errorf("pki.issuance_log.path does not contain pki.issuance_log.head %s", head)
 		}
 
-		l.WithField("fingerprintCount", len(bl)).Info("Blocklisted certificates")
+		caPool.RequireIssuanceLog(il)
+		l.WithField("entries", il.Len()).WithField("head", il.Head()).Info("Requiring certificates to be in the issuance log")
 	}
 
 	return caPool, nil
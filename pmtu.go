@@ -0,0 +1,87 @@
+package nebula
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/iputil"
+	"github.com/slackhq/nebula/udp"
+)
+
+// With listen.path_mtu_discovery the kernel stops fragmenting our ipv6 packets, so a write larger than what it learned
+// from an ICMPv6 Packet Too Big fails instead. When that happens we ask it for the path mtu to the tunnel's remote and
+// answer inside packets that would not fit with a Packet Too Big of our own, the inside sender then shrinks them.
+
+// pathMTUExpiry matches the kernel's net.ipv6.route.mtu_expires, after it we try larger packets again
+const pathMTUExpiry = 10 * time.Minute
+
+// learnedMTU is the largest inside packet that fits the path to remote
+type learnedMTU struct {
+	remote  netip.AddrPort
+	payload int
+	expires time.Time
+}
+
+// learnPathMTU is called when the encrypted p did not fit the path to hostinfo's remote
+func (f *Interface) learnPathMTU(hostinfo *HostInfo, w udp.Conn, p, out []byte, q int) {
+	pc, ok := w.(udp.PathMTUConn)
+	if !ok {
+		return
+	}
+
+	remote := hostinfo.remote
+	mtu, err := pc.PathMTU(remote)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).WithField("udpAddr", remote).Error("Failed to get the path mtu")
+		return
+	}
+
+	overhead := 40 + 8 + header.Len + hostinfo.ConnectionState.eKey.Overhead()
+	if remote.Addr().Unmap().Is4() {
+		overhead -= 20
+	}
+
+	payload := mtu - overhead
+	if payload <= 0 {
+		return
+	}
+
+	hostinfo.pathMTU.Store(&learnedMTU{remote: remote, payload: payload, expires: time.Now().Add(pathMTUExpiry)})
+	hostinfo.logger(f.l).WithFields(logrus.Fields{"udpAddr": remote, "pathMTU": mtu, "payload": payload}).
+		Info("Packet did not fit the path to the remote, limiting tunnel packet size")
+
+	f.sendPacketTooBig(p, out, q, payload)
+}
+
+// fitsPathMTU reports whether packet can be sent to hostinfo, the inside sender is told when it can not
+func (f *Interface) fitsPathMTU(hostinfo *HostInfo, packet, out []byte, q int) bool {
+	pm := hostinfo.pathMTU.Load()
+	if pm == nil || len(packet) <= pm.payload {
+		return true
+	}
+
+	if pm.remote != hostinfo.remote || time.Now().After(pm.expires) {
+		// The tunnel moved or the kernel forgot the path, the next write that does not fit tells us again
+		hostinfo.pathMTU.CompareAndSwap(pm, nil)
+		return true
+	}
+
+	f.sendPacketTooBig(packet, out, q, pm.payload)
+	return false
+}
+
+func (f *Interface) sendPacketTooBig(packet, out []byte, q int, mtu int) {
+	if f.macs != nil {
+		// A tap device wants ethernet frames
+		return
+	}
+
+	out = iputil.CreatePacketTooBig(packet, out, mtu)
+	if len(out) == 0 {
+		return
+	}
+
+	f.writeToTun(nil, out, q)
+}
@@ -0,0 +1,75 @@
+package nebula
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/slackhq/nebula/noiseutil"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pathMTUConn reports a fixed path mtu
+type pathMTUConn struct {
+	udp.NoopConn
+	mtu int
+}
+
+func (c *pathMTUConn) PathMTU(_ netip.AddrPort) (int, error) {
+	return c.mtu, nil
+}
+
+func newIPv6Packet(size int) []byte {
+	p := make([]byte, size)
+	p[0] = 0x60
+	p[6] = 17
+	copy(p[8:24], netip.MustParseAddr("fd00::1").AsSlice())
+	copy(p[24:40], netip.MustParseAddr("fd00::2").AsSlice())
+	return p
+}
+
+func TestInterface_pathMTU(t *testing.T) {
+	tun := &benchTun{}
+	f := &Interface{l: test.NewLogger(), readers: []io.ReadWriteCloser{tun}}
+	suite := noise.NewCipherSuite(noise.DH25519, noiseutil.CipherAESGCM, noise.HashSHA256)
+	hostinfo := &HostInfo{
+		remote:          netip.MustParseAddrPort("[2001:db8::1]:4242"),
+		ConnectionState: &ConnectionState{eKey: NewNebulaCipherState(noise.UnsafeNewCipherState(suite, [32]byte{}, 0))},
+	}
+	out := make([]byte, mtu)
+
+	// Nothing learned yet
+	assert.True(t, f.fitsPathMTU(hostinfo, newIPv6Packet(1400), out, 0))
+
+	// 1400 - 40 ipv6 - 8 udp - 16 header - 16 tag
+	f.learnPathMTU(hostinfo, &pathMTUConn{mtu: 1400}, newIPv6Packet(1400), out, 0)
+	require.NotNil(t, hostinfo.pathMTU.Load())
+	assert.Equal(t, 1320, hostinfo.pathMTU.Load().payload)
+	assert.Equal(t, 1280, tun.lastLen)
+
+	tun.lastLen = 0
+	assert.True(t, f.fitsPathMTU(hostinfo, newIPv6Packet(1320), out, 0))
+	assert.Zero(t, tun.lastLen)
+	assert.False(t, f.fitsPathMTU(hostinfo, newIPv6Packet(1321), out, 0))
+	assert.Equal(t, 1280, tun.lastLen)
+
+	// Listeners that can not tell us leave it alone
+	f.learnPathMTU(hostinfo, &udp.NoopConn{}, newIPv6Packet(1400), out, 0)
+	assert.Equal(t, 1320, hostinfo.pathMTU.Load().payload)
+
+	// It is forgotten when the tunnel moves
+	hostinfo.remote = netip.MustParseAddrPort("[2001:db8::2]:4242")
+	assert.True(t, f.fitsPathMTU(hostinfo, newIPv6Packet(1400), out, 0))
+	assert.Nil(t, hostinfo.pathMTU.Load())
+
+	// Or when it expires
+	f.learnPathMTU(hostinfo, &pathMTUConn{mtu: 1400}, newIPv6Packet(1400), out, 0)
+	hostinfo.pathMTU.Load().expires = time.Now().Add(-time.Second)
+	assert.True(t, f.fitsPathMTU(hostinfo, newIPv6Packet(1400), out, 0))
+	assert.Nil(t, hostinfo.pathMTU.Load())
+}
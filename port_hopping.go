@@ -0,0 +1,221 @@
+package nebula
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// Some networks throttle long lived udp flows by port. With listen.port_hopping every host that shares key moves the
+// data of its tunnels to a new port every period. The port of each period is derived from the key, so hosts agree on
+// it without talking, and the port is the same on every host. We listen on the ports of the previous, current, and
+// next period to cover clock skew and packets in flight.
+//
+// Handshakes, lighthouse, and relay traffic stay on listen.port, so static_host_map and the addresses lighthouses hand
+// out do not change, a host that knows the schedule finds the current port of a peer from them. Both hosts say which
+// schedule they follow in the handshake and data only hops between hosts on the same one. Hopped data is sent to the
+// address of the tunnel, hosts behind a NAT that rewrites ports can not receive it and should not enable this.
+
+const (
+	defaultPortHoppingPeriod = time.Minute
+	minPortHoppingPeriod     = 10 * time.Second
+)
+
+// hopSocket is the socket for one period of the schedule, conn is nil when the port could not be opened
+type hopSocket struct {
+	port uint16
+	conn udp.Conn
+}
+
+// portHopper opens and closes the sockets of the port hopping schedule, nil when it is off
+type portHopper struct {
+	l        *logrus.Logger
+	key      [32]byte
+	period   time.Duration
+	min, max uint16
+	// id is sent in handshakes, peers with the same id follow the same schedule
+	id uint32
+	// open binds a socket on port
+	open func(port uint16) (udp.Conn, error)
+
+	sync.Mutex
+	// sockets are the open sockets by period
+	sockets map[int64]*hopSocket
+	current atomic.Pointer[hopSocket]
+	done    chan struct{}
+}
+
+func newPortHopperFromConfig(l *logrus.Logger, c *config.C, open func(port uint16) (udp.Conn, error)) (*portHopper, error) {
+	key, err := c.GetSecret("listen.port_hopping.key", "")
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	ph := &portHopper{
+		l:       l,
+		key:     sha256.Sum256([]byte("nebula port hopping " + key)),
+		period:  c.GetDuration("listen.port_hopping.period", defaultPortHoppingPeriod),
+		open:    open,
+		sockets: map[int64]*hopSocket{},
+		done:    make(chan struct{}),
+	}
+
+	if ph.period < minPortHoppingPeriod {
+		return nil, fmt.Errorf("listen.port_hopping.period must be at least %s", minPortHoppingPeriod)
+	}
+
+	minPort := c.GetInt("listen.port_hopping.min_port", 1024)
+	maxPort := c.GetInt("listen.port_hopping.max_port", 65535)
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return nil, fmt.Errorf("listen.port_hopping.min_port and max_port must be a range of ports between 1 and 65535")
+	}
+	ph.min, ph.max = uint16(minPort), uint16(maxPort)
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(ph.period))
+	binary.BigEndian.PutUint16(b[8:], ph.min)
+	binary.BigEndian.PutUint16(b[10:], ph.max)
+	sum := sha256.Sum256(append(ph.key[:], b[:]...))
+	// 0 means no schedule in the handshake
+	ph.id = binary.BigEndian.Uint32(sum[:4]) | 1
+
+	l.WithFields(logrus.Fields{"period": ph.period, "minPort": ph.min, "maxPort": ph.max}).
+		Info("Hopping tunnel data over the port hopping schedule")
+	return ph, nil
+}
+
+// epoch is the period of the schedule at t
+func (ph *portHopper) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(ph.period)
+}
+
+// port is the port of period e on every host that shares the key
+func (ph *portHopper) port(e int64) uint16 {
+	mac := hmac.New(sha256.New, ph.key[:])
+	_ = binary.Write(mac, binary.BigEndian, e)
+	n := uint32(ph.max-ph.min) + 1
+	return ph.min + uint16(binary.BigEndian.Uint32(mac.Sum(nil))%n)
+}
+
+// start opens the sockets for now and keeps them following the schedule until close, listen reads from a new socket
+func (ph *portHopper) start(listen func(udp.Conn)) {
+	ph.rotate(time.Now(), listen)
+
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Unix(0, (ph.epoch(now)+1)*int64(ph.period))
+			select {
+			case <-ph.done:
+				return
+			case <-time.After(next.Sub(now)):
+				ph.rotate(time.Now(), listen)
+			}
+		}
+	}()
+}
+
+// rotate opens the sockets of the periods around now and closes the ones before them
+func (ph *portHopper) rotate(now time.Time, listen func(udp.Conn)) {
+	ph.Lock()
+	defer ph.Unlock()
+
+	e := ph.epoch(now)
+	for i := e - 1; i <= e+1; i++ {
+		if _, ok := ph.sockets[i]; ok {
+			continue
+		}
+
+		port := ph.port(i)
+		// Two periods can land on the same port, they share the socket
+		s := ph.socketForPort(port)
+		if s == nil {
+			s = &hopSocket{port: port}
+			conn, err := ph.open(port)
+			if err != nil {
+				ph.l.WithError(err).WithField("port", port).Error("Failed to open the port hopping socket")
+			} else {
+				s.conn = conn
+				listen(conn)
+			}
+		}
+		ph.sockets[i] = s
+	}
+
+	for i, s := range ph.sockets {
+		if i >= e-1 {
+			continue
+		}
+		delete(ph.sockets, i)
+		if s.conn != nil && ph.socketForPort(s.port) == nil {
+			_ = s.conn.Close()
+		}
+	}
+
+	ph.current.Store(ph.sockets[e])
+	if ph.l.Level >= logrus.DebugLevel {
+		ph.l.WithField("port", ph.sockets[e].port).Debug("Hopped tunnel data to a new port")
+	}
+}
+
+// socketForPort finds a socket of a period we are still in, ph must be locked
+func (ph *portHopper) socketForPort(port uint16) *hopSocket {
+	for _, s := range ph.sockets {
+		if s.port == port {
+			return s
+		}
+	}
+	return nil
+}
+
+// writer picks the socket and address data to hostinfo is sent to, ok is false if it does not follow our schedule
+func (ph *portHopper) writer(hostinfo *HostInfo) (w udp.Conn, addr netip.AddrPort, ok bool) {
+	if ph == nil || hostinfo.ConnectionState.peerHopSchedule != ph.id {
+		return nil, addr, false
+	}
+
+	s := ph.current.Load()
+	if s == nil || s.conn == nil {
+		return nil, addr, false
+	}
+
+	return s.conn, netip.AddrPortFrom(hostinfo.remote.Addr(), s.port), true
+}
+
+// scheduleID is what we send in handshakes
+func (ph *portHopper) scheduleID() uint32 {
+	if ph == nil {
+		return 0
+	}
+	return ph.id
+}
+
+func (ph *portHopper) close() {
+	if ph == nil {
+		return
+	}
+
+	close(ph.done)
+	ph.Lock()
+	defer ph.Unlock()
+	closed := map[udp.Conn]struct{}{}
+	for _, s := range ph.sockets {
+		if _, ok := closed[s.conn]; s.conn != nil && !ok {
+			_ = s.conn.Close()
+			closed[s.conn] = struct{}{}
+		}
+	}
+	ph.sockets = map[int64]*hopSocket{}
+}
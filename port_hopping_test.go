@@ -0,0 +1,136 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeCountingConn struct {
+	udp.NoopConn
+	port   uint16
+	closed int
+}
+
+func (c *closeCountingConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func newTestPortHopper(t *testing.T, settings map[string]any, open func(port uint16) (udp.Conn, error)) *portHopper {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["listen"] = map[string]any{"port_hopping": settings}
+	ph, err := newPortHopperFromConfig(l, c, open)
+	require.NoError(t, err)
+	return ph
+}
+
+func TestNewPortHopperFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	ph, err := newPortHopperFromConfig(l, c, nil)
+	require.NoError(t, err)
+	assert.Nil(t, ph)
+	assert.Equal(t, uint32(0), ph.scheduleID())
+
+	ph = newTestPortHopper(t, map[string]any{"key": "hunter2"}, nil)
+	assert.Equal(t, defaultPortHoppingPeriod, ph.period)
+	assert.Equal(t, uint16(1024), ph.min)
+	assert.Equal(t, uint16(65535), ph.max)
+	assert.NotZero(t, ph.scheduleID())
+
+	// Hosts with the same settings follow the same schedule, any difference is another one
+	assert.Equal(t, ph.id, newTestPortHopper(t, map[string]any{"key": "hunter2"}, nil).id)
+	assert.NotEqual(t, ph.id, newTestPortHopper(t, map[string]any{"key": "hunter3"}, nil).id)
+	assert.NotEqual(t, ph.id, newTestPortHopper(t, map[string]any{"key": "hunter2", "period": "2m"}, nil).id)
+	assert.NotEqual(t, ph.id, newTestPortHopper(t, map[string]any{"key": "hunter2", "min_port": 2000}, nil).id)
+
+	// The key may be a secret reference
+	t.Setenv("NEBULA_TEST_PORT_HOPPING_KEY", "hunter2")
+	assert.Equal(t, ph.id, newTestPortHopper(t, map[string]any{"key": "env://NEBULA_TEST_PORT_HOPPING_KEY"}, nil).id)
+	c.Settings["listen"] = map[string]any{"port_hopping": map[string]any{"key": "env://NEBULA_TEST_MISSING"}}
+	_, err = newPortHopperFromConfig(l, c, nil)
+	require.EqualError(t, err, "unable to resolve listen.port_hopping.key: environment variable NEBULA_TEST_MISSING is not set")
+
+	for _, bad := range []map[string]any{
+		{"key": "hunter2", "period": "1s"},
+		{"key": "hunter2", "min_port": 0},
+		{"key": "hunter2", "max_port": 65536},
+		{"key": "hunter2", "min_port": 3000, "max_port": 2000},
+	} {
+		c.Settings["listen"] = map[string]any{"port_hopping": bad}
+		_, err = newPortHopperFromConfig(l, c, nil)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestPortHopper_port(t *testing.T) {
+	ph := newTestPortHopper(t, map[string]any{"key": "hunter2", "min_port": 20000, "max_port": 20099}, nil)
+	other := newTestPortHopper(t, map[string]any{"key": "hunter2", "min_port": 20000, "max_port": 20099}, nil)
+
+	seen := map[uint16]struct{}{}
+	for e := range int64(100) {
+		p := ph.port(e)
+		assert.Equal(t, p, other.port(e))
+		assert.GreaterOrEqual(t, p, uint16(20000))
+		assert.LessOrEqual(t, p, uint16(20099))
+		seen[p] = struct{}{}
+	}
+	assert.Greater(t, len(seen), 30, "ports should spread over the range")
+
+	now := time.Unix(1_700_000_000, 0)
+	assert.Equal(t, ph.epoch(now)+1, ph.epoch(now.Add(ph.period)))
+}
+
+func TestPortHopper_rotate(t *testing.T) {
+	opened := map[uint16]*closeCountingConn{}
+	var listened []udp.Conn
+	ph := newTestPortHopper(t, map[string]any{"key": "hunter2", "period": "1m"}, func(port uint16) (udp.Conn, error) {
+		c := &closeCountingConn{port: port}
+		opened[port] = c
+		return c, nil
+	})
+	listen := func(c udp.Conn) { listened = append(listened, c) }
+
+	now := time.Unix(1_700_000_000, 0)
+	e := ph.epoch(now)
+	ph.rotate(now, listen)
+	assert.Len(t, ph.sockets, 3)
+	assert.Len(t, listened, len(opened))
+	assert.Equal(t, ph.port(e), ph.current.Load().port)
+
+	// Moving one period on opens the next port and closes the oldest
+	oldest := ph.sockets[e-1]
+	ph.rotate(now.Add(time.Minute), listen)
+	assert.Len(t, ph.sockets, 3)
+	assert.Equal(t, ph.port(e+1), ph.current.Load().port)
+	assert.NotContains(t, ph.sockets, e-1)
+	if ph.socketForPort(oldest.port) == nil {
+		assert.Equal(t, 1, oldest.conn.(*closeCountingConn).closed)
+	}
+
+	// Data to peers on our schedule goes to their hop port, everyone else keeps the tunnel address
+	hostinfo := &HostInfo{remote: netip.MustParseAddrPort("1.2.3.4:4242"), ConnectionState: &ConnectionState{}}
+	_, _, ok := ph.writer(hostinfo)
+	assert.False(t, ok)
+
+	hostinfo.ConnectionState.peerHopSchedule = ph.id
+	w, addr, ok := ph.writer(hostinfo)
+	require.True(t, ok)
+	assert.Equal(t, netip.AddrPortFrom(hostinfo.remote.Addr(), ph.port(e+1)), addr)
+	assert.Same(t, ph.current.Load().conn, w)
+
+	ph.close()
+	for _, c := range opened {
+		assert.LessOrEqual(t, c.closed, 1)
+	}
+	assert.Empty(t, ph.sockets)
+}
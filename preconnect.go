@@ -0,0 +1,179 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// preconnectInterval is how often we make sure there is a tunnel, or a handshake, to every preconnect host
+const preconnectInterval = 5 * time.Second
+
+// preconnect keeps tunnels up to the hosts in tunnels.preconnect so the first packet to them never waits on a handshake
+type preconnect struct {
+	l       *logrus.Logger
+	f       *Interface
+	targets atomic.Pointer[preconnectTargets]
+
+	// seen holds the hosts we learned are in a preconnect group from a tunnel to them. We only know a host's groups
+	// once we have its certificate, so a group can not bring up the first tunnel to a host.
+	sync.Mutex
+	seen map[netip.Addr]struct{}
+}
+
+type preconnectTargets struct {
+	addrs  map[netip.Addr]struct{}
+	groups []string
+}
+
+func newPreconnectFromConfig(l *logrus.Logger, c *config.C, f *Interface) *preconnect {
+	p := &preconnect{l: l, f: f, seen: map[netip.Addr]struct{}{}}
+	p.reload(c, true)
+	c.RegisterReloadCallback(func(c *config.C) {
+		p.reload(c, false)
+	})
+	return p
+}
+
+func (p *preconnect) reload(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("tunnels.preconnect") {
+		return
+	}
+
+	t := &preconnectTargets{addrs: map[netip.Addr]struct{}{}}
+	for _, v := range c.GetStringSlice("tunnels.preconnect", []string{}) {
+		// Anything that is not an address is a group
+		if addr, err := netip.ParseAddr(v); err == nil {
+			t.addrs[addr] = struct{}{}
+		} else {
+			t.groups = append(t.groups, v)
+		}
+	}
+
+	p.targets.Store(t)
+
+	// Forget hosts from groups that may no longer be listed, they are learned again from the tunnels we have
+	p.Lock()
+	p.seen = map[netip.Addr]struct{}{}
+	p.Unlock()
+
+	if !initial {
+		p.l.WithField("addrs", len(t.addrs)).WithField("groups", t.groups).Info("tunnels.preconnect has changed")
+	}
+}
+
+// wants reports whether the tunnel to h should be kept up even when idle
+func (p *preconnect) wants(h *HostInfo) bool {
+	if p == nil {
+		return false
+	}
+
+	t := p.targets.Load()
+	for _, addr := range h.vpnAddrs {
+		if _, ok := t.addrs[addr]; ok {
+			return true
+		}
+	}
+
+	if len(t.groups) == 0 {
+		return false
+	}
+
+	crt := h.GetCert()
+	if crt == nil {
+		return false
+	}
+
+	for _, g := range t.groups {
+		if _, ok := crt.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *preconnect) Start(ctx context.Context) {
+	p.connect()
+
+	ticker := time.NewTicker(preconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.connect()
+		}
+	}
+}
+
+// connect starts a handshake with every preconnect host we do not have a tunnel to, the handshake manager skips any
+// that are already handshaking
+func (p *preconnect) connect() {
+	t := p.targets.Load()
+	if len(t.groups) > 0 {
+		p.learnGroups(t)
+	}
+
+	p.Lock()
+	addrs := make([]netip.Addr, 0, len(t.addrs)+len(p.seen))
+	for addr := range t.addrs {
+		addrs = append(addrs, addr)
+	}
+	for addr := range p.seen {
+		addrs = append(addrs, addr)
+	}
+	p.Unlock()
+
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+
+	for _, addr := range addrs {
+		if p.f.myVpnAddrsTable.Contains(addr) {
+			continue
+		}
+
+		if p.f.hostMap.QueryVpnAddr(addr) != nil {
+			continue
+		}
+
+		if p.l.Level >= logrus.DebugLevel {
+			p.l.WithField("vpnAddr", addr).Debug("Preconnecting")
+		}
+		p.f.handshakeManager.StartHandshake(addr, nil)
+	}
+}
+
+// learnGroups remembers the hosts we have tunnels with that are in a preconnect group
+func (p *preconnect) learnGroups(t *preconnectTargets) {
+	var found []netip.Addr
+	p.f.hostMap.RLock()
+	for _, h := range p.f.hostMap.Hosts {
+		crt := h.GetCert()
+		if crt == nil {
+			continue
+		}
+
+		for _, g := range t.groups {
+			if _, ok := crt.InvertedGroups[g]; ok {
+				found = append(found, h.vpnAddrs[0])
+				break
+			}
+		}
+	}
+	p.f.hostMap.RUnlock()
+
+	p.Lock()
+	for _, addr := range found {
+		p.seen[addr] = struct{}{}
+	}
+	p.Unlock()
+}
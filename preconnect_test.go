@@ -0,0 +1,141 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreconnect(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	lh := newTestLighthouse()
+	myVpnAddrsTable := new(bart.Lite)
+	myVpnAddrsTable.Insert(netip.MustParsePrefix("10.42.0.1/32"))
+	f := &Interface{
+		hostMap:          hostMap,
+		lightHouse:       lh,
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		myVpnAddrsTable:  myVpnAddrsTable,
+		l:                l,
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+tunnels:
+  preconnect:
+    - 10.42.0.1
+    - 10.42.0.5
+    - databases
+`))
+	p := newPreconnectFromConfig(l, c, f)
+
+	newHostInfo := func(addr string, groups ...string) *HostInfo {
+		ig := map[string]struct{}{}
+		for _, g := range groups {
+			ig[g] = struct{}{}
+		}
+		return &HostInfo{
+			vpnAddrs: []netip.Addr{netip.MustParseAddr(addr)},
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: ig},
+			},
+		}
+	}
+
+	assert.True(t, p.wants(newHostInfo("10.42.0.5")))
+	assert.True(t, p.wants(newHostInfo("10.42.0.6", "databases")))
+	assert.False(t, p.wants(newHostInfo("10.42.0.7", "web")))
+	assert.False(t, (*preconnect)(nil).wants(newHostInfo("10.42.0.5")))
+
+	// Listed addresses are handshaked with, never ourselves
+	p.connect()
+	assert.NotNil(t, f.handshakeManager.QueryVpnAddr(netip.MustParseAddr("10.42.0.5")))
+	assert.Nil(t, f.handshakeManager.QueryVpnAddr(netip.MustParseAddr("10.42.0.1")))
+
+	// Hosts in a group are learned from the tunnels we have and brought back when their tunnel goes away
+	db := newHostInfo("10.42.0.6", "databases")
+	db.localIndexId = 1
+	hostMap.unlockedAddHostInfo(db, f)
+	hostMap.unlockedAddHostInfo(newHostInfo("10.42.0.7", "web"), f)
+	p.connect()
+	assert.Nil(t, f.handshakeManager.QueryVpnAddr(netip.MustParseAddr("10.42.0.6")))
+	assert.Contains(t, p.seen, netip.MustParseAddr("10.42.0.6"))
+	assert.NotContains(t, p.seen, netip.MustParseAddr("10.42.0.7"))
+
+	hostMap.DeleteHostInfo(db)
+	p.connect()
+	assert.NotNil(t, f.handshakeManager.QueryVpnAddr(netip.MustParseAddr("10.42.0.6")))
+
+	// A reload replaces the list and forgets learned hosts
+	require.NoError(t, c.ReloadConfigString(`
+tunnels:
+  preconnect:
+    - 10.42.0.8
+`))
+	assert.False(t, p.wants(newHostInfo("10.42.0.5")))
+	assert.True(t, p.wants(newHostInfo("10.42.0.8")))
+	assert.Empty(t, p.seen)
+}
+
+func TestPreconnect_connectionManager(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	preferredRanges := []netip.Prefix{}
+	hostMap.preferredRanges.Store(&preferredRanges)
+	lh := newTestLighthouse()
+
+	c := config.NewC(l)
+	c.Settings["tunnels"] = map[string]any{
+		"drop_inactive": true,
+		"preconnect":    []any{"172.1.1.2"},
+	}
+
+	ifce := &Interface{
+		hostMap:          hostMap,
+		inside:           &test.NoopTun{},
+		outside:          &udp.NoopConn{},
+		firewall:         &Firewall{},
+		lightHouse:       lh,
+		pki:              &PKI{},
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		l:                l,
+	}
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		privateKey:        []byte{},
+		v1Cert:            &dummyCert{version: cert.Version1},
+		v1HandshakeBytes:  []byte{},
+	})
+	ifce.preconnect = newPreconnectFromConfig(l, c, ifce)
+
+	nc := newConnectionManagerFromConfig(l, c, hostMap, NewPunchyFromConfig(l, c))
+	nc.intf = ifce
+
+	hostinfo := &HostInfo{
+		vpnAddrs:      []netip.Addr{netip.MustParseAddr("172.1.1.2")},
+		localIndexId:  1099,
+		remoteIndexId: 9901,
+	}
+	hostinfo.ConnectionState = &ConnectionState{
+		myCert: &dummyCert{version: cert.Version1},
+		H:      &noise.HandshakeState{},
+	}
+	nc.hostMap.unlockedAddHostInfo(hostinfo, ifce)
+
+	// An idle preconnect tunnel is tested instead of left alone, and never dropped for inactivity
+	now := time.Now()
+	hostinfo.lastUsed = now.Add(-time.Hour)
+	decision, _, _ := nc.makeTrafficDecision(hostinfo.localIndexId, now)
+	assert.Equal(t, sendTestPacket, decision)
+	assert.True(t, hostinfo.pendingDeletion.Load())
+}
@@ -0,0 +1,127 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/udp"
+)
+
+// qosConfig decides the DSCP class of the outside packet carrying an inside packet
+type qosConfig struct {
+	// copyDSCP copies the inside packet's DSCP to the outside packet
+	copyDSCP bool
+	// groups is a fixed DSCP class for tunnels to hosts in the group, it wins over copyDSCP
+	groups map[string]uint8
+}
+
+// dscpClasses are the names accepted in place of a DSCP number, see RFC 2474, RFC 2597 and RFC 3246
+var dscpClasses = map[string]uint8{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+func parseDSCP(v any) (uint8, error) {
+	s := strings.ToLower(fmt.Sprintf("%v", v))
+	if d, ok := dscpClasses[s]; ok {
+		return d, nil
+	}
+
+	d, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || d > 63 {
+		return 0, fmt.Errorf("%q is not a dscp class name or a number from 0 to 63", s)
+	}
+
+	return uint8(d), nil
+}
+
+func newQosConfigFromConfig(c *config.C) (*qosConfig, error) {
+	q := &qosConfig{
+		copyDSCP: c.GetBool("qos.copy_dscp", false),
+		groups:   map[string]uint8{},
+	}
+
+	for k, v := range c.GetMap("qos.groups", map[string]any{}) {
+		d, err := parseDSCP(v)
+		if err != nil {
+			return nil, fmt.Errorf("qos.groups.%v is invalid: %w", k, err)
+		}
+		q.groups[fmt.Sprintf("%v", k)] = d
+	}
+
+	return q, nil
+}
+
+func (q *qosConfig) enabled() bool {
+	return q != nil && (q.copyDSCP || len(q.groups) > 0)
+}
+
+// dscp returns the class for the outside packet carrying the inside packet p to hostinfo, 0 means leave it unmarked
+func (q *qosConfig) dscp(hostinfo *HostInfo, p []byte) uint8 {
+	if len(q.groups) > 0 && hostinfo.ConnectionState != nil && hostinfo.ConnectionState.peerCert != nil {
+		// A host in several groups gets the highest class of them
+		var d uint8
+		found := false
+		for g, gd := range q.groups {
+			if _, ok := hostinfo.ConnectionState.peerCert.InvertedGroups[g]; ok && (!found || gd > d) {
+				d = gd
+				found = true
+			}
+		}
+
+		if found {
+			return d
+		}
+	}
+
+	if q.copyDSCP && len(p) >= 2 {
+		switch p[0] >> 4 {
+		case 4:
+			return p[1] >> 2
+		case 6:
+			return (p[0]&0x0f)<<2 | p[1]>>6
+		}
+	}
+
+	return 0
+}
+
+func (f *Interface) reloadQos(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("qos") {
+		return
+	}
+
+	q, err := newQosConfigFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load qos config, keeping the previous one")
+		return
+	}
+
+	if q.enabled() {
+		if _, ok := f.outside.(udp.DSCPWriter); !ok {
+			f.l.Warn("qos is configured but the udp listener on this platform can not mark packets, it will be ignored")
+		}
+	}
+
+	f.qos.Store(q)
+	f.l.WithFields(logrus.Fields{"copyDSCP": q.copyDSCP, "groups": q.groups}).Info("Loaded qos config")
+}
+
+// writeOutside writes an encrypted packet to the underlay through w, marked with dscp when the listener supports it
+func writeOutside(w udp.Conn, b []byte, addr netip.AddrPort, dscp uint8) error {
+	if dscp != 0 {
+		if dw, ok := w.(udp.DSCPWriter); ok {
+			return dw.WriteToDSCP(b, addr, dscp)
+		}
+	}
+
+	return w.WriteTo(b, addr)
+}
@@ -0,0 +1,77 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDSCP(t *testing.T) {
+	d, err := parseDSCP("EF")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(46), d)
+
+	d, err = parseDSCP("af41")
+	require.NoError(t, err)
+	assert.Equal(t, uint8(34), d)
+
+	d, err = parseDSCP(10)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(10), d)
+
+	_, err = parseDSCP(64)
+	require.EqualError(t, err, `"64" is not a dscp class name or a number from 0 to 63`)
+
+	_, err = parseDSCP("af5")
+	require.Error(t, err)
+}
+
+func TestNewQosConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	q, err := newQosConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, q.enabled())
+
+	c.Settings["qos"] = map[string]any{"groups": map[string]any{"voip": "ef", "bulk": "cs1"}}
+	q, err = newQosConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, q.enabled())
+	assert.Equal(t, map[string]uint8{"voip": 46, "bulk": 8}, q.groups)
+
+	c.Settings["qos"] = map[string]any{"groups": map[string]any{"voip": "nope"}}
+	_, err = newQosConfigFromConfig(c)
+	require.EqualError(t, err, `qos.groups.voip is invalid: "nope" is not a dscp class name or a number from 0 to 63`)
+}
+
+func TestQosConfig_dscp(t *testing.T) {
+	h := &HostInfo{ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{
+		InvertedGroups: map[string]struct{}{"voip": {}, "bulk": {}},
+	}}}
+
+	// ipv4 with a TOS of EF, ECT(0)
+	v4 := []byte{0x45, 46<<2 | 0x2}
+	// ipv6 with a traffic class of AF41, ECT(0)
+	v6 := []byte{0x60 | 34>>2, (34&0x3)<<6 | 0x2<<4}
+
+	q := &qosConfig{}
+	assert.Equal(t, uint8(0), q.dscp(h, v4))
+
+	q.copyDSCP = true
+	assert.Equal(t, uint8(46), q.dscp(h, v4))
+	assert.Equal(t, uint8(34), q.dscp(h, v6))
+	assert.Equal(t, uint8(0), q.dscp(h, []byte{0x45}))
+
+	// Groups win over the inside class, the highest matching group is used
+	q.groups = map[string]uint8{"bulk": 8, "voip": 46, "other": 56}
+	assert.Equal(t, uint8(46), q.dscp(h, v6))
+
+	// Hosts outside of any group fall back to the inside class
+	q.groups = map[string]uint8{"other": 56}
+	assert.Equal(t, uint8(34), q.dscp(h, v6))
+}
@@ -0,0 +1,263 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+)
+
+// Relays with relay.advertise.enabled tell their lighthouses they are relays, along with tags describing them. Hosts
+// with relay.discover.enabled ask for those advertisements with every lighthouse update, measure the round trip time to
+// the relays carrying a wanted tag, and advertise the fastest as relays for them alongside relay.relays.
+
+const (
+	// maxRelayAdvertisements caps how many relays a lighthouse returns in a single ack to keep it within one packet
+	maxRelayAdvertisements = 32
+
+	defaultDiscoverRelayCount = 2
+)
+
+type relayDiscoveryConfig struct {
+	advertise     bool
+	advertiseTags []string
+
+	discover     bool
+	discoverTags []string
+	count        int
+}
+
+func newRelayDiscoveryConfigFromConfig(c *config.C) (*relayDiscoveryConfig, error) {
+	rc := &relayDiscoveryConfig{
+		advertise:     c.GetBool("relay.advertise.enabled", false),
+		advertiseTags: c.GetStringSlice("relay.advertise.tags", []string{}),
+		discover:      c.GetBool("relay.discover.enabled", false),
+		discoverTags:  c.GetStringSlice("relay.discover.tags", []string{}),
+		count:         c.GetInt("relay.discover.count", defaultDiscoverRelayCount),
+	}
+
+	amRelay := c.GetBool("relay.am_relay", false)
+	if rc.advertise && !amRelay {
+		return nil, fmt.Errorf("relay.advertise.enabled requires relay.am_relay")
+	}
+
+	if rc.discover && amRelay {
+		return nil, fmt.Errorf("relay.discover.enabled can not be used with relay.am_relay")
+	}
+
+	if rc.count < 1 {
+		return nil, fmt.Errorf("relay.discover.count must be at least 1")
+	}
+
+	return rc, nil
+}
+
+// wants reports if a relay with tags should be considered, an empty discover tag list wants every relay
+func (rc *relayDiscoveryConfig) wants(tags []string) bool {
+	if len(rc.discoverTags) == 0 {
+		return true
+	}
+
+	for _, t := range tags {
+		if slices.Contains(rc.discoverTags, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type relayCandidate struct {
+	tags []string
+	seen time.Time
+}
+
+// relayDiscovery is usable as its zero value
+type relayDiscovery struct {
+	config atomic.Pointer[relayDiscoveryConfig]
+
+	// selected holds the discovered relays we advertise as relays for us
+	selected atomic.Pointer[[]netip.Addr]
+
+	sync.Mutex
+	// advertised holds the tags of every relay that advertised itself to us, only used on lighthouses
+	advertised map[netip.Addr][]string
+	// candidates holds the relays our lighthouses told us about
+	candidates map[netip.Addr]relayCandidate
+}
+
+func (rd *relayDiscovery) getConfig() *relayDiscoveryConfig {
+	if rc := rd.config.Load(); rc != nil {
+		return rc
+	}
+	return &relayDiscoveryConfig{count: defaultDiscoverRelayCount}
+}
+
+func (rd *relayDiscovery) getSelected() []netip.Addr {
+	if s := rd.selected.Load(); s != nil {
+		return *s
+	}
+	return nil
+}
+
+// setAdvertisement records what a relay told us about itself. An update without an advertisement means the host is no
+// longer a relay.
+func (rd *relayDiscovery) setAdvertisement(vpnAddr netip.Addr, ads []*RelayAdvertisement) {
+	rd.Lock()
+	defer rd.Unlock()
+
+	if len(ads) == 0 {
+		delete(rd.advertised, vpnAddr)
+		return
+	}
+
+	if rd.advertised == nil {
+		rd.advertised = map[netip.Addr][]string{}
+	}
+	rd.advertised[vpnAddr] = slices.Clone(ads[0].Tags)
+}
+
+// forget removes the advertisements of a host we no longer have a tunnel to
+func (rd *relayDiscovery) forget(vpnAddrs []netip.Addr) {
+	rd.Lock()
+	defer rd.Unlock()
+
+	for _, addr := range vpnAddrs {
+		delete(rd.advertised, addr)
+	}
+}
+
+// advertisements returns up to maxRelayAdvertisements of the relays that advertised themselves to us, skipping the host
+// that asked
+func (rd *relayDiscovery) advertisements(except []netip.Addr) []*RelayAdvertisement {
+	rd.Lock()
+	defer rd.Unlock()
+
+	addrs := make([]netip.Addr, 0, len(rd.advertised))
+	for addr := range rd.advertised {
+		if !slices.Contains(except, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	// Keep the answer stable between acks
+	slices.SortFunc(addrs, func(a, b netip.Addr) int { return a.Compare(b) })
+	if len(addrs) > maxRelayAdvertisements {
+		addrs = addrs[:maxRelayAdvertisements]
+	}
+
+	ads := make([]*RelayAdvertisement, len(addrs))
+	for i, addr := range addrs {
+		ads[i] = &RelayAdvertisement{VpnAddr: netAddrToProtoAddr(addr), Tags: rd.advertised[addr]}
+	}
+	return ads
+}
+
+// learn records the relays a lighthouse told us about
+func (rd *relayDiscovery) learn(ads []*RelayAdvertisement, now time.Time) {
+	rd.Lock()
+	defer rd.Unlock()
+
+	if rd.candidates == nil {
+		rd.candidates = map[netip.Addr]relayCandidate{}
+	}
+
+	for _, ad := range ads {
+		if ad.VpnAddr == nil {
+			continue
+		}
+		rd.candidates[protoAddrToNetAddr(ad.VpnAddr)] = relayCandidate{tags: slices.Clone(ad.Tags), seen: now}
+	}
+}
+
+// wanted returns the candidates with a tag we want, candidates no lighthouse mentioned within maxAge are dropped
+func (rd *relayDiscovery) wanted(rc *relayDiscoveryConfig, now time.Time, maxAge time.Duration) []netip.Addr {
+	rd.Lock()
+	defer rd.Unlock()
+
+	var addrs []netip.Addr
+	for addr, c := range rd.candidates {
+		if now.Sub(c.seen) > maxAge {
+			delete(rd.candidates, addr)
+			continue
+		}
+
+		if rc.wants(c.tags) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// pickRelays returns up to count of the relays with the lowest round trip time
+func pickRelays(rtts map[netip.Addr]time.Duration, count int) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(rtts))
+	for addr := range rtts {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Slice(addrs, func(i, j int) bool {
+		if rtts[addrs[i]] == rtts[addrs[j]] {
+			return addrs[i].Less(addrs[j])
+		}
+		return rtts[addrs[i]] < rtts[addrs[j]]
+	})
+
+	if len(addrs) > count {
+		addrs = addrs[:count]
+	}
+	return addrs
+}
+
+// discoverRelays probes the relays our lighthouses told us about and keeps the fastest ones that answered as relays for
+// us. Relays we do not have a tunnel to yet are handshaked with and measured on the next update.
+func (lh *LightHouse) discoverRelays() {
+	rc := lh.relayDiscovery.getConfig()
+	if !rc.discover {
+		return
+	}
+
+	now := time.Now()
+	// Lighthouses mention every relay in each ack, give them a few updates before forgetting one
+	maxAge := 3 * time.Duration(lh.GetUpdateInterval()) * time.Second
+
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	rtts := map[netip.Addr]time.Duration{}
+	for _, addr := range lh.relayDiscovery.wanted(rc, now, maxAge) {
+		if lh.myVpnNetworksTable.Contains(addr) {
+			continue
+		}
+
+		hi := lh.ifce.GetHostInfo(addr)
+		if hi == nil || !hi.remote.IsValid() {
+			lh.ifce.Handshake(addr)
+			continue
+		}
+
+		// Measure what the last round of probes found before starting the next
+		if rtt, ok := hi.paths.freshRtt(hi.remote); ok {
+			rtts[addr] = rtt
+		}
+
+		hi.paths.startRound()
+		lh.ifce.SendMessageToHostInfo(header.Test, header.TestRequest, hi, hi.paths.probe(hi.remote, now), nb, out)
+	}
+
+	selected := pickRelays(rtts, rc.count)
+	old := lh.relayDiscovery.getSelected()
+	if slices.Equal(old, selected) {
+		return
+	}
+
+	lh.relayDiscovery.selected.Store(&selected)
+	lh.l.WithFields(logrus.Fields{"relays": selected, "previous": old}).Info("Discovered relays changed")
+}
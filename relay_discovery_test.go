@@ -0,0 +1,149 @@
+package nebula
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRelayDiscoveryConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	rc, err := newRelayDiscoveryConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, rc.advertise)
+	assert.False(t, rc.discover)
+	assert.Equal(t, defaultDiscoverRelayCount, rc.count)
+
+	c.Settings["relay"] = map[string]any{"advertise": map[string]any{"enabled": true}}
+	_, err = newRelayDiscoveryConfigFromConfig(c)
+	require.EqualError(t, err, "relay.advertise.enabled requires relay.am_relay")
+
+	c.Settings["relay"] = map[string]any{
+		"am_relay":  true,
+		"advertise": map[string]any{"enabled": true, "tags": []any{"eu", "fast"}},
+	}
+	rc, err = newRelayDiscoveryConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, rc.advertise)
+	assert.Equal(t, []string{"eu", "fast"}, rc.advertiseTags)
+
+	c.Settings["relay"] = map[string]any{"am_relay": true, "discover": map[string]any{"enabled": true}}
+	_, err = newRelayDiscoveryConfigFromConfig(c)
+	require.EqualError(t, err, "relay.discover.enabled can not be used with relay.am_relay")
+
+	c.Settings["relay"] = map[string]any{"discover": map[string]any{"enabled": true, "count": 0}}
+	_, err = newRelayDiscoveryConfigFromConfig(c)
+	require.EqualError(t, err, "relay.discover.count must be at least 1")
+
+	c.Settings["relay"] = map[string]any{"discover": map[string]any{"enabled": true, "tags": []any{"eu"}, "count": 1}}
+	rc, err = newRelayDiscoveryConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, rc.discover)
+	assert.True(t, rc.wants([]string{"us", "eu"}))
+	assert.False(t, rc.wants([]string{"us"}))
+	assert.False(t, rc.wants(nil))
+}
+
+func TestRelayDiscovery_wanted(t *testing.T) {
+	rd := &relayDiscovery{}
+	now := time.Now()
+	eu := netip.MustParseAddr("10.128.0.5")
+	us := netip.MustParseAddr("10.128.0.6")
+
+	rd.learn([]*RelayAdvertisement{
+		{VpnAddr: netAddrToProtoAddr(eu), Tags: []string{"eu"}},
+		{VpnAddr: netAddrToProtoAddr(us), Tags: []string{"us"}},
+		{Tags: []string{"missing an addr"}},
+	}, now)
+
+	assert.ElementsMatch(t, []netip.Addr{eu, us}, rd.wanted(&relayDiscoveryConfig{}, now, time.Minute))
+	assert.Equal(t, []netip.Addr{eu}, rd.wanted(&relayDiscoveryConfig{discoverTags: []string{"eu"}}, now, time.Minute))
+
+	// Only eu is mentioned again, us ages out
+	rd.learn([]*RelayAdvertisement{{VpnAddr: netAddrToProtoAddr(eu), Tags: []string{"eu"}}}, now.Add(time.Minute))
+	assert.Equal(t, []netip.Addr{eu}, rd.wanted(&relayDiscoveryConfig{}, now.Add(time.Minute+time.Second), time.Minute))
+	assert.Len(t, rd.candidates, 1)
+}
+
+func TestPickRelays(t *testing.T) {
+	a := netip.MustParseAddr("10.128.0.5")
+	b := netip.MustParseAddr("10.128.0.6")
+	c := netip.MustParseAddr("10.128.0.7")
+
+	rtts := map[netip.Addr]time.Duration{
+		a: 30 * time.Millisecond,
+		b: 10 * time.Millisecond,
+		c: 10 * time.Millisecond,
+	}
+
+	assert.Equal(t, []netip.Addr{b, c}, pickRelays(rtts, 2))
+	assert.Equal(t, []netip.Addr{b, c, a}, pickRelays(rtts, 5))
+	assert.Empty(t, pickRelays(map[netip.Addr]time.Duration{}, 2))
+}
+
+func TestLighthouse_relayAdvertisements(t *testing.T) {
+	l := test.NewLogger()
+	myVpnNet := netip.MustParsePrefix("10.128.0.1/24")
+	nt := new(bart.Lite)
+	nt.Insert(myVpnNet)
+	cs := &CertState{
+		myVpnNetworks:      []netip.Prefix{myVpnNet},
+		myVpnNetworksTable: nt,
+	}
+
+	c := config.NewC(l)
+	c.Settings["lighthouse"] = map[string]any{"am_lighthouse": true}
+	c.Settings["listen"] = map[string]any{"port": 4242}
+	lh, err := NewLightHouseFromConfig(context.Background(), l, c, cs, nil, nil)
+	require.NoError(t, err)
+	lhh := lh.NewRequestHandler()
+
+	relay := netip.MustParseAddr("10.128.0.5")
+	client := netip.MustParseAddr("10.128.0.6")
+	update := func(from netip.Addr, details *NebulaMetaDetails) *NebulaMeta {
+		details.VpnAddr = netAddrToProtoAddr(from)
+		b, err := (&NebulaMeta{Type: NebulaMeta_HostUpdateNotification, Details: details}).Marshal()
+		require.NoError(t, err)
+
+		filter := NebulaMeta_HostUpdateNotificationAck
+		w := &testEncWriter{metaFilter: &filter}
+		lhh.HandleRequest(netip.MustParseAddrPort("1.2.3.4:4242"), []netip.Addr{from}, b, w)
+		require.NotNil(t, w.lastReply.msg)
+		return w.lastReply.msg
+	}
+
+	ack := update(relay, &NebulaMetaDetails{RelayAdvertisements: []*RelayAdvertisement{{Tags: []string{"eu"}}}})
+	assert.Empty(t, ack.Details.RelayAdvertisements)
+
+	// Acks only carry advertisements when asked for, and never our own
+	ack = update(client, &NebulaMetaDetails{})
+	assert.Empty(t, ack.Details.RelayAdvertisements)
+
+	ack = update(client, &NebulaMetaDetails{WantRelays: true})
+	require.Len(t, ack.Details.RelayAdvertisements, 1)
+	assert.Equal(t, relay, protoAddrToNetAddr(ack.Details.RelayAdvertisements[0].VpnAddr))
+	assert.Equal(t, []string{"eu"}, ack.Details.RelayAdvertisements[0].Tags)
+
+	ack = update(relay, &NebulaMetaDetails{RelayAdvertisements: []*RelayAdvertisement{{Tags: []string{"eu"}}}, WantRelays: true})
+	assert.Empty(t, ack.Details.RelayAdvertisements)
+
+	// The relay goes away with its tunnel
+	lh.DeleteVpnAddrs([]netip.Addr{relay})
+	ack = update(client, &NebulaMetaDetails{WantRelays: true})
+	assert.Empty(t, ack.Details.RelayAdvertisements)
+
+	// And when it stops advertising
+	update(relay, &NebulaMetaDetails{RelayAdvertisements: []*RelayAdvertisement{{Tags: []string{"eu"}}}})
+	update(relay, &NebulaMetaDetails{})
+	ack = update(client, &NebulaMetaDetails{WantRelays: true})
+	assert.Empty(t, ack.Details.RelayAdvertisements)
+}
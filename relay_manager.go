@@ -18,6 +18,9 @@ type relayManager struct {
 	l       *logrus.Logger
 	hostmap *HostMap
 	amRelay atomic.Bool
+
+	lighthouseRelay atomic.Pointer[lighthouseRelay]
+	relayPolicy     atomic.Pointer[relayPolicy]
 }
 
 func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c *config.C) *relayManager {
@@ -25,7 +28,10 @@ func NewRelayManager(ctx context.Context, l *logrus.Logger, hostmap *HostMap, c
 		l:       l,
 		hostmap: hostmap,
 	}
-	rm.reload(c, true)
+	err := rm.reload(c, true)
+	if err != nil {
+		l.WithError(err).Error("Failed to load relay_manager")
+	}
 	c.RegisterReloadCallback(func(c *config.C) {
 		err := rm.reload(c, false)
 		if err != nil {
@@ -39,7 +45,8 @@ func (rm *relayManager) reload(c *config.C, initial bool) error {
 	if initial || c.HasChanged("relay.am_relay") {
 		rm.setAmRelay(c.GetBool("relay.am_relay", false))
 	}
-	return nil
+	rm.reloadRelayPolicy(c, initial)
+	return rm.reloadLighthouseRelay(c, initial)
 }
 
 func (rm *relayManager) GetAmRelay() bool {
@@ -50,6 +57,16 @@ func (rm *relayManager) setAmRelay(v bool) {
 	rm.amRelay.Store(v)
 }
 
+// allowForward reports if a relayed packet of n bytes from h may be forwarded, only lighthouse relays are limited
+func (rm *relayManager) allowForward(h *HostInfo, n int) bool {
+	if rm.GetAmRelay() {
+		return true
+	}
+
+	lr := rm.lighthouseRelay.Load()
+	return lr == nil || lr.allow(h, n)
+}
+
 // AddRelay finds an available relay index on the hostmap, and associates the relay info with it.
 // relayHostInfo is the Nebula peer which can be used as a relay to access the target vpnIp.
 func AddRelay(l *logrus.Logger, relayHostInfo *HostInfo, hm *HostMap, vpnIp netip.Addr, remoteIdx *uint32, relayType int, state int) (uint32, error) {
@@ -328,7 +345,8 @@ func (rm *relayManager) handleCreateRelayRequest(v cert.Version, h *HostInfo, f
 		return
 	} else {
 		// the target is not me. Create a relay to the target, from me.
-		if !rm.GetAmRelay() {
+		lr := rm.lighthouseRelay.Load()
+		if !rm.GetAmRelay() && lr == nil {
 			return
 		}
 		peer := rm.hostmap.QueryVpnAddr(target)
@@ -342,6 +360,17 @@ func (rm *relayManager) handleCreateRelayRequest(v cert.Version, h *HostInfo, f
 			// Only create relays to peers for whom I have a direct connection
 			return
 		}
+		if !rm.GetAmRelay() {
+			if err := lr.approve(rm.hostmap, h, peer); err != nil {
+				logMsg.WithError(err).Info("Denied lighthouse relay allocation")
+				return
+			}
+		} else if p := rm.relayPolicy.Load(); p != nil {
+			if err := p.allow(h, peer); err != nil {
+				logMsg.WithError(err).Info("Rejected relay request by relay policy")
+				return
+			}
+		}
 		var index uint32
 		var err error
 		targetRelay, ok := peer.relayState.QueryRelayForByIp(from)
@@ -0,0 +1,75 @@
+package nebula
+
+import (
+	"fmt"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+)
+
+// relayPolicy limits who a host with am_relay forwards for. Both ends of a relay must have a certificate with at least
+// one of the groups, this is checked when handling a CreateRelayRequest so relays that already exist are left alone.
+type relayPolicy struct {
+	groups   []string
+	rejected metrics.Counter
+}
+
+func newRelayPolicyFromConfig(c *config.C) *relayPolicy {
+	groups := c.GetStringSlice("relay.policy.groups", []string{})
+	if len(groups) == 0 {
+		return nil
+	}
+
+	return &relayPolicy{
+		groups:   groups,
+		rejected: metrics.GetOrRegisterCounter("relay.policy.rejected", nil),
+	}
+}
+
+// hostInGroups reports if the host has a certificate with at least one of groups, an empty list allows everyone
+func hostInGroups(h *HostInfo, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+
+	if h.ConnectionState == nil || h.ConnectionState.peerCert == nil {
+		return false
+	}
+
+	for _, g := range groups {
+		if _, ok := h.ConnectionState.peerCert.InvertedGroups[g]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allow returns an error if the policy does not let from relay to target through us
+func (p *relayPolicy) allow(from, target *HostInfo) error {
+	if !hostInGroups(from, p.groups) {
+		p.rejected.Inc(1)
+		return fmt.Errorf("relayFrom is not in an allowed group")
+	}
+
+	if !hostInGroups(target, p.groups) {
+		p.rejected.Inc(1)
+		return fmt.Errorf("relayTo is not in an allowed group")
+	}
+
+	return nil
+}
+
+func (rm *relayManager) reloadRelayPolicy(c *config.C, initial bool) {
+	if !initial && !c.HasChanged("relay.policy") {
+		return
+	}
+
+	p := newRelayPolicyFromConfig(c)
+	rm.relayPolicy.Store(p)
+	if p != nil {
+		rm.l.WithField("groups", p.groups).Info("Relay policy enabled")
+	} else if !initial {
+		rm.l.Info("Relay policy disabled")
+	}
+}
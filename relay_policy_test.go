@@ -0,0 +1,54 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayPolicy(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	assert.Nil(t, newRelayPolicyFromConfig(c))
+
+	c.Settings["relay"] = map[string]any{"policy": map[string]any{"groups": []any{"nat-hard", "relayed"}}}
+	p := newRelayPolicyFromConfig(c)
+	require.NotNil(t, p)
+	assert.Equal(t, []string{"nat-hard", "relayed"}, p.groups)
+
+	newHost := func(addr string, groups ...string) *HostInfo {
+		inverted := map[string]struct{}{}
+		for _, g := range groups {
+			inverted[g] = struct{}{}
+		}
+		return &HostInfo{
+			vpnAddrs:        []netip.Addr{netip.MustParseAddr(addr)},
+			ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{InvertedGroups: inverted}},
+		}
+	}
+
+	a := newHost("10.1.0.1", "nat-hard")
+	b := newHost("10.1.0.2", "relayed", "web")
+	outsider := newHost("10.1.0.3", "web")
+	noCert := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.4")}}
+
+	before := p.rejected.Count()
+	require.NoError(t, p.allow(a, b))
+	require.EqualError(t, p.allow(outsider, a), "relayFrom is not in an allowed group")
+	require.EqualError(t, p.allow(a, outsider), "relayTo is not in an allowed group")
+	require.EqualError(t, p.allow(a, noCert), "relayTo is not in an allowed group")
+	assert.Equal(t, before+3, p.rejected.Count())
+
+	rm := &relayManager{l: l}
+	rm.reloadRelayPolicy(c, true)
+	assert.NotNil(t, rm.relayPolicy.Load())
+
+	c.Settings["relay"] = map[string]any{}
+	rm.reloadRelayPolicy(c, true)
+	assert.Nil(t, rm.relayPolicy.Load())
+}
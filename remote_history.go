@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// remoteHistorySize is how many underlay addresses are remembered for each tunnel
+const remoteHistorySize = 8
+
+// remoteHistory remembers the underlay addresses packets for a tunnel recently came from. An address is validated once
+// a packet from it was authenticated, by the handshake or by decrypting it. Addresses that only ever sent packets we
+// could not authenticate stay unvalidated, those are usually a NAT rebinding we have not heard from properly yet, or
+// someone spoofing the tunnel.
+type remoteHistory struct {
+	sync.Mutex
+	entries []remoteHistoryEntry
+}
+
+type remoteHistoryEntry struct {
+	addr      netip.AddrPort
+	firstSeen time.Time
+	lastSeen  time.Time
+	validated bool
+}
+
+// ControlRemoteHistory is a single underlay address in a tunnel's history, see Control.GetRemoteHistory
+type ControlRemoteHistory struct {
+	Addr      netip.AddrPort `json:"addr"`
+	FirstSeen time.Time      `json:"firstSeen"`
+	LastSeen  time.Time      `json:"lastSeen"`
+	Validated bool           `json:"validated"`
+}
+
+// seen records a packet from addr, the oldest address is forgotten when the history is full
+func (rh *remoteHistory) seen(addr netip.AddrPort, validated bool, now time.Time) {
+	rh.Lock()
+	defer rh.Unlock()
+
+	for i := range rh.entries {
+		e := &rh.entries[i]
+		if e.addr == addr {
+			e.lastSeen = now
+			e.validated = e.validated || validated
+			return
+		}
+	}
+
+	if len(rh.entries) >= remoteHistorySize {
+		oldest := 0
+		for i := range rh.entries {
+			if rh.entries[i].lastSeen.Before(rh.entries[oldest].lastSeen) {
+				oldest = i
+			}
+		}
+		rh.entries = slices.Delete(rh.entries, oldest, oldest+1)
+	}
+
+	rh.entries = append(rh.entries, remoteHistoryEntry{addr: addr, firstSeen: now, lastSeen: now, validated: validated})
+}
+
+// copy returns the history with the most recently seen address first
+func (rh *remoteHistory) copy() []ControlRemoteHistory {
+	rh.Lock()
+	defer rh.Unlock()
+
+	out := make([]ControlRemoteHistory, len(rh.entries))
+	for i, e := range rh.entries {
+		out[i] = ControlRemoteHistory{Addr: e.addr, FirstSeen: e.firstSeen, LastSeen: e.lastSeen, Validated: e.validated}
+	}
+
+	slices.SortStableFunc(out, func(a, b ControlRemoteHistory) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return out
+}
@@ -0,0 +1,43 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteHistory(t *testing.T) {
+	rh := &remoteHistory{}
+	now := time.Now()
+	a := netip.MustParseAddrPort("1.1.1.1:4242")
+	b := netip.MustParseAddrPort("2.2.2.2:4242")
+
+	assert.Empty(t, rh.copy())
+
+	rh.seen(a, true, now)
+	rh.seen(b, false, now.Add(time.Second))
+	h := rh.copy()
+	require.Len(t, h, 2)
+	assert.Equal(t, ControlRemoteHistory{Addr: b, FirstSeen: now.Add(time.Second), LastSeen: now.Add(time.Second)}, h[0])
+	assert.Equal(t, ControlRemoteHistory{Addr: a, FirstSeen: now, LastSeen: now, Validated: true}, h[1])
+
+	// A later authenticated packet validates the address, an unauthenticated one does not undo it
+	rh.seen(b, true, now.Add(2*time.Second))
+	rh.seen(b, false, now.Add(3*time.Second))
+	h = rh.copy()
+	assert.Equal(t, ControlRemoteHistory{Addr: b, FirstSeen: now.Add(time.Second), LastSeen: now.Add(3 * time.Second), Validated: true}, h[0])
+
+	// The least recently seen address is forgotten first
+	for i := range remoteHistorySize {
+		rh.seen(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 4242), false, now.Add(time.Duration(10+i)*time.Second))
+	}
+	h = rh.copy()
+	require.Len(t, h, remoteHistorySize)
+	for _, e := range h {
+		assert.NotEqual(t, a, e.Addr)
+		assert.NotEqual(t, b, e.Addr)
+	}
+}
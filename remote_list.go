@@ -31,6 +31,8 @@ type Cache struct {
 	Learned  []netip.AddrPort `json:"learned,omitempty"`
 	Reported []netip.AddrPort `json:"reported,omitempty"`
 	Relay    []netip.Addr     `json:"relay"`
+	// Labels are the labels of the host in this answer, see lighthouse_labels.go
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // cache is an internal struct that splits v4 and v6 addresses inside the cache map
@@ -38,6 +40,13 @@ type cache struct {
 	v4    *cacheV4
 	v6    *cacheV6
 	relay *cacheRelay
+
+	// reportedAt is when the host last updated the lighthouse about these addresses. It is only set for the answers of
+	// lighthouses, and on a lighthouse for what the host told it, see lighthouse_split_brain.go
+	reportedAt time.Time
+
+	// labels are the key=value labels of the host, from the same lighthouse answer or host update, see lighthouse_labels.go
+	labels []string
 }
 
 type cacheRelay struct {
@@ -196,6 +205,9 @@ type RemoteList struct {
 	// A set of relay addresses. VpnIp addresses that the remote identified as relays.
 	relays []netip.Addr
 
+	// hints holds the priority and tag the host advertised for entries in addrs, see lighthouse.advertise_addrs
+	hints map[netip.AddrPort]addrHint
+
 	// These are maps to store v4 and v6 addresses per lighthouse
 	// Map key is the vpnIp of the person that told us about this the cached entries underneath.
 	// For learned addresses, this is the vpnIp that sent the packet
@@ -203,6 +215,13 @@ type RemoteList struct {
 
 	hr *hostnamesResults
 
+	// discovered holds the underlay addresses found for this host by static_map.discovery
+	discovered []netip.AddrPort
+
+	// persisted holds the underlay addresses loaded from lighthouse.remote_cache and when they were last confirmed
+	persisted   []netip.AddrPort
+	persistedAt time.Time
+
 	// shouldAdd is a nillable function that decides if x should be added to addrs.
 	shouldAdd func(vpnAddrs []netip.Addr, x netip.Addr) bool
 
@@ -212,6 +231,30 @@ type RemoteList struct {
 
 	// A flag that the cache may have changed and addrs needs to be rebuilt
 	shouldRebuild bool
+
+	// splitBrainSince is when the lighthouses started to disagree about this host, zero while they agree. splitBrain is
+	// set once they disagreed for lighthouse.split_brain_threshold, only the most recently updated lighthouse answer is
+	// used then. See lighthouse_split_brain.go
+	splitBrainSince time.Time
+	splitBrain      bool
+}
+
+// addrHint is how the owner of an address asked peers to rank it
+type addrHint struct {
+	priority uint32
+	tag      AddrTag
+}
+
+func (r *RemoteList) unlockedAddHint(addr netip.AddrPort, priority uint32, tag AddrTag) {
+	if priority == 0 && tag == AddrTag_Untagged {
+		return
+	}
+
+	// The same address may come from more than one lighthouse, keep the highest priority
+	if h, ok := r.hints[addr]; ok && h.priority > priority {
+		return
+	}
+	r.hints[addr] = addrHint{priority: priority, tag: tag}
 }
 
 // NewRemoteList creates a new empty RemoteList
@@ -233,6 +276,59 @@ func (r *RemoteList) unlockedSetHostnamesResults(hr *hostnamesResults) {
 	r.hr = hr
 }
 
+// unlockedSetDiscovered assumes you have the write lock and replaces the addresses found by static_map.discovery
+func (r *RemoteList) unlockedSetDiscovered(addrs []netip.AddrPort) {
+	r.discovered = addrs
+	r.shouldRebuild = true
+}
+
+// unlockedSetPersisted assumes you have the write lock and replaces the addresses loaded from lighthouse.remote_cache
+func (r *RemoteList) unlockedSetPersisted(addrs []netip.AddrPort, at time.Time) {
+	r.persisted = addrs
+	r.persistedAt = at
+	r.shouldRebuild = true
+}
+
+// persistEntry locks and returns what lighthouse.remote_cache should remember about this host. Addresses learned or
+// reported since we started are stamped with now, otherwise addresses loaded from the cache are kept until maxAge.
+func (r *RemoteList) persistEntry(now time.Time, maxAge time.Duration) (remoteCacheEntry, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	e := remoteCacheEntry{VpnAddrs: r.vpnAddrs, Updated: now}
+	for _, c := range r.cache {
+		if c.v4 != nil {
+			if c.v4.learned != nil {
+				e.Addrs = append(e.Addrs, protoV4AddrPortToNetAddrPort(c.v4.learned))
+			}
+			for _, v := range c.v4.reported {
+				e.Addrs = append(e.Addrs, protoV4AddrPortToNetAddrPort(v))
+			}
+		}
+
+		if c.v6 != nil {
+			if c.v6.learned != nil {
+				e.Addrs = append(e.Addrs, protoV6AddrPortToNetAddrPort(c.v6.learned))
+			}
+			for _, v := range c.v6.reported {
+				e.Addrs = append(e.Addrs, protoV6AddrPortToNetAddrPort(v))
+			}
+		}
+	}
+
+	if len(e.Addrs) == 0 {
+		if len(r.persisted) == 0 || now.Sub(r.persistedAt) > maxAge {
+			return e, false
+		}
+		e.Addrs = r.persisted
+		e.Updated = r.persistedAt
+	}
+
+	slices.SortFunc(e.Addrs, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	e.Addrs = slices.Compact(e.Addrs)
+	return e, true
+}
+
 // Len locks and reports the size of the deduplicated address list
 // The deduplication work may need to occur here, so you must pass preferredRanges
 func (r *RemoteList) Len(preferredRanges []netip.Prefix) int {
@@ -332,6 +428,8 @@ func (r *RemoteList) CopyCache() *CacheMap {
 				c.Relay = append(c.Relay, a)
 			}
 		}
+
+		c.Labels = labelsToMap(mc.labels)
 	}
 
 	return &cm
@@ -358,6 +456,14 @@ func (r *RemoteList) BlockRemote(bad ViaSender) {
 	r.shouldRebuild = true
 }
 
+// CopyStaticAddrs locks and returns the addresses for this host from static_host_map and static_map.discovery
+func (r *RemoteList) CopyStaticAddrs() []netip.AddrPort {
+	r.RLock()
+	defer r.RUnlock()
+
+	return append(r.hr.GetAddrs(), r.discovered...)
+}
+
 // CopyBlockedRemotes locks and makes a deep copy of the blocked remotes list
 func (r *RemoteList) CopyBlockedRemotes() []netip.AddrPort {
 	r.RLock()
@@ -419,6 +525,90 @@ func (r *RemoteList) unlockedSetLearnedV4(ownerVpnIp netip.Addr, to *V4AddrPort)
 	r.unlockedGetOrMakeV4(ownerVpnIp).learned = to
 }
 
+// unlockedMerge assumes you have the write lock on both lists and folds everything other knows about the host into r,
+// used when two vpn addrs we tracked apart turn out to belong to the same host. Reported addresses from the same owner
+// are combined, the next update from that owner replaces them as usual.
+func (r *RemoteList) unlockedMerge(other *RemoteList) {
+	for owner, oc := range other.cache {
+		c, ok := r.cache[owner]
+		if !ok {
+			r.cache[owner] = oc
+			continue
+		}
+
+		if oc.v4 != nil {
+			v4 := r.unlockedGetOrMakeV4(owner)
+			if v4.learned == nil {
+				v4.learned = oc.v4.learned
+			}
+			for _, v := range oc.v4.reported {
+				if len(v4.reported) < MaxRemotes && !slices.ContainsFunc(v4.reported, func(x *V4AddrPort) bool { return x.Addr == v.Addr && x.Port == v.Port }) {
+					v4.reported = append(v4.reported, v)
+				}
+			}
+		}
+
+		if oc.v6 != nil {
+			v6 := r.unlockedGetOrMakeV6(owner)
+			if v6.learned == nil {
+				v6.learned = oc.v6.learned
+			}
+			for _, v := range oc.v6.reported {
+				if len(v6.reported) < MaxRemotes && !slices.ContainsFunc(v6.reported, func(x *V6AddrPort) bool { return x.Hi == v.Hi && x.Lo == v.Lo && x.Port == v.Port }) {
+					v6.reported = append(v6.reported, v)
+				}
+			}
+		}
+
+		if oc.relay != nil {
+			relay := r.unlockedGetOrMakeRelay(owner)
+			for _, v := range oc.relay.relay {
+				if !slices.Contains(relay.relay, v) {
+					relay.relay = append(relay.relay, v)
+				}
+			}
+		}
+
+		if oc.reportedAt.After(c.reportedAt) {
+			c.reportedAt = oc.reportedAt
+			c.labels = oc.labels
+		} else if c.labels == nil {
+			c.labels = oc.labels
+		}
+	}
+
+	if r.hr == nil {
+		r.hr = other.hr
+	} else {
+		// The addresses other resolved are kept as static entries in its cache, merged above
+		other.hr.Cancel()
+	}
+	other.hr = nil
+
+	r.discovered = appendMissing(r.discovered, other.discovered)
+	r.persisted = appendMissing(r.persisted, other.persisted)
+	if other.persistedAt.After(r.persistedAt) {
+		r.persistedAt = other.persistedAt
+	}
+	r.badRemotes = appendMissing(r.badRemotes, other.badRemotes)
+
+	for _, addr := range other.vpnAddrs {
+		if !slices.Contains(r.vpnAddrs, addr) {
+			r.vpnAddrs = append(r.vpnAddrs, addr)
+		}
+	}
+	r.shouldRebuild = true
+}
+
+func appendMissing(to, from []netip.AddrPort) []netip.AddrPort {
+	for _, v := range from {
+		if !slices.Contains(to, v) {
+			to = append(to, v)
+		}
+	}
+	return to
+}
+
 // unlockedSetV4 assumes you have the write lock and resets the reported list of ips for this owner to the list provided
 // and marks the deduplicated address list as dirty
 func (r *RemoteList) unlockedSetV4(ownerVpnIp, vpnIp netip.Addr, to []*V4AddrPort, check checkFuncV4) {
@@ -545,8 +735,23 @@ func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp netip.Addr) *cacheV6 {
 func (r *RemoteList) unlockedCollect() {
 	addrs := r.addrs[:0]
 	relays := r.relays[:0]
+	clear(r.hints)
+	if r.hints == nil {
+		r.hints = map[netip.AddrPort]addrHint{}
+	}
+
+	// While the lighthouses disagree only the answer of the one the host updated last is used
+	latest, preferLatest := r.unlockedLatestAnswer()
+	preferLatest = preferLatest && r.splitBrain
+
+	for owner, c := range r.cache {
+		if preferLatest && !c.reportedAt.IsZero() && owner != latest {
+			if c.relay != nil {
+				relays = append(relays, c.relay.relay...)
+			}
+			continue
+		}
 
-	for _, c := range r.cache {
 		if c.v4 != nil {
 			if c.v4.learned != nil {
 				u := protoV4AddrPortToNetAddrPort(c.v4.learned)
@@ -559,6 +764,7 @@ func (r *RemoteList) unlockedCollect() {
 				u := protoV4AddrPortToNetAddrPort(v)
 				if !r.unlockedIsBad(u) {
 					addrs = append(addrs, u)
+					r.unlockedAddHint(u, v.Priority, v.Tag)
 				}
 			}
 		}
@@ -575,6 +781,7 @@ func (r *RemoteList) unlockedCollect() {
 				u := protoV6AddrPortToNetAddrPort(v)
 				if !r.unlockedIsBad(u) {
 					addrs = append(addrs, u)
+					r.unlockedAddHint(u, v.Priority, v.Tag)
 				}
 			}
 		}
@@ -587,7 +794,7 @@ func (r *RemoteList) unlockedCollect() {
 	}
 
 	dnsAddrs := r.hr.GetAddrs()
-	for _, addr := range dnsAddrs {
+	for _, addr := range slices.Concat(dnsAddrs, r.discovered, r.persisted) {
 		if r.shouldAdd == nil || r.shouldAdd(r.vpnAddrs, addr.Addr()) {
 			if !r.unlockedIsBad(addr) {
 				addrs = append(addrs, addr)
@@ -642,7 +849,20 @@ func (r *RemoteList) unlockedSort(preferredRanges []netip.Prefix) {
 			// Both i an j are either preferred or not, sort within that
 		}
 
-		// ipv6 addresses 2nd
+		// Higher advertised priority 2nd, then anything the host tagged as private after everything else
+		aHint := r.hints[a]
+		bHint := r.hints[b]
+		if aHint.priority != bHint.priority {
+			return aHint.priority > bHint.priority
+		}
+
+		aTagPrivate := aHint.tag == AddrTag_Private
+		bTagPrivate := bHint.tag == AddrTag_Private
+		if aTagPrivate != bTagPrivate {
+			return bTagPrivate
+		}
+
+		// ipv6 addresses 3rd
 		a4 := a.Addr().Is4()
 		b4 := b.Addr().Is4()
 		switch {
@@ -675,10 +895,10 @@ func (r *RemoteList) unlockedSort(preferredRanges []netip.Prefix) {
 			// Both i an j are either ipv4 or ipv6, sort within that
 		}
 
-		// lexical order of ips 3rd
+		// lexical order of ips 4th
 		c := a.Addr().Compare(b.Addr())
 		if c == 0 {
-			// Ips are the same, Lexical order of ports 4th
+			// Ips are the same, Lexical order of ports 5th
 			return a.Port() < b.Port()
 		}
 
@@ -257,3 +257,39 @@ func newIp6AndPortFromString(s string) *V6AddrPort {
 		Port: uint32(a.Port()),
 	}
 }
+
+func TestRemoteList_RebuildHints(t *testing.T) {
+	owner := netip.MustParseAddr("10.128.0.2")
+	rl := NewRemoteList([]netip.Addr{owner}, nil)
+
+	prioritized := newIp4AndPortFromString("172.17.0.1:4242")
+	prioritized.Priority = 10
+	tagged := newIp6AndPortFromString("[1::1]:4242")
+	tagged.Tag = AddrTag_Private
+	lowPriority := newIp4AndPortFromString("172.17.0.2:4242")
+	lowPriority.Priority = 5
+
+	rl.unlockedSetV4(owner, owner, []*V4AddrPort{
+		newIp4AndPortFromString("70.199.182.92:4242"),
+		lowPriority,
+		prioritized,
+	}, func(netip.Addr, *V4AddrPort) bool { return true })
+	rl.unlockedSetV6(owner, owner, []*V6AddrPort{
+		tagged,
+		newIp6AndPortFromString("[1::2]:4242"),
+	}, func(netip.Addr, *V6AddrPort) bool { return true })
+
+	rl.Rebuild([]netip.Prefix{})
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("172.17.0.1:4242"),
+		netip.MustParseAddrPort("172.17.0.2:4242"),
+		netip.MustParseAddrPort("[1::2]:4242"),
+		netip.MustParseAddrPort("70.199.182.92:4242"),
+		netip.MustParseAddrPort("[1::1]:4242"),
+	}, rl.addrs)
+
+	// Preferred ranges still win over priorities
+	rl.Rebuild([]netip.Prefix{netip.MustParsePrefix("70.199.182.0/24")})
+	assert.Equal(t, netip.MustParseAddrPort("70.199.182.92:4242"), rl.addrs[0])
+	assert.Equal(t, netip.MustParseAddrPort("172.17.0.1:4242"), rl.addrs[1])
+}
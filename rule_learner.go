@@ -0,0 +1,294 @@
+package nebula
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Rule learning watches the inbound flows the firewall accepts for a while and suggests the smallest set of inbound
+// rules that would have allowed all of them. Peers are described by the groups they share wherever possible and by
+// name when they have no groups, ports next to each other are collapsed into ranges. Run it with broad rules in place,
+// review the suggestion, and replace the broad rules with it.
+
+// RuleSuggestion is the inbound firewall rules suggested by what was seen while learning
+type RuleSuggestion struct {
+	Learning bool       `json:"learning"`
+	Started  time.Time  `json:"started"`
+	Until    time.Time  `json:"until"`
+	Flows    int        `json:"flows"`
+	Rules    []FlowRule `json:"rules"`
+}
+
+// String renders the rules as a firewall.inbound config section
+func (rs RuleSuggestion) String() string {
+	var sb strings.Builder
+	switch {
+	case rs.Started.IsZero():
+		return "# Nothing has been learned, start with learn-firewall-rules\n"
+	case rs.Learning:
+		fmt.Fprintf(&sb, "# Learned from %d flows since %s, still learning until %s\n", rs.Flows, rs.Started.Format(time.RFC3339), rs.Until.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(&sb, "# Learned from %d flows between %s and %s\n", rs.Flows, rs.Started.Format(time.RFC3339), rs.Until.Format(time.RFC3339))
+	}
+
+	if len(rs.Rules) == 0 {
+		sb.WriteString("inbound: []\n")
+		return sb.String()
+	}
+
+	sb.WriteString("inbound:\n")
+	for _, r := range rs.Rules {
+		fmt.Fprintf(&sb, "  - port: %s\n    proto: %s\n", r.Port, r.Proto)
+		if r.Host != "" {
+			fmt.Fprintf(&sb, "    host: %s\n", r.Host)
+		}
+		if len(r.Groups) == 1 {
+			fmt.Fprintf(&sb, "    group: %s\n", r.Groups[0])
+		} else if len(r.Groups) > 1 {
+			fmt.Fprintf(&sb, "    groups: [%s]\n", strings.Join(r.Groups, ", "))
+		}
+	}
+	return sb.String()
+}
+
+type learnedFlow struct {
+	proto string
+	port  uint16
+}
+
+type learnedPeer struct {
+	name   string
+	groups []string
+}
+
+type ruleLearner struct {
+	l  *logrus.Logger
+	fl *flowLog
+
+	sync.Mutex
+	started     time.Time
+	until       time.Time
+	unsubscribe func()
+	timer       *time.Timer
+	count       int
+	// flows holds the peers seen for every proto and port, keyed by certificate fingerprint
+	flows map[learnedFlow]map[string]learnedPeer
+}
+
+func newRuleLearner(l *logrus.Logger, fl *flowLog) *ruleLearner {
+	return &ruleLearner{l: l, fl: fl, flows: map[learnedFlow]map[string]learnedPeer{}}
+}
+
+// start forgets what was learned before and records flows for d
+func (rl *ruleLearner) start(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("learning duration must be positive, got %v", d)
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.stopLocked()
+	rl.started = time.Now()
+	rl.until = rl.started.Add(d)
+	rl.count = 0
+	rl.flows = map[learnedFlow]map[string]learnedPeer{}
+	rl.unsubscribe = rl.fl.subscribe(rl.add)
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		rl.Lock()
+		defer rl.Unlock()
+		// We may have been restarted while waiting on the lock
+		if rl.timer == t {
+			rl.stopLocked()
+		}
+	})
+	rl.timer = t
+
+	rl.l.WithField("until", rl.until).Info("Learning firewall rules from accepted inbound flows")
+	return nil
+}
+
+// stop ends learning early, what was learned is kept
+func (rl *ruleLearner) stop() {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.stopLocked()
+}
+
+func (rl *ruleLearner) stopLocked() {
+	if rl.timer != nil {
+		rl.timer.Stop()
+		rl.timer = nil
+	}
+	if rl.unsubscribe != nil {
+		rl.unsubscribe()
+		rl.unsubscribe = nil
+		rl.until = time.Now()
+		rl.l.WithField("flows", rl.count).Info("Stopped learning firewall rules")
+	}
+}
+
+func (rl *ruleLearner) add(e FlowEvent) {
+	key := learnedFlow{proto: e.Proto, port: e.LocalPort}
+	switch e.Proto {
+	case "tcp", "udp":
+	case "icmp":
+		// The firewall does not match on icmp types
+		key.port = 0
+	default:
+		// The firewall can not name any other protocol
+		key = learnedFlow{proto: "any"}
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	// A flow can still arrive just after we unsubscribe
+	if rl.unsubscribe == nil {
+		return
+	}
+
+	rl.count++
+	peers := rl.flows[key]
+	if peers == nil {
+		peers = map[string]learnedPeer{}
+		rl.flows[key] = peers
+	}
+	peers[e.PeerFingerprint] = learnedPeer{name: e.PeerName, groups: e.PeerGroups}
+}
+
+// suggest returns the rules for what has been learned so far
+func (rl *ruleLearner) suggest() RuleSuggestion {
+	rl.Lock()
+	defer rl.Unlock()
+
+	rs := RuleSuggestion{
+		Learning: rl.unsubscribe != nil,
+		Started:  rl.started,
+		Until:    rl.until,
+		Flows:    rl.count,
+		Rules:    []FlowRule{},
+	}
+
+	// Describe the peers of every flow, then collapse the ports of flows with the same peers
+	type ruleKey struct {
+		proto    string
+		selector string
+	}
+	ports := map[ruleKey][]uint16{}
+	selectors := map[string]FlowRule{}
+	for f, peers := range rl.flows {
+		for _, sel := range selectPeers(peers) {
+			k := ruleKey{proto: f.proto, selector: sel.Host + "\x00" + strings.Join(sel.Groups, "\x00")}
+			ports[k] = append(ports[k], f.port)
+			selectors[k.selector] = sel
+		}
+	}
+
+	for k, p := range ports {
+		for _, pr := range portRanges(p) {
+			r := selectors[k.selector]
+			r.Proto = k.proto
+			r.Port = pr
+			rs.Rules = append(rs.Rules, r)
+		}
+	}
+
+	slices.SortFunc(rs.Rules, func(a, b FlowRule) int {
+		return cmp.Or(
+			cmp.Compare(a.Proto, b.Proto),
+			cmp.Compare(firstPort(a.Port), firstPort(b.Port)),
+			cmp.Compare(a.Host, b.Host),
+			slices.Compare(a.Groups, b.Groups),
+		)
+	})
+	return rs
+}
+
+// selectPeers returns the fewest rule selectors that cover peers. Each picks the group held by the most peers not yet
+// covered and narrows it to every group those peers have in common, peers without groups are named.
+func selectPeers(peers map[string]learnedPeer) []FlowRule {
+	var out []FlowRule
+	left := map[string]learnedPeer{}
+	names := map[string]struct{}{}
+	for fp, p := range peers {
+		if len(p.groups) == 0 {
+			names[p.name] = struct{}{}
+		} else {
+			left[fp] = p
+		}
+	}
+
+	for len(left) > 0 {
+		counts := map[string]int{}
+		for _, p := range left {
+			for _, g := range p.groups {
+				counts[g]++
+			}
+		}
+
+		best := ""
+		for g, n := range counts {
+			if n > counts[best] || (n == counts[best] && g < best) {
+				best = g
+			}
+		}
+
+		var common []string
+		for fp, p := range left {
+			if !slices.Contains(p.groups, best) {
+				continue
+			}
+			if common == nil {
+				common = slices.Clone(p.groups)
+			} else {
+				common = slices.DeleteFunc(common, func(g string) bool { return !slices.Contains(p.groups, g) })
+			}
+			delete(left, fp)
+		}
+
+		slices.Sort(common)
+		out = append(out, FlowRule{Groups: slices.Compact(common)})
+	}
+
+	for name := range names {
+		out = append(out, FlowRule{Host: name})
+	}
+	return out
+}
+
+// portRanges collapses ports into as few firewall port ranges as it can, port 0 means any port
+func portRanges(ports []uint16) []string {
+	slices.Sort(ports)
+	ports = slices.Compact(ports)
+	if len(ports) > 0 && ports[0] == 0 {
+		return []string{"any"}
+	}
+
+	var out []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		out = append(out, portString(int32(ports[i]), int32(ports[j])))
+		i = j + 1
+	}
+	return out
+}
+
+// firstPort is the start of a port range for sorting, any sorts first
+func firstPort(port string) int {
+	start, _, _ := strings.Cut(port, "-")
+	p, _ := strconv.Atoi(start)
+	return p
+}
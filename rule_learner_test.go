@@ -0,0 +1,78 @@
+package nebula
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleLearner(t *testing.T) {
+	l := test.NewLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fl, err := newFlowLogFromConfig(ctx, l, config.NewC(l))
+	require.NoError(t, err)
+	rl := newRuleLearner(l, fl)
+	assert.Contains(t, rl.suggest().String(), "Nothing has been learned")
+	require.Error(t, rl.start(0))
+
+	require.NoError(t, rl.start(time.Hour))
+	assert.True(t, fl.wanted())
+
+	flow := func(name, fingerprint, proto string, port uint16, groups ...string) {
+		rl.add(FlowEvent{PeerName: name, PeerFingerprint: fingerprint, PeerGroups: groups, Proto: proto, LocalPort: port})
+	}
+	// Web servers are reached by every host in the lb group, they all share the prod group too
+	flow("lb1", "a", "tcp", 80, "lb", "prod")
+	flow("lb2", "b", "tcp", 80, "lb", "prod", "east")
+	flow("lb1", "a", "tcp", 443, "lb", "prod")
+	flow("lb2", "b", "tcp", 443, "lb", "prod", "east")
+	// A range of ports used by one peer without groups
+	flow("laptop", "c", "tcp", 8000)
+	flow("laptop", "c", "tcp", 8001)
+	flow("laptop", "c", "tcp", 8002)
+	flow("laptop", "c", "tcp", 8004)
+	// Two peers with nothing in common need a rule each
+	flow("mon", "d", "udp", 161, "monitoring")
+	flow("db", "e", "udp", 161, "database")
+	// Icmp has no ports and unknown protocols become any
+	flow("mon", "d", "icmp", 8, "monitoring")
+	flow("mon", "d", "47", 0, "monitoring")
+
+	rs := rl.suggest()
+	assert.True(t, rs.Learning)
+	assert.Equal(t, 12, rs.Flows)
+	assert.Equal(t, []FlowRule{
+		{Port: "any", Proto: "any", Groups: []string{"monitoring"}},
+		{Port: "any", Proto: "icmp", Groups: []string{"monitoring"}},
+		{Port: "80", Proto: "tcp", Groups: []string{"lb", "prod"}},
+		{Port: "443", Proto: "tcp", Groups: []string{"lb", "prod"}},
+		{Port: "8000-8002", Proto: "tcp", Host: "laptop"},
+		{Port: "8004", Proto: "tcp", Host: "laptop"},
+		{Port: "161", Proto: "udp", Groups: []string{"database"}},
+		{Port: "161", Proto: "udp", Groups: []string{"monitoring"}},
+	}, rs.Rules)
+	assert.Contains(t, rs.String(), "  - port: 8000-8002\n    proto: tcp\n    host: laptop\n")
+	assert.Contains(t, rs.String(), "  - port: 80\n    proto: tcp\n    groups: [lb, prod]\n")
+
+	// Stopping keeps what was learned and ignores later flows
+	rl.stop()
+	assert.False(t, fl.wanted())
+	flow("late", "f", "tcp", 22)
+	rs = rl.suggest()
+	assert.False(t, rs.Learning)
+	assert.Equal(t, 12, rs.Flows)
+
+	// Starting again forgets it, and learning ends on its own
+	require.NoError(t, rl.start(10*time.Millisecond))
+	assert.Equal(t, 0, rl.suggest().Flows)
+	assert.Eventually(t, func() bool { return !rl.suggest().Learning }, time.Second, 5*time.Millisecond)
+	assert.True(t, strings.HasSuffix(rl.suggest().String(), "inbound: []\n"))
+}
@@ -0,0 +1,206 @@
+package nebula
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// securityRequirements is security.min_requirements, a compliance floor every peer certificate has to meet before we
+// finish a handshake with it. It only applies to new handshakes, tunnels that already exist are left alone.
+type securityRequirements struct {
+	// curves a peer certificate may use, any when empty
+	curves map[cert.Curve]struct{}
+	// forbiddenCiphers are never used, one of aes, chachapoly, or null
+	forbiddenCiphers map[string]struct{}
+	// maxCertLifetime is the longest a peer certificate may be valid for, from NotBefore to NotAfter
+	maxCertLifetime time.Duration
+	minCertVersion  cert.Version
+	// fips is security.fips, it restricts the curves and ciphers above to the FIPS approved P256 and aes
+	fips     bool
+	rejected metrics.Counter
+}
+
+// newSecurityRequirementsFromConfig returns nil if neither security.min_requirements nor security.fips are configured.
+// cipher is the cipher we use, it is an error to forbid it.
+func newSecurityRequirementsFromConfig(c *config.C, cipher string) (*securityRequirements, error) {
+	sr := &securityRequirements{
+		fips:             c.GetBool("security.fips", false),
+		curves:           map[cert.Curve]struct{}{},
+		forbiddenCiphers: map[string]struct{}{},
+		maxCertLifetime:  c.GetDuration("security.min_requirements.max_cert_lifetime", 0),
+		minCertVersion:   cert.Version(c.GetInt("security.min_requirements.min_cert_version", 0)),
+	}
+
+	for _, raw := range c.GetStringSlice("security.min_requirements.curves", []string{}) {
+		curve, ok := cert.Curve_value[strings.ToUpper(raw)]
+		if !ok {
+			return nil, fmt.Errorf("security.min_requirements.curves has unknown curve %q", raw)
+		}
+		sr.curves[cert.Curve(curve)] = struct{}{}
+	}
+
+	for _, raw := range c.GetStringSlice("security.min_requirements.forbidden_ciphers", []string{}) {
+		name := strings.ToLower(raw)
+		if name == "<nil>" {
+			// yaml reads a bare null as nil
+			name = "null"
+		}
+
+		switch name {
+		case "aes", "chachapoly", "null":
+		default:
+			return nil, fmt.Errorf("security.min_requirements.forbidden_ciphers has unknown cipher %q", raw)
+		}
+
+		if name == cipher {
+			return nil, fmt.Errorf("security.min_requirements.forbidden_ciphers forbids the configured cipher %s", cipher)
+		}
+		sr.forbiddenCiphers[name] = struct{}{}
+	}
+
+	if sr.maxCertLifetime < 0 {
+		return nil, fmt.Errorf("security.min_requirements.max_cert_lifetime can not be negative")
+	}
+
+	if sr.minCertVersion != 0 && sr.minCertVersion != cert.Version1 && sr.minCertVersion != cert.Version2 {
+		return nil, fmt.Errorf("security.min_requirements.min_cert_version must be 1 or 2")
+	}
+
+	if sr.fips {
+		if len(sr.curves) > 0 {
+			if _, ok := sr.curves[cert.Curve_P256]; !ok {
+				return nil, fmt.Errorf("security.min_requirements.curves must include P256 when security.fips is enabled")
+			}
+		}
+		sr.curves = map[cert.Curve]struct{}{cert.Curve_P256: {}}
+
+		if cipher != "aes" {
+			return nil, fmt.Errorf("security.fips requires cipher aes, not %s", cipher)
+		}
+		sr.forbiddenCiphers["chachapoly"] = struct{}{}
+		sr.forbiddenCiphers["null"] = struct{}{}
+	}
+
+	if len(sr.curves) == 0 && len(sr.forbiddenCiphers) == 0 && sr.maxCertLifetime == 0 && sr.minCertVersion == 0 && !sr.fips {
+		return nil, nil
+	}
+
+	sr.rejected = metrics.GetOrRegisterCounter("handshakes.min_requirements.rejected", nil)
+	return sr, nil
+}
+
+// check returns why c does not meet the requirements, a nil securityRequirements allows everything
+func (sr *securityRequirements) check(c cert.Certificate) error {
+	if sr == nil {
+		return nil
+	}
+
+	err := sr.validate(c)
+	if err != nil {
+		sr.rejected.Inc(1)
+	}
+	return err
+}
+
+// validate is check without counting the rejection
+func (sr *securityRequirements) validate(c cert.Certificate) error {
+	if len(sr.curves) > 0 {
+		if _, ok := sr.curves[c.Curve()]; !ok {
+			if sr.fips {
+				return fmt.Errorf("certificate curve %s is not FIPS approved", c.Curve())
+			}
+			return fmt.Errorf("certificate curve %s is not allowed", c.Curve())
+		}
+	}
+
+	if sr.minCertVersion != 0 && c.Version() < sr.minCertVersion {
+		return fmt.Errorf("certificate version %d is lower than %d", c.Version(), sr.minCertVersion)
+	}
+
+	if sr.maxCertLifetime > 0 {
+		if lifetime := c.NotAfter().Sub(c.NotBefore()); lifetime > sr.maxCertLifetime {
+			return fmt.Errorf("certificate lifetime %s is longer than %s", lifetime, sr.maxCertLifetime)
+		}
+	}
+
+	return nil
+}
+
+// forbidsCipher reports if cipher may not be used, a nil securityRequirements allows everything
+func (sr *securityRequirements) forbidsCipher(cipher string) bool {
+	if sr == nil {
+		return false
+	}
+
+	_, ok := sr.forbiddenCiphers[cipher]
+	return ok
+}
+
+// fipsMode reports if security.fips is enabled, a nil securityRequirements is not
+func (sr *securityRequirements) fipsMode() bool {
+	return sr != nil && sr.fips
+}
+
+// checkFIPS refuses to start in security.fips mode unless we are built with boringcrypto and our own certificates use
+// an approved curve and cipher. It also vets certificates from a pki reload.
+func (sr *securityRequirements) checkFIPS(cs *CertState) error {
+	if !sr.fipsMode() {
+		return nil
+	}
+
+	if !boringEnabled() {
+		return fmt.Errorf("security.fips requires nebula to be built with boringcrypto")
+	}
+
+	if cs.cipher != "aes" {
+		return fmt.Errorf("security.fips requires cipher aes, not %s", cs.cipher)
+	}
+
+	for _, c := range []cert.Certificate{cs.v1Cert, cs.v2Cert} {
+		if c != nil && c.Curve() != cert.Curve_P256 {
+			return fmt.Errorf("security.fips requires a P256 certificate, version %d uses %s", c.Version(), c.Curve())
+		}
+	}
+
+	return nil
+}
+
+// reloadSecurityRequirements picks up security.min_requirements, it only applies to tunnels handshaked after the change.
+// security.fips can only be changed with a restart.
+func (f *Interface) reloadSecurityRequirements(c *config.C) {
+	if !c.HasChanged("security.min_requirements") && !c.HasChanged("security.fips") {
+		return
+	}
+
+	if c.GetBool("security.fips", false) != f.securityRequirements.Load().fipsMode() {
+		f.l.Error("security.fips can not be changed with a reload, restart nebula to change it")
+		return
+	}
+
+	sr, err := newSecurityRequirementsFromConfig(c, f.pki.getCertState().cipher)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load security.min_requirements, keeping the previous one")
+		return
+	}
+
+	f.securityRequirements.Store(sr)
+	f.checkOwnSecurityRequirements(sr)
+	f.l.Info("security.min_requirements has changed")
+}
+
+// checkOwnSecurityRequirements warns when our own certificate would be refused by peers with the same requirements
+func (f *Interface) checkOwnSecurityRequirements(sr *securityRequirements) {
+	if sr == nil {
+		return
+	}
+
+	if err := sr.validate(f.pki.getCertState().GetDefaultCertificate()); err != nil {
+		f.l.WithError(err).
+			Warn("Our own certificate does not meet the requirements, peers enforcing them will refuse us")
+	}
+}
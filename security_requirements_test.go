@@ -0,0 +1,152 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSecurityRequirementsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	sr, err := newSecurityRequirementsFromConfig(c, "aes")
+	require.NoError(t, err)
+	assert.Nil(t, sr)
+	assert.NoError(t, sr.check(&dummyCert{}))
+	assert.False(t, sr.forbidsCipher("null"))
+
+	require.NoError(t, c.LoadString("security:\n  min_requirements:\n    curves: [nope]"))
+	_, err = newSecurityRequirementsFromConfig(c, "aes")
+	require.EqualError(t, err, `security.min_requirements.curves has unknown curve "nope"`)
+
+	require.NoError(t, c.ReloadConfigString("security:\n  min_requirements:\n    forbidden_ciphers: [aes]"))
+	_, err = newSecurityRequirementsFromConfig(c, "aes")
+	require.EqualError(t, err, "security.min_requirements.forbidden_ciphers forbids the configured cipher aes")
+
+	require.NoError(t, c.ReloadConfigString("security:\n  min_requirements:\n    min_cert_version: 3"))
+	_, err = newSecurityRequirementsFromConfig(c, "aes")
+	require.EqualError(t, err, "security.min_requirements.min_cert_version must be 1 or 2")
+}
+
+func TestSecurityRequirements_check(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(`
+security:
+  min_requirements:
+    curves: [p256]
+    forbidden_ciphers: [null]
+    max_cert_lifetime: 24h
+    min_cert_version: 2
+`))
+	sr, err := newSecurityRequirementsFromConfig(c, "aes")
+	require.NoError(t, err)
+	assert.True(t, sr.forbidsCipher("null"))
+	assert.False(t, sr.forbidsCipher("aes"))
+
+	now := time.Now()
+	good := &dummyCert{version: cert.Version2, curve: cert.Curve_P256, notBefore: now, notAfter: now.Add(time.Hour)}
+	require.NoError(t, sr.check(good))
+
+	bad := *good
+	bad.curve = cert.Curve_CURVE25519
+	require.EqualError(t, sr.check(&bad), "certificate curve CURVE25519 is not allowed")
+
+	bad = *good
+	bad.version = cert.Version1
+	require.EqualError(t, sr.check(&bad), "certificate version 1 is lower than 2")
+
+	bad = *good
+	bad.notAfter = now.Add(48 * time.Hour)
+	require.EqualError(t, sr.check(&bad), "certificate lifetime 48h0m0s is longer than 24h0m0s")
+}
+
+func TestInterface_nullCipherForbidden(t *testing.T) {
+	l := test.NewLogger()
+	f := &Interface{l: l}
+	peer := &cert.CachedCertificate{Certificate: &dummyCert{}, InvertedGroups: map[string]struct{}{"fabric": {}}}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("null_cipher:\n  groups: [fabric]\nsecurity:\n  min_requirements:\n    forbidden_ciphers: [null]"))
+	f.reloadNullCipher(c)
+	assert.True(t, f.offerNullCipher())
+
+	sr, err := newSecurityRequirementsFromConfig(c, "aes")
+	require.NoError(t, err)
+	f.securityRequirements.Store(sr)
+	assert.False(t, f.offerNullCipher())
+	assert.False(t, f.allowsNullCipher(peer))
+}
+
+func TestSecurityRequirements_fips(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("security:\n  fips: true"))
+
+	_, err := newSecurityRequirementsFromConfig(c, "chachapoly")
+	require.EqualError(t, err, "security.fips requires cipher aes, not chachapoly")
+
+	sr, err := newSecurityRequirementsFromConfig(c, "aes")
+	require.NoError(t, err)
+	assert.True(t, sr.fipsMode())
+	assert.True(t, sr.forbidsCipher("null"))
+	assert.True(t, sr.forbidsCipher("chachapoly"))
+	require.NoError(t, sr.check(&dummyCert{curve: cert.Curve_P256}))
+	require.EqualError(t, sr.check(&dummyCert{curve: cert.Curve_CURVE25519}), "certificate curve CURVE25519 is not FIPS approved")
+
+	cs := &CertState{v2Cert: &dummyCert{version: cert.Version2, curve: cert.Curve_CURVE25519}, cipher: "aes"}
+	if boringEnabled() {
+		require.EqualError(t, sr.checkFIPS(cs), "security.fips requires a P256 certificate, version 2 uses CURVE25519")
+	} else {
+		require.EqualError(t, sr.checkFIPS(cs), "security.fips requires nebula to be built with boringcrypto")
+	}
+
+	require.NoError(t, c.ReloadConfigString("security:\n  fips: true\n  min_requirements:\n    curves: [CURVE25519]"))
+	_, err = newSecurityRequirementsFromConfig(c, "aes")
+	require.EqualError(t, err, "security.min_requirements.curves must include P256 when security.fips is enabled")
+
+	var nilSr *securityRequirements
+	assert.False(t, nilSr.fipsMode())
+	require.NoError(t, nilSr.checkFIPS(cs))
+}
+
+func TestPKI_reloadCheckCertState(t *testing.T) {
+	l := test.NewLogger()
+	networks := []netip.Prefix{netip.MustParsePrefix("10.128.0.1/24")}
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Time{}, time.Time{}, nil, nil, nil)
+	caPEM, err := ca.MarshalPEM()
+	require.NoError(t, err)
+
+	pkiConfig := func(name string) string {
+		_, _, key, certPEM := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, name, time.Time{}, time.Time{}, networks, nil, nil)
+		return fmt.Sprintf("pki:\n  ca: %q\n  cert: %q\n  key: %q\n", caPEM, certPEM, key)
+	}
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString(pkiConfig("before")))
+	p, err := NewPKIFromConfig(l, c)
+	require.NoError(t, err)
+	p.checkCertState = func(*CertState) error { return errors.New("not allowed") }
+
+	// A refused cert leaves the old one in place
+	require.NoError(t, c.ReloadConfigString(pkiConfig("after")))
+	assert.Equal(t, "before", p.getCertState().GetDefaultCertificate().Name())
+
+	p.checkCertState = nil
+	require.NoError(t, c.ReloadConfigString(pkiConfig("after")))
+	assert.Equal(t, "after", p.getCertState().GetDefaultCertificate().Name())
+
+	// In security.fips mode a chachapoly cert state is refused as well
+	sr := &securityRequirements{fips: true}
+	require.Error(t, sr.checkFIPS(&CertState{cipher: "chachapoly"}))
+}
@@ -0,0 +1,575 @@
+package nebula
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/noiseutil"
+)
+
+// With tunnels.warm_restart.resume the warm restart file also holds a session ticket for every tunnel, sealed with a
+// key derived from our private key. After a restart we send each peer that still has the tunnel a resume request
+// instead of a full handshake, one round trip brings the tunnel back without certificates or a lighthouse query.
+//
+// Every tunnel derives a resumption secret from its keys. A resume request names the tunnel by the peer's index and
+// the ticket id, carries a fresh nonce, and is authenticated with the secret. The peer answers with its own nonce and
+// both sides derive new keys and a new secret from the old secret and the two nonces, so no keys are ever reused and
+// every ticket works once. Peers that restarted as well, changed their config, or do not answer within the timeout
+// get a regular handshake. Both hosts must enable resume.
+//
+// A ticket is held to the same peer_filter, security.min_requirements, cipher, and null_cipher checks as a handshake,
+// the config may have changed while we were down. Resumed keys come from the old secret without a new key exchange, so
+// anyone holding our private key and the warm restart file could read them. The initiator rehandshakes each resumed
+// tunnel shortly after to get forward secrecy back.
+
+const (
+	resumeNonceLen = 32
+	// resumeBodyLen is the ticket id, index, source ports, hop schedule, nonce, and mac that follow the header
+	resumeBodyLen = 8 + 4 + 4 + 4 + resumeNonceLen + sha256.Size
+
+	// defaultResumeTimeout is how long we wait for a resume answer before handshaking instead
+	defaultResumeTimeout = 2 * time.Second
+
+	// resumeRehandshakeDelay is the least time before a resumed tunnel is rehandshaked, resumeRehandshakeJitter is
+	// added at random so the tunnels resumed after a restart do not all handshake at once
+	resumeRehandshakeDelay  = 10 * time.Second
+	resumeRehandshakeJitter = time.Minute
+)
+
+var errResumeInvalid = errors.New("invalid resume message")
+
+// newResumeSecret derives the resumption secret of a tunnel from its keys, both sides arrive at the same one
+func newResumeSecret(initiator bool, eKey, dKey *noise.CipherState) []byte {
+	i2r, r2i := eKey.UnsafeKey(), dKey.UnsafeKey()
+	if !initiator {
+		i2r, r2i = r2i, i2r
+	}
+
+	secret, _ := hkdf.Key(sha256.New, append(i2r[:], r2i[:]...), nil, "nebula resumption secret", 32)
+	return secret
+}
+
+// resumeTicketID names the ticket for secret, it is sent in the clear
+func resumeTicketID(secret []byte) uint64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("nebula ticket id"))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// resumeKeys derives the keys and resumption secret of the resumed tunnel
+func resumeKeys(secret, initiatorNonce, responderNonce []byte) (i2r, r2i [32]byte, next []byte) {
+	salt := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	// The lengths are fixed, this can not fail
+	b, _ := hkdf.Key(sha256.New, secret, salt, "nebula resume", 96)
+	copy(i2r[:], b[:32])
+	copy(r2i[:], b[32:64])
+	return i2r, r2i, b[64:]
+}
+
+// resumeMessage is the body of a resume request or answer
+type resumeMessage struct {
+	ticketID    uint64
+	index       uint32
+	sourcePorts uint32
+	hopSchedule uint32
+	nonce       []byte
+}
+
+// marshal encodes m after h and authenticates it with secret, answers are bound to the nonce of the request in bind
+func (m *resumeMessage) marshal(h, secret, bind []byte) []byte {
+	b := make([]byte, 0, header.Len+resumeBodyLen)
+	b = append(b, h...)
+	b = binary.BigEndian.AppendUint64(b, m.ticketID)
+	b = binary.BigEndian.AppendUint32(b, m.index)
+	b = binary.BigEndian.AppendUint32(b, m.sourcePorts)
+	b = binary.BigEndian.AppendUint32(b, m.hopSchedule)
+	b = append(b, m.nonce...)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b)
+	mac.Write(bind)
+	return mac.Sum(b)
+}
+
+// parseResumeMessage reads the body of packet without authenticating it, see verifyResumeMessage
+func parseResumeMessage(packet []byte) (*resumeMessage, error) {
+	if len(packet) != header.Len+resumeBodyLen {
+		return nil, errResumeInvalid
+	}
+
+	b := packet[header.Len:]
+	return &resumeMessage{
+		ticketID:    binary.BigEndian.Uint64(b),
+		index:       binary.BigEndian.Uint32(b[8:]),
+		sourcePorts: binary.BigEndian.Uint32(b[12:]),
+		hopSchedule: binary.BigEndian.Uint32(b[16:]),
+		nonce:       b[20 : 20+resumeNonceLen],
+	}, nil
+}
+
+// verifyResumeMessage checks that packet was authenticated with secret and is for its ticket
+func verifyResumeMessage(m *resumeMessage, packet, secret, bind []byte) error {
+	if m.ticketID != resumeTicketID(secret) {
+		return errResumeInvalid
+	}
+
+	end := len(packet) - sha256.Size
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(packet[:end])
+	mac.Write(bind)
+	if !hmac.Equal(mac.Sum(nil), packet[end:]) {
+		return errResumeInvalid
+	}
+	return nil
+}
+
+// sessionTicket is what we need to resume a tunnel, it is sealed before it is written to disk
+type sessionTicket struct {
+	Secret      []byte `json:"secret"`
+	Cipher      string `json:"cipher"`
+	NullCipher  bool   `json:"nullCipher"`
+	CertVersion int    `json:"certVersion"`
+	PeerCert    []byte `json:"peerCert"`
+}
+
+// ticketAEAD is the cipher tickets are sealed with, it fails if our private key is held in a device
+func ticketAEAD(cs *CertState) (cipher.AEAD, error) {
+	if cs.keyInDevice {
+		return nil, errors.New("session tickets need a private key nebula can read")
+	}
+
+	key, err := hkdf.Key(sha256.New, cs.privateKey, nil, "nebula session tickets", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTicket returns the sealed ticket for hostinfo, nil if it can not be resumed
+func sealTicket(cs *CertState, hostinfo *HostInfo) ([]byte, error) {
+	ci := hostinfo.ConnectionState
+	if ci == nil || ci.resumeSecret == nil || ci.peerCert == nil {
+		return nil, nil
+	}
+
+	peerCert, err := ci.peerCert.Certificate.MarshalPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(sessionTicket{
+		Secret:      ci.resumeSecret,
+		Cipher:      ci.cipher,
+		NullCipher:  ci.nullCipher,
+		CertVersion: int(ci.myCert.Version()),
+		PeerCert:    peerCert,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := ticketAEAD(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, b, nil), nil
+}
+
+// openTicket undoes sealTicket
+func openTicket(cs *CertState, b []byte) (*sessionTicket, error) {
+	aead, err := ticketAEAD(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("session ticket is too short")
+	}
+
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session ticket: %w", err)
+	}
+
+	t := &sessionTicket{}
+	if err := json.Unmarshal(plain, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// pendingResume is a resume request we sent and are waiting on an answer for
+type pendingResume struct {
+	vpnAddrs []netip.Addr
+	ticket   *sessionTicket
+	peerCert *cert.CachedCertificate
+	nonce    []byte
+}
+
+// sessionResumption sends and answers resume requests, nil when tunnels.warm_restart.resume is off
+type sessionResumption struct {
+	f       *Interface
+	l       *logrus.Logger
+	timeout time.Duration
+
+	sync.Mutex
+	// pending are the resume requests we sent by the local index of the tunnel they bring back
+	pending map[uint32]*pendingResume
+}
+
+func newSessionResumption(l *logrus.Logger, f *Interface, timeout time.Duration) *sessionResumption {
+	return &sessionResumption{f: f, l: l, timeout: timeout, pending: map[uint32]*pendingResume{}}
+}
+
+// start sends a resume request for a tunnel from before the restart, false if it can not be resumed and should be
+// handshaked instead. If the peer does not answer within the timeout we handshake with it.
+func (r *sessionResumption) start(t warmRestartTunnel) bool {
+	if r == nil || len(t.Ticket) == 0 || !t.Remote.IsValid() || len(t.VpnAddrs) == 0 {
+		return false
+	}
+
+	f := r.f
+	l := r.l.WithField("vpnAddrs", t.VpnAddrs).WithField("udpAddr", t.Remote)
+	ticket, err := openTicket(f.pki.getCertState(), t.Ticket)
+	if err != nil {
+		l.WithError(err).Info("Failed to load the session ticket, handshaking instead")
+		return false
+	}
+
+	crt, _, err := cert.UnmarshalCertificateFromPEM(ticket.PeerCert)
+	if err != nil {
+		l.WithError(err).Info("Failed to load the session ticket, handshaking instead")
+		return false
+	}
+
+	// The certificate may have expired or been blocklisted while we were down
+	peerCert, err := f.pki.GetCAPool().VerifyCertificate(time.Now(), crt)
+	if err != nil {
+		l.WithError(err).Info("Peer certificate in the session ticket is no longer valid, handshaking instead")
+		return false
+	}
+
+	if err := f.resumeAllowed(peerCert, ticket.Cipher, ticket.NullCipher); err != nil {
+		l.WithError(err).Info("Session ticket is no longer allowed by our config, handshaking instead")
+		return false
+	}
+
+	index, err := r.allocateIndex()
+	if err != nil {
+		l.WithError(err).Error("Failed to resume tunnel")
+		return false
+	}
+
+	p := &pendingResume{vpnAddrs: t.VpnAddrs, ticket: ticket, peerCert: peerCert, nonce: make([]byte, resumeNonceLen)}
+	if _, err := rand.Read(p.nonce); err != nil {
+		l.WithError(err).Error("Failed to resume tunnel")
+		return false
+	}
+
+	r.Lock()
+	r.pending[index] = p
+	r.Unlock()
+
+	req := resumeMessage{
+		ticketID:    resumeTicketID(ticket.Secret),
+		index:       index,
+		sourcePorts: f.sourcePortCount(),
+		hopSchedule: f.portHopper.scheduleID(),
+		nonce:       p.nonce,
+	}
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeResume, t.RemoteIndex, 1)
+	f.messageMetrics.Tx(header.Handshake, header.HandshakeResume, 1)
+	if err := f.outside.WriteTo(req.marshal(h, ticket.Secret, nil), t.Remote); err != nil {
+		l.WithError(err).Error("Failed to send resume request")
+	} else {
+		l.WithField("handshake", m{"stage": 1, "style": "resume"}).Info("Resume request sent")
+	}
+
+	time.AfterFunc(r.timeout, func() {
+		r.Lock()
+		_, unanswered := r.pending[index]
+		delete(r.pending, index)
+		r.Unlock()
+
+		if unanswered {
+			l.Info("Peer did not answer the resume request, handshaking instead")
+			f.handshakeManager.StartHandshake(t.VpnAddrs[0], nil)
+		}
+	})
+
+	return true
+}
+
+// allocateIndex picks a local index no tunnel, handshake, or pending resume uses
+func (r *sessionResumption) allocateIndex() (uint32, error) {
+	hm := r.f.handshakeManager
+	for range 32 {
+		index, err := generateIndex(r.l)
+		if err != nil {
+			return 0, err
+		}
+
+		hm.mainHostMap.RLock()
+		_, inMain := hm.mainHostMap.Indexes[index]
+		hm.mainHostMap.RUnlock()
+		hm.RLock()
+		_, inPending := hm.indexes[index]
+		hm.RUnlock()
+		r.Lock()
+		_, inResume := r.pending[index]
+		r.Unlock()
+
+		if !inMain && !inPending && !inResume {
+			return index, nil
+		}
+	}
+
+	return 0, errors.New("failed to generate unique localIndexId")
+}
+
+// handleRequest answers a resume request from a peer that restarted, packet is the whole message
+func (r *sessionResumption) handleRequest(via ViaSender, packet []byte, h *header.H) {
+	if r == nil || via.IsRelayed {
+		return
+	}
+
+	f := r.f
+	old := f.hostMap.QueryIndex(h.RemoteIndex)
+	req, err := parseResumeMessage(packet)
+	if old == nil || old.ConnectionState == nil || old.ConnectionState.resumeSecret == nil || err != nil {
+		r.l.WithField("from", via).WithField("remoteIndex", h.RemoteIndex).Debug("Unknown resume request")
+		return
+	}
+
+	ci := old.ConnectionState
+	l := old.logger(r.l).WithField("from", via).WithField("handshake", m{"stage": 1, "style": "resume"})
+	if err := verifyResumeMessage(req, packet, ci.resumeSecret, nil); err != nil {
+		l.WithError(err).Info("Refused resume request")
+		return
+	}
+
+	if err := f.pki.GetCAPool().VerifyCachedCertificate(time.Now(), ci.peerCert); err != nil {
+		l.WithError(err).Info("Refused resume request, the peer certificate is no longer valid")
+		return
+	}
+
+	// The peer handshakes once its request times out
+	if err := f.resumeAllowed(ci.peerCert, ci.cipher, ci.nullCipher); err != nil {
+		l.WithError(err).Info("Refused resume request, the tunnel is no longer allowed by our config")
+		return
+	}
+
+	index, err := r.allocateIndex()
+	if err != nil {
+		l.WithError(err).Error("Failed to resume tunnel")
+		return
+	}
+
+	nonce := make([]byte, resumeNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		l.WithError(err).Error("Failed to resume tunnel")
+		return
+	}
+
+	i2r, r2i, next := resumeKeys(ci.resumeSecret, req.nonce, nonce)
+	nci := resumedConnectionState(r.l, ci.myCert, ci.peerCert, ci.cipher, ci.nullCipher, false, r2i, i2r, next)
+	nci.compression = ci.compression
+	nci.peerSourcePorts = req.sourcePorts
+	nci.peerHopSchedule = req.hopSchedule
+
+	res := resumeMessage{
+		ticketID:    req.ticketID,
+		index:       index,
+		sourcePorts: f.sourcePortCount(),
+		hopSchedule: f.portHopper.scheduleID(),
+		nonce:       nonce,
+	}
+	rh := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeResume, req.index, 2)
+	msg := res.marshal(rh, ci.resumeSecret, req.nonce)
+
+	hostinfo := newResumedHostInfo(old.vpnAddrs, index, req.index, nci)
+	hostinfo.remotes = old.remotes
+	r.complete(hostinfo, via.UdpAddr, old)
+
+	f.messageMetrics.Tx(header.Handshake, header.HandshakeResume, 1)
+	if err := f.outside.WriteTo(msg, via.UdpAddr); err != nil {
+		l.WithError(err).Error("Failed to send resume answer")
+		return
+	}
+	l.WithField("localIndex", index).WithField("remoteIndex", req.index).Info("Tunnel resumed")
+}
+
+// handleResponse finishes a tunnel we asked to resume, packet is the whole message
+func (r *sessionResumption) handleResponse(via ViaSender, packet []byte, h *header.H) {
+	if r == nil || via.IsRelayed {
+		return
+	}
+
+	res, err := parseResumeMessage(packet)
+	if err != nil {
+		return
+	}
+
+	r.Lock()
+	p, ok := r.pending[h.RemoteIndex]
+	if ok {
+		if err = verifyResumeMessage(res, packet, p.ticket.Secret, p.nonce); err == nil {
+			// Only the first valid answer counts
+			delete(r.pending, h.RemoteIndex)
+		}
+	}
+	r.Unlock()
+
+	l := r.l.WithField("from", via).WithField("handshake", m{"stage": 2, "style": "resume"})
+	if !ok || err != nil {
+		l.WithField("remoteIndex", h.RemoteIndex).Debug("Unknown resume answer")
+		return
+	}
+
+	f := r.f
+	myCert := f.pki.getCertState().getCertificate(cert.Version(p.ticket.CertVersion))
+	if myCert == nil {
+		l.WithField("vpnAddrs", p.vpnAddrs).Info("Our certificate changed, handshaking instead")
+		f.handshakeManager.StartHandshake(p.vpnAddrs[0], nil)
+		return
+	}
+
+	// Our config may have been reloaded while we waited on the answer
+	if err := f.resumeAllowed(p.peerCert, p.ticket.Cipher, p.ticket.NullCipher); err != nil {
+		l.WithError(err).WithField("vpnAddrs", p.vpnAddrs).Info("Session ticket is no longer allowed by our config, handshaking instead")
+		f.handshakeManager.StartHandshake(p.vpnAddrs[0], nil)
+		return
+	}
+
+	i2r, r2i, next := resumeKeys(p.ticket.Secret, p.nonce, res.nonce)
+	ci := resumedConnectionState(r.l, myCert, p.peerCert, p.ticket.Cipher, p.ticket.NullCipher, true, i2r, r2i, next)
+	ci.compression = f.compressionFor(p.peerCert, uint32(supportedCompression))
+	ci.peerSourcePorts = res.sourcePorts
+	ci.peerHopSchedule = res.hopSchedule
+
+	hostinfo := newResumedHostInfo(p.vpnAddrs, h.RemoteIndex, res.index, ci)
+	hostinfo.remotes = f.lightHouse.QueryCache(p.vpnAddrs)
+	r.complete(hostinfo, via.UdpAddr, nil)
+	hostinfo.logger(r.l).WithField("from", via).WithField("handshake", m{"stage": 2, "style": "resume"}).
+		Info("Tunnel resumed")
+
+	time.AfterFunc(resumeRehandshakeDelay+time.Duration(mathrand.Int64N(int64(resumeRehandshakeJitter))), func() {
+		r.rehandshake(hostinfo)
+	})
+}
+
+// rehandshake replaces a resumed tunnel with a handshaked one for forward secrecy, unless it was already replaced
+func (r *sessionResumption) rehandshake(hostinfo *HostInfo) {
+	if r.f.hostMap.QueryIndex(hostinfo.localIndexId) != hostinfo {
+		return
+	}
+
+	hostinfo.logger(r.l).Info("Rehandshaking resumed tunnel for forward secrecy")
+	r.f.handshakeManager.Rehandshake(hostinfo.vpnAddrs[0])
+}
+
+// resumeAllowed applies the checks of a handshake to a tunnel about to be resumed with peerCert, cipherName and
+// nullCipher from its ticket
+func (f *Interface) resumeAllowed(peerCert *cert.CachedCertificate, cipherName string, nullCipher bool) error {
+	if !f.peerFilter.Load().allows(peerCert) {
+		return errors.New("peer is denied by peer_filter")
+	}
+
+	sr := f.securityRequirements.Load()
+	if err := sr.check(peerCert.Certificate); err != nil {
+		return err
+	}
+
+	if cipherName != f.pki.getCertState().cipher || sr.forbidsCipher(cipherName) {
+		return fmt.Errorf("cipher %s is no longer allowed", cipherName)
+	}
+
+	if nullCipher && !f.allowsNullCipher(peerCert) {
+		return errors.New("null cipher is no longer allowed")
+	}
+
+	return nil
+}
+
+// complete adds a resumed tunnel to the hostmap in place of old
+func (r *sessionResumption) complete(hostinfo *HostInfo, remote netip.AddrPort, old *HostInfo) {
+	f := r.f
+	hostinfo.lastHandshakeTime = uint64(time.Now().UnixNano())
+	hostinfo.SetRemote(remote)
+	hostinfo.remoteHistory.seen(remote, true, time.Now())
+	hostinfo.buildNetworks(f.myVpnNetworksTable, hostinfo.ConnectionState.peerCert.Certificate)
+
+	f.hostMap.Lock()
+	f.hostMap.unlockedAddHostInfo(hostinfo, f)
+	f.hostMap.Unlock()
+	if old != nil {
+		f.closeTunnel(old)
+	}
+
+	f.connectionManager.AddTrafficWatch(hostinfo)
+}
+
+// resumedConnectionState builds the connection state of a resumed tunnel from its new keys
+func resumedConnectionState(l *logrus.Logger, myCert cert.Certificate, peerCert *cert.CachedCertificate, cipherName string, nullCipher, initiator bool, eKey, dKey [32]byte, secret []byte) *ConnectionState {
+	var c noise.CipherFunc = noiseutil.CipherAESGCM
+	if cipherName == "chachapoly" {
+		c = noise.CipherChaChaPoly
+	}
+
+	ci := &ConnectionState{
+		eKey:         &NebulaCipherState{c: c.Cipher(eKey), authOnly: nullCipher},
+		dKey:         &NebulaCipherState{c: c.Cipher(dKey), authOnly: nullCipher},
+		myCert:       myCert,
+		peerCert:     peerCert,
+		initiator:    initiator,
+		cipher:       cipherName,
+		nullCipher:   nullCipher,
+		resumeSecret: secret,
+		window:       NewBits(ReplayWindow),
+	}
+	// Like a handshake the resume request and answer were packets 1 and 2
+	ci.messageCounter.Add(2)
+	ci.window.Update(l, 2)
+	return ci
+}
+
+func newResumedHostInfo(vpnAddrs []netip.Addr, localIndex, remoteIndex uint32, ci *ConnectionState) *HostInfo {
+	return &HostInfo{
+		vpnAddrs:        vpnAddrs,
+		localIndexId:    localIndex,
+		remoteIndexId:   remoteIndex,
+		ConnectionState: ci,
+		HandshakePacket: make(map[uint8][]byte, 0),
+		relayState: RelayState{
+			relays:         nil,
+			relayForByAddr: map[netip.Addr]*Relay{},
+			relayForByIdx:  map[uint32]*Relay{},
+		},
+	}
+}
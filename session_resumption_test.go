@@ -0,0 +1,145 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/cert_test"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeMessage(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	h := header.Encode(make([]byte, header.Len), header.Version, header.Handshake, header.HandshakeResume, 10, 1)
+	req := &resumeMessage{
+		ticketID:    resumeTicketID(secret),
+		index:       20,
+		sourcePorts: 3,
+		hopSchedule: 4,
+		nonce:       make([]byte, resumeNonceLen),
+	}
+	req.nonce[0] = 1
+	packet := req.marshal(h, secret, nil)
+
+	m, err := parseResumeMessage(packet)
+	require.NoError(t, err)
+	assert.Equal(t, req, m)
+	require.NoError(t, verifyResumeMessage(m, packet, secret, nil))
+
+	// Answers are bound to the request they answer
+	answer := req.marshal(h, secret, req.nonce)
+	m, err = parseResumeMessage(answer)
+	require.NoError(t, err)
+	require.NoError(t, verifyResumeMessage(m, answer, secret, req.nonce))
+	assert.ErrorIs(t, verifyResumeMessage(m, answer, secret, make([]byte, resumeNonceLen)), errResumeInvalid)
+
+	assert.ErrorIs(t, verifyResumeMessage(m, packet, []byte("another secret"), nil), errResumeInvalid)
+	packet[header.Len+8] ^= 1
+	assert.ErrorIs(t, verifyResumeMessage(m, packet, secret, nil), errResumeInvalid)
+
+	_, err = parseResumeMessage(packet[:len(packet)-1])
+	assert.ErrorIs(t, err, errResumeInvalid)
+}
+
+func TestResumeKeys(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	a, b := make([]byte, resumeNonceLen), make([]byte, resumeNonceLen)
+	b[0] = 1
+
+	i2r, r2i, next := resumeKeys(secret, a, b)
+	i2r2, r2i2, next2 := resumeKeys(secret, a, b)
+	assert.Equal(t, i2r, i2r2)
+	assert.Equal(t, r2i, r2i2)
+	assert.Equal(t, next, next2)
+	assert.NotEqual(t, i2r, r2i)
+	assert.NotEqual(t, secret, next)
+
+	// Every resume gets new keys
+	i2r3, _, next3 := resumeKeys(secret, b, a)
+	assert.NotEqual(t, i2r, i2r3)
+	assert.NotEqual(t, next, next3)
+}
+
+func TestSessionTicket(t *testing.T) {
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+	me, _, myKey, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "me", time.Now(), time.Now().Add(time.Hour), []netip.Prefix{netip.MustParsePrefix("10.1.0.1/24")}, nil, nil)
+	peer, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "peer", time.Now(), time.Now().Add(time.Hour), []netip.Prefix{netip.MustParsePrefix("10.1.0.2/24")}, nil, nil)
+	cs := &CertState{privateKey: myKey}
+
+	hostinfo := &HostInfo{ConnectionState: &ConnectionState{
+		myCert:       me,
+		peerCert:     &cert.CachedCertificate{Certificate: peer},
+		cipher:       "chachapoly",
+		resumeSecret: []byte("0123456789abcdef0123456789abcdef"),
+	}}
+
+	b, err := sealTicket(cs, hostinfo)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "chachapoly")
+
+	ticket, err := openTicket(cs, b)
+	require.NoError(t, err)
+	assert.Equal(t, hostinfo.ConnectionState.resumeSecret, ticket.Secret)
+	assert.Equal(t, "chachapoly", ticket.Cipher)
+	assert.Equal(t, int(cert.Version2), ticket.CertVersion)
+	c, _, err := cert.UnmarshalCertificateFromPEM(ticket.PeerCert)
+	require.NoError(t, err)
+	assert.Equal(t, "peer", c.Name())
+
+	// Only we can open our tickets
+	_, err = openTicket(&CertState{privateKey: []byte("someone else")}, b)
+	require.Error(t, err)
+	b[len(b)-1] ^= 1
+	_, err = openTicket(cs, b)
+	require.Error(t, err)
+
+	_, err = sealTicket(&CertState{keyInDevice: true}, hostinfo)
+	require.Error(t, err)
+
+	// Tunnels without a secret are not resumed
+	hostinfo.ConnectionState.resumeSecret = nil
+	b, err = sealTicket(cs, hostinfo)
+	require.NoError(t, err)
+	assert.Nil(t, b)
+}
+
+func TestInterface_resumeAllowed(t *testing.T) {
+	l := test.NewLogger()
+	ca, _, caKey, _ := cert_test.NewTestCaCert(cert.Version2, cert.Curve_CURVE25519, time.Now(), time.Now().Add(time.Hour), nil, nil, nil)
+	peer, _, _, _ := cert_test.NewTestCert(cert.Version2, cert.Curve_CURVE25519, ca, caKey, "peer", time.Now(), time.Now().Add(time.Hour), []netip.Prefix{netip.MustParsePrefix("10.1.0.2/24")}, nil, []string{"db"})
+	peerCert := &cert.CachedCertificate{Certificate: peer, InvertedGroups: map[string]struct{}{"db": {}}}
+
+	f := &Interface{l: l, pki: &PKI{}}
+	f.pki.cs.Store(&CertState{cipher: "aes"})
+	f.nullCipherGroups.Store(&[]string{"db"})
+	require.NoError(t, f.resumeAllowed(peerCert, "aes", true))
+
+	// The cipher changed while we were down
+	require.Error(t, f.resumeAllowed(peerCert, "chachapoly", false))
+
+	// null_cipher no longer covers the peer
+	f.nullCipherGroups.Store(nil)
+	require.Error(t, f.resumeAllowed(peerCert, "aes", true))
+	require.NoError(t, f.resumeAllowed(peerCert, "aes", false))
+
+	// The peer is now denied
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("peer_filter:\n  deny:\n    groups: [db]\nsecurity:\n  min_requirements:\n    curves: [P256]\n"))
+	pf, err := newPeerFilterFromConfig(c)
+	require.NoError(t, err)
+	f.peerFilter.Store(pf)
+	require.EqualError(t, f.resumeAllowed(peerCert, "aes", false), "peer is denied by peer_filter")
+	f.peerFilter.Store(nil)
+
+	// The peer certificate no longer meets security.min_requirements
+	sr, err := newSecurityRequirementsFromConfig(c, "aes")
+	require.NoError(t, err)
+	f.securityRequirements.Store(sr)
+	require.Error(t, f.resumeAllowed(peerCert, "aes", false))
+}
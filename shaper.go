@@ -0,0 +1,211 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// minShaperBurst makes sure a bucket can always hold a full sized packet
+const minShaperBurst = 2 * 9001
+
+// tokenBucket allows rate bytes per second on average with bursts of up to burst bytes
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst uint64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes n bytes worth of tokens if they are available
+func (b *tokenBucket) allow(now time.Time, n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+type groupBucket struct {
+	group  string
+	bucket *tokenBucket
+}
+
+// shaper limits the rate of tunneled traffic leaving this host. A packet must fit in its peer's bucket, the bucket
+// of every limited group the peer belongs to, and the global bucket or it is dropped.
+type shaper struct {
+	global *tokenBucket
+	hosts  map[netip.Addr]*tokenBucket
+	groups []groupBucket
+
+	dropped metrics.Counter
+}
+
+// parseRate reads a rate in bits per second with an optional k, m, or g prefix, like 10mbps, into bytes per second
+func parseRate(v any) (uint64, error) {
+	s := strings.ToLower(strings.TrimSpace(fmt.Sprintf("%v", v)))
+	s = strings.TrimSuffix(s, "bps")
+
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1000
+	case strings.HasSuffix(s, "m"):
+		mult = 1000 * 1000
+	case strings.HasSuffix(s, "g"):
+		mult = 1000 * 1000 * 1000
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%q is not a valid rate, expected something like 10mbps", fmt.Sprintf("%v", v))
+	}
+
+	return n * mult / 8, nil
+}
+
+// bucketFromConfig builds a bucket from a `{rate, burst}` map, burst defaults to 100ms of traffic at rate
+func bucketFromConfig(v any) (*tokenBucket, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a map with a rate")
+	}
+
+	rate, err := parseRate(m["rate"])
+	if err != nil {
+		return nil, err
+	}
+
+	burst := rate / 10
+	if rb, ok := m["burst"]; ok {
+		burst, err = strconv.ParseUint(fmt.Sprintf("%v", rb), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("burst %q is not a number of bytes", fmt.Sprintf("%v", rb))
+		}
+	}
+
+	if burst < minShaperBurst {
+		burst = minShaperBurst
+	}
+
+	return newTokenBucket(rate, burst), nil
+}
+
+func newShaperFromConfig(c *config.C) (*shaper, error) {
+	s := &shaper{
+		hosts:   map[netip.Addr]*tokenBucket{},
+		dropped: metrics.GetOrRegisterCounter("shaper.dropped", nil),
+	}
+
+	if c.Get("shaping.rate") != nil {
+		b, err := bucketFromConfig(c.GetMap("shaping", nil))
+		if err != nil {
+			return nil, fmt.Errorf("shaping is invalid: %w", err)
+		}
+		s.global = b
+	}
+
+	for k, v := range c.GetMap("shaping.hosts", map[string]any{}) {
+		addr, err := netip.ParseAddr(fmt.Sprintf("%v", k))
+		if err != nil {
+			return nil, fmt.Errorf("shaping.hosts.%v is not a vpn address: %w", k, err)
+		}
+
+		b, err := bucketFromConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("shaping.hosts.%v is invalid: %w", k, err)
+		}
+		s.hosts[addr.Unmap()] = b
+	}
+
+	for k, v := range c.GetMap("shaping.groups", map[string]any{}) {
+		b, err := bucketFromConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("shaping.groups.%v is invalid: %w", k, err)
+		}
+		s.groups = append(s.groups, groupBucket{group: fmt.Sprintf("%v", k), bucket: b})
+	}
+
+	return s, nil
+}
+
+func (s *shaper) enabled() bool {
+	return s != nil && (s.global != nil || len(s.hosts) > 0 || len(s.groups) > 0)
+}
+
+// allow reports if a packet of n bytes to hostinfo fits within the limits. The most specific bucket is checked first
+// so a busy peer does not use up the shared buckets.
+func (s *shaper) allow(hostinfo *HostInfo, n int) bool {
+	now := time.Now()
+
+	for _, addr := range hostinfo.vpnAddrs {
+		if b, ok := s.hosts[addr]; ok {
+			if !b.allow(now, n) {
+				s.dropped.Inc(1)
+				return false
+			}
+			break
+		}
+	}
+
+	if len(s.groups) > 0 && hostinfo.ConnectionState != nil && hostinfo.ConnectionState.peerCert != nil {
+		for _, g := range s.groups {
+			if _, ok := hostinfo.ConnectionState.peerCert.InvertedGroups[g.group]; ok && !g.bucket.allow(now, n) {
+				s.dropped.Inc(1)
+				return false
+			}
+		}
+	}
+
+	if s.global != nil && !s.global.allow(now, n) {
+		s.dropped.Inc(1)
+		return false
+	}
+
+	return true
+}
+
+func (f *Interface) reloadShaper(c *config.C) {
+	if !c.InitialLoad() && !c.HasChanged("shaping") {
+		return
+	}
+
+	s, err := newShaperFromConfig(c)
+	if err != nil {
+		f.l.WithError(err).Error("Failed to load shaping config, keeping the previous one")
+		return
+	}
+
+	f.shaper.Store(s)
+	if s.enabled() {
+		f.l.WithFields(logrus.Fields{"global": s.global != nil, "hosts": len(s.hosts), "groups": len(s.groups)}).
+			Info("Loaded shaping config")
+	}
+}
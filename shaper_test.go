@@ -0,0 +1,137 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	r, err := parseRate("10mbps")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1250000), r)
+
+	r, err = parseRate("1Gbps")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(125000000), r)
+
+	r, err = parseRate("800k")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100000), r)
+
+	r, err = parseRate(8000)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1000), r)
+
+	_, err = parseRate("fast")
+	require.EqualError(t, err, `"fast" is not a valid rate, expected something like 10mbps`)
+
+	_, err = parseRate(nil)
+	require.Error(t, err)
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1000, 1500)
+	now := time.Now()
+
+	// The bucket starts full
+	assert.True(t, b.allow(now, 1000))
+	assert.False(t, b.allow(now, 1000))
+	assert.True(t, b.allow(now, 500))
+
+	// Refills at rate
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, b.allow(now, 501))
+	assert.True(t, b.allow(now, 500))
+
+	// But never beyond burst
+	now = now.Add(time.Hour)
+	assert.True(t, b.allow(now, 1500))
+	assert.False(t, b.allow(now, 1))
+}
+
+func TestNewShaperFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	s, err := newShaperFromConfig(c)
+	require.NoError(t, err)
+	assert.False(t, s.enabled())
+
+	c.Settings["shaping"] = map[string]any{
+		"rate": "100mbps",
+		"hosts": map[string]any{
+			"10.1.0.5": map[string]any{"rate": "1mbps", "burst": 50000},
+		},
+		"groups": map[string]any{
+			"backup": map[string]any{"rate": "8kbps"},
+		},
+	}
+	s, err = newShaperFromConfig(c)
+	require.NoError(t, err)
+	assert.True(t, s.enabled())
+	assert.Equal(t, float64(12500000), s.global.rate)
+	assert.Equal(t, float64(1250000), s.global.burst)
+	assert.Equal(t, float64(125000), s.hosts[netip.MustParseAddr("10.1.0.5")].rate)
+	assert.Equal(t, float64(50000), s.hosts[netip.MustParseAddr("10.1.0.5")].burst)
+	require.Len(t, s.groups, 1)
+	assert.Equal(t, "backup", s.groups[0].group)
+	// A tiny rate still holds a full sized packet
+	assert.Equal(t, float64(minShaperBurst), s.groups[0].bucket.burst)
+
+	c.Settings["shaping"] = map[string]any{"hosts": map[string]any{"nope": map[string]any{"rate": "1mbps"}}}
+	_, err = newShaperFromConfig(c)
+	require.Error(t, err)
+
+	c.Settings["shaping"] = map[string]any{"groups": map[string]any{"backup": map[string]any{"rate": "1mbps", "burst": "lots"}}}
+	_, err = newShaperFromConfig(c)
+	require.EqualError(t, err, `shaping.groups.backup is invalid: burst "lots" is not a number of bytes`)
+}
+
+func TestShaper_allow(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["shaping"] = map[string]any{
+		"hosts": map[string]any{
+			"10.1.0.5": map[string]any{"rate": "8kbps", "burst": minShaperBurst},
+		},
+		"groups": map[string]any{
+			"backup": map[string]any{"rate": "8kbps", "burst": minShaperBurst},
+		},
+	}
+	s, err := newShaperFromConfig(c)
+	require.NoError(t, err)
+
+	limited := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.5")}, ConnectionState: &ConnectionState{}}
+	backup1 := &HostInfo{
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.6")},
+		ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{
+			InvertedGroups: map[string]struct{}{"backup": {}},
+		}},
+	}
+	backup2 := &HostInfo{
+		vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.7")},
+		ConnectionState: &ConnectionState{peerCert: &cert.CachedCertificate{
+			InvertedGroups: map[string]struct{}{"backup": {}},
+		}},
+	}
+	other := &HostInfo{vpnAddrs: []netip.Addr{netip.MustParseAddr("10.1.0.8")}, ConnectionState: &ConnectionState{}}
+
+	assert.True(t, s.allow(limited, minShaperBurst))
+	assert.False(t, s.allow(limited, 1000))
+
+	// Group members share a bucket
+	assert.True(t, s.allow(backup1, minShaperBurst))
+	assert.False(t, s.allow(backup2, 1000))
+
+	// Everyone else is unlimited without a global rate
+	for i := 0; i < 100; i++ {
+		assert.True(t, s.allow(other, minShaperBurst))
+	}
+}
@@ -0,0 +1,135 @@
+package nebula
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/udp"
+)
+
+// maxSourcePorts bounds listen.source_ports, every port is another socket and another reader
+const maxSourcePorts = 16
+
+// Some networks rate limit every 5-tuple, which caps a tunnel at whatever a single udp flow is allowed. With
+// listen.source_ports set we open extra sockets on random ports and spread the data of each tunnel over them and the
+// listen port, keeping every inner flow on one port so it is not reordered.
+//
+// Both hosts tell each other how many source ports they send from in the handshake. We only spread traffic to hosts
+// that sent the field at all, older hosts would see every port as a roam. Data arriving on the extra ports never
+// moves a tunnel, only packets from the listen port do, which all control traffic is sent from.
+
+// newSourcePortsFromConfig opens the extra sockets for listen.source_ports, the listen socket is not included
+func newSourcePortsFromConfig(l *logrus.Logger, c *config.C, listenHost netip.Addr) ([]udp.Conn, error) {
+	n := c.GetInt("listen.source_ports", 1)
+	if n < 1 || n > maxSourcePorts {
+		return nil, fmt.Errorf("listen.source_ports must be between 1 and %d", maxSourcePorts)
+	}
+
+	conns := make([]udp.Conn, 0, n-1)
+	ports := make([]uint16, 0, n-1)
+	for range n - 1 {
+		conn, err := udp.NewListener(l, listenHost, 0, false, c.GetInt("listen.batch", 64))
+		if err != nil {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			return nil, err
+		}
+		conn.ReloadConfig(c)
+		conns = append(conns, conn)
+
+		if addr, err := conn.LocalAddr(); err == nil {
+			ports = append(ports, addr.Port())
+		}
+	}
+
+	if len(conns) > 0 {
+		l.WithField("ports", ports).Info("Spreading tunnel traffic over extra source ports")
+	}
+
+	return conns, nil
+}
+
+// sourcePortCount is what we tell peers in the handshake, the listen port and every extra one
+func (f *Interface) sourcePortCount() uint32 {
+	return uint32(len(f.sourcePorts) + 1)
+}
+
+// dataWriter picks the socket a data packet to hostinfo leaves from and where it goes, p is the unencrypted packet
+func (f *Interface) dataWriter(q int, hostinfo *HostInfo, p []byte) (udp.Conn, netip.AddrPort) {
+	if w, addr, ok := f.portHopper.writer(hostinfo); ok {
+		return w, addr
+	}
+
+	if len(f.sourcePorts) == 0 || hostinfo.ConnectionState.peerSourcePorts == 0 {
+		return f.writers[q], hostinfo.remote
+	}
+
+	i := flowHash(p) % uint32(len(f.sourcePorts)+1)
+	if i == 0 {
+		return f.writers[q], hostinfo.remote
+	}
+	return f.sourcePorts[i-1], hostinfo.remote
+}
+
+// fromSourcePort reports whether a packet is data that hostinfo sent from one of its extra source ports, or a port of
+// the port hopping schedule
+func fromSourcePort(hostinfo *HostInfo, via ViaSender, h *header.H) bool {
+	ci := hostinfo.ConnectionState
+	return h.Type == header.Message && isDataSubtype(h.Subtype) && !via.IsRelayed &&
+		(ci.peerSourcePorts > 1 || ci.peerHopSchedule != 0) && via.UdpAddr.Addr() == hostinfo.remote.Addr()
+}
+
+// flowHash hashes the addresses, protocol, and ports of an ip packet with FNV-1a. Fragments and anything we do not
+// understand only hash what they can, so they stay together.
+func flowHash(p []byte) uint32 {
+	const offset, prime = 2166136261, 16777619
+	hash := func(h uint32, b []byte) uint32 {
+		for _, c := range b {
+			h = (h ^ uint32(c)) * prime
+		}
+		return h
+	}
+
+	h := uint32(offset)
+	if len(p) < 1 {
+		return h
+	}
+
+	var proto byte
+	var ports []byte
+	switch p[0] >> 4 {
+	case 4:
+		ihl := int(p[0]&0x0f) * 4
+		if len(p) < 20 || len(p) < ihl {
+			return h
+		}
+		proto = p[9]
+		h = hash(h, p[12:20])
+		// Only the first fragment has the ports
+		if p[6]&0x3f == 0 && p[7] == 0 && len(p) >= ihl+4 {
+			ports = p[ihl : ihl+4]
+		}
+	case 6:
+		if len(p) < 40 {
+			return h
+		}
+		proto = p[6]
+		h = hash(h, p[8:40])
+		if len(p) >= 44 {
+			ports = p[40:44]
+		}
+	default:
+		return h
+	}
+
+	h = (h ^ uint32(proto)) * prime
+	switch proto {
+	case 6, 17, 132:
+		h = hash(h, ports)
+	}
+	return h
+}
@@ -0,0 +1,163 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/header"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// namedConn lets tests tell writers apart
+type namedConn struct {
+	udp.NoopConn
+	name string
+}
+
+func newIPv4UDP(srcPort, dstPort uint16) []byte {
+	p := make([]byte, 28)
+	p[0] = 0x45
+	p[9] = 17
+	copy(p[12:16], []byte{10, 0, 0, 1})
+	copy(p[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(p[20:], srcPort)
+	binary.BigEndian.PutUint16(p[22:], dstPort)
+	return p
+}
+
+func TestFlowHash(t *testing.T) {
+	// A flow always hashes the same, other flows spread out
+	assert.Equal(t, flowHash(newIPv4UDP(1000, 53)), flowHash(newIPv4UDP(1000, 53)))
+	seen := map[uint32]struct{}{}
+	for port := range uint16(64) {
+		seen[flowHash(newIPv4UDP(1000+port, 53))%4] = struct{}{}
+	}
+	assert.Len(t, seen, 4)
+
+	// Later fragments have no ports, every fragment of a packet has to hash the same
+	frag := newIPv4UDP(1000, 53)
+	frag[6] = 0x20
+	other := newIPv4UDP(2000, 80)
+	other[6] = 0x20
+	assert.Equal(t, flowHash(frag), flowHash(other))
+
+	p6 := make([]byte, 44)
+	p6[0] = 0x60
+	p6[6] = 6
+	p6[23] = 1
+	p6[39] = 2
+	binary.BigEndian.PutUint16(p6[40:], 443)
+	h6 := flowHash(p6)
+	binary.BigEndian.PutUint16(p6[40:], 444)
+	assert.NotEqual(t, h6, flowHash(p6))
+
+	// Garbage does not panic
+	assert.NotPanics(t, func() {
+		flowHash(nil)
+		flowHash([]byte{0x4f})
+		flowHash([]byte{0x60, 0})
+	})
+}
+
+func TestInterface_dataWriter(t *testing.T) {
+	primary := &namedConn{name: "primary"}
+	f := &Interface{
+		writers:     []udp.Conn{primary},
+		sourcePorts: []udp.Conn{&namedConn{name: "1"}, &namedConn{name: "2"}, &namedConn{name: "3"}},
+	}
+	assert.Equal(t, uint32(4), f.sourcePortCount())
+
+	hostinfo := &HostInfo{remote: netip.MustParseAddrPort("1.2.3.4:4242"), ConnectionState: &ConnectionState{}}
+	writer := func(p []byte) udp.Conn {
+		w, addr := f.dataWriter(0, hostinfo, p)
+		assert.Equal(t, hostinfo.remote, addr)
+		return w
+	}
+
+	// Hosts that did not tell us about source ports would roam with every packet
+	for port := range uint16(16) {
+		assert.Same(t, primary, writer(newIPv4UDP(port, 53)))
+	}
+
+	hostinfo.ConnectionState.peerSourcePorts = 1
+	used := map[udp.Conn]struct{}{}
+	for port := range uint16(64) {
+		p := newIPv4UDP(port, 53)
+		w := writer(p)
+		assert.Same(t, w, writer(p))
+		used[w] = struct{}{}
+	}
+	assert.Len(t, used, 4)
+
+	f.sourcePorts = nil
+	assert.Equal(t, uint32(1), f.sourcePortCount())
+	assert.Same(t, primary, writer(newIPv4UDP(1, 53)))
+}
+
+func TestFromSourcePort(t *testing.T) {
+	remote := netip.MustParseAddrPort("1.2.3.4:4242")
+	hostinfo := &HostInfo{remote: remote, ConnectionState: &ConnectionState{peerSourcePorts: 4}}
+	data := &header.H{Type: header.Message, Subtype: header.MessageNone}
+	shard := ViaSender{UdpAddr: netip.MustParseAddrPort("1.2.3.4:50000")}
+
+	assert.True(t, fromSourcePort(hostinfo, shard, data))
+
+	// Control traffic only comes from the listen port, it may roam
+	assert.False(t, fromSourcePort(hostinfo, shard, &header.H{Type: header.Test, Subtype: header.TestRequest}))
+
+	// So does anything from another ip
+	assert.False(t, fromSourcePort(hostinfo, ViaSender{UdpAddr: netip.MustParseAddrPort("5.6.7.8:50000")}, data))
+
+	// And hosts that only send from one port
+	hostinfo.ConnectionState.peerSourcePorts = 1
+	assert.False(t, fromSourcePort(hostinfo, shard, data))
+
+	// Unless they hop ports
+	hostinfo.ConnectionState.peerHopSchedule = 7
+	assert.True(t, fromSourcePort(hostinfo, shard, data))
+}
+
+func TestNewSourcePortsFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	conns, err := newSourcePortsFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	assert.Empty(t, conns)
+
+	c.Settings["listen"] = map[string]any{"source_ports": 0}
+	_, err = newSourcePortsFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.Error(t, err)
+
+	c.Settings["listen"] = map[string]any{"source_ports": maxSourcePorts + 1}
+	_, err = newSourcePortsFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.Error(t, err)
+
+	c.Settings["listen"] = map[string]any{"source_ports": 3}
+	conns, err = newSourcePortsFromConfig(l, c, netip.MustParseAddr("127.0.0.1"))
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	for _, conn := range conns {
+		addr, err := conn.LocalAddr()
+		require.NoError(t, err)
+		assert.NotZero(t, addr.Port())
+		require.NoError(t, conn.Close())
+	}
+}
+
+func TestNebulaHandshakeDetails_sourcePorts(t *testing.T) {
+	hs := &NebulaHandshake{Details: &NebulaHandshakeDetails{InitiatorIndex: 10, NullCipher: true, SourcePorts: 4}}
+	b, err := hs.Marshal()
+	require.NoError(t, err)
+	assert.Equal(t, hs.Size(), len(b))
+
+	got := &NebulaHandshake{}
+	require.NoError(t, got.Unmarshal(b))
+	assert.Equal(t, uint32(4), got.Details.GetSourcePorts())
+	assert.True(t, got.Details.NullCipher)
+}
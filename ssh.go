@@ -2,6 +2,7 @@ package nebula
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -16,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -56,6 +58,27 @@ type sshDeviceInfoFlags struct {
 	Pretty bool
 }
 
+type sshDoctorFlags struct {
+	Json   bool
+	Pretty bool
+	Wait   time.Duration
+}
+
+type sshConnectFlags struct {
+	Pretty bool
+	Wait   time.Duration
+}
+
+type sshLearnFirewallRulesFlags struct {
+	Duration time.Duration
+	Stop     bool
+}
+
+type sshSuggestFirewallRulesFlags struct {
+	Json   bool
+	Pretty bool
+}
+
 func wireSSHReload(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) {
 	c.RegisterReloadCallback(func(c *config.C) {
 		if c.GetBool("sshd.enabled", false) {
@@ -91,7 +114,10 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 		return nil, fmt.Errorf("sshd.listen can not use port 22")
 	}
 
-	hostKeyPathOrKey := c.GetString("sshd.host_key", "")
+	hostKeyPathOrKey, err := c.GetSecret("sshd.host_key", "")
+	if err != nil {
+		return nil, err
+	}
 	if hostKeyPathOrKey == "" {
 		return nil, fmt.Errorf("sshd.host_key must be provided")
 	}
@@ -140,10 +166,19 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 				continue
 			}
 
+			role := sshd.RoleAdmin
+			if r, ok := kDef["role"]; ok {
+				role = fmt.Sprint(r)
+				if !sshd.ValidRole(role) {
+					l.WithField("sshKeyConfig", rk).Warn("Authorized user has an unknown role, ignoring")
+					continue
+				}
+			}
+
 			k := kDef["keys"]
 			switch v := k.(type) {
 			case string:
-				err := ssh.AddAuthorizedKey(user, v)
+				err := ssh.AddAuthorizedKeyWithRole(user, v, role)
 				if err != nil {
 					l.WithError(err).WithField("sshKeyConfig", rk).WithField("sshKey", v).Warn("Failed to authorize key")
 					continue
@@ -157,7 +192,7 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 						continue
 					}
 
-					err := ssh.AddAuthorizedKey(user, sk)
+					err := ssh.AddAuthorizedKeyWithRole(user, sk, role)
 					if err != nil {
 						l.WithError(err).WithField("sshKeyConfig", sk).Warn("Failed to authorize key")
 						continue
@@ -187,9 +222,14 @@ func configSSH(l *logrus.Logger, ssh *sshd.SSHServer, c *config.C) (func(), erro
 	return runner, nil
 }
 
-func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface, sigChan chan os.Signal) {
+func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Interface, doc *doctor, learner *ruleLearner, sigChan chan os.Signal) {
+	ssh.SetConnAuthenticator(func(local, remote net.Addr) (string, string, bool) {
+		return sshNebulaAuthenticate(l, c, f, local, remote)
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-hostmap",
+		ReadOnly:         true,
 		ShortDescription: "List all known previously connected hosts",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -206,6 +246,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-pending-hostmap",
+		ReadOnly:         true,
 		ShortDescription: "List all handshaking hosts",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -220,8 +261,43 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "lighthouse-health",
+		ReadOnly:         true,
+		ShortDescription: "Shows how well each lighthouse answers our queries",
+		Help:             "Queries go to the fastest lighthouses first, lighthouses that keep missing queries are backed off from.",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshListHostMapFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshLighthouseHealth(f.lightHouse, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-pending",
+		ReadOnly:         true,
+		ShortDescription: "Prints the handshakes in flight, oldest first",
+		Help:             "Shows the attempts made, the remotes and relays the last attempt went to, and why it failed if it did.",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshListHostMapFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshPrintPending(f.handshakeManager, fs, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "list-lighthouse-addrmap",
+		ReadOnly:         true,
 		ShortDescription: "List all lighthouse map entries",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -255,6 +331,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "mermaid",
+		ReadOnly:         true,
 		ShortDescription: "Outputs a mermaid diagram of the current network",
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			s := RenderHostmaps(true, f)
@@ -265,6 +342,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "dot",
+		ReadOnly:         true,
 		ShortDescription: "Outputs a dot diagram of the current network",
 		Callback: func(fs interface{}, a []string, w sshd.StringWriter) error {
 			s := RenderHostmaps(false, f)
@@ -309,8 +387,11 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "log-level",
 		ShortDescription: "Gets or sets the current log level",
+		Help: "Usage: log-level [level] or log-level <subsystem> [level|reset]\n" +
+			"  Subsystems: " + strings.Join(logSubsystemNames, ", ") + ". A subsystem follows the root log level until it is given one of its own, reset undoes that.\n" +
+			"  Levels set here last until the next config reload.",
 		Callback: func(fs any, a []string, w sshd.StringWriter) error {
-			return sshLogLevel(l, fs, a, w)
+			return sshLogLevel(l, f.logs, fs, a, w)
 		},
 	})
 
@@ -318,12 +399,13 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		Name:             "log-format",
 		ShortDescription: "Gets or sets the current log format",
 		Callback: func(fs any, a []string, w sshd.StringWriter) error {
-			return sshLogFormat(l, fs, a, w)
+			return sshLogFormat(l, f.logs, fs, a, w)
 		},
 	})
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "version",
+		ReadOnly:         true,
 		ShortDescription: "Prints the currently running version of nebula",
 		Callback: func(fs any, a []string, w sshd.StringWriter) error {
 			return sshVersion(f, fs, a, w)
@@ -332,6 +414,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "device-info",
+		ReadOnly:         true,
 		ShortDescription: "Prints information about the network device.",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -345,8 +428,57 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "doctor",
+		ReadOnly:         true,
+		ShortDescription: "Checks the certificate, networks, mtu, lighthouses, and clock for problems",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshDoctorFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			fl.DurationVar(&s.Wait, "wait", DefaultDoctorWait, "how long to wait for lighthouses to answer a handshake")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshDoctor(doc, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "learn-firewall-rules",
+		ShortDescription: "Records accepted inbound flows to suggest firewall rules from, see suggest-firewall-rules",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshLearnFirewallRulesFlags{}
+			fl.DurationVar(&s.Duration, "duration", time.Hour, "how long to learn for, anything learned before is forgotten")
+			fl.BoolVar(&s.Stop, "stop", false, "stops learning early, what was learned is kept")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshLearnFirewallRules(learner, fs, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "suggest-firewall-rules",
+		ReadOnly:         true,
+		ShortDescription: "Prints the fewest inbound firewall rules that allow the flows seen by learn-firewall-rules",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshSuggestFirewallRulesFlags{}
+			fl.BoolVar(&s.Json, "json", false, "outputs as json")
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json, assumes -json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshSuggestFirewallRules(learner, fs, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-cert",
+		ReadOnly:         true,
 		ShortDescription: "Prints the current certificate being used or the certificate for the provided vpn addr",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -363,6 +495,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-tunnel",
+		ReadOnly:         true,
 		ShortDescription: "Prints json details about a tunnel for the provided vpn addr",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -375,8 +508,24 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "print-remote-history",
+		ReadOnly:         true,
+		ShortDescription: "Prints json details about the underlay addresses recently seen for the provided vpn addr",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshPrintTunnelFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshPrintRemoteHistory(f, fs, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "print-relays",
+		ReadOnly:         true,
 		ShortDescription: "Prints json details about all relay info",
 		Flags: func() (*flag.FlagSet, any) {
 			fl := flag.NewFlagSet("", flag.ContinueOnError)
@@ -417,6 +566,31 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 		},
 	})
 
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "rehandshake-tunnel",
+		ShortDescription: "Replaces the tunnel for the provided vpn addr with a new handshake",
+		Help:             "The tunnel gets new keys and picks up the current certificates, the old keys are discarded once the new tunnel is up.",
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshRehandshakeTunnel(f, fs, a, w)
+		},
+	})
+
+	ssh.RegisterCommand(&sshd.Command{
+		Name:             "connect",
+		ShortDescription: "Brings up a tunnel to the provided vpn address and waits for it",
+		Help:             "The lighthouses are queried and the handshake starts right away, the state of the tunnel is printed as json.",
+		Flags: func() (*flag.FlagSet, any) {
+			fl := flag.NewFlagSet("", flag.ContinueOnError)
+			s := sshConnectFlags{}
+			fl.BoolVar(&s.Pretty, "pretty", false, "pretty prints json")
+			fl.DurationVar(&s.Wait, "wait", 10*time.Second, "how long to wait for the tunnel to come up")
+			return fl, &s
+		},
+		Callback: func(fs any, a []string, w sshd.StringWriter) error {
+			return sshConnect(f, fs, a, w)
+		},
+	})
+
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "create-tunnel",
 		ShortDescription: "Creates a tunnel for the provided vpn address",
@@ -434,6 +608,7 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 
 	ssh.RegisterCommand(&sshd.Command{
 		Name:             "query-lighthouse",
+		ReadOnly:         true,
 		ShortDescription: "Query the lighthouses for the provided vpn address",
 		Help:             "This command is asynchronous. Only currently known udp addresses will be printed.",
 		Callback: func(fs any, a []string, w sshd.StringWriter) error {
@@ -442,6 +617,63 @@ func attachCommands(l *logrus.Logger, c *config.C, ssh *sshd.SSHServer, f *Inter
 	})
 }
 
+// sshNebulaAuthenticate lets hosts in one of the sshd.nebula_groups log in over their tunnel, the nebula certificate
+// proves who they are so no ssh key needs to be configured for them
+func sshNebulaAuthenticate(l *logrus.Logger, c *config.C, f *Interface, local, remote net.Addr) (string, string, bool) {
+	groups := c.GetMap("sshd.nebula_groups", nil)
+	if len(groups) == 0 {
+		return "", "", false
+	}
+
+	la, lok := local.(*net.TCPAddr)
+	ra, rok := remote.(*net.TCPAddr)
+	if !lok || !rok {
+		return "", "", false
+	}
+
+	// Both ends must be vpn addresses so we know the connection came through a tunnel
+	localAddr := la.AddrPort().Addr().Unmap()
+	remoteAddr := ra.AddrPort().Addr().Unmap()
+	if !f.myVpnAddrsTable.Contains(localAddr) {
+		return "", "", false
+	}
+
+	hostinfo := f.hostMap.QueryVpnAddr(remoteAddr)
+	if hostinfo == nil {
+		return "", "", false
+	}
+
+	crt := hostinfo.GetCert()
+	if crt == nil {
+		return "", "", false
+	}
+
+	// The most capable role wins if the host is in several groups
+	role := ""
+	for _, g := range crt.Certificate.Groups() {
+		r, ok := groups[g]
+		if !ok {
+			continue
+		}
+
+		gr := fmt.Sprint(r)
+		if !sshd.ValidRole(gr) {
+			l.WithField("group", g).WithField("role", gr).Warn("sshd.nebula_groups has an unknown role, ignoring")
+			continue
+		}
+
+		if gr == sshd.RoleAdmin || role == "" {
+			role = gr
+		}
+	}
+
+	if role == "" {
+		return "", "", false
+	}
+
+	return crt.Certificate.Name(), role, true
+}
+
 func sshListHostMap(hl controlHostLister, a any, w sshd.StringWriter) error {
 	fs, ok := a.(*sshListHostMapFlags)
 	if !ok {
@@ -472,7 +704,12 @@ func sshListHostMap(hl controlHostLister, a any, w sshd.StringWriter) error {
 
 	} else {
 		for _, v := range hm {
-			err := w.WriteLine(fmt.Sprintf("%s: %s", v.VpnAddrs, v.RemoteAddrs))
+			line := fmt.Sprintf("%s: %s", v.VpnAddrs, v.RemoteAddrs)
+			if v.Handshake != nil {
+				line += fmt.Sprintf(" (%d attempts, %d remaining)", v.Handshake.Attempts, v.Handshake.RemainingAttempts)
+			}
+
+			err := w.WriteLine(line)
 			if err != nil {
 				return err
 			}
@@ -482,6 +719,47 @@ func sshListHostMap(hl controlHostLister, a any, w sshd.StringWriter) error {
 	return nil
 }
 
+func sshPrintPending(hm *HandshakeManager, a any, w sshd.StringWriter) error {
+	fs, ok := a.(*sshListHostMapFlags)
+	if !ok {
+		return nil
+	}
+
+	pending := listPendingHandshakes(hm)
+	if fs.Json || fs.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if fs.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(pending)
+	}
+
+	if len(pending) == 0 {
+		return w.WriteLine("No handshakes in flight")
+	}
+
+	now := time.Now()
+	for _, p := range pending {
+		hs := p.Handshake
+		if hs == nil {
+			continue
+		}
+
+		line := fmt.Sprintf("%s: for %s, %d attempts, %d remaining, remotes: %v", p.VpnAddrs, now.Sub(hs.StartTime).Round(time.Millisecond),
+			hs.Attempts, hs.RemainingAttempts, hs.Remotes)
+		if len(hs.Relays) > 0 {
+			line += fmt.Sprintf(", relays: %v", hs.Relays)
+		}
+		if hs.LastError != "" {
+			line += ", last error: " + hs.LastError
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func sshListLighthouseMap(lightHouse *LightHouse, a any, w sshd.StringWriter) error {
 	fs, ok := a.(*sshListHostMapFlags)
 	if !ok {
@@ -536,6 +814,34 @@ func sshListLighthouseMap(lightHouse *LightHouse, a any, w sshd.StringWriter) er
 	return nil
 }
 
+func sshLighthouseHealth(lightHouse *LightHouse, a any, w sshd.StringWriter) error {
+	fs, ok := a.(*sshListHostMapFlags)
+	if !ok {
+		return nil
+	}
+
+	health := lightHouse.LighthouseHealth()
+	if fs.Json || fs.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if fs.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(health)
+	}
+
+	now := time.Now()
+	for _, h := range health {
+		line := fmt.Sprintf("%s: queries: %d, answers: %d, missed: %d, rtt: %s", h.VpnAddr, h.Queries, h.Answers, h.Missed, h.RTT)
+		if !h.BackoffUntil.IsZero() {
+			line += fmt.Sprintf(", backing off for %s", h.BackoffUntil.Sub(now).Round(time.Second))
+		}
+		if err := w.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func sshStartCpuProfile(fs any, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
 		err := w.WriteLine("No path to write profile provided")
@@ -624,6 +930,48 @@ func sshCloseTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) er
 	return w.WriteLine("Closed")
 }
 
+func sshRehandshakeTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
+	if len(a) == 0 {
+		return w.WriteLine("No vpn address was provided")
+	}
+
+	vpnAddr, err := netip.ParseAddr(a[0])
+	if err != nil || !vpnAddr.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn address could not be parsed: %s", a[0]))
+	}
+
+	if !ifce.handshakeManager.Rehandshake(vpnAddr) {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn address: %v", a[0]))
+	}
+
+	return w.WriteLine("Rehandshaking")
+}
+
+func sshConnect(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshConnectFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshConnectFlags but was %+v", fs)
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn address was provided")
+	}
+
+	vpnAddr, err := netip.ParseAddr(a[0])
+	if err != nil || !vpnAddr.IsValid() {
+		return w.WriteLine(fmt.Sprintf("The provided vpn address could not be parsed: %s", a[0]))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flags.Wait)
+	defer cancel()
+
+	js := json.NewEncoder(w.GetWriter())
+	if flags.Pretty {
+		js.SetIndent("", "    ")
+	}
+	return js.Encode(ifce.connect(ctx, vpnAddr.Unmap()))
+}
+
 func sshCreateTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
 	flags, ok := fs.(*sshCreateTunnelFlags)
 	if !ok {
@@ -766,9 +1114,24 @@ func sshGetMutexProfile(fs any, a []string, w sshd.StringWriter) error {
 	return w.WriteLine(fmt.Sprintf("Mutex profile created at %s", a))
 }
 
-func sshLogLevel(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) error {
+func sshLogLevel(l *logrus.Logger, logs *logSubsystems, fs any, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
-		return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+		err := w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
+		if err != nil || logs == nil {
+			return err
+		}
+
+		for _, name := range logSubsystemNames {
+			err = w.WriteLine(fmt.Sprintf("%s log level is: %s", name, logs.get(name).GetLevel()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if logs != nil && logs.get(a[0]) != nil {
+		return sshSubsystemLogLevel(logs, a[0], a[1:], w)
 	}
 
 	level, err := logrus.ParseLevel(a[0])
@@ -777,10 +1140,29 @@ func sshLogLevel(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) erro
 	}
 
 	l.SetLevel(level)
+	if logs != nil {
+		logs.sync()
+	}
 	return w.WriteLine(fmt.Sprintf("Log level is: %s", l.Level))
 }
 
-func sshLogFormat(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) error {
+func sshSubsystemLogLevel(logs *logSubsystems, name string, a []string, w sshd.StringWriter) error {
+	if len(a) > 0 {
+		if a[0] == "reset" {
+			_ = logs.resetLevel(name)
+		} else {
+			level, err := logrus.ParseLevel(a[0])
+			if err != nil {
+				return w.WriteLine(fmt.Sprintf("Unknown log level %s. Possible log levels: %s", a[0], logrus.AllLevels))
+			}
+			_ = logs.setLevel(name, level)
+		}
+	}
+
+	return w.WriteLine(fmt.Sprintf("%s log level is: %s", name, logs.get(name).GetLevel()))
+}
+
+func sshLogFormat(l *logrus.Logger, logs *logSubsystems, fs any, a []string, w sshd.StringWriter) error {
 	if len(a) == 0 {
 		return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
 	}
@@ -795,6 +1177,9 @@ func sshLogFormat(l *logrus.Logger, fs any, a []string, w sshd.StringWriter) err
 		return fmt.Errorf("unknown log format `%s`. possible formats: %s", logFormat, []string{"text", "json"})
 	}
 
+	if logs != nil {
+		logs.sync()
+	}
 	return w.WriteLine(fmt.Sprintf("Log format is: %s", reflect.TypeOf(l.Formatter)))
 }
 
@@ -982,6 +1367,87 @@ func sshPrintTunnel(ifce *Interface, fs any, a []string, w sshd.StringWriter) er
 	return enc.Encode(copyHostInfo(hostInfo, ifce.hostMap.GetPreferredRanges()))
 }
 
+func sshPrintRemoteHistory(ifce *Interface, fs any, a []string, w sshd.StringWriter) error {
+	args, ok := fs.(*sshPrintTunnelFlags)
+	if !ok {
+		return nil
+	}
+
+	if len(a) == 0 {
+		return w.WriteLine("No vpn address was provided")
+	}
+
+	vpnAddr, err := netip.ParseAddr(a[0])
+	if err != nil {
+		return w.WriteLine(fmt.Sprintf("The provided vpn addr could not be parsed: %s", a[0]))
+	}
+
+	hostInfo := ifce.hostMap.QueryVpnAddr(vpnAddr)
+	if hostInfo == nil {
+		return w.WriteLine(fmt.Sprintf("Could not find tunnel for vpn addr: %v", a[0]))
+	}
+
+	enc := json.NewEncoder(w.GetWriter())
+	if args.Pretty {
+		enc.SetIndent("", "    ")
+	}
+
+	return enc.Encode(hostInfo.remoteHistory.copy())
+}
+
+func sshDoctor(doc *doctor, fs any, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshDoctorFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshDoctorFlags but was %+v", fs)
+	}
+
+	report := doc.run(context.Background(), flags.Wait)
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(report)
+	}
+
+	return w.Write(report.String())
+}
+
+func sshLearnFirewallRules(learner *ruleLearner, fs any, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshLearnFirewallRulesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshLearnFirewallRulesFlags but was %+v", fs)
+	}
+
+	if flags.Stop {
+		learner.stop()
+		return w.WriteLine("Stopped learning firewall rules")
+	}
+
+	if err := learner.start(flags.Duration); err != nil {
+		return w.WriteLine(err.Error())
+	}
+	return w.WriteLine(fmt.Sprintf("Learning firewall rules for %v", flags.Duration))
+}
+
+func sshSuggestFirewallRules(learner *ruleLearner, fs any, w sshd.StringWriter) error {
+	flags, ok := fs.(*sshSuggestFirewallRulesFlags)
+	if !ok {
+		return fmt.Errorf("internal error: expected flags to be sshSuggestFirewallRulesFlags but was %+v", fs)
+	}
+
+	rs := learner.suggest()
+	if flags.Json || flags.Pretty {
+		js := json.NewEncoder(w.GetWriter())
+		if flags.Pretty {
+			js.SetIndent("", "    ")
+		}
+		return js.Encode(rs)
+	}
+
+	return w.Write(rs.String())
+}
+
 func sshDeviceInfo(ifce *Interface, fs any, w sshd.StringWriter) error {
 
 	data := struct {
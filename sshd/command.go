@@ -24,7 +24,9 @@ type CommandFlags func() (*flag.FlagSet, any)
 type CommandCallback func(fs any, a []string, w StringWriter) error
 
 type Command struct {
-	Name             string
+	Name string
+	// ReadOnly commands do not change anything and may be run by users with the read-only role
+	ReadOnly         bool
 	ShortDescription string
 	Help             string
 	Flags            CommandFlags
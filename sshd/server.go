@@ -12,16 +12,33 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	// RoleAdmin may run every command
+	RoleAdmin = "admin"
+	// RoleReadOnly may only run commands marked ReadOnly
+	RoleReadOnly = "read-only"
+
+	// CertRoleExtension is the ssh certificate extension that sets the role of a user authenticated by a trusted CA,
+	// ex: `ssh-keygen -O extension:nebula-role=read-only`. Users without it are admins.
+	CertRoleExtension = "nebula-role"
+)
+
+// ConnAuthenticator can authenticate a connection by where it came from instead of its key. It returns a name to
+// identify the user by in logs along with their role.
+type ConnAuthenticator func(local, remote net.Addr) (name string, role string, ok bool)
+
 type SSHServer struct {
 	config *ssh.ServerConfig
 	l      *logrus.Entry
 
 	certChecker *ssh.CertChecker
 
-	// Map of user -> authorized keys
-	trustedKeys map[string]map[string]bool
+	// Map of user -> authorized keys -> role
+	trustedKeys map[string]map[string]string
 	trustedCAs  []ssh.PublicKey
 
+	connAuth ConnAuthenticator
+
 	// List of available commands
 	helpCommand *Command
 	commands    *radix.Tree
@@ -37,7 +54,7 @@ type SSHServer struct {
 func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 
 	s := &SSHServer{
-		trustedKeys: make(map[string]map[string]bool),
+		trustedKeys: make(map[string]map[string]string),
 		l:           l,
 		commands:    radix.New(),
 		conns:       make(map[int]*session),
@@ -62,7 +79,7 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 				return nil, fmt.Errorf("unknown user %s", c.User())
 			}
 
-			_, ok = tk[pk]
+			role, ok := tk[pk]
 			if !ok {
 				return nil, fmt.Errorf("unknown public key for %s (%s)", c.User(), fp)
 			}
@@ -72,6 +89,7 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 				Extensions: map[string]string{
 					"fp":   fp,
 					"user": c.User(),
+					"role": role,
 				},
 			}, nil
 
@@ -79,12 +97,15 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 	}
 
 	s.config = &ssh.ServerConfig{
-		PublicKeyCallback: cc.Authenticate,
-		ServerVersion:     fmt.Sprintf("SSH-2.0-Nebula???"),
+		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			return s.authenticate(&cc, c, pubKey)
+		},
+		ServerVersion: fmt.Sprintf("SSH-2.0-Nebula???"),
 	}
 
 	s.RegisterCommand(&Command{
 		Name:             "help",
+		ReadOnly:         true,
 		ShortDescription: "prints available commands or help <command> for specific usage info",
 		Callback: func(a any, args []string, w StringWriter) error {
 			return helpCallback(s.commands, args, w)
@@ -94,6 +115,50 @@ func NewSSHServer(l *logrus.Entry) (*SSHServer, error) {
 	return s, nil
 }
 
+func (s *SSHServer) authenticate(cc *ssh.CertChecker, c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	perms, err := cc.Authenticate(c, pubKey)
+	if err == nil {
+		if crt, ok := pubKey.(*ssh.Certificate); ok {
+			// Certificate permissions come straight from the certificate, fill in what our sessions need
+			role := RoleAdmin
+			if r, ok := crt.Extensions[CertRoleExtension]; ok {
+				role = r
+			}
+
+			perms = &ssh.Permissions{
+				CriticalOptions: perms.CriticalOptions,
+				Extensions: map[string]string{
+					"fp":   ssh.FingerprintSHA256(crt.Key),
+					"user": c.User(),
+					"role": role,
+					"cert": crt.KeyId,
+				},
+			}
+		}
+		return perms, nil
+	}
+
+	if s.connAuth != nil {
+		if name, role, ok := s.connAuth(c.LocalAddr(), c.RemoteAddr()); ok {
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"fp":     ssh.FingerprintSHA256(pubKey),
+					"user":   c.User(),
+					"role":   role,
+					"nebula": name,
+				},
+			}, nil
+		}
+	}
+
+	return nil, err
+}
+
+// SetConnAuthenticator sets a fallback for connections that did not present an authorized key or certificate
+func (s *SSHServer) SetConnAuthenticator(auth ConnAuthenticator) {
+	s.connAuth = auth
+}
+
 func (s *SSHServer) SetHostKey(hostPrivateKey []byte) error {
 	private, err := ssh.ParsePrivateKey(hostPrivateKey)
 	if err != nil {
@@ -109,7 +174,7 @@ func (s *SSHServer) ClearTrustedCAs() {
 }
 
 func (s *SSHServer) ClearAuthorizedKeys() {
-	s.trustedKeys = make(map[string]map[string]bool)
+	s.trustedKeys = make(map[string]map[string]string)
 }
 
 // AddTrustedCA adds a trusted CA for user certificates
@@ -124,8 +189,17 @@ func (s *SSHServer) AddTrustedCA(pubKey string) error {
 	return nil
 }
 
-// AddAuthorizedKey adds an ssh public key for a user
+// AddAuthorizedKey adds an ssh public key for an admin user
 func (s *SSHServer) AddAuthorizedKey(user, pubKey string) error {
+	return s.AddAuthorizedKeyWithRole(user, pubKey, RoleAdmin)
+}
+
+// AddAuthorizedKeyWithRole adds an ssh public key for a user that is limited to the commands allowed by role
+func (s *SSHServer) AddAuthorizedKeyWithRole(user, pubKey, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+
 	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
 	if err != nil {
 		return err
@@ -133,15 +207,20 @@ func (s *SSHServer) AddAuthorizedKey(user, pubKey string) error {
 
 	tk, ok := s.trustedKeys[user]
 	if !ok {
-		tk = make(map[string]bool)
+		tk = make(map[string]string)
 		s.trustedKeys[user] = tk
 	}
 
-	tk[string(pk.Marshal())] = true
-	s.l.WithField("sshKey", pubKey).WithField("sshUser", user).Info("Authorized ssh key")
+	tk[string(pk.Marshal())] = role
+	s.l.WithField("sshKey", pubKey).WithField("sshUser", user).WithField("sshRole", role).Info("Authorized ssh key")
 	return nil
 }
 
+// ValidRole returns true if role is one the server knows how to enforce
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleReadOnly
+}
+
 // RegisterCommand adds a command that can be run by a user, by default only `help` is available
 func (s *SSHServer) RegisterCommand(c *Command) {
 	s.commands.Insert(c.Name, c)
@@ -195,7 +274,13 @@ func (s *SSHServer) run() {
 			continue
 		}
 
-		l := s.l.WithField("sshUser", conn.User())
+		l := s.l.WithField("sshUser", conn.User()).WithField("sshRole", conn.Permissions.Extensions["role"])
+		if id := conn.Permissions.Extensions["cert"]; id != "" {
+			l = l.WithField("sshCertKeyId", id)
+		}
+		if name := conn.Permissions.Extensions["nebula"]; name != "" {
+			l = l.WithField("nebulaCertName", name)
+		}
 		l.WithField("remoteAddress", c.RemoteAddr()).WithField("sshFingerprint", fp).Info("ssh user logged in")
 
 		session := NewSession(s.commands, conn, chans, l.WithField("subsystem", "sshd.session"))
@@ -30,6 +30,7 @@ func NewSession(commands *radix.Tree, conn *ssh.ServerConn, chans <-chan ssh.New
 
 	s.commands.Insert("logout", &Command{
 		Name:             "logout",
+		ReadOnly:         true,
 		ShortDescription: "Ends the current session",
 		Callback: func(a any, args []string, w StringWriter) error {
 			s.Close()
@@ -169,10 +170,27 @@ func (s *session) dispatchCommand(line string, w StringWriter) {
 		return
 	}
 
+	// Every command run is logged so there is a record of who did what through the console
+	l := s.l.WithField("sshCommand", c.Name).WithField("sshArgs", args[1:])
+	if !c.ReadOnly && s.role() != RoleAdmin {
+		l.Warn("ssh command denied")
+		_ = w.WriteLine(fmt.Sprintf("permission denied: %s can only be run by an admin", c.Name))
+		return
+	}
+
+	l.Info("ssh command")
 	_ = execCommand(c, args[1:], w)
 	return
 }
 
+// role returns the role the user authenticated with
+func (s *session) role() string {
+	if s.c.Permissions == nil {
+		return ""
+	}
+	return s.c.Permissions.Extensions["role"]
+}
+
 func (s *session) Close() {
 	s.c.Close()
 	s.exitChan <- true
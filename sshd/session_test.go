@@ -0,0 +1,107 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/armon/go-radix"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSession_dispatchCommandRoles(t *testing.T) {
+	ran := map[string]bool{}
+	commands := radix.New()
+	for _, c := range []*Command{{Name: "list", ReadOnly: true}, {Name: "close"}} {
+		commands.Insert(c.Name, &Command{
+			Name:     c.Name,
+			ReadOnly: c.ReadOnly,
+			Callback: func(_ any, _ []string, _ StringWriter) error {
+				ran[c.Name] = true
+				return nil
+			},
+		})
+	}
+
+	l := logrus.New()
+	l.SetOutput(&bytes.Buffer{})
+	newSession := func(role string) *session {
+		return &session{
+			l:        logrus.NewEntry(l),
+			c:        &ssh.ServerConn{Permissions: &ssh.Permissions{Extensions: map[string]string{"role": role}}},
+			commands: commands,
+		}
+	}
+
+	out := &bytes.Buffer{}
+	s := newSession(RoleReadOnly)
+	s.dispatchCommand("list", &stringWriter{out})
+	s.dispatchCommand("close", &stringWriter{out})
+	assert.Equal(t, map[string]bool{"list": true}, ran)
+	assert.Contains(t, out.String(), "permission denied: close can only be run by an admin")
+
+	s = newSession(RoleAdmin)
+	s.dispatchCommand("close", &stringWriter{out})
+	assert.Equal(t, map[string]bool{"list": true, "close": true}, ran)
+}
+
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user          string
+	local, remote net.Addr
+}
+
+func (c testConnMetadata) User() string          { return c.user }
+func (c testConnMetadata) LocalAddr() net.Addr   { return c.local }
+func (c testConnMetadata) RemoteAddr() net.Addr  { return c.remote }
+func (c testConnMetadata) SessionID() []byte     { return nil }
+func (c testConnMetadata) ClientVersion() []byte { return nil }
+
+func TestSSHServer_authenticate(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(&bytes.Buffer{})
+	s, err := NewSSHServer(logrus.NewEntry(l))
+	require.NoError(t, err)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	authorized := string(ssh.MarshalAuthorizedKey(sshPub))
+
+	meta := testConnMetadata{
+		user:   "steeeeve",
+		local:  &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2222},
+		remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000},
+	}
+
+	// Unknown keys are rejected
+	_, err = s.config.PublicKeyCallback(meta, sshPub)
+	require.Error(t, err)
+
+	require.Error(t, s.AddAuthorizedKeyWithRole("steeeeve", authorized, "root"))
+	require.NoError(t, s.AddAuthorizedKeyWithRole("steeeeve", authorized, RoleReadOnly))
+	perms, err := s.config.PublicKeyCallback(meta, sshPub)
+	require.NoError(t, err)
+	assert.Equal(t, RoleReadOnly, perms.Extensions["role"])
+
+	// The connection authenticator is only a fallback
+	s.ClearAuthorizedKeys()
+	s.SetConnAuthenticator(func(local, remote net.Addr) (string, string, bool) {
+		return "admin-host", RoleAdmin, remote.String() == "10.0.0.2:50000"
+	})
+
+	perms, err = s.config.PublicKeyCallback(meta, sshPub)
+	require.NoError(t, err)
+	assert.Equal(t, RoleAdmin, perms.Extensions["role"])
+	assert.Equal(t, "admin-host", perms.Extensions["nebula"])
+
+	meta.remote = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 50000}
+	_, err = s.config.PublicKeyCallback(meta, sshPub)
+	require.Error(t, err)
+}
@@ -21,33 +21,43 @@ import (
 
 // startStats initializes stats from config. On success, if any further work
 // is needed to serve stats, it returns a func to handle that work. If no
-// work is needed, it'll return nil. On failure, it returns nil, error.
-func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest bool) (func(), error) {
+// work is needed, it'll return nil. Pushed stats also return a func that
+// pushes one last time on shutdown. On failure, it returns nil, nil, error.
+func startStats(l *logrus.Logger, c *config.C, identity statsIdentity, buildVersion string, configTest bool) (func(), func(), error) {
 	mType := c.GetString("stats.type", "")
 	if mType == "" || mType == "none" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	interval := c.GetDuration("stats.interval", 0)
 	if interval == 0 {
-		return nil, fmt.Errorf("stats.interval was an invalid duration: %s", c.GetString("stats.interval", ""))
+		return nil, nil, fmt.Errorf("stats.interval was an invalid duration: %s", c.GetString("stats.interval", ""))
 	}
 
-	var startFn func()
+	var startFn, stopFn func()
 	switch mType {
 	case "graphite":
 		err := startGraphiteStats(l, interval, c, configTest)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	case "prometheus":
 		var err error
 		startFn, err = startPrometheusStats(l, interval, c, buildVersion, configTest)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+	case "statsd", "otlp":
+		p, err := newStatsPusher(l, c, mType, interval, identity, buildVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !configTest {
+			l.WithField("type", mType).WithField("interval", interval).Info("Pushing stats")
+			startFn, stopFn = p.run, p.stop
 		}
 	default:
-		return nil, fmt.Errorf("stats.type was not understood: %s", mType)
+		return nil, nil, fmt.Errorf("stats.type was not understood: %s", mType)
 	}
 
 	metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
@@ -56,7 +66,7 @@ func startStats(l *logrus.Logger, c *config.C, buildVersion string, configTest b
 	go metrics.CaptureDebugGCStats(metrics.DefaultRegistry, interval)
 	go metrics.CaptureRuntimeMemStats(metrics.DefaultRegistry, interval)
 
-	return startFn, nil
+	return startFn, stopFn, nil
 }
 
 func startGraphiteStats(l *logrus.Logger, i time.Duration, c *config.C, configTest bool) error {
@@ -0,0 +1,454 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// Pushing stats lets hosts that come and go before a scrape still report. Every interval, and one last time when
+// nebula stops, the registry is sent to a statsd server or an OTLP/HTTP collector tagged with the name and groups of
+// our certificate and any stats.tags.
+
+// statsdMaxPacket keeps statsd datagrams under a common path mtu
+const statsdMaxPacket = 1400
+
+// statsIdentity returns the certificate name and groups pushed stats are tagged with
+type statsIdentity func() (name string, groups []string)
+
+// statsPusher sends the registry somewhere every interval
+type statsPusher struct {
+	l        *logrus.Logger
+	interval time.Duration
+	registry metrics.Registry
+	identity statsIdentity
+	tags     map[string]string
+	push     func(now time.Time) error
+
+	// flushing serializes pushes so the final flush does not race the ticker
+	flushing sync.Mutex
+	done     chan struct{}
+}
+
+func newStatsPusher(l *logrus.Logger, c *config.C, mType string, interval time.Duration, identity statsIdentity, buildVersion string) (*statsPusher, error) {
+	p := &statsPusher{
+		l:        l,
+		interval: interval,
+		registry: metrics.DefaultRegistry,
+		identity: identity,
+		tags:     map[string]string{},
+		done:     make(chan struct{}),
+	}
+
+	for k, v := range c.GetMap("stats.tags", map[string]any{}) {
+		p.tags[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+
+	switch mType {
+	case "statsd":
+		s, err := newStatsdSink(c, p)
+		if err != nil {
+			return nil, err
+		}
+		p.push = s.push
+	case "otlp":
+		o, err := newOtlpSink(c, p, buildVersion)
+		if err != nil {
+			return nil, err
+		}
+		p.push = o.push
+	}
+
+	return p, nil
+}
+
+// run pushes every interval until stop
+func (p *statsPusher) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.flush(now)
+		}
+	}
+}
+
+// stop ends run and pushes one last time so nothing since the last interval is lost
+func (p *statsPusher) stop() {
+	close(p.done)
+	p.flush(time.Now())
+}
+
+func (p *statsPusher) flush(now time.Time) {
+	p.flushing.Lock()
+	defer p.flushing.Unlock()
+	if err := p.push(now); err != nil {
+		p.l.WithError(err).Warn("Failed to push stats")
+	}
+}
+
+// statsSample is what histograms and timers have in common
+type statsSample interface {
+	Min() int64
+	Max() int64
+	Mean() float64
+	Percentiles([]float64) []float64
+}
+
+// statsdSink writes the registry as dogstatsd lines, counters are sent as the change since the last push
+type statsdSink struct {
+	p      *statsPusher
+	addr   string
+	prefix string
+	last   map[string]int64
+}
+
+func newStatsdSink(c *config.C, p *statsPusher) (*statsdSink, error) {
+	host := c.GetString("stats.host", "")
+	if host == "" {
+		return nil, errors.New("stats.host can not be empty")
+	}
+	if _, err := net.ResolveUDPAddr("udp", host); err != nil {
+		return nil, fmt.Errorf("error while setting up statsd sink: %s", err)
+	}
+
+	return &statsdSink{p: p, addr: host, prefix: c.GetString("stats.prefix", "nebula"), last: map[string]int64{}}, nil
+}
+
+// tags renders the dogstatsd tag suffix, groups become one group tag each
+func (s *statsdSink) tags() string {
+	var tags []string
+	name, groups := s.p.identity()
+	if name != "" {
+		tags = append(tags, "name:"+name)
+	}
+	for _, g := range groups {
+		tags = append(tags, "group:"+g)
+	}
+	for k, v := range s.p.tags {
+		tags = append(tags, k+":"+v)
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	slices.Sort(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// lines renders the registry, it is split from push for tests
+func (s *statsdSink) lines() []string {
+	tags := s.tags()
+	var lines []string
+	add := func(name, value, kind string) {
+		if s.prefix != "" {
+			name = s.prefix + "." + name
+		}
+		lines = append(lines, name+":"+value+"|"+kind+tags)
+	}
+	delta := func(name string, n int64) {
+		add(name, strconv.FormatInt(n-s.last[name], 10), "c")
+		s.last[name] = n
+	}
+	gauge := func(name string, v float64) {
+		add(name, strconv.FormatFloat(v, 'f', -1, 64), "g")
+	}
+	sample := func(name string, count int64, h statsSample) {
+		delta(name+".count", count)
+		gauge(name+".min", float64(h.Min()))
+		gauge(name+".max", float64(h.Max()))
+		gauge(name+".mean", h.Mean())
+		ps := h.Percentiles([]float64{0.5, 0.95, 0.99})
+		gauge(name+".p50", ps[0])
+		gauge(name+".p95", ps[1])
+		gauge(name+".p99", ps[2])
+	}
+
+	s.p.registry.Each(func(name string, i any) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			delta(name, m.Count())
+		case metrics.Gauge:
+			gauge(name, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			gauge(name, m.Value())
+		case metrics.Histogram:
+			h := m.Snapshot()
+			sample(name, h.Count(), h)
+		case metrics.Meter:
+			ms := m.Snapshot()
+			delta(name+".count", ms.Count())
+			gauge(name+".rate1", ms.Rate1())
+		case metrics.Timer:
+			t := m.Snapshot()
+			sample(name, t.Count(), t)
+		}
+	})
+
+	slices.Sort(lines)
+	return lines
+}
+
+func (s *statsdSink) push(time.Time) error {
+	conn, err := net.Dial("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var b bytes.Buffer
+	send := func() error {
+		if b.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(b.Bytes())
+		b.Reset()
+		return err
+	}
+
+	for _, line := range s.lines() {
+		if b.Len() > 0 && b.Len()+1+len(line) > statsdMaxPacket {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+	}
+	return send()
+}
+
+// otlpSink posts the registry to an OTLP/HTTP collector using the json encoding, counters are cumulative sums
+type otlpSink struct {
+	p        *statsPusher
+	endpoint string
+	headers  map[string]string
+	version  string
+	start    time.Time
+	client   *http.Client
+}
+
+func newOtlpSink(c *config.C, p *statsPusher, buildVersion string) (*otlpSink, error) {
+	endpoint := c.GetString("stats.endpoint", "")
+	if endpoint == "" {
+		return nil, errors.New("stats.endpoint can not be empty")
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("stats.endpoint must be an http or https url: %s", endpoint)
+	}
+
+	o := &otlpSink{
+		p:        p,
+		endpoint: endpoint,
+		headers:  map[string]string{},
+		version:  buildVersion,
+		start:    time.Now(),
+		client:   &http.Client{Timeout: p.interval},
+	}
+	for k, v := range c.GetMap("stats.headers", map[string]any{}) {
+		o.headers[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+	return o, nil
+}
+
+type otlpValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpValue `json:"values"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpDataPoint struct {
+	StartTimeUnixNano string               `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string               `json:"timeUnixNano"`
+	AsInt             *string              `json:"asInt,omitempty"`
+	AsDouble          *float64             `json:"asDouble,omitempty"`
+	Count             string               `json:"count,omitempty"`
+	Sum               *float64             `json:"sum,omitempty"`
+	QuantileValues    []otlpQuantileValues `json:"quantileValues,omitempty"`
+}
+
+type otlpQuantileValues struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// AggregationTemporality 2 is cumulative
+	AggregationTemporality int  `json:"aggregationTemporality"`
+	IsMonotonic            bool `json:"isMonotonic"`
+}
+
+type otlpMetric struct {
+	Name    string     `json:"name"`
+	Gauge   *otlpGauge `json:"gauge,omitempty"`
+	Sum     *otlpSum   `json:"sum,omitempty"`
+	Summary *otlpGauge `json:"summary,omitempty"`
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+func otlpString(s string) otlpValue {
+	return otlpValue{StringValue: &s}
+}
+
+// request renders the registry at now, it is split from push for tests
+func (o *otlpSink) request(now time.Time) otlpRequest {
+	rm := otlpResourceMetrics{}
+	attrs := []otlpAttribute{
+		{Key: "service.name", Value: otlpString("nebula")},
+		{Key: "service.version", Value: otlpString(o.version)},
+		{Key: "process.runtime.version", Value: otlpString(runtime.Version())},
+	}
+	name, groups := o.p.identity()
+	if name != "" {
+		attrs = append(attrs, otlpAttribute{Key: "nebula.cert.name", Value: otlpString(name)})
+	}
+	if len(groups) > 0 {
+		values := make([]otlpValue, len(groups))
+		for i, g := range groups {
+			values[i] = otlpString(g)
+		}
+		attrs = append(attrs, otlpAttribute{Key: "nebula.cert.groups", Value: otlpValue{ArrayValue: &otlpArrayValue{Values: values}}})
+	}
+	keys := make([]string, 0, len(o.p.tags))
+	for k := range o.p.tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpString(o.p.tags[k])})
+	}
+	rm.Resource.Attributes = attrs
+
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	start := strconv.FormatInt(o.start.UnixNano(), 10)
+	sm := otlpScopeMetrics{}
+	sm.Scope.Name = "github.com/slackhq/nebula"
+	sm.Scope.Version = o.version
+
+	sum := func(name string, n int64) otlpMetric {
+		v := strconv.FormatInt(n, 10)
+		return otlpMetric{Name: name, Sum: &otlpSum{
+			DataPoints:             []otlpDataPoint{{StartTimeUnixNano: start, TimeUnixNano: ts, AsInt: &v}},
+			AggregationTemporality: 2,
+		}}
+	}
+	gauge := func(name string, v float64) otlpMetric {
+		return otlpMetric{Name: name, Gauge: &otlpGauge{DataPoints: []otlpDataPoint{{TimeUnixNano: ts, AsDouble: &v}}}}
+	}
+	summary := func(name string, count int64, total float64, ps []float64) otlpMetric {
+		return otlpMetric{Name: name, Summary: &otlpGauge{DataPoints: []otlpDataPoint{{
+			StartTimeUnixNano: start,
+			TimeUnixNano:      ts,
+			Count:             strconv.FormatInt(count, 10),
+			Sum:               &total,
+			QuantileValues: []otlpQuantileValues{
+				{Quantile: 0.5, Value: ps[0]},
+				{Quantile: 0.95, Value: ps[1]},
+				{Quantile: 0.99, Value: ps[2]},
+			},
+		}}}}
+	}
+
+	quantiles := []float64{0.5, 0.95, 0.99}
+	o.p.registry.Each(func(name string, i any) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			sm.Metrics = append(sm.Metrics, sum(name, m.Count()))
+		case metrics.Gauge:
+			sm.Metrics = append(sm.Metrics, gauge(name, float64(m.Value())))
+		case metrics.GaugeFloat64:
+			sm.Metrics = append(sm.Metrics, gauge(name, m.Value()))
+		case metrics.Histogram:
+			h := m.Snapshot()
+			sm.Metrics = append(sm.Metrics, summary(name, h.Count(), float64(h.Sum()), h.Percentiles(quantiles)))
+		case metrics.Meter:
+			sm.Metrics = append(sm.Metrics, sum(name, m.Snapshot().Count()))
+		case metrics.Timer:
+			t := m.Snapshot()
+			sm.Metrics = append(sm.Metrics, summary(name, t.Count(), float64(t.Sum()), t.Percentiles(quantiles)))
+		}
+	})
+	slices.SortFunc(sm.Metrics, func(a, b otlpMetric) int { return strings.Compare(a.Name, b.Name) })
+
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}}
+}
+
+func (o *otlpSink) push(now time.Time) error {
+	b, err := json.Marshal(o.request(now))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package nebula
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStatsPusher(t *testing.T, settings map[string]any) *statsPusher {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	c.Settings["stats"] = settings
+	identity := func() (string, []string) { return "host1", []string{"web", "prod"} }
+	p, err := newStatsPusher(l, c, settings["type"].(string), time.Second, identity, "1.2.3")
+	require.NoError(t, err)
+	p.registry = metrics.NewRegistry()
+	return p
+}
+
+func TestNewStatsPusher(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	for _, bad := range []map[string]any{
+		{"type": "statsd"},
+		{"type": "otlp"},
+		{"type": "otlp", "endpoint": "collector:4318"},
+	} {
+		c.Settings["stats"] = bad
+		_, err := newStatsPusher(l, c, bad["type"].(string), time.Second, nil, "")
+		require.Error(t, err, bad)
+	}
+}
+
+func TestStatsdSink_lines(t *testing.T) {
+	p := newTestStatsPusher(t, map[string]any{"type": "statsd", "host": "127.0.0.1:8125", "tags": map[string]any{"env": "dev"}})
+	s, err := newStatsdSink(config.NewC(test.NewLogger()), p)
+	require.Error(t, err)
+
+	c := config.NewC(test.NewLogger())
+	c.Settings["stats"] = map[string]any{"host": "127.0.0.1:8125"}
+	s, err = newStatsdSink(c, p)
+	require.NoError(t, err)
+
+	counter := metrics.GetOrRegisterCounter("handshakes.sent", p.registry)
+	metrics.GetOrRegisterGauge("hostmap.hosts", p.registry).Update(3)
+	counter.Inc(5)
+
+	tags := "|#env:dev,group:prod,group:web,name:host1"
+	assert.Equal(t, []string{
+		"nebula.handshakes.sent:5|c" + tags,
+		"nebula.hostmap.hosts:3|g" + tags,
+	}, s.lines())
+
+	// Counters are sent as the change since the last push
+	counter.Inc(2)
+	assert.Equal(t, "nebula.handshakes.sent:2|c"+tags, s.lines()[0])
+
+	metrics.GetOrRegisterHistogram("latency", p.registry, metrics.NewUniformSample(10)).Update(7)
+	assert.Contains(t, s.lines(), "nebula.latency.p99:7|g"+tags)
+}
+
+func TestOtlpSink_push(t *testing.T) {
+	var got otlpRequest
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+		b, _ := io.ReadAll(r.Body)
+		assert.NoError(t, json.Unmarshal(b, &got))
+	}))
+	defer srv.Close()
+
+	p := newTestStatsPusher(t, map[string]any{
+		"type":     "otlp",
+		"endpoint": srv.URL + "/v1/metrics",
+		"headers":  map[string]any{"Authorization": "Bearer hunter2"},
+		"tags":     map[string]any{"env": "dev"},
+	})
+	metrics.GetOrRegisterCounter("handshakes.sent", p.registry).Inc(5)
+	metrics.GetOrRegisterHistogram("latency", p.registry, metrics.NewUniformSample(10)).Update(7)
+
+	p.flush(time.Now())
+	assert.Equal(t, "Bearer hunter2", header)
+	require.Len(t, got.ResourceMetrics, 1)
+
+	attrs := map[string]otlpValue{}
+	for _, a := range got.ResourceMetrics[0].Resource.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	assert.Equal(t, "host1", *attrs["nebula.cert.name"].StringValue)
+	assert.Equal(t, "dev", *attrs["env"].StringValue)
+	assert.Len(t, attrs["nebula.cert.groups"].ArrayValue.Values, 2)
+
+	ms := got.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, ms, 2)
+	assert.Equal(t, "handshakes.sent", ms[0].Name)
+	assert.Equal(t, "5", *ms[0].Sum.DataPoints[0].AsInt)
+	assert.Equal(t, "latency", ms[1].Name)
+	assert.Equal(t, "1", ms[1].Summary.DataPoints[0].Count)
+
+	// A collector that refuses the push is an error
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	require.Error(t, p.push(time.Now()))
+}
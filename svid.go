@@ -0,0 +1,398 @@
+package nebula
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// We issue ourselves an X.509 SVID so applications can use the mesh identity for mTLS with each other. The SPIFFE ID
+// is spiffe://<trust_domain>/<certificate name>, the subject holds the name and groups, and the vpn addresses are ip
+// SANs. Nebula host keys can not sign X.509 certificates so every SVID gets a fresh key and is signed by an X.509 CA
+// shared by the nodes of the trust domain. We only ever sign for the identity in our own nebula certificate, but the
+// CA key can sign anything, treat every node that holds it as able to mint any SVID in the trust domain.
+//
+// The SVID is kept in memory for Control.SVID and written to dir in the layout of spiffe-helper, svid.pem,
+// svid_key.pem, and svid_bundle.pem. A new one is issued at half its lifetime and when our certificate changes.
+
+// svidCheckInterval is how often we look for an SVID to renew
+const svidCheckInterval = 30 * time.Second
+
+var (
+	// spiffeTrustDomain and spiffePathSegment are the characters SPIFFE allows in a trust domain and a path segment
+	spiffeTrustDomain = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	spiffePathSegment = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// SVID is an X.509 SVID for our nebula identity
+type SVID struct {
+	// ID is the SPIFFE ID, spiffe://<trust domain>/<certificate name>
+	ID *url.URL
+	// Certificates is the SVID first followed by any intermediates needed to reach the bundle
+	Certificates []*x509.Certificate
+	PrivateKey   crypto.Signer
+	// Bundle is the CA every SVID in the trust domain chains to
+	Bundle []*x509.Certificate
+
+	// nebulaFingerprint is the certificate the SVID was issued for, a new one is issued if it changes
+	nebulaFingerprint string
+	renewAt           time.Time
+}
+
+type svidIssuer struct {
+	l           *logrus.Logger
+	f           *Interface
+	trustDomain string
+	dir         string
+	ttl         time.Duration
+
+	// caChain is the CA certificate followed by the certificates between it and the bundle
+	caChain []*x509.Certificate
+	caKey   crypto.Signer
+	bundle  []*x509.Certificate
+
+	current atomic.Pointer[SVID]
+}
+
+// newSVIDFromConfig returns nil if svid is not enabled, it is only read at startup
+func newSVIDFromConfig(l *logrus.Logger, c *config.C, f *Interface) (*svidIssuer, error) {
+	if !c.GetBool("svid.enabled", false) {
+		return nil, nil
+	}
+
+	s := &svidIssuer{
+		l:           l,
+		f:           f,
+		trustDomain: c.GetString("svid.trust_domain", ""),
+		dir:         c.GetString("svid.dir", ""),
+		ttl:         c.GetDuration("svid.ttl", time.Hour),
+	}
+
+	if !spiffeTrustDomain.MatchString(s.trustDomain) {
+		return nil, fmt.Errorf("svid.trust_domain must be a valid trust domain, got %q", s.trustDomain)
+	}
+
+	if s.ttl < 2*svidCheckInterval {
+		return nil, fmt.Errorf("svid.ttl must be at least %v", 2*svidCheckInterval)
+	}
+
+	var err error
+	s.caChain, err = readPEMCertificates(c.GetString("svid.ca_cert", ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read svid.ca_cert: %w", err)
+	}
+	if !s.caChain[0].IsCA || s.caChain[0].KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, errors.New("svid.ca_cert must be a CA that can sign certificates")
+	}
+
+	caKeyPathOrPEM, err := c.GetSecret("svid.ca_key", "")
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(caKeyPathOrPEM, "-----BEGIN") {
+		s.caKey, err = parsePEMPrivateKey([]byte(caKeyPathOrPEM))
+	} else {
+		s.caKey, err = readPEMPrivateKey(caKeyPathOrPEM)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read svid.ca_key: %w", err)
+	}
+	if !publicKeysEqual(s.caChain[0].PublicKey, s.caKey.Public()) {
+		return nil, errors.New("svid.ca_key does not match svid.ca_cert")
+	}
+
+	s.bundle = s.caChain[len(s.caChain)-1:]
+	if path := c.GetString("svid.bundle", ""); path != "" {
+		s.bundle, err = readPEMCertificates(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read svid.bundle: %w", err)
+		}
+	}
+
+	// Make sure we will be able to issue, the name in our certificate may not be usable
+	if name := f.pki.getCertState().GetDefaultCertificate().Name(); !spiffePathSegment.MatchString(name) {
+		return nil, fmt.Errorf("certificate name %q can not be used in a SPIFFE ID", name)
+	}
+
+	return s, nil
+}
+
+// Start issues an SVID and renews it until ctx is done
+func (s *svidIssuer) Start(ctx context.Context) {
+	if err := s.renew(time.Now()); err != nil {
+		s.l.WithError(err).Error("Failed to issue an SVID")
+	}
+
+	ticker := time.NewTicker(svidCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := s.renew(now); err != nil {
+				s.l.WithError(err).Error("Failed to renew the SVID")
+			}
+		}
+	}
+}
+
+// renew issues a new SVID if the current one is getting old or was issued for a certificate we no longer use
+func (s *svidIssuer) renew(now time.Time) error {
+	crt := s.f.pki.getCertState().GetDefaultCertificate()
+	fingerprint, err := crt.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	cur := s.current.Load()
+	if cur != nil && cur.nebulaFingerprint == fingerprint && now.Before(cur.renewAt) {
+		return nil
+	}
+
+	svid, err := s.issue(now)
+	if err != nil {
+		return err
+	}
+
+	if s.dir != "" {
+		if err = s.write(svid); err != nil {
+			return err
+		}
+	}
+
+	s.current.Store(svid)
+	s.l.WithField("id", svid.ID.String()).WithField("notAfter", svid.Certificates[0].NotAfter).Info("Issued a new SVID")
+	return nil
+}
+
+func (s *svidIssuer) issue(now time.Time) (*SVID, error) {
+	cs := s.f.pki.getCertState()
+	crt := cs.GetDefaultCertificate()
+	fingerprint, err := crt.Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	if !spiffePathSegment.MatchString(crt.Name()) {
+		return nil, fmt.Errorf("certificate name %q can not be used in a SPIFFE ID", crt.Name())
+	}
+	id := &url.URL{Scheme: "spiffe", Host: s.trustDomain, Path: "/" + crt.Name()}
+
+	notAfter := now.Add(s.ttl)
+	for _, limit := range []time.Time{crt.NotAfter(), s.caChain[0].NotAfter} {
+		if limit.Before(notAfter) {
+			notAfter = limit
+		}
+	}
+	if !notAfter.After(now) {
+		return nil, errors.New("our certificate or the svid CA has expired")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         crt.Name(),
+			OrganizationalUnit: crt.Groups(),
+		},
+		URIs:                  []*url.URL{id},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, addr := range cs.myVpnAddrs {
+		template.IPAddresses = append(template.IPAddresses, addr.AsSlice())
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caChain[0], key.Public(), s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bundle is what peers trust, only send the certificates between it and the SVID
+	chain := []*x509.Certificate{leaf}
+	for _, c := range s.caChain {
+		if !certificateIn(c, s.bundle) {
+			chain = append(chain, c)
+		}
+	}
+
+	return &SVID{
+		ID:                id,
+		Certificates:      chain,
+		PrivateKey:        key,
+		Bundle:            s.bundle,
+		nebulaFingerprint: fingerprint,
+		renewAt:           now.Add(notAfter.Sub(now) / 2),
+	}, nil
+}
+
+// write saves svid the way spiffe-helper does, each file is replaced whole so readers never see half of one
+func (s *svidIssuer) write(svid *SVID) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		mode os.FileMode
+		data []byte
+	}{
+		{"svid_key.pem", 0600, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})},
+		{"svid.pem", 0644, encodePEMCertificates(svid.Certificates)},
+		{"svid_bundle.pem", 0644, encodePEMCertificates(svid.Bundle)},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.name)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, file.data, file.mode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readPEMCertificates(path string) ([]*x509.Certificate, error) {
+	if path == "" {
+		return nil, errors.New("no path was given")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+
+	if len(out) == 0 {
+		return nil, errors.New("no certificates were found")
+	}
+	return out, nil
+}
+
+func readPEMPrivateKey(path string) (crypto.Signer, error) {
+	if path == "" {
+		return nil, errors.New("no path was given")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsePEMPrivateKey(b)
+}
+
+func parsePEMPrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no private key was found")
+	}
+
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%T keys can not sign certificates", key)
+	}
+	return signer, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
+
+func certificateIn(c *x509.Certificate, certs []*x509.Certificate) bool {
+	for _, o := range certs {
+		if c.Equal(o) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodePEMCertificates(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, c := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package nebula
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSVID(t *testing.T) {
+	l := test.NewLogger()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "svid ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "svid ca"}}, caKey.Public(), caKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(caKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	crt := &dummyCert{name: "web-1", groups: []string{"web", "prod"}, notAfter: time.Now().Add(time.Hour)}
+	ifce := &Interface{pki: &PKI{}, l: l}
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            crt,
+		myVpnAddrs:        []netip.Addr{netip.MustParseAddr("10.42.0.5")},
+	})
+
+	c := config.NewC(l)
+	load := func(ttl string) (*svidIssuer, error) {
+		require.NoError(t, c.LoadString(`
+svid:
+  enabled: true
+  trust_domain: example.org
+  ca_cert: `+filepath.Join(dir, "ca.crt")+`
+  ca_key: `+filepath.Join(dir, "ca.key")+`
+  dir: `+filepath.Join(dir, "out")+`
+  ttl: `+ttl+`
+`))
+		return newSVIDFromConfig(l, c, ifce)
+	}
+
+	s, err := load("2h")
+	require.NoError(t, err)
+	now := time.Now()
+	require.NoError(t, s.renew(now))
+	svid := s.current.Load()
+	require.NotNil(t, svid)
+	assert.Equal(t, "spiffe://example.org/web-1", svid.ID.String())
+
+	// The SVID verifies against the bundle and never outlives our certificate
+	leaf := svid.Certificates[0]
+	pool := x509.NewCertPool()
+	pool.AddCert(svid.Bundle[0])
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	require.NoError(t, err)
+	assert.Equal(t, "web-1", leaf.Subject.CommonName)
+	assert.Equal(t, []string{"web", "prod"}, leaf.Subject.OrganizationalUnit)
+	assert.Equal(t, "10.42.0.5", leaf.IPAddresses[0].String())
+	assert.WithinDuration(t, crt.notAfter, leaf.NotAfter, time.Second)
+	assert.Len(t, svid.Certificates, 1)
+
+	// The files match and the key is private
+	keyFile := filepath.Join(dir, "out", "svid_key.pem")
+	fi, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	written, err := readPEMCertificates(filepath.Join(dir, "out", "svid.pem"))
+	require.NoError(t, err)
+	assert.True(t, written[0].Equal(leaf))
+	key, err := readPEMPrivateKey(keyFile)
+	require.NoError(t, err)
+	assert.True(t, publicKeysEqual(leaf.PublicKey, key.Public()))
+	bundle, err := readPEMCertificates(filepath.Join(dir, "out", "svid_bundle.pem"))
+	require.NoError(t, err)
+	assert.True(t, bundle[0].Equal(svid.Bundle[0]))
+
+	// Nothing is issued until halfway through, or until our certificate changes
+	require.NoError(t, s.renew(now.Add(10*time.Minute)))
+	assert.Same(t, svid, s.current.Load())
+	require.NoError(t, s.renew(now.Add(40*time.Minute)))
+	assert.NotSame(t, svid, s.current.Load())
+
+	svid = s.current.Load()
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            &dummyCert{name: "web-2", notAfter: time.Now().Add(time.Hour)},
+	})
+	// dummyCert fingerprints are all empty, pretend the SVID was issued for another certificate
+	svid.nebulaFingerprint = "old"
+	require.NoError(t, s.renew(now.Add(41*time.Minute)))
+	assert.Equal(t, "spiffe://example.org/web-2", s.current.Load().ID.String())
+
+	// Config problems are caught at startup
+	_, err = load("1s")
+	require.ErrorContains(t, err, "svid.ttl must be at least")
+	require.NoError(t, c.LoadString("svid:\n  enabled: true\n  trust_domain: Example.org\n"))
+	_, err = newSVIDFromConfig(l, c, ifce)
+	require.ErrorContains(t, err, "svid.trust_domain must be a valid trust domain")
+	ifce.pki.cs.Store(&CertState{initiatingVersion: cert.Version1, v1Cert: &dummyCert{name: "web 1"}})
+	_, err = load("2h")
+	require.ErrorContains(t, err, `certificate name "web 1" can not be used in a SPIFFE ID`)
+}
@@ -0,0 +1,320 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/header"
+)
+
+// With tun.mode set to tap the inside device carries ethernet frames instead of ip packets, and we tunnel the frames
+// whole. We learn which peer a mac address lives behind from the frames it sends us and use that to pick the tunnel
+// for frames to it. ARP requests and ipv6 neighbor solicitations go to the host that owns the address being asked
+// about, any other broadcast, multicast, or unknown frame is flooded to every established tunnel. The firewall still
+// sees the ip packet inside a frame, frames without one and neighbor discovery pass. Every host we talk to must be in
+// tap mode as well, this is meant for small setups.
+
+const (
+	ethHeaderLen  = 14
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	// macExpiry is how long a mac address is tied to a peer without hearing from it
+	macExpiry = 5 * time.Minute
+	// macsPerPeer stops a single peer from filling the mac table
+	macsPerPeer = 64
+)
+
+type macAddr [6]byte
+
+func (m macAddr) String() string {
+	return net.HardwareAddr(m[:]).String()
+}
+
+func (m macAddr) unicast() bool {
+	return m[0]&1 == 0
+}
+
+type macEntry struct {
+	vpnAddr netip.Addr
+	seen    time.Time
+}
+
+// macTable maps the mac addresses we have seen frames from to the peer that sent them
+type macTable struct {
+	sync.RWMutex
+	entries map[macAddr]macEntry
+	perPeer map[netip.Addr]int
+}
+
+func newMACTable() *macTable {
+	return &macTable{
+		entries: map[macAddr]macEntry{},
+		perPeer: map[netip.Addr]int{},
+	}
+}
+
+// learn ties mac to vpnAddr, it returns false if the peer already has too many mac addresses
+func (t *macTable) learn(mac macAddr, vpnAddr netip.Addr, now time.Time) bool {
+	if !mac.unicast() {
+		return false
+	}
+
+	// Most frames come from a mac we already know, only take the write lock to move it or every so often to refresh it
+	t.RLock()
+	e, ok := t.entries[mac]
+	t.RUnlock()
+	if ok && e.vpnAddr == vpnAddr && now.Sub(e.seen) < macExpiry/10 {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	e, ok = t.entries[mac]
+	if ok && e.vpnAddr != vpnAddr {
+		t.forget(mac, e)
+		ok = false
+	}
+
+	if !ok && t.perPeer[vpnAddr] >= macsPerPeer {
+		t.expire(vpnAddr, now)
+		if t.perPeer[vpnAddr] >= macsPerPeer {
+			return false
+		}
+	}
+
+	if !ok {
+		t.perPeer[vpnAddr]++
+	}
+	t.entries[mac] = macEntry{vpnAddr: vpnAddr, seen: now}
+	return true
+}
+
+// lookup returns the peer mac lives behind
+func (t *macTable) lookup(mac macAddr, now time.Time) (netip.Addr, bool) {
+	t.RLock()
+	e, ok := t.entries[mac]
+	t.RUnlock()
+	if !ok || now.Sub(e.seen) > macExpiry {
+		return netip.Addr{}, false
+	}
+	return e.vpnAddr, true
+}
+
+// expire drops the mac addresses of vpnAddr we have not heard from in a while, the caller must hold the write lock
+func (t *macTable) expire(vpnAddr netip.Addr, now time.Time) {
+	for mac, e := range t.entries {
+		if e.vpnAddr == vpnAddr && now.Sub(e.seen) > macExpiry {
+			t.forget(mac, e)
+		}
+	}
+}
+
+func (t *macTable) forget(mac macAddr, e macEntry) {
+	delete(t.entries, mac)
+	t.perPeer[e.vpnAddr]--
+	if t.perPeer[e.vpnAddr] <= 0 {
+		delete(t.perPeer, e.vpnAddr)
+	}
+}
+
+// frameIP returns the ip packet carried by frame
+func frameIP(frame []byte) ([]byte, bool) {
+	if len(frame) < ethHeaderLen {
+		return nil, false
+	}
+
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeIPv4, etherTypeIPv6:
+		return frame[ethHeaderLen:], true
+	}
+	return nil, false
+}
+
+// neighborDiscovery reports whether frame is an ipv6 neighbor discovery message, these take the place of ARP
+func neighborDiscovery(frame []byte) bool {
+	p, ok := frameIP(frame)
+	if !ok || len(p) < 41 || p[0]>>4 != 6 || p[6] != 58 {
+		return false
+	}
+	return p[40] >= 133 && p[40] <= 137
+}
+
+// frameTarget returns the address of the host a frame is meant for when the frame itself tells us. That is the
+// address asked about by an ARP request or a neighbor solicitation, or the destination of a unicast ip packet.
+func frameTarget(frame []byte) (netip.Addr, bool) {
+	if len(frame) < ethHeaderLen {
+		return netip.Addr{}, false
+	}
+
+	p := frame[ethHeaderLen:]
+	var addr netip.Addr
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		// Only ethernet and ipv4, the target protocol address is the last field
+		if len(p) < 28 || binary.BigEndian.Uint16(p[0:2]) != 1 || binary.BigEndian.Uint16(p[2:4]) != etherTypeIPv4 {
+			return netip.Addr{}, false
+		}
+		addr = netip.AddrFrom4([4]byte(p[24:28]))
+
+	case etherTypeIPv4:
+		if len(p) < 20 || p[0]>>4 != 4 {
+			return netip.Addr{}, false
+		}
+		addr = netip.AddrFrom4([4]byte(p[16:20]))
+
+	case etherTypeIPv6:
+		if len(p) < 40 || p[0]>>4 != 6 {
+			return netip.Addr{}, false
+		}
+		addr = netip.AddrFrom16([16]byte(p[24:40]))
+		if p[6] == 58 && len(p) >= 64 && p[40] == 135 {
+			// Neighbor solicitations go to a multicast address, the target is in the message
+			addr = netip.AddrFrom16([16]byte(p[48:64]))
+		}
+
+	default:
+		return netip.Addr{}, false
+	}
+
+	return addr, addr.IsValid() && !addr.IsMulticast() && addr != limitedBroadcast
+}
+
+// consumeInsideFrame is consumeInsidePacket for tap mode
+func (f *Interface) consumeInsideFrame(frame []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	if len(frame) < ethHeaderLen {
+		return
+	}
+
+	if dst := macAddr(frame[0:6]); dst.unicast() {
+		if vpnAddr, ok := f.macs.lookup(dst, time.Now()); ok {
+			f.sendFrame(vpnAddr, frame, fwPacket, nb, out, q, localCache)
+			return
+		}
+	}
+
+	if vpnAddr, ok := frameTarget(frame); ok && f.myVpnNetworksTable.Contains(vpnAddr) {
+		if !f.myVpnAddrsTable.Contains(vpnAddr) {
+			f.sendFrame(vpnAddr, frame, fwPacket, nb, out, q, localCache)
+		}
+		return
+	}
+
+	f.floodFrame(frame, fwPacket, nb, out, q, localCache)
+}
+
+// sendFrame sends frame to vpnAddr, starting a handshake if we have to
+func (f *Interface) sendFrame(vpnAddr netip.Addr, frame []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	hostinfo, ready := f.getOrHandshakeNoRouting(vpnAddr, func(hh *HandshakeHostInfo) {
+		hh.cachePacket(f.l, header.Message, 0, frame, f.sendFrameNow, f.cachedPacketMetrics)
+	})
+	if hostinfo == nil || !ready {
+		return
+	}
+
+	if err := f.dropFrame(frame, false, fwPacket, hostinfo, localCache); err != nil {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).WithField("reason", err).
+				Debugln("dropping outbound frame")
+		}
+		return
+	}
+
+	if s := f.shaper.Load(); s.enabled() && !s.allow(hostinfo, len(frame)) {
+		return
+	}
+
+	f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, frame, nb, out, q)
+}
+
+// sendFrameNow sends a frame that was cached while the tunnel was handshaking
+func (f *Interface) sendFrameNow(_ header.MessageType, st header.MessageSubType, hostinfo *HostInfo, p, nb, out []byte) {
+	if err := f.dropFrame(p, false, &firewall.Packet{}, hostinfo, nil); err != nil {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("reason", err).Debugln("dropping cached frame")
+		}
+		return
+	}
+
+	f.sendNoMetrics(header.Message, st, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, p, nb, out, 0)
+}
+
+// floodFrame copies frame to every host we have a tunnel with, flooding never starts a handshake
+func (f *Interface) floodFrame(frame []byte, fwPacket *firewall.Packet, nb, out []byte, q int, localCache firewall.ConntrackCache) {
+	hosts := map[*HostInfo]struct{}{}
+	f.hostMap.ForEachVpnAddr(func(hostinfo *HostInfo) {
+		hosts[hostinfo] = struct{}{}
+	})
+
+	for hostinfo := range hosts {
+		if err := f.dropFrame(frame, false, fwPacket, hostinfo, localCache); err != nil {
+			if f.l.Level >= logrus.DebugLevel {
+				hostinfo.logger(f.l).WithField("fwPacket", fwPacket).WithField("reason", err).
+					Debugln("dropping outbound flooded frame")
+			}
+			continue
+		}
+
+		f.sendNoMetrics(header.Message, 0, hostinfo.ConnectionState, hostinfo, netip.AddrPort{}, frame, nb, out, q)
+	}
+}
+
+// dropFrame runs the firewall over the ip packet in frame, a nil return means the frame may pass
+func (f *Interface) dropFrame(frame []byte, incoming bool, fwPacket *firewall.Packet, hostinfo *HostInfo, localCache firewall.ConntrackCache) error {
+	p, ok := frameIP(frame)
+	if !ok || neighborDiscovery(frame) {
+		return nil
+	}
+
+	if err := newPacket(p, incoming, fwPacket); err != nil {
+		return err
+	}
+
+	dst := fwPacket.RemoteAddr
+	if incoming {
+		dst = fwPacket.LocalAddr
+	}
+
+	if dst.IsMulticast() || dst == limitedBroadcast || f.myBroadcastAddrsTable.Contains(dst) {
+		return f.firewall.DropBroadcast(*fwPacket, incoming, hostinfo, f.pki.GetCAPool(), localCache)
+	}
+	return f.firewall.Drop(*fwPacket, incoming, hostinfo, f.pki.GetCAPool(), localCache)
+}
+
+// receiveFrame is the tap mode end of decryptToTun, frame has been decrypted
+func (f *Interface) receiveFrame(hostinfo *HostInfo, messageCounter uint64, frame []byte, fwPacket *firewall.Packet, q int, localCache firewall.ConntrackCache) bool {
+	if len(frame) < ethHeaderLen {
+		hostinfo.logger(f.l).WithField("frame", frame).Warnf("Error while validating inbound frame")
+		return false
+	}
+
+	if !hostinfo.ConnectionState.window.Update(f.l, messageCounter) {
+		hostinfo.logger(f.l).Debugln("dropping out of window frame")
+		return false
+	}
+
+	if err := f.dropFrame(frame, true, fwPacket, hostinfo, localCache); err != nil {
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithField("fwPacket", fwPacket).WithField("reason", err).
+				Debugln("dropping inbound frame")
+		}
+		return false
+	}
+
+	if !f.macs.learn(macAddr(frame[6:12]), hostinfo.vpnAddrs[0], time.Now()) && f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).WithField("mac", macAddr(frame[6:12])).Debugln("not learning mac address")
+	}
+
+	f.connectionManager.In(hostinfo)
+	hostinfo.counters.rx(len(frame))
+
+	f.writeToTun(hostinfo, frame, q)
+	return true
+}
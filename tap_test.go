@@ -0,0 +1,106 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACTable(t *testing.T) {
+	m := newMACTable()
+	now := time.Now()
+	a := netip.MustParseAddr("10.0.0.2")
+	b := netip.MustParseAddr("10.0.0.3")
+	mac := macAddr{0x02, 0, 0, 0, 0, 1}
+
+	_, ok := m.lookup(mac, now)
+	assert.False(t, ok)
+
+	assert.True(t, m.learn(mac, a, now))
+	got, ok := m.lookup(mac, now)
+	assert.True(t, ok)
+	assert.Equal(t, a, got)
+
+	// Multicast and broadcast sources are never learned
+	assert.False(t, m.learn(macAddr{0x01, 0, 0x5e, 0, 0, 1}, a, now))
+	assert.False(t, m.learn(macAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, a, now))
+
+	// A mac that shows up behind another peer moves
+	assert.True(t, m.learn(mac, b, now))
+	got, _ = m.lookup(mac, now)
+	assert.Equal(t, b, got)
+	assert.Equal(t, 0, m.perPeer[a])
+	assert.Equal(t, 1, m.perPeer[b])
+
+	// It is forgotten when we stop hearing from it
+	_, ok = m.lookup(mac, now.Add(macExpiry+time.Second))
+	assert.False(t, ok)
+
+	// A peer can not fill the table, until its old entries expire
+	for i := range macsPerPeer - 1 {
+		assert.True(t, m.learn(macAddr{0x02, 0, 0, 0, 1, byte(i)}, b, now))
+	}
+	assert.False(t, m.learn(macAddr{0x02, 0, 0, 0, 2, 0}, b, now))
+	assert.True(t, m.learn(macAddr{0x02, 0, 0, 0, 2, 0}, a, now))
+	assert.True(t, m.learn(macAddr{0x02, 0, 0, 0, 2, 0}, b, now.Add(macExpiry+time.Second)))
+	assert.Equal(t, 1, m.perPeer[b])
+	assert.Len(t, m.entries, 1)
+}
+
+func newFrame(etherType uint16, payload []byte) []byte {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, byte(etherType >> 8), byte(etherType)}
+	return append(frame, payload...)
+}
+
+func TestFrameTarget(t *testing.T) {
+	arp := make([]byte, 28)
+	copy(arp, []byte{0, 1, 0x08, 0x00, 6, 4, 0, 1})
+	copy(arp[14:18], []byte{10, 0, 0, 1})
+	copy(arp[24:28], []byte{10, 0, 0, 2})
+	addr, ok := frameTarget(newFrame(etherTypeARP, arp))
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.2"), addr)
+
+	ipv4 := make([]byte, 20)
+	ipv4[0] = 0x45
+	copy(ipv4[16:20], []byte{10, 0, 0, 3})
+	addr, ok = frameTarget(newFrame(etherTypeIPv4, ipv4))
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("10.0.0.3"), addr)
+
+	copy(ipv4[16:20], []byte{255, 255, 255, 255})
+	_, ok = frameTarget(newFrame(etherTypeIPv4, ipv4))
+	assert.False(t, ok)
+
+	// A neighbor solicitation is sent to the solicited node address, we want the target
+	ns := newIPv6Packet(64)
+	ns[6] = 58
+	copy(ns[24:40], netip.MustParseAddr("ff02::1:ff00:2").AsSlice())
+	ns[40] = 135
+	copy(ns[48:64], netip.MustParseAddr("fd00::2").AsSlice())
+	frame := newFrame(etherTypeIPv6, ns)
+	addr, ok = frameTarget(frame)
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("fd00::2"), addr)
+	assert.True(t, neighborDiscovery(frame))
+
+	// Other multicast is flooded
+	mdns := newIPv6Packet(48)
+	copy(mdns[24:40], netip.MustParseAddr("ff02::fb").AsSlice())
+	frame = newFrame(etherTypeIPv6, mdns)
+	_, ok = frameTarget(frame)
+	assert.False(t, ok)
+	assert.False(t, neighborDiscovery(frame))
+	p, ok := frameIP(frame)
+	assert.True(t, ok)
+	assert.Equal(t, mdns, p)
+
+	_, ok = frameTarget(newFrame(0x88cc, make([]byte, 40)))
+	assert.False(t, ok)
+	_, ok = frameIP(newFrame(etherTypeARP, arp))
+	assert.False(t, ok)
+	_, ok = frameTarget([]byte{1, 2, 3})
+	assert.False(t, ok)
+}
@@ -0,0 +1,162 @@
+package nebula
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// A write to the tun device fails with host or network unreachable when the kernel has nowhere to send the packet,
+// usually a peer sending to something behind an unsafe route that is down. That peer will keep doing it at line rate,
+// so once tun.write_errors.hold_after writes in a row of its packets were unreachable we stop handing its packets to
+// the tun device for tun.write_errors.hold and send an InterfaceTunWriteFailing event instead of logging every packet.
+
+const (
+	// tunWriteErrorLogInterval is the least time between two logs of failed tun writes not tied to a held back peer
+	tunWriteErrorLogInterval = 10 * time.Second
+
+	defaultTunWriteHoldAfter = 10
+	defaultTunWriteHold      = 5 * time.Second
+)
+
+type tunWriteErrorKind int
+
+const (
+	tunWriteErrorOther tunWriteErrorKind = iota
+	tunWriteErrorHostUnreachable
+	tunWriteErrorNetUnreachable
+)
+
+func (k tunWriteErrorKind) String() string {
+	switch k {
+	case tunWriteErrorHostUnreachable:
+		return "host_unreachable"
+	case tunWriteErrorNetUnreachable:
+		return "net_unreachable"
+	default:
+		return "other"
+	}
+}
+
+func classifyTunWriteError(err error) tunWriteErrorKind {
+	switch {
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return tunWriteErrorHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return tunWriteErrorNetUnreachable
+	default:
+		return tunWriteErrorOther
+	}
+}
+
+type tunWriteErrors struct {
+	// holdAfter is how many unreachable writes in a row hold back a peer, 0 never does
+	holdAfter atomic.Uint32
+	hold      atomic.Int64
+
+	// lastLog and suppressed rate limit the logs of failures that do not hold back a peer
+	lastLog    atomic.Int64
+	suppressed atomic.Uint64
+
+	metricErrors [3]metrics.Counter
+	metricHeld   metrics.Counter
+}
+
+func newTunWriteErrors() *tunWriteErrors {
+	t := &tunWriteErrors{
+		metricHeld: metrics.GetOrRegisterCounter("tun.write_errors.held", nil),
+	}
+	for _, k := range []tunWriteErrorKind{tunWriteErrorOther, tunWriteErrorHostUnreachable, tunWriteErrorNetUnreachable} {
+		t.metricErrors[k] = metrics.GetOrRegisterCounter("tun.write_errors."+k.String(), nil)
+	}
+	t.holdAfter.Store(defaultTunWriteHoldAfter)
+	t.hold.Store(int64(defaultTunWriteHold))
+	return t
+}
+
+func (f *Interface) reloadTunWriteErrors(c *config.C) {
+	initial := c.InitialLoad()
+	if !initial && !c.HasChanged("tun.write_errors") {
+		return
+	}
+
+	holdAfter := max(c.GetInt("tun.write_errors.hold_after", defaultTunWriteHoldAfter), 0)
+	hold := c.GetDuration("tun.write_errors.hold", defaultTunWriteHold)
+	if hold <= 0 {
+		hold = defaultTunWriteHold
+	}
+
+	f.tunWriteErrors.holdAfter.Store(uint32(holdAfter))
+	f.tunWriteErrors.hold.Store(int64(hold))
+	if !initial {
+		f.l.WithField("holdAfter", holdAfter).WithField("hold", hold).Info("tun.write_errors changed")
+	}
+}
+
+// writeToTun hands packet to the tun device for queue q. hostinfo is the peer that sent the packet, nil if it came
+// from nebula itself.
+func (f *Interface) writeToTun(hostinfo *HostInfo, packet []byte, q int) {
+	if hostinfo != nil {
+		if until := hostinfo.tunHeldUntil.Load(); until != 0 {
+			if time.Now().UnixNano() < until {
+				f.tunWriteErrors.metricHeld.Inc(1)
+				return
+			}
+			// Give the peer another chance
+			hostinfo.tunHeldUntil.Store(0)
+			hostinfo.tunWriteFailures.Store(0)
+		}
+	}
+
+	_, err := f.readers[q].Write(packet)
+	if err == nil {
+		if hostinfo != nil && hostinfo.tunWriteFailures.Load() != 0 {
+			hostinfo.tunWriteFailures.Store(0)
+		}
+		return
+	}
+
+	f.tunWriteFailed(hostinfo, err)
+}
+
+func (f *Interface) tunWriteFailed(hostinfo *HostInfo, err error) {
+	t := f.tunWriteErrors
+	kind := classifyTunWriteError(err)
+	t.metricErrors[kind].Inc(1)
+
+	if hostinfo != nil && kind != tunWriteErrorOther {
+		holdAfter := t.holdAfter.Load()
+		if holdAfter > 0 && hostinfo.tunWriteFailures.Add(1) >= holdAfter {
+			hold := time.Duration(t.hold.Load())
+			hostinfo.tunHeldUntil.Store(time.Now().Add(hold).UnixNano())
+			hostinfo.logger(f.l).WithError(err).
+				WithFields(logrus.Fields{"reason": kind, "failures": holdAfter, "hold": hold}).
+				Warn("Holding back packets from peer, the tun device can not deliver them")
+			f.emitEvent(InterfaceTunWriteFailing)
+			return
+		}
+
+		if f.l.Level >= logrus.DebugLevel {
+			hostinfo.logger(f.l).WithError(err).WithField("reason", kind).Debug("Failed to write to tun")
+		}
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := t.lastLog.Load()
+	if now-last < int64(tunWriteErrorLogInterval) || !t.lastLog.CompareAndSwap(last, now) {
+		t.suppressed.Add(1)
+		return
+	}
+
+	suppressed := t.suppressed.Swap(0)
+	f.l.WithError(err).WithField("reason", kind).WithField("suppressed", suppressed).Error("Failed to write to tun")
+	if suppressed > 0 {
+		f.emitEvent(InterfaceTunWriteFailing)
+	}
+}
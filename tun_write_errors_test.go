@@ -0,0 +1,91 @@
+package nebula
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTun is an inside device whose writes fail with err, and that counts the writes it was given
+type failingTun struct {
+	test.NoopTun
+	err    error
+	writes int
+}
+
+func (t *failingTun) Write(b []byte) (int, error) {
+	t.writes++
+	if t.err != nil {
+		return 0, t.err
+	}
+	return len(b), nil
+}
+
+func Test_classifyTunWriteError(t *testing.T) {
+	assert.Equal(t, tunWriteErrorHostUnreachable, classifyTunWriteError(&os.PathError{Op: "write", Path: "/dev/net/tun", Err: syscall.EHOSTUNREACH}))
+	assert.Equal(t, tunWriteErrorNetUnreachable, classifyTunWriteError(fmt.Errorf("write: %w", syscall.ENETUNREACH)))
+	assert.Equal(t, tunWriteErrorOther, classifyTunWriteError(syscall.EIO))
+}
+
+func TestInterface_writeToTun(t *testing.T) {
+	l := test.NewLogger()
+	tun := &failingTun{err: syscall.EHOSTUNREACH}
+	f := &Interface{l: l, readers: []io.ReadWriteCloser{tun}, tunWriteErrors: newTunWriteErrors()}
+
+	var events []InterfaceEvent
+	f.events.subscribe(func(e InterfaceEvent) { events = append(events, e) })
+
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tun: {write_errors: {hold_after: 3, hold: 1h}}"))
+	f.reloadTunWriteErrors(c)
+
+	hostinfo := &HostInfo{}
+	packet := make([]byte, 20)
+
+	// A success in between starts the count over
+	f.writeToTun(hostinfo, packet, 0)
+	f.writeToTun(hostinfo, packet, 0)
+	tun.err = nil
+	f.writeToTun(hostinfo, packet, 0)
+	assert.Zero(t, hostinfo.tunWriteFailures.Load())
+	assert.Empty(t, events)
+
+	tun.err = syscall.EHOSTUNREACH
+	for range 3 {
+		f.writeToTun(hostinfo, packet, 0)
+	}
+	assert.Equal(t, 6, tun.writes)
+	assert.NotZero(t, hostinfo.tunHeldUntil.Load())
+	assert.Equal(t, []InterfaceEvent{InterfaceTunWriteFailing}, events)
+
+	// Held back packets never reach the tun device
+	f.writeToTun(hostinfo, packet, 0)
+	assert.Equal(t, 6, tun.writes)
+
+	// Until the hold is up
+	hostinfo.tunHeldUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	tun.err = nil
+	f.writeToTun(hostinfo, packet, 0)
+	assert.Equal(t, 7, tun.writes)
+	assert.Zero(t, hostinfo.tunHeldUntil.Load())
+
+	// Other errors and our own packets are never held back, only logged now and then
+	events = nil
+	tun.err = syscall.EIO
+	for range 5 {
+		f.writeToTun(hostinfo, packet, 0)
+		f.writeToTun(nil, packet, 0)
+	}
+	assert.Equal(t, 17, tun.writes)
+	assert.Zero(t, hostinfo.tunHeldUntil.Load())
+	assert.Equal(t, uint64(9), f.tunWriteErrors.suppressed.Load())
+	assert.Empty(t, events)
+}
@@ -23,6 +23,17 @@ type Conn interface {
 	Close() error
 }
 
+// DSCPWriter is implemented by a Conn that can set the DSCP class of individual packets
+type DSCPWriter interface {
+	WriteToDSCP(b []byte, addr netip.AddrPort, dscp uint8) error
+}
+
+// PathMTUConn is implemented by a Conn that can report the path mtu the kernel learned for a remote, writes that do not
+// fit it fail with ErrPacketTooBig
+type PathMTUConn interface {
+	PathMTU(addr netip.AddrPort) (int, error)
+}
+
 type NoopConn struct{}
 
 func (NoopConn) Rebind() error {
@@ -3,3 +3,6 @@ package udp
 import "errors"
 
 var ErrInvalidIPv6RemoteForSocket = errors.New("listener is IPv4, but writing to IPv6 remote")
+
+// ErrPacketTooBig is returned by writes that are larger than the path mtu to the remote and were not fragmented
+var ErrPacketTooBig = errors.New("packet is larger than the path mtu")
@@ -0,0 +1,59 @@
+package udp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// headerOptions are the listen settings for the ip header of every outside packet
+type headerOptions struct {
+	// ttl is the ipv4 ttl and ipv6 hop limit, -1 leaves the system default
+	ttl int
+	// df is the fragmentation policy, one of dont, want, do, probe. Empty leaves the system default
+	df string
+	// tos is the ipv4 tos and ipv6 traffic class, qos marks win over it. -1 leaves the system default
+	tos int
+}
+
+// dfPolicies are the values accepted by listen.df, they follow the IP_MTU_DISCOVER modes of linux
+var dfPolicies = []string{"dont", "want", "do", "probe"}
+
+func parseHeaderOptions(c *config.C) (headerOptions, error) {
+	o := headerOptions{
+		ttl: c.GetInt("listen.ttl", -1),
+		df:  strings.ToLower(c.GetString("listen.df", "")),
+		tos: c.GetInt("listen.tos", -1),
+	}
+
+	if o.ttl != -1 && (o.ttl < 1 || o.ttl > 255) {
+		return o, fmt.Errorf("listen.ttl must be between 1 and 255")
+	}
+
+	if o.tos != -1 && (o.tos < 0 || o.tos > 255) {
+		return o, fmt.Errorf("listen.tos must be between 0 and 255")
+	}
+
+	if o.df != "" {
+		found := false
+		for _, p := range dfPolicies {
+			found = found || p == o.df
+		}
+		if !found {
+			return o, fmt.Errorf("listen.df must be one of %s", strings.Join(dfPolicies, ", "))
+		}
+	}
+
+	return o, nil
+}
+
+// warnHeaderOptionsUnsupported is used by platforms that can not honor listen.ttl, listen.df, and listen.tos
+func warnHeaderOptionsUnsupported(l *logrus.Logger, c *config.C) {
+	for _, k := range []string{"listen.ttl", "listen.df", "listen.tos"} {
+		if c.Get(k) != nil {
+			l.Warnf("%s is only supported on linux and will be ignored", k)
+		}
+	}
+}
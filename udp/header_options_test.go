@@ -0,0 +1,35 @@
+package udp
+
+import (
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseHeaderOptions(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	o, err := parseHeaderOptions(c)
+	require.NoError(t, err)
+	assert.Equal(t, headerOptions{ttl: -1, df: "", tos: -1}, o)
+
+	c.Settings["listen"] = map[string]any{"ttl": 64, "df": "DO", "tos": 184}
+	o, err = parseHeaderOptions(c)
+	require.NoError(t, err)
+	assert.Equal(t, headerOptions{ttl: 64, df: "do", tos: 184}, o)
+
+	c.Settings["listen"] = map[string]any{"ttl": 0}
+	_, err = parseHeaderOptions(c)
+	require.EqualError(t, err, "listen.ttl must be between 1 and 255")
+
+	c.Settings["listen"] = map[string]any{"tos": 256}
+	_, err = parseHeaderOptions(c)
+	require.EqualError(t, err, "listen.tos must be between 0 and 255")
+
+	c.Settings["listen"] = map[string]any{"df": "sometimes"}
+	_, err = parseHeaderOptions(c)
+	require.EqualError(t, err, "listen.df must be one of dont, want, do, probe")
+}
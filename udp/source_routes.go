@@ -0,0 +1,88 @@
+package udp
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// sourceRoute is an entry from listen.routes, it pins traffic to remotes within to onto a local interface, a local
+// source address, or both
+type sourceRoute struct {
+	to     netip.Prefix
+	ifName string
+	src    netip.Addr
+}
+
+// parseSourceRoutes reads listen.routes, a list of `{to: <cidr>, via: <interface or local address>}`. via may be
+// given as a list to set both an interface and a source address.
+func parseSourceRoutes(c *config.C) ([]sourceRoute, error) {
+	r := c.Get("listen.routes")
+	if r == nil {
+		return nil, nil
+	}
+
+	rawRoutes, ok := r.([]any)
+	if !ok {
+		return nil, fmt.Errorf("listen.routes is not an array")
+	}
+
+	routes := make([]sourceRoute, len(rawRoutes))
+	for i, rr := range rawRoutes {
+		m, ok := rr.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("entry %v in listen.routes is invalid", i+1)
+		}
+
+		rTo, ok := m["to"]
+		if !ok {
+			return nil, fmt.Errorf("entry %v.to in listen.routes is not present", i+1)
+		}
+
+		to, err := netip.ParsePrefix(fmt.Sprintf("%v", rTo))
+		if err != nil {
+			return nil, fmt.Errorf("entry %v.to in listen.routes failed to parse: %v", i+1, err)
+		}
+		routes[i].to = to.Masked()
+
+		var vias []any
+		switch v := m["via"].(type) {
+		case nil:
+			return nil, fmt.Errorf("entry %v.via in listen.routes is not present", i+1)
+		case []any:
+			vias = v
+		default:
+			vias = []any{v}
+		}
+
+		for _, v := range vias {
+			sv := fmt.Sprintf("%v", v)
+			if addr, err := netip.ParseAddr(sv); err == nil {
+				if routes[i].src.IsValid() {
+					return nil, fmt.Errorf("entry %v.via in listen.routes has more than one source address", i+1)
+				}
+				routes[i].src = addr.Unmap()
+			} else {
+				if routes[i].ifName != "" {
+					return nil, fmt.Errorf("entry %v.via in listen.routes has more than one interface", i+1)
+				}
+				routes[i].ifName = sv
+			}
+		}
+
+		if routes[i].src.IsValid() && routes[i].src.Is4() != routes[i].to.Addr().Is4() {
+			return nil, fmt.Errorf("entry %v.via in listen.routes is a different address family than %v", i+1, routes[i].to)
+		}
+	}
+
+	return routes, nil
+}
+
+// warnSourceRoutesUnsupported is used by platforms that can not honor listen.routes
+func warnSourceRoutesUnsupported(l *logrus.Logger, c *config.C) {
+	if c.Get("listen.routes") != nil {
+		l.Warn("listen.routes is only supported on linux and will be ignored")
+	}
+}
@@ -0,0 +1,54 @@
+package udp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSourceRoutes(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	// Nothing configured
+	routes, err := parseSourceRoutes(c)
+	require.NoError(t, err)
+	assert.Empty(t, routes)
+
+	c.Settings["listen"] = map[string]any{"routes": "hi"}
+	_, err = parseSourceRoutes(c)
+	require.EqualError(t, err, "listen.routes is not an array")
+
+	c.Settings["listen"] = map[string]any{"routes": []any{map[string]any{"via": "eth0"}}}
+	_, err = parseSourceRoutes(c)
+	require.EqualError(t, err, "entry 1.to in listen.routes is not present")
+
+	c.Settings["listen"] = map[string]any{"routes": []any{map[string]any{"to": "10.0.0.0/8"}}}
+	_, err = parseSourceRoutes(c)
+	require.EqualError(t, err, "entry 1.via in listen.routes is not present")
+
+	c.Settings["listen"] = map[string]any{"routes": []any{map[string]any{"to": "10.0.0.0/8", "via": []any{"eth0", "eth1"}}}}
+	_, err = parseSourceRoutes(c)
+	require.EqualError(t, err, "entry 1.via in listen.routes has more than one interface")
+
+	c.Settings["listen"] = map[string]any{"routes": []any{map[string]any{"to": "10.0.0.0/8", "via": "fd00::1"}}}
+	_, err = parseSourceRoutes(c)
+	require.EqualError(t, err, "entry 1.via in listen.routes is a different address family than 10.0.0.0/8")
+
+	c.Settings["listen"] = map[string]any{"routes": []any{
+		map[string]any{"to": "10.0.0.1/8", "via": "eth1"},
+		map[string]any{"to": "192.168.0.0/16", "via": "192.168.0.5"},
+		map[string]any{"to": "fd00::/8", "via": []any{"wlan0", "fd00::5"}},
+	}}
+	routes, err = parseSourceRoutes(c)
+	require.NoError(t, err)
+	assert.Equal(t, []sourceRoute{
+		{to: netip.MustParsePrefix("10.0.0.0/8"), ifName: "eth1"},
+		{to: netip.MustParsePrefix("192.168.0.0/16"), src: netip.MustParseAddr("192.168.0.5")},
+		{to: netip.MustParsePrefix("fd00::/8"), ifName: "wlan0", src: netip.MustParseAddr("fd00::5")},
+	}, routes)
+}
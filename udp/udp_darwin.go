@@ -158,6 +158,8 @@ func (u *StdConn) LocalAddr() (netip.AddrPort, error) {
 
 func (u *StdConn) ReloadConfig(c *config.C) {
 	// TODO
+	warnSourceRoutesUnsupported(u.l, c)
+	warnHeaderOptionsUnsupported(u.l, c)
 }
 
 func NewUDPStatsEmitter(udpConns []Conn) func() {
@@ -23,6 +23,8 @@ import (
 type GenericConn struct {
 	*net.UDPConn
 	l *logrus.Logger
+	// multi is true when the socket shares its port with the sockets of other routines
+	multi bool
 }
 
 var _ Conn = &GenericConn{}
@@ -34,7 +36,7 @@ func NewGenericListener(l *logrus.Logger, ip netip.Addr, port int, multi bool, b
 		return nil, err
 	}
 	if uc, ok := pc.(*net.UDPConn); ok {
-		return &GenericConn{UDPConn: uc, l: l}, nil
+		return &GenericConn{UDPConn: uc, l: l, multi: multi}, nil
 	}
 	return nil, fmt.Errorf("Unexpected PacketConn: %T %#v", pc, pc)
 }
@@ -61,7 +63,8 @@ func (u *GenericConn) LocalAddr() (netip.AddrPort, error) {
 }
 
 func (u *GenericConn) ReloadConfig(c *config.C) {
-
+	warnSourceRoutesUnsupported(u.l, c)
+	warnHeaderOptionsUnsupported(u.l, c)
 }
 
 func NewUDPStatsEmitter(udpConns []Conn) func() {
@@ -99,5 +102,5 @@ func (u *GenericConn) ListenOut(r EncReader) {
 }
 
 func (u *GenericConn) SupportsMultipleReaders() bool {
-	return false
+	return u.multi
 }
@@ -8,9 +8,12 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
+	"github.com/gaissmai/bart"
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -22,6 +25,15 @@ type StdConn struct {
 	isV4  bool
 	l     *logrus.Logger
 	batch int
+
+	// routesLock guards routes which is the last listen.routes config we loaded
+	routesLock sync.Mutex
+	routes     []sourceRoute
+	// routeTree maps remote networks to the pktinfo control message used when sending to them
+	routeTree atomic.Pointer[bart.Table[[]byte]]
+
+	// pmtuDiscDefault is the IP_MTU_DISCOVER and IPV6_MTU_DISCOVER of the socket before listen.df changed them
+	pmtuDiscDefault []int
 }
 
 func maybeIPV4(ip net.IP) (net.IP, bool) {
@@ -77,6 +89,12 @@ func (u *StdConn) SupportsMultipleReaders() bool {
 }
 
 func (u *StdConn) Rebind() error {
+	// Interfaces may have come and gone, make sure our source routes point at the current interface indexes
+	u.routesLock.Lock()
+	defer u.routesLock.Unlock()
+	if len(u.routes) > 0 {
+		u.routeTree.Store(u.makeRouteTree(u.routes))
+	}
 	return nil
 }
 
@@ -192,6 +210,30 @@ func (u *StdConn) ReadMulti(msgs []rawMessage) (int, error) {
 }
 
 func (u *StdConn) WriteTo(b []byte, ip netip.AddrPort) error {
+	return u.WriteToDSCP(b, ip, 0)
+}
+
+// WriteToDSCP writes b to ip with the dscp class set in the ip header, 0 leaves the socket default in place
+func (u *StdConn) WriteToDSCP(b []byte, ip netip.AddrPort, dscp uint8) error {
+	var oob []byte
+	if t := u.routeTree.Load(); t != nil {
+		oob, _ = t.Lookup(ip.Addr().Unmap())
+	}
+
+	if dscp != 0 {
+		tos := dscpControl(ip.Addr().Unmap().Is4(), dscp)
+		if oob == nil {
+			oob = tos
+		} else {
+			// Never append into the slice held by the route tree
+			oob = append(oob[:len(oob):len(oob)], tos...)
+		}
+	}
+
+	if oob != nil {
+		return u.writeToVia(b, ip, oob)
+	}
+
 	if u.isV4 {
 		return u.writeTo4(b, ip)
 	}
@@ -216,7 +258,7 @@ func (u *StdConn) writeTo6(b []byte, ip netip.AddrPort) error {
 		)
 
 		if err != 0 {
-			return &net.OpError{Op: "sendto", Err: err}
+			return writeError("sendto", err)
 		}
 
 		return nil
@@ -245,14 +287,268 @@ func (u *StdConn) writeTo4(b []byte, ip netip.AddrPort) error {
 		)
 
 		if err != 0 {
-			return &net.OpError{Op: "sendto", Err: err}
+			return writeError("sendto", err)
 		}
 
 		return nil
 	}
 }
 
+// writeError wraps a failed send, EMSGSIZE only happens once listen.path_mtu_discovery stops the kernel from fragmenting
+func writeError(op string, err error) error {
+	if err == unix.EMSGSIZE {
+		return &net.OpError{Op: op, Err: ErrPacketTooBig}
+	}
+	return &net.OpError{Op: op, Err: err}
+}
+
+// PathMTU asks the kernel for the mtu of the route to addr, which includes what it learned from ICMPv6 Packet Too Big
+func (u *StdConn) PathMTU(addr netip.AddrPort) (int, error) {
+	ip := addr.Addr().Unmap()
+	af, level, opt := unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU
+	var sa unix.Sockaddr = &unix.SockaddrInet6{Addr: ip.As16(), Port: int(addr.Port())}
+	if ip.Is4() {
+		af, level, opt = unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU
+		sa = &unix.SockaddrInet4{Addr: ip.As4(), Port: int(addr.Port())}
+	}
+
+	// Only a connected socket can tell us, nothing is ever sent on it
+	fd, err := unix.Socket(af, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open socket: %s", err)
+	}
+	defer unix.Close(fd)
+
+	// Policy routing may depend on our mark
+	if mark, err := u.GetSoMark(); err == nil && mark != 0 {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, mark)
+	}
+
+	if err = unix.Connect(fd, sa); err != nil {
+		return 0, &net.OpError{Op: "connect", Err: err}
+	}
+
+	return unix.GetsockoptInt(fd, level, opt)
+}
+
+// dscpControls holds the IP_TOS and IPV6_TCLASS control messages for every dscp class, ipv4 first
+var dscpControls = func() (c [2][64][]byte) {
+	for i := range c {
+		for dscp := range c[i] {
+			b := make([]byte, unix.CmsgSpace(4))
+			h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+			if i == 0 {
+				h.Level = unix.IPPROTO_IP
+				h.Type = unix.IP_TOS
+			} else {
+				h.Level = unix.IPPROTO_IPV6
+				h.Type = unix.IPV6_TCLASS
+			}
+			h.SetLen(unix.CmsgLen(4))
+			// The low 2 bits are ECN and are left for the kernel
+			*(*int32)(unsafe.Pointer(&b[unix.CmsgLen(0)])) = int32(dscp) << 2
+			c[i][dscp] = b
+		}
+	}
+	return
+}()
+
+// dscpControl returns the control message to mark a packet, the kernel picks the option by the remote's family even
+// on an ipv6 socket
+func dscpControl(isV4 bool, dscp uint8) []byte {
+	if isV4 {
+		return dscpControls[0][dscp&0x3f]
+	}
+	return dscpControls[1][dscp&0x3f]
+}
+
+// writeToVia sends with control messages, like the pktinfo chosen by listen.routes or a dscp class
+func (u *StdConn) writeToVia(b []byte, ip netip.AddrPort, oob []byte) error {
+	var sa unix.Sockaddr
+	if u.isV4 {
+		if !ip.Addr().Is4() {
+			return ErrInvalidIPv6RemoteForSocket
+		}
+		sa = &unix.SockaddrInet4{Addr: ip.Addr().As4(), Port: int(ip.Port())}
+	} else {
+		sa = &unix.SockaddrInet6{Addr: ip.Addr().As16(), Port: int(ip.Port())}
+	}
+
+	if _, err := unix.SendmsgN(u.sysFd, b, oob, sa, 0); err != nil {
+		return writeError("sendmsg", err)
+	}
+
+	return nil
+}
+
+// makeRouteTree resolves interface names and builds the control messages for each route. Routes that can not be
+// used right now are logged and left out, a later Rebind will try them again.
+func (u *StdConn) makeRouteTree(routes []sourceRoute) *bart.Table[[]byte] {
+	routeTree := new(bart.Table[[]byte])
+	for _, r := range routes {
+		if u.isV4 && !r.to.Addr().Is4() {
+			u.l.WithField("to", r.to).Warn("Ignoring listen.routes entry, an ipv6 network can not be reached from an ipv4 listener")
+			continue
+		}
+
+		ifIndex := 0
+		if r.ifName != "" {
+			iface, err := net.InterfaceByName(r.ifName)
+			if err != nil {
+				u.l.WithError(err).WithField("to", r.to).WithField("via", r.ifName).
+					Warn("Ignoring listen.routes entry, the interface could not be found")
+				continue
+			}
+			ifIndex = iface.Index
+		}
+
+		if u.isV4 {
+			info := unix.Inet4Pktinfo{Ifindex: int32(ifIndex)}
+			if r.src.IsValid() {
+				info.Spec_dst = r.src.As4()
+			}
+			routeTree.Insert(r.to, unix.PktInfo4(&info))
+
+		} else {
+			info := unix.Inet6Pktinfo{Ifindex: uint32(ifIndex)}
+			if r.src.IsValid() {
+				info.Addr = r.src.As16()
+			} else if r.to.Addr().Is4() {
+				// The kernel requires a mapped address when sending to ipv4 remotes from an ipv6 socket
+				info.Addr = netip.IPv4Unspecified().As16()
+			}
+			routeTree.Insert(r.to, unix.PktInfo6(&info))
+		}
+	}
+
+	return routeTree
+}
+
+func (u *StdConn) reloadSourceRoutes(c *config.C) {
+	routes, err := parseSourceRoutes(c)
+	if err != nil {
+		u.l.WithError(err).Error("Failed to parse listen.routes")
+		return
+	}
+
+	u.routesLock.Lock()
+	defer u.routesLock.Unlock()
+	u.routes = routes
+	if len(routes) == 0 {
+		u.routeTree.Store(nil)
+		return
+	}
+
+	u.routeTree.Store(u.makeRouteTree(routes))
+	u.l.WithField("routes", len(routes)).Info("listen.routes was set")
+}
+
+// reloadIPv6Options applies the listen options that only mean something to an ipv6 socket
+func (u *StdConn) reloadIPv6Options(c *config.C) {
+	if u.isV4 {
+		return
+	}
+
+	// Without fragmenting, writes that do not fit the path learned from ICMPv6 Packet Too Big fail so we can tell
+	// the inside sender to use smaller packets
+	pmtud := c.GetBool("listen.path_mtu_discovery", false)
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, boolInt(pmtud)); err != nil {
+		u.l.WithError(err).Error("Failed to set listen.path_mtu_discovery")
+	} else if pmtud {
+		u.l.Info("listen.path_mtu_discovery was set")
+	}
+
+	// The kernel derives the label from the addresses and ports, so every packet of a tunnel carries the same one
+	// and underlay routers hashing on it keep the tunnel on one path
+	labels := c.GetBool("listen.flow_labels", true)
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL, boolInt(labels)); err != nil {
+		u.l.WithError(err).Warn("Failed to set listen.flow_labels")
+	}
+}
+
+// pmtuDiscModes maps listen.df to IP_MTU_DISCOVER, the IPV6_MTU_DISCOVER values are the same
+var pmtuDiscModes = map[string]int{
+	"dont":  unix.IP_PMTUDISC_DONT,
+	"want":  unix.IP_PMTUDISC_WANT,
+	"do":    unix.IP_PMTUDISC_DO,
+	"probe": unix.IP_PMTUDISC_PROBE,
+}
+
+// reloadHeaderOptions applies listen.ttl, listen.df, and listen.tos. An ipv6 socket gets both the ipv4 and ipv6
+// options since it also carries ipv4 remotes.
+func (u *StdConn) reloadHeaderOptions(c *config.C) {
+	o, err := parseHeaderOptions(c)
+	if err != nil {
+		u.l.WithError(err).Error("Failed to load the listen header options, keeping the previous ones")
+		return
+	}
+
+	// -1 puts the system default back for everything but IP_TOS, where the default is 0
+	ipTos := max(o.tos, 0)
+	if err := u.setIPOption(unix.IP_TTL, unix.IPV6_UNICAST_HOPS, o.ttl, o.ttl); err != nil {
+		u.l.WithError(err).Error("Failed to set listen.ttl")
+	} else if o.ttl != -1 {
+		u.l.WithField("ttl", o.ttl).Info("listen.ttl was set")
+	}
+
+	if err := u.setIPOption(unix.IP_TOS, unix.IPV6_TCLASS, ipTos, o.tos); err != nil {
+		u.l.WithError(err).Error("Failed to set listen.tos")
+	} else if o.tos != -1 {
+		u.l.WithField("tos", o.tos).Info("listen.tos was set")
+	}
+
+	if o.df == "" && u.pmtuDiscDefault == nil {
+		return
+	}
+
+	// Remember what the kernel picked so unsetting listen.df can put it back
+	if u.pmtuDiscDefault == nil {
+		v4, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		v6 := v4
+		if err == nil && !u.isV4 {
+			v6, err = unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+		}
+		if err != nil {
+			u.l.WithError(err).Error("Failed to get listen.df")
+			return
+		}
+		u.pmtuDiscDefault = []int{v4, v6}
+	}
+
+	v4, v6 := u.pmtuDiscDefault[0], u.pmtuDiscDefault[1]
+	if o.df != "" {
+		v4, v6 = pmtuDiscModes[o.df], pmtuDiscModes[o.df]
+	}
+	if err := u.setIPOption(unix.IP_MTU_DISCOVER, unix.IPV6_MTU_DISCOVER, v4, v6); err != nil {
+		u.l.WithError(err).Error("Failed to set listen.df")
+	} else if o.df != "" {
+		u.l.WithField("df", o.df).Info("listen.df was set")
+	}
+}
+
+// setIPOption sets the ipv4 option and, on an ipv6 socket, the ipv6 one too
+func (u *StdConn) setIPOption(v4Opt, v6Opt, v4, v6 int) error {
+	if err := unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IP, v4Opt, v4); err != nil {
+		return err
+	}
+	if u.isV4 {
+		return nil
+	}
+	return unix.SetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, v6Opt, v6)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (u *StdConn) ReloadConfig(c *config.C) {
+	u.reloadSourceRoutes(c)
+	u.reloadIPv6Options(c)
+	u.reloadHeaderOptions(c)
+
 	b := c.GetInt("listen.read_buffer", 0)
 	if b > 0 {
 		err := u.SetRecvBuffer(b)
@@ -313,11 +609,16 @@ func (u *StdConn) Close() error {
 	return syscall.Close(u.sysFd)
 }
 
+// memInfoConn is a Conn that can report its socket memory, StdConn and the XDPConn wrapping one
+type memInfoConn interface {
+	getMemInfo(meminfo *[unix.SK_MEMINFO_VARS]uint32) error
+}
+
 func NewUDPStatsEmitter(udpConns []Conn) func() {
 	// Check if our kernel supports SO_MEMINFO before registering the gauges
 	var udpGauges [][unix.SK_MEMINFO_VARS]metrics.Gauge
 	var meminfo [unix.SK_MEMINFO_VARS]uint32
-	if err := udpConns[0].(*StdConn).getMemInfo(&meminfo); err == nil {
+	if err := udpConns[0].(memInfoConn).getMemInfo(&meminfo); err == nil {
 		udpGauges = make([][unix.SK_MEMINFO_VARS]metrics.Gauge, len(udpConns))
 		for i := range udpConns {
 			udpGauges[i] = [unix.SK_MEMINFO_VARS]metrics.Gauge{
@@ -336,7 +637,7 @@ func NewUDPStatsEmitter(udpConns []Conn) func() {
 
 	return func() {
 		for i, gauges := range udpGauges {
-			if err := udpConns[i].(*StdConn).getMemInfo(&meminfo); err == nil {
+			if err := udpConns[i].(memInfoConn).getMemInfo(&meminfo); err == nil {
 				for j := 0; j < unix.SK_MEMINFO_VARS; j++ {
 					gauges[j].Update(int64(meminfo[j]))
 				}
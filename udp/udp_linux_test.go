@@ -0,0 +1,101 @@
+//go:build !android && !e2e_testing
+// +build !android,!e2e_testing
+
+package udp
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestStdConn_ipv6Options(t *testing.T) {
+	l := test.NewLogger()
+	conn, err := NewListener(l, netip.IPv6Loopback(), 0, false, 1)
+	if err != nil {
+		t.Skipf("no ipv6 here: %s", err)
+	}
+	defer conn.Close()
+	u := conn.(*StdConn)
+
+	c := config.NewC(l)
+	u.ReloadConfig(c)
+	v, err := unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG)
+	require.NoError(t, err)
+	assert.Equal(t, 0, v)
+	v, err = unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL)
+	require.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	c.Settings["listen"] = map[string]any{"path_mtu_discovery": true, "flow_labels": false}
+	u.ReloadConfig(c)
+	v, err = unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG)
+	require.NoError(t, err)
+	assert.Equal(t, 1, v)
+	v, err = unix.GetsockoptInt(u.sysFd, unix.IPPROTO_IPV6, unix.IPV6_AUTOFLOWLABEL)
+	require.NoError(t, err)
+	assert.Equal(t, 0, v)
+
+	// Loopback has a large mtu, the kernel learned nothing smaller
+	addr, err := u.LocalAddr()
+	require.NoError(t, err)
+	mtu, err := u.PathMTU(addr)
+	require.NoError(t, err)
+	assert.Greater(t, mtu, 1280)
+}
+
+func TestStdConn_reloadHeaderOptions(t *testing.T) {
+	l := test.NewLogger()
+	for _, ip := range []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.IPv6Loopback()} {
+		conn, err := NewListener(l, ip, 0, false, 1)
+		if err != nil {
+			t.Logf("skipping %s: %s", ip, err)
+			continue
+		}
+		u := conn.(*StdConn)
+		get := func(level, opt int) int {
+			v, err := unix.GetsockoptInt(u.sysFd, level, opt)
+			require.NoError(t, err)
+			return v
+		}
+
+		c := config.NewC(l)
+		u.ReloadConfig(c)
+		pmtuDisc := get(unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		assert.Nil(t, u.pmtuDiscDefault)
+
+		c.Settings["listen"] = map[string]any{"ttl": 7, "df": "dont", "tos": 0xb8}
+		u.ReloadConfig(c)
+		assert.Equal(t, 7, get(unix.IPPROTO_IP, unix.IP_TTL))
+		assert.Equal(t, unix.IP_PMTUDISC_DONT, get(unix.IPPROTO_IP, unix.IP_MTU_DISCOVER))
+		assert.Equal(t, 0xb8, get(unix.IPPROTO_IP, unix.IP_TOS))
+		if ip.Is6() {
+			assert.Equal(t, 7, get(unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS))
+			assert.Equal(t, unix.IP_PMTUDISC_DONT, get(unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER))
+			assert.Equal(t, 0xb8, get(unix.IPPROTO_IPV6, unix.IPV6_TCLASS))
+		}
+
+		// Unsetting them puts the defaults back
+		c.Settings["listen"] = map[string]any{}
+		u.ReloadConfig(c)
+		assert.NotEqual(t, 7, get(unix.IPPROTO_IP, unix.IP_TTL))
+		assert.Equal(t, pmtuDisc, get(unix.IPPROTO_IP, unix.IP_MTU_DISCOVER))
+		assert.Equal(t, 0, get(unix.IPPROTO_IP, unix.IP_TOS))
+		if ip.Is6() {
+			assert.NotEqual(t, 7, get(unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS))
+			assert.Equal(t, 0, get(unix.IPPROTO_IPV6, unix.IPV6_TCLASS))
+		}
+
+		// Bad values leave the socket alone
+		c.Settings["listen"] = map[string]any{"ttl": 7, "df": "nope"}
+		u.ReloadConfig(c)
+		assert.NotEqual(t, 7, get(unix.IPPROTO_IP, unix.IP_TTL))
+
+		require.NoError(t, conn.Close())
+	}
+}
@@ -336,7 +336,10 @@ func (u *RIOConn) Rebind() error {
 	return nil
 }
 
-func (u *RIOConn) ReloadConfig(*config.C) {}
+func (u *RIOConn) ReloadConfig(c *config.C) {
+	warnSourceRoutesUnsupported(u.l, c)
+	warnHeaderOptionsUnsupported(u.l, c)
+}
 
 func (u *RIOConn) Close() error {
 	if !u.isOpen.CompareAndSwap(true, false) {
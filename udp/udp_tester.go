@@ -5,8 +5,11 @@ package udp
 
 import (
 	"io"
+	"math/rand"
 	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/config"
@@ -36,19 +39,127 @@ type TesterConn struct {
 	RxPackets chan *Packet // Packets to receive into nebula
 	TxPackets chan *Packet // Packets transmitted outside by nebula
 
+	impairLock  sync.Mutex
+	impairments map[netip.AddrPort]*impairedLink
+
 	closed atomic.Bool
 	l      *logrus.Logger
 }
 
+// Impairment degrades the packets written by a TesterConn to simulate a poor network. Chances are from 0 to 1.
+type Impairment struct {
+	// Loss is the chance a packet is dropped
+	Loss float64
+	// Duplicate is the chance a packet is sent twice
+	Duplicate float64
+	// Reorder is the chance a packet is held back and sent after the next packet on the link
+	Reorder float64
+	// Latency is how long a packet takes to show up on TxPackets, order is kept
+	Latency time.Duration
+	// Seed seeds the random source so a test sees the same decisions on every run
+	Seed int64
+}
+
+type impairedLink struct {
+	Impairment
+	rand    *rand.Rand
+	held    *Packet
+	delayed chan delayedPacket
+}
+
+type delayedPacket struct {
+	at time.Time
+	p  *Packet
+}
+
 func NewListener(l *logrus.Logger, ip netip.Addr, port int, _ bool, _ int) (Conn, error) {
 	return &TesterConn{
-		Addr:      netip.AddrPortFrom(ip, uint16(port)),
-		RxPackets: make(chan *Packet, 10),
-		TxPackets: make(chan *Packet, 10),
-		l:         l,
+		Addr:        netip.AddrPortFrom(ip, uint16(port)),
+		RxPackets:   make(chan *Packet, 10),
+		TxPackets:   make(chan *Packet, 10),
+		impairments: make(map[netip.AddrPort]*impairedLink),
+		l:           l,
 	}, nil
 }
 
+// Impair degrades all future packets written to the to address, an invalid address applies to every destination
+// without its own impairment. A zero Impairment restores the link.
+func (u *TesterConn) Impair(to netip.AddrPort, i Impairment) {
+	u.impairLock.Lock()
+	defer u.impairLock.Unlock()
+
+	if old, ok := u.impairments[to]; ok {
+		if old.held != nil {
+			u.transmit(old, old.held)
+		}
+		if old.delayed != nil {
+			close(old.delayed)
+		}
+		delete(u.impairments, to)
+	}
+
+	if i == (Impairment{}) {
+		return
+	}
+
+	link := &impairedLink{Impairment: i, rand: rand.New(rand.NewSource(i.Seed))}
+	if i.Latency > 0 {
+		link.delayed = make(chan delayedPacket, 1024)
+		go u.releaseDelayed(link.delayed)
+	}
+	u.impairments[to] = link
+}
+
+// impair applies any impairment for p's destination, the caller must hold impairLock
+func (u *TesterConn) impair(p *Packet) {
+	link, ok := u.impairments[p.To]
+	if !ok {
+		link, ok = u.impairments[netip.AddrPort{}]
+	}
+	if !ok {
+		u.TxPackets <- p
+		return
+	}
+
+	if link.Loss > 0 && link.rand.Float64() < link.Loss {
+		return
+	}
+
+	if link.held == nil && link.Reorder > 0 && link.rand.Float64() < link.Reorder {
+		link.held = p
+		return
+	}
+
+	u.transmit(link, p)
+	if link.Duplicate > 0 && link.rand.Float64() < link.Duplicate {
+		u.transmit(link, p.Copy())
+	}
+
+	if link.held != nil {
+		u.transmit(link, link.held)
+		link.held = nil
+	}
+}
+
+func (u *TesterConn) transmit(link *impairedLink, p *Packet) {
+	if link.delayed != nil {
+		link.delayed <- delayedPacket{at: time.Now().Add(link.Latency), p: p}
+		return
+	}
+
+	u.TxPackets <- p
+}
+
+func (u *TesterConn) releaseDelayed(delayed chan delayedPacket) {
+	for d := range delayed {
+		time.Sleep(time.Until(d.at))
+		if u.closed.Load() {
+			return
+		}
+		u.TxPackets <- d.p
+	}
+}
+
 // Send will place a UdpPacket onto the receive queue for nebula to consume
 // this is an encrypted packet or a handshake message in most cases
 // packets were transmitted from another nebula node, you can send them with Tun.Send
@@ -102,7 +213,9 @@ func (u *TesterConn) WriteTo(b []byte, addr netip.AddrPort) error {
 	}
 
 	copy(p.Data, b)
-	u.TxPackets <- p
+	u.impairLock.Lock()
+	u.impair(p)
+	u.impairLock.Unlock()
 	return nil
 }
 
@@ -0,0 +1,304 @@
+//go:build linux && !android && !e2e_testing
+// +build linux,!android,!e2e_testing
+
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// xdpProgram is the xdp program steering our udp port into the AF_XDP sockets of an interface. Every XDPConn on the
+// interface shares it, the last one to close detaches it.
+type xdpProgram struct {
+	link    netlink.Link
+	port    uint16
+	generic bool
+	progFd  int
+	mapFd   int
+	refs    int
+}
+
+var (
+	xdpProgramsLock sync.Mutex
+	xdpPrograms     = map[int]*xdpProgram{}
+)
+
+// xdpMaxQueues bounds the rx queues that can be redirected, packets on higher queues are passed to the kernel socket
+const xdpMaxQueues = 256
+
+// acquireXDPProgram attaches the program for port to link, or returns the one already attached
+func acquireXDPProgram(link netlink.Link, port uint16, generic bool) (*xdpProgram, error) {
+	xdpProgramsLock.Lock()
+	defer xdpProgramsLock.Unlock()
+
+	ifindex := link.Attrs().Index
+	if p, ok := xdpPrograms[ifindex]; ok {
+		if p.port != port || p.generic != generic {
+			return nil, fmt.Errorf("xdp program on %s is already attached for port %d", link.Attrs().Name, p.port)
+		}
+		p.refs++
+		return p, nil
+	}
+
+	mapFd, err := bpfMapCreate(unix.BPF_MAP_TYPE_XSKMAP, 4, 4, xdpMaxQueues)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create xskmap: %w", err)
+	}
+
+	progFd, err := bpfProgLoad(unix.BPF_PROG_TYPE_XDP, xdpRedirectProgram(mapFd, port))
+	if err != nil {
+		unix.Close(mapFd)
+		return nil, err
+	}
+
+	flags := unix.XDP_FLAGS_DRV_MODE
+	if generic {
+		flags = unix.XDP_FLAGS_SKB_MODE
+	}
+
+	// Never replace a program someone else attached
+	if err := netlink.LinkSetXdpFdWithFlags(link, progFd, flags|unix.XDP_FLAGS_UPDATE_IF_NOEXIST); err != nil {
+		unix.Close(progFd)
+		unix.Close(mapFd)
+		return nil, fmt.Errorf("failed to attach xdp program to %s: %w", link.Attrs().Name, err)
+	}
+
+	p := &xdpProgram{link: link, port: port, generic: generic, progFd: progFd, mapFd: mapFd, refs: 1}
+	xdpPrograms[ifindex] = p
+	return p, nil
+}
+
+// setSocket redirects the packets arriving on queue to the AF_XDP socket fd
+func (p *xdpProgram) setSocket(queue int, fd int) error {
+	key, value := uint32(queue), uint32(fd)
+	return bpfMapUpdate(p.mapFd, unsafe.Pointer(&key), unsafe.Pointer(&value))
+}
+
+func (p *xdpProgram) release() error {
+	xdpProgramsLock.Lock()
+	defer xdpProgramsLock.Unlock()
+
+	p.refs--
+	if p.refs > 0 {
+		return nil
+	}
+
+	delete(xdpPrograms, p.link.Attrs().Index)
+	flags := unix.XDP_FLAGS_DRV_MODE
+	if p.generic {
+		flags = unix.XDP_FLAGS_SKB_MODE
+	}
+
+	err := netlink.LinkSetXdpFdWithFlags(p.link, -1, flags)
+	unix.Close(p.progFd)
+	unix.Close(p.mapFd)
+	return err
+}
+
+// bpfInsn is struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+const (
+	bpfLdxW     = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfLdxH     = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_H
+	bpfLdxB     = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_B
+	bpfLdImm64  = unix.BPF_LD | unix.BPF_IMM | unix.BPF_DW
+	bpfMovReg   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	bpfMovImm   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	bpfAddImm   = unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_K
+	bpfAndImm   = unix.BPF_ALU64 | unix.BPF_AND | unix.BPF_K
+	bpfJgtReg   = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_X
+	bpfJeqImm   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJneImm   = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	bpfJa       = unix.BPF_JMP | unix.BPF_JA
+	bpfCall     = unix.BPF_JMP | unix.BPF_CALL
+	bpfExit     = unix.BPF_JMP | unix.BPF_EXIT
+	bpfRedirMap = 51 // BPF_FUNC_redirect_map
+	xdpPass     = 2  // XDP_PASS
+)
+
+// xdpRedirectProgram assembles the xdp program, which is this C with the map and port filled in
+//
+//	struct ethhdr *eth = data;
+//	if (eth + 1 > data_end) return XDP_PASS;
+//	if (eth->h_proto == htons(ETH_P_IP)) {
+//		struct iphdr *ip = eth + 1; struct udphdr *udp = ip + 1;
+//		if (udp + 1 > data_end || ip->ihl != 5 || ip->version != 4 || ip->protocol != IPPROTO_UDP) return XDP_PASS;
+//		if (ip->frag_off & htons(IP_MF | IP_OFFSET)) return XDP_PASS;
+//		if (udp->dest != htons(port)) return XDP_PASS;
+//	} else if (eth->h_proto == htons(ETH_P_IPV6)) {
+//		struct ipv6hdr *ip6 = eth + 1; struct udphdr *udp = ip6 + 1;
+//		if (udp + 1 > data_end || ip6->nexthdr != IPPROTO_UDP || udp->dest != htons(port)) return XDP_PASS;
+//	} else {
+//		return XDP_PASS;
+//	}
+//	return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+//
+// Packets are loaded as they are in memory so every constant is compared in network byte order.
+func xdpRedirectProgram(mapFd int, port uint16) []bpfInsn {
+	be16 := func(v uint16) int32 {
+		return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+	}
+
+	// Registers: r1 ctx, r2 data, r3 data_end, r4 bounds scratch, r5 loaded fields, r6 saved ctx
+	const (
+		pass = iota + 1
+		ipv4
+		redirect
+	)
+
+	type jump struct {
+		insn  bpfInsn
+		label int
+	}
+	var prog []jump
+	labels := map[int]int{}
+	emit := func(code uint8, dst, src uint8, off int16, imm int32) {
+		prog = append(prog, jump{insn: bpfInsn{code: code, regs: bpfRegs(dst, src), off: off, imm: imm}})
+	}
+	jmp := func(code uint8, dst, src uint8, imm int32, label int) {
+		prog = append(prog, jump{insn: bpfInsn{code: code, regs: bpfRegs(dst, src), imm: imm}, label: label})
+	}
+	mark := func(label int) {
+		labels[label] = len(prog)
+	}
+
+	emit(bpfMovReg, 6, 1, 0, 0)
+	emit(bpfLdxW, 2, 6, 0, 0)
+	emit(bpfLdxW, 3, 6, 4, 0)
+	emit(bpfMovReg, 4, 2, 0, 0)
+	emit(bpfAddImm, 4, 0, 0, ethHeaderLen)
+	jmp(bpfJgtReg, 4, 3, 0, pass)
+	emit(bpfLdxH, 5, 2, 12, 0)
+	jmp(bpfJeqImm, 5, 0, be16(etherTypeIPv4), ipv4)
+	jmp(bpfJneImm, 5, 0, be16(etherTypeIPv6), pass)
+
+	emit(bpfMovReg, 4, 2, 0, 0)
+	emit(bpfAddImm, 4, 0, 0, ethHeaderLen+ipv6HeaderLen+udpHeaderLen)
+	jmp(bpfJgtReg, 4, 3, 0, pass)
+	emit(bpfLdxB, 5, 2, ethHeaderLen+6, 0)
+	jmp(bpfJneImm, 5, 0, protoUDP, pass)
+	emit(bpfLdxH, 5, 2, ethHeaderLen+ipv6HeaderLen+2, 0)
+	jmp(bpfJneImm, 5, 0, be16(port), pass)
+	jmp(bpfJa, 0, 0, 0, redirect)
+
+	mark(ipv4)
+	emit(bpfMovReg, 4, 2, 0, 0)
+	emit(bpfAddImm, 4, 0, 0, ethHeaderLen+ipv4HeaderLen+udpHeaderLen)
+	jmp(bpfJgtReg, 4, 3, 0, pass)
+	emit(bpfLdxB, 5, 2, ethHeaderLen, 0)
+	jmp(bpfJneImm, 5, 0, 0x45, pass)
+	emit(bpfLdxB, 5, 2, ethHeaderLen+9, 0)
+	jmp(bpfJneImm, 5, 0, protoUDP, pass)
+	emit(bpfLdxH, 5, 2, ethHeaderLen+6, 0)
+	emit(bpfAndImm, 5, 0, 0, be16(0x3fff))
+	jmp(bpfJneImm, 5, 0, 0, pass)
+	emit(bpfLdxH, 5, 2, ethHeaderLen+ipv4HeaderLen+2, 0)
+	jmp(bpfJneImm, 5, 0, be16(port), pass)
+
+	mark(redirect)
+	emit(bpfLdxW, 2, 6, 16, 0)
+	emit(bpfLdImm64, 1, unix.BPF_PSEUDO_MAP_FD, 0, int32(mapFd))
+	emit(0, 0, 0, 0, 0)
+	emit(bpfMovImm, 3, 0, 0, xdpPass)
+	emit(bpfCall, 0, 0, 0, bpfRedirMap)
+	emit(bpfExit, 0, 0, 0, 0)
+
+	mark(pass)
+	emit(bpfMovImm, 0, 0, 0, xdpPass)
+	emit(bpfExit, 0, 0, 0, 0)
+
+	insns := make([]bpfInsn, len(prog))
+	for i, j := range prog {
+		insns[i] = j.insn
+		if j.label != 0 {
+			insns[i].off = int16(labels[j.label] - i - 1)
+		}
+	}
+	return insns
+}
+
+// bpfRegs packs the dst and src register nibbles the way the kernel bitfield lays them out
+func bpfRegs(dst, src uint8) uint8 {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) == 1 {
+		return dst | src<<4
+	}
+	return dst<<4 | src
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{mapType, keySize, valueSize, maxEntries, 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(mapFd int, key, value unsafe.Pointer) error {
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(mapFd), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func bpfProgLoad(progType uint32, insns []bpfInsn) (int, error) {
+	license := []byte("Dual MIT/GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: progType,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load xdp program: %w: %s", err, unix.ByteSliceToString(logBuf))
+	}
+	return fd, nil
+}
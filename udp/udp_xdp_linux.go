@@ -0,0 +1,498 @@
+//go:build linux && !android && !e2e_testing
+// +build linux,!android,!e2e_testing
+
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// xdpFrameSize is the size of each umem frame, nebula packets never get close
+	xdpFrameSize = 4096
+	// xdpBatch is how many frames we take from the rx ring at once
+	xdpBatch = 64
+	// xdpMaxNeighbors bounds the learned remote macs, the table is thrown away when it fills up
+	xdpMaxNeighbors = 1 << 16
+)
+
+// XDPConn moves udp packets through an AF_XDP socket bound to one rx queue of an interface. It wraps the regular kernel
+// socket, which keeps owning the port, receives what the xdp program does not redirect, and sends whatever we can not
+// build a frame for.
+//
+// Frames are sent to the mac address the remote last sent from, so until we hear from a remote, and for remotes on
+// another address family than ours, packets go through the kernel.
+type XDPConn struct {
+	*StdConn
+	l     *logrus.Logger
+	fd    int
+	queue int
+	prog  *xdpProgram
+
+	mac  [6]byte
+	src4 netip.Addr
+	src6 netip.Addr
+	port uint16
+
+	umem       []byte
+	rxFrames   int
+	fill, comp xdpRing
+	rx, tx     xdpRing
+
+	// txLock guards the tx and completion rings and txFree, the frames not in flight
+	txLock sync.Mutex
+	txFree []uint64
+
+	neighborsLock sync.RWMutex
+	neighbors     map[netip.Addr][6]byte
+
+	// readLock is held by ListenOut so Close does not unmap the rings out from under it
+	readLock sync.Mutex
+	closed   atomic.Bool
+}
+
+// xdpRing is one of the four rings shared with the kernel. We own the producer of the fill and tx rings and the
+// consumer of the rx and completion rings.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	flags    *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Add(r.descs, uintptr(i&r.mask)*8))
+}
+
+func (r *xdpRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Add(r.descs, uintptr(i&r.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+func (r *xdpRing) needsWakeup() bool {
+	return atomic.LoadUint32(r.flags)&unix.XDP_RING_NEED_WAKEUP != 0
+}
+
+// NewXDPListener opens the kernel socket like NewListener does and then binds an AF_XDP socket to queue xc.Queue+routine
+// of xc.Interface. The xdp program is attached to the interface by the first listener and redirects every udp packet to
+// our port, whatever its destination address.
+func NewXDPListener(l *logrus.Logger, ip netip.Addr, port int, multi bool, batch int, xc *XDPConfig, routine int) (Conn, error) {
+	c, err := NewListener(l, ip, port, multi, batch)
+	if err != nil {
+		return nil, err
+	}
+	std := c.(*StdConn)
+
+	x, err := newXDPConn(l, std, ip, xc, xc.Queue+routine)
+	if err != nil {
+		std.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+func newXDPConn(l *logrus.Logger, std *StdConn, ip netip.Addr, xc *XDPConfig, queue int) (*XDPConn, error) {
+	if queue >= xdpMaxQueues {
+		return nil, fmt.Errorf("xdp queue %d is too high, at most %d queues can be used", queue, xdpMaxQueues)
+	}
+
+	local, err := std.LocalAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	iface, err := net.InterfaceByName(xc.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find xdp interface %s: %w", xc.Interface, err)
+	}
+
+	if len(iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("xdp interface %s is not an ethernet interface", xc.Interface)
+	}
+
+	x := &XDPConn{
+		StdConn:   std,
+		l:         l,
+		fd:        -1,
+		queue:     queue,
+		mac:       [6]byte(iface.HardwareAddr),
+		port:      local.Port(),
+		rxFrames:  xc.Frames / 2,
+		neighbors: map[netip.Addr][6]byte{},
+	}
+
+	if err := x.pickSources(iface, ip); err != nil {
+		return nil, err
+	}
+
+	if err := x.open(iface.Index, xc); err != nil {
+		x.unmap()
+		if x.fd >= 0 {
+			unix.Close(x.fd)
+		}
+		return nil, err
+	}
+
+	link, err := netlink.LinkByIndex(iface.Index)
+	if err == nil {
+		x.prog, err = acquireXDPProgram(link, x.port, xc.Generic)
+	}
+	if err == nil {
+		err = x.prog.setSocket(queue, x.fd)
+		if err != nil {
+			x.prog.release()
+		}
+	}
+	if err != nil {
+		x.unmap()
+		unix.Close(x.fd)
+		return nil, err
+	}
+
+	return x, nil
+}
+
+// pickSources decides the addresses we send from, the listen host if one is set or the first usable address of each
+// family on the interface.
+func (x *XDPConn) pickSources(iface *net.Interface, ip netip.Addr) error {
+	if !ip.IsUnspecified() {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			x.src4 = ip
+		} else {
+			x.src6 = ip
+		}
+		return nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("failed to get the addresses of xdp interface %s: %w", iface.Name, err)
+	}
+
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		switch {
+		case addr.Is4() && !x.src4.IsValid():
+			x.src4 = addr
+		case addr.Is6() && addr.IsGlobalUnicast() && !x.src6.IsValid():
+			x.src6 = addr
+		}
+	}
+
+	if !x.src4.IsValid() && !x.src6.IsValid() {
+		return fmt.Errorf("xdp interface %s has no addresses to send from", iface.Name)
+	}
+	return nil
+}
+
+func (x *XDPConn) open(ifindex int, xc *XDPConfig) error {
+	syscall.ForkLock.RLock()
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return fmt.Errorf("unable to open AF_XDP socket: %w", err)
+	}
+	x.fd = fd
+
+	x.umem, err = unix.Mmap(-1, 0, xc.Frames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("failed to allocate xdp umem: %w", err)
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&x.umem[0]))),
+		Len:  uint64(len(x.umem)),
+		Size: xdpFrameSize,
+	}
+	if err := setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("failed to register xdp umem: %w", err)
+	}
+
+	ringSize := x.rxFrames
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING, unix.XDP_TX_RING} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_XDP, opt, ringSize); err != nil {
+			return fmt.Errorf("failed to size xdp rings: %w", err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to get xdp ring offsets: %w", errno)
+	}
+
+	if x.fill, err = mmapRing(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, ringSize, 8); err != nil {
+		return err
+	}
+	if x.comp, err = mmapRing(fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, ringSize, 8); err != nil {
+		return err
+	}
+	if x.rx, err = mmapRing(fd, unix.XDP_PGOFF_RX_RING, off.Rx, ringSize, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return err
+	}
+	if x.tx, err = mmapRing(fd, unix.XDP_PGOFF_TX_RING, off.Tx, ringSize, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return err
+	}
+
+	// The first half of the frames are for receiving and all start out in the fill ring, the rest are for sending
+	for i := 0; i < x.rxFrames; i++ {
+		*x.fill.addr(uint32(i)) = uint64(i * xdpFrameSize)
+	}
+	atomic.StoreUint32(x.fill.producer, uint32(x.rxFrames))
+
+	x.txFree = make([]uint64, 0, xc.Frames-x.rxFrames)
+	for i := x.rxFrames; i < xc.Frames; i++ {
+		x.txFree = append(x.txFree, uint64(i*xdpFrameSize))
+	}
+
+	sa := &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(x.queue)}
+	if xc.ZeroCopy {
+		sa.Flags = unix.XDP_ZEROCOPY | unix.XDP_USE_NEED_WAKEUP
+		if err = unix.Bind(fd, sa); err == nil {
+			x.l.WithField("interface", xc.Interface).WithField("queue", x.queue).Info("Bound zero copy AF_XDP socket")
+			return nil
+		}
+		x.l.WithError(err).WithField("interface", xc.Interface).WithField("queue", x.queue).
+			Warn("Zero copy AF_XDP is not supported, falling back to copy mode")
+	}
+
+	sa.Flags = unix.XDP_COPY | unix.XDP_USE_NEED_WAKEUP
+	if err = unix.Bind(fd, sa); err != nil {
+		return fmt.Errorf("failed to bind AF_XDP socket to %s queue %d: %w", xc.Interface, x.queue, err)
+	}
+
+	x.l.WithField("interface", xc.Interface).WithField("queue", x.queue).Info("Bound AF_XDP socket")
+	return nil
+}
+
+func setsockopt(fd int, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func mmapRing(fd int, pgoff int64, off unix.XDPRingOffset, n int, descSize int) (xdpRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+n*descSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xdpRing{}, fmt.Errorf("failed to map xdp ring: %w", err)
+	}
+
+	base := unsafe.Pointer(&mem[0])
+	return xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Add(base, off.Producer)),
+		consumer: (*uint32)(unsafe.Add(base, off.Consumer)),
+		flags:    (*uint32)(unsafe.Add(base, off.Flags)),
+		descs:    unsafe.Add(base, off.Desc),
+		mask:     uint32(n - 1),
+	}, nil
+}
+
+func (x *XDPConn) unmap() {
+	for _, r := range []*xdpRing{&x.fill, &x.comp, &x.rx, &x.tx} {
+		if r.mem != nil {
+			unix.Munmap(r.mem)
+			r.mem = nil
+		}
+	}
+	if x.umem != nil {
+		unix.Munmap(x.umem)
+		x.umem = nil
+	}
+}
+
+// ListenOut reads the AF_XDP socket and, from another goroutine, the kernel socket. r is never called concurrently.
+func (x *XDPConn) ListenOut(r EncReader) {
+	var lock sync.Mutex
+	go x.StdConn.ListenOut(func(addr netip.AddrPort, payload []byte) {
+		lock.Lock()
+		r(addr, payload)
+		lock.Unlock()
+	})
+
+	x.readLock.Lock()
+	defer x.readLock.Unlock()
+
+	pfd := []unix.PollFd{{Fd: int32(x.fd), Events: unix.POLLIN}}
+	var addrs [xdpBatch]uint64
+	cons := atomic.LoadUint32(x.rx.consumer)
+	for !x.closed.Load() {
+		n := atomic.LoadUint32(x.rx.producer) - cons
+		if n == 0 {
+			// A short timeout so we notice Close
+			_, err := unix.Poll(pfd, 1000)
+			if err != nil && !errors.Is(err, unix.EINTR) {
+				x.l.WithError(err).Debug("AF_XDP socket is closed, exiting read loop")
+				return
+			}
+			continue
+		}
+		n = min(n, xdpBatch)
+
+		lock.Lock()
+		for i := uint32(0); i < n; i++ {
+			d := x.rx.desc(cons + i)
+			addrs[i] = d.Addr &^ (xdpFrameSize - 1)
+			src, mac, payload, ok := parseUDPFrame(x.umem[d.Addr : d.Addr+uint64(d.Len)])
+			if !ok {
+				continue
+			}
+			x.learn(src.Addr(), mac)
+			r(src, payload)
+		}
+		lock.Unlock()
+
+		cons += n
+		atomic.StoreUint32(x.rx.consumer, cons)
+		x.refill(addrs[:n])
+	}
+}
+
+// refill hands received frames back to the kernel, the fill ring is sized to hold every rx frame so it never overflows
+func (x *XDPConn) refill(addrs []uint64) {
+	prod := atomic.LoadUint32(x.fill.producer)
+	for i, a := range addrs {
+		*x.fill.addr(prod + uint32(i)) = a
+	}
+	atomic.StoreUint32(x.fill.producer, prod+uint32(len(addrs)))
+
+	if x.fill.needsWakeup() {
+		unix.Syscall6(unix.SYS_RECVFROM, uintptr(x.fd), 0, 0, unix.MSG_DONTWAIT, 0, 0)
+	}
+}
+
+func (x *XDPConn) learn(addr netip.Addr, mac [6]byte) {
+	x.neighborsLock.RLock()
+	known, ok := x.neighbors[addr]
+	x.neighborsLock.RUnlock()
+	if ok && known == mac {
+		return
+	}
+
+	x.neighborsLock.Lock()
+	if len(x.neighbors) >= xdpMaxNeighbors {
+		clear(x.neighbors)
+	}
+	x.neighbors[addr] = mac
+	x.neighborsLock.Unlock()
+}
+
+func (x *XDPConn) WriteTo(b []byte, addr netip.AddrPort) error {
+	return x.WriteToDSCP(b, addr, 0)
+}
+
+// WriteToDSCP sends b in a frame of its own if we know where addr lives, otherwise through the kernel socket
+func (x *XDPConn) WriteToDSCP(b []byte, addr netip.AddrPort, dscp uint8) error {
+	dst := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	src := x.src6
+	if dst.Addr().Is4() {
+		src = x.src4
+	}
+
+	x.neighborsLock.RLock()
+	mac, ok := x.neighbors[dst.Addr()]
+	x.neighborsLock.RUnlock()
+
+	if !ok || !src.IsValid() || len(b)+udpFrameOverhead(dst.Addr().Is4()) > xdpFrameSize {
+		return x.StdConn.WriteToDSCP(b, addr, dscp)
+	}
+
+	x.txLock.Lock()
+	defer x.txLock.Unlock()
+
+	if x.closed.Load() {
+		// The rings may already be unmapped
+		return x.StdConn.WriteToDSCP(b, addr, dscp)
+	}
+
+	x.reclaim()
+	if len(x.txFree) == 0 {
+		x.kick()
+		x.reclaim()
+		if len(x.txFree) == 0 {
+			// Everything is still in flight, let the kernel queue it instead of dropping it
+			return x.StdConn.WriteToDSCP(b, addr, dscp)
+		}
+	}
+
+	frame := x.txFree[len(x.txFree)-1]
+	x.txFree = x.txFree[:len(x.txFree)-1]
+	n := writeUDPFrame(x.umem[frame:frame+xdpFrameSize], x.mac, mac, netip.AddrPortFrom(src, x.port), dst, dscp, b)
+
+	prod := atomic.LoadUint32(x.tx.producer)
+	*x.tx.desc(prod) = unix.XDPDesc{Addr: frame, Len: uint32(n)}
+	atomic.StoreUint32(x.tx.producer, prod+1)
+	x.kick()
+	return nil
+}
+
+// reclaim takes the sent frames off of the completion ring, txLock must be held
+func (x *XDPConn) reclaim() {
+	cons := atomic.LoadUint32(x.comp.consumer)
+	n := atomic.LoadUint32(x.comp.producer) - cons
+	for i := uint32(0); i < n; i++ {
+		x.txFree = append(x.txFree, *x.comp.addr(cons + i))
+	}
+	atomic.StoreUint32(x.comp.consumer, cons+n)
+}
+
+// kick tells the kernel there is something on the tx ring, txLock must be held
+func (x *XDPConn) kick() {
+	if !x.tx.needsWakeup() {
+		return
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(x.fd), 0, 0, unix.MSG_DONTWAIT, 0, 0)
+	switch errno {
+	case 0, unix.EAGAIN, unix.EBUSY, unix.ENOBUFS, unix.ENETDOWN:
+	default:
+		x.l.WithError(errno).Debug("Failed to wake up the AF_XDP tx ring")
+	}
+}
+
+func (x *XDPConn) Close() error {
+	if x.closed.Swap(true) {
+		return nil
+	}
+
+	err := x.StdConn.Close()
+	if perr := x.prog.release(); perr != nil && err == nil {
+		err = perr
+	}
+
+	// Closing the socket wakes up ListenOut, wait for it to let go of the rings before unmapping them
+	unix.Close(x.fd)
+	x.readLock.Lock()
+	x.txLock.Lock()
+	x.unmap()
+	x.txLock.Unlock()
+	x.readLock.Unlock()
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !linux || android || e2e_testing
+// +build !linux android e2e_testing
+
+package udp
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewXDPListener is only available on linux
+func NewXDPListener(_ *logrus.Logger, _ netip.Addr, _ int, _ bool, _ int, _ *XDPConfig, _ int) (Conn, error) {
+	return nil, fmt.Errorf("listen.xdp is only supported on linux")
+}
@@ -0,0 +1,58 @@
+package udp
+
+import (
+	"fmt"
+
+	"github.com/slackhq/nebula/config"
+)
+
+// XDPConfig is listen.xdp, it moves the outside traffic of dedicated relays through AF_XDP sockets instead of the
+// kernel udp stack. See NewXDPListener.
+type XDPConfig struct {
+	// Interface is the network interface nebula traffic arrives on
+	Interface string
+	// Queue is the first rx queue of Interface to bind, routine n binds Queue+n
+	Queue int
+	// Generic attaches the xdp program in skb mode, for drivers without native xdp support
+	Generic bool
+	// ZeroCopy asks the driver to hand us its frames directly, we fall back to copy mode if it can not
+	ZeroCopy bool
+	// Frames is how many frames each queue has, half for receiving and half for sending
+	Frames int
+}
+
+// NewXDPConfigFromConfig returns nil if listen.xdp is not enabled
+func NewXDPConfigFromConfig(c *config.C) (*XDPConfig, error) {
+	if !c.GetBool("listen.xdp.enabled", false) {
+		return nil, nil
+	}
+
+	xc := &XDPConfig{
+		Interface: c.GetString("listen.xdp.interface", ""),
+		Queue:     c.GetInt("listen.xdp.queue", 0),
+		ZeroCopy:  c.GetBool("listen.xdp.zerocopy", true),
+		Frames:    c.GetInt("listen.xdp.frames", 4096),
+	}
+
+	if xc.Interface == "" {
+		return nil, fmt.Errorf("listen.xdp.interface is required")
+	}
+
+	if xc.Queue < 0 {
+		return nil, fmt.Errorf("listen.xdp.queue can not be negative")
+	}
+
+	switch mode := c.GetString("listen.xdp.mode", "native"); mode {
+	case "native":
+	case "generic":
+		xc.Generic = true
+	default:
+		return nil, fmt.Errorf("listen.xdp.mode must be native or generic, not %q", mode)
+	}
+
+	if xc.Frames < 64 || xc.Frames&(xc.Frames-1) != 0 {
+		return nil, fmt.Errorf("listen.xdp.frames must be a power of 2 and at least 64, not %d", xc.Frames)
+	}
+
+	return xc, nil
+}
@@ -0,0 +1,173 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// The AF_XDP conn sends and receives whole ethernet frames, these build and take apart the ethernet, ip, and udp
+// headers around the nebula packets. Only what a relay needs is supported, no vlan tags, ip options on send, or ipv6
+// extension headers. Anything else is left to the kernel.
+
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	protoUDP      = 17
+)
+
+// udpFrameOverhead returns the bytes added around a payload sent to a remote of the given family
+func udpFrameOverhead(is4 bool) int {
+	if is4 {
+		return ethHeaderLen + ipv4HeaderLen + udpHeaderLen
+	}
+	return ethHeaderLen + ipv6HeaderLen + udpHeaderLen
+}
+
+// parseUDPFrame returns who sent frame, their mac, and the udp payload. ok is false for anything that is not a complete
+// unfragmented udp packet.
+func parseUDPFrame(frame []byte) (src netip.AddrPort, srcMAC [6]byte, payload []byte, ok bool) {
+	if len(frame) < ethHeaderLen {
+		return src, srcMAC, nil, false
+	}
+	copy(srcMAC[:], frame[6:12])
+
+	ip := frame[ethHeaderLen:]
+	var udp []byte
+	var srcAddr netip.Addr
+
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeIPv4:
+		if len(ip) < ipv4HeaderLen || ip[0]>>4 != 4 || ip[9] != protoUDP {
+			return src, srcMAC, nil, false
+		}
+
+		// More fragments or a fragment offset
+		if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+			return src, srcMAC, nil, false
+		}
+
+		ihl := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(ip) {
+			return src, srcMAC, nil, false
+		}
+
+		srcAddr = netip.AddrFrom4([4]byte(ip[12:16]))
+		udp = ip[ihl:total]
+
+	case etherTypeIPv6:
+		if len(ip) < ipv6HeaderLen || ip[0]>>4 != 6 || ip[6] != protoUDP {
+			return src, srcMAC, nil, false
+		}
+
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total > len(ip) {
+			return src, srcMAC, nil, false
+		}
+
+		srcAddr = netip.AddrFrom16([16]byte(ip[8:24]))
+		udp = ip[ipv6HeaderLen:total]
+
+	default:
+		return src, srcMAC, nil, false
+	}
+
+	if len(udp) < udpHeaderLen {
+		return src, srcMAC, nil, false
+	}
+
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < udpHeaderLen || udpLen > len(udp) {
+		return src, srcMAC, nil, false
+	}
+
+	return netip.AddrPortFrom(srcAddr, binary.BigEndian.Uint16(udp[0:2])), srcMAC, udp[udpHeaderLen:udpLen], true
+}
+
+// writeUDPFrame writes payload from src to dst into frame, dscp is put in the ip header. It returns the length of the
+// frame, or 0 if it does not fit. The udp checksum is left out for ipv4, which is allowed, and required for ipv6.
+func writeUDPFrame(frame []byte, srcMAC, dstMAC [6]byte, src, dst netip.AddrPort, dscp uint8, payload []byte) int {
+	is4 := dst.Addr().Is4()
+	n := udpFrameOverhead(is4) + len(payload)
+	if n > len(frame) || src.Addr().Is4() != is4 {
+		return 0
+	}
+
+	copy(frame[0:6], dstMAC[:])
+	copy(frame[6:12], srcMAC[:])
+
+	udpLen := udpHeaderLen + len(payload)
+	var udp []byte
+	if is4 {
+		binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+		ip := frame[ethHeaderLen : ethHeaderLen+ipv4HeaderLen]
+		ip[0] = 0x45
+		ip[1] = dscp << 2
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipv4HeaderLen+udpLen))
+		// No id, flags, or fragment offset
+		clear(ip[4:8])
+		ip[8] = 64
+		ip[9] = protoUDP
+		clear(ip[10:12])
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:16], s[:])
+		copy(ip[16:20], d[:])
+		binary.BigEndian.PutUint16(ip[10:12], ^foldChecksum(checksum(ip, 0)))
+		udp = frame[ethHeaderLen+ipv4HeaderLen : n]
+
+	} else {
+		binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+		ip := frame[ethHeaderLen : ethHeaderLen+ipv6HeaderLen]
+		binary.BigEndian.PutUint32(ip[0:4], 6<<28|uint32(dscp)<<22)
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+		ip[6] = protoUDP
+		ip[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:24], s[:])
+		copy(ip[24:40], d[:])
+		udp = frame[ethHeaderLen+ipv6HeaderLen : n]
+	}
+
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	clear(udp[6:8])
+	copy(udp[udpHeaderLen:], payload)
+
+	if !is4 {
+		// The ipv6 pseudo header is the addresses, the udp length, and the next header
+		sum := checksum(frame[ethHeaderLen+8:ethHeaderLen+ipv6HeaderLen], uint32(udpLen)+protoUDP)
+		csum := ^foldChecksum(checksum(udp, sum))
+		if csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(udp[6:8], csum)
+	}
+
+	return n
+}
+
+// checksum adds b to the ones complement sum in initial
+func checksum(b []byte, initial uint32) uint32 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,100 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewXDPConfigFromConfig(t *testing.T) {
+	c := config.NewC(test.NewLogger())
+
+	xc, err := NewXDPConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, xc)
+
+	c.Settings["listen"] = map[string]any{"xdp": map[string]any{"enabled": true, "interface": "eth1", "queue": 2}}
+	xc, err = NewXDPConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &XDPConfig{Interface: "eth1", Queue: 2, ZeroCopy: true, Frames: 4096}, xc)
+
+	c.Settings["listen"] = map[string]any{"xdp": map[string]any{"enabled": true, "interface": "eth1", "mode": "generic", "zerocopy": false, "frames": 512}}
+	xc, err = NewXDPConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, &XDPConfig{Interface: "eth1", Generic: true, Frames: 512}, xc)
+
+	c.Settings["listen"] = map[string]any{"xdp": map[string]any{"enabled": true}}
+	_, err = NewXDPConfigFromConfig(c)
+	require.EqualError(t, err, "listen.xdp.interface is required")
+
+	c.Settings["listen"] = map[string]any{"xdp": map[string]any{"enabled": true, "interface": "eth1", "mode": "offload"}}
+	_, err = NewXDPConfigFromConfig(c)
+	require.EqualError(t, err, `listen.xdp.mode must be native or generic, not "offload"`)
+
+	c.Settings["listen"] = map[string]any{"xdp": map[string]any{"enabled": true, "interface": "eth1", "frames": 1000}}
+	_, err = NewXDPConfigFromConfig(c)
+	require.EqualError(t, err, "listen.xdp.frames must be a power of 2 and at least 64, not 1000")
+}
+
+func TestUDPFrame(t *testing.T) {
+	srcMAC := [6]byte{2, 0, 0, 0, 0, 1}
+	dstMAC := [6]byte{2, 0, 0, 0, 0, 2}
+	payload := []byte("a nebula packet of odd length")
+
+	for _, tc := range []struct {
+		src, dst netip.AddrPort
+	}{
+		{netip.MustParseAddrPort("192.0.2.1:4242"), netip.MustParseAddrPort("198.51.100.7:31337")},
+		{netip.MustParseAddrPort("[2001:db8::1]:4242"), netip.MustParseAddrPort("[2001:db8::7]:31337")},
+	} {
+		frame := make([]byte, 2048)
+		n := writeUDPFrame(frame, srcMAC, dstMAC, tc.src, tc.dst, 46, payload)
+		require.Equal(t, udpFrameOverhead(tc.dst.Addr().Is4())+len(payload), n)
+		frame = frame[:n]
+
+		assert.Equal(t, dstMAC[:], frame[0:6])
+		ip := frame[ethHeaderLen:]
+		if tc.dst.Addr().Is4() {
+			assert.Equal(t, uint8(46<<2), ip[1])
+			// A header with a correct checksum sums to all ones
+			assert.Equal(t, uint16(0xffff), foldChecksum(checksum(ip[:ipv4HeaderLen], 0)))
+		} else {
+			assert.Equal(t, uint32(46), binary.BigEndian.Uint32(ip[0:4])>>22&0x3f)
+			udpLen := uint32(len(ip) - ipv6HeaderLen)
+			sum := checksum(ip[8:ipv6HeaderLen], udpLen+protoUDP)
+			assert.Equal(t, uint16(0xffff), foldChecksum(checksum(ip[ipv6HeaderLen:], sum)))
+		}
+
+		// Reading our own frame back sees it from the sender
+		from, mac, got, ok := parseUDPFrame(frame)
+		require.True(t, ok)
+		assert.Equal(t, tc.src, from)
+		assert.Equal(t, srcMAC, mac)
+		assert.Equal(t, payload, got)
+
+		// Ethernet padding past the ip packet is not payload
+		from, _, got, ok = parseUDPFrame(append(frame, 0, 0, 0, 0))
+		require.True(t, ok)
+		assert.Equal(t, tc.src, from)
+		assert.Equal(t, payload, got)
+
+		_, _, _, ok = parseUDPFrame(frame[:n-1])
+		assert.False(t, ok)
+	}
+
+	// Mixed families and frames that are too small are refused
+	frame := make([]byte, 2048)
+	assert.Zero(t, writeUDPFrame(frame, srcMAC, dstMAC, netip.MustParseAddrPort("192.0.2.1:1"), netip.MustParseAddrPort("[2001:db8::7]:1"), 0, payload))
+	assert.Zero(t, writeUDPFrame(frame[:40], srcMAC, dstMAC, netip.MustParseAddrPort("192.0.2.1:1"), netip.MustParseAddrPort("192.0.2.2:1"), 0, payload))
+
+	// Fragments are left alone
+	n := writeUDPFrame(frame, srcMAC, dstMAC, netip.MustParseAddrPort("192.0.2.1:1"), netip.MustParseAddrPort("192.0.2.2:1"), 0, payload)
+	binary.BigEndian.PutUint16(frame[ethHeaderLen+6:], 0x2000)
+	_, _, _, ok := parseUDPFrame(frame[:n])
+	assert.False(t, ok)
+}
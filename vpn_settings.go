@@ -0,0 +1,75 @@
+package nebula
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+)
+
+// vpnSettings keeps the desired tun device settings current across config reloads for apps that own the device
+type vpnSettings struct {
+	l           *logrus.Logger
+	vpnNetworks []netip.Prefix
+	current     atomic.Pointer[overlay.VpnSettings]
+
+	callbacksLock sync.Mutex
+	callbacks     []func(overlay.VpnSettings)
+}
+
+func newVpnSettingsFromConfig(l *logrus.Logger, c *config.C, vpnNetworks []netip.Prefix) (*vpnSettings, error) {
+	v := &vpnSettings{l: l, vpnNetworks: vpnNetworks}
+
+	s, err := overlay.NewVpnSettingsFromConfig(c, vpnNetworks)
+	if err != nil {
+		return nil, err
+	}
+	v.current.Store(&s)
+
+	c.RegisterReloadCallback(v.reload)
+	return v, nil
+}
+
+func (v *vpnSettings) reload(c *config.C) {
+	if !c.HasChanged("tun.unsafe_routes") && !c.HasChanged("tun.dns") && !c.HasChanged("tun.mtu") {
+		return
+	}
+
+	s, err := overlay.NewVpnSettingsFromConfig(c, v.vpnNetworks)
+	if err != nil {
+		v.l.WithError(err).Error("Failed to reload vpn settings, keeping the previous ones")
+		return
+	}
+
+	if s.Equal(*v.current.Load()) {
+		return
+	}
+	v.current.Store(&s)
+
+	v.callbacksLock.Lock()
+	callbacks := v.callbacks
+	v.callbacksLock.Unlock()
+
+	for _, cb := range callbacks {
+		cb(v.get())
+	}
+}
+
+func (v *vpnSettings) get() overlay.VpnSettings {
+	s := *v.current.Load()
+	s.Networks = slices.Clone(s.Networks)
+	s.Routes = slices.Clone(s.Routes)
+	s.DNS = slices.Clone(s.DNS)
+	s.SearchDomains = slices.Clone(s.SearchDomains)
+	return s
+}
+
+func (v *vpnSettings) onChange(cb func(overlay.VpnSettings)) {
+	v.callbacksLock.Lock()
+	defer v.callbacksLock.Unlock()
+	v.callbacks = append(v.callbacks[:len(v.callbacks):len(v.callbacks)], cb)
+}
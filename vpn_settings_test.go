@@ -0,0 +1,47 @@
+package nebula
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/overlay"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControl_VpnSettings(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+	require.NoError(t, c.LoadString("tun:\n  mtu: 1300\n"))
+
+	v, err := newVpnSettingsFromConfig(l, c, []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")})
+	require.NoError(t, err)
+	ctrl := &Control{vpnSettings: v}
+	assert.Equal(t, 1300, ctrl.VpnSettings().MTU)
+
+	var got []overlay.VpnSettings
+	ctrl.OnVpnSettingsChange(func(s overlay.VpnSettings) {
+		got = append(got, s)
+	})
+
+	// Callers get their own copy
+	s := ctrl.VpnSettings()
+	s.Networks[0] = netip.MustParsePrefix("10.9.9.9/24")
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.1/24"), ctrl.VpnSettings().Networks[0])
+
+	// Reloads that do not touch the device settings are quiet
+	require.NoError(t, c.ReloadConfigString("tun:\n  mtu: 1300\nlogging:\n  level: debug\n"))
+	assert.Empty(t, got)
+
+	require.NoError(t, c.ReloadConfigString("tun:\n  mtu: 1300\n  dns:\n    servers: [10.0.0.53]\n"))
+	require.Len(t, got, 1)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.53")}, got[0].DNS)
+	assert.Equal(t, got[0], ctrl.VpnSettings())
+
+	// A bad reload keeps the previous settings
+	require.NoError(t, c.ReloadConfigString("tun:\n  mtu: 1300\n  dns:\n    servers: [nope]\n"))
+	assert.Len(t, got, 1)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.53")}, ctrl.VpnSettings().DNS)
+}
@@ -0,0 +1,288 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+const warmRestartVersion = 1
+
+// warmRestart saves the hosts we have tunnels with so that after a restart we handshake with them right away instead
+// of waiting for traffic. Keys are never written, every tunnel is handshaked again unless it can be resumed from a
+// session ticket, see session_resumption.go.
+type warmRestart struct {
+	l        *logrus.Logger
+	f        *Interface
+	path     string
+	interval time.Duration
+	maxAge   time.Duration
+	// resumption is set when tunnels are saved with session tickets
+	resumption *sessionResumption
+
+	// indexes holds the local index of each tunnel we loaded. Peers keep sending to them until they see our new
+	// handshake, which tells us where they are.
+	sync.Mutex
+	indexes map[uint32][]netip.Addr
+}
+
+type warmRestartFile struct {
+	Version int                 `json:"version"`
+	Saved   time.Time           `json:"saved"`
+	Tunnels []warmRestartTunnel `json:"tunnels"`
+}
+
+type warmRestartTunnel struct {
+	VpnAddrs    []netip.Addr     `json:"vpnAddrs"`
+	LocalIndex  uint32           `json:"localIndex"`
+	RemoteIndex uint32           `json:"remoteIndex"`
+	Remote      netip.AddrPort   `json:"remote"`
+	Remotes     []netip.AddrPort `json:"remotes"`
+	Relays      []netip.Addr     `json:"relays"`
+	// Ticket is the sealed session ticket of the tunnel, only saved with resume
+	Ticket []byte `json:"ticket,omitempty"`
+}
+
+// newWarmRestartFromConfig returns nil if tunnels.warm_restart is not configured, it is only read at startup
+func newWarmRestartFromConfig(l *logrus.Logger, c *config.C, f *Interface) (*warmRestart, error) {
+	path := c.GetString("tunnels.warm_restart.path", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	w := &warmRestart{
+		l:        l,
+		f:        f,
+		path:     path,
+		interval: c.GetDuration("tunnels.warm_restart.interval", time.Minute),
+		maxAge:   c.GetDuration("tunnels.warm_restart.max_age", 10*time.Minute),
+	}
+
+	if w.interval <= 0 {
+		return nil, fmt.Errorf("tunnels.warm_restart.interval must be greater than 0")
+	}
+
+	if w.maxAge <= 0 {
+		return nil, fmt.Errorf("tunnels.warm_restart.max_age must be greater than 0")
+	}
+
+	if c.GetBool("tunnels.warm_restart.resume", false) {
+		timeout := c.GetDuration("tunnels.warm_restart.resume_timeout", defaultResumeTimeout)
+		if timeout <= 0 {
+			return nil, fmt.Errorf("tunnels.warm_restart.resume_timeout must be greater than 0")
+		}
+
+		if f.pki.getCertState().keyInDevice {
+			l.Warn("tunnels.warm_restart.resume needs a private key nebula can read, tunnels will be handshaked instead")
+		} else {
+			w.resumption = newSessionResumption(l, f, timeout)
+		}
+	}
+
+	return w, nil
+}
+
+// Start handshakes with the hosts we had tunnels with before the restart and saves our tunnels until ctx is done
+func (w *warmRestart) Start(ctx context.Context) {
+	n, err := w.load(time.Now())
+	if err != nil {
+		w.l.WithError(err).WithField("path", w.path).Warn("Failed to load the warm restart state")
+	} else if n > 0 {
+		w.l.WithField("path", w.path).WithField("tunnels", n).Info("Handshaking with hosts from before the restart")
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := w.save(now); err != nil {
+				w.l.WithError(err).WithField("path", w.path).Error("Failed to save the warm restart state")
+			}
+		}
+	}
+}
+
+// Stop saves our tunnels one last time, it must run before they are closed
+func (w *warmRestart) Stop() {
+	if err := w.save(time.Now()); err != nil {
+		w.l.WithError(err).WithField("path", w.path).Error("Failed to save the warm restart state")
+	}
+}
+
+// load seeds the lighthouse with the remotes of every saved tunnel and starts a handshake with each of them,
+// returning how many there were. Nothing is loaded if the state is older than max_age.
+func (w *warmRestart) load(now time.Time) (int, error) {
+	b, err := os.ReadFile(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var wf warmRestartFile
+	if err := json.Unmarshal(b, &wf); err != nil {
+		return 0, err
+	}
+
+	if wf.Version != warmRestartVersion {
+		return 0, fmt.Errorf("unsupported warm restart version %d", wf.Version)
+	}
+
+	if now.Sub(wf.Saved) > w.maxAge {
+		w.l.WithField("saved", wf.Saved).Info("Warm restart state is too old, ignoring it")
+		return 0, nil
+	}
+
+	indexes := map[uint32][]netip.Addr{}
+	lh := w.f.lightHouse
+	owner := w.f.myVpnAddrs[0]
+	loaded := 0
+	for _, t := range wf.Tunnels {
+		if len(t.VpnAddrs) == 0 {
+			continue
+		}
+
+		remotes := t.Remotes
+		if t.Remote.IsValid() {
+			remotes = append(remotes, t.Remote)
+		}
+
+		lh.Lock()
+		am := lh.unlockedGetRemoteList(t.VpnAddrs)
+		am.Lock()
+		w.unlockedAddRemotes(am, remotes, wf.Saved)
+		if len(t.Relays) > 0 {
+			am.unlockedSetRelay(owner, t.Relays)
+		}
+		am.Unlock()
+		lh.Unlock()
+
+		indexes[t.LocalIndex] = t.VpnAddrs
+		if !w.resumption.start(t) {
+			w.f.handshakeManager.StartHandshake(t.VpnAddrs[0], nil)
+		}
+		loaded++
+	}
+
+	w.Lock()
+	w.indexes = indexes
+	w.Unlock()
+
+	return loaded, nil
+}
+
+// unlockedAddRemotes adds addrs to what lighthouse.remote_cache may have already loaded, am must be locked
+func (w *warmRestart) unlockedAddRemotes(am *RemoteList, addrs []netip.AddrPort, at time.Time) {
+	persisted := append(slices.Clone(am.persisted), addrs...)
+	slices.SortFunc(persisted, func(a, b netip.AddrPort) int { return a.Compare(b) })
+	am.unlockedSetPersisted(slices.Compact(persisted), at)
+}
+
+// recognize is called for packets to a local index we have no tunnel for. If the index belonged to a tunnel from
+// before the restart we now know where the peer is, it is only recognized once. The address is not trusted, the
+// handshake still verifies the peer.
+func (w *warmRestart) recognize(index uint32, addr netip.AddrPort) {
+	if w == nil {
+		return
+	}
+
+	w.Lock()
+	vpnAddrs, ok := w.indexes[index]
+	delete(w.indexes, index)
+	w.Unlock()
+	if !ok {
+		return
+	}
+
+	lh := w.f.lightHouse
+	lh.Lock()
+	am := lh.unlockedGetRemoteList(vpnAddrs)
+	am.Lock()
+	w.unlockedAddRemotes(am, []netip.AddrPort{addr}, time.Now())
+	am.Unlock()
+	lh.Unlock()
+
+	w.f.handshakeManager.StartHandshake(vpnAddrs[0], nil)
+}
+
+func (w *warmRestart) save(now time.Time) error {
+	hm := w.f.hostMap
+	seen := map[*HostInfo]struct{}{}
+	hm.RLock()
+	for _, h := range hm.Hosts {
+		seen[h] = struct{}{}
+	}
+	hm.RUnlock()
+
+	preferredRanges := hm.GetPreferredRanges()
+	var cs *CertState
+	if w.resumption != nil {
+		cs = w.f.pki.getCertState()
+	}
+	wf := warmRestartFile{Version: warmRestartVersion, Saved: now, Tunnels: []warmRestartTunnel{}}
+	for h := range seen {
+		if len(h.vpnAddrs) == 0 {
+			continue
+		}
+
+		t := warmRestartTunnel{
+			VpnAddrs:    h.vpnAddrs,
+			LocalIndex:  h.localIndexId,
+			RemoteIndex: h.remoteIndexId,
+			Remote:      h.remote,
+			Remotes:     h.remotes.CopyAddrs(preferredRanges),
+			Relays:      h.relayState.CopyRelayIps(),
+		}
+
+		if w.resumption != nil {
+			ticket, err := sealTicket(cs, h)
+			if err != nil {
+				h.logger(w.l).WithError(err).Error("Failed to seal the session ticket")
+			}
+			t.Ticket = ticket
+		}
+
+		wf.Tunnels = append(wf.Tunnels, t)
+	}
+
+	slices.SortFunc(wf.Tunnels, func(a, b warmRestartTunnel) int { return a.VpnAddrs[0].Compare(b.VpnAddrs[0]) })
+
+	b, err := json.Marshal(wf)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash mid write does not leave a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
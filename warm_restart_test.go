@@ -0,0 +1,108 @@
+package nebula
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/slackhq/nebula/udp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newWarmRestartInterface(t *testing.T, path string) (*Interface, *warmRestart) {
+	l := test.NewLogger()
+	cachePath, ctx := newRemoteCachePath(t)
+	lh, _ := newRemoteCacheLighthouse(t, ctx, cachePath)
+	hostMap := newHostMap(l)
+	hostMap.preferredRanges.Store(&[]netip.Prefix{})
+	f := &Interface{
+		hostMap:          hostMap,
+		lightHouse:       lh,
+		handshakeManager: NewHandshakeManager(l, hostMap, lh, &udp.NoopConn{}, defaultHandshakeConfig),
+		myVpnAddrs:       []netip.Addr{netip.MustParseAddr("10.128.0.1")},
+		l:                l,
+	}
+
+	c := config.NewC(l)
+	c.Settings["tunnels"] = map[string]any{"warm_restart": map[string]any{"path": path}}
+	w, err := newWarmRestartFromConfig(l, c, f)
+	require.NoError(t, err)
+	f.warmRestart = w
+	return f, w
+}
+
+func TestWarmRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnels.json")
+	f, w := newWarmRestartInterface(t, path)
+
+	peer := netip.MustParseAddr("10.128.0.3")
+	relay := netip.MustParseAddr("10.128.0.4")
+	remote := netip.MustParseAddrPort("1.2.3.4:4242")
+	other := netip.MustParseAddrPort("5.6.7.8:4242")
+
+	am := f.lightHouse.QueryCache([]netip.Addr{peer})
+	am.LearnRemote(peer, other)
+	hostinfo := &HostInfo{
+		vpnAddrs:        []netip.Addr{peer},
+		localIndexId:    1099,
+		remoteIndexId:   9901,
+		remote:          remote,
+		remotes:         am,
+		ConnectionState: &ConnectionState{},
+		relayState: RelayState{
+			relays:         []netip.Addr{relay},
+			relayForByAddr: map[netip.Addr]*Relay{},
+			relayForByIdx:  map[uint32]*Relay{},
+		},
+	}
+	f.hostMap.unlockedAddHostInfo(hostinfo, f)
+
+	now := time.Now()
+	require.NoError(t, w.save(now))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var wf warmRestartFile
+	require.NoError(t, json.Unmarshal(b, &wf))
+	assert.True(t, now.Equal(wf.Saved))
+	require.Len(t, wf.Tunnels, 1)
+	assert.Equal(t, warmRestartTunnel{
+		VpnAddrs:    []netip.Addr{peer},
+		LocalIndex:  1099,
+		RemoteIndex: 9901,
+		Remote:      remote,
+		Remotes:     []netip.AddrPort{other},
+		Relays:      []netip.Addr{relay},
+	}, wf.Tunnels[0])
+
+	// A restarted node handshakes with the peer right away using what it knew
+	f2, w2 := newWarmRestartInterface(t, path)
+	n, err := w2.load(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NotNil(t, f2.handshakeManager.QueryVpnAddr(peer))
+
+	am2 := f2.lightHouse.Query(peer)
+	require.NotNil(t, am2)
+	assert.ElementsMatch(t, []netip.AddrPort{remote, other}, am2.CopyAddrs(nil))
+	assert.Equal(t, []netip.Addr{relay}, am2.relays)
+
+	// The peer still sending to the old index tells us where it is, once
+	roamed := netip.MustParseAddrPort("9.9.9.9:4242")
+	w2.recognize(1099, roamed)
+	assert.Contains(t, am2.CopyAddrs(nil), roamed)
+	_, ok := w2.indexes[1099]
+	assert.False(t, ok)
+
+	// Stale state is ignored
+	_, w3 := newWarmRestartInterface(t, path)
+	n, err = w3.load(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,295 @@
+//go:build linux || darwin || freebsd || openbsd || windows
+
+package wggateway
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	DefaultListenPort = 51820
+	DefaultMTU        = 1420
+
+	queueLen = 1024
+)
+
+// Peer is a wireguard client bridged into the overlay
+type Peer struct {
+	Name         string
+	PublicKey    Key
+	PresharedKey Key
+	// Addr is the overlay address the peer uses, it must be within an unsafe network of the gateway host
+	Addr netip.Addr
+	// Groups are the nebula groups allowed to reach the peer
+	Groups    []string
+	Keepalive time.Duration
+}
+
+// Key is a curve25519 wireguard key
+type Key [32]byte
+
+func ParseKey(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(b) != len(k) {
+		return k, fmt.Errorf("invalid key: expected %d bytes, got %d", len(k), len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k Key) IsZero() bool {
+	return k == Key{}
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+type Config struct {
+	ListenPort int
+	PrivateKey Key
+	MTU        int
+	Peers      []Peer
+}
+
+// NewConfigFromConfig parses the wireguard_gateway section, returning nil if the gateway is not enabled
+func NewConfigFromConfig(c *config.C) (*Config, error) {
+	if !c.GetBool("wireguard_gateway.enabled", false) {
+		return nil, nil
+	}
+
+	gc := &Config{
+		ListenPort: c.GetInt("wireguard_gateway.listen_port", DefaultListenPort),
+		MTU:        c.GetInt("wireguard_gateway.mtu", DefaultMTU),
+	}
+
+	rawKey, err := c.GetSecret("wireguard_gateway.private_key", "")
+	if err != nil {
+		return nil, err
+	}
+	if path := c.GetString("wireguard_gateway.private_key_file", ""); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read wireguard_gateway.private_key_file: %w", err)
+		}
+		rawKey = string(b)
+	}
+	if rawKey == "" {
+		return nil, errors.New("wireguard_gateway.private_key or wireguard_gateway.private_key_file must be set")
+	}
+
+	gc.PrivateKey, err = ParseKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("wireguard_gateway.private_key: %w", err)
+	}
+
+	rawPeers, ok := c.Get("wireguard_gateway.peers").([]any)
+	if !ok && c.Get("wireguard_gateway.peers") != nil {
+		return nil, errors.New("wireguard_gateway.peers must be a list")
+	}
+
+	seenAddrs := map[netip.Addr]struct{}{}
+	seenKeys := map[Key]struct{}{}
+	for i, rp := range rawPeers {
+		p, err := parsePeer(rp)
+		if err != nil {
+			return nil, fmt.Errorf("wireguard_gateway.peers entry %d: %w", i+1, err)
+		}
+
+		if _, ok := seenAddrs[p.Addr]; ok {
+			return nil, fmt.Errorf("wireguard_gateway.peers entry %d: address %s is already in use", i+1, p.Addr)
+		}
+		if _, ok := seenKeys[p.PublicKey]; ok {
+			return nil, fmt.Errorf("wireguard_gateway.peers entry %d: public_key is already in use", i+1)
+		}
+		seenAddrs[p.Addr] = struct{}{}
+		seenKeys[p.PublicKey] = struct{}{}
+
+		gc.Peers = append(gc.Peers, p)
+	}
+
+	return gc, nil
+}
+
+func parsePeer(raw any) (Peer, error) {
+	var p Peer
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return p, fmt.Errorf("invalid type: %T", raw)
+	}
+
+	if v, ok := m["name"]; ok {
+		p.Name = fmt.Sprint(v)
+	}
+
+	var err error
+	p.PublicKey, err = ParseKey(fmt.Sprint(m["public_key"]))
+	if err != nil {
+		return p, fmt.Errorf("public_key: %w", err)
+	}
+
+	if v, ok := m["preshared_key"]; ok {
+		p.PresharedKey, err = ParseKey(fmt.Sprint(v))
+		if err != nil {
+			return p, fmt.Errorf("preshared_key: %w", err)
+		}
+	}
+
+	p.Addr, err = netip.ParseAddr(fmt.Sprint(m["address"]))
+	if err != nil {
+		return p, fmt.Errorf("address: %w", err)
+	}
+
+	if v, ok := m["groups"]; ok {
+		rg, ok := v.([]any)
+		if !ok {
+			return p, errors.New("groups must be a list")
+		}
+		for _, g := range rg {
+			p.Groups = append(p.Groups, fmt.Sprint(g))
+		}
+	}
+
+	if v, ok := m["persistent_keepalive"]; ok {
+		p.Keepalive, err = time.ParseDuration(fmt.Sprint(v))
+		if err != nil {
+			return p, fmt.Errorf("persistent_keepalive: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+// Gateway terminates wireguard peers in process, exchanging their packets with nebula through Read and Deliver
+type Gateway struct {
+	l     *logrus.Logger
+	dev   *device.Device
+	tun   *channelTun
+	peers atomic.Pointer[map[netip.Addr]Peer]
+
+	configLock sync.Mutex
+	config     *Config
+}
+
+func New(l *logrus.Logger, gc *Config) (*Gateway, error) {
+	g := &Gateway{
+		l:   l,
+		tun: newChannelTun(gc.MTU, queueLen),
+	}
+
+	wl := l.WithField("subsystem", "wireguard")
+	g.dev = device.NewDevice(g.tun, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: wl.Debugf,
+		Errorf:   wl.Errorf,
+	})
+
+	if err := g.Reconfigure(gc); err != nil {
+		g.dev.Close()
+		return nil, err
+	}
+
+	if err := g.dev.Up(); err != nil {
+		g.dev.Close()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Reconfigure applies a new config, replacing the full set of peers. Sessions with unchanged peers are kept.
+func (g *Gateway) Reconfigure(gc *Config) error {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+
+	var b strings.Builder
+	if g.config == nil || g.config.PrivateKey != gc.PrivateKey {
+		fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(gc.PrivateKey[:]))
+	}
+	if g.config == nil || g.config.ListenPort != gc.ListenPort {
+		fmt.Fprintf(&b, "listen_port=%d\n", gc.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+
+	peers := make(map[netip.Addr]Peer, len(gc.Peers))
+	for _, p := range gc.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(p.PublicKey[:]))
+		if !p.PresharedKey.IsZero() {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey[:]))
+		}
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(p.Keepalive.Seconds()))
+		b.WriteString("replace_allowed_ips=true\n")
+		fmt.Fprintf(&b, "allowed_ip=%s\n", netip.PrefixFrom(p.Addr, p.Addr.BitLen()))
+		peers[p.Addr] = p
+	}
+
+	if err := g.dev.IpcSet(b.String()); err != nil {
+		return fmt.Errorf("failed to configure wireguard: %w", err)
+	}
+
+	g.config = gc
+	g.peers.Store(&peers)
+	return nil
+}
+
+// Peers returns the configured peers
+func (g *Gateway) Peers() []Peer {
+	g.configLock.Lock()
+	defer g.configLock.Unlock()
+	return append([]Peer(nil), g.config.Peers...)
+}
+
+// Peer returns the peer using the overlay address
+func (g *Gateway) Peer(addr netip.Addr) (Peer, bool) {
+	p, ok := (*g.peers.Load())[addr]
+	return p, ok
+}
+
+// Read blocks until a packet from a peer is available and copies it into b
+func (g *Gateway) Read(b []byte) (int, error) {
+	select {
+	case <-g.tun.closed:
+		return 0, os.ErrClosed
+	case p := <-g.tun.fromPeers:
+		return copy(b, p), nil
+	}
+}
+
+// Deliver sends a packet to the peer that owns addr, reporting false if no peer does
+func (g *Gateway) Deliver(addr netip.Addr, b []byte) bool {
+	if _, ok := g.Peer(addr); !ok {
+		return false
+	}
+
+	p := make([]byte, len(b))
+	copy(p, b)
+
+	select {
+	case g.tun.toPeers <- p:
+	default:
+		g.l.WithField("vpnAddr", addr).Debug("Dropping packet for wireguard peer, queue is full")
+	}
+	return true
+}
+
+func (g *Gateway) Close() error {
+	g.dev.Close()
+	return nil
+}
@@ -0,0 +1,174 @@
+//go:build linux || darwin || freebsd || openbsd || windows
+
+package wggateway
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func newKeyPair(t *testing.T) (Key, Key) {
+	var priv Key
+	_, err := rand.Read(priv[:])
+	require.NoError(t, err)
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	return priv, Key(pub)
+}
+
+// ipv4Packet builds a minimal ipv4 header followed by payload, enough for wireguard to route on
+func ipv4Packet(src, dst netip.Addr, payload string) []byte {
+	p := make([]byte, 20+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = 17
+	copy(p[12:16], src.AsSlice())
+	copy(p[16:20], dst.AsSlice())
+	copy(p[20:], payload)
+	return p
+}
+
+func TestNewConfigFromConfig(t *testing.T) {
+	l := test.NewLogger()
+	c := config.NewC(l)
+
+	gc, err := NewConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Nil(t, gc)
+
+	_, pub := newKeyPair(t)
+	priv, _ := newKeyPair(t)
+	require.NoError(t, c.LoadString(fmt.Sprintf(`
+wireguard_gateway:
+  enabled: true
+  private_key: %s
+  peers:
+    - name: phone
+      public_key: %s
+      address: 10.99.0.2
+      groups: [mobile, admin]
+      persistent_keepalive: 25s
+`, priv, pub)))
+
+	gc, err = NewConfigFromConfig(c)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultListenPort, gc.ListenPort)
+	assert.Equal(t, DefaultMTU, gc.MTU)
+	assert.Equal(t, priv, gc.PrivateKey)
+	assert.Equal(t, []Peer{{
+		Name:      "phone",
+		PublicKey: pub,
+		Addr:      netip.MustParseAddr("10.99.0.2"),
+		Groups:    []string{"mobile", "admin"},
+		Keepalive: 25 * time.Second,
+	}}, gc.Peers)
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString(fmt.Sprintf(`
+wireguard_gateway:
+  enabled: true
+  private_key: %s
+  peers:
+    - public_key: %s
+      address: 10.99.0.2
+    - public_key: %s
+      address: 10.99.0.2
+`, priv, pub, priv)))
+	_, err = NewConfigFromConfig(c)
+	require.EqualError(t, err, "wireguard_gateway.peers entry 2: address 10.99.0.2 is already in use")
+
+	c = config.NewC(l)
+	require.NoError(t, c.LoadString(`
+wireguard_gateway:
+  enabled: true
+  private_key: nope
+`))
+	_, err = NewConfigFromConfig(c)
+	require.ErrorContains(t, err, "wireguard_gateway.private_key: invalid key")
+}
+
+func TestGateway(t *testing.T) {
+	l := test.NewLogger()
+	gwPriv, gwPub := newKeyPair(t)
+	clientPriv, clientPub := newKeyPair(t)
+	peerAddr := netip.MustParseAddr("10.99.0.2")
+	meshAddr := netip.MustParseAddr("10.0.0.1")
+
+	gw, err := New(l, &Config{
+		ListenPort: 0,
+		PrivateKey: gwPriv,
+		MTU:        DefaultMTU,
+		Peers:      []Peer{{Name: "client", PublicKey: clientPub, Addr: peerAddr, Groups: []string{"mobile"}}},
+	})
+	require.NoError(t, err)
+	defer gw.Close()
+
+	state, err := gw.dev.IpcGet()
+	require.NoError(t, err)
+	var port int
+	for _, line := range strings.Split(state, "\n") {
+		if v, ok := strings.CutPrefix(line, "listen_port="); ok {
+			_, err = fmt.Sscan(v, &port)
+			require.NoError(t, err)
+		}
+	}
+	require.NotZero(t, port)
+
+	// A regular wireguard client with a tunnel to the gateway
+	clientTun := newChannelTun(DefaultMTU, queueLen)
+	client := device.NewDevice(clientTun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	defer client.Close()
+	require.NoError(t, client.IpcSet(fmt.Sprintf("private_key=%x\npublic_key=%x\nendpoint=127.0.0.1:%d\nallowed_ip=0.0.0.0/0\n", clientPriv[:], gwPub[:], port)))
+	require.NoError(t, client.Up())
+
+	p, ok := gw.Peer(peerAddr)
+	require.True(t, ok)
+	assert.Equal(t, "client", p.Name)
+
+	// Client to mesh
+	clientTun.toPeers <- ipv4Packet(peerAddr, meshAddr, "hello mesh")
+	b := make([]byte, DefaultMTU)
+	readDone := make(chan int)
+	go func() {
+		n, _ := gw.Read(b)
+		readDone <- n
+	}()
+	select {
+	case n := <-readDone:
+		assert.Equal(t, ipv4Packet(peerAddr, meshAddr, "hello mesh"), b[:n])
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for packet from the client")
+	}
+
+	// Mesh to client
+	assert.False(t, gw.Deliver(netip.MustParseAddr("10.99.0.3"), ipv4Packet(meshAddr, peerAddr, "nope")))
+	assert.True(t, gw.Deliver(peerAddr, ipv4Packet(meshAddr, peerAddr, "hello client")))
+	select {
+	case got := <-clientTun.fromPeers:
+		assert.Equal(t, ipv4Packet(meshAddr, peerAddr, "hello client"), got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for packet to the client")
+	}
+
+	// Removing the peer stops delivery
+	require.NoError(t, gw.Reconfigure(&Config{PrivateKey: gwPriv, MTU: DefaultMTU}))
+	assert.False(t, gw.Deliver(peerAddr, ipv4Packet(meshAddr, peerAddr, "gone")))
+	assert.Empty(t, gw.Peers())
+}
@@ -0,0 +1,89 @@
+//go:build linux || darwin || freebsd || openbsd || windows
+
+package wggateway
+
+import (
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// channelTun is an in memory tun.Device. Packets written by wireguard, decrypted from peers, are queued for Read by
+// nebula and packets nebula delivers to peers are handed to wireguard through its Read.
+type channelTun struct {
+	mtu       int
+	toPeers   chan []byte
+	fromPeers chan []byte
+	events    chan tun.Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChannelTun(mtu int, queueLen int) *channelTun {
+	t := &channelTun{
+		mtu:       mtu,
+		toPeers:   make(chan []byte, queueLen),
+		fromPeers: make(chan []byte, queueLen),
+		events:    make(chan tun.Event, 1),
+		closed:    make(chan struct{}),
+	}
+	t.events <- tun.EventUp
+	return t
+}
+
+func (t *channelTun) File() *os.File {
+	return nil
+}
+
+// Read is called by wireguard to collect packets bound for peers
+func (t *channelTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, os.ErrClosed
+	case p := <-t.toPeers:
+		sizes[0] = copy(bufs[0][offset:], p)
+		return 1, nil
+	}
+}
+
+// Write is called by wireguard with packets decrypted from peers
+func (t *channelTun) Write(bufs [][]byte, offset int) (int, error) {
+	for i, b := range bufs {
+		p := make([]byte, len(b)-offset)
+		copy(p, b[offset:])
+
+		select {
+		case <-t.closed:
+			return i, os.ErrClosed
+		case t.fromPeers <- p:
+		default:
+			// Drop rather than stall wireguard when nebula is not keeping up, the same as a full tun queue would
+		}
+	}
+	return len(bufs), nil
+}
+
+func (t *channelTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *channelTun) Name() (string, error) {
+	return "nebula-wg", nil
+}
+
+func (t *channelTun) Events() <-chan tun.Event {
+	return t.events
+}
+
+func (t *channelTun) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.events)
+	})
+	return nil
+}
+
+func (t *channelTun) BatchSize() int {
+	return 1
+}
@@ -0,0 +1,163 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/config"
+)
+
+// The whois endpoint lets local processes ask who is behind an overlay address, so a service can make authorization
+// decisions from the name and groups in the certificate the peer presented to us instead of trusting its source
+// address alone. It is served over http on a unix socket, access is controlled with the socket's file permissions.
+//
+//	GET /whois?addr=10.42.0.9
+//	GET /whois?addr=10.42.0.9:51234
+//
+// Only addresses from a peer's certificate are answered, an address behind a peer's unsafe_routes belongs to some
+// other host the peer routes for and returns a 404 like an address we have no tunnel to.
+
+// WhoisResponse is the identity of the host behind an overlay address
+type WhoisResponse struct {
+	VpnAddrs       []netip.Addr   `json:"vpnAddrs"`
+	Name           string         `json:"name"`
+	Groups         []string       `json:"groups"`
+	Networks       []netip.Prefix `json:"networks"`
+	UnsafeNetworks []netip.Prefix `json:"unsafeNetworks"`
+	Issuer         string         `json:"issuer"`
+	Fingerprint    string         `json:"fingerprint"`
+	NotAfter       time.Time      `json:"notAfter"`
+	// Self is true when the address is one of ours
+	Self bool `json:"self"`
+}
+
+type whois struct {
+	l *logrus.Logger
+	f *Interface
+}
+
+func newWhoisFromConfig(l *logrus.Logger, c *config.C, f *Interface) (func(context.Context), error) {
+	if !c.GetBool("whois.enabled", false) {
+		return nil, nil
+	}
+
+	listen := c.GetString("whois.listen", "")
+	if listen == "" {
+		return nil, errors.New("whois.listen must be the path of a unix socket")
+	}
+
+	mode, err := strconv.ParseUint(c.GetString("whois.mode", "0660"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("whois.mode must be octal file permissions: %w", err)
+	}
+
+	w := &whois{l: l, f: f}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whois", w.handle)
+	return func(ctx context.Context) {
+		w.serve(ctx, listen, os.FileMode(mode), mux)
+	}, nil
+}
+
+func (w *whois) serve(ctx context.Context, listen string, mode os.FileMode, mux *http.ServeMux) {
+	// A socket left behind by a nebula that did not shut down cleanly would stop us from listening
+	if fi, err := os.Lstat(listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(listen)
+	}
+
+	ln, err := net.Listen("unix", listen)
+	if err != nil {
+		w.l.WithError(err).WithField("listen", listen).Error("Failed to start the whois listener")
+		return
+	}
+
+	if err := os.Chmod(listen, mode); err != nil {
+		w.l.WithError(err).WithField("listen", listen).Error("Failed to set the whois socket permissions")
+		_ = ln.Close()
+		return
+	}
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	w.l.WithField("listen", listen).Info("Whois endpoint listening")
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		w.l.WithError(err).Error("Whois listener stopped")
+	}
+}
+
+func (w *whois) handle(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	raw := r.URL.Query().Get("addr")
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		ap, apErr := netip.ParseAddrPort(raw)
+		if apErr != nil {
+			http.Error(rw, fmt.Sprintf("addr must be an ip address or ip:port, got %q", raw), http.StatusBadRequest)
+			return
+		}
+		addr = ap.Addr()
+	}
+
+	res, ok := w.f.whois(addr.Unmap())
+	if !ok {
+		http.Error(rw, fmt.Sprintf("no tunnel to %s", addr), http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+// whois returns the identity behind addr, we must have an established tunnel to it or it must be ours
+func (f *Interface) whois(addr netip.Addr) (WhoisResponse, bool) {
+	cs := f.pki.getCertState()
+	if cs.myVpnAddrsTable.Contains(addr) {
+		res := newWhoisResponse(cs.GetDefaultCertificate(), cs.myVpnAddrs, "")
+		res.Self = true
+		return res, true
+	}
+
+	h := f.hostMap.QueryVpnAddr(addr)
+	if h == nil || h.ConnectionState == nil || h.ConnectionState.peerCert == nil {
+		return WhoisResponse{}, false
+	}
+
+	peer := h.ConnectionState.peerCert
+	return newWhoisResponse(peer.Certificate, h.vpnAddrs, peer.Fingerprint), true
+}
+
+func newWhoisResponse(c cert.Certificate, vpnAddrs []netip.Addr, fingerprint string) WhoisResponse {
+	if fingerprint == "" {
+		fingerprint, _ = c.Fingerprint()
+	}
+
+	return WhoisResponse{
+		VpnAddrs:       vpnAddrs,
+		Name:           c.Name(),
+		Groups:         c.Groups(),
+		Networks:       c.Networks(),
+		UnsafeNetworks: c.UnsafeNetworks(),
+		Issuer:         c.Issuer(),
+		Fingerprint:    fingerprint,
+		NotAfter:       c.NotAfter(),
+	}
+}
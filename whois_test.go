@@ -0,0 +1,82 @@
+package nebula
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gaissmai/bart"
+	"github.com/slackhq/nebula/cert"
+	"github.com/slackhq/nebula/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhois(t *testing.T) {
+	l := test.NewLogger()
+	hostMap := newHostMap(l)
+	myAddr := netip.MustParseAddr("10.42.0.1")
+	myAddrs := new(bart.Lite)
+	myAddrs.Insert(netip.PrefixFrom(myAddr, myAddr.BitLen()))
+
+	ifce := &Interface{hostMap: hostMap, pki: &PKI{}, l: l}
+	ifce.pki.cs.Store(&CertState{
+		initiatingVersion: cert.Version1,
+		v1Cert:            &dummyCert{name: "me", groups: []string{"servers"}},
+		myVpnAddrs:        []netip.Addr{myAddr},
+		myVpnAddrsTable:   myAddrs,
+	})
+
+	peerAddr := netip.MustParseAddr("10.42.0.9")
+	hostMap.unlockedAddHostInfo(&HostInfo{
+		vpnAddrs:     []netip.Addr{peerAddr},
+		localIndexId: 1,
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.CachedCertificate{
+				Certificate: &dummyCert{name: "laptop", groups: []string{"eng", "admin"}, issuer: "ca"},
+				Fingerprint: "abc",
+			},
+		},
+	}, ifce)
+
+	w := &whois{l: l, f: ifce}
+	get := func(method, addr string) (int, WhoisResponse) {
+		rec := httptest.NewRecorder()
+		w.handle(rec, httptest.NewRequest(method, "/whois?addr="+addr, nil))
+		var res WhoisResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		}
+		return rec.Code, res
+	}
+
+	code, res := get(http.MethodGet, "10.42.0.9")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "laptop", res.Name)
+	assert.Equal(t, []string{"eng", "admin"}, res.Groups)
+	assert.Equal(t, []netip.Addr{peerAddr}, res.VpnAddrs)
+	assert.Equal(t, "abc", res.Fingerprint)
+	assert.Equal(t, "ca", res.Issuer)
+	assert.False(t, res.Self)
+
+	// Applications usually have the remote address of a connection
+	code, res = get(http.MethodGet, "10.42.0.9:51234")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "laptop", res.Name)
+
+	code, res = get(http.MethodGet, "10.42.0.1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "me", res.Name)
+	assert.True(t, res.Self)
+
+	code, _ = get(http.MethodGet, "10.42.0.10")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = get(http.MethodGet, "laptop")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = get(http.MethodPost, "10.42.0.9")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
@@ -0,0 +1,153 @@
+//go:build linux || darwin || freebsd || openbsd || windows
+
+package nebula
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+	"github.com/slackhq/nebula/firewall"
+	"github.com/slackhq/nebula/wggateway"
+)
+
+// wireguardGateway bridges wireguard peers into the overlay. Each peer uses an address from an unsafe network of this
+// host, traffic from peers is treated as if it came from our tun device and traffic to them is diverted after the
+// inbound firewall.
+type wireguardGateway struct {
+	l  *logrus.Logger
+	f  *Interface
+	gw atomic.Pointer[wggateway.Gateway]
+
+	configLock sync.Mutex
+	config     *wggateway.Config
+}
+
+func newWireguardGatewayFromConfig(l *logrus.Logger, c *config.C, cs *CertState) (*wireguardGateway, error) {
+	gc, err := wggateway.NewConfigFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if gc == nil {
+		return nil, nil
+	}
+
+	w := &wireguardGateway{l: l, config: gc}
+	w.checkPeers(cs, gc)
+	c.RegisterReloadCallback(func(c *config.C) {
+		w.reload(c, cs)
+	})
+
+	return w, nil
+}
+
+func (w *wireguardGateway) checkPeers(cs *CertState, gc *wggateway.Config) {
+	for _, p := range gc.Peers {
+		if !cs.unsafeNetworksContain(netip.PrefixFrom(p.Addr, p.Addr.BitLen())) {
+			w.l.WithField("peer", p.Name).WithField("vpnAddr", p.Addr).
+				Warn("wireguard_gateway peer address is not within the unsafe networks of this hosts certificate, its traffic will be dropped")
+		}
+	}
+}
+
+func (w *wireguardGateway) reload(c *config.C, cs *CertState) {
+	if !c.HasChanged("wireguard_gateway") {
+		return
+	}
+
+	gc, err := wggateway.NewConfigFromConfig(c)
+	if err != nil {
+		w.l.WithError(err).Error("Failed to reload wireguard_gateway")
+		return
+	}
+
+	if gc == nil {
+		w.l.Warn("wireguard_gateway can not be disabled without a restart")
+		return
+	}
+
+	if gw := w.gw.Load(); gw != nil {
+		if err := gw.Reconfigure(gc); err != nil {
+			w.l.WithError(err).Error("Failed to reload wireguard_gateway")
+			return
+		}
+	}
+
+	w.checkPeers(cs, gc)
+
+	w.configLock.Lock()
+	w.config = gc
+	w.configLock.Unlock()
+
+	w.l.WithField("peers", len(gc.Peers)).Info("wireguard_gateway peers reloaded")
+	w.f.rebuildFirewall(c)
+}
+
+// Start brings up the wireguard device and feeds packets from peers into the overlay until the context is canceled
+func (w *wireguardGateway) Start(ctx context.Context) {
+	w.configLock.Lock()
+	gc := w.config
+	w.configLock.Unlock()
+
+	gw, err := wggateway.New(w.l, gc)
+	if err != nil {
+		w.l.WithError(err).Error("Failed to start the wireguard gateway")
+		return
+	}
+	w.gw.Store(gw)
+
+	go func() {
+		<-ctx.Done()
+		gw.Close()
+	}()
+
+	w.l.WithField("port", gc.ListenPort).WithField("peers", len(gc.Peers)).Info("Wireguard gateway listening")
+
+	packet := make([]byte, mtu)
+	out := make([]byte, mtu)
+	fwPacket := &firewall.Packet{}
+	nb := make([]byte, 12, 12)
+	conntrackCache := firewall.NewConntrackCacheTicker(w.f.conntrackCacheTimeout)
+
+	for {
+		n, err := gw.Read(packet)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.l.WithError(err).Error("Error while reading wireguard packet")
+			}
+			return
+		}
+
+		w.f.consumeInsidePacket(packet[:n], fwPacket, nb, out, 0, conntrackCache.Get(w.l))
+	}
+}
+
+// deliver hands a packet that passed the inbound firewall to the wireguard peer that owns addr, if any
+func (w *wireguardGateway) deliver(addr netip.Addr, packet []byte) bool {
+	gw := w.gw.Load()
+	if gw == nil {
+		return false
+	}
+	return gw.Deliver(addr, packet)
+}
+
+// addFirewallRules allows inbound traffic to each peer from hosts holding one of its groups
+func (w *wireguardGateway) addFirewallRules(fw FirewallInterface) error {
+	w.configLock.Lock()
+	defer w.configLock.Unlock()
+
+	for _, p := range w.config.Peers {
+		if err := addLocalGroupRules(fw, p.Addr, p.Groups); err != nil {
+			return fmt.Errorf("failed to add firewall rule for wireguard peer %s: %w", p.Name, err)
+		}
+	}
+
+	return nil
+}
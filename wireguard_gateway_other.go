@@ -0,0 +1,34 @@
+//go:build !(linux || darwin || freebsd || openbsd || windows)
+
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/config"
+)
+
+// wireguardGateway is not available here, wireguard-go does not support this platform
+type wireguardGateway struct {
+	f *Interface
+}
+
+func newWireguardGatewayFromConfig(_ *logrus.Logger, c *config.C, _ *CertState) (*wireguardGateway, error) {
+	if c.GetBool("wireguard_gateway.enabled", false) {
+		return nil, errors.New("wireguard_gateway is not supported on this platform")
+	}
+	return nil, nil
+}
+
+func (w *wireguardGateway) Start(_ context.Context) {}
+
+func (w *wireguardGateway) deliver(_ netip.Addr, _ []byte) bool {
+	return false
+}
+
+func (w *wireguardGateway) addFirewallRules(_ FirewallInterface) error {
+	return nil
+}